@@ -4,10 +4,15 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"os"
+	"path"
 	"runtime"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/buger/goreplay/size"
@@ -22,13 +27,20 @@ type Handler func(gopacket.Packet)
 // PcapOptions options that can be set on a pcap capture handle,
 // these options take effect on inactive pcap handles
 type PcapOptions struct {
-	BufferTimeout time.Duration `json:"input-raw-buffer-timeout"`
-	TimestampType string        `json:"input-raw-timestamp-type"`
-	BPFFilter     string        `json:"input-raw-bpf-filter"`
-	BufferSize    size.Size     `json:"input-raw-buffer-size"`
-	Promiscuous   bool          `json:"input-raw-promisc"`
-	Monitor       bool          `json:"input-raw-monitor"`
-	Snaplen       bool          `json:"input-raw-override-snaplen"`
+	BufferTimeout    time.Duration    `json:"input-raw-buffer-timeout"`
+	TimestampType    string           `json:"input-raw-timestamp-type"`
+	BPFFilter        string           `json:"input-raw-bpf-filter"`
+	BPFFilterAppend  bool             `json:"input-raw-bpf-filter-append"`    // BPFFilter is and'ed with the generated filter
+	InterfaceFilters InterfaceFilters `json:"input-raw-interface-bpf-filter"` // replace BPFFilter on their interfaces
+	BufferSize       size.Size        `json:"input-raw-buffer-size"`
+	Promiscuous      bool             `json:"input-raw-promisc"`
+	Monitor          bool             `json:"input-raw-monitor"`
+	Snaplen          bool             `json:"input-raw-override-snaplen"`
+	BlockSize        size.Size        `json:"input-raw-block-size"`       // size of the blocks of the af_packet_v3 ring
+	BlockTimeout     time.Duration    `json:"input-raw-block-timeout"`    // maximum time the kernel fills an af_packet_v3 block
+	Fanout           int              `json:"input-raw-fanout"`           // af_packet sockets per interface, the handler is called concurrently
+	ReplaySpeed      float64          `json:"input-raw-replay-speed"`     // pace of pcap files relative to their timestamps, 0 reads them at once
+	WatchInterfaces  time.Duration    `json:"input-raw-watch-interfaces"` // interval at which the interfaces appearing and disappearing are attached and detached
 }
 
 // NetInterface represents network interface
@@ -40,21 +52,30 @@ type NetInterface struct {
 // Listener handle traffic capture, this is its representation.
 type Listener struct {
 	sync.Mutex
-	Transport  string       // transport layer default to tcp
-	Activate   func() error // function is used to activate the engine. it must be called before reading packets
+	Transport  string                    // transport layer default to tcp
+	Activate   func() error              // function is used to activate the engine. it must be called before reading packets
+	Debugger   func(int, ...interface{}) // optional, reports the interfaces attached and detached while watching them
 	Handles    map[string]gopacket.PacketDataSource
 	Interfaces []NetInterface
 	loopIndex  int
 	Reading    chan bool // this channel is closed when the listener has started reading packets
 	PcapOptions
 	Engine        EngineType
-	port          uint16 // src or/and dst port
+	Tunnels       []string  // tunnels(vxlan, gre, geneve, ipip, erspan or gtp) whose packets pass the automatic filter
+	Sample        [2]uint32 // when Sample[1] is not 0, the automatic filter keeps Sample[0] connections out of Sample[1]
+	port          uint16    // src or/and dst port
 	trackResponse bool
 
-	host string // pcap file name or interface (name, hardware addr, index or ip address)
+	host string // pcap file name or interfaces (comma separated names, hardware addrs, indexes or ip addresses)
 
 	quit    chan bool
 	packets chan gopacket.Packet
+	stats   map[string]CaptureStats // statistics accumulated for handles reporting them since their last call
+
+	open     func(NetInterface) (map[string]gopacket.PacketDataSource, error) // opens the handles of an interface
+	watching bool                                                             // the interfaces are watched, see PcapOptions.WatchInterfaces
+	readers  int                                                              // goroutines reading handles, packets is closed once they are all done
+	netns    int                                                              // network namespace the interfaces are watched in
 }
 
 // EngineType ...
@@ -65,6 +86,8 @@ const (
 	EnginePcap EngineType = 1 << iota
 	EnginePcapFile
 	EngineRawSocket
+	EngineAFPacketV3
+	EngineXDP
 )
 
 // Set is here so that EngineType can implement flag.Var
@@ -76,8 +99,18 @@ func (eng *EngineType) Set(v string) error {
 		*eng = EnginePcapFile
 	case "raw_socket", "af_packet":
 		*eng = EngineRawSocket
+	case "af_packet_v3":
+		*eng = EngineAFPacketV3
+	case "af_xdp":
+		*eng = EngineXDP
 	default:
-		return fmt.Errorf("invalid engine %s", v)
+		engines.RLock()
+		e, ok := engines.byName[v]
+		engines.RUnlock()
+		if !ok {
+			return fmt.Errorf("invalid engine %s", v)
+		}
+		*eng = e
 	}
 	return nil
 }
@@ -90,8 +123,14 @@ func (eng *EngineType) String() (e string) {
 		e = "libpcap"
 	case EngineRawSocket:
 		e = "raw_socket"
+	case EngineAFPacketV3:
+		e = "af_packet_v3"
+	case EngineXDP:
+		e = "af_xdp"
 	default:
-		e = ""
+		if engine, ok := lookupEngine(*eng); ok {
+			e = engine.name
+		}
 	}
 	return e
 }
@@ -113,14 +152,23 @@ func NewListener(host string, port uint16, transport string, engine EngineType,
 	l.packets = make(chan gopacket.Packet, 1000)
 	l.quit = make(chan bool, 1)
 	l.Reading = make(chan bool, 1)
-	switch engine {
+	l.netns = -1
+	l.Activate = l.activate
+	registered, ok := lookupEngine(engine)
+	switch {
+	case ok:
+		l.Engine = engine
+		l.open = l.openEngine(registered)
 	default:
 		l.Engine = EnginePcap
-		l.Activate = l.activatePcap
-	case EngineRawSocket:
-		l.Engine = EngineRawSocket
-		l.Activate = l.activateRawSocket
-	case EnginePcapFile:
+		l.open = l.openPcap
+	case engine == EngineRawSocket, engine == EngineAFPacketV3:
+		l.Engine = engine
+		l.open = l.openRawSocket
+	case engine == EngineXDP:
+		l.Engine = EngineXDP
+		l.open = l.openXDP
+	case engine == EnginePcapFile:
 		l.Engine = EnginePcapFile
 		l.Activate = l.activatePcapFile
 		return
@@ -142,7 +190,7 @@ func (l *Listener) SetPcapOptions(opts PcapOptions) {
 // until the context done signal is sent or EOF on handles.
 // this function should be called after activating pcap handles
 func (l *Listener) Listen(ctx context.Context, handler Handler) (err error) {
-	l.read()
+	l.read(handler)
 	done := ctx.Done()
 	var p gopacket.Packet
 	var ok bool
@@ -177,6 +225,16 @@ func (l *Listener) ListenBackground(ctx context.Context, handler Handler) chan e
 	return err
 }
 
+// Port returns the port the listener captures, 0 for all the ports
+func (l *Listener) Port() uint16 {
+	return l.port
+}
+
+// TrackResponse reports whether the responses sent from the port are captured too
+func (l *Listener) TrackResponse() bool {
+	return l.trackResponse
+}
+
 // Filter returns automatic filter applied by goreplay
 // to a pcap handle of a specific interface
 func (l *Listener) Filter(ifi NetInterface) (filter string) {
@@ -190,14 +248,132 @@ func (l *Listener) Filter(ifi NetInterface) (filter string) {
 	if l.trackResponse {
 		dir = " "
 	}
-	filter = fmt.Sprintf("(%s%s%s)", l.Transport, dir, port)
-	if listenAll(l.host) || isDevice(l.host, ifi) {
+	filter = fmt.Sprintf("(%s%s%s%s or %s)", l.Transport, dir, port, l.sampleFilter(), fragments)
+	if host := l.hostFilter(ifi); host != "" {
+		filter = fmt.Sprintf("(%s and host %s)", filter, host)
+	}
+	// the ports of encapsulated packets are not at fixed offsets, all the tunnel packets are captured
+	for _, tunnel := range l.Tunnels {
+		if t, ok := tunnelFilters[tunnel]; ok {
+			filter = fmt.Sprintf("(%s or %s)", filter, t)
+		}
+	}
+	// the vlan keyword shifts the offsets of the rest of the filter, one and two 802.1Q tags are matched.
+	// the linux cooked headers of the any interface have no vlan support
+	if ifi.Name == "any" {
 		return
 	}
-	filter = fmt.Sprintf("(%s%s%s and host %s)", l.Transport, dir, port, l.host)
+	filter = fmt.Sprintf("(%s or (vlan and (%s or (vlan and %s))))", filter, filter, filter)
 	return
 }
 
+// hostFilter returns the address the filter of the interface is restricted to, the host
+// is empty, an ip address, or a comma separated list of interfaces and ip addresses
+func (l *Listener) hostFilter(ifi NetInterface) string {
+	if listenAll(l.host) {
+		return ""
+	}
+	hosts := strings.Split(l.host, ",")
+	for i, host := range hosts {
+		hosts[i] = strings.TrimSpace(host)
+		if isDevice(hosts[i], ifi) {
+			return ""
+		}
+	}
+	if len(hosts) == 1 {
+		return l.host
+	}
+	for _, host := range hosts {
+		for _, ip := range ifi.IPs {
+			if ip == host {
+				return host
+			}
+		}
+	}
+	return ""
+}
+
+// bpfFilter returns the filter of the handles of the interface: the generated filter, PcapOptions.BPFFilter
+// in its place, or both of them if PcapOptions.BPFFilterAppend is set
+func (l *Listener) bpfFilter(ifi NetInterface) string {
+	custom := l.BPFFilter
+	if f, ok := l.InterfaceFilters.lookup(ifi); ok {
+		custom = f
+	}
+	if custom == "" {
+		return l.Filter(ifi)
+	}
+	if l.BPFFilterAppend {
+		// the custom expression comes first, the vlan keywords of the generated filter would shift its offsets
+		return fmt.Sprintf("((%s) and %s)", custom, l.Filter(ifi))
+	}
+	if custom[0] != '(' || custom[len(custom)-1] != ')' {
+		return "(" + custom + ")"
+	}
+	return custom
+}
+
+// InterfaceFilters are the custom BPF filters of interfaces, keyed by their name, index or hardware address
+type InterfaceFilters map[string]string
+
+// Set is here so that InterfaceFilters can implement flag.Var, v is "interface=expression"
+func (filters *InterfaceFilters) Set(v string) error {
+	i := strings.IndexByte(v, '=')
+	if i < 1 || strings.TrimSpace(v[i+1:]) == "" {
+		return fmt.Errorf("invalid interface filter %q, expected interface=expression", v)
+	}
+	if *filters == nil {
+		*filters = make(InterfaceFilters)
+	}
+	(*filters)[strings.TrimSpace(v[:i])] = strings.TrimSpace(v[i+1:])
+	return nil
+}
+
+func (filters *InterfaceFilters) String() string {
+	var s []string
+	for name, filter := range *filters {
+		s = append(s, name+"="+filter)
+	}
+	sort.Strings(s)
+	return strings.Join(s, ", ")
+}
+
+func (filters InterfaceFilters) lookup(ifi NetInterface) (string, bool) {
+	for name, filter := range filters {
+		if isDevice(name, ifi) {
+			return filter, true
+		}
+	}
+	return "", false
+}
+
+// sampleFilter keeps the connections whose sum of the 32 bits words of the addresses and of the ports
+// modulo Sample[1] is below Sample[0], like tcp.Sampling. fragments and tunnels are sampled by the tcp pool,
+// and so are IPv6 packets with extension headers.
+func (l *Listener) sampleFilter() string {
+	if l.Sample[1] == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" and ((ip and (ip[12:4] + ip[16:4] + %[1]s[0:2] + %[1]s[2:2]) %% %[2]d < %[3]d)"+
+		" or (ip6 and (ip6[8:4] + ip6[12:4] + ip6[16:4] + ip6[20:4] + ip6[24:4] + ip6[28:4] + ip6[32:4] + ip6[36:4]"+
+		" + ip6[40:2] + ip6[42:2]) %% %[2]d < %[3]d))", l.Transport, l.Sample[1], l.Sample[0])
+}
+
+// tunnelFilters matches the outer headers of tunnels
+var tunnelFilters = map[string]string{
+	"vxlan":  "udp port 4789",
+	"gre":    "ip proto 47 or ip6 proto 47",
+	"geneve": "udp port 6081",
+	"ipip":   "ip proto 4 or ip proto 41 or ip6 proto 4 or ip6 proto 41",
+	"erspan": "ip proto 47 or ip6 proto 47",
+	"gtp":    "udp port 2152",
+}
+
+// fragments matches IPv4 fragments other than the first, they don't carry the transport header and must
+// pass the filter to reassemble datagrams. IPv6 packets with extension headers(hop-by-hop, routing, fragment
+// and destination options) pass too, the transport expressions only look for the header after the IPv6 one.
+const fragments = "ip[6:2] & 0x1fff != 0 or ip6[6] == 0 or ip6[6] == 43 or ip6[6] == 44 or ip6[6] == 60"
+
 // PcapDumpHandler returns a handler to write packet data in PCAP
 // format, See http://wiki.wireshark.org/Development/LibpcapFileFormathandler.
 // if link layer is invalid Ethernet is assumed
@@ -252,6 +428,10 @@ func (l *Listener) PcapHandle(ifi NetInterface) (handle *pcap.Handle, err error)
 		snap = 64<<10 + 200
 	} else if ifi.MTU > 0 {
 		snap = ifi.MTU + 200
+		// offloaded segments are captured before being split to the MTU
+		if snap < 64<<10+200 && Offloading(ifi.Name) {
+			snap = 64<<10 + 200
+		}
 	}
 	err = inactive.SetSnapLen(snap)
 	if err != nil {
@@ -274,157 +454,295 @@ func (l *Listener) PcapHandle(ifi NetInterface) (handle *pcap.Handle, err error)
 	if err != nil {
 		return nil, fmt.Errorf("PCAP Activate device error: %q, interface: %q", err, ifi.Name)
 	}
-	if l.BPFFilter != "" {
-		if l.BPFFilter[0] != '(' || l.BPFFilter[len(l.BPFFilter)-1] != ')' {
-			l.BPFFilter = "(" + l.BPFFilter + ")"
-		}
-	} else {
-		l.BPFFilter = l.Filter(ifi)
-	}
-	err = handle.SetBPFFilter(l.BPFFilter)
+	filter := l.bpfFilter(ifi)
+	err = handle.SetBPFFilter(filter)
 	if err != nil {
 		handle.Close()
-		return nil, fmt.Errorf("BPF filter error: %q%s, interface: %q", err, l.BPFFilter, ifi.Name)
+		return nil, fmt.Errorf("BPF filter error: %q%s, interface: %q", err, filter, ifi.Name)
 	}
 	return
 }
 
 // SocketHandle returns new unix ethernet handle associated with this listener settings
 func (l *Listener) SocketHandle(ifi NetInterface) (handle *SockRaw, err error) {
-	handle, err = NewSockRaw(ifi.Interface)
+	if l.Engine == EngineAFPacketV3 {
+		blockSize := l.BlockSize
+		if blockSize < 1 {
+			blockSize = V3BLOCKSIZE
+		}
+		handle, err = NewSockRawV3(ifi.Interface, int(blockSize), int(l.BufferSize/blockSize), l.BlockTimeout)
+	} else {
+		handle, err = NewSockRaw(ifi.Interface)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("sock raw error: %q, interface: %q", err, ifi.Name)
 	}
-	if err = handle.SetPromiscuous(l.Promiscuous || l.Monitor); err != nil {
-		return nil, fmt.Errorf("promiscuous mode error: %q, interface: %q", err, ifi.Name)
-	}
-	if l.BPFFilter != "" {
-		if l.BPFFilter[0] != '(' || l.BPFFilter[len(l.BPFFilter)-1] != ')' {
-			l.BPFFilter = "(" + l.BPFFilter + ")"
+	// the index of the any interface is 0, memberships can't be set on it
+	if ifi.Index != 0 {
+		if err = handle.SetPromiscuous(l.Promiscuous || l.Monitor); err != nil {
+			return nil, fmt.Errorf("promiscuous mode error: %q, interface: %q", err, ifi.Name)
 		}
-	} else {
-		l.BPFFilter = l.Filter(ifi)
 	}
-	if err = handle.SetBPFFilter(l.BPFFilter); err != nil {
+	filter := l.bpfFilter(ifi)
+	if err = handle.SetBPFFilter(filter); err != nil {
 		handle.Close()
-		return nil, fmt.Errorf("BPF filter error: %q%s, interface: %q", err, l.BPFFilter, ifi.Name)
+		return nil, fmt.Errorf("BPF filter error: %q%s, interface: %q", err, filter, ifi.Name)
 	}
 	handle.SetLoopbackIndex(int32(l.loopIndex))
 	return
 }
 
-func (l *Listener) read() {
+// XDPHandles returns the AF_XDP sockets of the receive queues of the interface, the packets to the
+// listener port are redirected to them by an XDP program. the BPF filter and the host are not applied.
+func (l *Listener) XDPHandles(ifi NetInterface) (handles []*SockXDP, err error) {
+	queues := RxQueues(ifi.Name)
+	prog, err := NewXDPProgram(ifi.Interface, queues, l.port, l.trackResponse)
+	if err != nil {
+		return nil, fmt.Errorf("%q, interface: %q", err, ifi.Name)
+	}
+	for q := 0; q < queues; q++ {
+		var handle *SockXDP
+		handle, err = prog.Socket(q, int(l.BufferSize/XDPFRAMESIZE))
+		if err != nil {
+			break
+		}
+		handles = append(handles, handle)
+	}
+	if err == nil {
+		err = prog.Attach()
+	}
+	if err != nil {
+		for _, handle := range handles {
+			handle.Close()
+		}
+		prog.Close()
+		return nil, fmt.Errorf("%q, interface: %q", err, ifi.Name)
+	}
+	return
+}
+
+// read reads the packets of the handles in their own goroutines, the packets are sent to Listen unless
+// the handles are in fanout groups: then handler is called by the goroutines of the handles to spread the load.
+func (l *Listener) read(handler Handler) {
 	l.Lock()
 	defer l.Unlock()
 	for key, handle := range l.Handles {
-		var source *gopacket.PacketSource
-		linkType := layers.LinkTypeEthernet
-		if _, ok := handle.(*pcap.Handle); ok {
-			linkType = handle.(*pcap.Handle).LinkType()
-		}
-		source = gopacket.NewPacketSource(handle, linkType)
-		source.Lazy = true
-		source.NoCopy = true
-		ch := source.Packets()
-		go func(key string) {
-			defer l.closeHandles(key)
-			for {
-				select {
-				case <-l.quit:
+		l.readHandle(key, handle, handler)
+	}
+	if l.watching {
+		go l.watch(handler)
+	}
+	l.Reading <- true
+	close(l.Reading)
+}
+
+// readHandle starts reading the packets of a handle, l must be locked
+func (l *Listener) readHandle(key string, handle gopacket.PacketDataSource, handler Handler) {
+	source := handle
+	var decoder gopacket.Decoder = layers.LinkTypeEthernet
+	if h, ok := handle.(interface{ LinkType() layers.LinkType }); ok {
+		decoder = h.LinkType()
+	}
+	// handles of several link types decode their packets themselves, e.g. FileReader
+	if h, ok := handle.(gopacket.Decoder); ok {
+		decoder = h
+	}
+	if l.Engine == EnginePcapFile && l.ReplaySpeed > 0 {
+		source = &pacedSource{PacketDataSource: handle, speed: l.ReplaySpeed, quit: l.quit}
+	}
+	packets := gopacket.NewPacketSource(source, decoder)
+	packets.Lazy = true
+	packets.NoCopy = true
+	ch := packets.Packets()
+	l.readers++
+	go func() {
+		defer l.doneReading()
+		defer l.closeHandle(key, handle)
+		for {
+			select {
+			case <-l.quit:
+				return
+			case p, ok := <-ch:
+				if !ok {
 					return
-				case p, ok := <-ch:
-					if !ok {
-						return
-					}
-					l.packets <- p
 				}
+				if l.Fanout > 1 && p != nil {
+					handler(p)
+					continue
+				}
+				l.packets <- p
 			}
-		}(key)
+		}
+	}()
+}
+
+// pacedSource delays the packets of a capture file by the time elapsed between them
+// in the capture divided by speed, packets without timestamp are not delayed
+type pacedSource struct {
+	gopacket.PacketDataSource
+	speed float64
+	quit  chan bool
+	first time.Time // timestamp of the first packet
+	start time.Time // wall clock time of the first packet
+}
+
+func (s *pacedSource) ReadPacketData() (data []byte, ci gopacket.CaptureInfo, err error) {
+	data, ci, err = s.PacketDataSource.ReadPacketData()
+	if err != nil || ci.Timestamp.IsZero() {
+		return
 	}
-	l.Reading <- true
-	close(l.Reading)
+	if s.first.IsZero() {
+		s.first, s.start = ci.Timestamp, time.Now()
+		return
+	}
+	due := s.start.Add(time.Duration(float64(ci.Timestamp.Sub(s.first)) / s.speed))
+	if wait := time.Until(due); wait > 0 {
+		select {
+		case <-time.After(wait):
+		case <-s.quit:
+			return nil, ci, io.EOF
+		}
+	}
+	return
 }
 
-func (l *Listener) closeHandles(key string) {
+// closeHandle closes the handle of key once it has been read, unless it has been detached meanwhile
+func (l *Listener) closeHandle(key string, handle gopacket.PacketDataSource) {
 	l.Lock()
 	defer l.Unlock()
-	if handle, ok := l.Handles[key]; ok {
+	if h, ok := l.Handles[key]; ok && h == handle {
 		if _, ok = handle.(interface{ Close() }); ok {
 			handle.(interface{ Close() }).Close()
 		}
 		delete(l.Handles, key)
-		if len(l.Handles) == 0 {
-			close(l.packets)
-		}
+		delete(l.stats, key)
 	}
 }
 
-func (l *Listener) activatePcap() error {
-	var e error
+// doneReading closes the packets channel once the last handle has been read, unless
+// the interfaces are watched: they may come back, see Listener.watch
+func (l *Listener) doneReading() {
+	l.Lock()
+	defer l.Unlock()
+	l.readers--
+	if l.readers == 0 && !l.watching {
+		close(l.packets)
+	}
+}
+
+// activate opens the handles of the interfaces, it fails if none of them could be opened
+// unless the interfaces are watched
+func (l *Listener) activate() error {
 	var msg string
 	for _, ifi := range l.Interfaces {
-		var handle *pcap.Handle
-		handle, e = l.PcapHandle(ifi)
+		handles, e := l.open(ifi)
 		if e != nil {
 			msg += ("\n" + e.Error())
-			continue
 		}
-		l.Handles[ifi.Name] = handle
+		for key, handle := range handles {
+			l.Handles[key] = handle
+		}
+	}
+	if l.WatchInterfaces > 0 {
+		if l.Engine == EngineXDP {
+			return fmt.Errorf("af_xdp handles can not be detached, interfaces can not be watched")
+		}
+		netns, e := currentNetns()
+		if e != nil {
+			return e
+		}
+		l.netns = netns
+		l.watching = true
+		return nil
+	}
+	if len(l.Interfaces) == 0 {
+		msg += "\nno interface matches " + l.host
 	}
 	if len(l.Handles) == 0 {
-		return fmt.Errorf("pcap handles error:%s", msg)
+		return fmt.Errorf("%s handles error:%s", l.Engine.String(), msg)
 	}
 	return nil
 }
 
-func (l *Listener) activateRawSocket() error {
-	if runtime.GOOS != "linux" {
-		return fmt.Errorf("sock_raw is not stabilized on OS other than linux")
+func (l *Listener) openPcap(ifi NetInterface) (map[string]gopacket.PacketDataSource, error) {
+	handle, err := l.PcapHandle(ifi)
+	if err != nil {
+		return nil, err
 	}
-	var msg string
-	var e error
-	for _, ifi := range l.Interfaces {
-		var handle *SockRaw
-		handle, e = l.SocketHandle(ifi)
-		if e != nil {
-			msg += ("\n" + e.Error())
-			continue
+	return map[string]gopacket.PacketDataSource{ifi.Name: handle}, nil
+}
+
+func (l *Listener) openRawSocket(ifi NetInterface) (map[string]gopacket.PacketDataSource, error) {
+	if runtime.GOOS != "linux" {
+		return nil, fmt.Errorf("sock_raw is not stabilized on OS other than linux")
+	}
+	handles := make(map[string]gopacket.PacketDataSource)
+	if l.Fanout > 1 {
+		var msg string
+		id := uint16(atomic.AddUint32(&fanoutID, 1))
+		for i := 0; i < l.Fanout; i++ {
+			handle, e := l.SocketHandle(ifi)
+			if e == nil {
+				if e = handle.SetFanout(id); e != nil {
+					handle.Close()
+					e = fmt.Errorf("fanout error: %q, interface: %q", e, ifi.Name)
+				}
+			}
+			if e != nil {
+				msg += ("\n" + e.Error())
+				continue
+			}
+			handles[fmt.Sprintf("%s:%d", ifi.Name, i)] = handle
 		}
-		l.Handles[ifi.Name] = handle
+		if msg != "" {
+			return handles, fmt.Errorf("%s", msg[1:])
+		}
+		return handles, nil
 	}
-	return e
+	handle, err := l.SocketHandle(ifi)
+	if err != nil {
+		return nil, err
+	}
+	handles[ifi.Name] = handle
+	return handles, nil
 }
 
+// fanoutID is the id of the last fanout group, the groups of different processes must not collide
+var fanoutID = uint32(os.Getpid())
+
 func (l *Listener) activatePcapFile() (err error) {
 	var handle *pcap.Handle
 	var e error
 	if handle, e = pcap.OpenOffline(l.host); e != nil {
 		return fmt.Errorf("open pcap file error: %q", e)
 	}
-	if l.BPFFilter != "" {
-		if l.BPFFilter[0] != '(' || l.BPFFilter[len(l.BPFFilter)-1] != ')' {
-			l.BPFFilter = "(" + l.BPFFilter + ")"
-		}
-	} else {
-		addr := l.host
-		l.host = ""
-		l.BPFFilter = l.Filter(NetInterface{})
-		l.host = addr
-	}
-	if e = handle.SetBPFFilter(l.BPFFilter); e != nil {
+	addr := l.host
+	l.host = ""
+	filter := l.bpfFilter(NetInterface{})
+	l.host = addr
+	if e = handle.SetBPFFilter(filter); e != nil {
 		handle.Close()
-		return fmt.Errorf("BPF filter error: %q, filter: %s", e, l.BPFFilter)
+		return fmt.Errorf("BPF filter error: %q, filter: %s", e, filter)
 	}
 	l.Handles["pcap_file"] = handle
 	return
 }
 
 func (l *Listener) setInterfaces() (err error) {
-	var Ifis []NetInterface
+	var ifis []NetInterface
+	if ifis, err = l.listInterfaces(); err != nil {
+		return
+	}
+	l.Interfaces, err = l.matchInterfaces(ifis)
+	return
+}
+
+// listInterfaces returns the interfaces that are up
+func (l *Listener) listInterfaces() (Ifis []NetInterface, err error) {
 	var ifis []net.Interface
 	ifis, err = net.Interfaces()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	for i := 0; i < len(ifis); i++ {
@@ -437,10 +755,7 @@ func (l *Listener) setInterfaces() (err error) {
 		var addrs []net.Addr
 		addrs, err = ifis[i].Addrs()
 		if err != nil {
-			return err
-		}
-		if len(addrs) == 0 {
-			continue
+			return nil, err
 		}
 		ifi := NetInterface{}
 		ifi.Interface = ifis[i]
@@ -450,29 +765,71 @@ func (l *Listener) setInterfaces() (err error) {
 		}
 		Ifis = append(Ifis, ifi)
 	}
+	return
+}
 
+// matchInterfaces returns the interfaces of the host among ifis, name patterns may match none of them
+func (l *Listener) matchInterfaces(Ifis []NetInterface) (matched []NetInterface, err error) {
 	if listenAll(l.host) {
-		l.Interfaces = Ifis
+		// the interfaces without address are left out, e.g. the bridged ends of veth pairs
+		for _, ifi := range Ifis {
+			if len(ifi.IPs) > 0 {
+				matched = append(matched, ifi)
+			}
+		}
 		return
 	}
-	found := false
-	for _, ifi := range Ifis {
-		if isDevice(l.host, ifi) {
-			found = true
+	if l.host == "any" {
+		// the pseudo interface of linux capturing on all interfaces, pcap handles yield linux cooked headers
+		ifi := NetInterface{Interface: net.Interface{Name: "any", Flags: net.FlagUp}}
+		for _, v := range Ifis {
+			if v.MTU > ifi.MTU {
+				ifi.MTU = v.MTU
+			}
+			ifi.IPs = append(ifi.IPs, v.IPs...)
 		}
-		for _, ip := range ifi.IPs {
-			if ip == l.host {
-				found = true
-				break
+		return []NetInterface{ifi}, nil
+	}
+	// several interfaces can be listed, separated with commas
+	for _, host := range strings.Split(l.host, ",") {
+		host = strings.TrimSpace(host)
+		var found []NetInterface
+		if isPattern(host) {
+			for _, ifi := range Ifis {
+				if isDevice(host, ifi) {
+					found = append(found, ifi)
+				}
+			}
+		} else if ifi, ok := findInterface(host, Ifis); ok {
+			found = append(found, ifi)
+		} else {
+			return nil, fmt.Errorf("can not find interface with addr, name or index %s", host)
+		}
+		for _, ifi := range found {
+			dup := false
+			for _, v := range matched {
+				dup = dup || v.Name == ifi.Name
+			}
+			if !dup {
+				matched = append(matched, ifi)
 			}
 		}
-		if found {
-			l.Interfaces = []NetInterface{ifi}
-			return
+	}
+	return
+}
+
+func findInterface(host string, ifis []NetInterface) (NetInterface, bool) {
+	for _, ifi := range ifis {
+		if isDevice(host, ifi) {
+			return ifi, true
+		}
+		for _, ip := range ifi.IPs {
+			if ip == host {
+				return ifi, true
+			}
 		}
 	}
-	err = fmt.Errorf("can not find interface with addr, name or index %s", l.host)
-	return err
+	return NetInterface{}, false
 }
 
 func cutMask(addr net.Addr) string {
@@ -486,9 +843,18 @@ func cutMask(addr net.Addr) string {
 }
 
 func isDevice(addr string, ifi NetInterface) bool {
+	if isPattern(addr) {
+		ok, _ := path.Match(addr, ifi.Name)
+		return ok
+	}
 	return addr == ifi.Name || addr == fmt.Sprintf("%d", ifi.Index) || addr == ifi.HardwareAddr.String()
 }
 
+// isPattern reports whether addr is a pattern of interface names, e.g. veth*
+func isPattern(addr string) bool {
+	return strings.ContainsAny(addr, "*?[") && net.ParseIP(strings.Trim(addr, "[]")) == nil
+}
+
 func listenAll(addr string) bool {
 	switch addr {
 	case "", "0.0.0.0", "[::]", "::":
@@ -496,3 +862,21 @@ func listenAll(addr string) bool {
 	}
 	return false
 }
+
+func (l *Listener) openXDP(ifi NetInterface) (map[string]gopacket.PacketDataSource, error) {
+	if runtime.GOOS != "linux" {
+		return nil, fmt.Errorf("af_xdp is only available on linux")
+	}
+	if l.Transport != "tcp" {
+		return nil, fmt.Errorf("af_xdp only captures tcp, not %s", l.Transport)
+	}
+	handles, err := l.XDPHandles(ifi)
+	if err != nil {
+		return nil, err
+	}
+	sources := make(map[string]gopacket.PacketDataSource)
+	for q, handle := range handles {
+		sources[fmt.Sprintf("%s:%d", ifi.Name, q)] = handle
+	}
+	return sources, nil
+}
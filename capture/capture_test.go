@@ -1,17 +1,35 @@
 package capture
 
 import (
+	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"debug/elf"
 	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"math/big"
 	"net"
 	"os"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
+	"unsafe"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcap"
+	"golang.org/x/sys/unix"
 )
 
 var LoopBack = func() net.Interface {
@@ -41,6 +59,23 @@ func TestSetInterfaces(t *testing.T) {
 	if len(l.Interfaces) < 1 {
 		t.Error("should get all interfaces")
 	}
+	l.host = LoopBack.Name + ", 127.0.0.1"
+	if err := l.setInterfaces(); err != nil || len(l.Interfaces) != 1 || l.Interfaces[0].Name != LoopBack.Name {
+		t.Errorf("expected the loop back interface once, got %v %v", l.Interfaces, err)
+	}
+	l.host = LoopBack.Name + ",unknown0"
+	if err := l.setInterfaces(); err == nil {
+		t.Errorf("expected an error for an unknown interface, got %v", l.Interfaces)
+	}
+	l.host = LoopBack.Name[:1] + "*,unknown*"
+	if err := l.setInterfaces(); err != nil || len(l.Interfaces) < 1 || l.hostFilter(l.Interfaces[0]) != "" {
+		t.Errorf("expected the interfaces matching the pattern, got %v %v", l.Interfaces, err)
+	}
+	l.host = "any"
+	l.setInterfaces()
+	if len(l.Interfaces) != 1 || l.Interfaces[0].Name != "any" || l.Interfaces[0].Index != 0 || len(l.Interfaces[0].IPs) == 0 {
+		t.Errorf("expected the any interface, got %v", l.Interfaces)
+	}
 }
 
 func TestBPFFilter(t *testing.T) {
@@ -49,14 +84,98 @@ func TestBPFFilter(t *testing.T) {
 	l.Transport = "tcp"
 	l.setInterfaces()
 	filter := l.Filter(l.Interfaces[0])
-	if filter != "(tcp dst portrange 0-65535 and host 127.0.0.1)" {
+	f := "((tcp dst portrange 0-65535 or ip[6:2] & 0x1fff != 0 or ip6[6] == 0 or ip6[6] == 43 or ip6[6] == 44 or ip6[6] == 60) and host 127.0.0.1)"
+	if filter != fmt.Sprintf("(%s or (vlan and (%s or (vlan and %s))))", f, f, f) {
 		t.Error("wrong filter", filter)
 	}
 	l.port = 8000
 	l.trackResponse = true
 	filter = l.Filter(l.Interfaces[0])
-	if filter != "(tcp port 8000 and host 127.0.0.1)" {
-		t.Error("wrong filter")
+	f = "((tcp port 8000 or ip[6:2] & 0x1fff != 0 or ip6[6] == 0 or ip6[6] == 43 or ip6[6] == 44 or ip6[6] == 60) and host 127.0.0.1)"
+	if filter != fmt.Sprintf("(%s or (vlan and (%s or (vlan and %s))))", f, f, f) {
+		t.Error("wrong filter", filter)
+	}
+	l.Tunnels = []string{"vxlan", "ipip"}
+	filter = l.Filter(l.Interfaces[0])
+	f = "((" + f + " or udp port 4789) or ip proto 4 or ip proto 41 or ip6 proto 4 or ip6 proto 41)"
+	if filter != fmt.Sprintf("(%s or (vlan and (%s or (vlan and %s))))", f, f, f) {
+		t.Error("wrong filter", filter)
+	}
+	l.host = "any"
+	l.setInterfaces()
+	if filter = l.Filter(l.Interfaces[0]); filter != "(((tcp port 8000 or ip[6:2] & 0x1fff != 0 or ip6[6] == 0 or ip6[6] == 43 or ip6[6] == 44 or ip6[6] == 60) or udp port 4789) or ip proto 4 or ip proto 41 or ip6 proto 4 or ip6 proto 41)" {
+		t.Error("wrong filter", filter)
+	}
+	l.Transport = "sctp"
+	if filter = l.Filter(l.Interfaces[0]); !strings.HasPrefix(filter, "(((sctp port 8000 or ") {
+		t.Error("wrong filter", filter)
+	}
+	if _, err := l.openXDP(l.Interfaces[0]); err == nil {
+		t.Error("expected af_xdp to refuse sctp")
+	}
+	l.Transport = "tcp"
+	l.Sample = [2]uint32{1, 10}
+	f = "(tcp port 8000 and ((ip and (ip[12:4] + ip[16:4] + tcp[0:2] + tcp[2:2]) % 10 < 1) or (ip6 and (ip6[8:4] + ip6[12:4] + ip6[16:4] + ip6[20:4]" +
+		" + ip6[24:4] + ip6[28:4] + ip6[32:4] + ip6[36:4] + ip6[40:2] + ip6[42:2]) % 10 < 1)) or ip[6:2] & 0x1fff != 0 or ip6[6] == 0 or ip6[6] == 43 or ip6[6] == 44 or ip6[6] == 60)"
+	if filter = l.Filter(l.Interfaces[0]); !strings.HasPrefix(filter, "(("+f) {
+		t.Error("wrong filter", filter)
+	}
+	l.Sample = [2]uint32{}
+	l.BPFFilter = "dst port 80"
+	if filter = l.bpfFilter(l.Interfaces[0]); filter != "(dst port 80)" {
+		t.Error("wrong filter", filter)
+	}
+	l.BPFFilterAppend = true
+	if filter = l.bpfFilter(l.Interfaces[0]); filter != "((dst port 80) and "+l.Filter(l.Interfaces[0])+")" {
+		t.Error("wrong filter", filter)
+	}
+	var filters InterfaceFilters
+	if filters.Set("eth0") == nil || filters.Set("eth0=") == nil {
+		t.Error("expected an error for a filter without expression")
+	}
+	if err := filters.Set("lo = vlan 100"); err != nil || filters.String() != "lo=vlan 100" {
+		t.Errorf("expected lo=vlan 100, got %s %v", filters.String(), err)
+	}
+	l.InterfaceFilters = filters
+	lo := NetInterface{Interface: net.Interface{Name: "lo"}}
+	if filter = l.bpfFilter(lo); filter != "((vlan 100) and "+l.Filter(lo)+")" {
+		t.Error("wrong filter", filter)
+	}
+	l.BPFFilterAppend = false
+	if filter = l.bpfFilter(lo); filter != "(vlan 100)" {
+		t.Error("wrong filter", filter)
+	}
+	if filter = l.bpfFilter(NetInterface{Interface: net.Interface{Name: "eth1"}}); filter != "(dst port 80)" {
+		t.Error("wrong filter", filter)
+	}
+	l.host = "lo,10.0.0.1"
+	if filter = l.Filter(NetInterface{Interface: net.Interface{Name: "eth1"}, IPs: []string{"10.0.0.1"}}); !strings.Contains(filter, "((tcp port 8000 or ip[6:2] & 0x1fff != 0 or ip6[6] == 0 or ip6[6] == 43 or ip6[6] == 44 or ip6[6] == 60) and host 10.0.0.1)") {
+		t.Error("wrong filter", filter)
+	}
+	if filter = l.Filter(lo); strings.Contains(filter, "host") {
+		t.Error("wrong filter", filter)
+	}
+}
+
+func TestLinuxSLL2(t *testing.T) {
+	data := make([]byte, 20+len(generateHeaders(0, 0))-4)
+	binary.BigEndian.PutUint16(data[0:], uint16(layers.EthernetTypeIPv4))
+	binary.BigEndian.PutUint32(data[4:], 1)
+	binary.BigEndian.PutUint16(data[8:], 772)
+	data[10] = byte(layers.LinuxSLLPacketTypeOutgoing)
+	data[11] = 6
+	h := generateHeaders(0, 0)
+	copy(data[20:], h[4:])
+	packet := gopacket.NewPacket(data, LinkTypeLinuxSLL2, gopacket.Default)
+	if err := packet.ErrorLayer(); err != nil {
+		t.Fatal(err.Error())
+	}
+	sll, ok := packet.LinkLayer().(*layers.LinuxSLL)
+	if !ok || sll.PacketType != layers.LinuxSLLPacketTypeOutgoing || sll.EthernetType != layers.EthernetTypeIPv4 || len(sll.Addr) != 6 {
+		t.Fatalf("expected a linux cooked v2 link layer, got %#v", packet.LinkLayer())
+	}
+	if _, ok = packet.NetworkLayer().(*layers.IPv4); !ok || packet.Layer(layers.LayerTypeTCP) == nil {
+		t.Errorf("expected ipv4 and tcp layers, got %v", packet.Layers())
 	}
 }
 
@@ -204,6 +323,217 @@ func TestSocketHandler(t *testing.T) {
 	}
 }
 
+func TestSocketHandlerV3(t *testing.T) {
+	l, err := NewListener(LoopBack.Name, 8000, "", EngineAFPacketV3, true)
+	if err != nil {
+		t.Errorf("expected error to be nil, got %v", err)
+		return
+	}
+	l.BlockSize = 1 << 16
+	l.BufferSize = 1 << 18
+	err = l.Activate()
+	if err != nil {
+		t.Errorf("expected error to be nil, got %v", err)
+		return
+	}
+	defer l.Handles[LoopBack.Name].(*SockRaw).Close()
+	for i := 0; i < 5; i++ {
+		_, _ = net.Dial("tcp", "127.0.0.1:8000")
+	}
+	sts, _ := l.Handles[LoopBack.Name].(*SockRaw).Stats()
+	if sts.Packets < 5 {
+		t.Errorf("expected >=5 packets got %d", sts.Packets)
+	}
+}
+
+func TestListenerStats(t *testing.T) {
+	sock, err := NewSockRaw(LoopBack)
+	if err != nil {
+		t.Skipf("af_packet socket error: %v", err)
+	}
+	l := &Listener{Handles: map[string]gopacket.PacketDataSource{LoopBack.Name: sock}}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	for i := 0; i < 5; i++ {
+		if conn, err := net.Dial("tcp", ln.Addr().String()); err == nil {
+			conn.Close()
+		}
+	}
+	first := l.Stats()[LoopBack.Name]
+	if first.Received < 5 {
+		t.Errorf("expected >=5 packets got %d", first.Received)
+	}
+
+	// a read waiting for packets must not hold the statistics back
+	read := make(chan bool)
+	go func() {
+		for {
+			if _, _, err := sock.ReadPacketData(); err != nil {
+				close(read)
+				return
+			}
+		}
+	}()
+	done := make(chan CaptureStats)
+	go func() {
+		done <- l.Stats()[LoopBack.Name]
+	}()
+	select {
+	case second := <-done:
+		if second.Received < first.Received {
+			t.Errorf("expected the statistics to accumulate, got %d after %d", second.Received, first.Received)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("statistics blocked by the read")
+	}
+	// the read returns once the socket is closed and a packet wakes it up
+	go sock.Close()
+	for i := 0; i < 100; i++ {
+		if conn, err := net.Dial("tcp", ln.Addr().String()); err == nil {
+			conn.Close()
+		}
+		select {
+		case <-read:
+			i = 100
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	sock.Close()
+	if st, ok := l.Stats()[LoopBack.Name]; ok {
+		t.Errorf("expected no statistics of a closed socket, got %+v", st)
+	}
+}
+
+func TestSocketFanout(t *testing.T) {
+	id := uint16(atomic.AddUint32(&fanoutID, 1))
+	var socks []*SockRaw
+	for i := 0; i < 2; i++ {
+		sock, err := NewSockRaw(LoopBack)
+		if err != nil {
+			t.Skipf("can not open a raw socket: %v", err)
+		}
+		defer sock.Close()
+		if err = sock.SetFanout(id); err != nil {
+			t.Fatalf("expected to join fanout group %d, got %v", id, err)
+		}
+		if arg, err := unix.GetsockoptInt(sock.fd, unix.SOL_PACKET, unix.PACKET_FANOUT); err != nil || uint16(arg) != id {
+			t.Errorf("expected fanout group %d, got %d %v", id, uint16(arg), err)
+		}
+		socks = append(socks, sock)
+	}
+	for i := 0; i < 5; i++ {
+		_, _ = net.Dial("tcp", "127.0.0.1:8000")
+	}
+	var packets uint32
+	for _, sock := range socks {
+		sts, _ := sock.Stats()
+		packets += sts.Packets
+	}
+	if packets < 5 {
+		t.Errorf("expected >=5 packets got %d", packets)
+	}
+}
+
+func TestXDPHandler(t *testing.T) {
+	l, err := NewListener(LoopBack.Name, 8001, "", EngineXDP, true)
+	if err != nil {
+		t.Errorf("expected error to be nil, got %v", err)
+		return
+	}
+	l.BufferSize = 1 << 20
+	err = l.Activate()
+	if err != nil {
+		t.Errorf("expected error to be nil, got %v", err)
+		return
+	}
+	handle := l.Handles[LoopBack.Name+":0"].(*SockXDP)
+	defer handle.Close()
+	handle.SetTimeout(time.Second)
+	// the syn is redirected to the socket, it never reaches the network stack
+	go net.DialTimeout("tcp", "127.0.0.1:8001", time.Second)
+	data, ci, err := handle.ReadPacketData()
+	if err != nil {
+		t.Errorf("expected error to be nil, got %v", err)
+		return
+	}
+	pckt := gopacket.NewPacket(data, layers.LinkTypeEthernet, gopacket.Default)
+	tcp, ok := pckt.TransportLayer().(*layers.TCP)
+	if !ok || tcp.DstPort != 8001 || !tcp.SYN || ci.CaptureLength != len(data) {
+		t.Errorf("expected a syn to port 8001, got %s", pckt)
+	}
+
+	// the extension headers of ipv6 packets are walked
+	dialer := net.Dialer{Timeout: time.Second, Control: func(network, address string, c syscall.RawConn) error {
+		return c.Control(func(fd uintptr) {
+			hbh := string([]byte{0, 0, 1, 4, 0, 0, 0, 0})
+			unix.SetsockoptString(int(fd), unix.IPPROTO_IPV6, unix.IPV6_HOPOPTS, hbh)
+		})
+	}}
+	go dialer.Dial("tcp", "[::1]:8001")
+	if data, _, err = handle.ReadPacketData(); err != nil {
+		t.Skipf("no ipv6 packet, got %v", err)
+	}
+	pckt = gopacket.NewPacket(data, layers.LinkTypeEthernet, gopacket.Default)
+	ip6, _ := pckt.NetworkLayer().(*layers.IPv6)
+	tcp, ok = pckt.TransportLayer().(*layers.TCP)
+	if ip6 == nil || ip6.HopByHop == nil || !ok || tcp.DstPort != 8001 {
+		t.Errorf("expected an ipv6 syn with hop-by-hop options to port 8001, got %s", pckt)
+	}
+}
+
+type testEngine struct{ port uint16 }
+
+type testSource struct{ closed bool }
+
+func (s *testSource) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	return nil, gopacket.CaptureInfo{}, io.EOF
+}
+
+func (s *testSource) Close() { s.closed = true }
+
+func (e *testEngine) Open(l *Listener, ifi NetInterface) (gopacket.PacketDataSource, error) {
+	e.port = l.Port()
+	return &testSource{}, nil
+}
+
+var engineTest = &testEngine{}
+
+var EngineTest = RegisterEngine("test", engineTest)
+
+func TestRegisterEngine(t *testing.T) {
+	var eng EngineType
+	if err := eng.Set("test"); err != nil || eng != EngineTest || eng.String() != "test" {
+		t.Errorf("expected test engine, got %d %q %v", eng, eng.String(), err)
+	}
+	l, err := NewListener(LoopBack.Name, 8000, "", EngineTest, false)
+	if err != nil {
+		t.Errorf("expected error to be nil, got %v", err)
+		return
+	}
+	if err = l.Activate(); err != nil {
+		t.Errorf("expected error to be nil, got %v", err)
+		return
+	}
+	src, ok := l.Handles[LoopBack.Name].(*testSource)
+	if l.Engine != EngineTest || !ok || engineTest.port != 8000 {
+		t.Errorf("expected the source of the test engine, got %v %T", l.Engine, l.Handles[LoopBack.Name])
+		return
+	}
+	l.closeHandle(LoopBack.Name, src)
+	if !src.closed {
+		t.Error("expected the source to be closed")
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("expected registering a builtin engine name to panic")
+		}
+	}()
+	RegisterEngine("af_packet", engineTest)
+}
+
 func BenchmarkPcapDump(b *testing.B) {
 	f, err := ioutil.TempFile("", "pcap_file")
 	if err != nil {
@@ -305,3 +635,476 @@ func BenchmarkRawSocket(b *testing.B) {
 	sts, _ := l.Handles[LoopBack.Name].(*SockRaw).Stats()
 	b.Logf("%d packets in %s", sts.Packets, time.Since(now))
 }
+
+func TestWithNetns(t *testing.T) {
+	if path, err := NetnsPath("1"); err != nil || path != "/proc/1/ns/net" {
+		t.Errorf("expected the namespace of pid 1, got %q %v", path, err)
+	}
+	if _, err := NetnsPath("unknown"); err == nil {
+		t.Error("expected an error for an unknown namespace")
+	}
+	// a new namespace, the thread that created it is terminated with its goroutine
+	fds := make(chan int)
+	go func() {
+		runtime.LockOSThread()
+		if unix.Unshare(unix.CLONE_NEWNET) != nil {
+			fds <- -1
+			return
+		}
+		fd, _ := currentNetns()
+		fds <- fd
+	}()
+	fd := <-fds
+	if fd < 0 {
+		t.Skip("can not create a network namespace")
+	}
+	defer unix.Close(fd)
+	var inside []net.Interface
+	err := WithNetns(fmt.Sprintf("/proc/self/fd/%d", fd), func() (err error) {
+		inside, err = net.Interfaces()
+		return
+	})
+	if err != nil || len(inside) != 1 || inside[0].Flags&net.FlagLoopback == 0 {
+		t.Errorf("expected a single loop back interface in the namespace, got %v %v", inside, err)
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	current, err := currentNetns()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(current)
+	var st, nst unix.Stat_t
+	unix.Fstat(current, &st)
+	unix.Fstat(fd, &nst)
+	if st.Ino == nst.Ino {
+		t.Error("expected to get back to the original namespace")
+	}
+}
+
+// blockingSource is read until it is closed
+type blockingSource struct{ closed chan bool }
+
+func (s *blockingSource) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	<-s.closed
+	return nil, gopacket.CaptureInfo{}, io.EOF
+}
+
+func (s *blockingSource) Close() { close(s.closed) }
+
+type blockingEngine struct{}
+
+func (blockingEngine) Open(l *Listener, ifi NetInterface) (gopacket.PacketDataSource, error) {
+	return &blockingSource{make(chan bool)}, nil
+}
+
+var EngineBlocking = RegisterEngine("test_blocking", blockingEngine{})
+
+// setLinkUp sets the interface up or down with SIOCSIFFLAGS
+func setLinkUp(name string, up bool) error {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	var ifr [40]byte
+	copy(ifr[:unix.IFNAMSIZ-1], name)
+	flags := uint16(unix.IFF_UP)
+	if !up {
+		flags = 0
+	}
+	*(*uint16)(unsafe.Pointer(&ifr[unix.IFNAMSIZ])) = flags
+	_, _, e := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), unix.SIOCSIFFLAGS, uintptr(unsafe.Pointer(&ifr[0])))
+	if e != 0 {
+		return e
+	}
+	return nil
+}
+
+func TestWatchInterfaces(t *testing.T) {
+	// a new namespace whose loop back interface is down
+	fds := make(chan int)
+	go func() {
+		runtime.LockOSThread()
+		if unix.Unshare(unix.CLONE_NEWNET) != nil {
+			fds <- -1
+			return
+		}
+		fd, _ := currentNetns()
+		fds <- fd
+	}()
+	fd := <-fds
+	if fd < 0 {
+		t.Skip("can not create a network namespace")
+	}
+	defer unix.Close(fd)
+	ns := fmt.Sprintf("/proc/self/fd/%d", fd)
+	var l *Listener
+	err := WithNetns(ns, func() (err error) {
+		if l, err = NewListener("l*", 8000, "", EngineBlocking, false); err != nil {
+			return
+		}
+		l.WatchInterfaces = 10 * time.Millisecond
+		return l.Activate()
+	})
+	if err != nil || len(l.Handles) != 0 {
+		t.Fatalf("expected no handle, got %v %v", l.Handles, err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := l.ListenBackground(ctx, func(gopacket.Packet) {})
+	<-l.Reading
+	handle := func() *blockingSource {
+		l.Lock()
+		defer l.Unlock()
+		h, _ := l.Handles["lo"].(*blockingSource)
+		return h
+	}
+	waitFor := func(cond func() bool) bool {
+		for i := 0; i < 200 && !cond(); i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		return cond()
+	}
+
+	if err = WithNetns(ns, func() error { return setLinkUp("lo", true) }); err != nil {
+		t.Fatal(err)
+	}
+	if !waitFor(func() bool { return handle() != nil }) {
+		t.Fatal("expected the interface to be attached")
+	}
+	src := handle()
+	if err = WithNetns(ns, func() error { return setLinkUp("lo", false) }); err != nil {
+		t.Fatal(err)
+	}
+	closed := func() bool {
+		select {
+		case <-src.closed:
+			return true
+		default:
+			return false
+		}
+	}
+	if !waitFor(func() bool { return handle() == nil && closed() }) {
+		t.Fatal("expected the interface to be detached")
+	}
+
+	cancel()
+	select {
+	case <-errCh:
+	case <-time.After(time.Second):
+		t.Error("expected the listener to stop")
+	}
+}
+
+func ngBlock(t uint32, body ...[]byte) []byte {
+	var data []byte
+	for _, b := range body {
+		data = append(data, b...)
+	}
+	for len(data)%4 != 0 {
+		data = append(data, 0)
+	}
+	block := make([]byte, 8, len(data)+12)
+	binary.LittleEndian.PutUint32(block[0:], t)
+	binary.LittleEndian.PutUint32(block[4:], uint32(len(data)+12))
+	block = append(block, data...)
+	return append(block, le32(uint32(len(data)+12))...)
+}
+
+func le32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, v)
+	return b
+}
+
+func ngOption(code uint16, value []byte) []byte {
+	opt := le32(uint32(code) | uint32(len(value))<<16)
+	opt = append(opt, value...)
+	for len(opt)%4 != 0 {
+		opt = append(opt, 0)
+	}
+	return opt
+}
+
+func ngPacket(id uint32, ts uint64, data []byte, options ...[]byte) []byte {
+	var header []byte
+	for _, v := range []uint32{id, uint32(ts >> 32), uint32(ts), uint32(len(data)), uint32(len(data))} {
+		header = append(header, le32(v)...)
+	}
+	for len(data)%4 != 0 {
+		data = append(data[:len(data):len(data)], 0)
+	}
+	return ngBlock(ngBlockEnhancedPacket, append([][]byte{header, data}, options...)...)
+}
+
+func TestFileReader(t *testing.T) {
+	h := generateHeaders(0, 0)
+	ip := h[4:]
+	eth := append([]byte{0, 1, 2, 3, 4, 5, 0, 1, 2, 3, 4, 6, 8, 0}, ip...)
+	sll := append([]byte{0, 4, 0, 1, 0, 6, 0, 1, 2, 3, 4, 5, 0, 0, 8, 0}, ip...)
+	var file []byte
+	file = append(file, ngBlock(ngBlockSectionHeader, []byte{0x4d, 0x3c, 0x2b, 0x1a, 1, 0, 0, 0}, bytes.Repeat([]byte{0xff}, 8))...)
+	file = append(file, ngBlock(ngBlockInterfaceDescriptor, []byte{1, 0, 0, 0, 0, 0, 1, 0}, ngOption(ngOptionInterfaceName, []byte("eth0")), ngOption(ngOptionInterfaceTSResol, []byte{9}))...)
+	file = append(file, ngBlock(ngBlockInterfaceDescriptor, []byte{113, 0, 0, 0, 0, 0, 1, 0}, ngOption(ngOptionInterfaceName, []byte("any")))...)
+	file = append(file, ngPacket(0, 1500000000123456789, eth, ngOption(ngOptionComment, []byte("first packet")))...)
+	file = append(file, ngBlock(0xbad, []byte{1, 2, 3, 4})...)
+	file = append(file, ngPacket(1, 1500000000123456, sll)...)
+	r, err := NewFileReader(bytes.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ifis := r.Interfaces(); len(ifis) != 2 || ifis[0].Name != "eth0" || ifis[0].LinkType != layers.LinkTypeEthernet || ifis[1].Name != "any" || ifis[1].LinkType != layers.LinkTypeLinuxSLL {
+		t.Fatalf("expected interfaces eth0 and any, got %v", ifis)
+	}
+	source := gopacket.NewPacketSource(r, r)
+	for i, expected := range []time.Time{time.Unix(1500000000, 123456789), time.Unix(1500000000, 123456000)} {
+		packet, err := source.NextPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		md := packet.Metadata()
+		if md.InterfaceIndex != i || !md.Timestamp.Equal(expected) || packet.Layer(layers.LayerTypeTCP) == nil {
+			t.Errorf("expected a tcp packet of interface %d at %s, got %d %s %v", i, expected, md.InterfaceIndex, md.Timestamp, packet.Layers())
+		}
+		if (i == 0) != (len(md.AncillaryData) == 1 && md.AncillaryData[0] == "first packet") {
+			t.Errorf("unexpected comments %v", md.AncillaryData)
+		}
+	}
+	if _, err = source.NextPacket(); err != io.EOF {
+		t.Errorf("expected EOF, got %v", err)
+	}
+
+	var buf bytes.Buffer
+	w := NewWriterNanos(&buf)
+	w.WriteFileHeader(65536, layers.LinkTypeEthernet)
+	w.WritePacket(gopacket.CaptureInfo{Timestamp: time.Unix(1500000000, 5), CaptureLength: len(eth), Length: len(eth)}, eth)
+	if r, err = NewFileReader(&buf); err != nil {
+		t.Fatal(err)
+	}
+	data, ci, err := r.ReadPacketData()
+	if err != nil || !bytes.Equal(data, eth) || !ci.Timestamp.Equal(time.Unix(1500000000, 5)) || r.LinkType() != layers.LinkTypeEthernet {
+		t.Errorf("expected the written packet, got %v %v %v", ci, err, r.LinkType())
+	}
+	if _, err = NewFileReader(bytes.NewReader([]byte("1 abc 123 4\n"))); err == nil {
+		t.Error("expected an error for a goreplay file")
+	}
+}
+
+func TestPacedSource(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriterNanos(&buf)
+	w.WriteFileHeader(65536, layers.LinkTypeEthernet)
+	start := time.Unix(1500000000, 0)
+	for _, d := range []time.Duration{0, 100 * time.Millisecond, 200 * time.Millisecond, time.Hour} {
+		w.WritePacket(gopacket.CaptureInfo{Timestamp: start.Add(d), CaptureLength: 4, Length: 4}, []byte{1, 2, 3, 4})
+	}
+	r, err := NewFileReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := &pacedSource{PacketDataSource: r, speed: 2, quit: make(chan bool)}
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if _, _, err = src.ReadPacketData(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(now); elapsed < 100*time.Millisecond || elapsed > time.Second {
+		t.Errorf("expected the packets to be read in 100ms, got %s", elapsed)
+	}
+	close(src.quit)
+	if _, _, err = src.ReadPacketData(); err != io.EOF {
+		t.Errorf("expected EOF once the listener quits, got %v", err)
+	}
+}
+
+func TestGoReturnsCode(t *testing.T) {
+	for _, tt := range []struct {
+		code string
+		rets []uint64
+	}{
+		{"4883ec18" + "c3" + "e800000000" + "c3", []uint64{4, 10}},   // sub rsp, 0x18; ret; call rel32; ret
+		{"488b4c2408" + "66660f1f840000000000" + "c3", []uint64{15}}, // mov rcx, [rsp+8]; nop word [rax+rax]; ret
+		{"c5fe6f00" + "c3", []uint64{4}},                             // vmovdqu ymm0, [rax]; ret
+		{"4889e5", nil},                                              // mov rbp, rsp, no return
+		{"62f1fe486f00" + "c3", nil},                                 // vmovdqu64 zmm0, [rax], unsupported
+		{"06", nil},                                                  // push es, invalid
+	} {
+		code, _ := hex.DecodeString(tt.code)
+		rets, err := goReturns(code, "amd64")
+		if (err != nil) != (tt.rets == nil) || !reflect.DeepEqual(rets, tt.rets) {
+			t.Errorf("%s: expected %v, got %v, %v", tt.code, tt.rets, rets, err)
+		}
+	}
+	if _, err := goReturns([]byte{0xc0, 0x03, 0x5f, 0xd6}, "riscv64"); err == nil {
+		t.Error("expected riscv64 to be unsupported")
+	}
+}
+
+func TestGoSymbols(t *testing.T) {
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := elf.Open(exe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	// test binaries are not PIE, the addresses of the functions are the ones of the file
+	for name, fn := range map[string]interface{}{
+		"crypto/tls.(*Conn).Write": (*tls.Conn).Write,
+		"crypto/tls.(*Conn).Read":  (*tls.Conn).Read,
+	} {
+		syms := goSymbols(f, name)
+		if want := uint64(reflect.ValueOf(fn).Pointer()); syms[name].Value != want {
+			t.Errorf("expected %s at %#x, got %#x", name, want, syms[name].Value)
+		}
+	}
+}
+
+func TestGoReturns(t *testing.T) {
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := elf.Open(exe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	// the symbols of test binaries are stripped
+	var names []string
+	for _, name := range []string{"Read", "Write", "readRecordOrCCS", "handshakeContext", "writeRecordLocked"} {
+		names = append(names, "crypto/tls.(*Conn)."+name)
+	}
+	syms := goSymbols(f, names...)
+	if len(syms) != len(names) {
+		t.Fatalf("expected the symbols of %v, got %v", names, syms)
+	}
+	for _, sym := range syms {
+		offset, err := symbolOffset(f, sym.Value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		code := make([]byte, sym.Size)
+		if err = readAt(exe, code, int64(offset)); err != nil {
+			t.Fatal(err)
+		}
+		rets, err := goReturns(code, runtime.GOARCH)
+		if err != nil {
+			t.Errorf("%s: %v", sym.Name, err)
+		}
+		for _, ret := range rets {
+			if runtime.GOARCH == "amd64" && code[ret] != 0xc3 {
+				t.Errorf("%s: no return at %#x", sym.Name, ret)
+			}
+		}
+	}
+	if _, err = goReturns([]byte{0x06}, "amd64"); err == nil {
+		t.Error("expected an error decoding an invalid instruction")
+	}
+}
+
+func TestProcNetAddr(t *testing.T) {
+	var ipv4, ipv6 string
+	if nativeEndian == binary.LittleEndian {
+		ipv4, ipv6 = "0100007F:1F90", "00000000000000000000000001000000:01BB"
+	} else {
+		ipv4, ipv6 = "7F000001:1F90", "00000000000000000000000000000001:01BB"
+	}
+	if addr, err := procNetAddr(ipv4); err != nil || addr != "127.0.0.1:8080" {
+		t.Errorf("expected 127.0.0.1:8080, got %q %v", addr, err)
+	}
+	if addr, err := procNetAddr(ipv6); err != nil || addr != "[::1]:443" {
+		t.Errorf("expected [::1]:443, got %q %v", addr, err)
+	}
+}
+
+// TestUprobes traces the crypto/tls functions of the test binary
+func TestUprobes(t *testing.T) {
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := NewUprobes(exe)
+	if err != nil {
+		t.Skipf("can not attach uprobes: %v", err)
+	}
+	const request = "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"
+	events := make(chan UprobeEvent, 100)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- u.Listen(ctx, func(ev UprobeEvent) { events <- ev })
+	}()
+	defer func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	}()
+
+	ln, err := tls.Listen("tcp4", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{testCert(t)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	// the sockets are looked up once the events are received, the connection is kept open until then
+	release := make(chan struct{})
+	defer close(release)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.ReadFull(conn, make([]byte, len(request)))
+		<-release
+	}()
+	conn, err := tls.Dial("tcp4", ln.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte(request)); err != nil {
+		t.Fatal(err)
+	}
+
+	var written, read bool
+	for !written || !read {
+		select {
+		case ev := <-events:
+			if ev.Pid != os.Getpid() || string(ev.Data) != request {
+				continue
+			}
+			if ev.Read {
+				read = true
+				if ev.Local != ln.Addr().String() || ev.Remote != conn.LocalAddr().String() {
+					t.Errorf("expected the read from %s to %s, got %s to %s", conn.LocalAddr(), ln.Addr(), ev.Remote, ev.Local)
+				}
+			} else {
+				written = true
+				if ev.Local != conn.LocalAddr().String() || ev.Remote != ln.Addr().String() {
+					t.Errorf("expected the write from %s to %s, got %s to %s", conn.LocalAddr(), ln.Addr(), ev.Local, ev.Remote)
+				}
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected the request to be written and read, written: %v, read: %v", written, read)
+		}
+	}
+}
+
+// testCert returns a self-signed certificate
+func testCert(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{SerialNumber: big.NewInt(1), NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
@@ -4,6 +4,24 @@ it allows you to listen for traffic from any port (e.g. sniffing) because they o
 Ports is TCP/IP feature, same as flow control, reliable transmission and etc.
 Currently this package implements TCP layer: flow control is managed under tcp package.
 BPF filters can also be applied.
+EngineAFPacketV3 reads packets from a block based AF_PACKET ring (TPACKET_V3), its blocks are sized
+with PcapOptions.BlockSize and PcapOptions.BlockTimeout, and their number with PcapOptions.BufferSize.
+with PcapOptions.Fanout, the AF_PACKET engines open several sockets per interface in a fanout group, the packets
+are spread among them by flow and each socket calls the handler from its own goroutine.
+EngineXDP attaches an XDP program to the interface that redirects the tcp packets of the port to AF_XDP
+sockets, one per receive queue(linux 5.4 and above). the redirected packets never reach the network stack,
+so it is meant for mirror ports. the BPF filter is not applied, and PcapOptions.BufferSize sizes the umem of each queue.
+other engines, e.g. PF_RING ZC or DPDK, can be plugged with RegisterEngine, and selected by name with EngineType.Set.
+EnginePFRing is available when built with the pfring tag, it needs the PF_RING kernel module and links against libpfring.
+the host "any" captures on all the interfaces of linux, pcap handles yield linux cooked headers(LinkTypeLinuxSLL
+and LinkTypeLinuxSLL2) that tell the direction of the packets.
+several interfaces can be listed in the host, separated with commas, and PcapOptions.InterfaceFilters
+sets the BPF filter of each of them.
+WithNetns activates listeners in other network namespaces, e.g. the one of a container.
+FileReader reads pcap and pcapng files without libpcap, including pcapng files with interfaces of several link types.
+
+NewUprobes(paths...) attaches eBPF uprobes to the OpenSSL libraries and Go programs at paths, its Listen(ctx, handler)
+passes the data read and written on TLS connections before their encryption, no key is needed.
 
 example:
 
@@ -87,7 +87,11 @@ func (w *Writer) WriteFileHeader(snaplen uint32, linktype layers.LinkType) error
 	// bytes 12:16 stay 0 (sigfigs is always set to zero, according to
 	//   http://wiki.wireshark.org/Development/LibpcapFileFormat
 	binary.LittleEndian.PutUint32(buf[16:20], snaplen)
-	binary.LittleEndian.PutUint32(buf[20:24], uint32(linktype))
+	if linktype == LinkTypeLinuxSLL2 {
+		binary.LittleEndian.PutUint32(buf[20:24], dltLinuxSLL2)
+	} else {
+		binary.LittleEndian.PutUint32(buf[20:24], uint32(linktype))
+	}
 	_, err := w.w.Write(buf[:])
 	return err
 }
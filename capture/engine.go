@@ -0,0 +1,88 @@
+package capture
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/google/gopacket"
+)
+
+// Engine is a capture engine that can be plugged into a listener, e.g. PF_RING ZC or DPDK poll-mode drivers.
+// the packet sources it opens must return ethernet frames, unless they implement
+// interface{ LinkType() layers.LinkType }, and are closed with their Close method if they have one.
+type Engine interface {
+	// Open returns the packet source capturing on the interface with the settings of the listener,
+	// see Listener.Port, Listener.TrackResponse, Listener.Filter and Listener.PcapOptions.
+	Open(l *Listener, ifi NetInterface) (gopacket.PacketDataSource, error)
+}
+
+// EngineCustom is the type of the first registered engine, the following ones are numbered from it
+const EngineCustom EngineType = 1 << 6
+
+var engines = struct {
+	sync.RWMutex
+	next   EngineType
+	byName map[string]EngineType
+	byType map[EngineType]registeredEngine
+}{
+	next:   EngineCustom,
+	byName: make(map[string]EngineType),
+	byType: make(map[EngineType]registeredEngine),
+}
+
+type registeredEngine struct {
+	name string
+	Engine
+}
+
+// RegisterEngine registers engine under name, so that it can be selected with EngineType.Set(name).
+// it returns the type of the engine, and panics if name is already in use or if too many engines are registered.
+// it is meant to be called from the init function of the package providing the engine.
+func RegisterEngine(name string, engine Engine) EngineType {
+	var eng EngineType
+	if name == "" || eng.Set(name) == nil {
+		panic(fmt.Sprintf("capture: engine %q is already registered", name))
+	}
+	engines.Lock()
+	defer engines.Unlock()
+	if _, ok := engines.byName[name]; ok {
+		panic(fmt.Sprintf("capture: engine %q is already registered", name))
+	}
+	if engines.next == 0 {
+		panic("capture: too many engines registered")
+	}
+	eng = engines.next
+	engines.next++
+	engines.byName[name] = eng
+	engines.byType[eng] = registeredEngine{name, engine}
+	return eng
+}
+
+// EngineNames returns the names of the registered engines
+func EngineNames() (names []string) {
+	engines.RLock()
+	defer engines.RUnlock()
+	for name := range engines.byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
+
+func lookupEngine(eng EngineType) (registeredEngine, bool) {
+	engines.RLock()
+	defer engines.RUnlock()
+	e, ok := engines.byType[eng]
+	return e, ok
+}
+
+func (l *Listener) openEngine(engine Engine) func(NetInterface) (map[string]gopacket.PacketDataSource, error) {
+	return func(ifi NetInterface) (map[string]gopacket.PacketDataSource, error) {
+		handle, err := engine.Open(l, ifi)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]gopacket.PacketDataSource{ifi.Name: handle}, nil
+	}
+}
@@ -0,0 +1,101 @@
+package capture
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// NetnsPath returns the path of the network namespace ns, which is either a path, a name
+// given by "ip netns add", the pid of a process, or the id(or its prefix of 12 characters at least) of a container.
+func NetnsPath(ns string) (string, error) {
+	if strings.ContainsRune(ns, '/') {
+		return ns, nil
+	}
+	if _, err := strconv.Atoi(ns); err == nil {
+		return "/proc/" + ns + "/ns/net", nil
+	}
+	if _, err := os.Stat("/var/run/netns/" + ns); err == nil {
+		return "/var/run/netns/" + ns, nil
+	}
+	if pid := containerPid(ns); pid != "" {
+		return "/proc/" + pid + "/ns/net", nil
+	}
+	return "", fmt.Errorf("can not find network namespace, process or container %q", ns)
+}
+
+// containerPid returns the pid of a process whose cgroup is named after the container id,
+// which holds with docker, containerd and cri-o
+func containerPid(id string) string {
+	if len(id) < 12 || strings.Trim(strings.ToLower(id), "0123456789abcdef") != "" {
+		return ""
+	}
+	cgroups, _ := filepath.Glob("/proc/[0-9]*/cgroup")
+	for _, cgroup := range cgroups {
+		data, err := ioutil.ReadFile(cgroup)
+		if err == nil && strings.Contains(string(data), strings.ToLower(id)) {
+			return filepath.Base(filepath.Dir(cgroup))
+		}
+	}
+	return ""
+}
+
+// WithNetns calls f in the network namespace ns, see NetnsPath. the handles opened by f keep capturing
+// in the namespace. f runs on the calling goroutine and must not rely on others to open them.
+func WithNetns(ns string, f func() error) error {
+	if ns == "" {
+		return f()
+	}
+	path, err := NetnsPath(ns)
+	if err != nil {
+		return err
+	}
+	fd, err := unix.Open(path, unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("network namespace error: %q, namespace: %q", err, ns)
+	}
+	defer unix.Close(fd)
+	return withNetnsFd(fd, f)
+}
+
+func withNetnsFd(fd int, f func() error) error {
+	runtime.LockOSThread()
+	origin, err := currentNetns()
+	if err != nil {
+		runtime.UnlockOSThread()
+		return err
+	}
+	defer unix.Close(origin)
+	// setns requires CAP_SYS_ADMIN, even to stay in the same namespace
+	var st, cur unix.Stat_t
+	if unix.Fstat(fd, &st) == nil && unix.Fstat(origin, &cur) == nil && st.Dev == cur.Dev && st.Ino == cur.Ino {
+		runtime.UnlockOSThread()
+		return f()
+	}
+	if err = unix.Setns(fd, unix.CLONE_NEWNET); err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("setns error: %q", err)
+	}
+	defer func() {
+		// if the thread can't get back to its namespace, it stays locked and exits with the goroutine
+		if unix.Setns(origin, unix.CLONE_NEWNET) == nil {
+			runtime.UnlockOSThread()
+		}
+	}()
+	return f()
+}
+
+// currentNetns opens the network namespace of the calling thread
+func currentNetns() (int, error) {
+	fd, err := unix.Open("/proc/thread-self/ns/net", unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, fmt.Errorf("network namespace error: %q", err)
+	}
+	return fd, nil
+}
@@ -0,0 +1,408 @@
+package capture
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// pcap and pcapng magic numbers, see https://www.ietf.org/archive/id/draft-ietf-opsawg-pcapng-02.html
+const (
+	magicMicrosecondsBigendian = 0xD4C3B2A1
+	magicNanosecondsBigendian  = 0x4D3CB2A1
+	ngByteOrderMagic           = 0x1A2B3C4D
+)
+
+// pcapng block types and options
+const (
+	ngBlockSectionHeader        = 0x0A0D0D0A
+	ngBlockInterfaceDescriptor  = 1
+	ngBlockPacket               = 2
+	ngBlockSimplePacket         = 3
+	ngBlockEnhancedPacket       = 6
+	ngOptionComment             = 1
+	ngOptionInterfaceName       = 2
+	ngOptionInterfaceDesc       = 3
+	ngOptionInterfaceTSResol    = 9
+	ngOptionInterfaceTSOffset   = 14
+	ngDefaultResolution         = 6
+	ngMaxBlockSize              = 16 << 20
+	ngSectionHeaderMinBlockSize = 28
+)
+
+// IsCaptureFile reports whether magic, the first 4 bytes of a file, are the ones of a pcap or pcapng file
+func IsCaptureFile(magic []byte) bool {
+	if len(magic) < 4 {
+		return false
+	}
+	switch binary.LittleEndian.Uint32(magic) {
+	case magicMicroseconds, magicNanoseconds, magicMicrosecondsBigendian, magicNanosecondsBigendian, ngBlockSectionHeader:
+		return true
+	}
+	return false
+}
+
+// FileInterface is an interface of a capture file, pcap files have a single unnamed one
+type FileInterface struct {
+	Name        string
+	Description string
+	LinkType    layers.LinkType
+	Snaplen     uint32
+	resolution  byte  // if_tsresol, units of the timestamps
+	offset      int64 // if_tsoffset, seconds added to the timestamps
+}
+
+// FileReader reads the packets of pcap and pcapng files without libpcap, the files can be gzipped.
+// the interfaces of pcapng files can have different link types, and the packets are decoded with the one of their
+// interface by FileReader.Decode. CaptureInfo.InterfaceIndex is the index of the interface of the packet in
+// FileReader.Interfaces, and the comments of pcapng packets are added to CaptureInfo.AncillaryData as strings.
+type FileReader struct {
+	r          *bufio.Reader
+	closers    []io.Closer
+	order      binary.ByteOrder
+	ng         bool
+	interfaces []FileInterface
+	section    int             // index of the first interface of the current pcapng section
+	block      uint32          // type of the block in buf
+	link       layers.LinkType // link type of the last packet read
+	buf        []byte
+}
+
+// OpenFile opens the pcap or pcapng file name
+func OpenFile(name string) (*FileReader, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	r, err := NewFileReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	r.closers = append(r.closers, f)
+	return r, nil
+}
+
+// NewFileReader returns a reader of the pcap or pcapng data of r
+func NewFileReader(r io.Reader) (*FileReader, error) {
+	fr := &FileReader{r: bufio.NewReader(r)}
+	magic, err := fr.r.Peek(4)
+	if err != nil {
+		return nil, fmt.Errorf("capture file header error: %v", err)
+	}
+	if magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(fr.r)
+		if err != nil {
+			return nil, err
+		}
+		fr.closers = append(fr.closers, gz)
+		fr.r = bufio.NewReader(gz)
+		if magic, err = fr.r.Peek(4); err != nil {
+			return nil, fmt.Errorf("capture file header error: %v", err)
+		}
+	}
+	if !IsCaptureFile(magic) {
+		return nil, errors.New("not a pcap or pcapng file")
+	}
+	if binary.LittleEndian.Uint32(magic) == ngBlockSectionHeader {
+		fr.ng = true
+		// the first interfaces are described before the first packet
+		err = fr.readBlocks(false)
+	} else {
+		err = fr.readPcapHeader()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return fr, nil
+}
+
+func (r *FileReader) readPcapHeader() error {
+	var header [24]byte
+	if _, err := io.ReadFull(r.r, header[:]); err != nil {
+		return fmt.Errorf("pcap file header error: %v", err)
+	}
+	ifi := FileInterface{resolution: ngDefaultResolution}
+	switch binary.LittleEndian.Uint32(header[0:4]) {
+	case magicMicroseconds:
+		r.order = binary.LittleEndian
+	case magicNanoseconds:
+		r.order, ifi.resolution = binary.LittleEndian, 9
+	case magicMicrosecondsBigendian:
+		r.order = binary.BigEndian
+	case magicNanosecondsBigendian:
+		r.order, ifi.resolution = binary.BigEndian, 9
+	}
+	ifi.Snaplen = r.order.Uint32(header[16:20])
+	ifi.LinkType = linkType(r.order.Uint32(header[20:24]))
+	r.interfaces = []FileInterface{ifi}
+	r.link = ifi.LinkType
+	return nil
+}
+
+// ReadPacketData implements gopacket.PacketDataSource, it returns io.EOF at the end of the file
+func (r *FileReader) ReadPacketData() (data []byte, ci gopacket.CaptureInfo, err error) {
+	if r.ng {
+		if err = r.readBlocks(true); err != nil {
+			return
+		}
+		return r.readNgPacket()
+	}
+	var header [16]byte
+	if _, err = io.ReadFull(r.r, header[:]); err != nil {
+		return
+	}
+	ifi := r.interfaces[0]
+	ci.CaptureLength = int(r.order.Uint32(header[8:12]))
+	ci.Length = int(r.order.Uint32(header[12:16]))
+	if ci.CaptureLength > ngMaxBlockSize {
+		return nil, ci, fmt.Errorf("invalid pcap packet length %d", ci.CaptureLength)
+	}
+	ts := uint64(r.order.Uint32(header[0:4]))*ifi.units() + uint64(r.order.Uint32(header[4:8]))
+	ci.Timestamp = ifi.timestamp(ts)
+	data = make([]byte, ci.CaptureLength)
+	if _, err = io.ReadFull(r.r, data); err != nil {
+		return nil, ci, io.ErrUnexpectedEOF
+	}
+	return
+}
+
+// readBlocks reads the blocks of a pcapng file until the next packet block, which is left in r.buf.
+// if packet is false, it stops before the first packet block instead.
+func (r *FileReader) readBlocks(packet bool) error {
+	for {
+		if !packet {
+			header, err := r.r.Peek(4)
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("pcapng file error: %v", err)
+			}
+			if t := r.blockType(header); t == ngBlockPacket || t == ngBlockSimplePacket || t == ngBlockEnhancedPacket {
+				return nil
+			}
+		}
+		t, err := r.readBlock()
+		if err != nil {
+			return err
+		}
+		r.block = t
+		switch t {
+		case ngBlockSectionHeader:
+			r.section = len(r.interfaces)
+		case ngBlockInterfaceDescriptor:
+			if err = r.readInterface(); err != nil {
+				return err
+			}
+		case ngBlockPacket, ngBlockSimplePacket, ngBlockEnhancedPacket:
+			return nil
+		}
+	}
+}
+
+func (r *FileReader) blockType(header []byte) uint32 {
+	if r.order == nil {
+		return binary.LittleEndian.Uint32(header)
+	}
+	return r.order.Uint32(header)
+}
+
+// readBlock reads a block in r.buf, without its type, length and trailing length
+func (r *FileReader) readBlock() (t uint32, err error) {
+	var header [12]byte
+	if _, err = io.ReadFull(r.r, header[:8]); err != nil {
+		return
+	}
+	if binary.LittleEndian.Uint32(header[:4]) == ngBlockSectionHeader {
+		// the byte order of the section is given by the magic following the length
+		if _, err = io.ReadFull(r.r, header[8:12]); err != nil {
+			return 0, io.ErrUnexpectedEOF
+		}
+		switch {
+		case binary.LittleEndian.Uint32(header[8:12]) == ngByteOrderMagic:
+			r.order = binary.LittleEndian
+		case binary.BigEndian.Uint32(header[8:12]) == ngByteOrderMagic:
+			r.order = binary.BigEndian
+		default:
+			return 0, errors.New("invalid pcapng byte order magic")
+		}
+	}
+	t = r.order.Uint32(header[:4])
+	length := r.order.Uint32(header[4:8])
+	if length < 12 || length%4 != 0 || length > ngMaxBlockSize || t == ngBlockSectionHeader && length < ngSectionHeaderMinBlockSize {
+		return 0, fmt.Errorf("invalid pcapng block length %d", length)
+	}
+	body := int(length) - 12
+	if cap(r.buf) < body+4 {
+		r.buf = make([]byte, body+4)
+	}
+	r.buf = r.buf[:body+4]
+	if t == ngBlockSectionHeader {
+		copy(r.buf, header[8:12])
+		_, err = io.ReadFull(r.r, r.buf[4:])
+	} else {
+		_, err = io.ReadFull(r.r, r.buf)
+	}
+	if err != nil {
+		return 0, io.ErrUnexpectedEOF
+	}
+	r.buf = r.buf[:body]
+	return t, nil
+}
+
+func (r *FileReader) readInterface() error {
+	if len(r.buf) < 8 {
+		return errors.New("invalid pcapng interface description block")
+	}
+	ifi := FileInterface{
+		LinkType:   linkType(uint32(r.order.Uint16(r.buf[0:2]))),
+		Snaplen:    r.order.Uint32(r.buf[4:8]),
+		resolution: ngDefaultResolution,
+	}
+	r.options(r.buf[8:], func(code uint16, value []byte) {
+		switch {
+		case code == ngOptionInterfaceName:
+			ifi.Name = string(value)
+		case code == ngOptionInterfaceDesc:
+			ifi.Description = string(value)
+		case code == ngOptionInterfaceTSResol && len(value) == 1:
+			ifi.resolution = value[0]
+		case code == ngOptionInterfaceTSOffset && len(value) == 8:
+			ifi.offset = int64(r.order.Uint64(value))
+		}
+	})
+	r.interfaces = append(r.interfaces, ifi)
+	return nil
+}
+
+// options calls f with the options of a block
+func (r *FileReader) options(data []byte, f func(code uint16, value []byte)) {
+	for len(data) >= 4 {
+		code, length := r.order.Uint16(data[0:2]), int(r.order.Uint16(data[2:4]))
+		if code == 0 || len(data) < 4+length {
+			return
+		}
+		f(code, data[4:4+length])
+		data = data[4+(length+3)&^3:]
+	}
+}
+
+// readNgPacket returns the packet of the block in r.buf
+func (r *FileReader) readNgPacket() (data []byte, ci gopacket.CaptureInfo, err error) {
+	var id int
+	var options []byte
+	if r.block == ngBlockSimplePacket {
+		// simple packets belong to the first interface of the section, and have no timestamp
+		if len(r.buf) < 4 {
+			return nil, ci, errors.New("invalid pcapng simple packet block")
+		}
+		ci.Length = int(r.order.Uint32(r.buf[0:4]))
+		data = r.buf[4:]
+		ci.CaptureLength = len(data)
+		if ci.Length < ci.CaptureLength {
+			ci.CaptureLength = ci.Length
+		}
+	} else {
+		if len(r.buf) < 20 {
+			return nil, ci, errors.New("invalid pcapng packet block")
+		}
+		id = int(r.order.Uint32(r.buf[0:4]))
+		if r.block == ngBlockPacket {
+			id = int(r.order.Uint16(r.buf[0:2]))
+		}
+		ci.CaptureLength = int(r.order.Uint32(r.buf[12:16]))
+		ci.Length = int(r.order.Uint32(r.buf[16:20]))
+		data = r.buf[20:]
+		if ci.CaptureLength > len(data) {
+			return nil, ci, fmt.Errorf("invalid pcapng packet length %d", ci.CaptureLength)
+		}
+		options = data[(ci.CaptureLength+3)&^3:]
+	}
+	if id >= len(r.interfaces)-r.section {
+		return nil, ci, fmt.Errorf("invalid pcapng packet of interface %d", id)
+	}
+	ci.InterfaceIndex = r.section + id
+	ifi := r.interfaces[ci.InterfaceIndex]
+	r.link = ifi.LinkType
+	if r.block != ngBlockSimplePacket {
+		ci.Timestamp = ifi.timestamp(uint64(r.order.Uint32(r.buf[4:8]))<<32 | uint64(r.order.Uint32(r.buf[8:12])))
+	}
+	r.options(options, func(code uint16, value []byte) {
+		if code == ngOptionComment {
+			ci.AncillaryData = append(ci.AncillaryData, string(value))
+		}
+	})
+	data = append([]byte(nil), data[:ci.CaptureLength]...)
+	return
+}
+
+// units returns the number of units of the timestamps of the interface in a second
+func (ifi FileInterface) units() uint64 {
+	exp := uint64(ifi.resolution & 0x7f)
+	if ifi.resolution&0x80 != 0 {
+		if exp > 63 {
+			exp = 63
+		}
+		return 1 << exp
+	}
+	units := uint64(1)
+	for i := uint64(0); i < exp && i < 19; i++ {
+		units *= 10
+	}
+	return units
+}
+
+func (ifi FileInterface) timestamp(ts uint64) time.Time {
+	units := ifi.units()
+	hi, lo := bits.Mul64(ts%units, uint64(time.Second))
+	nanos, _ := bits.Div64(hi, lo, units)
+	return time.Unix(int64(ts/units)+ifi.offset, int64(nanos))
+}
+
+// Interfaces returns the interfaces described so far, indexed by CaptureInfo.InterfaceIndex
+func (r *FileReader) Interfaces() []FileInterface {
+	return r.interfaces
+}
+
+// LinkType returns the link type of the first interface
+func (r *FileReader) LinkType() layers.LinkType {
+	if len(r.interfaces) == 0 {
+		return layers.LinkTypeEthernet
+	}
+	return r.interfaces[0].LinkType
+}
+
+// Decode implements gopacket.Decoder, it decodes the last packet read with the link type of its interface
+func (r *FileReader) Decode(data []byte, p gopacket.PacketBuilder) error {
+	return r.link.Decode(data, p)
+}
+
+// Close closes the file opened by OpenFile
+func (r *FileReader) Close() (err error) {
+	for i := len(r.closers) - 1; i >= 0; i-- {
+		if e := r.closers[i].Close(); e != nil {
+			err = e
+		}
+	}
+	r.closers = nil
+	return
+}
+
+// linkType returns the link type of a DLT_ value of a capture file, the upper bits of pcap files hold the FCS length
+func linkType(dlt uint32) layers.LinkType {
+	dlt &= 0xffff
+	if dlt == dltLinuxSLL2 {
+		return LinkTypeLinuxSLL2
+	}
+	return layers.LinkType(dlt)
+}
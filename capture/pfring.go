@@ -0,0 +1,60 @@
+//go:build pfring
+// +build pfring
+
+package capture
+
+import (
+	"fmt"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/pfring"
+)
+
+// EnginePFRing captures packets with PF_RING, ZC devices are selected with their PF_RING name(e.g. zc:eth0).
+// it is only available when built with the pfring tag and linked against libpfring.
+var EnginePFRing = RegisterEngine("pf_ring", pfringEngine{})
+
+type pfringEngine struct{}
+
+func (pfringEngine) Open(l *Listener, ifi NetInterface) (gopacket.PacketDataSource, error) {
+	flags := pfring.FlagTimestamp | pfring.FlagLongHeader
+	if l.Promiscuous || l.Monitor {
+		flags |= pfring.FlagPromisc
+	}
+	snap := 64<<10 + 200
+	if !l.Snaplen && ifi.MTU > 0 && !Offloading(ifi.Name) {
+		snap = ifi.MTU + 200
+	}
+	ring, err := pfring.NewRing(ifi.Name, uint32(snap), flags)
+	if err != nil {
+		return nil, fmt.Errorf("pf_ring error: %q, interface: %q", err, ifi.Name)
+	}
+	if err = ring.SetSocketMode(pfring.ReadOnly); err != nil {
+		ring.Close()
+		return nil, fmt.Errorf("pf_ring socket mode error: %q, interface: %q", err, ifi.Name)
+	}
+	ring.SetApplicationName("goreplay")
+	filter := l.bpfFilter(ifi)
+	if err = ring.SetBPFFilter(filter); err != nil {
+		ring.Close()
+		return nil, fmt.Errorf("BPF filter error: %q%s, interface: %q", err, filter, ifi.Name)
+	}
+	if err = ring.Enable(); err != nil {
+		ring.Close()
+		return nil, fmt.Errorf("pf_ring enable error: %q, interface: %q", err, ifi.Name)
+	}
+	return pfringSource{ring}, nil
+}
+
+// pfringSource reports the statistics of the ring to the listener
+type pfringSource struct {
+	*pfring.Ring
+}
+
+func (ring pfringSource) CaptureStats() (CaptureStats, error) {
+	s, err := ring.Stats()
+	if err != nil {
+		return CaptureStats{}, err
+	}
+	return CaptureStats{Received: s.Received, Dropped: s.Dropped}, nil
+}
@@ -0,0 +1,45 @@
+package capture
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// LinkTypeLinuxSLL2 is the link type of the linux cooked captures v2(DLT_LINUX_SLL2), e.g. on the "any" interface.
+// link types of gopacket are 8 bits long, 276 is truncated to 20 by pcap handles.
+const LinkTypeLinuxSLL2 = layers.LinkType(dltLinuxSLL2 & 0xff)
+
+const dltLinuxSLL2 = 276
+
+func init() {
+	layers.LinkTypeMetadata[LinkTypeLinuxSLL2] = layers.EnumMetadata{
+		DecodeWith: gopacket.DecodeFunc(decodeLinuxSLL2),
+		Name:       "Linux SLL2",
+		LayerType:  layers.LayerTypeLinuxSLL,
+	}
+}
+
+// decodeLinuxSLL2 decodes a linux cooked v2 header as a layers.LinuxSLL, the interface index is left out
+func decodeLinuxSLL2(data []byte, p gopacket.PacketBuilder) error {
+	if len(data) < 20 {
+		return errors.New("Linux SLL2 packet too small")
+	}
+	sll := &layers.LinuxSLL{
+		EthernetType: layers.EthernetType(binary.BigEndian.Uint16(data[0:2])),
+		AddrType:     binary.BigEndian.Uint16(data[8:10]),
+		PacketType:   layers.LinuxSLLPacketType(data[10]),
+		AddrLen:      uint16(data[11]),
+	}
+	if sll.AddrLen > 8 {
+		sll.AddrLen = 8
+	}
+	sll.Addr = net.HardwareAddr(data[12 : 12+sll.AddrLen])
+	sll.Contents, sll.Payload = data[:20], data[20:]
+	p.AddLayer(sll)
+	p.SetLinkLayer(sll)
+	return p.NextDecoder(sll.EthernetType)
+}
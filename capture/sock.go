@@ -1,6 +1,7 @@
 package capture
 
 import (
+	"encoding/binary"
 	"fmt"
 	"net"
 	"sync"
@@ -31,9 +32,57 @@ const (
 
 var tpacket2hdrlen = tpAlign(int(unsafe.Sizeof(unix.Tpacket2Hdr{})))
 
+// ethtool commands and flags, see linux/ethtool.h
+const (
+	ethtoolGTSO   = 0x1e
+	ethtoolGGSO   = 0x23
+	ethtoolGFLAGS = 0x25
+	ethtoolGGRO   = 0x2b
+	ethFlagLRO    = 1 << 15
+)
+
+type ethtoolValue struct {
+	cmd  uint32
+	data uint32
+}
+
+type ifreqData struct {
+	name [unix.IFNAMSIZ]byte
+	data uintptr
+	_    [24 - unsafe.Sizeof(uintptr(0))]byte
+}
+
+// Offloading reports whether the interface has segmentation or receive offloads enabled(TSO, GSO, GRO or LRO),
+// the packets captured on such interfaces can be much larger than the MTU.
+func Offloading(name string) bool {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM, 0)
+	if err != nil {
+		return false
+	}
+	defer unix.Close(fd)
+	for _, cmd := range []uint32{ethtoolGTSO, ethtoolGGSO, ethtoolGGRO, ethtoolGFLAGS} {
+		value := ethtoolValue{cmd: cmd}
+		var ifr ifreqData
+		copy(ifr.name[:unix.IFNAMSIZ-1], name)
+		ifr.data = uintptr(unsafe.Pointer(&value))
+		_, _, e := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), unix.SIOCETHTOOL, uintptr(unsafe.Pointer(&ifr)))
+		if e != 0 {
+			continue
+		}
+		if cmd == ethtoolGFLAGS {
+			value.data &= ethFlagLRO
+		}
+		if value.data != 0 {
+			return true
+		}
+	}
+	return false
+}
+
 // SockRaw is a linux M'maped af_packet socket
 type SockRaw struct {
 	mu          sync.Mutex
+	ctl         sync.Mutex // guards fd against Close for the calls made while a read is blocked
 	fd          int
 	ifindex     int
 	snaplen     int
@@ -41,10 +90,46 @@ type SockRaw struct {
 	frame       uint32 // current frame
 	buf         []byte // points to the memory space of the ring buffer shared with the kernel.
 	loopIndex   int32  // this field must filled to avoid reading packet twice on a loopback device
+	version     int    // TPACKET_V2 or TPACKET_V3
+	v3          ringV3 // state of the ring of blocks on packet version 3
 }
 
 // NewSockRaw returns new M'maped sock_raw on packet version 2.
 func NewSockRaw(ifi net.Interface) (*SockRaw, error) {
+	sock, err := openSockRaw(ifi, unix.TPACKET_V2)
+	if err != nil {
+		return nil, err
+	}
+	fd := sock.fd
+
+	// create shared-memory ring buffer
+	tp := &unix.TpacketReq{
+		Block_size: BLOCKSIZE,
+		Block_nr:   BLOCKNR,
+		Frame_size: FRAMESIZE,
+		Frame_nr:   FRAMENR,
+	}
+	err = unix.SetsockoptTpacketReq(sock.fd, unix.SOL_PACKET, unix.PACKET_RX_RING, tp)
+	if err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("setsockopt packet_rx_ring: %v", err)
+	}
+	sock.buf, err = unix.Mmap(
+		sock.fd,
+		0,
+		BLOCKSIZE*BLOCKNR,
+		unix.PROT_READ|unix.PROT_WRITE,
+		unix.MAP_SHARED|unix.MAP_LOCKED,
+	)
+	if err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("socket mmap error: %v", err)
+	}
+	return sock, nil
+}
+
+// openSockRaw returns a new af_packet socket on packet version, bound to the interface
+func openSockRaw(ifi net.Interface, version int) (*SockRaw, error) {
 	// sock create
 	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW, int(ETHALL))
 	if err != nil {
@@ -55,10 +140,11 @@ func NewSockRaw(ifi net.Interface) (*SockRaw, error) {
 		ifindex:     ifi.Index,
 		snaplen:     unix.IP_MAXPACKET,
 		pollTimeout: ^uintptr(0),
+		version:     version,
 	}
 
 	// set packet version
-	err = unix.SetsockoptInt(fd, unix.SOL_PACKET, unix.PACKET_VERSION, unix.TPACKET_V2)
+	err = unix.SetsockoptInt(fd, unix.SOL_PACKET, unix.PACKET_VERSION, version)
 	if err != nil {
 		unix.Close(fd)
 		return nil, fmt.Errorf("setsockopt packet_version: %v", err)
@@ -80,30 +166,6 @@ func NewSockRaw(ifi net.Interface) (*SockRaw, error) {
 		unix.Close(fd)
 		return nil, e
 	}
-
-	// create shared-memory ring buffer
-	tp := &unix.TpacketReq{
-		Block_size: BLOCKSIZE,
-		Block_nr:   BLOCKNR,
-		Frame_size: FRAMESIZE,
-		Frame_nr:   FRAMENR,
-	}
-	err = unix.SetsockoptTpacketReq(sock.fd, unix.SOL_PACKET, unix.PACKET_RX_RING, tp)
-	if err != nil {
-		unix.Close(fd)
-		return nil, fmt.Errorf("setsockopt packet_rx_ring: %v", err)
-	}
-	sock.buf, err = unix.Mmap(
-		sock.fd,
-		0,
-		BLOCKSIZE*BLOCKNR,
-		unix.PROT_READ|unix.PROT_WRITE,
-		unix.MAP_SHARED|unix.MAP_LOCKED,
-	)
-	if err != nil {
-		unix.Close(fd)
-		return nil, fmt.Errorf("socket mmap error: %v", err)
-	}
 	return sock, nil
 }
 
@@ -111,6 +173,12 @@ func NewSockRaw(ifi net.Interface) (*SockRaw, error) {
 func (sock *SockRaw) ReadPacketData() (buf []byte, ci gopacket.CaptureInfo, err error) {
 	sock.mu.Lock()
 	defer sock.mu.Unlock()
+	if sock.fd == -1 {
+		return nil, ci, unix.EBADF
+	}
+	if sock.version == unix.TPACKET_V3 {
+		return sock.readV3()
+	}
 	var tpHdr *unix.Tpacket2Hdr
 	poll := &unix.PollFd{
 		Fd:     int32(sock.fd),
@@ -127,12 +195,16 @@ read:
 		if e != 0 && e != unix.EINTR {
 			return buf, ci, e
 		}
+		if err = pollError(poll); err != nil {
+			return buf, ci, err
+		}
 		// it might be some other frame with data!
 		if tpHdr.Status&unix.TP_STATUS_USER == 0 {
 			goto read
 		}
 	}
 
+	status := tpHdr.Status
 	tpHdr.Status = unix.TP_STATUS_KERNEL
 	sockAddr := (*unix.RawSockaddrLinklayer)(unsafe.Pointer(&sock.buf[i+tpacket2hdrlen]))
 
@@ -146,14 +218,37 @@ read:
 	ci.InterfaceIndex = int(sockAddr.Ifindex)
 	buf = make([]byte, tpHdr.Snaplen)
 	ci.CaptureLength = copy(buf, sock.buf[i+int(tpHdr.Mac):])
+	if status&unix.TP_STATUS_VLAN_VALID != 0 {
+		buf = vlanFrame(buf, tpHdr.Vlan_tpid, tpHdr.Vlan_tci)
+		ci.Length += len(buf) - ci.CaptureLength
+		ci.CaptureLength = len(buf)
+	}
 
 	return
 }
 
+// vlanFrame returns the ethernet frame with the 802.1Q tag that was stripped by the kernel(or the nic) put back
+func vlanFrame(frame []byte, tpid, tci uint16) []byte {
+	if len(frame) < 12 {
+		return frame
+	}
+	if tpid == 0 {
+		tpid = unix.ETH_P_8021Q
+	}
+	buf := make([]byte, len(frame)+4)
+	copy(buf, frame[:12])
+	binary.BigEndian.PutUint16(buf[12:], tpid)
+	binary.BigEndian.PutUint16(buf[14:], tci)
+	copy(buf[16:], frame[12:])
+	return buf
+}
+
 // Close closes the underlying socket
 func (sock *SockRaw) Close() (err error) {
 	sock.mu.Lock()
 	defer sock.mu.Unlock()
+	sock.ctl.Lock()
+	defer sock.ctl.Unlock()
 	if sock.fd != -1 {
 		unix.Munmap(sock.buf)
 		sock.buf = nil
@@ -236,10 +331,31 @@ func (sock *SockRaw) SetPromiscuous(b bool) error {
 	return unix.SetsockoptPacketMreq(sock.fd, unix.SOL_PACKET, opt, &mreq)
 }
 
-// Stats returns number of packets and dropped packets. This will be the number of packets/dropped packets since the last call to stats (not the cummulative sum!).
-func (sock *SockRaw) Stats() (*unix.TpacketStats, error) {
+// SetFanout adds the socket to the fanout group id of its interface, the packets are spread among the sockets
+// of the group by the hash of their flow, the same in both directions. IP fragments are reassembled beforehand.
+func (sock *SockRaw) SetFanout(id uint16) error {
 	sock.mu.Lock()
 	defer sock.mu.Unlock()
+	arg := int(id) | (unix.PACKET_FANOUT_HASH|unix.PACKET_FANOUT_FLAG_DEFRAG)<<16
+	return unix.SetsockoptInt(sock.fd, unix.SOL_PACKET, unix.PACKET_FANOUT, arg)
+}
+
+// pollError returns ENETDOWN when poll reported an error on the socket, e.g. once its interface is down or gone.
+// the read returns instead of polling again at once, so that the socket can be closed meanwhile.
+func pollError(poll *unix.PollFd) error {
+	if poll.Revents&(unix.POLLERR|unix.POLLHUP|unix.POLLNVAL) != 0 && poll.Revents&unix.POLLIN == 0 {
+		return unix.ENETDOWN
+	}
+	return nil
+}
+
+// Stats returns number of packets and dropped packets. This will be the number of packets/dropped packets since the last call to stats (not the cummulative sum!).
+func (sock *SockRaw) Stats() (*unix.TpacketStats, error) {
+	sock.ctl.Lock()
+	defer sock.ctl.Unlock()
+	if sock.fd == -1 {
+		return nil, unix.EBADF
+	}
 	return unix.GetsockoptTpacketStats(sock.fd, unix.SOL_PACKET, unix.PACKET_STATISTICS)
 }
 
@@ -0,0 +1,144 @@
+package capture
+
+import (
+	"fmt"
+	"net"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/google/gopacket"
+)
+
+// default settings of the ring of blocks on packet version 3
+const (
+	// V3BLOCKSIZE default size of a block
+	V3BLOCKSIZE = 1 << 20
+	// V3BLOCKNR default number of blocks
+	V3BLOCKNR = 64
+	// V3FRAMESIZE size of the frames blocks are divided into, packets are not bound to frames on version 3
+	V3FRAMESIZE = 1 << 11
+)
+
+var tpacket3hdrlen = tpAlign(int(unsafe.Sizeof(unix.Tpacket3Hdr{})))
+
+// ringV3 is the state of a ring of blocks, the kernel fills a block with as many packets
+// as it can hold, and passes it to the user space once full or once its timeout is reached.
+type ringV3 struct {
+	blockSize uint32
+	blockNr   uint32
+	block     uint32 // current block
+	pkts      uint32 // packets of the current block not read yet
+	offset    uint32 // offset of the next packet in the current block
+}
+
+// NewSockRawV3 returns new M'maped sock_raw on packet version 3, with a ring of blockNr blocks of blockSize bytes.
+// blocks are passed to the user space after timeout even if they are not full. blockSize is rounded to a multiple
+// of the page size, zero values use the defaults.
+func NewSockRawV3(ifi net.Interface, blockSize, blockNr int, timeout time.Duration) (*SockRaw, error) {
+	if blockSize <= 0 {
+		blockSize = V3BLOCKSIZE
+	}
+	blockSize = (blockSize + PAGESIZE - 1) &^ (PAGESIZE - 1)
+	if blockNr <= 0 {
+		blockNr = V3BLOCKNR
+	}
+	if timeout <= 0 {
+		timeout = time.Millisecond * 10
+	}
+	sock, err := openSockRaw(ifi, unix.TPACKET_V3)
+	if err != nil {
+		return nil, err
+	}
+	tp := &unix.TpacketReq3{
+		Block_size:     uint32(blockSize),
+		Block_nr:       uint32(blockNr),
+		Frame_size:     V3FRAMESIZE,
+		Frame_nr:       uint32(blockSize / V3FRAMESIZE * blockNr),
+		Retire_blk_tov: uint32(timeout / time.Millisecond),
+	}
+	err = unix.SetsockoptTpacketReq3(sock.fd, unix.SOL_PACKET, unix.PACKET_RX_RING, tp)
+	if err != nil {
+		unix.Close(sock.fd)
+		return nil, fmt.Errorf("setsockopt packet_rx_ring: %v", err)
+	}
+	sock.buf, err = unix.Mmap(
+		sock.fd,
+		0,
+		blockSize*blockNr,
+		unix.PROT_READ|unix.PROT_WRITE,
+		unix.MAP_SHARED|unix.MAP_LOCKED,
+	)
+	if err != nil {
+		unix.Close(sock.fd)
+		return nil, fmt.Errorf("socket mmap error: %v", err)
+	}
+	sock.v3.blockSize = uint32(blockSize)
+	sock.v3.blockNr = uint32(blockNr)
+	return sock, nil
+}
+
+// readV3 reads the next packet of the ring of blocks, blocks are given back to the kernel
+// as soon as all their packets have been read.
+func (sock *SockRaw) readV3() (buf []byte, ci gopacket.CaptureInfo, err error) {
+	ring := &sock.v3
+	poll := &unix.PollFd{
+		Fd:     int32(sock.fd),
+		Events: unix.POLLIN,
+	}
+	for {
+		base := ring.block * ring.blockSize
+		desc := (*unix.TpacketBlockDesc)(unsafe.Pointer(&sock.buf[base]))
+		bh := (*unix.TpacketHdrV1)(unsafe.Pointer(&desc.Hdr[0]))
+		if ring.pkts == 0 {
+			if bh.Block_status&unix.TP_STATUS_USER == 0 {
+				_, _, e := unix.Syscall(unix.SYS_POLL, uintptr(unsafe.Pointer(poll)), 1, sock.pollTimeout)
+				if e != 0 && e != unix.EINTR {
+					return buf, ci, e
+				}
+				if err = pollError(poll); err != nil {
+					return buf, ci, err
+				}
+				continue
+			}
+			ring.pkts = bh.Num_pkts
+			ring.offset = bh.Offset_to_first_pkt
+			if ring.pkts == 0 {
+				sock.releaseBlock(bh)
+				continue
+			}
+		}
+		i := base + ring.offset
+		tpHdr := (*unix.Tpacket3Hdr)(unsafe.Pointer(&sock.buf[i]))
+		sockAddr := (*unix.RawSockaddrLinklayer)(unsafe.Pointer(&sock.buf[i+uint32(tpacket3hdrlen)]))
+		ring.offset += tpHdr.Next_offset
+		ring.pkts--
+		// on loopback packets are seen once outgoing and once incoming
+		skip := sockAddr.Ifindex == sock.loopIndex && sockAddr.Pkttype == unix.PACKET_OUTGOING
+		if !skip {
+			ci.Length = int(tpHdr.Len)
+			ci.Timestamp = time.Unix(int64(tpHdr.Sec), int64(tpHdr.Nsec))
+			ci.InterfaceIndex = int(sockAddr.Ifindex)
+			buf = make([]byte, tpHdr.Snaplen)
+			ci.CaptureLength = copy(buf, sock.buf[i+uint32(tpHdr.Mac):])
+			if tpHdr.Status&unix.TP_STATUS_VLAN_VALID != 0 {
+				buf = vlanFrame(buf, tpHdr.Hv1.Vlan_tpid, uint16(tpHdr.Hv1.Vlan_tci))
+				ci.Length += len(buf) - ci.CaptureLength
+				ci.CaptureLength = len(buf)
+			}
+		}
+		if ring.pkts == 0 {
+			sock.releaseBlock(bh)
+		}
+		if !skip {
+			return
+		}
+	}
+}
+
+// releaseBlock gives the current block back to the kernel, and moves to the next one
+func (sock *SockRaw) releaseBlock(bh *unix.TpacketHdrV1) {
+	bh.Block_status = unix.TP_STATUS_KERNEL
+	sock.v3.block = (sock.v3.block + 1) % sock.v3.blockNr
+}
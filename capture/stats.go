@@ -0,0 +1,70 @@
+package capture
+
+import (
+	"github.com/google/gopacket/pcap"
+)
+
+// CaptureStats are the counters of a capture handle since it was opened
+type CaptureStats struct {
+	Received  uint64 `json:"received"`   // packets seen by the handle, the dropped ones are included for af_packet sockets
+	Dropped   uint64 `json:"dropped"`    // packets dropped because the handle did not read them fast enough
+	IfDropped uint64 `json:"if_dropped"` // packets dropped by the interface or its driver, only known by libpcap
+}
+
+// Add returns the sum of the statistics
+func (st CaptureStats) Add(other CaptureStats) CaptureStats {
+	st.Received += other.Received
+	st.Dropped += other.Dropped
+	st.IfDropped += other.IfDropped
+	return st
+}
+
+// Stats returns the statistics of the handles of the listener, keyed like Listener.Handles.
+// the packet sources of registered engines report theirs by implementing
+// interface{ CaptureStats() (CaptureStats, error) }, the handles without statistics are left out.
+func (l *Listener) Stats() map[string]CaptureStats {
+	l.Lock()
+	defer l.Unlock()
+	if l.stats == nil {
+		l.stats = make(map[string]CaptureStats)
+	}
+	stats := make(map[string]CaptureStats)
+	for key, handle := range l.Handles {
+		var st CaptureStats
+		switch h := handle.(type) {
+		case *pcap.Handle:
+			s, err := h.Stats()
+			if err != nil {
+				continue
+			}
+			st = CaptureStats{
+				Received:  uint64(s.PacketsReceived),
+				Dropped:   uint64(s.PacketsDropped),
+				IfDropped: uint64(s.PacketsIfDropped),
+			}
+		case *SockRaw:
+			// the socket counts since the last call
+			s, err := h.Stats()
+			if err != nil {
+				continue
+			}
+			st = l.stats[key].Add(CaptureStats{Received: uint64(s.Packets), Dropped: uint64(s.Drops)})
+			l.stats[key] = st
+		case *SockXDP:
+			s, err := h.Stats()
+			if err != nil {
+				continue
+			}
+			st = CaptureStats{Received: h.Received() + s.Rx_dropped, Dropped: s.Rx_dropped}
+		case interface{ CaptureStats() (CaptureStats, error) }:
+			var err error
+			if st, err = h.CaptureStats(); err != nil {
+				continue
+			}
+		default:
+			continue
+		}
+		stats[key] = st
+	}
+	return stats
+}
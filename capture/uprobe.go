@@ -0,0 +1,724 @@
+package capture
+
+import (
+	"bufio"
+	"context"
+	"debug/elf"
+	"debug/gosym"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// uprobeRingPages is the number of pages of the perf ring buffer of each cpu
+const uprobeRingPages = 64
+
+// uprobeConnExpire is how long the sockets of the connections without events are remembered
+const uprobeConnExpire = 10 * time.Minute
+
+// UprobeEvent is data read or written in plaintext on a TLS connection by a traced process
+type UprobeEvent struct {
+	Pid       int
+	Conn      uint64 // address of the SSL or crypto/tls.Conn of the connection in the process
+	Read      bool   // the data was read from the peer, it was written to it otherwise
+	Local     string // address of the socket of the process, empty if it is not known
+	Remote    string // address of the peer, empty if it is not known
+	Timestamp time.Time
+	Data      []byte
+	Lost      int // length of the data of the call that was not captured
+}
+
+// Uprobes captures the data read and written by the TLS libraries of processes before it is encrypted, using
+// uprobes on OpenSSL(SSL_read, SSL_write and their _ex variants, BoringSSL included) and on crypto/tls of
+// Go programs built with the register ABI(go1.17 on amd64, go1.18 on arm64). the addresses of the sockets
+// are found from the file descriptors set with SSL_set_fd, or from the net.TCPConn of Go connections.
+type Uprobes struct {
+	Debugger func(int, ...interface{}) // optional, reports the events lost
+	maps     uprobeMaps
+	regs     uprobeRegs
+	progs    map[string]int // loaded programs, by their description
+	probes   []int          // perf events of the uprobes attached
+	rings    []*perfRing
+	epoll    int
+	boot     time.Time // of CLOCK_MONOTONIC
+	conns    map[uprobeConn]*uprobeSocket
+	purged   time.Time
+	lost     uint64 // events lost
+	close    sync.Once
+}
+
+type uprobeConn struct {
+	pid  int
+	conn uint64
+}
+
+// uprobeSocket is the socket of a connection
+type uprobeSocket struct {
+	fd       int // -1 if unknown
+	resolved bool
+	local    string
+	remote   string
+	seen     time.Time
+}
+
+// NewUprobes attaches uprobes to the TLS functions of the shared libraries or executables at paths, they
+// trace all the processes using them. the files of containers can be given with /proc/<pid>/root/<path>.
+func NewUprobes(paths ...string) (_ *Uprobes, err error) {
+	regs, ok := uprobeArchRegs[runtime.GOARCH]
+	if !ok {
+		return nil, fmt.Errorf("uprobes: unsupported architecture %s", runtime.GOARCH)
+	}
+	// locked memory is accounted with the rlimit before linux 5.11
+	_ = unix.Setrlimit(unix.RLIMIT_MEMLOCK, &unix.Rlimit{Cur: unix.RLIM_INFINITY, Max: unix.RLIM_INFINITY})
+	u := &Uprobes{regs: regs, progs: make(map[string]int), conns: make(map[uprobeConn]*uprobeSocket), epoll: -1}
+	u.maps = uprobeMaps{-1, -1, -1}
+	defer func() {
+		if err != nil {
+			u.Close()
+		}
+	}()
+	cpus := possibleCPUs()
+	if u.maps.events, err = bpfMapCreate(unix.BPF_MAP_TYPE_PERF_EVENT_ARRAY, 4, 4, cpus); err != nil {
+		return nil, fmt.Errorf("uprobes: perf event array create error: %v", err)
+	}
+	if u.maps.scratch, err = bpfMapCreate(unix.BPF_MAP_TYPE_PERCPU_ARRAY, 4, uprobeHeaderLen+uprobeMaxData, 1); err != nil {
+		return nil, fmt.Errorf("uprobes: scratch map create error: %v", err)
+	}
+	if u.maps.calls, err = bpfMapCreate(unix.BPF_MAP_TYPE_LRU_HASH, 16, 24, 1<<14); err != nil {
+		return nil, fmt.Errorf("uprobes: calls map create error: %v", err)
+	}
+	for _, path := range paths {
+		if err = u.attach(path); err != nil {
+			return nil, fmt.Errorf("uprobes: %s: %v", path, err)
+		}
+	}
+	if u.epoll, err = unix.EpollCreate1(unix.EPOLL_CLOEXEC); err != nil {
+		return nil, err
+	}
+	for cpu := 0; cpu < cpus; cpu++ {
+		ring, err := newPerfRing(cpu, uprobeRingPages)
+		if err != nil {
+			// cpus possible but not online can't be opened
+			if errors.Is(err, unix.ENODEV) {
+				continue
+			}
+			return nil, fmt.Errorf("uprobes: perf buffer error: %v", err)
+		}
+		u.rings = append(u.rings, ring)
+		if err = bpfMapUpdate(u.maps.events, uint32(cpu), uint32(ring.fd)); err != nil {
+			return nil, err
+		}
+		if err = unix.EpollCtl(u.epoll, unix.EPOLL_CTL_ADD, ring.fd, &unix.EpollEvent{Events: unix.EPOLLIN}); err != nil {
+			return nil, err
+		}
+	}
+	var ts unix.Timespec
+	if err = unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts); err != nil {
+		return nil, err
+	}
+	u.boot = time.Now().Add(-time.Duration(ts.Nano()))
+	return u, nil
+}
+
+// attach attaches the uprobes to the functions of the file found in its symbols
+func (u *Uprobes) attach(path string) error {
+	f, err := elf.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	funcs := make(map[string]elf.Symbol)
+	syms, _ := f.Symbols()
+	dyn, _ := f.DynamicSymbols()
+	for _, sym := range append(syms, dyn...) {
+		if elf.ST_TYPE(sym.Info) == elf.STT_FUNC && sym.Section != elf.SHN_UNDEF && sym.Value != 0 {
+			funcs[sym.Name] = sym
+		}
+	}
+	if len(syms) == 0 {
+		// stripped Go programs keep the table of their functions
+		for name, sym := range goSymbols(f, "crypto/tls.(*Conn).Write", "crypto/tls.(*Conn).Read") {
+			funcs[name] = sym
+		}
+	}
+	r := u.regs
+	m := u.maps
+	type probe struct {
+		name string
+		ret  bool
+		prog string // description of the program, it is loaded once
+		insn func() []bpfInsn
+	}
+	var probes []probe
+	for _, fn := range []struct {
+		name string
+		kind int32
+		size int16
+	}{
+		{"SSL_write", uprobeWrite, -1},
+		{"SSL_read", uprobeRead, -1},
+		{"SSL_write_ex", uprobeWrite, r.args[3]},
+		{"SSL_read_ex", uprobeRead, r.args[3]},
+	} {
+		fn := fn
+		if _, ok := funcs[fn.name]; !ok {
+			continue
+		}
+		probes = append(probes,
+			probe{fn.name, false, fmt.Sprintf("call size %d", fn.size), func() []bpfInsn {
+				return uprobeCallProgram(m, r.args[0], r.args[1], fn.size, -1)
+			}},
+			probe{fn.name, true, fmt.Sprintf("return %d", fn.kind), func() []bpfInsn {
+				return uprobeReturnProgram(m, fn.kind, r.ret, true, -1)
+			}})
+	}
+	if _, ok := funcs["SSL_set_fd"]; ok {
+		probes = append(probes, probe{"SSL_set_fd", false, "set fd", func() []bpfInsn {
+			return uprobeSetFdProgram(m, r.args[0], r.args[1])
+		}})
+	}
+	if _, ok := funcs["crypto/tls.(*Conn).Write"]; ok {
+		probes = append(probes, probe{"crypto/tls.(*Conn).Write", false, "go write", func() []bpfInsn {
+			return uprobeEntryProgram(m, uprobeWrite|uprobeGo, r.goArgs[0], r.goArgs[1], r.goArgs[2], false)
+		}})
+	}
+	var readOffset uint64
+	var rets []uint64
+	read, goRead := funcs["crypto/tls.(*Conn).Read"]
+	if goRead {
+		// the data are sent at each return of the function, uretprobes would crash the program.
+		// the returns are found before any probe is attached, so that an unsupported program attaches none
+		if readOffset, err = symbolOffset(f, read.Value); err != nil {
+			return err
+		}
+		code := make([]byte, read.Size)
+		if err = readAt(path, code, int64(readOffset)); err != nil {
+			return err
+		}
+		if rets, err = goReturns(code, runtime.GOARCH); err != nil {
+			return fmt.Errorf("crypto/tls.(*Conn).Read is unsupported, its returns can't be probed: %v", err)
+		}
+	}
+	for _, p := range probes {
+		offset, err := symbolOffset(f, funcs[p.name].Value)
+		if err != nil {
+			return err
+		}
+		if err = u.probe(path, offset, p.ret, p.prog, p.insn); err != nil {
+			return fmt.Errorf("%s: %v", p.name, err)
+		}
+	}
+	attached := len(probes)
+
+	if goRead {
+		err = u.probe(path, readOffset, false, "go call", func() []bpfInsn {
+			return uprobeCallProgram(m, r.goArgs[0], r.goArgs[1], -1, r.g)
+		})
+		if err != nil {
+			return fmt.Errorf("crypto/tls.(*Conn).Read: %v", err)
+		}
+		for _, ret := range rets {
+			err = u.probe(path, readOffset+ret, false, "go return", func() []bpfInsn {
+				return uprobeReturnProgram(m, uprobeRead|uprobeGo, r.goRet, false, r.g)
+			})
+			if err != nil {
+				return fmt.Errorf("crypto/tls.(*Conn).Read: %v", err)
+			}
+		}
+		attached++
+	}
+	if attached == 0 {
+		return errors.New("no OpenSSL or crypto/tls function found")
+	}
+	return nil
+}
+
+// probe attaches the program described by prog to the offset of the file, it is loaded if it was not already
+func (u *Uprobes) probe(path string, offset uint64, ret bool, prog string, insns func() []bpfInsn) error {
+	fd, ok := u.progs[prog]
+	if !ok {
+		var err error
+		if fd, err = bpfLoad(unix.BPF_PROG_TYPE_KPROBE, kernelVersion(), insns()); err != nil {
+			return fmt.Errorf("program load error: %v", err)
+		}
+		u.progs[prog] = fd
+	}
+	pfd, err := uprobeOpen(path, offset, ret)
+	if err != nil {
+		return fmt.Errorf("uprobe error: %v", err)
+	}
+	u.probes = append(u.probes, pfd)
+	if err = unix.IoctlSetInt(pfd, unix.PERF_EVENT_IOC_SET_BPF, fd); err != nil {
+		return err
+	}
+	return unix.IoctlSetInt(pfd, unix.PERF_EVENT_IOC_ENABLE, 0)
+}
+
+// Listen passes the events to handler until ctx is done, the uprobes are closed then
+func (u *Uprobes) Listen(ctx context.Context, handler func(UprobeEvent)) error {
+	defer u.Close()
+	events := make([]unix.EpollEvent, len(u.rings))
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		default:
+		}
+		_, err := unix.EpollWait(u.epoll, events, 100)
+		if err != nil && err != unix.EINTR {
+			return err
+		}
+		for _, ring := range u.rings {
+			ring.read(func(typ uint32, record []byte) {
+				u.record(typ, record, handler)
+			})
+		}
+	}
+}
+
+// Lost returns the number of events lost because the perf buffers were full
+func (u *Uprobes) Lost() uint64 {
+	return atomic.LoadUint64(&u.lost)
+}
+
+// record handles a record of a perf buffer
+func (u *Uprobes) record(typ uint32, record []byte, handler func(UprobeEvent)) {
+	switch typ {
+	case unix.PERF_RECORD_LOST:
+		if len(record) >= 16 {
+			n := nativeEndian.Uint64(record[8:])
+			atomic.AddUint64(&u.lost, n)
+			if u.Debugger != nil {
+				go u.Debugger(4, fmt.Sprintf("[UPROBES] %d events lost, the perf buffers are full", n))
+			}
+		}
+		return
+	case unix.PERF_RECORD_SAMPLE:
+	default:
+		return
+	}
+	if len(record) < 4 {
+		return
+	}
+	raw := record[4:]
+	if size := int(nativeEndian.Uint32(record)); size < len(raw) {
+		raw = raw[:size]
+	}
+	if len(raw) < uprobeHeaderLen {
+		return
+	}
+	now := time.Now()
+	if now.Sub(u.purged) > uprobeConnExpire/10 {
+		u.purge(now)
+	}
+	key := uprobeConn{int(nativeEndian.Uint32(raw[uprobeEvPid:])), nativeEndian.Uint64(raw[uprobeEvConn:])}
+	kind := nativeEndian.Uint32(raw[uprobeEvKind:])
+	length := int(nativeEndian.Uint32(raw[uprobeEvLength:]))
+	if kind == uprobeSetFd {
+		// the conn may be reused by a new connection
+		u.conns[key] = &uprobeSocket{fd: int(int32(length)), seen: now}
+		return
+	}
+	if length > len(raw)-uprobeHeaderLen {
+		return
+	}
+	ev := UprobeEvent{
+		Pid:       key.pid,
+		Conn:      key.conn,
+		Read:      kind&uprobeRead != 0,
+		Timestamp: u.boot.Add(time.Duration(nativeEndian.Uint64(raw[uprobeEvTimestamp:]))),
+		Data:      append([]byte(nil), raw[uprobeHeaderLen:uprobeHeaderLen+length]...),
+	}
+	total := int(nativeEndian.Uint32(raw[uprobeEvTotal:]))
+	if end := int(nativeEndian.Uint32(raw[uprobeEvOffset:])) + length; end == uprobeChunks*uprobeMaxData && total > end {
+		ev.Lost = total - end
+	}
+	s, ok := u.conns[key]
+	if !ok {
+		s = &uprobeSocket{fd: -1}
+		u.conns[key] = s
+	}
+	s.seen = now
+	if !s.resolved {
+		s.resolved = true
+		if s.fd < 0 && kind&uprobeGo != 0 {
+			s.fd = goConnFd(key.pid, key.conn)
+		}
+		if s.fd >= 0 {
+			s.local, s.remote, _ = socketAddrs(key.pid, s.fd)
+		}
+	}
+	ev.Local, ev.Remote = s.local, s.remote
+	handler(ev)
+}
+
+func (u *Uprobes) purge(now time.Time) {
+	u.purged = now
+	for key, s := range u.conns {
+		if now.Sub(s.seen) > uprobeConnExpire {
+			delete(u.conns, key)
+		}
+	}
+}
+
+// Close detaches the uprobes
+func (u *Uprobes) Close() error {
+	u.close.Do(func() {
+		for _, fd := range u.probes {
+			unix.Close(fd)
+		}
+		for _, fd := range u.progs {
+			unix.Close(fd)
+		}
+		for _, ring := range u.rings {
+			ring.close()
+		}
+		for _, fd := range []int{u.maps.events, u.maps.scratch, u.maps.calls, u.epoll} {
+			if fd >= 0 {
+				unix.Close(fd)
+			}
+		}
+	})
+	return nil
+}
+
+// perfRing is the ring buffer of a perf event of a cpu, the uprobe programs send their events to
+type perfRing struct {
+	fd   int
+	mem  []byte
+	meta *unix.PerfEventMmapPage
+	data []byte
+}
+
+func newPerfRing(cpu, pages int) (*perfRing, error) {
+	attr := unix.PerfEventAttr{
+		Type:        unix.PERF_TYPE_SOFTWARE,
+		Config:      unix.PERF_COUNT_SW_BPF_OUTPUT,
+		Sample_type: unix.PERF_SAMPLE_RAW,
+		Wakeup:      1,
+	}
+	attr.Size = uint32(unsafe.Sizeof(attr))
+	fd, err := unix.PerfEventOpen(&attr, -1, cpu, -1, unix.PERF_FLAG_FD_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	size := os.Getpagesize()
+	mem, err := unix.Mmap(fd, 0, size*(1+pages), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	r := &perfRing{fd: fd, mem: mem, meta: (*unix.PerfEventMmapPage)(unsafe.Pointer(&mem[0])), data: mem[size:]}
+	if err = unix.IoctlSetInt(fd, unix.PERF_EVENT_IOC_ENABLE, 0); err != nil {
+		r.close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// read passes the records written to the ring to handle, they are only valid until it returns
+func (r *perfRing) read(handle func(typ uint32, record []byte)) {
+	head := atomic.LoadUint64(&r.meta.Data_head)
+	tail := r.meta.Data_tail
+	for tail < head {
+		header := r.bytes(tail, 8)
+		size := uint64(nativeEndian.Uint16(header[6:]))
+		if size < 8 {
+			break
+		}
+		handle(nativeEndian.Uint32(header), r.bytes(tail+8, size-8))
+		tail += size
+	}
+	atomic.StoreUint64(&r.meta.Data_tail, tail)
+}
+
+// bytes returns n bytes of the ring starting at off, they are copied if they wrap around
+func (r *perfRing) bytes(off, n uint64) []byte {
+	size := uint64(len(r.data))
+	start := off % size
+	if start+n <= size {
+		return r.data[start : start+n]
+	}
+	b := make([]byte, n)
+	copy(b[copy(b, r.data[start:]):], r.data)
+	return b
+}
+
+func (r *perfRing) close() {
+	unix.Munmap(r.mem)
+	unix.Close(r.fd)
+}
+
+// uprobeOpen opens a perf event of a uprobe at the offset of the file, or of a uretprobe if ret is true
+func uprobeOpen(path string, offset uint64, ret bool) (int, error) {
+	typ, err := readSysUint("/sys/bus/event_source/devices/uprobe/type")
+	if err != nil {
+		return -1, fmt.Errorf("the uprobe pmu is needed(linux 4.17): %v", err)
+	}
+	name := append([]byte(path), 0)
+	attr := unix.PerfEventAttr{
+		Type: uint32(typ),
+		Ext1: uint64(uintptr(unsafe.Pointer(&name[0]))),
+		Ext2: offset,
+	}
+	attr.Size = uint32(unsafe.Sizeof(attr))
+	if ret {
+		// the format is config:<bit>
+		format, err := ioutil.ReadFile("/sys/bus/event_source/devices/uprobe/format/retprobe")
+		if err != nil {
+			return -1, err
+		}
+		bit, err := strconv.Atoi(strings.TrimPrefix(strings.TrimSpace(string(format)), "config:"))
+		if err != nil {
+			return -1, fmt.Errorf("unexpected retprobe format %q", format)
+		}
+		attr.Config |= 1 << uint(bit)
+	}
+	fd, err := unix.PerfEventOpen(&attr, -1, 0, -1, unix.PERF_FLAG_FD_CLOEXEC)
+	runtime.KeepAlive(name)
+	return fd, err
+}
+
+// goSymbols returns the symbols of the Go functions named, found in the pclntab of the file
+func goSymbols(f *elf.File, names ...string) map[string]elf.Symbol {
+	pclntab, text := f.Section(".gopclntab"), f.Section(".text")
+	if pclntab == nil || text == nil {
+		return nil
+	}
+	data, err := pclntab.Data()
+	if err != nil {
+		return nil
+	}
+	table, err := gosym.NewTable(nil, gosym.NewLineTable(data, goTextStart(f, pclntab, text)))
+	if err != nil {
+		return nil
+	}
+	syms := make(map[string]elf.Symbol)
+	for _, name := range names {
+		if fn := table.LookupFunc(name); fn != nil {
+			syms[name] = elf.Symbol{Name: name, Value: fn.Entry, Size: fn.End - fn.Entry}
+		}
+	}
+	return syms
+}
+
+// goTextStart returns the address of the Go text the functions of the pclntab are relative to since go1.18, it
+// is after the C code at the start of the .text section of the programs linked externally. it is read from the
+// moduledata of the runtime(in .go.module with recent versions), that starts with the address of the pclntab.
+func goTextStart(f *elf.File, pclntab, text *elf.Section) uint64 {
+	size := 8
+	word := f.ByteOrder.Uint64
+	if f.Class == elf.ELFCLASS32 {
+		size = 4
+		word = func(b []byte) uint64 { return uint64(f.ByteOrder.Uint32(b)) }
+	}
+	for _, name := range []string{".go.module", ".noptrdata", ".data"} {
+		sec := f.Section(name)
+		if sec == nil {
+			continue
+		}
+		data, err := sec.Data()
+		if err != nil {
+			continue
+		}
+		// the text follows the address of the pclntab, its 6 slices of tables, findfunctab, minpc and maxpc
+		for off := 0; off+23*size <= len(data); off += size {
+			if word(data[off:]) != pclntab.Addr {
+				continue
+			}
+			if start := word(data[off+22*size:]); start >= text.Addr && start < text.Addr+text.Size {
+				return start
+			}
+		}
+	}
+	return text.Addr
+}
+
+// symbolOffset returns the offset in the file of the symbol at the virtual address addr
+func symbolOffset(f *elf.File, addr uint64) (uint64, error) {
+	for _, prog := range f.Progs {
+		if prog.Type == elf.PT_LOAD && prog.Flags&elf.PF_X != 0 && addr >= prog.Vaddr && addr < prog.Vaddr+prog.Memsz {
+			return addr - prog.Vaddr + prog.Off, nil
+		}
+	}
+	return 0, fmt.Errorf("no executable segment holds the address %#x", addr)
+}
+
+func readAt(path string, b []byte, off int64) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.ReadAt(b, off)
+	return err
+}
+
+func readSysUint(path string) (uint64, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+}
+
+// possibleCPUs returns the number of cpus the perf buffers are indexed by
+func possibleCPUs() int {
+	b, err := ioutil.ReadFile("/sys/devices/system/cpu/possible")
+	if err != nil {
+		return runtime.NumCPU()
+	}
+	// e.g: 0-7 or 0
+	ranges := strings.Split(strings.TrimSpace(string(b)), ",")
+	last := ranges[len(ranges)-1]
+	if i := strings.LastIndexByte(last, '-'); i >= 0 {
+		last = last[i+1:]
+	}
+	n, err := strconv.Atoi(last)
+	if err != nil {
+		return runtime.NumCPU()
+	}
+	return n + 1
+}
+
+// kernelVersion returns the LINUX_VERSION_CODE of the running kernel
+func kernelVersion() uint32 {
+	var uts unix.Utsname
+	if unix.Uname(&uts) != nil {
+		return 0
+	}
+	var v [3]uint32
+	release := string(uts.Release[:clen(uts.Release[:])])
+	for i, s := range strings.SplitN(release, ".", 3) {
+		n := 0
+		for n < len(s) && s[n] >= '0' && s[n] <= '9' {
+			n++
+		}
+		x, _ := strconv.Atoi(s[:n])
+		v[i] = uint32(x)
+	}
+	if v[2] > 255 {
+		v[2] = 255
+	}
+	return v[0]<<16 | v[1]<<8 | v[2]
+}
+
+// goConnFd returns the file descriptor of the net.TCPConn of a crypto/tls.Conn, read in the memory of the
+// process, or -1. tls.Conn starts with its net.Conn, whose data is a *net.TCPConn pointing to the netFD,
+// whose poll.FD holds the descriptor after its fdMutex.
+func goConnFd(pid int, conn uint64) int {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/mem", pid))
+	if err != nil {
+		return -1
+	}
+	defer f.Close()
+	word := func(addr uint64) (uint64, bool) {
+		var b [8]byte
+		if _, err := f.ReadAt(b[:], int64(addr)); err != nil {
+			return 0, false
+		}
+		return nativeEndian.Uint64(b[:]), true
+	}
+	tcpConn, ok := word(conn + 8)
+	if !ok || tcpConn == 0 {
+		return -1
+	}
+	netFD, ok := word(tcpConn)
+	if !ok || netFD == 0 {
+		return -1
+	}
+	fd, ok := word(netFD + 16)
+	if !ok || fd > 1<<20 {
+		return -1
+	}
+	return int(fd)
+}
+
+// socketAddrs returns the local and remote addresses of the tcp socket of the file descriptor of the process
+func socketAddrs(pid, fd int) (local, remote string, err error) {
+	link, err := os.Readlink(fmt.Sprintf("/proc/%d/fd/%d", pid, fd))
+	if err != nil {
+		return
+	}
+	if !strings.HasPrefix(link, "socket:[") {
+		return "", "", fmt.Errorf("%s is not a socket", link)
+	}
+	inode := strings.TrimSuffix(strings.TrimPrefix(link, "socket:["), "]")
+	// the socket is in the namespace of the thread that created it, /proc/<pid>/net is the one of the main thread
+	tasks, _ := filepath.Glob(fmt.Sprintf("/proc/%d/task/*", pid))
+	seen := make(map[uint64]bool)
+	for _, dir := range append([]string{fmt.Sprintf("/proc/%d", pid)}, tasks...) {
+		var st unix.Stat_t
+		if unix.Stat(dir+"/ns/net", &st) == nil {
+			if seen[st.Ino] {
+				continue
+			}
+			seen[st.Ino] = true
+		}
+		if local, remote, err = procNetSocket(dir, inode); err == nil {
+			return
+		}
+	}
+	return "", "", fmt.Errorf("no tcp socket with the inode %s", inode)
+}
+
+// procNetSocket returns the addresses of the tcp socket with the inode, in the network namespace of the process
+// or task at dir
+func procNetSocket(dir, inode string) (local, remote string, err error) {
+	for _, table := range []string{"tcp", "tcp6"} {
+		f, err := os.Open(dir + "/net/" + table)
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 10 || fields[9] != inode {
+				continue
+			}
+			f.Close()
+			if local, err = procNetAddr(fields[1]); err != nil {
+				return "", "", err
+			}
+			remote, err = procNetAddr(fields[2])
+			return local, remote, err
+		}
+		f.Close()
+	}
+	return "", "", fmt.Errorf("no tcp socket with the inode %s", inode)
+}
+
+// procNetAddr parses an address of /proc/net/tcp, the ip is made of 32 bits words in the byte order of the host
+func procNetAddr(s string) (string, error) {
+	i := strings.IndexByte(s, ':')
+	if i < 0 {
+		return "", fmt.Errorf("invalid address %q", s)
+	}
+	words, err := hex.DecodeString(s[:i])
+	if err != nil || (len(words) != 4 && len(words) != 16) {
+		return "", fmt.Errorf("invalid address %q", s)
+	}
+	port, err := strconv.ParseUint(s[i+1:], 16, 16)
+	if err != nil {
+		return "", fmt.Errorf("invalid address %q", s)
+	}
+	ip := make(net.IP, len(words))
+	for j := 0; j < len(words); j += 4 {
+		nativeEndian.PutUint32(ip[j:], binary.BigEndian.Uint32(words[j:]))
+	}
+	return net.JoinHostPort(ip.String(), strconv.Itoa(int(port))), nil
+}
@@ -0,0 +1,278 @@
+package capture
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// eBPF opcodes used by the uprobe programs, in addition to the ones of the XDP program
+const (
+	bpfLdxDW  = 0x79 // BPF_LDX | BPF_MEM | BPF_DW
+	bpfStxW   = 0x63 // BPF_STX | BPF_MEM | BPF_W
+	bpfStxDW  = 0x7b // BPF_STX | BPF_MEM | BPF_DW
+	bpfStW    = 0x62 // BPF_ST | BPF_MEM | BPF_W
+	bpfStDW   = 0x7a // BPF_ST | BPF_MEM | BPF_DW
+	bpfSubX   = 0x1f // BPF_ALU64 | BPF_SUB | BPF_X
+	bpfRshK   = 0x77 // BPF_ALU64 | BPF_RSH | BPF_K
+	bpfArshK  = 0xc7 // BPF_ALU64 | BPF_ARSH | BPF_K
+	bpfMov32K = 0xb4 // BPF_ALU | BPF_MOV | BPF_K
+	bpfJgtK   = 0x25 // BPF_JMP | BPF_JGT | BPF_K
+	bpfJsleK  = 0xd5 // BPF_JMP | BPF_JSLE | BPF_K
+
+	bpfFuncMapLookup     = 1
+	bpfFuncMapUpdate     = 2
+	bpfFuncMapDelete     = 3
+	bpfFuncKtimeGetNs    = 5
+	bpfFuncGetPidTgid    = 14
+	bpfFuncPerfOutput    = 25
+	bpfFuncProbeReadUser = 112
+)
+
+// layout of the events sent by the uprobe programs, in the byte order of the host
+const (
+	uprobeEvTimestamp = 0  // u64, CLOCK_MONOTONIC
+	uprobeEvConn      = 8  // u64, address of the SSL or crypto/tls.Conn
+	uprobeEvPid       = 16 // u32
+	uprobeEvKind      = 20 // u32
+	uprobeEvLength    = 24 // u32, length of the data of the event, or the file descriptor of uprobeSetFd events
+	uprobeEvTotal     = 28 // u32, length of the data read or written by the call
+	uprobeEvOffset    = 32 // u32, offset of the data of the event in the data of the call
+	uprobeHeaderLen   = 40
+
+	uprobeMaxData = 1 << 14 // data sent by an event
+	uprobeChunks  = 4       // events sent by a call, the data beyond is lost
+)
+
+// kinds of events
+const (
+	uprobeWrite = 0
+	uprobeRead  = 1
+	uprobeSetFd = 2
+	uprobeGo    = 1 << 8 // the conn is a crypto/tls.Conn of a Go program
+)
+
+// uprobeRegs are the offsets in struct pt_regs of the registers read by the uprobe programs
+type uprobeRegs struct {
+	args   [4]int16 // arguments of C functions
+	ret    int16
+	goArgs [3]int16 // register ABI of Go methods taking a slice: receiver, slice pointer and length
+	goRet  int16
+	g      int16 // current goroutine of Go programs
+}
+
+var uprobeArchRegs = map[string]uprobeRegs{
+	"amd64": {args: [4]int16{112, 104, 96, 88}, ret: 80, goArgs: [3]int16{80, 40, 88}, goRet: 80, g: 8},
+	"arm64": {args: [4]int16{0, 8, 16, 24}, ret: 0, goArgs: [3]int16{0, 8, 16}, goRet: 0, g: 224},
+}
+
+// uprobeMaps are the maps shared by the uprobe programs
+type uprobeMaps struct {
+	events  int // perf event array the events are sent to
+	scratch int // per-cpu array of an event being built
+	calls   int // lru hash of the arguments of the calls in progress, by thread or goroutine
+}
+
+func (a *bpfAsm) ldMap(dst uint8, fd int) {
+	a.emit(bpfLdImm64, dst, unix.BPF_PSEUDO_MAP_FD, 0, int32(fd))
+	a.emit(0, 0, 0, 0, 0)
+}
+
+// callKey stores the key of the call in progress at fp-16, the thread or the goroutine of the process when
+// g is the offset of the register holding it. r6 must hold the context.
+func (a *bpfAsm) callKey(g int16) {
+	a.emit(bpfCall, 0, 0, 0, bpfFuncGetPidTgid)
+	if g < 0 {
+		a.emit(bpfStDW, 10, 0, -8, 0)
+	} else {
+		a.emit(bpfRshK, 0, 0, 0, 32)
+		a.emit(bpfLdxDW, 1, 6, g, 0)
+		a.emit(bpfStxDW, 10, 1, -8, 0)
+	}
+	a.emit(bpfStxDW, 10, 0, -16, 0)
+}
+
+// header looks up the scratch event in r9 and sets its header, r7 must hold the conn and r1 the length field.
+// it jumps to exit if the scratch event can't be found.
+func (a *bpfAsm) header(m uprobeMaps, kind int32) {
+	a.emit(bpfStxDW, 10, 1, -32, 0)
+	a.emit(bpfStW, 10, 0, -8, 0)
+	a.ldMap(1, m.scratch)
+	a.emit(bpfMovX, 2, 10, 0, 0)
+	a.emit(bpfAddK, 2, 0, 0, -8)
+	a.emit(bpfCall, 0, 0, 0, bpfFuncMapLookup)
+	a.jump(bpfJeqK, 0, 0, 0, "exit")
+	a.emit(bpfMovX, 9, 0, 0, 0)
+	a.emit(bpfCall, 0, 0, 0, bpfFuncKtimeGetNs)
+	a.emit(bpfStxDW, 9, 0, uprobeEvTimestamp, 0)
+	a.emit(bpfStxDW, 9, 7, uprobeEvConn, 0)
+	a.emit(bpfCall, 0, 0, 0, bpfFuncGetPidTgid)
+	a.emit(bpfRshK, 0, 0, 0, 32)
+	a.emit(bpfStxW, 9, 0, uprobeEvPid, 0)
+	a.emit(bpfStW, 9, 0, uprobeEvKind, kind)
+	a.emit(bpfLdxDW, 1, 10, -32, 0)
+	a.emit(bpfStxW, 9, 1, uprobeEvLength, 0)
+	a.emit(bpfStxW, 9, 1, uprobeEvTotal, 0)
+	a.emit(bpfStW, 9, 0, uprobeEvOffset, 0)
+}
+
+// data sends the data of a call in events of at most uprobeMaxData bytes, r6 must hold the context, r7 the conn,
+// r8 the address of the data and r1 its length. the program exits after.
+func (a *bpfAsm) data(m uprobeMaps, kind int32) {
+	a.emit(bpfStxDW, 10, 1, -16, 0)
+	a.jump(bpfJsleK, 1, 0, 0, "exit")
+	a.header(m, kind)
+	a.emit(bpfStDW, 10, 0, -24, 0)
+	for i := 0; i < uprobeChunks; i++ {
+		clamp, size := fmt.Sprintf("clamp%d", i), fmt.Sprintf("size%d", i)
+		// r2 = min(remaining, uprobeMaxData)
+		a.emit(bpfLdxDW, 2, 10, -16, 0)
+		a.jump(bpfJsleK, 2, 0, 0, "exit")
+		a.jump(bpfJgtK, 2, 0, uprobeMaxData, clamp)
+		a.jump(bpfJa, 0, 0, 0, size)
+		a.label(clamp)
+		a.emit(bpfMovK, 2, 0, 0, uprobeMaxData)
+		a.label(size)
+		a.emit(bpfStxDW, 10, 2, -32, 0)
+		a.emit(bpfStxW, 9, 2, uprobeEvLength, 0)
+		a.emit(bpfLdxDW, 1, 10, -24, 0)
+		a.emit(bpfStxW, 9, 1, uprobeEvOffset, 0)
+		a.emit(bpfMovX, 1, 9, 0, 0)
+		a.emit(bpfAddK, 1, 0, 0, uprobeHeaderLen)
+		a.emit(bpfMovX, 3, 8, 0, 0)
+		a.emit(bpfCall, 0, 0, 0, bpfFuncProbeReadUser)
+		a.jump(bpfJneK, 0, 0, 0, "exit")
+		a.output(m, true)
+		// next chunk
+		a.emit(bpfLdxDW, 1, 10, -32, 0)
+		a.emit(bpfAddX, 8, 1, 0, 0)
+		a.emit(bpfLdxDW, 2, 10, -16, 0)
+		a.emit(bpfSubX, 2, 1, 0, 0)
+		a.emit(bpfStxDW, 10, 2, -16, 0)
+		a.emit(bpfLdxDW, 2, 10, -24, 0)
+		a.emit(bpfAddX, 2, 1, 0, 0)
+		a.emit(bpfStxDW, 10, 2, -24, 0)
+	}
+	a.exit()
+}
+
+// output sends the scratch event, with the data whose length is at fp-32 if withData is true
+func (a *bpfAsm) output(m uprobeMaps, withData bool) {
+	a.emit(bpfMovK, 5, 0, 0, uprobeHeaderLen)
+	if withData {
+		a.emit(bpfLdxDW, 5, 10, -32, 0)
+		a.jump(bpfJgtK, 5, 0, uprobeMaxData, "exit")
+		a.emit(bpfAddK, 5, 0, 0, uprobeHeaderLen)
+	}
+	a.emit(bpfMovX, 1, 6, 0, 0)
+	a.ldMap(2, m.events)
+	a.emit(bpfMov32K, 3, 0, 0, -1) // BPF_F_CURRENT_CPU
+	a.emit(bpfMovX, 4, 9, 0, 0)
+	a.emit(bpfCall, 0, 0, 0, bpfFuncPerfOutput)
+}
+
+func (a *bpfAsm) exit() {
+	a.label("exit")
+	a.emit(bpfMovK, 0, 0, 0, 0)
+	a.emit(bpfExit, 0, 0, 0, 0)
+}
+
+// signExtend extends the sign of the 32 bits int in the register, the upper half of registers holding
+// an int argument is undefined
+func (a *bpfAsm) signExtend(r uint8) {
+	a.emit(bpfLshK, r, 0, 0, 32)
+	a.emit(bpfArshK, r, 0, 0, 32)
+}
+
+// uprobeEntryProgram sends the data passed to a function, the offsets of the registers holding the conn, the
+// address of the data and its length are given. int32 is true if the length is an int of C.
+func uprobeEntryProgram(m uprobeMaps, kind int32, conn, buf, length int16, int32 bool) []bpfInsn {
+	a := new(bpfAsm)
+	a.emit(bpfMovX, 6, 1, 0, 0)
+	a.emit(bpfLdxDW, 7, 6, conn, 0)
+	a.emit(bpfLdxDW, 8, 6, buf, 0)
+	a.emit(bpfLdxDW, 1, 6, length, 0)
+	if int32 {
+		a.signExtend(1)
+	}
+	a.data(m, kind)
+	return a.program()
+}
+
+// uprobeCallProgram saves the conn, the address of the buffer and the address the size is written at, if size
+// isn't negative, of a call whose data are sent on return by the uprobeReturnProgram with the same g
+func uprobeCallProgram(m uprobeMaps, conn, buf, size, g int16) []bpfInsn {
+	a := new(bpfAsm)
+	a.emit(bpfMovX, 6, 1, 0, 0)
+	a.callKey(g)
+	a.emit(bpfLdxDW, 1, 6, conn, 0)
+	a.emit(bpfStxDW, 10, 1, -40, 0)
+	a.emit(bpfLdxDW, 1, 6, buf, 0)
+	a.emit(bpfStxDW, 10, 1, -32, 0)
+	if size < 0 {
+		a.emit(bpfStDW, 10, 0, -24, 0)
+	} else {
+		a.emit(bpfLdxDW, 1, 6, size, 0)
+		a.emit(bpfStxDW, 10, 1, -24, 0)
+	}
+	a.ldMap(1, m.calls)
+	a.emit(bpfMovX, 2, 10, 0, 0)
+	a.emit(bpfAddK, 2, 0, 0, -16)
+	a.emit(bpfMovX, 3, 10, 0, 0)
+	a.emit(bpfAddK, 3, 0, 0, -40)
+	a.emit(bpfMovK, 4, 0, 0, 0) // BPF_ANY
+	a.emit(bpfCall, 0, 0, 0, bpfFuncMapUpdate)
+	a.exit()
+	return a.program()
+}
+
+// uprobeReturnProgram sends the data of the call saved by the uprobeCallProgram, the return value is the length
+// of the data, or 1 on success if the size was saved. int32 is true if the return value is an int of C.
+func uprobeReturnProgram(m uprobeMaps, kind int32, ret int16, int32 bool, g int16) []bpfInsn {
+	a := new(bpfAsm)
+	a.emit(bpfMovX, 6, 1, 0, 0)
+	a.callKey(g)
+	a.ldMap(1, m.calls)
+	a.emit(bpfMovX, 2, 10, 0, 0)
+	a.emit(bpfAddK, 2, 0, 0, -16)
+	a.emit(bpfCall, 0, 0, 0, bpfFuncMapLookup)
+	a.jump(bpfJeqK, 0, 0, 0, "exit")
+	a.emit(bpfLdxDW, 7, 0, 0, 0)
+	a.emit(bpfLdxDW, 8, 0, 8, 0)
+	a.emit(bpfLdxDW, 1, 0, 16, 0)
+	a.emit(bpfStxDW, 10, 1, -24, 0)
+	a.ldMap(1, m.calls)
+	a.emit(bpfMovX, 2, 10, 0, 0)
+	a.emit(bpfAddK, 2, 0, 0, -16)
+	a.emit(bpfCall, 0, 0, 0, bpfFuncMapDelete)
+	a.emit(bpfLdxDW, 1, 6, ret, 0)
+	if int32 {
+		a.signExtend(1)
+	}
+	a.emit(bpfLdxDW, 3, 10, -24, 0)
+	a.jump(bpfJeqK, 3, 0, 0, "length")
+	// the size is written at the saved address on success
+	a.jump(bpfJneK, 1, 0, 1, "exit")
+	a.emit(bpfMovX, 1, 10, 0, 0)
+	a.emit(bpfAddK, 1, 0, 0, -24)
+	a.emit(bpfMovK, 2, 0, 0, 8)
+	a.emit(bpfCall, 0, 0, 0, bpfFuncProbeReadUser)
+	a.jump(bpfJneK, 0, 0, 0, "exit")
+	a.emit(bpfLdxDW, 1, 10, -24, 0)
+	a.label("length")
+	a.data(m, kind)
+	return a.program()
+}
+
+// uprobeSetFdProgram sends the file descriptor the conn is set to, the offsets of the registers holding them are given
+func uprobeSetFdProgram(m uprobeMaps, conn, fd int16) []bpfInsn {
+	a := new(bpfAsm)
+	a.emit(bpfMovX, 6, 1, 0, 0)
+	a.emit(bpfLdxDW, 7, 6, conn, 0)
+	a.emit(bpfLdxDW, 1, 6, fd, 0)
+	a.signExtend(1)
+	a.header(m, uprobeSetFd)
+	a.output(m, false)
+	a.exit()
+	return a.program()
+}
@@ -0,0 +1,40 @@
+package capture
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"golang.org/x/arch/x86/x86asm"
+)
+
+// goReturns returns the offsets of the return instructions of the code of a Go function, compiled for arch.
+// uretprobes can't be used on Go functions, the stack of goroutines is moved when it grows.
+// the instructions are walked from the start of the function, a function holding instructions that can't be
+// decoded(e.g: AVX-512 in assembly) is unsupported, as its return instructions can't be found reliably.
+func goReturns(code []byte, arch string) (offsets []uint64, err error) {
+	switch arch {
+	case "amd64":
+		for off := 0; off < len(code); {
+			inst, err := x86asm.Decode(code[off:], 64)
+			if err != nil {
+				return nil, fmt.Errorf("unsupported instruction at %#x: %v", off, err)
+			}
+			if inst.Op == x86asm.RET {
+				offsets = append(offsets, uint64(off))
+			}
+			off += inst.Len
+		}
+	case "arm64":
+		for off := 0; off+4 <= len(code); off += 4 {
+			if binary.LittleEndian.Uint32(code[off:]) == 0xd65f03c0 {
+				offsets = append(offsets, uint64(off))
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unsupported architecture %s", arch)
+	}
+	if len(offsets) == 0 {
+		return nil, fmt.Errorf("no return instruction found")
+	}
+	return offsets, nil
+}
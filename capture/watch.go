@@ -0,0 +1,117 @@
+package capture
+
+import (
+	"strings"
+	"time"
+
+	"github.com/google/gopacket"
+	"golang.org/x/sys/unix"
+)
+
+// watch attaches the interfaces of the host appearing and detaches those disappearing, at each
+// PcapOptions.WatchInterfaces interval until the listener quits. the interfaces are looked up in the
+// network namespace the listener was activated in.
+func (l *Listener) watch(handler Handler) {
+	ticker := time.NewTicker(l.WatchInterfaces)
+	defer ticker.Stop()
+	defer unix.Close(l.netns)
+	for {
+		select {
+		case <-l.quit:
+			l.Lock()
+			l.watching = false
+			if l.readers == 0 {
+				close(l.packets)
+			}
+			l.Unlock()
+			return
+		case <-ticker.C:
+		}
+		err := withNetnsFd(l.netns, func() error {
+			ifis, err := l.listInterfaces()
+			if err == nil {
+				ifis, err = l.matchInterfaces(ifis)
+			}
+			if err == nil {
+				l.attach(ifis, handler)
+			}
+			return err
+		})
+		if err != nil {
+			l.debug(1, "[CAPTURE] interfaces error:", err)
+		}
+	}
+}
+
+// attach opens the handles of the interfaces of ifis not captured yet, and closes the handles of the
+// captured interfaces missing from ifis. an interface created again under the same name has a new index.
+func (l *Listener) attach(ifis []NetInterface, handler Handler) {
+	var detached []gopacket.PacketDataSource
+	l.Lock()
+	defer func() {
+		l.Unlock()
+		// the reads of the handles are given a chance to fail before they are closed
+		for _, handle := range detached {
+			go closeSource(handle)
+		}
+	}()
+	var attached []NetInterface
+	for _, ifi := range l.Interfaces {
+		if hasInterface(ifis, ifi) {
+			attached = append(attached, ifi)
+			continue
+		}
+		for key, handle := range l.Handles {
+			if key == ifi.Name || strings.HasPrefix(key, ifi.Name+":") {
+				detached = append(detached, handle)
+				delete(l.Handles, key)
+				delete(l.stats, key)
+			}
+		}
+		l.debug(1, "[CAPTURE] detached interface", ifi.Name)
+	}
+	for _, ifi := range ifis {
+		if hasInterface(attached, ifi) {
+			continue
+		}
+		handles, err := l.open(ifi)
+		if err != nil {
+			l.debug(1, "[CAPTURE] attach error:", err)
+		}
+		if len(handles) == 0 {
+			continue
+		}
+		for key, handle := range handles {
+			l.Handles[key] = handle
+			l.readHandle(key, handle, handler)
+		}
+		attached = append(attached, ifi)
+		l.debug(1, "[CAPTURE] attached interface", ifi.Name)
+	}
+	l.Interfaces = attached
+}
+
+func hasInterface(ifis []NetInterface, ifi NetInterface) bool {
+	for _, v := range ifis {
+		if v.Name == ifi.Name && v.Index == ifi.Index {
+			return true
+		}
+	}
+	return false
+}
+
+// closeSource closes a packet source whatever the signature of its Close method
+func closeSource(handle gopacket.PacketDataSource) {
+	switch h := handle.(type) {
+	case interface{ Close() }:
+		h.Close()
+	case interface{ Close() error }:
+		h.Close()
+	}
+}
+
+func (l *Listener) debug(level int, data ...interface{}) {
+	if l.Debugger != nil {
+		go l.Debugger(level, data...)
+	}
+}
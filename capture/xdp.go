@@ -0,0 +1,377 @@
+package capture
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/google/gopacket"
+)
+
+// default settings of the AF_XDP sockets
+const (
+	// XDPFRAMESIZE size of the frames of the umem, a frame holds a single packet
+	XDPFRAMESIZE = 1 << 11
+	// XDPFRAMENR default number of frames of the umem of each receive queue
+	XDPFRAMENR = 1 << 12
+)
+
+// XDPProgram is an XDP program attached to an interface, redirecting the tcp packets of a port
+// to the AF_XDP sockets of the receive queues of the interface. it is detached once all its sockets are closed.
+type XDPProgram struct {
+	mu       sync.Mutex
+	ifindex  int
+	queues   int
+	xsks     int // xskmap fd
+	prog     int // program fd
+	flags    uint32
+	refs     int
+	attached bool
+	netns    int // network namespace of the interface, the program is detached from it
+}
+
+// NewXDPProgram loads an XDP program for the queues receive queues of the interface, redirecting the tcp packets
+// sent to port, or sent from port too if trackResponse is true. port 0 redirects all the tcp packets.
+func NewXDPProgram(ifi net.Interface, queues int, port uint16, trackResponse bool) (*XDPProgram, error) {
+	// locked memory is accounted with the rlimit before linux 5.11
+	_ = unix.Setrlimit(unix.RLIMIT_MEMLOCK, &unix.Rlimit{Cur: unix.RLIM_INFINITY, Max: unix.RLIM_INFINITY})
+	var err error
+	p := &XDPProgram{ifindex: ifi.Index, queues: queues, flags: unix.XDP_FLAGS_UPDATE_IF_NOEXIST}
+	runtime.LockOSThread()
+	p.netns, err = currentNetns()
+	runtime.UnlockOSThread()
+	if err != nil {
+		return nil, err
+	}
+	p.xsks, err = bpfXSKMap(queues)
+	if err != nil {
+		unix.Close(p.netns)
+		return nil, fmt.Errorf("xskmap create error: %v", err)
+	}
+	p.prog, err = bpfLoadXDP(xdpProgram(p.xsks, port, trackResponse))
+	if err != nil {
+		unix.Close(p.netns)
+		unix.Close(p.xsks)
+		return nil, fmt.Errorf("xdp program load error: %v", err)
+	}
+	return p, nil
+}
+
+// Attach attaches the program to the interface, it fails if another XDP program is attached.
+// the packets are redirected only to the sockets of the queues registered with Socket.
+func (p *XDPProgram) Attach() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	err := xdpAttach(p.ifindex, p.prog, p.flags)
+	if err != nil {
+		return fmt.Errorf("xdp attach error: %v", err)
+	}
+	p.attached = true
+	return nil
+}
+
+// Socket returns a new AF_XDP socket receiving the packets redirected from queue, with a umem of frames
+// frames, zero uses the default.
+func (p *XDPProgram) Socket(queue, frames int) (*SockXDP, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if queue >= p.queues {
+		return nil, fmt.Errorf("queue %d out of range 0-%d", queue, p.queues-1)
+	}
+	sock, err := newSockXDP(p.ifindex, queue, frames)
+	if err != nil {
+		return nil, err
+	}
+	if err = bpfMapUpdate(p.xsks, uint32(queue), uint32(sock.fd)); err != nil {
+		sock.close()
+		return nil, fmt.Errorf("xskmap update error: %v", err)
+	}
+	sock.prog = p
+	p.refs++
+	return sock, nil
+}
+
+// Close detaches the program and releases it, sockets should be closed instead.
+func (p *XDPProgram) Close() (err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.close()
+}
+
+func (p *XDPProgram) close() (err error) {
+	if p.prog == -1 {
+		return
+	}
+	if p.attached {
+		// the listener may have been activated in another network namespace, see WithNetns
+		err = withNetnsFd(p.netns, func() error {
+			return xdpAttach(p.ifindex, -1, p.flags&^unix.XDP_FLAGS_UPDATE_IF_NOEXIST)
+		})
+		p.attached = false
+	}
+	unix.Close(p.prog)
+	unix.Close(p.xsks)
+	unix.Close(p.netns)
+	p.prog, p.xsks, p.netns = -1, -1, -1
+	return
+}
+
+// release removes the socket of queue from the xskmap, the kernel keeps the socket bound to the queue
+// as long as it is referenced by the map.
+func (p *XDPProgram) release(queue int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.xsks != -1 {
+		bpfMapDelete(p.xsks, uint32(queue))
+	}
+	p.refs--
+	if p.refs == 0 {
+		p.close()
+	}
+}
+
+// xdpRing is a single producer single consumer ring shared with the kernel
+type xdpRing struct {
+	mem      []byte
+	producer *uint32
+	consumer *uint32
+	descs    uint64 // offset of the descriptors in mem
+	mask     uint32
+}
+
+func (r *xdpRing) desc(i uint32) *unix.XDPDesc {
+	return (*unix.XDPDesc)(unsafe.Pointer(&r.mem[r.descs+uint64(i&r.mask)*uint64(unsafe.Sizeof(unix.XDPDesc{}))]))
+}
+
+func (r *xdpRing) addr(i uint32) *uint64 {
+	return (*uint64)(unsafe.Pointer(&r.mem[r.descs+uint64(i&r.mask)*8]))
+}
+
+// SockXDP is an AF_XDP socket receiving the packets redirected by an XDP program from a receive queue
+type SockXDP struct {
+	received    uint64 // packets read, first for the alignment of atomic operations
+	mu          sync.Mutex
+	ctl         sync.Mutex // guards fd against Close for the calls made while a read is blocked
+	fd          int
+	ifindex     int
+	queue       int
+	pollTimeout uintptr
+	umem        []byte
+	rx          xdpRing
+	fill        xdpRing
+	comp        xdpRing
+	prog        *XDPProgram
+}
+
+func newSockXDP(ifindex, queue, frames int) (sock *SockXDP, err error) {
+	if frames <= 0 {
+		frames = XDPFRAMENR
+	}
+	// rings sizes must be powers of 2
+	for frames&(frames-1) != 0 {
+		frames &= frames - 1
+	}
+	fd, err := unix.Socket(unix.AF_XDP, unix.SOCK_RAW|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("af_xdp socket error: %v", err)
+	}
+	sock = &SockXDP{fd: fd, ifindex: ifindex, queue: queue, pollTimeout: ^uintptr(0)}
+	defer func() {
+		if err != nil {
+			sock.close()
+		}
+	}()
+	sock.umem, err = unix.Mmap(-1, 0, frames*XDPFRAMESIZE, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS|unix.MAP_POPULATE)
+	if err != nil {
+		return sock, fmt.Errorf("umem mmap error: %v", err)
+	}
+	reg := unix.XDPUmemReg{
+		Addr: uint64(uintptr(unsafe.Pointer(&sock.umem[0]))),
+		Len:  uint64(len(sock.umem)),
+		Size: XDPFRAMESIZE,
+	}
+	if err = setsockopt(fd, unix.XDP_UMEM_REG, unsafe.Pointer(&reg), unsafe.Sizeof(reg)); err != nil {
+		return sock, fmt.Errorf("setsockopt xdp_umem_reg: %v", err)
+	}
+	for _, opt := range []int{unix.XDP_UMEM_FILL_RING, unix.XDP_UMEM_COMPLETION_RING, unix.XDP_RX_RING} {
+		if err = unix.SetsockoptInt(fd, unix.SOL_XDP, opt, frames); err != nil {
+			return sock, fmt.Errorf("setsockopt xdp ring %d: %v", opt, err)
+		}
+	}
+	var off unix.XDPMmapOffsets
+	n := uint32(unsafe.Sizeof(off))
+	_, _, e := unix.Syscall6(unix.SYS_GETSOCKOPT, uintptr(fd), unix.SOL_XDP, unix.XDP_MMAP_OFFSETS, uintptr(unsafe.Pointer(&off)), uintptr(unsafe.Pointer(&n)), 0)
+	if e != 0 {
+		return sock, fmt.Errorf("getsockopt xdp_mmap_offsets: %v", e)
+	}
+	if err = sock.rx.mmap(fd, unix.XDP_PGOFF_RX_RING, off.Rx, frames, unsafe.Sizeof(unix.XDPDesc{})); err != nil {
+		return sock, err
+	}
+	if err = sock.fill.mmap(fd, unix.XDP_UMEM_PGOFF_FILL_RING, off.Fr, frames, 8); err != nil {
+		return sock, err
+	}
+	if err = sock.comp.mmap(fd, unix.XDP_UMEM_PGOFF_COMPLETION_RING, off.Cr, frames, 8); err != nil {
+		return sock, err
+	}
+	// all the frames are given to the kernel to be filled
+	for i := 0; i < frames; i++ {
+		*sock.fill.addr(uint32(i)) = uint64(i * XDPFRAMESIZE)
+	}
+	atomic.StoreUint32(sock.fill.producer, uint32(frames))
+	// the queue of a closed socket is released asynchronously by the kernel
+	for i := 0; i < 100; i++ {
+		err = unix.Bind(fd, &unix.SockaddrXDP{Ifindex: uint32(ifindex), QueueID: uint32(queue)})
+		if err != unix.EBUSY {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if err != nil {
+		return sock, fmt.Errorf("af_xdp bind error: %v", err)
+	}
+	return sock, nil
+}
+
+func (r *xdpRing) mmap(fd int, pgoff int64, off unix.XDPRingOffset, entries int, size uintptr) (err error) {
+	r.mem, err = unix.Mmap(fd, pgoff, int(off.Desc)+entries*int(size), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+	if err != nil {
+		return fmt.Errorf("xdp ring mmap error: %v", err)
+	}
+	r.producer = (*uint32)(unsafe.Pointer(&r.mem[off.Producer]))
+	r.consumer = (*uint32)(unsafe.Pointer(&r.mem[off.Consumer]))
+	r.descs = off.Desc
+	r.mask = uint32(entries - 1)
+	return nil
+}
+
+// ReadPacketData implements gopacket.PacketDataSource. the packets are timestamped when read.
+func (sock *SockXDP) ReadPacketData() (buf []byte, ci gopacket.CaptureInfo, err error) {
+	sock.mu.Lock()
+	defer sock.mu.Unlock()
+	if sock.fd == -1 {
+		return nil, ci, unix.EBADF
+	}
+	poll := &unix.PollFd{
+		Fd:     int32(sock.fd),
+		Events: unix.POLLIN,
+	}
+	cons := *sock.rx.consumer
+	for atomic.LoadUint32(sock.rx.producer) == cons {
+		_, _, e := unix.Syscall(unix.SYS_POLL, uintptr(unsafe.Pointer(poll)), 1, sock.pollTimeout)
+		if e != 0 && e != unix.EINTR {
+			return buf, ci, e
+		}
+	}
+	desc := sock.rx.desc(cons)
+	buf = make([]byte, desc.Len)
+	copy(buf, sock.umem[desc.Addr:])
+	frame := desc.Addr &^ (XDPFRAMESIZE - 1)
+	atomic.StoreUint32(sock.rx.consumer, cons+1)
+	atomic.AddUint64(&sock.received, 1)
+
+	// the frame is given back to the kernel
+	prod := *sock.fill.producer
+	*sock.fill.addr(prod) = frame
+	atomic.StoreUint32(sock.fill.producer, prod+1)
+
+	ci.Timestamp = time.Now()
+	ci.Length = len(buf)
+	ci.CaptureLength = len(buf)
+	ci.InterfaceIndex = sock.ifindex
+	return
+}
+
+// SetTimeout sets poll wait timeout for the socket.
+// negative value will block forever
+func (sock *SockXDP) SetTimeout(t time.Duration) error {
+	sock.mu.Lock()
+	defer sock.mu.Unlock()
+	sock.pollTimeout = uintptr(t)
+	return nil
+}
+
+// Stats returns the number of packets dropped because the rx ring was full, and the number of invalid descriptors.
+func (sock *SockXDP) Stats() (*unix.XDPStatistics, error) {
+	sock.ctl.Lock()
+	defer sock.ctl.Unlock()
+	if sock.fd == -1 {
+		return nil, unix.EBADF
+	}
+	var stats unix.XDPStatistics
+	n := uint32(unsafe.Sizeof(stats))
+	_, _, e := unix.Syscall6(unix.SYS_GETSOCKOPT, uintptr(sock.fd), unix.SOL_XDP, unix.XDP_STATISTICS, uintptr(unsafe.Pointer(&stats)), uintptr(unsafe.Pointer(&n)), 0)
+	if e != 0 {
+		return nil, e
+	}
+	return &stats, nil
+}
+
+// Received returns the number of packets read from the socket
+func (sock *SockXDP) Received() uint64 {
+	return atomic.LoadUint64(&sock.received)
+}
+
+// Close closes the socket, the XDP program is detached with its last socket.
+func (sock *SockXDP) Close() (err error) {
+	sock.mu.Lock()
+	defer sock.mu.Unlock()
+	sock.ctl.Lock()
+	defer sock.ctl.Unlock()
+	if sock.fd == -1 {
+		return
+	}
+	if sock.prog != nil {
+		sock.prog.release(sock.queue)
+	}
+	return sock.close()
+}
+
+func (sock *SockXDP) close() error {
+	for _, r := range []*xdpRing{&sock.rx, &sock.fill, &sock.comp} {
+		if r.mem != nil {
+			unix.Munmap(r.mem)
+			r.mem = nil
+		}
+	}
+	err := unix.Close(sock.fd)
+	sock.fd = -1
+	if sock.umem != nil {
+		unix.Munmap(sock.umem)
+		sock.umem = nil
+	}
+	return err
+}
+
+func setsockopt(fd, opt int, value unsafe.Pointer, size uintptr) error {
+	_, _, e := unix.Syscall6(unix.SYS_SETSOCKOPT, uintptr(fd), unix.SOL_XDP, uintptr(opt), uintptr(value), size, 0)
+	if e != 0 {
+		return e
+	}
+	return nil
+}
+
+// RxQueues returns the number of receive queues of the interface
+func RxQueues(name string) int {
+	files, err := ioutil.ReadDir("/sys/class/net/" + name + "/queues")
+	if err != nil {
+		return 1
+	}
+	n := 0
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), "rx-") {
+			n++
+		}
+	}
+	if n == 0 {
+		return 1
+	}
+	return n
+}
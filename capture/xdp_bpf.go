@@ -0,0 +1,337 @@
+package capture
+
+import (
+	"encoding/binary"
+	"fmt"
+	"runtime"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// eBPF opcodes used by the XDP program, see linux/bpf.h and linux/bpf_common.h
+const (
+	bpfLdxW    = 0x61 // BPF_LDX | BPF_MEM | BPF_W
+	bpfLdxH    = 0x69 // BPF_LDX | BPF_MEM | BPF_H
+	bpfLdxB    = 0x71 // BPF_LDX | BPF_MEM | BPF_B
+	bpfLdImm64 = 0x18 // BPF_LD | BPF_IMM | BPF_DW
+	bpfMovX    = 0xbf // BPF_ALU64 | BPF_MOV | BPF_X
+	bpfMovK    = 0xb7 // BPF_ALU64 | BPF_MOV | BPF_K
+	bpfAddX    = 0x0f // BPF_ALU64 | BPF_ADD | BPF_X
+	bpfAddK    = 0x07 // BPF_ALU64 | BPF_ADD | BPF_K
+	bpfAndK    = 0x57 // BPF_ALU64 | BPF_AND | BPF_K
+	bpfLshK    = 0x67 // BPF_ALU64 | BPF_LSH | BPF_K
+	bpfJa      = 0x05 // BPF_JMP | BPF_JA
+	bpfJeqK    = 0x15 // BPF_JMP | BPF_JEQ | BPF_K
+	bpfJneK    = 0x55 // BPF_JMP | BPF_JNE | BPF_K
+	bpfJgtX    = 0x2d // BPF_JMP | BPF_JGT | BPF_X
+	bpfCall    = 0x85 // BPF_JMP | BPF_CALL
+	bpfExit    = 0x95 // BPF_JMP | BPF_EXIT
+
+	bpfFuncRedirectMap = 51
+	xdpPass            = 2
+	xdpIPv6Extensions  = 4 // extension headers walked by the XDP program before giving up on a packet
+
+	// nested attributes of IFLA_XDP, see linux/if_link.h
+	iflaXDPFd    = 1
+	iflaXDPFlags = 3
+)
+
+// nativeEndian is the byte order of the host, packets are loaded by the XDP program in this order
+var nativeEndian binary.ByteOrder = binary.LittleEndian
+
+func init() {
+	i := uint16(1)
+	if (*[2]byte)(unsafe.Pointer(&i))[0] == 0 {
+		nativeEndian = binary.BigEndian
+	}
+}
+
+// htons returns the value a 16 bits load of the network ordered v gives on the host
+func htons(v uint16) int32 {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], v)
+	return int32(nativeEndian.Uint16(b[:]))
+}
+
+type bpfInsn struct {
+	code uint8
+	regs uint8 // src<<4 | dst
+	off  int16
+	imm  int32
+}
+
+// bpfAsm assembles an eBPF program, jumps are made to labels resolved by program
+type bpfAsm struct {
+	insns  []bpfInsn
+	labels map[string]int
+	jumps  map[int]string
+}
+
+func (a *bpfAsm) emit(code, dst, src uint8, off int16, imm int32) {
+	a.insns = append(a.insns, bpfInsn{code, src<<4 | dst, off, imm})
+}
+
+func (a *bpfAsm) jump(code, dst, src uint8, imm int32, label string) {
+	if a.jumps == nil {
+		a.jumps = make(map[int]string)
+	}
+	a.jumps[len(a.insns)] = label
+	a.emit(code, dst, src, 0, imm)
+}
+
+func (a *bpfAsm) label(name string) {
+	if a.labels == nil {
+		a.labels = make(map[string]int)
+	}
+	a.labels[name] = len(a.insns)
+}
+
+func (a *bpfAsm) program() []bpfInsn {
+	for i, label := range a.jumps {
+		a.insns[i].off = int16(a.labels[label] - i - 1)
+	}
+	return a.insns
+}
+
+// xdpProgram returns an XDP program redirecting the tcp packets with the destination port(or the source port
+// if trackResponse is true) to the AF_XDP socket of their receive queue found in the xskmap xsks, the other
+// packets are passed to the network stack. port 0 redirects all the tcp packets.
+func xdpProgram(xsks int, port uint16, trackResponse bool) []bpfInsn {
+	a := new(bpfAsm)
+	// r6 = ctx, r2 = data, r3 = data_end
+	a.emit(bpfMovX, 6, 1, 0, 0)
+	a.emit(bpfLdxW, 2, 6, 0, 0)
+	a.emit(bpfLdxW, 3, 6, 4, 0)
+	// ethernet
+	a.emit(bpfMovX, 4, 2, 0, 0)
+	a.emit(bpfAddK, 4, 0, 0, 14)
+	a.jump(bpfJgtX, 4, 3, 0, "pass")
+	a.emit(bpfLdxH, 5, 2, 12, 0)
+	a.jump(bpfJeqK, 5, 0, htons(0x0800), "ipv4")
+	a.jump(bpfJeqK, 5, 0, htons(0x86dd), "ipv6")
+	a.jump(bpfJa, 0, 0, 0, "pass")
+	// ipv4, r2 = tcp header
+	a.label("ipv4")
+	a.emit(bpfMovX, 4, 2, 0, 0)
+	a.emit(bpfAddK, 4, 0, 0, 34)
+	a.jump(bpfJgtX, 4, 3, 0, "pass")
+	a.emit(bpfLdxB, 5, 2, 23, 0)
+	a.jump(bpfJneK, 5, 0, 6, "pass")
+	// fragments other than the first don't carry the tcp header, they are reassembled by the tcp pool
+	a.emit(bpfLdxH, 5, 2, 20, 0)
+	a.emit(bpfAndK, 5, 0, 0, htons(0x1fff))
+	a.jump(bpfJneK, 5, 0, 0, "redirect")
+	a.emit(bpfLdxB, 5, 2, 14, 0)
+	a.emit(bpfAndK, 5, 0, 0, 0xf)
+	a.emit(bpfLshK, 5, 0, 0, 2)
+	a.emit(bpfAddK, 2, 0, 0, 14)
+	a.emit(bpfAddX, 2, 5, 0, 0)
+	a.jump(bpfJa, 0, 0, 0, "tcp")
+	// ipv6, r5 = next header, r2 = header following the ipv6 one
+	a.label("ipv6")
+	a.emit(bpfMovX, 4, 2, 0, 0)
+	a.emit(bpfAddK, 4, 0, 0, 54)
+	a.jump(bpfJgtX, 4, 3, 0, "pass")
+	a.emit(bpfLdxB, 5, 2, 20, 0)
+	a.emit(bpfAddK, 2, 0, 0, 54)
+	// the extension headers are walked up to the tcp header, the loop is unrolled for the verifier
+	for i := 0; i <= xdpIPv6Extensions; i++ {
+		a.jump(bpfJeqK, 5, 0, 6, "tcp")
+		if i == xdpIPv6Extensions {
+			break
+		}
+		// all the fragments are reassembled by the tcp pool
+		a.jump(bpfJeqK, 5, 0, 44, "redirect")
+		next := fmt.Sprintf("ipv6ext%d", i)
+		a.jump(bpfJeqK, 5, 0, 0, next)
+		a.jump(bpfJeqK, 5, 0, 43, next)
+		a.jump(bpfJeqK, 5, 0, 60, next)
+		a.jump(bpfJa, 0, 0, 0, "pass")
+		// hop-by-hop, routing and destination options headers, r4 = (length + 1) * 8
+		a.label(next)
+		a.emit(bpfMovX, 4, 2, 0, 0)
+		a.emit(bpfAddK, 4, 0, 0, 8)
+		a.jump(bpfJgtX, 4, 3, 0, "pass")
+		a.emit(bpfLdxB, 5, 2, 0, 0)
+		a.emit(bpfLdxB, 4, 2, 1, 0)
+		a.emit(bpfAddK, 4, 0, 0, 1)
+		a.emit(bpfLshK, 4, 0, 0, 3)
+		a.emit(bpfAddX, 2, 4, 0, 0)
+	}
+	a.jump(bpfJa, 0, 0, 0, "pass")
+	// tcp ports
+	a.label("tcp")
+	a.emit(bpfMovX, 4, 2, 0, 0)
+	a.emit(bpfAddK, 4, 0, 0, 4)
+	a.jump(bpfJgtX, 4, 3, 0, "pass")
+	if port != 0 {
+		a.emit(bpfLdxH, 5, 2, 2, 0)
+		a.jump(bpfJeqK, 5, 0, htons(port), "redirect")
+		if trackResponse {
+			a.emit(bpfLdxH, 5, 2, 0, 0)
+			a.jump(bpfJeqK, 5, 0, htons(port), "redirect")
+		}
+		a.jump(bpfJa, 0, 0, 0, "pass")
+	}
+	// bpf_redirect_map(xsks, ctx->rx_queue_index, XDP_PASS)
+	a.label("redirect")
+	a.emit(bpfLdxW, 2, 6, 16, 0)
+	a.emit(bpfLdImm64, 1, unix.BPF_PSEUDO_MAP_FD, 0, int32(xsks))
+	a.emit(0, 0, 0, 0, 0)
+	a.emit(bpfMovK, 3, 0, 0, xdpPass)
+	a.emit(bpfCall, 0, 0, 0, bpfFuncRedirectMap)
+	a.emit(bpfExit, 0, 0, 0, 0)
+	a.label("pass")
+	a.emit(bpfMovK, 0, 0, 0, xdpPass)
+	a.emit(bpfExit, 0, 0, 0, 0)
+	return a.program()
+}
+
+func bpf(cmd int, attr unsafe.Pointer, size uintptr) (int, error) {
+	r, _, e := unix.Syscall(unix.SYS_BPF, uintptr(cmd), uintptr(attr), size)
+	if e != 0 {
+		return -1, e
+	}
+	return int(r), nil
+}
+
+// bpfMapCreate creates a map of the type, with entries keys and values of the given sizes
+func bpfMapCreate(mapType, keySize, valueSize, entries int) (int, error) {
+	attr := struct {
+		mapType, keySize, valueSize, maxEntries, mapFlags uint32
+	}{uint32(mapType), uint32(keySize), uint32(valueSize), uint32(entries), 0}
+	return bpf(unix.BPF_MAP_CREATE, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+}
+
+// bpfXSKMap creates a map of entries AF_XDP sockets indexed by receive queue
+func bpfXSKMap(entries int) (int, error) {
+	return bpfMapCreate(unix.BPF_MAP_TYPE_XSKMAP, 4, 4, entries)
+}
+
+// bpfMapUpdate sets the value of key in the map of 32 bits keys and values
+func bpfMapUpdate(fd int, key, value uint32) error {
+	attr := struct {
+		mapFd uint32
+		_     uint32
+		key   uint64
+		value uint64
+		flags uint64
+	}{mapFd: uint32(fd), key: uint64(uintptr(unsafe.Pointer(&key))), value: uint64(uintptr(unsafe.Pointer(&value)))}
+	_, err := bpf(unix.BPF_MAP_UPDATE_ELEM, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(&key)
+	runtime.KeepAlive(&value)
+	return err
+}
+
+// bpfMapDelete deletes key from the map of 32 bits keys
+func bpfMapDelete(fd int, key uint32) error {
+	attr := struct {
+		mapFd uint32
+		_     uint32
+		key   uint64
+		value uint64
+		flags uint64
+	}{mapFd: uint32(fd), key: uint64(uintptr(unsafe.Pointer(&key)))}
+	_, err := bpf(unix.BPF_MAP_DELETE_ELEM, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(&key)
+	return err
+}
+
+// bpfLoadXDP loads the XDP program, the verifier log is returned with the error
+func bpfLoadXDP(insns []bpfInsn) (int, error) {
+	return bpfLoad(unix.BPF_PROG_TYPE_XDP, 0, insns)
+}
+
+// bpfLoad loads a program of the type, kernVersion is checked by kprobe programs before linux 5.0
+func bpfLoad(progType int, kernVersion uint32, insns []bpfInsn) (int, error) {
+	license := []byte("GPL\x00")
+	log := make([]byte, 1<<16)
+	attr := struct {
+		progType    uint32
+		insnCnt     uint32
+		insns       uint64
+		license     uint64
+		logLevel    uint32
+		logSize     uint32
+		logBuf      uint64
+		kernVersion uint32
+		progFlags   uint32
+		progName    [16]byte
+	}{
+		progType:    uint32(progType),
+		insnCnt:     uint32(len(insns)),
+		insns:       uint64(uintptr(unsafe.Pointer(&insns[0]))),
+		license:     uint64(uintptr(unsafe.Pointer(&license[0]))),
+		logLevel:    1,
+		logSize:     uint32(len(log)),
+		logBuf:      uint64(uintptr(unsafe.Pointer(&log[0]))),
+		kernVersion: kernVersion,
+	}
+	copy(attr.progName[:], "goreplay")
+	fd, err := bpf(unix.BPF_PROG_LOAD, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(insns)
+	runtime.KeepAlive(license)
+	runtime.KeepAlive(log)
+	if err != nil {
+		if n := clen(log); n > 0 {
+			return -1, fmt.Errorf("%v: %s", err, log[:n])
+		}
+		return -1, err
+	}
+	return fd, nil
+}
+
+// xdpAttach attaches the XDP program progFd to the interface, a negative progFd detaches the current program
+func xdpAttach(ifindex, progFd int, flags uint32) error {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	msg := make([]byte, unix.NLMSG_HDRLEN+unix.SizeofIfInfomsg+20)
+	nativeEndian.PutUint32(msg[0:], uint32(len(msg)))
+	nativeEndian.PutUint16(msg[4:], unix.RTM_SETLINK)
+	nativeEndian.PutUint16(msg[6:], unix.NLM_F_REQUEST|unix.NLM_F_ACK)
+	nativeEndian.PutUint32(msg[8:], 1)
+	ifinfo := msg[unix.NLMSG_HDRLEN:]
+	ifinfo[0] = unix.AF_UNSPEC
+	nativeEndian.PutUint32(ifinfo[4:], uint32(ifindex))
+	attr := ifinfo[unix.SizeofIfInfomsg:]
+	nativeEndian.PutUint16(attr[0:], 20)
+	nativeEndian.PutUint16(attr[2:], unix.IFLA_XDP|unix.NLA_F_NESTED)
+	nativeEndian.PutUint16(attr[4:], 8)
+	nativeEndian.PutUint16(attr[6:], iflaXDPFd)
+	nativeEndian.PutUint32(attr[8:], uint32(int32(progFd)))
+	nativeEndian.PutUint16(attr[12:], 8)
+	nativeEndian.PutUint16(attr[14:], iflaXDPFlags)
+	nativeEndian.PutUint32(attr[16:], flags)
+
+	if err = unix.Sendto(fd, msg, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return err
+	}
+	buf := make([]byte, 4096)
+	n, _, err := unix.Recvfrom(fd, buf, 0)
+	if err != nil {
+		return err
+	}
+	if n < unix.NLMSG_HDRLEN+4 || nativeEndian.Uint16(buf[4:]) != unix.NLMSG_ERROR {
+		return fmt.Errorf("unexpected netlink reply")
+	}
+	if errno := int32(nativeEndian.Uint32(buf[unix.NLMSG_HDRLEN:])); errno != 0 {
+		return syscall.Errno(-errno)
+	}
+	return nil
+}
+
+// clen returns the length of the null terminated string in b
+func clen(b []byte) int {
+	for i := 0; i < len(b); i++ {
+		if b[i] == 0 {
+			return i
+		}
+	}
+	return len(b)
+}
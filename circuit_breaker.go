@@ -0,0 +1,100 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	circuitClosed = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+// circuitBreaker sheds the requests to a target while it fails: the circuit opens when the ratio of the failed
+// requests in a window of time reaches the threshold, with minRequests requests at least. while it is open the
+// requests are dropped, and after the cooldown a single request probes the target, closing the circuit if it
+// succeeds or opening it again if it fails
+type circuitBreaker struct {
+	name        string
+	threshold   float64
+	minRequests int
+	window      time.Duration
+	cooldown    time.Duration
+
+	mu          sync.Mutex
+	state       int
+	requests    int
+	failures    int
+	windowStart time.Time
+	openedAt    time.Time
+	probing     bool
+}
+
+func newCircuitBreaker(name string, threshold float64, minRequests int, window, cooldown time.Duration) *circuitBreaker {
+	if minRequests <= 0 {
+		minRequests = 1
+	}
+	if window <= 0 {
+		window = 10 * time.Second
+	}
+	if cooldown <= 0 {
+		cooldown = 30 * time.Second
+	}
+	return &circuitBreaker{name: name, threshold: threshold, minRequests: minRequests, window: window, cooldown: cooldown, windowStart: time.Now()}
+}
+
+// allow reports whether a request can be sent to the target
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case circuitOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = circuitHalfOpen
+		b.probing = true
+		return true
+	case circuitHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+	}
+	return true
+}
+
+// record records the outcome of a request allowed
+func (b *circuitBreaker) record(failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	switch b.state {
+	case circuitHalfOpen:
+		b.probing = false
+		if failed {
+			b.state = circuitOpen
+			b.openedAt = now
+			log.Printf("[OUTPUT-HTTP] the circuit of %s is open again, the probe failed", b.name)
+			return
+		}
+		b.state = circuitClosed
+		b.requests, b.failures, b.windowStart = 0, 0, now
+		log.Printf("[OUTPUT-HTTP] the circuit of %s is closed", b.name)
+	case circuitClosed:
+		if now.Sub(b.windowStart) >= b.window {
+			b.requests, b.failures, b.windowStart = 0, 0, now
+		}
+		b.requests++
+		if failed {
+			b.failures++
+		}
+		if b.requests >= b.minRequests && float64(b.failures) >= b.threshold*float64(b.requests) {
+			b.state = circuitOpen
+			b.openedAt = now
+			log.Printf("[OUTPUT-HTTP] the circuit of %s is open, %d of %d requests failed, the requests are dropped for %s", b.name, b.failures, b.requests, b.cooldown)
+		}
+	}
+}
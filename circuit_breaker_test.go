@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	b := newCircuitBreaker("test", 0.5, 4, time.Minute, 10*time.Millisecond)
+	for _, failed := range []bool{false, true, false, true} {
+		if !b.allow() {
+			t.Fatal("expected the circuit to be closed")
+		}
+		b.record(failed)
+	}
+	if b.allow() {
+		t.Fatal("expected the circuit to open once half of the requests failed")
+	}
+
+	// a single request probes the target after the cooldown
+	time.Sleep(20 * time.Millisecond)
+	if !b.allow() || b.allow() {
+		t.Fatal("expected a single probe")
+	}
+	b.record(true)
+	if b.allow() {
+		t.Fatal("expected the circuit to open again once the probe failed")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if !b.allow() {
+		t.Fatal("expected a probe")
+	}
+	b.record(false)
+	if !b.allow() || !b.allow() {
+		t.Fatal("expected the circuit to close once the probe succeeded")
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dnsResolver resolves the hosts of the targets of an output: the hosts of the static overrides are resolved to
+// their addresses, the others with the DNS server of the output, or the resolver of the system without one. with
+// a ttl the addresses are cached for this long, otherwise each connection resolves its host
+type dnsResolver struct {
+	resolver *net.Resolver
+	hosts    map[string][]string // the static overrides
+	ttl      time.Duration
+
+	mu    sync.Mutex
+	cache map[string]dnsCached
+}
+
+type dnsCached struct {
+	addrs   []string
+	expires time.Time
+}
+
+// newDNSResolver returns the resolver of the DNS server, host or host:port, the overrides, host=ip[,ip...], and
+// the ttl of the cache. it returns nil without any of them, the resolution of the system
+func newDNSResolver(server string, overrides []string, ttl time.Duration) (*dnsResolver, error) {
+	if server == "" && len(overrides) == 0 && ttl <= 0 {
+		return nil, nil
+	}
+	r := &dnsResolver{resolver: net.DefaultResolver, hosts: make(map[string][]string), ttl: ttl, cache: make(map[string]dnsCached)}
+	if server != "" {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+		r.resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, server)
+			},
+		}
+	}
+	for _, override := range overrides {
+		host, ips := override, ""
+		if i := strings.Index(override, "="); i > 0 {
+			host, ips = override[:i], override[i+1:]
+		}
+		if ips == "" {
+			return nil, fmt.Errorf("invalid host override %q, expected host=ip", override)
+		}
+		for _, ip := range strings.Split(ips, ",") {
+			if net.ParseIP(ip) == nil {
+				return nil, fmt.Errorf("invalid address %q of the host override %q", ip, override)
+			}
+			r.hosts[strings.ToLower(host)] = append(r.hosts[strings.ToLower(host)], ip)
+		}
+	}
+	return r, nil
+}
+
+// lookupHost returns the addresses of the host
+func (r *dnsResolver) lookupHost(ctx context.Context, host string) ([]string, error) {
+	if r == nil {
+		return net.DefaultResolver.LookupHost(ctx, host)
+	}
+	if addrs, ok := r.hosts[strings.ToLower(host)]; ok {
+		return addrs, nil
+	}
+	if r.ttl <= 0 {
+		return r.resolver.LookupHost(ctx, host)
+	}
+	r.mu.Lock()
+	cached, ok := r.cache[host]
+	r.mu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.addrs, nil
+	}
+	addrs, err := r.resolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	r.cache[host] = dnsCached{addrs: addrs, expires: time.Now().Add(r.ttl)}
+	r.mu.Unlock()
+	return addrs, nil
+}
+
+// dialContext dials the address, host:port, to the addresses of its host in turn until a connection succeeds,
+// like the dialer does with the resolver of the system
+func (r *dnsResolver) dialContext(ctx context.Context, dialer *net.Dialer, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if r == nil || err != nil || net.ParseIP(host) != nil {
+		return dialer.DialContext(ctx, network, address)
+	}
+	addrs, err := r.lookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		var conn net.Conn
+		if conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(addr, port)); err == nil {
+			return conn, nil
+		}
+	}
+	if err == nil {
+		err = fmt.Errorf("no address for %s", host)
+	}
+	return nil, err
+}
+
+// dial dials the address with the timeout
+func (r *dnsResolver) dial(network, address string, timeout time.Duration) (net.Conn, error) {
+	return r.dialContext(context.Background(), &net.Dialer{Timeout: timeout}, network, address)
+}
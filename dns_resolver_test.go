@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+)
+
+func TestDNSResolver(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var queries int64
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			m, _ := proto.ParseDNS(buf[:n])
+			m.Response = true
+			if q := m.Questions[0]; q.Type == proto.DNSTypeA {
+				atomic.AddInt64(&queries, 1)
+				m.Answers = []proto.DNSRecord{{Name: q.Name, Type: proto.DNSTypeA, Class: 1, TTL: 60, Data: []byte{10, 0, 0, 1}}}
+			}
+			conn.WriteTo(proto.AppendDNS(nil, m), addr)
+		}
+	}()
+
+	r, err := newDNSResolver(conn.LocalAddr().String(), []string{"API.test=127.0.0.2,127.0.0.3"}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addrs, err := r.lookupHost(context.Background(), "api.test"); err != nil || len(addrs) != 2 || addrs[0] != "127.0.0.2" {
+		t.Errorf("expected the addresses of the override, got %v(%v)", addrs, err)
+	}
+	for i := 0; i < 2; i++ {
+		if addrs, err := r.lookupHost(context.Background(), "backend.goreplay.test"); err != nil || len(addrs) != 1 || addrs[0] != "10.0.0.1" {
+			t.Errorf("expected the address of the DNS server, got %v(%v)", addrs, err)
+		}
+	}
+	if n := atomic.LoadInt64(&queries); n != 1 {
+		t.Errorf("expected the address to be cached, got %d queries", n)
+	}
+
+	if r, err := newDNSResolver("", nil, 0); r != nil || err != nil {
+		t.Errorf("expected the resolver of the system, got %v(%v)", r, err)
+	}
+	for _, override := range []string{"api.test", "api.test=", "api.test=10.0.0.1,backend"} {
+		if _, err := newDNSResolver("", []string{override}, 0); err == nil {
+			t.Errorf("expected an error for %q", override)
+		}
+	}
+}
+
+func TestDNSResolverHTTPClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Host))
+	}))
+	defer server.Close()
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+
+	r, _ := newDNSResolver("", []string{"blue.goreplay.test=127.0.0.1"}, 0)
+	client := NewHTTPClient("http://blue.goreplay.test:"+port, &HTTPClientConfig{Timeout: time.Second, Dialer: newHTTPDialer(0, 0, 0, 0, 0, r)})
+	resp, err := client.Send([]byte("GET / HTTP/1.1\r\nHost: blue.goreplay.test\r\n\r\n"))
+	if err != nil || string(httpStatus(resp)) != "200" {
+		t.Errorf("expected the request to be sent to the override, got %q(%v)", resp, err)
+	}
+}
@@ -1,15 +1,29 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"log"
+	"net/http"
 	"net/url"
+	"os"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/buger/goreplay/proto"
+	"github.com/buger/goreplay/size"
 
-	elastigo "github.com/mattbaird/elastigo/lib"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
 )
 
 type ESUriErorr struct{}
@@ -18,18 +32,60 @@ func (e *ESUriErorr) Error() string {
 	return "Wrong ElasticSearch URL format. Expected to be: scheme://host/index_name"
 }
 
+// ESConfig is the configuration of the ElasticSearch stats of the HTTP output
+type ESConfig struct {
+	APIKey        string        `json:"output-http-elasticsearch-api-key"`
+	User          string        `json:"output-http-elasticsearch-user"`
+	Password      string        `json:"output-http-elasticsearch-password"`
+	CloudID       string        `json:"output-http-elasticsearch-cloud-id"`
+	CACert        string        `json:"output-http-elasticsearch-ca"`
+	SkipVerify    bool          `json:"output-http-elasticsearch-skip-verify"`
+	BulkSize      int           `json:"output-http-elasticsearch-bulk-size"`
+	BulkBytes     size.Size     `json:"output-http-elasticsearch-bulk-bytes"`
+	FlushInterval time.Duration `json:"output-http-elasticsearch-flush-interval"`
+	DataStream    bool          `json:"output-http-elasticsearch-data-stream"`
+	Template      bool          `json:"output-http-elasticsearch-template"`
+	ILMPolicy     string        `json:"output-http-elasticsearch-ilm-policy"`
+	Retention     time.Duration `json:"output-http-elasticsearch-retention"`
+	Timeout       time.Duration `json:"output-http-elasticsearch-timeout"`
+	AWSSigV4      bool          `json:"output-http-elasticsearch-aws-sigv4"`
+	AWSRegion     string        `json:"output-http-elasticsearch-aws-region"`
+	AWSService    string        `json:"output-http-elasticsearch-aws-service"` // es, or aoss for OpenSearch Serverless
+}
+
+// ESPlugin indexes the stats of the replayed requests and their responses with the bulk API of ElasticSearch or
+// OpenSearch. the documents are sent in bulks of BulkSize documents or BulkBytes, or every FlushInterval, and the
+// documents rejected with 429 are retried. the index can be a data stream, and the index template and the ILM
+// policy, or the ISM policy of OpenSearch, are created on the first bulk. the documents have no type, but for the
+// ElasticSearch servers before 7.0. with AWSSigV4, the requests are signed for Amazon OpenSearch Service.
 type ESPlugin struct {
+	// Keep this as first element of struct because it guarantees 64bit
+	// alignment. atomic.* functions crash on 32bit machines if operand is not
+	// aligned at 64bit. See https://github.com/golang/go/issues/599
+	indexed int64
+	failed  int64
+	dropped int64
+
 	Active  bool
 	ApiPort string
-	eConn   *elastigo.Conn
 	Host    string
 	Index   string
-	indexor *elastigo.BulkIndexer
-	done    chan bool
+
+	config       *ESConfig
+	url          string // without the index
+	client       *http.Client
+	docs         chan []byte
+	done         chan bool
+	finished     chan struct{}
+	bootstrapped bool
+	legacy       bool // the server needs a type of document
+	opensearch   bool
+	signer       *v4.Signer // the requests are signed with AWS SigV4 for Amazon OpenSearch Service
 }
 
 type ESRequestResponse struct {
 	ReqURL               string `json:"Req_URL"`
+	ReqURLNormalized     string `json:"Req_URL-Normalized,omitempty"`
 	ReqMethod            string `json:"Req_Method"`
 	ReqUserAgent         string `json:"Req_User-Agent"`
 	ReqAcceptLanguage    string `json:"Req_Accept-Language,omitempty"`
@@ -51,6 +107,7 @@ type ESRequestResponse struct {
 	RespSetCookie        string `json:"Resp_Set-Cookie,omitempty"`
 	Rtt                  int64  `json:"RTT"`
 	Timestamp            time.Time
+	DataStreamTimestamp  *time.Time `json:"@timestamp,omitempty"` // required by the data streams
 }
 
 // Parse ElasticSearch URI
@@ -82,39 +139,430 @@ func parseURI(URI string) (err error, index string) {
 	return
 }
 
-func (p *ESPlugin) Init(URI string) {
+// esCloudURL returns the URL of ElasticSearch of an Elastic Cloud id, [name:]base64(host[:port]$es_id[$kibana_id])
+func esCloudURL(cloudID string) (string, error) {
+	if i := strings.LastIndexByte(cloudID, ':'); i != -1 {
+		cloudID = cloudID[i+1:]
+	}
+	decoded, err := base64.StdEncoding.DecodeString(cloudID)
+	if err != nil {
+		return "", err
+	}
+	parts := strings.Split(string(decoded), "$")
+	if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+		return "", errors.New("invalid cloud id")
+	}
+	host, port := parts[0], "443"
+	if i := strings.LastIndexByte(host, ':'); i != -1 {
+		host, port = host[:i], host[i+1:]
+	}
+	return "https://" + parts[1] + "." + host + ":" + port, nil
+}
+
+// esAWSEndpoint returns the region and the service of the endpoints of Amazon OpenSearch Service,
+// <domain>.<region>.es.amazonaws.com and <collection>.<region>.aoss.amazonaws.com, es for the other hosts
+func esAWSEndpoint(host string) (region, service string) {
+	parts := strings.Split(host, ".")
+	for i := 1; i+2 < len(parts); i++ {
+		if (parts[i+1] == "es" || parts[i+1] == "aoss") && parts[i+2] == "amazonaws" {
+			return parts[i], parts[i+1]
+		}
+	}
+	return "", "es"
+}
+
+func (p *ESPlugin) Init(URI string, config *ESConfig) {
 	var err error
 
+	p.config = config
+	if p.config.CloudID != "" && !strings.Contains(URI, "://") {
+		// the URI is the index
+		cloudURL, err := esCloudURL(p.config.CloudID)
+		if err != nil {
+			log.Fatal("Can't initialize ElasticSearch plugin: invalid cloud id: ", err)
+		}
+		URI = cloudURL + "/" + URI
+	}
+
 	err, p.Index = parseURI(URI)
 
 	if err != nil {
 		log.Fatal("Can't initialize ElasticSearch plugin.", err)
 	}
 
-	p.eConn = elastigo.NewConn()
+	u, _ := url.Parse(URI)
+	if u.User != nil && p.config.User == "" {
+		p.config.User = u.User.Username()
+		p.config.Password, _ = u.User.Password()
+	}
+	u.User = nil
+	u.Path = strings.TrimSuffix(u.Path, p.Index)
+	p.url = strings.TrimSuffix(u.String(), "/")
+	p.Host = u.Host
 
-	p.eConn.SetFromUrl(URI)
+	if p.config.BulkSize <= 0 {
+		p.config.BulkSize = 1000
+	}
+	if p.config.BulkBytes <= 0 {
+		p.config.BulkBytes = 5 << 20
+	}
+	if p.config.FlushInterval <= 0 {
+		p.config.FlushInterval = time.Second
+	}
+	if p.config.Timeout < time.Millisecond {
+		p.config.Timeout = 30 * time.Second
+	}
+	tlsConfig := &tls.Config{InsecureSkipVerify: p.config.SkipVerify}
+	if p.config.CACert != "" {
+		ca, err := ioutil.ReadFile(p.config.CACert)
+		if err != nil {
+			log.Fatal("Can't initialize ElasticSearch plugin: ", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		tlsConfig.RootCAs.AppendCertsFromPEM(ca)
+	}
+	if p.config.AWSSigV4 {
+		region, service := esAWSEndpoint(u.Hostname())
+		if p.config.AWSRegion == "" {
+			if p.config.AWSRegion = region; region == "" {
+				p.config.AWSRegion = os.Getenv("AWS_REGION")
+			}
+		}
+		if p.config.AWSRegion == "" {
+			log.Fatal("Can't initialize ElasticSearch plugin: the region of the domain is required, set --output-http-elasticsearch-aws-region or AWS_REGION")
+		}
+		if p.config.AWSService == "" {
+			p.config.AWSService = service
+		}
+		p.signer = awsSigner("output-http-elasticsearch", p.config.AWSRegion)
+	}
+	p.client = &http.Client{
+		Timeout:   p.config.Timeout,
+		Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tlsConfig},
+	}
 
-	p.indexor = p.eConn.NewBulkIndexerErrors(50, 60)
+	p.docs = make(chan []byte, 10*p.config.BulkSize)
 	p.done = make(chan bool)
-	p.indexor.Start()
-
-	go p.ErrorHandler()
+	p.finished = make(chan struct{})
+	go p.run()
 
 	Debug(1, "Initialized Elasticsearch Plugin")
 	return
 }
 
+// IndexerShutdown flushes the documents queued
 func (p *ESPlugin) IndexerShutdown() {
-	p.indexor.Stop()
+	close(p.done)
+	select {
+	case <-p.finished:
+	case <-time.After(p.config.Timeout):
+	}
 	return
 }
 
-func (p *ESPlugin) ErrorHandler() {
+// run sends the documents in bulks
+func (p *ESPlugin) run() {
+	defer close(p.finished)
+	ticker := time.NewTicker(p.config.FlushInterval)
+	defer ticker.Stop()
+	var docs [][]byte
+	var size int
 	for {
-		errBuf := <-p.indexor.ErrorChannel
-		Debug(1, "[ELASTICSEARCH]", errBuf.Err)
+		select {
+		case doc := <-p.docs:
+			docs, size = append(docs, doc), size+len(doc)
+			if len(docs) < p.config.BulkSize && size < int(p.config.BulkBytes) {
+				continue
+			}
+		case <-ticker.C:
+		case <-p.done:
+			for len(p.docs) > 0 {
+				docs = append(docs, <-p.docs)
+			}
+			p.flush(docs)
+			return
+		}
+		p.flush(docs)
+		docs, size = nil, 0
+	}
+}
+
+// flush bootstraps the index, on the first bulk, and sends the documents, the documents rejected because of the
+// load of the cluster are retried with a backoff of 1s doubled on each retry, up to 3 times
+func (p *ESPlugin) flush(docs [][]byte) {
+	if len(docs) == 0 {
+		return
+	}
+	if !p.bootstrapped {
+		if err := p.bootstrap(); err != nil {
+			Debug(1, "[ELASTICSEARCH] bootstrap:", err)
+		}
+	}
+	for retry := 0; len(docs) > 0; retry++ {
+		if retry > 0 {
+			if retry > 3 {
+				break
+			}
+			time.Sleep(time.Duration(1<<uint(retry-1)) * time.Second)
+		}
+		rejected, err := p.bulk(docs)
+		if err != nil {
+			Debug(1, "[ELASTICSEARCH]", err)
+			continue
+		}
+		docs = rejected
+	}
+	atomic.AddInt64(&p.failed, int64(len(docs)))
+}
+
+// bulk sends the documents with the bulk API, it returns the documents rejected with 429
+func (p *ESPlugin) bulk(docs [][]byte) (rejected [][]byte, err error) {
+	action := map[string]string{"_index": p.Index}
+	if p.legacy {
+		action["_type"] = "RequestResponse"
+	}
+	op := "index"
+	if p.config.DataStream {
+		op = "create"
+	}
+	line, _ := json.Marshal(map[string]interface{}{op: action})
+	var body bytes.Buffer
+	for _, doc := range docs {
+		body.Write(line)
+		body.WriteByte('\n')
+		body.Write(doc)
+		body.WriteByte('\n')
+	}
+	status, resp, err := p.request(http.MethodPost, "/_bulk", body.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	if status == http.StatusTooManyRequests {
+		return docs, nil
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("bulk: status %d: %s", status, resp)
+	}
+	var result struct {
+		Errors bool
+		Items  []map[string]struct {
+			Status int
+			Error  json.RawMessage
+		}
+	}
+	if err = json.Unmarshal(resp, &result); err != nil {
+		return nil, err
+	}
+	for i, item := range result.Items {
+		for _, r := range item {
+			switch {
+			case r.Status < 300:
+				atomic.AddInt64(&p.indexed, 1)
+			case r.Status == http.StatusTooManyRequests && i < len(docs):
+				rejected = append(rejected, docs[i])
+			default:
+				atomic.AddInt64(&p.failed, 1)
+				Debug(1, "[ELASTICSEARCH]", string(r.Error))
+			}
+		}
+	}
+	return rejected, nil
+}
+
+// bootstrap reads the version of the server, and creates the ILM policy, the index template and the first index
+// of the rollovers when they are configured
+func (p *ESPlugin) bootstrap() error {
+	status, resp, err := p.request(http.MethodGet, "/", nil)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("status %d: %s", status, resp)
+	}
+	var info struct {
+		Version struct {
+			Number       string
+			Distribution string
+		}
+	}
+	json.Unmarshal(resp, &info)
+	major, _ := strconv.Atoi(strings.SplitN(info.Version.Number, ".", 2)[0])
+	p.opensearch = info.Version.Distribution == "opensearch"
+	p.legacy = !p.opensearch && major > 0 && major < 7
+	p.bootstrapped = true
+
+	rollover := p.config.ILMPolicy != "" && !p.config.DataStream
+	if p.config.ILMPolicy != "" {
+		if p.opensearch {
+			pattern := p.Index
+			if rollover {
+				pattern += "-*"
+			}
+			err = p.put("/_plugins/_ism/policies/"+url.PathEscape(p.config.ILMPolicy), esISMPolicy(pattern, p.config.Retention))
+		} else {
+			err = p.put("/_ilm/policy/"+url.PathEscape(p.config.ILMPolicy), esILMPolicy(p.config.Retention))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if !p.config.Template && !p.config.DataStream && p.config.ILMPolicy == "" {
+		return nil
+	}
+	if err = p.put("/_index_template/"+url.PathEscape(p.Index), esIndexTemplate(p.Index, p.config.DataStream, rollover, p.config.ILMPolicy, p.opensearch)); err != nil {
+		return err
 	}
+	if !rollover {
+		return nil
+	}
+	// the documents are written to the alias of the index, the first index is created with it
+	if status, _, err = p.request(http.MethodHead, "/_alias/"+url.PathEscape(p.Index), nil); err != nil || status == http.StatusOK {
+		return err
+	}
+	return p.put("/"+url.PathEscape(p.Index+"-000001"), map[string]interface{}{
+		"aliases": map[string]interface{}{p.Index: map[string]bool{"is_write_index": true}},
+	})
+}
+
+// esILMPolicy returns an ILM policy rolling the indexes over at 50gb or 30 days, and deleting them after the
+// retention
+func esILMPolicy(retention time.Duration) map[string]interface{} {
+	phases := map[string]interface{}{
+		"hot": map[string]interface{}{
+			"actions": map[string]interface{}{
+				"rollover": map[string]string{"max_size": "50gb", "max_age": "30d"},
+			},
+		},
+	}
+	if retention > 0 {
+		phases["delete"] = map[string]interface{}{
+			"min_age": strconv.FormatInt(int64(retention/time.Second), 10) + "s",
+			"actions": map[string]interface{}{"delete": map[string]interface{}{}},
+		}
+	}
+	return map[string]interface{}{"policy": map[string]interface{}{"phases": phases}}
+}
+
+// esISMPolicy returns the ILM policy for OpenSearch, an ISM policy applied to the indexes of the pattern
+func esISMPolicy(pattern string, retention time.Duration) map[string]interface{} {
+	hot := map[string]interface{}{
+		"name":        "hot",
+		"actions":     []interface{}{map[string]interface{}{"rollover": map[string]string{"min_size": "50gb", "min_index_age": "30d"}}},
+		"transitions": []interface{}{},
+	}
+	states := []interface{}{hot}
+	if retention > 0 {
+		hot["transitions"] = []interface{}{map[string]interface{}{
+			"state_name": "delete",
+			"conditions": map[string]string{"min_rollover_age": strconv.FormatInt(int64(retention/time.Second), 10) + "s"},
+		}}
+		states = append(states, map[string]interface{}{
+			"name":        "delete",
+			"actions":     []interface{}{map[string]interface{}{"delete": map[string]interface{}{}}},
+			"transitions": []interface{}{},
+		})
+	}
+	return map[string]interface{}{"policy": map[string]interface{}{
+		"description":   "goreplay",
+		"default_state": "hot",
+		"states":        states,
+		"ism_template":  []interface{}{map[string]interface{}{"index_patterns": []string{pattern}, "priority": 200}},
+	}}
+}
+
+// esIndexTemplate returns the index template of the index, a data stream or the indexes of the rollovers of the
+// alias, with the ILM policy and the mappings of the documents: the strings as keywords, RTT and the timestamps.
+// the ISM policies of OpenSearch are applied by their own templates
+func esIndexTemplate(index string, dataStream, rollover bool, policy string, opensearch bool) map[string]interface{} {
+	settings := map[string]interface{}{}
+	if policy != "" && !opensearch {
+		settings["index.lifecycle.name"] = policy
+	}
+	pattern := index
+	if rollover {
+		pattern = index + "-*"
+		if opensearch {
+			settings["plugins.index_state_management.rollover_alias"] = index
+		} else {
+			settings["index.lifecycle.rollover_alias"] = index
+		}
+	}
+	template := map[string]interface{}{
+		"index_patterns": []string{pattern},
+		"priority":       200,
+		"template": map[string]interface{}{
+			"settings": settings,
+			"mappings": map[string]interface{}{
+				"dynamic_templates": []interface{}{
+					map[string]interface{}{"strings": map[string]interface{}{
+						"match_mapping_type": "string",
+						"mapping":            map[string]interface{}{"type": "keyword", "ignore_above": 2048},
+					}},
+				},
+				"properties": map[string]interface{}{
+					"RTT":        map[string]string{"type": "long"},
+					"Timestamp":  map[string]string{"type": "date"},
+					"@timestamp": map[string]string{"type": "date"},
+				},
+			},
+		},
+	}
+	if dataStream {
+		template["data_stream"] = map[string]interface{}{}
+	}
+	return template
+}
+
+// put sends the JSON of the value with a PUT request
+func (p *ESPlugin) put(path string, value interface{}) error {
+	body, _ := json.Marshal(value)
+	status, resp, err := p.request(http.MethodPut, path, body)
+	if err != nil {
+		return err
+	}
+	// the ISM policies are not replaced without their sequence number
+	if status != http.StatusOK && status != http.StatusCreated && !(status == http.StatusConflict && strings.HasPrefix(path, "/_plugins/_ism/")) {
+		return fmt.Errorf("%s: status %d: %s", path, status, resp)
+	}
+	return nil
+}
+
+// request sends a request to the server, signed with AWS SigV4 or authenticated with the API key or the user
+func (p *ESPlugin) request(method, path string, body []byte) (status int, resp []byte, err error) {
+	req, err := http.NewRequest(method, p.url+path, bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+		if path == "/_bulk" {
+			req.Header.Set("Content-Type", "application/x-ndjson")
+		}
+	}
+	switch {
+	case p.signer != nil:
+		hash := sha256.Sum256(body)
+		req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(hash[:]))
+		if _, err = p.signer.Sign(req, bytes.NewReader(body), p.config.AWSService, p.config.AWSRegion, time.Now()); err != nil {
+			return
+		}
+	case p.config.APIKey != "":
+		key := p.config.APIKey
+		if strings.Contains(key, ":") {
+			// id:api_key
+			key = base64.StdEncoding.EncodeToString([]byte(key))
+		}
+		req.Header.Set("Authorization", "ApiKey "+key)
+	case p.config.User != "":
+		req.SetBasicAuth(p.config.User, p.config.Password)
+	}
+	r, err := p.client.Do(req)
+	if err != nil {
+		return
+	}
+	defer r.Body.Close()
+	resp, err = ioutil.ReadAll(r.Body)
+	return r.StatusCode, resp, err
 }
 
 func (p *ESPlugin) RttDurationToMs(d time.Duration) int64 {
@@ -135,6 +583,7 @@ func (p *ESPlugin) ResponseAnalyze(req, resp []byte, start, stop time.Time) {
 
 	esResp := ESRequestResponse{
 		ReqURL:               string(proto.Path(req)),
+		ReqURLNormalized:     normalizedURL(req),
 		ReqMethod:            string(proto.Method(req)),
 		ReqUserAgent:         string(proto.Header(req, []byte("User-Agent"))),
 		ReqAcceptLanguage:    string(proto.Header(req, []byte("Accept-Language"))),
@@ -153,15 +602,28 @@ func (p *ESPlugin) ResponseAnalyze(req, resp []byte, start, stop time.Time) {
 		RespExpires:          string(proto.Header(resp, []byte("Expires"))),
 		RespCacheControl:     string(proto.Header(resp, []byte("Cache-Control"))),
 		RespVary:             string(proto.Header(resp, []byte("Vary"))),
-		RespSetCookie:        string(proto.Header(resp, []byte("Set-Cookie"))),
+		RespSetCookie:        string(bytes.Join(proto.HeaderValues(resp, []byte("Set-Cookie")), []byte("\n"))),
 		Rtt:                  rtt,
 		Timestamp:            t,
 	}
+	if p.config.DataStream {
+		esResp.DataStreamTimestamp = &t
+	}
 	j, err := json.Marshal(&esResp)
 	if err != nil {
 		Debug(0, "[ELASTIC-RESPONSE]", err)
-	} else {
-		p.indexor.Index(p.Index, "RequestResponse", "", "", "", &t, j)
+		return
+	}
+	select {
+	case p.docs <- j:
+	default:
+		// the replay is not slowed down by the indexing
+		atomic.AddInt64(&p.dropped, 1)
 	}
 	return
 }
+
+func (p *ESPlugin) String() string {
+	return fmt.Sprintf("ElasticSearch: %s/%s, indexed: %d, failed: %d, dropped: %d", p.url, p.Index,
+		atomic.LoadInt64(&p.indexed), atomic.LoadInt64(&p.failed), atomic.LoadInt64(&p.dropped))
+}
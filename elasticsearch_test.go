@@ -1,7 +1,15 @@
 package main
 
 import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 const expectedIndex = "gor"
@@ -138,3 +146,139 @@ func TestElasticComplexPathConnectionBuild(t *testing.T) {
 
 	assertExpectedGorIndex(index, t)
 }
+
+func TestElasticCloudURL(t *testing.T) {
+	// "us-east-1.aws.found.io$es-id$kibana-id"
+	u, err := esCloudURL("deployment:dXMtZWFzdC0xLmF3cy5mb3VuZC5pbyRlcy1pZCRraWJhbmEtaWQ=")
+	if err != nil || u != "https://es-id.us-east-1.aws.found.io:443" {
+		t.Errorf("unexpected url %q %v", u, err)
+	}
+	if _, err = esCloudURL("deployment:invalid"); err == nil {
+		t.Error("expected an invalid cloud id to fail")
+	}
+}
+
+func TestElasticBulk(t *testing.T) {
+	var mu sync.Mutex
+	var paths []string
+	var docs []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.Header.Get("Authorization") != "ApiKey aWQ6a2V5" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		paths = append(paths, r.Method+" "+r.URL.Path)
+		switch r.URL.Path {
+		case "/es/":
+			w.Write([]byte(`{"version":{"number":"8.11.0"}}`))
+		case "/es/_bulk":
+			lines := strings.Split(strings.TrimSpace(readAll(r)), "\n")
+			var items []string
+			for i := 0; i+1 < len(lines); i += 2 {
+				if lines[i] != `{"create":{"_index":"gor"}}` || !strings.Contains(lines[i+1], `"@timestamp"`) {
+					t.Errorf("unexpected bulk %q", lines[i:i+2])
+				}
+				// the first document is rejected once
+				if len(docs) == 0 && i == 0 {
+					items = append(items, `{"create":{"status":429}}`)
+					docs = append(docs, "")
+					continue
+				}
+				docs = append(docs, lines[i+1])
+				items = append(items, `{"create":{"status":201}}`)
+			}
+			w.Write([]byte(`{"errors":true,"items":[` + strings.Join(items, ",") + `]}`))
+		default:
+			w.Write([]byte(`{"acknowledged":true}`))
+		}
+	}))
+	defer server.Close()
+
+	p := new(ESPlugin)
+	p.Init(server.URL+"/es/gor", &ESConfig{APIKey: "id:key", DataStream: true, ILMPolicy: "gor", FlushInterval: 10 * time.Millisecond})
+	req := []byte("1 a 1 0\nGET /a HTTP/1.1\r\n\r\n")
+	p.ResponseAnalyze(req, []byte("HTTP/1.1 200 OK\r\n\r\n"), time.Now(), time.Now())
+	p.ResponseAnalyze(req, []byte("HTTP/1.1 404 Not Found\r\n\r\n"), time.Now(), time.Now())
+	time.Sleep(50 * time.Millisecond)
+	p.IndexerShutdown()
+
+	mu.Lock()
+	defer mu.Unlock()
+	expected := []string{"GET /es/", "PUT /es/_ilm/policy/gor", "PUT /es/_index_template/gor", "POST /es/_bulk"}
+	if len(paths) < 5 || !reflect.DeepEqual(paths[:4], expected) {
+		t.Errorf("unexpected requests %q", paths)
+	}
+	if p.indexed != 2 || p.failed != 0 {
+		t.Errorf("expected the rejected document to be retried, got %s", p)
+	}
+}
+
+func readAll(r *http.Request) string {
+	body, _ := ioutil.ReadAll(r.Body)
+	return string(body)
+}
+
+func TestOpenSearchSigV4(t *testing.T) {
+	os.Setenv("AWS_ACCESS_KEY_ID", "id")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	defer os.Unsetenv("AWS_ACCESS_KEY_ID")
+	defer os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+
+	var mu sync.Mutex
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=id/") || !strings.Contains(r.Header.Get("Authorization"), "/eu-west-1/es/aws4_request") || r.Header.Get("X-Amz-Content-Sha256") == "" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		paths = append(paths, r.Method+" "+r.URL.Path)
+		switch r.URL.Path {
+		case "/":
+			w.Write([]byte(`{"version":{"distribution":"opensearch","number":"2.11.0"}}`))
+		case "/_bulk":
+			if strings.Contains(readAll(r), "_type") {
+				t.Error("expected no type of document on OpenSearch")
+			}
+			w.Write([]byte(`{"errors":false,"items":[{"index":{"status":201}}]}`))
+		case "/_plugins/_ism/policies/gor":
+			// the policy exists
+			w.WriteHeader(http.StatusConflict)
+		case "/_alias/gor":
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			w.Write([]byte(`{"acknowledged":true}`))
+		}
+	}))
+	defer server.Close()
+
+	p := new(ESPlugin)
+	p.Init(server.URL+"/gor", &ESConfig{AWSSigV4: true, AWSRegion: "eu-west-1", ILMPolicy: "gor"})
+	p.ResponseAnalyze([]byte("1 a 1 0\nGET /a HTTP/1.1\r\n\r\n"), []byte("HTTP/1.1 200 OK\r\n\r\n"), time.Now(), time.Now())
+	p.IndexerShutdown()
+
+	mu.Lock()
+	defer mu.Unlock()
+	expected := []string{"GET /", "PUT /_plugins/_ism/policies/gor", "PUT /_index_template/gor", "HEAD /_alias/gor", "PUT /gor-000001", "POST /_bulk"}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("unexpected requests %q", paths)
+	}
+	if p.indexed != 1 {
+		t.Errorf("expected the document to be indexed, got %s", p)
+	}
+}
+
+func TestOpenSearchAWSEndpoint(t *testing.T) {
+	for host, expected := range map[string][2]string{
+		"search-gor-abc123.us-east-1.es.amazonaws.com": {"us-east-1", "es"},
+		"abc123.eu-west-1.aoss.amazonaws.com":          {"eu-west-1", "aoss"},
+		"localhost":                                    {"", "es"},
+	} {
+		if region, service := esAWSEndpoint(host); region != expected[0] || service != expected[1] {
+			t.Errorf("%s: expected %v, got %s %s", host, expected, region, service)
+		}
+	}
+}
@@ -9,6 +9,11 @@ import (
 	"time"
 )
 
+// flusher is implemented by inputs holding data that can be completed on shutdown
+type flusher interface {
+	Flush()
+}
+
 type emitter struct {
 	sync.Mutex
 	sync.WaitGroup
@@ -30,6 +35,11 @@ func (e *emitter) Start(plugins *InOutPlugins, middlewareCmd string) {
 		Settings.CopyBufferSize = 5 << 20
 	}
 	e.plugins = plugins
+	if Settings.SplitOutputWeights != "" {
+		if err := splitWeights.setup(Settings.SplitOutputWeights, plugins.Outputs); err != nil {
+			log.Fatal("--split-output-weights: ", err)
+		}
+	}
 
 	if middlewareCmd != "" {
 		middleware := NewMiddleware(middlewareCmd)
@@ -97,7 +107,13 @@ func (e *emitter) close() {
 }
 
 // Close closes all the goroutine and waits for it to finish.
+// inputs are flushed first, so that the data they still hold reach the outputs.
 func (e *emitter) Close() {
+	for _, p := range e.plugins.Inputs {
+		if f, ok := p.(flusher); ok {
+			f.Flush()
+		}
+	}
 	e.close()
 	for _, p := range e.plugins.Inputs {
 		if cp, ok := p.(io.Closer); ok {
@@ -116,7 +132,28 @@ func (e *emitter) Close() {
 func CopyMulty(stop chan int, src io.Reader, writers ...io.Writer) error {
 	buf := make([]byte, Settings.CopyBufferSize)
 	wIndex := 0
-	modifier := NewHTTPModifier(&Settings.ModifierConfig)
+	var modifiers []func([]byte) []byte
+	if modifier := NewHTTPModifier(&Settings.ModifierConfig); modifier != nil {
+		modifiers = append(modifiers, modifier.Rewrite)
+	}
+	if modifier := NewPostgresModifier(&Settings.PostgresModifierConfig); modifier != nil {
+		modifiers = append(modifiers, modifier.Rewrite)
+	}
+	if modifier := NewRedisModifier(&Settings.RedisModifierConfig); modifier != nil {
+		modifiers = append(modifiers, modifier.Rewrite)
+	}
+	if modifier := NewMongoModifier(&Settings.MongoModifierConfig); modifier != nil {
+		modifiers = append(modifiers, modifier.Rewrite)
+	}
+	if modifier := NewThriftModifier(&Settings.ThriftModifierConfig); modifier != nil {
+		modifiers = append(modifiers, modifier.Rewrite)
+	}
+	if modifier := NewMQTTModifier(&Settings.MQTTModifierConfig); modifier != nil {
+		modifiers = append(modifiers, modifier.Rewrite)
+	}
+	if modifier := NewKafkaModifier(&Settings.KafkaModifierConfig); modifier != nil {
+		modifiers = append(modifiers, modifier.Rewrite)
+	}
 	filteredRequests := make(map[string]time.Time)
 	filteredRequestsLastCleanTime := time.Now()
 
@@ -149,12 +186,20 @@ func CopyMulty(stop chan int, src io.Reader, writers ...io.Writer) error {
 
 			Debug(3, "[EMITTER] input:", string(payload[0:_maxN]), nr, "from:", src)
 
-			if modifier != nil {
+			if Settings.DecodeHTTPBody {
+				payload = decodeHTTPBody(payload)
+			}
+
+			if len(modifiers) > 0 {
 				if isRequestPayload(payload) {
 					headSize := bytes.IndexByte(payload, '\n') + 1
 					body := payload[headSize:]
 					originalBodyLen := len(body)
-					body = modifier.Rewrite(body)
+					for _, rewrite := range modifiers {
+						if body = rewrite(body); len(body) == 0 {
+							break
+						}
+					}
 
 					// If modifier tells to skip request
 					if len(body) == 0 {
@@ -183,7 +228,12 @@ func CopyMulty(stop chan int, src io.Reader, writers ...io.Writer) error {
 				}
 			}
 
-			if Settings.SplitOutput {
+			if splitWeights.enabled() {
+				// the payloads of a session go to the same output
+				if _, err := writers[splitWeights.pick(payloadID(payload))].Write(payload); err != nil {
+					return err
+				}
+			} else if Settings.SplitOutput {
 				if Settings.RecognizeTCPSessions {
 					if !PRO {
 						log.Fatal("Detailed TCP sessions work only with PRO license")
@@ -3,7 +3,10 @@ package main
 import (
 	"fmt"
 	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -138,6 +141,85 @@ func TestEmitterSplitRoundRobin(t *testing.T) {
 	Settings.SplitOutput = false
 }
 
+func TestEmitterSplitWeights(t *testing.T) {
+	wg := new(sync.WaitGroup)
+	quit := make(chan int)
+
+	input := NewTestInput()
+
+	var counter1, counter2 int32
+
+	output1 := NewTestOutput(func(data []byte) {
+		atomic.AddInt32(&counter1, 1)
+		wg.Done()
+	})
+
+	output2 := NewTestOutput(func(data []byte) {
+		atomic.AddInt32(&counter2, 1)
+		wg.Done()
+	})
+
+	plugins := &InOutPlugins{
+		Inputs:  []io.Reader{input},
+		Outputs: []io.Writer{output1, output2},
+	}
+
+	Settings.SplitOutputWeights = "80,20"
+	defer func() {
+		Settings.SplitOutputWeights = ""
+		splitWeights.Lock()
+		splitWeights.weights, splitWeights.total = nil, 0
+		splitWeights.Unlock()
+	}()
+
+	emitter := NewEmitter(quit)
+	go emitter.Start(plugins, Settings.Middleware)
+
+	for i := 0; i < 2000; i++ {
+		wg.Add(1)
+		input.EmitGET()
+	}
+
+	wg.Wait()
+
+	emitter.Close()
+
+	if counter1 < 1500 || counter1 > 1700 || counter1+counter2 != 2000 {
+		t.Errorf("expected 80%% of the traffic on the first output: %d vs %d", counter1, counter2)
+	}
+
+	// the weights are ramped up, the sessions of the second output stay on it
+	ids := make([][]byte, 1000)
+	before := make([]int, len(ids))
+	for i := range ids {
+		ids[i] = uuid()
+		before[i] = splitWeights.pick(ids[i])
+	}
+	rec := httptest.NewRecorder()
+	splitWeights.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/debug/split-output?weights=50,50", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"weight":50`) {
+		t.Fatalf("expected the weights to be set, got %d %s", rec.Code, rec.Body)
+	}
+	moved := 0
+	for i, id := range ids {
+		if after := splitWeights.pick(id); after != before[i] {
+			if before[i] == 1 {
+				t.Fatalf("expected the session %s to stay on the second output", id)
+			}
+			moved++
+		}
+	}
+	if moved < 200 || moved > 400 {
+		t.Errorf("expected 30%% of the sessions to move, got %d", moved)
+	}
+
+	rec = httptest.NewRecorder()
+	splitWeights.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/debug/split-output?weights=1,2,3", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected the weights to be rejected, got %d", rec.Code)
+	}
+}
+
 func TestEmitterRoundRobin(t *testing.T) {
 	wg := new(sync.WaitGroup)
 	quit := make(chan int)
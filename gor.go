@@ -3,6 +3,7 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
@@ -16,6 +17,9 @@ import (
 	"runtime/pprof"
 	"syscall"
 	"time"
+
+	"github.com/buger/goreplay/capture"
+	"github.com/buger/goreplay/tcp"
 )
 
 var (
@@ -69,6 +73,11 @@ func main() {
 	}
 
 	if Settings.Pprof != "" {
+		http.HandleFunc("/debug/input-raw", rawSnapshots(plugins))
+		http.HandleFunc("/debug/input-raw-stats", rawCaptureStats(plugins))
+		http.Handle("/debug/http-smuggling", &smugglingStats)
+		http.Handle("/debug/header-limits", &headerLimitStats)
+		http.Handle("/debug/split-output", &splitWeights)
 		go func() {
 			log.Println(http.ListenAndServe(Settings.Pprof, nil))
 		}()
@@ -126,3 +135,32 @@ func profileMEM(memprofile string) {
 		})
 	}
 }
+
+// rawSnapshots returns a handler writing the state of the messages being reassembled by the raw inputs as json
+func rawSnapshots(plugins *InOutPlugins) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		snapshots := make(map[string]tcp.Snapshot)
+		for _, in := range plugins.Inputs {
+			if raw, ok := in.(*RAWInput); ok {
+				snapshots[raw.String()] = raw.Snapshot()
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(snapshots)
+	}
+}
+
+// rawCaptureStats returns a handler writing the statistics of the capture handles of the raw inputs as json,
+// their drops tell whether the capture itself is losing packets
+func rawCaptureStats(plugins *InOutPlugins) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		stats := make(map[string]map[string]capture.CaptureStats)
+		for _, in := range plugins.Inputs {
+			if raw, ok := in.(*RAWInput); ok {
+				stats[raw.String()] = raw.CaptureStats()
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(stats)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+
+	"github.com/buger/goreplay/proto"
+	"github.com/buger/goreplay/size"
+)
+
+// the ways a message exceeds the header limits
+var (
+	errHeaderTooLarge  = errors.New("header section too large")
+	errTooManyHeaders  = errors.New("too many header fields")
+	errHeaderTruncated = errors.New("header section truncated")
+)
+
+// reasonCounts counts the messages dropped or modified by a plugin, by group and reason
+type reasonCounts struct {
+	sync.Mutex
+	counts map[string]map[string]uint64
+}
+
+func (r *reasonCounts) add(group string, err error) {
+	r.Lock()
+	if r.counts == nil {
+		r.counts = make(map[string]map[string]uint64)
+	}
+	if r.counts[group] == nil {
+		r.counts[group] = make(map[string]uint64)
+	}
+	r.counts[group][err.Error()]++
+	r.Unlock()
+}
+
+func (r *reasonCounts) get(group string, err error) uint64 {
+	r.Lock()
+	defer r.Unlock()
+	return r.counts[group][err.Error()]
+}
+
+// ServeHTTP writes the counts as json
+func (r *reasonCounts) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	r.Lock()
+	defer r.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(r.counts)
+}
+
+// headerLimitStats counts the HTTP messages dropped for exceeding the header limits, by plugin and reason
+var headerLimitStats reasonCounts
+
+// checkHeaderLimits returns why the HTTP message exceeds the maximum size of its header section or the maximum
+// number of its header fields, zero disables a limit. the messages truncated within their header section, e.g:
+// by --copy-buffer-size, are reported as well, they can't be replayed faithfully.
+func checkHeaderLimits(payload []byte, maxSize size.Size, maxCount int, truncated bool) error {
+	if !proto.HasTitle(payload) {
+		return nil
+	}
+	n, count := proto.HeaderSection(payload)
+	switch {
+	case n == -1 && truncated:
+		return errHeaderTruncated
+	case n == -1 && maxSize > 0 && len(payload) > int(maxSize):
+		return errHeaderTooLarge
+	case n == -1:
+		return nil
+	case maxSize > 0 && n > int(maxSize):
+		return errHeaderTooLarge
+	case maxCount > 0 && count > maxCount:
+		return errTooManyHeaders
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/buger/goreplay/size"
+)
+
+func TestCheckHeaderLimits(t *testing.T) {
+	cookie := "Cookie: " + strings.Repeat("a", 100) + "\r\n"
+	for _, tt := range []struct {
+		payload   string
+		maxSize   int
+		maxCount  int
+		truncated bool
+		err       error
+	}{
+		{"GET / HTTP/1.1\r\nHost: a\r\n" + cookie + "\r\n", 0, 0, false, nil},
+		{"GET / HTTP/1.1\r\nHost: a\r\n" + cookie + "\r\n", 137, 2, false, nil},
+		{"GET / HTTP/1.1\r\nHost: a\r\n" + cookie + "\r\n", 100, 0, false, errHeaderTooLarge},
+		{"GET / HTTP/1.1\r\nHost: a\r\n" + cookie + "\r\n", 0, 1, false, errTooManyHeaders},
+		// the headers are not complete yet
+		{"GET / HTTP/1.1\r\nHost: a\r\n" + cookie, 0, 0, false, nil},
+		{"GET / HTTP/1.1\r\nHost: a\r\n" + cookie, 100, 0, false, errHeaderTooLarge},
+		{"GET / HTTP/1.1\r\nHost: a\r\n" + cookie, 0, 0, true, errHeaderTruncated},
+		// the truncated bodies are not reported
+		{"POST / HTTP/1.1\r\nContent-Length: 10\r\n\r\nabc", 0, 0, true, nil},
+		{"\x00\x00\x00\x01", 1, 1, true, nil},
+	} {
+		if err := checkHeaderLimits([]byte(tt.payload), size.Size(tt.maxSize), tt.maxCount, tt.truncated); err != tt.err {
+			t.Errorf("expected %v, got %v, payload: %q", tt.err, err, tt.payload)
+		}
+	}
+}
+
+func TestHTTPOutputHeaderLimits(t *testing.T) {
+	output := &HTTPOutput{config: &HTTPOutputConfig{MaxHeaderCount: 1}}
+	request := append(payloadHeader(RequestPayload, uuid(), 1, -1), "GET / HTTP/1.1\r\nHost: a\r\nCookie: a=1\r\n\r\n"...)
+	before := headerLimitStats.get("output-http", errTooManyHeaders)
+	output.sendRequest(nil, request)
+	if n := headerLimitStats.get("output-http", errTooManyHeaders); n != before+1 {
+		t.Errorf("expected the request to be dropped and counted, got %d", n-before)
+	}
+}
@@ -0,0 +1,573 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+	"golang.org/x/net/http2/hpack"
+)
+
+// http2Window is the flow control window the client grants to the server, for the connection and each stream
+const http2Window = 1 << 30
+
+var errHTTP2GoAway = errors.New("http2 connection closed by the server")
+
+var errHTTP2Timeout = errors.New("http2 stream timed out")
+
+// http2Conn is an HTTP/2 connection replaying requests over HTTP/2(HTTPClientConfig.HTTP2), the requests of the
+// workers are multiplexed on its streams, at most maxStreams at a time, or less if the server limits them with
+// SETTINGS_MAX_CONCURRENT_STREAMS. a goroutine reads the frames of the server and another one writes the frames
+// answering them, so that a request blocked on the flow control doesn't block the connection.
+type http2Conn struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	decoder *hpack.Decoder // used by the reading goroutine only
+	control chan []byte    // the frames answering the server
+
+	// the frames of the requests are written one at a time, the header blocks are encoded and written in the
+	// order of their streams
+	writeMu sync.Mutex
+	encoder *hpack.Encoder
+	block   bytes.Buffer
+
+	mu         sync.Mutex
+	cond       *sync.Cond // signaled when a stream ends, a window opens or the connection fails
+	streams    map[uint32]*http2Stream
+	next       uint32 // the stream of the next request
+	active     int    // the streams in progress
+	maxStreams int    // the limit of the streams in progress of the client, 0 for no limit
+	serverMax  int    // the limit of the server
+	window     int64  // send window of the connection
+	initial    int64  // initial send window of streams
+	maxFrame   int
+	err        error // no new streams are started once set
+	closed     chan struct{}
+}
+
+// http2Stream is a request in progress and its response
+type http2Stream struct {
+	id     uint32
+	window int64 // send window of the stream
+	fields []hpack.HeaderField
+	body   []byte
+	block  []byte // header block waiting for its CONTINUATION frames
+	end    bool   // the header block ends the stream
+	done   chan struct{}
+	err    error
+}
+
+// newHTTP2Conn starts an HTTP/2 connection with the client preface, server push is disabled
+func newHTTP2Conn(conn net.Conn, maxStreams int) (*http2Conn, error) {
+	h := &http2Conn{
+		conn:       conn,
+		reader:     bufio.NewReader(conn),
+		control:    make(chan []byte, 64),
+		streams:    make(map[uint32]*http2Stream),
+		next:       1,
+		maxStreams: maxStreams,
+		serverMax:  1<<31 - 1,
+		window:     65535,
+		initial:    65535,
+		maxFrame:   16384,
+		closed:     make(chan struct{}),
+	}
+	h.cond = sync.NewCond(&h.mu)
+	h.encoder = hpack.NewEncoder(&h.block)
+	h.decoder = hpack.NewDecoder(4096, nil)
+	settings := make([]byte, 12)
+	binary.BigEndian.PutUint16(settings, proto.HTTP2SettingEnablePush)
+	binary.BigEndian.PutUint16(settings[6:], proto.HTTP2SettingInitialWindowSize)
+	binary.BigEndian.PutUint32(settings[8:], http2Window)
+	increment := make([]byte, 4)
+	binary.BigEndian.PutUint32(increment, http2Window-65535)
+	buf := append([]byte(nil), proto.HTTP2Preface...)
+	buf = proto.AppendHTTP2Frame(buf, proto.HTTP2Frame{Type: proto.HTTP2FrameSettings, Payload: settings})
+	buf = proto.AppendHTTP2Frame(buf, proto.HTTP2Frame{Type: proto.HTTP2FrameWindowUpdate, Payload: increment})
+	if _, err := conn.Write(buf); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	go h.readLoop()
+	go h.writeLoop()
+	return h, nil
+}
+
+// available reports whether a request can start a stream without waiting
+func (h *http2Conn) available() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.err == nil && h.active < h.limit()
+}
+
+// load returns the streams in progress, and whether the connection can start streams
+func (h *http2Conn) load() (int, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.active, h.err == nil
+}
+
+func (h *http2Conn) limit() int {
+	if h.maxStreams > 0 && h.maxStreams < h.serverMax {
+		return h.maxStreams
+	}
+	return h.serverMax
+}
+
+// roundTrip sends a request on a new stream and returns the header fields and the body of its response. the
+// request waits for a stream when the limit of the streams is reached, and the stream is reset when the
+// response isn't received within the timeout
+func (h *http2Conn) roundTrip(fields []hpack.HeaderField, body []byte, timeout time.Duration) ([]hpack.HeaderField, []byte, error) {
+	deadline := time.Now().Add(timeout)
+	// the waits on the condition end at the deadline
+	timer := time.AfterFunc(timeout, func() {
+		h.mu.Lock()
+		h.cond.Broadcast()
+		h.mu.Unlock()
+	})
+	defer timer.Stop()
+
+	h.mu.Lock()
+	for h.err == nil && h.active >= h.limit() && time.Now().Before(deadline) {
+		h.cond.Wait()
+	}
+	if h.err != nil || h.active >= h.limit() {
+		err := h.err
+		h.mu.Unlock()
+		if err == nil {
+			err = errHTTP2Timeout
+		}
+		return nil, nil, err
+	}
+	h.active++
+	h.mu.Unlock()
+
+	h.writeMu.Lock()
+	h.mu.Lock()
+	s := &http2Stream{id: h.next, window: h.initial, done: make(chan struct{})}
+	h.next += 2
+	if s.id >= 1<<31 {
+		h.err = errHTTP2GoAway
+	} else if h.err == nil {
+		h.streams[s.id] = s
+	}
+	err := h.err
+	h.mu.Unlock()
+	defer h.endStream(s)
+	if err != nil {
+		h.writeMu.Unlock()
+		return nil, nil, err
+	}
+
+	h.block.Reset()
+	for _, f := range fields {
+		if err := h.encoder.WriteField(f); err != nil {
+			h.writeMu.Unlock()
+			return nil, nil, err
+		}
+	}
+	var buf []byte
+	block := h.block.Bytes()
+	typ := proto.HTTP2FrameHeaders
+	for {
+		var flags uint8
+		n := len(block)
+		if n > h.maxFrameSize() {
+			n = h.maxFrameSize()
+		} else {
+			flags |= proto.HTTP2FlagEndHeaders
+		}
+		if typ == proto.HTTP2FrameHeaders && len(body) == 0 {
+			flags |= proto.HTTP2FlagEndStream
+		}
+		buf = proto.AppendHTTP2Frame(buf, proto.HTTP2Frame{Type: typ, Flags: flags, Stream: s.id, Payload: block[:n]})
+		block = block[n:]
+		typ = proto.HTTP2FrameContinuation
+		if len(block) == 0 {
+			break
+		}
+	}
+	err = h.write(buf, deadline)
+	h.writeMu.Unlock()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for len(body) > 0 {
+		h.mu.Lock()
+		var n int
+		for {
+			n = len(body)
+			for _, limit := range []int64{int64(h.maxFrame), h.window, s.window} {
+				if int64(n) > limit {
+					n = int(limit)
+				}
+			}
+			if n > 0 || s.err != nil || !time.Now().Before(deadline) {
+				break
+			}
+			// wait for the server to open the window
+			h.cond.Wait()
+		}
+		if s.err != nil || n <= 0 {
+			err := s.err
+			h.mu.Unlock()
+			if err == nil {
+				h.reset(s)
+				err = errHTTP2Timeout
+			}
+			return nil, nil, err
+		}
+		h.window -= int64(n)
+		s.window -= int64(n)
+		h.mu.Unlock()
+
+		var flags uint8
+		if n == len(body) {
+			flags = proto.HTTP2FlagEndStream
+		}
+		h.writeMu.Lock()
+		err := h.write(proto.AppendHTTP2Frame(nil, proto.HTTP2Frame{Type: proto.HTTP2FrameData, Flags: flags, Stream: s.id, Payload: body[:n]}), deadline)
+		h.writeMu.Unlock()
+		if err != nil {
+			return nil, nil, err
+		}
+		body = body[n:]
+	}
+
+	wait := time.NewTimer(time.Until(deadline))
+	defer wait.Stop()
+	select {
+	case <-s.done:
+	case <-wait.C:
+		h.reset(s)
+		return nil, nil, errHTTP2Timeout
+	}
+	if s.err != nil {
+		return nil, nil, s.err
+	}
+	return s.fields, s.body, nil
+}
+
+func (h *http2Conn) maxFrameSize() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.maxFrame
+}
+
+// endStream removes the stream, its frames received later are ignored
+func (h *http2Conn) endStream(s *http2Stream) {
+	h.mu.Lock()
+	delete(h.streams, s.id)
+	h.active--
+	h.cond.Broadcast()
+	h.mu.Unlock()
+}
+
+// reset cancels the stream
+func (h *http2Conn) reset(s *http2Stream) {
+	code := make([]byte, 4)
+	binary.BigEndian.PutUint32(code, proto.HTTP2ErrCodeCancel)
+	h.send(proto.HTTP2Frame{Type: proto.HTTP2FrameRSTStream, Stream: s.id, Payload: code})
+}
+
+// write writes the frames of a request, the connection fails on errors
+func (h *http2Conn) write(buf []byte, deadline time.Time) error {
+	h.conn.SetWriteDeadline(deadline)
+	if _, err := h.conn.Write(buf); err != nil {
+		h.fail(err)
+		return err
+	}
+	return nil
+}
+
+// send queues a frame answering the server
+func (h *http2Conn) send(f proto.HTTP2Frame) {
+	select {
+	case h.control <- proto.AppendHTTP2Frame(nil, f):
+	case <-h.closed:
+	}
+}
+
+func (h *http2Conn) writeLoop() {
+	for {
+		select {
+		case buf := <-h.control:
+			h.writeMu.Lock()
+			err := h.write(buf, time.Now().Add(10*time.Second))
+			h.writeMu.Unlock()
+			if err != nil {
+				return
+			}
+		case <-h.closed:
+			return
+		}
+	}
+}
+
+// fail closes the connection, the streams in progress fail with the error
+func (h *http2Conn) fail(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	select {
+	case <-h.closed:
+		return
+	default:
+	}
+	close(h.closed)
+	h.conn.Close()
+	if h.err == nil {
+		h.err = err
+	}
+	for id, s := range h.streams {
+		s.err = err
+		close(s.done)
+		delete(h.streams, id)
+	}
+	h.cond.Broadcast()
+}
+
+// Close closes the connection
+func (h *http2Conn) Close() error {
+	h.fail(errHTTP2GoAway)
+	return nil
+}
+
+func (h *http2Conn) readLoop() {
+	for {
+		if err := h.read(); err != nil {
+			h.fail(err)
+			return
+		}
+	}
+}
+
+// read reads and handles a frame from the server
+func (h *http2Conn) read() error {
+	header := make([]byte, proto.HTTP2FrameHeaderLen)
+	if _, err := io.ReadFull(h.reader, header); err != nil {
+		return err
+	}
+	data := make([]byte, proto.HTTP2FrameHeaderLen+(int(header[0])<<16|int(header[1])<<8|int(header[2])))
+	copy(data, header)
+	if _, err := io.ReadFull(h.reader, data[proto.HTTP2FrameHeaderLen:]); err != nil {
+		return err
+	}
+	f, _ := proto.ParseHTTP2Frame(data)
+	switch f.Type {
+	case proto.HTTP2FrameSettings:
+		if f.Flags&proto.HTTP2FlagAck != 0 {
+			return nil
+		}
+		var tableSize []uint32
+		h.mu.Lock()
+		for p := f.Payload; len(p) >= 6; p = p[6:] {
+			v := binary.BigEndian.Uint32(p[2:])
+			switch binary.BigEndian.Uint16(p) {
+			case proto.HTTP2SettingHeaderTableSize:
+				tableSize = append(tableSize, v)
+			case proto.HTTP2SettingMaxConcurrentStreams:
+				h.serverMax = int(v)
+			case proto.HTTP2SettingInitialWindowSize:
+				for _, s := range h.streams {
+					s.window += int64(v) - h.initial
+				}
+				h.initial = int64(v)
+			case proto.HTTP2SettingMaxFrameSize:
+				h.maxFrame = int(v)
+			}
+		}
+		h.cond.Broadcast()
+		h.mu.Unlock()
+		// the encoder is used under the write lock
+		for _, v := range tableSize {
+			h.writeMu.Lock()
+			h.encoder.SetMaxDynamicTableSizeLimit(v)
+			h.writeMu.Unlock()
+		}
+		h.send(proto.HTTP2Frame{Type: proto.HTTP2FrameSettings, Flags: proto.HTTP2FlagAck})
+	case proto.HTTP2FramePing:
+		if f.Flags&proto.HTTP2FlagAck != 0 {
+			return nil
+		}
+		h.send(proto.HTTP2Frame{Type: proto.HTTP2FramePing, Flags: proto.HTTP2FlagAck, Payload: f.Payload})
+	case proto.HTTP2FrameWindowUpdate:
+		if len(f.Payload) < 4 {
+			return proto.ErrHTTP2Frame
+		}
+		increment := int64(binary.BigEndian.Uint32(f.Payload) & (1<<31 - 1))
+		h.mu.Lock()
+		if f.Stream == 0 {
+			h.window += increment
+		} else if s := h.streams[f.Stream]; s != nil {
+			s.window += increment
+		}
+		h.cond.Broadcast()
+		h.mu.Unlock()
+	case proto.HTTP2FrameGoAway:
+		if len(f.Payload) < 8 {
+			return proto.ErrHTTP2Frame
+		}
+		// the streams after the last one processed by the server fail, the others complete
+		last := binary.BigEndian.Uint32(f.Payload) & (1<<31 - 1)
+		h.mu.Lock()
+		h.err = errHTTP2GoAway
+		for id, s := range h.streams {
+			if id > last {
+				h.endResponse(s, errHTTP2GoAway)
+			}
+		}
+		h.cond.Broadcast()
+		h.mu.Unlock()
+	case proto.HTTP2FrameRSTStream:
+		h.mu.Lock()
+		if s := h.streams[f.Stream]; s != nil {
+			h.endResponse(s, fmt.Errorf("http2 stream %d reset by the server", f.Stream))
+		}
+		h.mu.Unlock()
+	case proto.HTTP2FrameHeaders, proto.HTTP2FrameContinuation:
+		frag, err := f.Fragment()
+		if err != nil {
+			return err
+		}
+		h.mu.Lock()
+		s := h.streams[f.Stream]
+		h.mu.Unlock()
+		// the header blocks of the streams ended are decoded too, they keep the HPACK context
+		if s == nil {
+			s = new(http2Stream)
+		}
+		if f.Type == proto.HTTP2FrameHeaders {
+			s.block = s.block[:0]
+			s.end = f.Flags&proto.HTTP2FlagEndStream != 0
+		}
+		s.block = append(s.block, frag...)
+		if f.Flags&proto.HTTP2FlagEndHeaders == 0 {
+			return nil
+		}
+		fields, err := h.decoder.DecodeFull(s.block)
+		if err != nil {
+			return err
+		}
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if s.done == nil || h.streams[s.id] != s {
+			return nil
+		}
+		switch {
+		case len(fields) > 0 && fields[0].Name == ":status" && strings.HasPrefix(fields[0].Value, "1"):
+			// informational response
+		default:
+			// trailers are added to the headers, e.g: the status of gRPC calls
+			s.fields = append(s.fields, fields...)
+		}
+		if s.end {
+			h.endResponse(s, nil)
+		}
+	case proto.HTTP2FrameData:
+		if len(f.Payload) > 0 {
+			increment := make([]byte, 4)
+			binary.BigEndian.PutUint32(increment, uint32(len(f.Payload)))
+			h.send(proto.HTTP2Frame{Type: proto.HTTP2FrameWindowUpdate, Payload: increment})
+		}
+		data, err := f.Fragment()
+		if err != nil {
+			return err
+		}
+		h.mu.Lock()
+		if s := h.streams[f.Stream]; s != nil {
+			s.body = append(s.body, data...)
+			if f.Flags&proto.HTTP2FlagEndStream != 0 {
+				h.endResponse(s, nil)
+			}
+		}
+		h.mu.Unlock()
+	}
+	return nil
+}
+
+// endResponse ends the response of the stream, h.mu is held
+func (h *http2Conn) endResponse(s *http2Stream, err error) {
+	s.err = err
+	close(s.done)
+	delete(h.streams, s.id)
+	h.cond.Broadcast()
+}
+
+// http2Pool is the HTTP/2 connections shared by the workers of an output, the requests are sent on the
+// connection with the less streams in progress, and a connection is opened when all of them are at their limit
+// of streams, up to size connections
+type http2Pool struct {
+	dial       func() (net.Conn, error)
+	size       int
+	maxStreams int
+
+	mu    sync.Mutex
+	conns []*http2Conn
+}
+
+func newHTTP2Pool(dial func() (net.Conn, error), size, maxStreams int) *http2Pool {
+	if size <= 0 {
+		size = 1
+	}
+	return &http2Pool{dial: dial, size: size, maxStreams: maxStreams}
+}
+
+// get returns a connection for a request
+func (p *http2Pool) get() (*http2Conn, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var least *http2Conn
+	var leastLoad, open int
+	conns := p.conns[:0]
+	for _, h := range p.conns {
+		load, ok := h.load()
+		if !ok {
+			// the connections closed by the server are closed once their streams end
+			if load == 0 {
+				h.Close()
+			} else {
+				conns = append(conns, h)
+			}
+			continue
+		}
+		conns = append(conns, h)
+		open++
+		if least == nil || load < leastLoad {
+			least, leastLoad = h, load
+		}
+	}
+	p.conns = conns
+	if least != nil && (least.available() || open >= p.size) {
+		return least, nil
+	}
+	conn, err := p.dial()
+	if err != nil {
+		return nil, err
+	}
+	h, err := newHTTP2Conn(conn, p.maxStreams)
+	if err != nil {
+		return nil, err
+	}
+	p.conns = append(p.conns, h)
+	return h, nil
+}
+
+// Close closes the connections
+func (p *http2Pool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, h := range p.conns {
+		h.Close()
+	}
+	p.conns = nil
+	return nil
+}
@@ -5,6 +5,7 @@ import (
 	"bytes"
 	"crypto/tls"
 	"encoding/base64"
+	"fmt"
 	"io"
 	"log"
 	"net"
@@ -28,8 +29,6 @@ const (
 	maxResponseSize = 1073741824
 )
 
-var chunkedSuffix = []byte("0\r\n\r\n")
-
 var defaultPorts = map[string]string{
 	"http":  "80",
 	"https": "443",
@@ -43,8 +42,17 @@ type HTTPClientConfig struct {
 	Timeout            time.Duration
 	ResponseBufferSize int
 	CompatibilityMode  bool
+	HTTP2              bool        // requests are replayed over HTTP/2, h2c for http and h2 negotiated with ALPN for https
+	ExpectContinue     string      // wait or strip, how the requests with Expect: 100-continue are sent
+	HTTP2Pool          *http2Pool  // the HTTP/2 connections shared with other clients, a connection of the client by default
+	Dialer             *httpDialer // the limits of the connections shared with other clients, none by default
+	TLSConfig          *tls.Config // the certificate of the target is not verified by default
 }
 
+// expectContinueTimeout is how long the body of a request with Expect: 100-continue waits for the interim
+// response of the server, like the Go client the body is sent when it expires
+const expectContinueTimeout = time.Second
+
 type HTTPClient struct {
 	baseURL        string
 	scheme         string
@@ -57,6 +65,11 @@ type HTTPClient struct {
 	config         *HTTPClientConfig
 	goClient       *http.Client
 	redirectsCount int
+	h2pool         *http2Pool
+	dialer         *httpDialer
+	slot           bool // the connection holds a slot of the dialer
+	idle           bool // the connection is counted as idle by the dialer
+	idleSince      time.Time
 }
 
 func NewHTTPClient(baseURL string, config *HTTPClientConfig) *HTTPClient {
@@ -82,12 +95,36 @@ func NewHTTPClient(baseURL string, config *HTTPClientConfig) *HTTPClient {
 	client.scheme = u.Scheme
 	client.respBuf = make([]byte, config.ResponseBufferSize)
 	client.config = config
+	client.h2pool = config.HTTP2Pool
+	client.dialer = config.Dialer
+	if client.dialer == nil {
+		client.dialer = newHTTPDialer(0, 0, 0, 0, 0, nil)
+	}
 
 	if config.CompatibilityMode {
 		client.goClient = &http.Client{
 			// #TODO
 			// CheckRedirect: redirectPolicyFunc,
 		}
+		if d := config.Dialer; d != nil || config.TLSConfig != nil {
+			transport := http.DefaultTransport.(*http.Transport).Clone()
+			transport.TLSClientConfig = config.TLSConfig
+			if d == nil {
+				d = client.dialer
+			}
+			transport.DialContext = d.dialContext
+			if d.maxIdle > 0 {
+				transport.MaxIdleConns = d.maxIdle
+				transport.MaxIdleConnsPerHost = d.maxIdle
+			}
+			if d.slots != nil {
+				transport.MaxConnsPerHost = cap(d.slots)
+			}
+			if d.idleTimeout > 0 {
+				transport.IdleConnTimeout = d.idleTimeout
+			}
+			client.goClient.Transport = transport
+		}
 	}
 
 	if u.User != nil {
@@ -105,7 +142,39 @@ func NewHTTPClient(baseURL string, config *HTTPClientConfig) *HTTPClient {
 
 func (c *HTTPClient) Connect() (err error) {
 	c.Disconnect()
+	if err = c.dialer.acquire(c.config.ConnectionTimeout); err != nil {
+		return
+	}
+	if c.conn, err = c.dial(); err != nil {
+		c.dialer.release()
+		return
+	}
+	c.slot = true
+	return
+}
+
+// address returns the address the connections are dialed to, the one of the proxy or of the host
+func (c *HTTPClient) address() string {
+	if c.isProxy() {
+		return c.proxy.Host
+	}
+	if !strings.Contains(c.host, ":") {
+		return c.host + ":" + defaultPorts[c.scheme]
+	}
+	return c.host
+}
+
+// hostname returns the host without its port, the server name of TLS
+func (c *HTTPClient) hostname() string {
+	if host, _, err := net.SplitHostPort(c.host); err == nil {
+		return host
+	}
+	return c.host
+}
 
+// dial opens a connection to the host, through the proxy and wrapped in TLS for https. for HTTP/2, h2 is
+// negotiated with ALPN
+func (c *HTTPClient) dial() (conn net.Conn, err error) {
 	var toDial string
 	if !strings.Contains(c.host, ":") {
 		toDial = c.host + ":" + defaultPorts[c.scheme]
@@ -118,20 +187,21 @@ func (c *HTTPClient) Connect() (err error) {
 			panic("Unsupported HTTP Proxy method")
 		}
 		Debug(3, "[HTTPClient] Connecting to proxy", c.proxy.String(), "<>", toDial)
-		c.conn, err = net.DialTimeout("tcp", c.proxy.Host, c.config.ConnectionTimeout)
+		conn, err = c.dialer.dial(c.proxy.Host, c.config.ConnectionTimeout)
 		if err != nil {
 			return
 		}
 		if c.scheme == "https" {
-			c.conn.Write([]byte("CONNECT " + toDial + " HTTP/1.1\r\n"))
+			conn.Write([]byte("CONNECT " + toDial + " HTTP/1.1\r\n"))
 			if c.proxyAuth != "" {
-				c.conn.Write([]byte("Proxy-Authorization: " + c.proxyAuth + "\r\n"))
+				conn.Write([]byte("Proxy-Authorization: " + c.proxyAuth + "\r\n"))
 			}
-			c.conn.Write([]byte("\r\n"))
-			br := bufio.NewReader(c.conn)
+			conn.Write([]byte("\r\n"))
+			br := bufio.NewReader(conn)
 			l, _, err := br.ReadLine()
 			if err != nil {
-				return err
+				conn.Close()
+				return nil, err
 			}
 			if len(l) < 12 {
 				panic("HTTP proxy did not respond correctly")
@@ -144,7 +214,8 @@ func (c *HTTPClient) Connect() (err error) {
 				// Read until we find the empty line
 				l, _, err := br.ReadLine()
 				if err != nil {
-					return err
+					conn.Close()
+					return nil, err
 				}
 				if len(l) == 0 {
 					break
@@ -153,7 +224,7 @@ func (c *HTTPClient) Connect() (err error) {
 		}
 		Debug(3, "[HTTPClient] Proxy successfully connected")
 	} else {
-		c.conn, err = net.DialTimeout("tcp", toDial, c.config.ConnectionTimeout)
+		conn, err = c.dialer.dial(toDial, c.config.ConnectionTimeout)
 		if err != nil {
 			return
 		}
@@ -162,14 +233,29 @@ func (c *HTTPClient) Connect() (err error) {
 	if c.scheme == "https" {
 		// Wrap our socket in TLS
 		Debug(3, "[HTTPClient] Wrapping socket in TLS", c.host)
-		tlsConn := tls.Client(c.conn, &tls.Config{InsecureSkipVerify: true, ServerName: c.host})
+		config := &tls.Config{InsecureSkipVerify: true}
+		if c.config.TLSConfig != nil {
+			config = c.config.TLSConfig.Clone()
+		}
+		if config.ServerName == "" {
+			config.ServerName = c.hostname()
+		}
+		if c.config.HTTP2 {
+			config.NextProtos = []string{"h2"}
+		}
+		tlsConn := tls.Client(conn, config)
 
 		if err = tlsConn.Handshake(); err != nil {
-			return
+			conn.Close()
+			return nil, err
 		}
 
-		c.conn = tlsConn
+		conn = tlsConn
 		Debug(3, "[HTTPClient] Successfully wrapped in TLS")
+		if c.config.HTTP2 && tlsConn.ConnectionState().NegotiatedProtocol != "h2" {
+			conn.Close()
+			return nil, fmt.Errorf("%s does not support http2", c.host)
+		}
 	}
 
 	return
@@ -177,8 +263,16 @@ func (c *HTTPClient) Connect() (err error) {
 
 func (c *HTTPClient) Disconnect() {
 	if c.conn != nil {
+		if c.idle {
+			c.dialer.activeConn()
+			c.idle = false
+		}
 		c.conn.Close()
 		c.conn = nil
+		if c.slot {
+			c.dialer.release()
+			c.slot = false
+		}
 		Debug(3, "[HTTP] Disconnected: ", c.baseURL)
 	}
 }
@@ -214,10 +308,25 @@ func (c *HTTPClient) SendGoClient(data []byte) ([]byte, error) {
 		return nil, err
 	}
 
+	// the client only sends the trailers it knows of before the body is read
+	if trailers := proto.Trailers(data); trailers != nil {
+		if req.Trailer == nil {
+			req.Trailer = make(http.Header)
+		}
+		proto.ParseHeaders([][]byte{trailers}, func(header, value []byte) {
+			req.Trailer.Add(string(header), string(value))
+		})
+	}
+
 	if !c.config.OriginalHost {
 		req.Host = c.host
 	}
 
+	// the transport of the client sends the body after 100 Continue
+	if c.config.ExpectContinue == "strip" {
+		req.Header.Del("Expect")
+	}
+
 	if c.auth != "" {
 		req.Header.Add("Authorization", c.auth)
 	}
@@ -252,24 +361,37 @@ func (c *HTTPClient) Send(data []byte) (response []byte, err error) {
 	}
 
 	var readBytes int
-	if c.conn == nil || !c.isAlive(&readBytes) {
-		Debug(3, "[HTTPClient] Connecting:", c.baseURL)
-		if err = c.Connect(); err != nil {
-			Debug(1, "[HTTPClient] Connection error:", err)
-			response = errorPayload(HTTP_CONNECTION_ERROR)
-			return
+	var timeout time.Time
+	// the http2 requests are sent on the connections of the pool
+	if !c.config.HTTP2 {
+		if c.conn != nil && c.idle {
+			c.dialer.activeConn()
+			c.idle = false
+			if c.dialer.stale(c.conn, c.address(), c.idleSince) {
+				Debug(3, "[HTTPClient] idle connection expired, reconnecting")
+				c.Disconnect()
+			}
+		}
+		defer c.release()
+		if c.conn == nil || !c.isAlive(&readBytes) {
+			Debug(3, "[HTTPClient] Connecting:", c.baseURL)
+			if err = c.Connect(); err != nil {
+				Debug(1, "[HTTPClient] Connection error:", err)
+				response = errorPayload(HTTP_CONNECTION_ERROR)
+				return
+			}
 		}
-	}
 
-	timeout := time.Now().Add(c.config.Timeout)
+		timeout = time.Now().Add(c.config.Timeout)
 
-	c.conn.SetWriteDeadline(timeout)
+		c.conn.SetWriteDeadline(timeout)
+	}
 
 	if !c.config.OriginalHost {
 		data = proto.SetHost(data, []byte(c.baseURL), []byte(c.host))
 	}
 
-	if c.isProxy() && c.scheme == "http" {
+	if c.isProxy() && c.scheme == "http" && !c.config.HTTP2 {
 		path := proto.Path(data)
 		if len(path) > 0 && path[0] == '/' {
 			data = proto.SetPath(data, c.proxyPath(path))
@@ -283,13 +405,139 @@ func (c *HTTPClient) Send(data []byte) (response []byte, err error) {
 		data = proto.SetHeader(data, []byte("Authorization"), []byte(c.auth))
 	}
 
+	// the http2 requests are sent with their body at once
+	expect := bytes.EqualFold(proto.Header(data, []byte("Expect")), []byte("100-continue"))
+	if expect && (c.config.ExpectContinue == "strip" || c.config.HTTP2) {
+		data = proto.DeleteHeader(data, []byte("Expect"))
+		expect = false
+	}
+
 	if c.config.Debug {
 		Debug(3, "[HTTPClient] Sending:", string(data))
 	}
 
+	if c.config.HTTP2 {
+		return c.sendHTTP2(data)
+	}
+
+	if expect && len(proto.Body(data)) > 0 {
+		return c.sendExpectContinue(data, readBytes, timeout)
+	}
+
 	return c.send(data, readBytes, timeout)
 }
 
+// release counts the connection as idle once the request is sent, it is closed beyond the idle connections of
+// the dialer
+func (c *HTTPClient) release() {
+	// the requests of the redirects release the connection first
+	if c.conn == nil || c.idle {
+		return
+	}
+	if c.dialer.idleConn() {
+		Debug(3, "[HTTPClient] too many idle connections, disconnecting")
+		c.Disconnect()
+		return
+	}
+	c.idle = true
+	c.idleSince = time.Now()
+}
+
+// sendExpectContinue sends the headers of a request with Expect: 100-continue, and its body once the server
+// answers with 100 Continue or doesn't answer within expectContinueTimeout. when the server answers with a final
+// response instead, e.g: 417 Expectation Failed or 401 Unauthorized, the body is not sent and the connection is
+// closed once the response is read.
+func (c *HTTPClient) sendExpectContinue(data []byte, readBytes int, timeout time.Time) (response []byte, err error) {
+	end := proto.MIMEHeadersEndPos(data)
+	if _, err = c.conn.Write(data[:end]); err != nil {
+		Debug(1, "[HTTPClient] Write error:", err, c.baseURL)
+		response = errorPayload(HTTP_TIMEOUT)
+		c.Disconnect()
+		return
+	}
+	start := readBytes
+	wait := time.Now().Add(expectContinueTimeout)
+	if wait.After(timeout) {
+		wait = timeout
+	}
+	c.conn.SetReadDeadline(wait)
+	var headersEnd int
+	for headersEnd = -1; headersEnd == -1 && readBytes < len(c.respBuf); {
+		var n int
+		n, err = c.conn.Read(c.respBuf[readBytes:])
+		readBytes += n
+		headersEnd = proto.MIMEHeadersEndPos(c.respBuf[start:readBytes])
+		if err == nil {
+			continue
+		}
+		if e, ok := err.(net.Error); ok && e.Timeout() && readBytes == start {
+			// no interim response
+			Debug(3, "[HTTPClient] No 100 Continue received, sending the body")
+			return c.send(data[end:], readBytes, timeout)
+		}
+		if e, ok := err.(net.Error); !ok || !e.Timeout() || time.Now().After(timeout) {
+			Debug(1, "[HTTPClient] Read error:", err, c.baseURL)
+			response = errorPayload(HTTP_TIMEOUT)
+			c.Disconnect()
+			return
+		}
+		// the interim response is incomplete, it is waited for up to the timeout
+		c.conn.SetReadDeadline(timeout)
+	}
+	if headersEnd == -1 {
+		response = errorPayload(HTTP_UNKNOWN_ERROR)
+		c.Disconnect()
+		return
+	}
+	if status, _ := strconv.Atoi(string(proto.Status(c.respBuf[start:readBytes]))); status >= 100 && status < 200 {
+		copy(c.respBuf[start:], c.respBuf[start+headersEnd:readBytes])
+		readBytes -= headersEnd
+		return c.send(data[end:], readBytes, timeout)
+	}
+	// the final response, the server doesn't read the body
+	Debug(3, "[HTTPClient] Body not sent, the server answered to Expect: 100-continue with", string(proto.Status(c.respBuf[start:readBytes])))
+	defer c.Disconnect()
+	if proto.MessageLength(c.respBuf[start:readBytes]) != -1 {
+		response = append([]byte(nil), c.respBuf[:readBytes]...)
+		return
+	}
+	return c.send(nil, readBytes, timeout)
+}
+
+// sendHTTP2 replays the request on a new stream of a connection of the pool, the response is converted to
+// HTTP/1.1. redirects are not followed.
+func (c *HTTPClient) sendHTTP2(data []byte) (response []byte, err error) {
+	fields, body, err := proto.HTTP2Request(data, c.scheme)
+	if err != nil {
+		Debug(1, "[HTTPClient] Invalid request:", err)
+		return
+	}
+	if c.h2pool == nil {
+		c.h2pool = newHTTP2Pool(c.dial, 1, 0)
+	}
+	h2, err := c.h2pool.get()
+	if err != nil {
+		Debug(1, "[HTTPClient] Connection error:", err)
+		response = errorPayload(HTTP_CONNECTION_ERROR)
+		return
+	}
+	if fields, body, err = h2.roundTrip(fields, body, c.config.Timeout); err != nil {
+		Debug(1, "[HTTPClient] http2 error:", err, c.baseURL)
+		response = errorPayload(HTTP_TIMEOUT)
+		return
+	}
+	response = proto.HTTP2Message(fields, body)
+	if len(response) > c.config.ResponseBufferSize {
+		response = response[:c.config.ResponseBufferSize]
+	}
+
+	if c.config.Debug {
+		Debug(3, "[HTTPClient] Received:", string(response))
+	}
+
+	return
+}
+
 func (c *HTTPClient) send(data []byte, readBytes int, timeout time.Time) (response []byte, err error) {
 	var payload []byte
 	var n int
@@ -350,8 +598,8 @@ func (c *HTTPClient) send(data []byte, readBytes int, timeout time.Time) (respon
 			}
 
 			if chunked {
-				// Check if chunked message finished
-				if bytes.HasSuffix(c.respBuf[:readBytes], chunkedSuffix) {
+				// Check if chunked message finished, trailers may follow the last chunk
+				if proto.IsChunkedEnd(c.respBuf[:readBytes]) {
 					break
 				}
 			} else if contentLength != -1 {
@@ -382,8 +630,8 @@ func (c *HTTPClient) send(data []byte, readBytes int, timeout time.Time) (respon
 			currentContentLength += n
 
 			if chunked {
-				// Check if chunked message finished
-				if bytes.HasSuffix(currentChunk[:n], chunkedSuffix) {
+				// Check if chunked message finished, trailers may follow the last chunk
+				if proto.IsChunkedEnd(currentChunk[:n]) {
 					break
 				}
 			} else if contentLength != -1 {
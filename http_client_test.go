@@ -1,8 +1,10 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"crypto/rand"
+	"fmt"
 	"io/ioutil"
 	_ "log"
 	"net"
@@ -108,6 +110,121 @@ func TestHTTPClientSend(t *testing.T) {
 	wg.Wait()
 }
 
+func TestHTTPClientTrailers(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if string(body) != "Wiki" || r.Trailer.Get("Grpc-Status") != "0" {
+			t.Errorf("expected the body and the trailers of the request, got %q %v", body, r.Trailer)
+		}
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Write([]byte("pedia"))
+		w.(http.Flusher).Flush()
+		w.Header().Set("Grpc-Status", "14")
+	}))
+	defer server.Close()
+
+	payload := []byte("POST / HTTP/1.1\r\nHost: www.w3.org\r\nTransfer-Encoding: chunked\r\n\r\n4\r\nWiki\r\n0\r\nGrpc-Status: 0\r\n\r\n")
+	for _, compatibility := range []bool{false, true} {
+		// the response would end with the timeout if its trailers were not expected
+		client := NewHTTPClient(server.URL, &HTTPClientConfig{Timeout: 5 * time.Second, CompatibilityMode: compatibility})
+		start := time.Now()
+		resp, err := client.Send(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if time.Since(start) > 2*time.Second {
+			t.Errorf("expected the end of the response to be found, it took %s", time.Since(start))
+		}
+		var status []byte
+		proto.ParseHeaders([][]byte{proto.Trailers(resp)}, func(header, value []byte) {
+			if string(header) == "Grpc-Status" {
+				status = value
+			}
+		})
+		if string(status) != "14" {
+			t.Errorf("expected the trailers of the response with compatibility mode %v, got %q", compatibility, resp)
+		}
+	}
+}
+
+func TestHTTPClientExpectContinue(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	// the path of the request tells the server how to answer
+	bodies := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					req, err := http.ReadRequest(r)
+					if err != nil {
+						return
+					}
+					switch req.URL.Path {
+					case "/continue":
+						conn.Write([]byte("HTTP/1.1 100 Continue\r\n\r\n"))
+					case "/reject":
+						conn.Write([]byte("HTTP/1.1 417 Expectation Failed\r\nContent-Length: 0\r\n\r\n"))
+						// the body must not follow
+						conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+						if n, _ := r.Read(make([]byte, 1)); n > 0 {
+							bodies <- "unexpected body"
+						}
+						return
+					}
+					body, _ := ioutil.ReadAll(req.Body)
+					bodies <- req.Header.Get("Expect") + ":" + string(body)
+					conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"))
+				}
+			}()
+		}
+	}()
+
+	request := func(path string) []byte {
+		return []byte("POST " + path + " HTTP/1.1\r\nHost: www.w3.org\r\nExpect: 100-continue\r\nContent-Length: 4\r\n\r\nWiki")
+	}
+	for _, tt := range []struct {
+		mode, path string
+		status     string
+		body       string
+	}{
+		{"wait", "/continue", "200", "100-continue:Wiki"},
+		{"wait", "/reject", "417", ""},
+		// the server doesn't answer, the body is sent after expectContinueTimeout
+		{"wait", "/silent", "200", "100-continue:Wiki"},
+		{"strip", "/silent", "200", ":Wiki"},
+	} {
+		client := NewHTTPClient(ln.Addr().String(), &HTTPClientConfig{Timeout: 5 * time.Second, ExpectContinue: tt.mode})
+		resp, err := client.Send(request(tt.path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status := string(proto.Status(resp)); status != tt.status {
+			t.Errorf("expected %s to the %s request with %s, got %q", tt.status, tt.path, tt.mode, resp)
+		}
+		if tt.body != "" {
+			if body := <-bodies; body != tt.body {
+				t.Errorf("expected the %s request with %s to be received with %q, got %q", tt.path, tt.mode, tt.body, body)
+			}
+		}
+		client.Disconnect()
+	}
+	select {
+	case body := <-bodies:
+		t.Errorf("expected no more requests, got %q", body)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
 func TestHTTPClientResonseByClose(t *testing.T) {
 	wg := new(sync.WaitGroup)
 
@@ -530,3 +647,115 @@ func TestHTTPClientHandleHTTP10(t *testing.T) {
 // 		t.Error("Should throw error")
 // 	}
 // }
+
+func TestHTTPClientHTTP2(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("X-Proto", r.Proto)
+		w.Write(append([]byte(r.Method+" "+r.URL.Path+" "), body...))
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	client := NewHTTPClient(server.URL, &HTTPClientConfig{HTTP2: true})
+	large := bytes.Repeat([]byte("a"), 100000)
+	for i, req := range [][]byte{
+		[]byte("GET /a HTTP/1.1\r\nHost: example.com\r\n\r\n"),
+		append([]byte("POST /b HTTP/1.1\r\nContent-Length: 100000\r\n\r\n"), large...),
+	} {
+		resp, err := client.Send(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !proto.HasResponseTitle(resp) || string(proto.Header(resp, []byte("X-Proto"))) != "HTTP/2.0" {
+			t.Fatalf("expected an http2 response, got %q", resp)
+		}
+		want := "GET /a "
+		if i == 1 {
+			// the response is truncated to the response buffer
+			want = "POST /b aaa"
+		}
+		if body := proto.Body(resp); !bytes.HasPrefix(body, []byte(want)) {
+			t.Errorf("expected the body to start with %q, got %q", want, body)
+		}
+	}
+	if client.h2pool == nil || len(client.h2pool.conns) != 1 || client.h2pool.conns[0].next != 5 {
+		t.Error("expected the requests to be sent on the streams of a connection")
+	}
+}
+
+func TestHTTPClientHTTP2Multiplexing(t *testing.T) {
+	var mu sync.Mutex
+	var inProgress, maxInProgress, conns int
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inProgress++
+		if inProgress > maxInProgress {
+			maxInProgress = inProgress
+		}
+		mu.Unlock()
+		time.Sleep(50 * time.Millisecond)
+		mu.Lock()
+		inProgress--
+		mu.Unlock()
+		w.Write([]byte(r.URL.Path))
+	}))
+	server.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			mu.Lock()
+			conns++
+			mu.Unlock()
+		}
+	}
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	// the workers share 2 connections of 3 streams at most
+	dialer := NewHTTPClient(server.URL, &HTTPClientConfig{HTTP2: true})
+	pool := newHTTP2Pool(dialer.dial, 2, 3)
+	defer pool.Close()
+	var wg sync.WaitGroup
+	for i := 0; i < 12; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			client := NewHTTPClient(server.URL, &HTTPClientConfig{HTTP2: true, Timeout: 5 * time.Second, HTTP2Pool: pool})
+			path := fmt.Sprintf("/%d", i)
+			resp, _ := client.Send([]byte("GET " + path + " HTTP/1.1\r\n\r\n"))
+			if string(proto.Status(resp)) != "200" || string(proto.Body(resp)) != path {
+				t.Errorf("unexpected response %q", resp)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if conns != 2 || maxInProgress < 4 || maxInProgress > 6 {
+		t.Errorf("expected 2 connections of 3 streams, got %d connections and %d requests in progress", conns, maxInProgress)
+	}
+}
+
+func TestHTTPClientHTTP2Timeout(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(300 * time.Millisecond)
+		}
+		w.Write([]byte(r.URL.Path))
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	client := NewHTTPClient(server.URL, &HTTPClientConfig{HTTP2: true, Timeout: 100 * time.Millisecond})
+	if resp, _ := client.Send([]byte("GET /slow HTTP/1.1\r\n\r\n")); !bytes.Equal(resp, errorPayload(HTTP_TIMEOUT)) {
+		t.Errorf("expected the request to time out, got %q", resp)
+	}
+	// the stream is reset, the connection is kept
+	if resp, _ := client.Send([]byte("GET /fast HTTP/1.1\r\n\r\n")); string(proto.Body(resp)) != "/fast" {
+		t.Errorf("unexpected response %q", resp)
+	}
+	if len(client.h2pool.conns) != 1 {
+		t.Errorf("expected the connection to be kept, got %d connections", len(client.h2pool.conns))
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httputil"
+	"strconv"
+
+	"github.com/buger/goreplay/proto"
+)
+
+// decodedEncodingHeader keeps the Content-Encoding of the bodies decoded by --http-decode-body
+var decodedEncodingHeader = []byte("X-Gor-Content-Encoding")
+
+// decodeHTTPBody decodes the body of the requests and the responses with a Content-Encoding, so that the filters,
+// the modifiers and the middleware see their content. the chunked bodies are dechunked, their trailers become
+// headers, and the encoding is kept in the X-Gor-Content-Encoding header for --output-http-recompress. the
+// bodies whose encoding is not supported, like compress, or that decode to more than --copy-buffer-size are left
+// as is.
+func decodeHTTPBody(payload []byte) []byte {
+	headSize := bytes.IndexByte(payload, '\n') + 1
+	head, msg := payload[:headSize], payload[headSize:]
+	if !proto.HasTitle(msg) {
+		return payload
+	}
+	end := proto.MIMEHeadersEndPos(msg)
+	if end == -1 {
+		return payload
+	}
+	headers := msg[:end]
+	encoding := string(proto.Header(headers, []byte("Content-Encoding")))
+	if encoding == "" {
+		return payload
+	}
+	content := msg[end:]
+	chunked := bytes.Contains(proto.Header(headers, []byte("Transfer-Encoding")), []byte("chunked"))
+	var trailers []byte
+	if chunked {
+		trailers = proto.Trailers(msg)
+		var err error
+		if content, err = ioutil.ReadAll(httputil.NewChunkedReader(bytes.NewReader(content))); err != nil {
+			return payload
+		}
+	}
+	max := int(Settings.CopyBufferSize)
+	if max < 1 {
+		max = 5 << 20
+	}
+	decoded, err := proto.DecodeContent(encoding, content, max)
+	if err != nil {
+		Debug(3, "[HTTP-DECODER] body left encoded:", err)
+		return payload
+	}
+
+	headers = append([]byte(nil), headers...)
+	if chunked {
+		headers = proto.DeleteHeader(headers, []byte("Transfer-Encoding"))
+		headers = addTrailers(headers, trailers)
+	}
+	headers = proto.DeleteHeader(headers, []byte("Content-Encoding"))
+	headers = proto.SetHeader(headers, decodedEncodingHeader, []byte(encoding))
+	headers = proto.SetHeader(headers, []byte("Content-Length"), []byte(strconv.Itoa(len(decoded))))
+
+	out := make([]byte, 0, len(head)+len(headers)+len(decoded))
+	return append(append(append(out, head...), headers...), decoded...)
+}
+
+// messageBody returns the body of the HTTP message, dechunked and decoded, for the outputs which show or compare
+// the content
+func messageBody(msg []byte) []byte {
+	end := proto.MIMEHeadersEndPos(msg)
+	if end == -1 {
+		return nil
+	}
+	headers, body := msg[:end], msg[end:]
+	if bytes.Contains(proto.Header(headers, []byte("Transfer-Encoding")), []byte("chunked")) {
+		if dechunked, err := ioutil.ReadAll(httputil.NewChunkedReader(bytes.NewReader(body))); err == nil {
+			body = dechunked
+		}
+	}
+	if encoding := proto.Header(headers, []byte("Content-Encoding")); len(encoding) > 0 {
+		max := int(Settings.CopyBufferSize)
+		if max < 1 {
+			max = 5 << 20
+		}
+		if decoded, err := proto.DecodeContent(string(encoding), body, max); err == nil {
+			body = decoded
+		}
+	}
+	return body
+}
+
+// recompressHTTPBody encodes the body of a request decoded by decodeHTTPBody back with its Content-Encoding,
+// the request is sent decoded if it fails
+func recompressHTTPBody(data []byte) []byte {
+	encoding := string(proto.Header(data, decodedEncodingHeader))
+	if encoding == "" {
+		return data
+	}
+	data = proto.DeleteHeader(data, decodedEncodingHeader)
+	body, err := proto.EncodeContent(encoding, proto.Body(data))
+	if err != nil {
+		Debug(1, "[HTTP-DECODER] body sent decoded:", err)
+		return data
+	}
+	data = proto.SetHeader(data, []byte("Content-Encoding"), []byte(encoding))
+	data = proto.SetHeader(data, []byte("Content-Length"), []byte(strconv.Itoa(len(body))))
+	end := proto.MIMEHeadersEndPos(data)
+	return append(data[:end:end], body...)
+}
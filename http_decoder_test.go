@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+)
+
+func gzipBody(t *testing.T, body string) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write([]byte(body))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecodeHTTPBody(t *testing.T) {
+	encoded := gzipBody(t, `{"email":"a@b.c"}`)
+	request := append([]byte("1 1 1\nPOST / HTTP/1.1\r\nContent-Encoding: gzip\r\nContent-Length: "+strconv.Itoa(len(encoded))+"\r\n\r\n"), encoded...)
+	decoded := decodeHTTPBody(request)
+	if string(decoded) != "1 1 1\nPOST / HTTP/1.1\r\nX-Gor-Content-Encoding: gzip\r\nContent-Length: 17\r\n\r\n{\"email\":\"a@b.c\"}" {
+		t.Errorf("expected the body to be decoded, got %q", decoded)
+	}
+
+	// chunked, with trailers
+	chunked := []byte("2 1 1\nHTTP/1.1 200 OK\r\nContent-Encoding: gzip\r\nTransfer-Encoding: chunked\r\n\r\n")
+	chunked = append(chunked, strconv.FormatInt(int64(len(encoded)), 16)+"\r\n"...)
+	chunked = append(append(chunked, encoded...), "\r\n0\r\nGrpc-Status: 0\r\n\r\n"...)
+	if decoded := decodeHTTPBody(chunked); string(decoded) != "2 1 1\nHTTP/1.1 200 OK\r\nContent-Length: 17\r\nX-Gor-Content-Encoding: gzip\r\nGrpc-Status: 0\r\n\r\n{\"email\":\"a@b.c\"}" {
+		t.Errorf("expected the chunked body to be decoded, got %q", decoded)
+	}
+
+	// left as is
+	for _, payload := range []string{
+		"1 1 1\nPOST / HTTP/1.1\r\nContent-Encoding: compress\r\nContent-Length: 4\r\n\r\nWiki",
+		"1 1 1\nPOST / HTTP/1.1\r\nContent-Encoding: gzip\r\nContent-Length: 4\r\n\r\nWiki",
+		"1 1 1\nPOST / HTTP/1.1\r\nContent-Length: 4\r\n\r\nWiki",
+	} {
+		if decoded := decodeHTTPBody([]byte(payload)); string(decoded) != payload {
+			t.Errorf("expected the payload to be left as is, got %q", decoded)
+		}
+	}
+
+	// encoded back
+	data := recompressHTTPBody(payloadBody(decoded))
+	if proto.Header(data, decodedEncodingHeader) != nil || string(proto.Header(data, []byte("Content-Encoding"))) != "gzip" {
+		t.Fatalf("expected the request to be encoded with gzip, got %q", data)
+	}
+	if body, err := proto.DecodeContent("gzip", proto.Body(data), 100); err != nil || string(body) != `{"email":"a@b.c"}` ||
+		string(proto.Header(data, []byte("Content-Length"))) != strconv.Itoa(len(proto.Body(data))) {
+		t.Errorf("expected the body to be encoded back, got %q %v", data, err)
+	}
+}
+
+func TestEmitterDecodeHTTPBody(t *testing.T) {
+	Settings.DecodeHTTPBody = true
+	defer func() { Settings.DecodeHTTPBody = false }()
+	wg := new(sync.WaitGroup)
+	quit := make(chan int)
+
+	input := NewTestInput()
+	input.skipHeader = true
+	var received [][]byte
+	output := NewTestOutput(func(data []byte) {
+		received = append(received, append([]byte(nil), data...))
+		wg.Done()
+	})
+
+	plugins := &InOutPlugins{
+		Inputs:  []io.Reader{input},
+		Outputs: []io.Writer{output},
+	}
+	plugins.All = append(plugins.All, input, output)
+
+	emitter := NewEmitter(quit)
+	go emitter.Start(plugins, "")
+
+	wg.Add(1)
+	encoded := gzipBody(t, "a=1&b=2")
+	req := payloadHeader(RequestPayload, uuid(), time.Now().UnixNano(), -1)
+	req = append(req, "POST / HTTP/1.1\r\nContent-Encoding: gzip\r\nContent-Length: "+strconv.Itoa(len(encoded))+"\r\n\r\n"...)
+	input.EmitBytes(append(req, encoded...))
+	wg.Wait()
+	emitter.Close()
+
+	if len(received) != 1 || string(proto.Body(payloadBody(received[0]))) != "a=1&b=2" {
+		t.Errorf("expected the body of the request to be decoded, got %q", received)
+	}
+}
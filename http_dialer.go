@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var errHTTPConnLimit = errors.New("no connection available within the timeout")
+
+// httpDialer opens the connections of the HTTP clients of an output, it is shared by their workers to mimic the
+// connection pool of the clients of production: the connections are limited to maxConns, the idle connections
+// beyond maxIdle are closed, like the ones idle for more than idleTimeout. with dnsRefresh, the addresses of the
+// hosts are resolved again on this interval and the connections are dialed to them in turn, the connections to
+// addresses no longer resolved are closed. the hosts are resolved with the resolver of the output
+type httpDialer struct {
+	// Keep this as first element of struct because it guarantees 64bit
+	// alignment. atomic.* functions crash on 32bit machines if operand is not
+	// aligned at 64bit. See https://github.com/golang/go/issues/599
+	idle int64 // the idle connections
+
+	keepAlive   time.Duration // 0 for the default of the system, negative to disable the TCP keep-alives
+	maxIdle     int
+	idleTimeout time.Duration
+	dnsRefresh  time.Duration
+	slots       chan struct{} // the connections open when limited
+	resolver    *dnsResolver
+
+	mu    sync.Mutex
+	hosts map[string]*httpResolved
+}
+
+// httpResolved is the addresses of a host
+type httpResolved struct {
+	addrs      []string
+	resolvedAt time.Time
+	next       int
+}
+
+func newHTTPDialer(keepAlive time.Duration, maxConns, maxIdle int, idleTimeout, dnsRefresh time.Duration, resolver *dnsResolver) *httpDialer {
+	d := &httpDialer{keepAlive: keepAlive, maxIdle: maxIdle, idleTimeout: idleTimeout, dnsRefresh: dnsRefresh, resolver: resolver, hosts: make(map[string]*httpResolved)}
+	if maxConns > 0 {
+		d.slots = make(chan struct{}, maxConns)
+	}
+	return d
+}
+
+// acquire waits for the limit of the connections, up to the timeout
+func (d *httpDialer) acquire(timeout time.Duration) error {
+	if d.slots == nil {
+		return nil
+	}
+	select {
+	case d.slots <- struct{}{}:
+		return nil
+	default:
+	}
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case d.slots <- struct{}{}:
+		return nil
+	case <-t.C:
+		return errHTTPConnLimit
+	}
+}
+
+// release releases a connection acquired
+func (d *httpDialer) release() {
+	if d.slots != nil {
+		<-d.slots
+	}
+}
+
+// dial dials the address, host:port, to the addresses of the host resolved by the dialer with dnsRefresh
+func (d *httpDialer) dial(address string, timeout time.Duration) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout, KeepAlive: d.keepAlive}
+	if resolved := d.resolve(address); resolved != "" {
+		return dialer.Dial("tcp", resolved)
+	}
+	return d.resolver.dialContext(context.Background(), dialer, "tcp", address)
+}
+
+// dialContext is the dial function of the transport of the Go client
+func (d *httpDialer) dialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	dialer := &net.Dialer{KeepAlive: d.keepAlive}
+	if resolved := d.resolve(address); resolved != "" {
+		return dialer.DialContext(ctx, network, resolved)
+	}
+	return d.resolver.dialContext(ctx, dialer, network, address)
+}
+
+// resolve returns the next address of the host of the address, empty without dnsRefresh
+func (d *httpDialer) resolve(address string) string {
+	addrs := d.addresses(address)
+	if len(addrs) == 0 {
+		return ""
+	}
+	_, port, _ := net.SplitHostPort(address)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	r := d.hosts[address]
+	r.next++
+	return net.JoinHostPort(addrs[r.next%len(addrs)], port)
+}
+
+// addresses returns the addresses of the host of the address, resolved again every dnsRefresh
+func (d *httpDialer) addresses(address string) []string {
+	if d.dnsRefresh <= 0 {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil || net.ParseIP(host) != nil {
+		return nil
+	}
+	d.mu.Lock()
+	r := d.hosts[address]
+	if r != nil && time.Since(r.resolvedAt) < d.dnsRefresh {
+		d.mu.Unlock()
+		return r.addrs
+	}
+	if r == nil {
+		r = new(httpResolved)
+		d.hosts[address] = r
+	}
+	// the other connections keep the previous addresses while the host is resolved
+	r.resolvedAt = time.Now()
+	previous := r.addrs
+	d.mu.Unlock()
+
+	addrs, err := d.resolver.lookupHost(context.Background(), host)
+	if err != nil || len(addrs) == 0 {
+		Debug(1, "[HTTPClient] DNS error:", host, err)
+		return previous
+	}
+	d.mu.Lock()
+	r.addrs = addrs
+	d.mu.Unlock()
+	return addrs
+}
+
+// stale reports whether the connection to the address is idle for more than idleTimeout, or no longer to one of
+// the addresses of its host
+func (d *httpDialer) stale(conn net.Conn, address string, idleSince time.Time) bool {
+	if d.idleTimeout > 0 && time.Since(idleSince) > d.idleTimeout {
+		return true
+	}
+	addrs := d.addresses(address)
+	if len(addrs) == 0 {
+		return false
+	}
+	ip, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	for _, addr := range addrs {
+		if addr == ip {
+			return false
+		}
+	}
+	return true
+}
+
+// idleConn counts a connection becoming idle, it reports whether it is beyond maxIdle and must be closed
+func (d *httpDialer) idleConn() bool {
+	if n := atomic.AddInt64(&d.idle, 1); d.maxIdle > 0 && n > int64(d.maxIdle) {
+		atomic.AddInt64(&d.idle, -1)
+		return true
+	}
+	return false
+}
+
+// activeConn counts an idle connection used again or closed
+func (d *httpDialer) activeConn() {
+	atomic.AddInt64(&d.idle, -1)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHTTPDialerLimits(t *testing.T) {
+	var mu sync.Mutex
+	var conns int
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			mu.Lock()
+			conns++
+			mu.Unlock()
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	request := []byte("GET / HTTP/1.1\r\n\r\n")
+	client := func(d *httpDialer) *HTTPClient {
+		return NewHTTPClient(server.URL, &HTTPClientConfig{Timeout: 100 * time.Millisecond, Dialer: d})
+	}
+
+	// the second idle connection is closed
+	d := newHTTPDialer(0, 0, 1, 0, 0, nil)
+	c1, c2 := client(d), client(d)
+	c1.Send(request)
+	c2.Send(request)
+	if c1.conn == nil || c2.conn != nil {
+		t.Error("expected the second idle connection to be closed")
+	}
+	c1.Disconnect()
+
+	// the request waits for the connection of the other client
+	d = newHTTPDialer(0, 1, 0, 0, 0, nil)
+	c1, c2 = client(d), client(d)
+	c1.Send(request)
+	if resp, _ := c2.Send(request); string(httpStatus(resp)) != HTTP_CONNECTION_ERROR {
+		t.Errorf("expected the connections to be limited, got %q", resp)
+	}
+	c1.Disconnect()
+	if resp, _ := c2.Send(request); string(httpStatus(resp)) != "200" {
+		t.Errorf("expected a connection, got %q", resp)
+	}
+	c2.Disconnect()
+
+	// the idle connection expires
+	d = newHTTPDialer(0, 0, 0, 50*time.Millisecond, 0, nil)
+	c1 = client(d)
+	c1.Send(request)
+	c1.Send(request)
+	time.Sleep(60 * time.Millisecond)
+	c1.Send(request)
+	c1.Disconnect()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if conns != 6 {
+		t.Errorf("expected 6 connections, got %d", conns)
+	}
+}
+
+func TestHTTPDialerDNSRefresh(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+
+	d := newHTTPDialer(0, 0, 0, 0, time.Minute, nil)
+	d.hosts["gor.test:"+port] = &httpResolved{addrs: []string{"127.0.0.1"}, resolvedAt: time.Now()}
+	conn, err := d.dial("gor.test:"+port, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if d.stale(conn, "gor.test:"+port, time.Now()) {
+		t.Error("expected the connection to one of the addresses of the host")
+	}
+	d.hosts["gor.test:"+port].addrs = []string{"127.0.0.2", "127.0.0.3"}
+	if !d.stale(conn, "gor.test:"+port, time.Now()) {
+		t.Error("expected the connection to be stale once the host is resolved to other addresses")
+	}
+	if a, b := d.resolve("gor.test:"+port), d.resolve("gor.test:"+port); a == b || a != "127.0.0.2:"+port && a != "127.0.0.3:"+port {
+		t.Errorf("expected the addresses in turn, got %s and %s", a, b)
+	}
+}
@@ -4,13 +4,21 @@ import (
 	"bytes"
 	"encoding/base64"
 	"hash/fnv"
+	"math/rand"
 	"strings"
 
 	"github.com/buger/goreplay/proto"
 )
 
+// redactedPart replaces the content of the parts redacted by --http-redact-multipart-part
+var redactedPart = []byte("[redacted]")
+
+// smugglingStats counts the requests with an ambiguous framing by action and reason, see --http-smuggling
+var smugglingStats reasonCounts
+
 type HTTPModifier struct {
-	config *HTTPModifierConfig
+	config        *HTTPModifierConfig
+	normalization *proto.URLNormalization // of the URLs matched by the filters, the requests keep their URL
 }
 
 func NewHTTPModifier(config *HTTPModifierConfig) *HTTPModifier {
@@ -26,11 +34,37 @@ func NewHTTPModifier(config *HTTPModifierConfig) *HTTPModifier {
 		len(config.ParamHashFilters) == 0 &&
 		len(config.Params) == 0 &&
 		len(config.Headers) == 0 &&
-		len(config.Methods) == 0 {
+		len(config.Methods) == 0 &&
+		len(config.GRPCMethods) == 0 &&
+		len(config.GRPCNegativeMethods) == 0 &&
+		len(config.GraphQLOperations) == 0 &&
+		len(config.GraphQLNegativeOperations) == 0 &&
+		len(config.GraphQLLimiters) == 0 &&
+		config.Smuggling == SmugglingKeep &&
+		len(config.MultipartDrop) == 0 &&
+		len(config.MultipartRedact) == 0 {
 		return nil
 	}
 
-	return &HTTPModifier{config: config}
+	return &HTTPModifier{config: config, normalization: config.URLNormalization()}
+}
+
+// path returns the path of the request matched by the URL filters, normalized with --http-normalize-url
+func (m *HTTPModifier) path(payload []byte) []byte {
+	if m.normalization == nil {
+		return proto.Path(payload)
+	}
+	return proto.NormalizeURL(proto.Path(payload), m.normalization)
+}
+
+// normalizedURL returns the URL of the request normalized for the stats, or an empty string if
+// --http-normalize-url and --http-url-template are not set
+func normalizedURL(req []byte) string {
+	n := Settings.ModifierConfig.URLNormalization()
+	if n == nil {
+		return ""
+	}
+	return string(proto.NormalizeURL(proto.Path(req), n))
 }
 
 func (m *HTTPModifier) Rewrite(payload []byte) (response []byte) {
@@ -38,6 +72,18 @@ func (m *HTTPModifier) Rewrite(payload []byte) (response []byte) {
 		return payload
 	}
 
+	if m.config.Smuggling != SmugglingKeep {
+		if err := proto.FramingError(payload); err != nil {
+			if m.config.Smuggling == SmugglingDrop {
+				smugglingStats.add("dropped", err)
+				Debug(2, "[HTTP-MODIFIER] request dropped:", err)
+				return
+			}
+			smugglingStats.add("normalized", err)
+			payload = proto.NormalizeFraming(payload)
+		}
+	}
+
 	if len(m.config.Methods) > 0 {
 		method := proto.Method(payload)
 
@@ -55,6 +101,27 @@ func (m *HTTPModifier) Rewrite(payload []byte) (response []byte) {
 		}
 	}
 
+	if len(m.config.GRPCMethods) > 0 && !m.config.GRPCMethods.Match(proto.GRPCMethod(payload)) {
+		return
+	}
+
+	if len(m.config.GRPCNegativeMethods) > 0 && m.config.GRPCNegativeMethods.Match(proto.GRPCMethod(payload)) {
+		return
+	}
+
+	if len(m.config.GraphQLOperations) > 0 || len(m.config.GraphQLNegativeOperations) > 0 || len(m.config.GraphQLLimiters) > 0 {
+		ops := proto.GraphQLOperations(payload)
+		if len(m.config.GraphQLOperations) > 0 && !m.config.GraphQLOperations.Match(ops) {
+			return
+		}
+		if len(m.config.GraphQLNegativeOperations) > 0 && m.config.GraphQLNegativeOperations.Match(ops) {
+			return
+		}
+		if len(m.config.GraphQLLimiters) > 0 && m.config.GraphQLLimiters.Percent(ops) <= rand.Intn(100) {
+			return
+		}
+	}
+
 	if len(m.config.Headers) > 0 {
 		for _, header := range m.config.Headers {
 			payload = proto.SetHeader(payload, []byte(header.Name), []byte(header.Value))
@@ -68,7 +135,7 @@ func (m *HTTPModifier) Rewrite(payload []byte) (response []byte) {
 	}
 
 	if len(m.config.URLRegexp) > 0 {
-		path := proto.Path(payload)
+		path := m.path(payload)
 
 		matched := false
 
@@ -85,7 +152,7 @@ func (m *HTTPModifier) Rewrite(payload []byte) (response []byte) {
 	}
 
 	if len(m.config.URLNegativeRegexp) > 0 {
-		path := proto.Path(payload)
+		path := m.path(payload)
 
 		for _, f := range m.config.URLNegativeRegexp {
 			if f.regexp.Match(path) {
@@ -96,13 +163,17 @@ func (m *HTTPModifier) Rewrite(payload []byte) (response []byte) {
 
 	if len(m.config.HeaderFilters) > 0 {
 		for _, f := range m.config.HeaderFilters {
-			value := proto.Header(payload, f.name)
+			// one of the fields with the name has to match
+			matched := false
 
-			if len(value) == 0 {
-				return
+			for _, value := range proto.HeaderValues(payload, f.name) {
+				if len(value) > 0 && f.regexp.Match(value) {
+					matched = true
+					break
+				}
 			}
 
-			if !f.regexp.Match(value) {
+			if !matched {
 				return
 			}
 		}
@@ -110,10 +181,10 @@ func (m *HTTPModifier) Rewrite(payload []byte) (response []byte) {
 
 	if len(m.config.HeaderNegativeFilters) > 0 {
 		for _, f := range m.config.HeaderNegativeFilters {
-			value := proto.Header(payload, f.name)
-
-			if len(value) > 0 && f.regexp.Match(value) {
-				return
+			for _, value := range proto.HeaderValues(payload, f.name) {
+				if len(value) > 0 && f.regexp.Match(value) {
+					return
+				}
 			}
 		}
 	}
@@ -165,6 +236,18 @@ func (m *HTTPModifier) Rewrite(payload []byte) (response []byte) {
 		}
 	}
 
+	if len(m.config.MultipartDrop) > 0 || len(m.config.MultipartRedact) > 0 {
+		parts, _ := proto.MultipartParts(payload)
+		// the last parts are modified first, the offsets of the others stay valid
+		for i := len(parts) - 1; i >= 0; i-- {
+			if m.config.MultipartDrop.Match(parts[i]) {
+				payload = proto.DeletePart(payload, parts[i])
+			} else if m.config.MultipartRedact.Match(parts[i]) {
+				payload = proto.SetPartContent(payload, parts[i], redactedPart)
+			}
+		}
+	}
+
 	if len(m.config.URLRewrite) > 0 {
 		path := proto.Path(payload)
 
@@ -180,15 +263,12 @@ func (m *HTTPModifier) Rewrite(payload []byte) (response []byte) {
 
 	if len(m.config.HeaderRewrite) > 0 {
 		for _, f := range m.config.HeaderRewrite {
-			value := proto.Header(payload, f.header)
-			if len(value) == 0 {
-				break
-			}
-
-			if f.src.Match(value) {
-				newValue := f.src.ReplaceAll(value, f.target)
-				payload = proto.SetHeader(payload, f.header, newValue)
-			}
+			payload = proto.ReplaceHeaderValues(payload, f.header, func(value []byte) []byte {
+				if f.src.Match(value) {
+					return f.src.ReplaceAll(value, f.target)
+				}
+				return value
+			})
 		}
 	}
 
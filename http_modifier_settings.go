@@ -3,9 +3,12 @@ package main
 import (
 	"errors"
 	"fmt"
+	"path"
 	"regexp"
 	"strconv"
 	"strings"
+
+	"github.com/buger/goreplay/proto"
 )
 
 // HTTPModifierConfig holds configuration options for built-in traffic modifier
@@ -23,6 +26,21 @@ type HTTPModifierConfig struct {
 	Params  HTTPParams  `json:"http-set-param"`
 	Headers HTTPHeaders `json:"http-set-header"`
 	Methods HTTPMethods `json:"http-allow-method"`
+
+	GRPCMethods         GRPCMethods `json:"http-allow-grpc-method"`
+	GRPCNegativeMethods GRPCMethods `json:"http-disallow-grpc-method"`
+
+	GraphQLOperations         GraphQLOperationFilters  `json:"http-allow-graphql-operation"`
+	GraphQLNegativeOperations GraphQLOperationFilters  `json:"http-disallow-graphql-operation"`
+	GraphQLLimiters           GraphQLOperationLimiters `json:"http-graphql-operation-limiter"`
+
+	Smuggling HTTPSmuggling `json:"http-smuggling"`
+
+	URLNormalize HTTPURLNormalize `json:"http-normalize-url"`
+	URLTemplates HTTPURLTemplates `json:"http-url-template"`
+
+	MultipartDrop   MultipartPartFilters `json:"http-drop-multipart-part"`
+	MultipartRedact MultipartPartFilters `json:"http-redact-multipart-part"`
 }
 
 //
@@ -196,6 +214,38 @@ func (h *HTTPMethods) Set(value string) error {
 	return nil
 }
 
+//
+// Handling of --http-allow-grpc-method, --http-disallow-grpc-method options
+//
+
+// GRPCMethods holds full gRPC methods, or patterns matching them like /users.v1.UserService/*
+type GRPCMethods []string
+
+func (g *GRPCMethods) String() string {
+	return fmt.Sprint(*g)
+}
+
+func (g *GRPCMethods) Set(value string) error {
+	if _, err := path.Match(value, ""); err != nil {
+		return fmt.Errorf("invalid grpc method pattern %q: %v", value, err)
+	}
+	if !strings.HasPrefix(value, "/") {
+		value = "/" + value
+	}
+	*g = append(*g, value)
+	return nil
+}
+
+// Match reports whether the full method matches one of the methods
+func (g GRPCMethods) Match(method []byte) bool {
+	for _, pattern := range g {
+		if ok, _ := path.Match(pattern, string(method)); ok {
+			return true
+		}
+	}
+	return false
+}
+
 //
 // Handling of --http-rewrite-url option
 //
@@ -279,3 +329,270 @@ func (r *HTTPURLRegexp) Set(value string) error {
 
 	return err
 }
+
+//
+// Handling of --http-drop-multipart-part, --http-redact-multipart-part options
+//
+type multipartPartFilter struct {
+	field  string
+	regexp *regexp.Regexp
+}
+
+// MultipartPartFilters holds the fields of the parts of multipart/form-data bodies and their regexps
+type MultipartPartFilters []multipartPartFilter
+
+func (m *MultipartPartFilters) String() string {
+	return fmt.Sprint(*m)
+}
+
+func (m *MultipartPartFilters) Set(value string) error {
+	valArr := strings.SplitN(value, ":", 2)
+	if len(valArr) < 2 {
+		return errors.New("need both part field and value, colon-delimited (ex. filename:\\.zip$)")
+	}
+	field := strings.ToLower(strings.TrimSpace(valArr[0]))
+	switch field {
+	case "name", "filename", "content-type":
+	default:
+		return fmt.Errorf("unknown part field %q, it is name, filename or content-type", valArr[0])
+	}
+	r, err := regexp.Compile(strings.TrimSpace(valArr[1]))
+	if err != nil {
+		return err
+	}
+	*m = append(*m, multipartPartFilter{field: field, regexp: r})
+	return nil
+}
+
+// Match reports whether one of the filters matches the part
+func (m MultipartPartFilters) Match(part proto.Part) bool {
+	for _, f := range m {
+		value := part.Name
+		switch f.field {
+		case "filename":
+			// only the parts uploading a file have a file name
+			if part.Filename == "" {
+				continue
+			}
+			value = part.Filename
+		case "content-type":
+			value = part.ContentType
+		}
+		if f.regexp.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
+
+//
+// Handling of --http-allow-graphql-operation, --http-disallow-graphql-operation options
+//
+type graphQLOperationFilter struct {
+	opType  string
+	pattern string
+}
+
+// GraphQLOperationFilters holds the patterns of GraphQL operations, matching their name or one of their
+// top-level fields, optionally restricted to a type of operation like mutation:*
+type GraphQLOperationFilters []graphQLOperationFilter
+
+func (g *GraphQLOperationFilters) String() string {
+	return fmt.Sprint(*g)
+}
+
+func (g *GraphQLOperationFilters) Set(value string) error {
+	f, err := parseGraphQLOperationFilter(value)
+	if err != nil {
+		return err
+	}
+	*g = append(*g, f)
+	return nil
+}
+
+func parseGraphQLOperationFilter(value string) (f graphQLOperationFilter, err error) {
+	f.pattern = value
+	if i := strings.IndexByte(value, ':'); i != -1 {
+		f.opType, f.pattern = value[:i], value[i+1:]
+		switch f.opType {
+		case "query", "mutation", "subscription":
+		default:
+			return f, fmt.Errorf("unknown graphql operation type %q, it is query, mutation or subscription", f.opType)
+		}
+	}
+	if _, err = path.Match(f.pattern, ""); err != nil {
+		return f, fmt.Errorf("invalid graphql operation pattern %q: %v", f.pattern, err)
+	}
+	return f, nil
+}
+
+func (f graphQLOperationFilter) match(op proto.GraphQLOperation) bool {
+	if f.opType != "" && f.opType != op.Type {
+		return false
+	}
+	if ok, _ := path.Match(f.pattern, op.Name); ok && op.Name != "" {
+		return true
+	}
+	for _, field := range op.Fields {
+		if ok, _ := path.Match(f.pattern, field); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Match reports whether one of the filters matches one of the operations
+func (g GraphQLOperationFilters) Match(ops []proto.GraphQLOperation) bool {
+	for _, f := range g {
+		for _, op := range ops {
+			if f.match(op) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//
+// Handling of --http-graphql-operation-limiter option
+//
+type graphQLOperationLimiter struct {
+	graphQLOperationFilter
+	percent int
+}
+
+// GraphQLOperationLimiters holds the percentages of the requests of GraphQL operations to keep
+type GraphQLOperationLimiters []graphQLOperationLimiter
+
+func (g *GraphQLOperationLimiters) String() string {
+	return fmt.Sprint(*g)
+}
+
+func (g *GraphQLOperationLimiters) Set(value string) error {
+	i := strings.LastIndexByte(value, ':')
+	if i == -1 || !strings.HasSuffix(value, "%") {
+		return errors.New("need both operation and percentage, colon-delimited (ex. GetUser:25%)")
+	}
+	percent, err := strconv.Atoi(value[i+1 : len(value)-1])
+	if err != nil || percent < 0 || percent > 100 {
+		return fmt.Errorf("invalid percentage %q", value[i+1:])
+	}
+	f, err := parseGraphQLOperationFilter(value[:i])
+	if err != nil {
+		return err
+	}
+	*g = append(*g, graphQLOperationLimiter{f, percent})
+	return nil
+}
+
+// Percent returns the percentage of the first limiter matching one of the operations, or 100
+func (g GraphQLOperationLimiters) Percent(ops []proto.GraphQLOperation) int {
+	for _, l := range g {
+		for _, op := range ops {
+			if l.match(op) {
+				return l.percent
+			}
+		}
+	}
+	return 100
+}
+
+//
+// Handling of --http-smuggling option
+//
+
+// HTTPSmuggling tells what to do with the requests whose framing is ambiguous, see proto.FramingError
+type HTTPSmuggling uint8
+
+// Available handlings of the ambiguous requests
+const (
+	SmugglingKeep      HTTPSmuggling = iota // requests are replayed as captured
+	SmugglingNormalize                      // framing headers are rewritten to the framing used to capture the request
+	SmugglingDrop                           // requests are dropped
+)
+
+func (h *HTTPSmuggling) String() string {
+	switch *h {
+	case SmugglingNormalize:
+		return "normalize"
+	case SmugglingDrop:
+		return "drop"
+	}
+	return "keep"
+}
+
+func (h *HTTPSmuggling) Set(value string) error {
+	switch value {
+	case "", "keep":
+		*h = SmugglingKeep
+	case "normalize":
+		*h = SmugglingNormalize
+	case "drop":
+		*h = SmugglingDrop
+	default:
+		return fmt.Errorf("invalid smuggling handling %q, it is keep, normalize or drop", value)
+	}
+	return nil
+}
+
+//
+// Handling of --http-normalize-url, --http-url-template options
+//
+
+// HTTPURLNormalize holds the steps of the normalization of the URLs: decode, slashes, sort-query and template
+type HTTPURLNormalize []string
+
+func (h *HTTPURLNormalize) String() string {
+	return fmt.Sprint(*h)
+}
+
+func (h *HTTPURLNormalize) Set(value string) error {
+	for _, step := range strings.Split(value, ",") {
+		switch step = strings.TrimSpace(step); step {
+		case "all":
+			*h = append(*h, "decode", "slashes", "sort-query", "template")
+		case "decode", "slashes", "sort-query", "template":
+			*h = append(*h, step)
+		default:
+			return fmt.Errorf("unknown url normalization %q, it is decode, slashes, sort-query, template or all", step)
+		}
+	}
+	return nil
+}
+
+// HTTPURLTemplates holds the path templates like /users/{id}, split in segments
+type HTTPURLTemplates [][]string
+
+func (h *HTTPURLTemplates) String() string {
+	return fmt.Sprint(*h)
+}
+
+func (h *HTTPURLTemplates) Set(value string) error {
+	if !strings.HasPrefix(value, "/") {
+		return fmt.Errorf("invalid url template %q, it is a path like /users/{id}", value)
+	}
+	*h = append(*h, strings.Split(value, "/"))
+	return nil
+}
+
+// URLNormalization returns the normalization of the URLs set by --http-normalize-url and --http-url-template,
+// or nil if they are not set
+func (c *HTTPModifierConfig) URLNormalization() *proto.URLNormalization {
+	n := &proto.URLNormalization{Templates: c.URLTemplates}
+	for _, step := range c.URLNormalize {
+		switch step {
+		case "decode":
+			n.Decode = true
+		case "slashes":
+			n.Slashes = true
+		case "sort-query":
+			n.SortQuery = true
+		case "template":
+			n.Template = true
+		}
+	}
+	if !n.Enabled() {
+		return nil
+	}
+	return n
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"strconv"
 	"testing"
 
 	"github.com/buger/goreplay/proto"
@@ -168,6 +169,37 @@ func TestHTTPModifierHeaderRewrite(t *testing.T) {
 	}
 }
 
+func TestHTTPModifierMultiValueHeaders(t *testing.T) {
+	payload := []byte("GET / HTTP/1.1\r\nCookie: a=1\r\nX-Forwarded-For: 10.0.0.1\r\nx-forwarded-for: 192.168.1.1\r\n\r\n")
+
+	filters := HTTPHeaderFilters{}
+	filters.Set("X-Forwarded-For:^192\\.168\\.")
+	modifier := NewHTTPModifier(&HTTPModifierConfig{
+		HeaderFilters: filters,
+	})
+	if len(modifier.Rewrite(payload)) == 0 {
+		t.Error("Request should pass filters, its second field matches")
+	}
+
+	modifier = NewHTTPModifier(&HTTPModifierConfig{
+		HeaderNegativeFilters: filters,
+	})
+	if len(modifier.Rewrite(payload)) != 0 {
+		t.Error("Request should not pass filters, its second field matches")
+	}
+
+	rewrites := HeaderRewriteMap{}
+	rewrites.Set("Missing: (.*),$1")
+	rewrites.Set("x-forwarded-for: ^(\\d+)\\.,1$1.")
+	modifier = NewHTTPModifier(&HTTPModifierConfig{
+		HeaderRewrite: rewrites,
+	})
+	expected := "GET / HTTP/1.1\r\nCookie: a=1\r\nX-Forwarded-For: 110.0.0.1\r\nx-forwarded-for: 1192.168.1.1\r\n\r\n"
+	if rewritten := modifier.Rewrite(append([]byte(nil), payload...)); string(rewritten) != expected {
+		t.Errorf("expected all the fields to be rewritten, got %q", rewritten)
+	}
+}
+
 func TestHTTPModifierHeaderHashFilters(t *testing.T) {
 	filters := HTTPHashFilters{}
 	filters.Set("Header2:1/2")
@@ -287,6 +319,44 @@ func TestHTTPModifierURLNegativeRegexp(t *testing.T) {
 	}
 }
 
+func TestHTTPModifierURLNormalization(t *testing.T) {
+	normalize := HTTPURLNormalize{}
+	if err := normalize.Set("decode,lowercase"); err == nil {
+		t.Error("Should not accept unknown steps")
+	}
+	normalize = HTTPURLNormalize{}
+	normalize.Set("all")
+	templates := HTTPURLTemplates{}
+	if err := templates.Set("users/{id}"); err == nil {
+		t.Error("Should not accept templates that are not paths")
+	}
+	templates.Set("/users/{user}/avatar")
+
+	filters := HTTPURLRegexp{}
+	filters.Set("^/users/{id}$")
+	filters.Set("^/users/{user}/avatar$")
+
+	modifier := NewHTTPModifier(&HTTPModifierConfig{
+		URLRegexp:    filters,
+		URLNormalize: normalize,
+		URLTemplates: templates,
+	})
+
+	payload := func(url string) []byte {
+		return []byte("GET " + url + " HTTP/1.1\r\nHost: www.w3.org\r\n\r\n")
+	}
+
+	if p := modifier.Rewrite(payload("//users/%34%32")); string(proto.Path(p)) != "//users/%34%32" {
+		t.Errorf("Should pass url and replay it verbatim, got %q", proto.Path(p))
+	}
+	if len(modifier.Rewrite(payload("/users/bob/avatar"))) == 0 {
+		t.Error("Should pass url matching the template")
+	}
+	if len(modifier.Rewrite(payload("/users/bob"))) != 0 {
+		t.Error("Should not pass url")
+	}
+}
+
 func TestHTTPModifierSetHeader(t *testing.T) {
 	filters := HTTPHeaders{}
 	filters.Set("User-Agent:Gor")
@@ -318,3 +388,177 @@ func TestHTTPModifierSetParam(t *testing.T) {
 		t.Error("Should override param", string(payload))
 	}
 }
+
+func TestHTTPModifierGRPCMethods(t *testing.T) {
+	methods := GRPCMethods{}
+	if err := methods.Set("users.v1.UserService/*"); err != nil {
+		t.Fatal(err)
+	}
+	if err := methods.Set("/users.v1.[UserService/Get"); err == nil {
+		t.Error("Should not accept invalid patterns")
+	}
+
+	modifier := NewHTTPModifier(&HTTPModifierConfig{
+		GRPCMethods: methods,
+	})
+
+	get := []byte("POST /users.v1.UserService/Get HTTP/1.1\r\nContent-Type: application/grpc\r\nContent-Length: 5\r\n\r\n\x00\x00\x00\x00\x00")
+	order := []byte("POST /orders.v1.OrderService/Get HTTP/1.1\r\nContent-Type: application/grpc+proto\r\nContent-Length: 5\r\n\r\n\x00\x00\x00\x00\x00")
+	plain := []byte("POST /users.v1.UserService/Get HTTP/1.1\r\nContent-Length: 0\r\n\r\n")
+
+	if len(modifier.Rewrite(get)) == 0 {
+		t.Error("Request should pass filters")
+	}
+	if len(modifier.Rewrite(order)) != 0 {
+		t.Error("Request of another service should not pass filters")
+	}
+	if len(modifier.Rewrite(plain)) != 0 {
+		t.Error("Request that is not a gRPC call should not pass filters")
+	}
+
+	methods = GRPCMethods{}
+	methods.Set("/users.v1.UserService/Get")
+
+	modifier = NewHTTPModifier(&HTTPModifierConfig{
+		GRPCNegativeMethods: methods,
+	})
+
+	if len(modifier.Rewrite(get)) != 0 {
+		t.Error("Request should not pass filters")
+	}
+	if len(modifier.Rewrite(order)) == 0 || len(modifier.Rewrite(plain)) == 0 {
+		t.Error("Request should pass filters")
+	}
+}
+
+func TestHTTPModifierMultipart(t *testing.T) {
+	drop, redact := MultipartPartFilters{}, MultipartPartFilters{}
+	if err := drop.Set("filename:."); err != nil {
+		t.Fatal(err)
+	}
+	if err := drop.Set("size:1"); err == nil {
+		t.Error("Should not accept unknown part fields")
+	}
+	redact.Set("name:^password$")
+
+	modifier := NewHTTPModifier(&HTTPModifierConfig{
+		MultipartDrop:   drop,
+		MultipartRedact: redact,
+	})
+
+	body := "--xYzZY\r\nContent-Disposition: form-data; name=\"user\"\r\n\r\nbob\r\n" +
+		"--xYzZY\r\nContent-Disposition: form-data; name=\"password\"\r\n\r\nhunter2\r\n" +
+		"--xYzZY\r\nContent-Disposition: form-data; name=\"avatar\"; filename=\"me.png\"\r\nContent-Type: image/png\r\n\r\n\x89PNG\r\n" +
+		"--xYzZY--\r\n"
+	payload := []byte("POST /signup HTTP/1.1\r\nContent-Type: multipart/form-data; boundary=xYzZY\r\nContent-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n" + body)
+	expected := "--xYzZY\r\nContent-Disposition: form-data; name=\"user\"\r\n\r\nbob\r\n" +
+		"--xYzZY\r\nContent-Disposition: form-data; name=\"password\"\r\n\r\n[redacted]\r\n" +
+		"--xYzZY--\r\n"
+
+	payload = modifier.Rewrite(payload)
+	if string(proto.Body(payload)) != expected {
+		t.Errorf("expected %q, got %q", expected, proto.Body(payload))
+	}
+	if length := string(proto.Header(payload, []byte("Content-Length"))); length != strconv.Itoa(len(expected)) {
+		t.Errorf("expected Content-Length %d, got %s", len(expected), length)
+	}
+
+	plain := []byte("POST / HTTP/1.1\r\nContent-Type: text/plain\r\nContent-Length: 8\r\n\r\npassword")
+	if !bytes.Equal(modifier.Rewrite(plain), plain) {
+		t.Error("Request that is not multipart should not be modified")
+	}
+}
+
+func TestHTTPModifierGraphQLOperations(t *testing.T) {
+	operations := GraphQLOperationFilters{}
+	if err := operations.Set("query:*"); err != nil {
+		t.Fatal(err)
+	}
+	if err := operations.Set("fragment:*"); err == nil {
+		t.Error("Should not accept unknown operation types")
+	}
+	if err := operations.Set("Get[User"); err == nil {
+		t.Error("Should not accept invalid patterns")
+	}
+
+	request := func(query string) []byte {
+		body := `{"query":"` + query + `"}`
+		return []byte("POST /graphql HTTP/1.1\r\nContent-Type: application/json\r\nContent-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n" + body)
+	}
+	getUser := request("query GetUser { user { name } }")
+	deleteUser := request("mutation DeleteUser { deleteUser(id: 1) }")
+	plain := []byte("POST /graphql HTTP/1.1\r\nContent-Length: 0\r\n\r\n")
+
+	modifier := NewHTTPModifier(&HTTPModifierConfig{
+		GraphQLOperations: operations,
+	})
+	if len(modifier.Rewrite(getUser)) == 0 {
+		t.Error("Request should pass filters")
+	}
+	if len(modifier.Rewrite(deleteUser)) != 0 || len(modifier.Rewrite(plain)) != 0 {
+		t.Error("Request should not pass filters")
+	}
+
+	operations = GraphQLOperationFilters{}
+	operations.Set("delete*")
+	modifier = NewHTTPModifier(&HTTPModifierConfig{
+		GraphQLNegativeOperations: operations,
+	})
+	if len(modifier.Rewrite(deleteUser)) != 0 {
+		t.Error("Request should not pass filters")
+	}
+	if len(modifier.Rewrite(getUser)) == 0 || len(modifier.Rewrite(plain)) == 0 {
+		t.Error("Request should pass filters")
+	}
+
+	limiters := GraphQLOperationLimiters{}
+	if err := limiters.Set("GetUser:0%"); err != nil {
+		t.Fatal(err)
+	}
+	if err := limiters.Set("GetUser:150%"); err == nil {
+		t.Error("Should not accept invalid percentages")
+	}
+	limiters.Set("mutation:*:100%")
+	modifier = NewHTTPModifier(&HTTPModifierConfig{
+		GraphQLLimiters: limiters,
+	})
+	if len(modifier.Rewrite(getUser)) != 0 {
+		t.Error("Request of a 0% operation should not pass filters")
+	}
+	if len(modifier.Rewrite(deleteUser)) == 0 || len(modifier.Rewrite(plain)) == 0 {
+		t.Error("Request should pass filters")
+	}
+}
+
+func TestHTTPModifierSmuggling(t *testing.T) {
+	var smuggling HTTPSmuggling
+	if err := smuggling.Set("reject"); err == nil {
+		t.Error("Should not accept unknown handlings")
+	}
+	smuggling.Set("normalize")
+
+	modifier := NewHTTPModifier(&HTTPModifierConfig{
+		Smuggling: smuggling,
+	})
+	payload := []byte("POST / HTTP/1.1\r\nContent-Length: 6\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\nG")
+	expected := "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\nG"
+	if normalized := modifier.Rewrite(append([]byte(nil), payload...)); string(normalized) != expected {
+		t.Errorf("expected %q, got %q", expected, normalized)
+	}
+
+	smuggling.Set("drop")
+	modifier = NewHTTPModifier(&HTTPModifierConfig{
+		Smuggling: smuggling,
+	})
+	if len(modifier.Rewrite(payload)) != 0 {
+		t.Error("Request should be dropped")
+	}
+	plain := []byte("POST / HTTP/1.1\r\nContent-Length: 1\r\n\r\nG")
+	if !bytes.Equal(modifier.Rewrite(plain), plain) {
+		t.Error("Request should pass filters")
+	}
+
+	if smugglingStats.get("dropped", proto.ErrLengthAndChunked) == 0 {
+		t.Error("expected the dropped request to be counted")
+	}
+}
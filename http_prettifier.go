@@ -35,16 +35,22 @@ func prettifyHTTP(p []byte) []byte {
 		}
 	})
 
+	if proto.IsGRPC(body) {
+		return prettifyGRPC(head, headers, content)
+	}
+
 	if len(tEnc) == 0 && len(cEnc) == 0 {
 		return p
 	}
 
 	if bytes.Equal(tEnc, []byte("chunked")) {
+		trailers := proto.Trailers(body)
 		buf := bytes.NewBuffer(content)
 		r := httputil.NewChunkedReader(buf)
 		content, _ = ioutil.ReadAll(r)
 
 		headers = proto.DeleteHeader(headers, []byte("Transfer-Encoding"))
+		headers = addTrailers(headers, trailers)
 
 		newLen := strconv.Itoa(len(content))
 		headers = proto.SetHeader(headers, []byte("Content-Length"), []byte(newLen))
@@ -71,3 +77,43 @@ func prettifyHTTP(p []byte) []byte {
 
 	return newPayload
 }
+
+// addTrailers adds the trailer fields of a chunked message to its headers, in their order, the
+// Trailer header announcing them is removed
+func addTrailers(headers, trailers []byte) []byte {
+	if len(trailers) == 0 {
+		return headers
+	}
+	headers = proto.DeleteHeader(headers, []byte("Trailer"))
+	lines := bytes.Split(trailers[:len(trailers)-len(proto.EmptyLine)], proto.CRLF)
+	// AddHeader inserts the header before the others
+	for i := len(lines) - 1; i >= 0; i-- {
+		colon := bytes.IndexByte(lines[i], ':')
+		if colon < 1 {
+			continue
+		}
+		headers = proto.AddHeader(headers, lines[i][:colon], bytes.TrimSpace(lines[i][colon+1:]))
+	}
+	return headers
+}
+
+// prettifyGRPC annotates gRPC calls with the lengths of their protobuf messages, a trailing "+" tells the
+// last message is incomplete
+func prettifyGRPC(head, headers, content []byte) []byte {
+	lengths, ok := proto.GRPCMessages(content)
+	if len(lengths) == 0 && ok {
+		return append(append(head, headers...), content...)
+	}
+	value := make([]byte, 0, 8*len(lengths))
+	for i, n := range lengths {
+		if i > 0 {
+			value = append(value, ',')
+		}
+		value = strconv.AppendInt(value, int64(n), 10)
+	}
+	if !ok {
+		value = append(value, '+')
+	}
+	headers = proto.SetHeader(headers, []byte("X-Grpc-Message-Lengths"), value)
+	return append(append(head, headers...), content...)
+}
@@ -34,3 +34,23 @@ func TestHTTPPrettifierChunked(t *testing.T) {
 		t.Error("Payload not match:", string(newPayload))
 	}
 }
+
+func TestHTTPPrettifierTrailers(t *testing.T) {
+	payload := []byte("2 1 1\nHTTP/1.1 200 OK\r\nTrailer: Grpc-Status, Grpc-Message\r\nTransfer-Encoding: chunked\r\n\r\n4\r\nWiki\r\n0\r\nGrpc-Status: 0\r\nGrpc-Message: ok\r\n\r\n")
+
+	newPayload := prettifyHTTP(payload)
+
+	if string(newPayload) != "2 1 1\nHTTP/1.1 200 OK\r\nContent-Length: 4\r\nGrpc-Status: 0\r\nGrpc-Message: ok\r\n\r\nWiki" {
+		t.Errorf("Payload not match: %q", newPayload)
+	}
+}
+
+func TestHTTPPrettifierGRPC(t *testing.T) {
+	payload := []byte("1 1 1\nPOST /users.v1.UserService/Get HTTP/1.1\r\nContent-Type: application/grpc\r\nContent-Length: 12\r\n\r\n\x00\x00\x00\x00\x02hi\x00\x00\x00\x00\x09")
+
+	newPayload := prettifyHTTP(payload)
+
+	if string(newPayload) != "1 1 1\nPOST /users.v1.UserService/Get HTTP/1.1\r\nX-Grpc-Message-Lengths: 2+\r\nContent-Type: application/grpc\r\nContent-Length: 12\r\n\r\n\x00\x00\x00\x00\x02hi\x00\x00\x00\x00\x09" {
+		t.Errorf("Payload not match: %q", newPayload)
+	}
+}
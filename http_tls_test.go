@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHTTPClientTLS(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gor_tls")
+	defer os.RemoveAll(dir)
+	write := func(name string, data []byte) string {
+		path := filepath.Join(dir, name)
+		ioutil.WriteFile(path, data, 0600)
+		return path
+	}
+
+	serverCert, serverKey := genCertificate(&x509.Certificate{DNSNames: []string{"api.mesh"}})
+	client1, key1 := genCertificate(&x509.Certificate{Subject: pkix.Name{CommonName: "client-1"}})
+	client2, key2 := genCertificate(&x509.Certificate{Subject: pkix.Name{CommonName: "client-2"}})
+	cert, _ := tls.X509KeyPair(serverCert, serverKey)
+	clients := x509.NewCertPool()
+	clients.AppendCertsFromPEM(client1)
+	clients.AppendCertsFromPEM(client2)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName + " " + r.TLS.ServerName))
+	}))
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{cert}, ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clients}
+	server.StartTLS()
+	defer server.Close()
+
+	certFile, keyFile := write("client.pem", client1), write("client-key.pem", key1)
+	config, err := newClientTLSConfig(certFile, keyFile, write("ca.pem", serverCert), "api.mesh", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := []byte("GET / HTTP/1.1\r\nHost: api.mesh\r\n\r\n")
+	for _, compat := range []bool{false, true} {
+		client := NewHTTPClient(server.URL, &HTTPClientConfig{Timeout: time.Second, CompatibilityMode: compat, TLSConfig: config})
+		if resp, err := client.Send(req); err != nil || !bytes.HasSuffix(resp, []byte("client-1 api.mesh")) {
+			t.Errorf("expected the client certificate to be verified, got %q(%v)", resp, err)
+		}
+		client.Disconnect()
+	}
+
+	// the rotated certificate is used by the next connections
+	write("client.pem", client2)
+	write("client-key.pem", key2)
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, future, future)
+	client := NewHTTPClient(server.URL, &HTTPClientConfig{Timeout: time.Second, TLSConfig: config})
+	if resp, err := client.Send(req); err != nil || !bytes.HasSuffix(resp, []byte("client-2 api.mesh")) {
+		t.Errorf("expected the rotated certificate, got %q(%v)", resp, err)
+	}
+
+	// the certificate of the target is verified with the CAs of the system
+	config, _ = newClientTLSConfig(certFile, keyFile, "", "", false)
+	client = NewHTTPClient(server.URL, &HTTPClientConfig{Timeout: time.Second, TLSConfig: config})
+	if resp, _ := client.Send(req); string(httpStatus(resp)) != HTTP_CONNECTION_ERROR {
+		t.Errorf("expected the certificate of the target to be rejected, got %q", resp)
+	}
+	config, _ = newClientTLSConfig(certFile, keyFile, "", "", true)
+	client = NewHTTPClient(server.URL, &HTTPClientConfig{Timeout: time.Second, TLSConfig: config})
+	if resp, err := client.Send(req); err != nil || string(httpStatus(resp)) != "200" {
+		t.Errorf("expected the certificate of the target not to be verified, got %q(%v)", resp, err)
+	}
+
+	if _, err := newClientTLSConfig(certFile, "", "", "", false); err == nil {
+		t.Error("expected an error without the key")
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"errors"
 	"io"
 	"log"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -15,9 +16,14 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/buger/goreplay/capture"
+	"github.com/buger/goreplay/tcp"
+
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/google/gopacket"
+	"github.com/klauspost/compress/zstd"
 )
 
 type fileInputReader struct {
@@ -27,9 +33,22 @@ type fileInputReader struct {
 	timestamp int64
 	closed    int32 // Value of 0 indicates that the file is still open.
 	s3        bool
+	messages  chan []byte // payloads of the tcp messages of pcap and pcapng files
+	done      chan bool
+	zstd      *zstd.Decoder
 }
 
 func (f *fileInputReader) parseNext() error {
+	if f.messages != nil {
+		data, ok := <-f.messages
+		if !ok {
+			f.Close()
+			return io.EOF
+		}
+		f.timestamp, _ = strconv.ParseInt(string(payloadMeta(data)[2]), 10, 64)
+		f.data = data
+		return nil
+	}
 	payloadSeparatorAsBytes := []byte(payloadSeparator)
 	var buffer bytes.Buffer
 	for {
@@ -67,12 +86,79 @@ func (f *fileInputReader) ReadPayload() []byte {
 func (f *fileInputReader) Close() error {
 	if atomic.LoadInt32(&f.closed) == 0 {
 		atomic.StoreInt32(&f.closed, 1)
+		if f.done != nil {
+			close(f.done)
+		}
 		f.file.Close()
+		if f.zstd != nil {
+			f.zstd.Close()
+		}
 	}
 
 	return nil
 }
 
+// readPackets reassembles the tcp messages of a pcap or pcapng file, their payloads
+// carry the name of the interface and the comments of their packets
+func (f *fileInputReader) readPackets(packets *capture.FileReader) {
+	defer close(f.messages)
+	pool := tcp.NewMessagePool(Settings.CopyBufferSize, Settings.Expire, Debug, func(m *tcp.Message) {
+		select {
+		case f.messages <- capturedPayload(m, packets.Interfaces()):
+		case <-f.done:
+		}
+		m.Release()
+	})
+	pool.SetHints("http")
+	source := gopacket.NewPacketSource(packets, packets)
+	source.Lazy = true
+	source.NoCopy = true
+	for {
+		packet, err := source.NextPacket()
+		if err != nil {
+			if err != io.EOF {
+				Debug(1, "[INPUT-FILE] error reading packets:", err)
+			}
+			break
+		}
+		select {
+		case <-f.done:
+			pool.Close()
+			return
+		default:
+		}
+		pool.Handler(packet)
+	}
+	pool.Close()
+}
+
+// capturedPayload returns the payload of a message of a capture file, the metadata of the header
+// are followed by the name of the interface and the comments of the packets, query escaped:
+//
+//	1 f45590522cd1838b4a0d5c5aab80b77929dea3b3 13923489726487326 1231 if=eth0 comment=slow+request\n
+func capturedPayload(m *tcp.Message, interfaces []capture.FileInterface) []byte {
+	var msgType byte = ResponsePayload
+	if m.IsIncoming {
+		msgType = RequestPayload
+	}
+	header := payloadHeader(msgType, m.UUID(), m.Start.UnixNano(), m.End.UnixNano()-m.Start.UnixNano())
+	header = header[:len(header)-1]
+	seen := make(map[string]bool)
+	for i, pckt := range m.Packets() {
+		if i == 0 && pckt.Interface < len(interfaces) && interfaces[pckt.Interface].Name != "" {
+			header = append(header, " if="+url.QueryEscape(interfaces[pckt.Interface].Name)...)
+		}
+		for _, comment := range pckt.Comments {
+			if !seen[comment] {
+				seen[comment] = true
+				header = append(header, " comment="+url.QueryEscape(comment)...)
+			}
+		}
+	}
+	header = append(header, '\n')
+	return append(header, m.Data()...)
+}
+
 func NewFileInputReader(path string) *fileInputReader {
 	var file io.ReadCloser
 	var err error
@@ -88,18 +174,45 @@ func NewFileInputReader(path string) *fileInputReader {
 		return nil
 	}
 
+	return newFileInputReader(path, file)
+}
+
+// newFileInputReader returns the reader of the payloads of file, decompressed by the extension of its path,
+// or reassembled if it is a pcap or pcapng file
+func newFileInputReader(path string, file io.ReadCloser) *fileInputReader {
 	r := &fileInputReader{file: file, closed: 0}
-	if strings.HasSuffix(path, ".gz") {
+	switch {
+	case strings.HasSuffix(path, ".gz"):
 		gzReader, err := gzip.NewReader(file)
 		if err != nil {
 			log.Println(err)
 			return nil
 		}
 		r.reader = bufio.NewReader(gzReader)
-	} else {
+	case strings.HasSuffix(path, ".zst"):
+		zstdReader, err := zstd.NewReader(file, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			log.Println(err)
+			return nil
+		}
+		r.zstd = zstdReader
+		r.reader = bufio.NewReader(zstdReader)
+	default:
 		r.reader = bufio.NewReader(file)
 	}
 
+	// pcap and pcapng files are read through the tcp reassembly of input-raw
+	if magic, _ := r.reader.Peek(4); capture.IsCaptureFile(magic) {
+		packets, err := capture.NewFileReader(r.reader)
+		if err != nil {
+			log.Println(err)
+			return nil
+		}
+		r.messages = make(chan []byte, 1000)
+		r.done = make(chan bool)
+		go r.readPackets(packets)
+	}
+
 	r.parseNext()
 
 	return r
@@ -236,7 +349,10 @@ func (i *FileInput) emit() {
 
 		if lastTime != -1 {
 			diff := reader.timestamp - lastTime
-			lastTime = reader.timestamp
+			// the messages of capture files are read in the order they complete, earlier ones are not delayed
+			if diff > 0 {
+				lastTime = reader.timestamp
+			}
 
 			if i.speedFactor != 1 {
 				diff = int64(float64(diff) / i.speedFactor)
@@ -2,16 +2,21 @@ package main
 
 import (
 	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"math/rand"
+	"net"
 	"os"
 	"sync"
 	"testing"
 	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
 )
 
 var _ = log.Println
@@ -258,6 +263,84 @@ type CaptureFile struct {
 	file *os.File
 }
 
+func TestInputFilePcapng(t *testing.T) {
+	block := func(typ uint32, body ...[]byte) []byte {
+		data := bytes.Join(body, nil)
+		for len(data)%4 != 0 {
+			data = append(data, 0)
+		}
+		b := make([]byte, 8, len(data)+12)
+		binary.LittleEndian.PutUint32(b[0:], typ)
+		binary.LittleEndian.PutUint32(b[4:], uint32(len(data)+12))
+		b = append(append(b, data...), b[4:8]...)
+		return b
+	}
+	option := func(code uint16, value string) []byte {
+		opt := make([]byte, 4, 8+len(value))
+		binary.LittleEndian.PutUint16(opt[0:], code)
+		binary.LittleEndian.PutUint16(opt[2:], uint16(len(value)))
+		opt = append(opt, value...)
+		for len(opt)%4 != 0 {
+			opt = append(opt, 0)
+		}
+		return opt
+	}
+	packet := func(src, dst string, sport, dport layers.TCPPort, seq uint32, payload string, ts time.Time, options ...[]byte) []byte {
+		eth := &layers.Ethernet{SrcMAC: net.HardwareAddr{0, 1, 2, 3, 4, 5}, DstMAC: net.HardwareAddr{0, 1, 2, 3, 4, 6}, EthernetType: layers.EthernetTypeIPv4}
+		ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: net.ParseIP(src), DstIP: net.ParseIP(dst)}
+		tcp := &layers.TCP{SrcPort: sport, DstPort: dport, Seq: seq, ACK: true, PSH: true}
+		tcp.SetNetworkLayerForChecksum(ip)
+		buf := gopacket.NewSerializeBuffer()
+		if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, eth, ip, tcp, gopacket.Payload(payload)); err != nil {
+			t.Fatal(err)
+		}
+		header := make([]byte, 20)
+		binary.LittleEndian.PutUint32(header[4:], uint32(uint64(ts.UnixNano()/1000)>>32))
+		binary.LittleEndian.PutUint32(header[8:], uint32(ts.UnixNano()/1000))
+		binary.LittleEndian.PutUint32(header[12:], uint32(len(buf.Bytes())))
+		binary.LittleEndian.PutUint32(header[16:], uint32(len(buf.Bytes())))
+		data := append([]byte(nil), buf.Bytes()...)
+		for len(data)%4 != 0 {
+			data = append(data, 0)
+		}
+		return block(6, append([][]byte{header, data}, options...)...)
+	}
+	start := time.Unix(1500000000, 0)
+	var data []byte
+	data = append(data, block(0x0A0D0D0A, []byte{0x4d, 0x3c, 0x2b, 0x1a, 1, 0, 0, 0}, bytes.Repeat([]byte{0xff}, 8))...)
+	data = append(data, block(1, []byte{1, 0, 0, 0, 0, 0, 1, 0}, option(2, "eth0"))...)
+	data = append(data, packet("192.168.1.2", "192.168.1.3", 45678, 80, 1000, "GET / HTTP/1.1\r\n\r\n", start, option(1, "health check"))...)
+	data = append(data, packet("192.168.1.3", "192.168.1.2", 80, 45678, 2000, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n", start.Add(time.Millisecond))...)
+	file, err := ioutil.TempFile("", "input_file_test*.pcapng")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.Write(data)
+	file.Close()
+
+	var payloads [][]byte
+	err = ReadFromCaptureFile(file, 2, func(data []byte) {
+		payloads = append(payloads, Duplicate(data))
+	})
+	if err != nil || len(payloads) != 2 {
+		t.Fatalf("expected a request and a response, got %q %v", payloads, err)
+	}
+	if payloads[0][0] == ResponsePayload {
+		payloads[0], payloads[1] = payloads[1], payloads[0]
+	}
+	meta := payloadMeta(payloads[0])
+	if len(meta) != 6 || meta[0][0] != RequestPayload || string(meta[2]) != fmt.Sprint(start.UnixNano()) || string(meta[4]) != "if=eth0" || string(meta[5]) != "comment=health+check" {
+		t.Errorf("unexpected request metadata %q", meta)
+	}
+	if string(payloadBody(payloads[0])) != "GET / HTTP/1.1\r\n\r\n" {
+		t.Errorf("unexpected request %q", payloadBody(payloads[0]))
+	}
+	if meta = payloadMeta(payloads[1]); len(meta) != 5 || meta[0][0] != ResponsePayload || string(meta[4]) != "if=eth0" {
+		t.Errorf("unexpected response metadata %q", meta)
+	}
+}
+
 func NewExpectedCaptureFile(data [][]byte, file *os.File) *CaptureFile {
 	ecf := new(CaptureFile)
 	ecf.file = file
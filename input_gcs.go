@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// gcsReadScope is the OAuth scope of the access tokens of the GCS input
+const gcsReadScope = "https://www.googleapis.com/auth/devstorage.read_only"
+
+// GCSInputConfig is the configuration of the Google Cloud Storage input
+type GCSInputConfig struct {
+	Credentials string `json:"input-gcs-credentials"`
+	From        string `json:"input-gcs-from"` // RFC 3339
+	To          string `json:"input-gcs-to"`
+}
+
+// GCSInput replays the objects written by --output-file gs:// under a prefix, in the order of the timestamps of
+// their payloads across the objects, like S3Input. the objects are listed and streamed with the JSON API, with
+// the access tokens of the service account of Credentials, or of the metadata server, like GCSOutput. the input
+// reads from the emulator at STORAGE_EMULATOR_HOST if it is set
+type GCSInput struct {
+	*objectInput
+}
+
+// NewGCSInput constructor for GCSInput, path is the gs://bucket/prefix of the objects
+func NewGCSInput(path string, config *GCSInputConfig) *GCSInput {
+	bucket, prefix := parseGCSUrl(path)
+	if !strings.HasPrefix(path, "gs://") || bucket == "" || !strings.Contains(path[5:], "/") {
+		log.Fatalf("input-gcs: invalid path %q, expected gs://bucket/prefix", path)
+	}
+	from, to, err := parseObjectInputRange(config.From, config.To)
+	if err != nil {
+		log.Fatalf("input-gcs: %v", err)
+	}
+
+	store := &gcsStore{bucket: bucket, endpoint: "https://storage.googleapis.com"}
+	if host := os.Getenv("STORAGE_EMULATOR_HOST"); host != "" {
+		store.endpoint = host
+		if !strings.Contains(host, "://") {
+			store.endpoint = "http://" + host
+		}
+		store.emulator = true
+	}
+	// the objects are streamed, the timeout is the one of the responses
+	store.client = &http.Client{Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		ResponseHeaderTimeout: time.Minute,
+	}}
+	store.auth = &googleAuth{credentials: config.Credentials, scope: gcsReadScope, client: store.client}
+
+	i := new(GCSInput)
+	if i.objectInput, err = newObjectInput("INPUT-GCS", path, prefix, store, from, to); err != nil {
+		log.Fatalf("input-gcs: %v", err)
+	}
+	return i
+}
+
+func (i *GCSInput) String() string {
+	return "GCS input: " + i.path
+}
+
+// gcsStore is the objectStore of a Google Cloud Storage bucket
+type gcsStore struct {
+	bucket   string
+	endpoint string
+	emulator bool // no authentication
+	client   *http.Client
+	auth     *googleAuth
+}
+
+func (s *gcsStore) list(prefix string) ([]*storeObject, error) {
+	var objects []*storeObject
+	var pageToken string
+	for {
+		query := url.Values{"prefix": {prefix}, "fields": {"items(name,size,updated),nextPageToken"}}
+		if pageToken != "" {
+			query.Set("pageToken", pageToken)
+		}
+		req, err := http.NewRequest(http.MethodGet, s.endpoint+"/storage/v1/b/"+url.PathEscape(s.bucket)+"/o?"+query.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := s.do(req)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Items []struct {
+				Name    string    `json:"name"`
+				Size    string    `json:"size"` // uint64 as a string
+				Updated time.Time `json:"updated"`
+			} `json:"items"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("invalid objects list: %v", err)
+		}
+		for _, item := range page.Items {
+			size, _ := strconv.ParseInt(item.Size, 10, 64)
+			objects = append(objects, &storeObject{key: item.Name, size: size, updated: item.Updated})
+		}
+		if page.NextPageToken == "" {
+			return objects, nil
+		}
+		pageToken = page.NextPageToken
+	}
+}
+
+func (s *gcsStore) get(key string, offset int64) (io.ReadCloser, error) {
+	req, err := http.NewRequest(http.MethodGet, s.endpoint+"/storage/v1/b/"+url.PathEscape(s.bucket)+"/o/"+url.PathEscape(key)+"?alt=media", nil)
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// do sends the request with the access token, the response is returned with a 200 or 206 status
+func (s *gcsStore) do(req *http.Request) (*http.Response, error) {
+	if !s.emulator {
+		token, err := s.auth.accessToken()
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusPartialContent {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode == http.StatusUnauthorized {
+		// the token is requested again
+		s.auth.reset()
+	}
+	return nil, fmt.Errorf("status %d: %s", resp.StatusCode, bytes.TrimSpace(body))
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGCSInput(t *testing.T) {
+	base := time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC).UnixNano()
+	ms := int64(time.Millisecond)
+	objects := map[string][]byte{
+		"logs/a.gor":  s3InputPayloads(base, base+3*ms, base+4*ms),
+		"logs/b.gor":  s3InputPayloads(base+2*ms, base+5*ms),
+		"logs/c.gor":  s3InputPayloads(base + 6*ms),
+		"other/d.gor": s3InputPayloads(base + ms),
+	}
+	var keys []string
+	for key := range objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/storage/v1/b/bucket/o" {
+			// a page per object
+			page := map[string]interface{}{}
+			var items []map[string]interface{}
+			for n, key := range keys {
+				if !strings.HasPrefix(key, r.URL.Query().Get("prefix")) || key <= r.URL.Query().Get("pageToken") {
+					continue
+				}
+				items = append(items, map[string]interface{}{
+					"name": key, "size": strconv.Itoa(len(objects[key])), "updated": time.Now().Format(time.RFC3339),
+				})
+				if n < len(keys)-1 {
+					page["nextPageToken"] = key
+				}
+				break
+			}
+			page["items"] = items
+			json.NewEncoder(w).Encode(page)
+			return
+		}
+		key := strings.TrimPrefix(r.URL.Path, "/storage/v1/b/bucket/o/")
+		data, ok := objects[key]
+		if !ok || r.URL.Query().Get("alt") != "media" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if rng := r.Header.Get("Range"); rng != "" {
+			offset, _ := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(rng, "bytes="), "-"))
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, len(data)-1, len(data)))
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(data[offset:])
+			return
+		}
+		if key == "logs/a.gor" {
+			// the connection is lost in the middle of the second payload
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+			w.Write(data[:len(data)/2])
+			w.(http.Flusher).Flush()
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		w.Write(data)
+	}))
+	defer server.Close()
+	os.Setenv("STORAGE_EMULATOR_HOST", server.URL)
+	defer os.Unsetenv("STORAGE_EMULATOR_HOST")
+
+	input := NewGCSInput("gs://bucket/logs/", &GCSInputConfig{})
+	defer input.Close()
+
+	buf := make([]byte, 1000)
+	var timestamps []int64
+	for n := 0; n < 6; n++ {
+		done := make(chan int)
+		go func() {
+			n, _ := input.Read(buf)
+			done <- n
+		}()
+		select {
+		case n := <-done:
+			if n > 0 && !strings.HasSuffix(string(buf[:n]), "HTTP/1.1\r\n\r\n") {
+				t.Errorf("unexpected payload %q", buf[:n])
+			}
+			ts, _ := strconv.ParseInt(string(payloadMeta(buf[:n])[2]), 10, 64)
+			timestamps = append(timestamps, (ts-base)/ms)
+		case <-time.After(time.Second):
+			t.Fatalf("expected 6 payloads, got %v", timestamps)
+		}
+	}
+	if fmt.Sprint(timestamps) != "[0 2 3 4 5 6]" {
+		t.Errorf("expected the payloads of the objects in the order of their timestamps, got %v", timestamps)
+	}
+}
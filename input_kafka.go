@@ -1,9 +1,13 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"log"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/Shopify/sarama"
 	"github.com/Shopify/sarama/mocks"
@@ -11,10 +15,30 @@ import (
 
 // KafkaInput is used for recieving Kafka messages and
 // transforming them into HTTP payloads.
+//
+// without Group every partition of the topic is consumed from Offset. with Group the partitions are shared with
+// the other members of the consumer group, rebalanced when members join or leave, and the offsets of the messages
+// read are committed so that the group resumes after them. Offset is then only where the partitions without
+// committed offsets start, but a timestamp moves the partitions claimed by the input to it once, when it starts.
 type KafkaInput struct {
 	config    *InputKafkaConfig
 	consumers []sarama.PartitionConsumer
-	messages  chan *sarama.ConsumerMessage
+	client    sarama.Client
+	group     sarama.ConsumerGroup
+	messages  chan *kafkaInputMessage
+	done      chan struct{}
+	stop      sync.Once
+	cancel    context.CancelFunc
+
+	offset int64 // sarama.OffsetOldest, sarama.OffsetNewest, or a timestamp in milliseconds
+	lock   sync.Mutex
+	moved  map[int32]bool // the partitions moved to the timestamp of offset
+}
+
+// kafkaInputMessage is a message with the session of the consumer group it was claimed in, if any
+type kafkaInputMessage struct {
+	*sarama.ConsumerMessage
+	session sarama.ConsumerGroupSession
 }
 
 // NewKafkaInput creates instance of kafka consumer client.
@@ -26,14 +50,32 @@ func NewKafkaInput(address string, config *InputKafkaConfig) *KafkaInput {
 func NewKafkaInputWithTLS(address string, config *InputKafkaConfig, tlsConfig *KafkaTLSConfig) *KafkaInput {
 	c := NewKafkaConfig(tlsConfig)
 
+	i := &KafkaInput{
+		config:   config,
+		messages: make(chan *kafkaInputMessage, 256),
+		done:     make(chan struct{}),
+		moved:    make(map[int32]bool),
+	}
+	var err error
+	if i.offset, err = kafkaStartOffset(config.Offset); err != nil {
+		log.Fatalf("input-kafka: %v", err)
+	}
+
+	if config.Group != "" {
+		i.joinGroup(c)
+		return i
+	}
+
 	var con sarama.Consumer
 
 	if mock, ok := config.consumer.(*mocks.Consumer); ok && mock != nil {
 		con = config.consumer
 	} else {
 		var err error
-		//con, err = sarama.NewConsumer([]string{config.Host}, c)
-		con, err = sarama.NewConsumer(strings.Split(config.Host, ","), c)
+		if i.client, err = sarama.NewClient(strings.Split(config.Host, ","), c); err != nil {
+			log.Fatalln("Failed to start Sarama(Kafka) consumer:", err)
+		}
+		con, err = sarama.NewConsumerFromClient(i.client)
 
 		if err != nil {
 			log.Fatalln("Failed to start Sarama(Kafka) consumer:", err)
@@ -45,14 +87,14 @@ func NewKafkaInputWithTLS(address string, config *InputKafkaConfig, tlsConfig *K
 		log.Fatalln("Failed to collect Sarama(Kafka) partitions:", err)
 	}
 
-	i := &KafkaInput{
-		config:    config,
-		consumers: make([]sarama.PartitionConsumer, len(partitions)),
-		messages:  make(chan *sarama.ConsumerMessage, 256),
-	}
+	i.consumers = make([]sarama.PartitionConsumer, len(partitions))
 
 	for index, partition := range partitions {
-		consumer, err := con.ConsumePartition(config.Topic, partition, sarama.OffsetNewest)
+		offset, err := i.partitionOffset(partition)
+		if err != nil {
+			log.Fatalln("Failed to get the Sarama(Kafka) offset of the timestamp:", err)
+		}
+		consumer, err := con.ConsumePartition(config.Topic, partition, offset)
 		if err != nil {
 			log.Fatalln("Failed to start Sarama(Kafka) partition consumer:", err)
 		}
@@ -61,7 +103,11 @@ func NewKafkaInputWithTLS(address string, config *InputKafkaConfig, tlsConfig *K
 			defer consumer.Close()
 
 			for message := range consumer.Messages() {
-				i.messages <- message
+				select {
+				case i.messages <- &kafkaInputMessage{ConsumerMessage: message}:
+				case <-i.done:
+					return
+				}
 			}
 		}(consumer)
 
@@ -73,6 +119,130 @@ func NewKafkaInputWithTLS(address string, config *InputKafkaConfig, tlsConfig *K
 	return i
 }
 
+// kafkaStartOffset parses the start offset of the input: earliest, latest, or an RFC 3339 timestamp returned in
+// milliseconds
+func kafkaStartOffset(offset string) (int64, error) {
+	switch offset {
+	case "", "latest":
+		return sarama.OffsetNewest, nil
+	case "earliest":
+		return sarama.OffsetOldest, nil
+	}
+	t, err := time.Parse(time.RFC3339, offset)
+	if err != nil {
+		return 0, fmt.Errorf("invalid offset %q, it is earliest, latest or an RFC 3339 timestamp", offset)
+	}
+	return t.UnixNano() / int64(time.Millisecond), nil
+}
+
+// partitionOffset returns the offset the partition starts at, the one of the first message at the timestamp
+// of the start offset if it is one
+func (i *KafkaInput) partitionOffset(partition int32) (int64, error) {
+	if i.offset < 0 {
+		return i.offset, nil
+	}
+	if i.client == nil {
+		return 0, fmt.Errorf("no client to get the offsets of the timestamps")
+	}
+	return i.client.GetOffset(i.config.Topic, partition, i.offset)
+}
+
+// joinGroup consumes the topic as a member of the consumer group
+func (i *KafkaInput) joinGroup(c *sarama.Config) {
+	if !c.Version.IsAtLeast(sarama.V0_10_2_0) {
+		c.Version = sarama.V0_10_2_0
+	}
+	c.Consumer.Return.Errors = true
+	c.Consumer.Offsets.Initial = sarama.OffsetOldest
+	if i.offset == sarama.OffsetNewest {
+		c.Consumer.Offsets.Initial = sarama.OffsetNewest
+	}
+	switch i.config.Balance {
+	case "", "range":
+		c.Consumer.Group.Rebalance.Strategy = sarama.BalanceStrategyRange
+	case "roundrobin":
+		c.Consumer.Group.Rebalance.Strategy = sarama.BalanceStrategyRoundRobin
+	case "sticky":
+		c.Consumer.Group.Rebalance.Strategy = sarama.BalanceStrategySticky
+	default:
+		log.Fatalf("input-kafka: unsupported balance strategy %q, it is range, roundrobin or sticky", i.config.Balance)
+	}
+
+	var err error
+	if i.client, err = sarama.NewClient(strings.Split(i.config.Host, ","), c); err != nil {
+		log.Fatalln("Failed to start Sarama(Kafka) consumer:", err)
+	}
+	if i.group, err = sarama.NewConsumerGroupFromClient(i.config.Group, i.client); err != nil {
+		log.Fatalln("Failed to join the Sarama(Kafka) consumer group:", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	i.cancel = cancel
+	go func() {
+		// Consume returns on each rebalance, and joins the group again
+		for ctx.Err() == nil {
+			if err := i.group.Consume(ctx, []string{i.config.Topic}, kafkaGroupHandler{i}); err != nil {
+				Debug(1, "[KAFKA-INPUT] consumer group:", err)
+				select {
+				case <-ctx.Done():
+				case <-time.After(c.Consumer.Group.Rebalance.Retry.Backoff):
+				}
+			}
+		}
+	}()
+	go func() {
+		for err := range i.group.Errors() {
+			Debug(1, "[KAFKA-INPUT] consumer group:", err)
+		}
+	}()
+}
+
+// kafkaGroupHandler hands the messages of the partitions claimed by the input in the consumer group to Read
+type kafkaGroupHandler struct {
+	input *KafkaInput
+}
+
+// Setup moves the partitions claimed for the first time to the timestamp of the start offset
+func (h kafkaGroupHandler) Setup(session sarama.ConsumerGroupSession) error {
+	i := h.input
+	claimed := session.Claims()[i.config.Topic]
+	Debug(1, fmt.Sprintf("[KAFKA-INPUT] generation %d of group %s, claimed partitions %v", session.GenerationID(), i.config.Group, claimed))
+	if i.offset < 0 {
+		return nil
+	}
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	for _, partition := range claimed {
+		if i.moved[partition] {
+			continue
+		}
+		offset, err := i.partitionOffset(partition)
+		if err != nil {
+			return err
+		}
+		// the committed offset may be before or after it
+		session.MarkOffset(i.config.Topic, partition, offset, "")
+		session.ResetOffset(i.config.Topic, partition, offset, "")
+		i.moved[partition] = true
+	}
+	return nil
+}
+
+func (h kafkaGroupHandler) Cleanup(sarama.ConsumerGroupSession) error {
+	return nil
+}
+
+func (h kafkaGroupHandler) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	for message := range claim.Messages() {
+		select {
+		case h.input.messages <- &kafkaInputMessage{ConsumerMessage: message, session: session}:
+		case <-session.Context().Done():
+			return nil
+		}
+	}
+	return nil
+}
+
 // ErrorHandler should receive errors
 func (i *KafkaInput) ErrorHandler(consumer sarama.PartitionConsumer) {
 	for err := range consumer.Errors() {
@@ -81,7 +251,16 @@ func (i *KafkaInput) ErrorHandler(consumer sarama.PartitionConsumer) {
 }
 
 func (i *KafkaInput) Read(data []byte) (int, error) {
-	message := <-i.messages
+	var message *kafkaInputMessage
+	select {
+	case message = <-i.messages:
+	case <-i.done:
+		return 0, ErrorStopped
+	}
+	if message.session != nil {
+		// committed with the next commit of the group
+		message.session.MarkMessage(message.ConsumerMessage, "")
+	}
 
 	if !i.config.UseJSON {
 		copy(data, message.Value)
@@ -104,5 +283,28 @@ func (i *KafkaInput) Read(data []byte) (int, error) {
 }
 
 func (i *KafkaInput) String() string {
+	if i.config.Group != "" {
+		return "Kafka Input: " + i.config.Host + "/" + i.config.Topic + ", group: " + i.config.Group
+	}
 	return "Kafka Input: " + i.config.Host + "/" + i.config.Topic
 }
+
+// Close leaves the consumer group, committing the offsets of the messages read, or stops the partition consumers
+func (i *KafkaInput) Close() error {
+	i.stop.Do(func() {
+		close(i.done)
+		if i.group != nil {
+			i.cancel()
+			if err := i.group.Close(); err != nil {
+				Debug(1, "[KAFKA-INPUT] consumer group:", err)
+			}
+		}
+		for _, consumer := range i.consumers {
+			consumer.AsyncClose()
+		}
+		if i.client != nil {
+			i.client.Close()
+		}
+	})
+	return nil
+}
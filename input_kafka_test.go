@@ -1,7 +1,9 @@
 package main
 
 import (
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/Shopify/sarama"
 	"github.com/Shopify/sarama/mocks"
@@ -60,3 +62,167 @@ func TestInputKafkaJSON(t *testing.T) {
 		t.Error("Message not properly decoded: ", string(buf[:n]), n)
 	}
 }
+
+// kafkaGroupBroker returns a broker coordinating the group grp, which assigns the partition 0 of the topic test to
+// the input, and whose committed offset is 5
+func kafkaGroupBroker(t *testing.T, fetch *sarama.MockFetchResponse, offsets *sarama.MockOffsetResponse) *sarama.MockBroker {
+	broker := sarama.NewMockBroker(t, 1)
+	// version 0, the topic test with the partition 0, no user data
+	assignment := []byte{0, 0, 0, 0, 0, 1, 0, 4, 't', 'e', 's', 't', 0, 0, 0, 1, 0, 0, 0, 0, 0xff, 0xff, 0xff, 0xff}
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("test", 0, broker.BrokerID()),
+		"FindCoordinatorRequest": sarama.NewMockFindCoordinatorResponse(t).
+			SetCoordinator(sarama.CoordinatorGroup, "grp", broker),
+		"JoinGroupRequest": sarama.NewMockWrapper(&sarama.JoinGroupResponse{
+			Version: 1, GenerationId: 1, GroupProtocol: "range", LeaderId: "other", MemberId: "m1",
+		}),
+		"SyncGroupRequest":    sarama.NewMockWrapper(&sarama.SyncGroupResponse{MemberAssignment: assignment}),
+		"HeartbeatRequest":    sarama.NewMockWrapper(&sarama.HeartbeatResponse{}),
+		"LeaveGroupRequest":   sarama.NewMockWrapper(&sarama.LeaveGroupResponse{}),
+		"OffsetFetchRequest":  sarama.NewMockOffsetFetchResponse(t).SetOffset("grp", "test", 0, 5, "", sarama.ErrNoError),
+		"OffsetCommitRequest": sarama.NewMockOffsetCommitResponse(t),
+		"OffsetRequest":       offsets.SetVersion(1),
+		"FetchRequest":        fetch.SetVersion(3),
+	})
+	return broker
+}
+
+// kafkaCommittedOffset returns the last offset of the partition 0 of the topic test committed to the broker
+func kafkaCommittedOffset(broker *sarama.MockBroker) int64 {
+	committed := int64(-1)
+	for _, rr := range broker.History() {
+		req, ok := rr.Request.(*sarama.OffsetCommitRequest)
+		if !ok {
+			continue
+		}
+		// the blocks of the request are not exported
+		block := reflect.ValueOf(req).Elem().FieldByName("blocks").MapIndex(reflect.ValueOf("test"))
+		if block.IsValid() {
+			if b := block.MapIndex(reflect.ValueOf(int32(0))); b.IsValid() {
+				committed = b.Elem().FieldByName("offset").Int()
+			}
+		}
+	}
+	return committed
+}
+
+func readKafkaInput(t *testing.T, input *KafkaInput) string {
+	data := make(chan string, 1)
+	go func() {
+		buf := make([]byte, 1024)
+		n, _ := input.Read(buf)
+		data <- string(buf[:n])
+	}()
+	select {
+	case d := <-data:
+		return d
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a message of the group")
+	}
+	return ""
+}
+
+func TestInputKafkaGroup(t *testing.T) {
+	fetch := sarama.NewMockFetchResponse(t, 1).
+		SetMessage("test", 0, 5, sarama.StringEncoder("1 5 1\nGET /5 HTTP/1.1\r\n\r\n")).
+		SetMessage("test", 0, 6, sarama.StringEncoder("1 6 1\nGET /6 HTTP/1.1\r\n\r\n")).
+		SetHighWaterMark("test", 0, 7)
+	offsets := sarama.NewMockOffsetResponse(t).
+		SetOffset("test", 0, sarama.OffsetOldest, 0).
+		SetOffset("test", 0, sarama.OffsetNewest, 7)
+	broker := kafkaGroupBroker(t, fetch, offsets)
+	defer broker.Close()
+
+	input := NewKafkaInput("", &InputKafkaConfig{Host: broker.Addr(), Topic: "test", Group: "grp"})
+	if msg := readKafkaInput(t, input); msg != "1 5 1\nGET /5 HTTP/1.1\r\n\r\n" {
+		t.Errorf("expected the group to resume at its committed offset, got %q", msg)
+	}
+	input.Close()
+
+	if committed := kafkaCommittedOffset(broker); committed != 6 {
+		t.Errorf("expected the offset after the message read to be committed, got %d", committed)
+	}
+}
+
+func TestInputKafkaGroupTimestamp(t *testing.T) {
+	start := time.Date(2020, 1, 2, 15, 4, 5, 0, time.UTC)
+	fetch := sarama.NewMockFetchResponse(t, 1).
+		SetMessage("test", 0, 5, sarama.StringEncoder("1 5 1\nGET /5 HTTP/1.1\r\n\r\n")).
+		SetMessage("test", 0, 9, sarama.StringEncoder("1 9 1\nGET /9 HTTP/1.1\r\n\r\n")).
+		SetHighWaterMark("test", 0, 10)
+	offsets := sarama.NewMockOffsetResponse(t).
+		SetOffset("test", 0, sarama.OffsetOldest, 0).
+		SetOffset("test", 0, sarama.OffsetNewest, 10).
+		SetOffset("test", 0, start.UnixNano()/int64(time.Millisecond), 9)
+	broker := kafkaGroupBroker(t, fetch, offsets)
+	defer broker.Close()
+
+	input := NewKafkaInput("", &InputKafkaConfig{Host: broker.Addr(), Topic: "test", Group: "grp", Offset: start.Format(time.RFC3339)})
+	defer input.Close()
+	if msg := readKafkaInput(t, input); msg != "1 9 1\nGET /9 HTTP/1.1\r\n\r\n" {
+		t.Errorf("expected the group to be moved to the timestamp, got %q", msg)
+	}
+}
+
+func TestKafkaStartOffset(t *testing.T) {
+	for offset, expected := range map[string]int64{
+		"":                     sarama.OffsetNewest,
+		"latest":               sarama.OffsetNewest,
+		"earliest":             sarama.OffsetOldest,
+		"2020-01-02T15:04:05Z": 1577977445000,
+	} {
+		if got, err := kafkaStartOffset(offset); err != nil || got != expected {
+			t.Errorf("expected %d for %q, got %d, %v", expected, offset, got, err)
+		}
+	}
+	if _, err := kafkaStartOffset("yesterday"); err == nil {
+		t.Error("expected an error for an invalid offset")
+	}
+}
+
+func TestInputKafkaSASL(t *testing.T) {
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"SaslHandshakeRequest":    sarama.NewMockSaslHandshakeResponse(t).SetEnabledMechanisms([]string{sarama.SASLTypePlaintext}),
+		"SaslAuthenticateRequest": sarama.NewMockSaslAuthenticateResponse(t),
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("test", 0, broker.BrokerID()),
+		"OffsetRequest": sarama.NewMockOffsetResponse(t).
+			SetOffset("test", 0, sarama.OffsetOldest, 0).
+			SetOffset("test", 0, sarama.OffsetNewest, 1),
+		"FetchRequest": sarama.NewMockFetchResponse(t, 1).
+			SetMessage("test", 0, 0, sarama.StringEncoder("1 1 1\nGET / HTTP/1.1\r\n\r\n")),
+	})
+
+	input := NewKafkaInputWithTLS("", &InputKafkaConfig{Host: broker.Addr(), Topic: "test", Offset: "earliest"},
+		&KafkaTLSConfig{SASL: KafkaSASLConfig{Mechanism: "PLAIN", User: "gor", Password: "secret"}})
+	defer input.Close()
+	if msg := readKafkaInput(t, input); msg != "1 1 1\nGET / HTTP/1.1\r\n\r\n" {
+		t.Errorf("unexpected message %q", msg)
+	}
+
+	authenticated := false
+	for _, rr := range broker.History() {
+		if req, ok := rr.Request.(*sarama.SaslAuthenticateRequest); ok {
+			authenticated = string(req.SaslAuthBytes) == "\x00gor\x00secret"
+		}
+	}
+	if !authenticated {
+		t.Error("expected the input to authenticate with its SASL credentials")
+	}
+}
+
+func TestInputKafkaTLSConfig(t *testing.T) {
+	if (&KafkaTLSConfig{}).isSet() {
+		t.Error("expected the empty options not to be set")
+	}
+	for _, c := range []KafkaTLSConfig{{Enable: true}, {CACert: "ca.pem"}, {clientCert: "cert.pem"}, {SASL: KafkaSASLConfig{Mechanism: "PLAIN"}}} {
+		if !c.isSet() {
+			t.Errorf("expected %+v to be set", c)
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// objectInputPeekers is the number of objects whose first payload is read at once
+const objectInputPeekers = 10
+
+// objectStore lists and reads the objects of a bucket, of S3 or of Google Cloud Storage
+type objectStore interface {
+	// list returns the objects of the prefix
+	list(prefix string) ([]*storeObject, error)
+	// get returns the content of the object from offset
+	get(key string, offset int64) (io.ReadCloser, error)
+}
+
+type storeObject struct {
+	key     string
+	size    int64
+	updated time.Time
+	start   int64 // timestamp of the first payload
+}
+
+// objectInput replays the objects written by --output-file under a prefix of a bucket, like --input-file, in the
+// order of the timestamps of their payloads across the objects, so that the chunks of several instances uploaded
+// to the same prefix are replayed in their global order. the objects are streamed, and only opened when the
+// replay reaches the timestamp of their first payload, so that the objects open at once are the ones overlapping
+// in time. with from and to, the payloads outside of the range are skipped, and so are the objects updated before
+// from. it is the input of S3Input and GCSInput
+type objectInput struct {
+	mu      sync.Mutex
+	name    string // of the debug logs
+	path    string
+	store   objectStore
+	from    int64              // in nanoseconds, 0 without from
+	to      int64              // in nanoseconds, 0 without to
+	objects []*storeObject     // not opened yet, by the timestamp of their first payload
+	readers []*fileInputReader // opened
+	data    chan []byte
+	exit    chan bool
+	stop    sync.Once
+}
+
+// parseObjectInputRange parses the RFC 3339 times of the range of the payloads replayed, in nanoseconds
+func parseObjectInputRange(from, to string) (int64, int64, error) {
+	times := [2]int64{}
+	for i, value := range [2]string{from, to} {
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid time %q, expected an RFC 3339 timestamp", value)
+		}
+		times[i] = t.UnixNano()
+	}
+	return times[0], times[1], nil
+}
+
+// newObjectInput lists the objects of the prefix, reads their first payload to order them, and starts replaying
+// them
+func newObjectInput(name, path, prefix string, store objectStore, from, to int64) (*objectInput, error) {
+	i := &objectInput{name: name, path: path, store: store, from: from, to: to}
+	if err := i.list(prefix); err != nil {
+		return nil, err
+	}
+	i.data = make(chan []byte, 1000)
+	i.exit = make(chan bool)
+	go i.emit()
+	return i, nil
+}
+
+func (i *objectInput) list(prefix string) error {
+	listed, err := i.store.list(prefix)
+	if err != nil {
+		return fmt.Errorf("listing %s: %v", i.path, err)
+	}
+	var objects []*storeObject
+	for _, o := range listed {
+		// the payloads of an object are all before its upload
+		if i.from != 0 && !o.updated.IsZero() && o.updated.UnixNano() < i.from {
+			continue
+		}
+		objects = append(objects, o)
+	}
+	if len(objects) == 0 {
+		return errors.New("no objects match " + i.path)
+	}
+
+	keys := make(chan *storeObject)
+	var wg sync.WaitGroup
+	for n := 0; n < objectInputPeekers; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for o := range keys {
+				o.start = -1
+				if r := i.open(o); r != nil {
+					if atomic.LoadInt32(&r.closed) == 0 {
+						o.start = r.timestamp
+					}
+					r.Close()
+				}
+			}
+		}()
+	}
+	for _, o := range objects {
+		keys <- o
+	}
+	close(keys)
+	wg.Wait()
+
+	for _, o := range objects {
+		if o.start == -1 || (i.to != 0 && o.start > i.to) {
+			continue
+		}
+		i.objects = append(i.objects, o)
+	}
+	sort.SliceStable(i.objects, func(a, b int) bool {
+		return i.objects[a].start < i.objects[b].start
+	})
+	Debug(1, fmt.Sprintf("[%s] %d objects of %d to replay from %s", i.name, len(i.objects), len(listed), i.path))
+	return nil
+}
+
+// open returns the reader of the payloads of the object, with its first payload read
+func (i *objectInput) open(o *storeObject) *fileInputReader {
+	body := &objectReader{name: i.name, store: i.store, key: o.key, size: o.size}
+	r := newFileInputReader(o.key, body)
+	if r == nil {
+		body.Close()
+	}
+	return r
+}
+
+// nextReader opens the objects which may have the next payload, and returns the reader with the smallest
+// timestamp. the objects not opened have no payload before the first payload of the next one
+func (i *objectInput) nextReader() *fileInputReader {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	for {
+		var next *fileInputReader
+		open := i.readers[:0]
+		for _, r := range i.readers {
+			if atomic.LoadInt32(&r.closed) != 0 {
+				continue
+			}
+			open = append(open, r)
+			if next == nil || r.timestamp < next.timestamp {
+				next = r
+			}
+		}
+		i.readers = open
+		if len(i.objects) == 0 || (next != nil && i.objects[0].start > next.timestamp) {
+			return next
+		}
+		o := i.objects[0]
+		i.objects = i.objects[1:]
+		Debug(2, fmt.Sprintf("[%s] opening %s", i.name, o.key))
+		if r := i.open(o); r != nil {
+			i.readers = append(i.readers, r)
+		}
+	}
+}
+
+func (i *objectInput) emit() {
+	var lastTime int64 = -1
+	for {
+		select {
+		case <-i.exit:
+			return
+		default:
+		}
+
+		reader := i.nextReader()
+		if reader == nil {
+			break
+		}
+		if i.to != 0 && reader.timestamp > i.to {
+			// the payloads of an object are in the order of their timestamps
+			reader.Close()
+			continue
+		}
+		if reader.timestamp < i.from {
+			reader.ReadPayload()
+			continue
+		}
+
+		if lastTime != -1 {
+			diff := reader.timestamp - lastTime
+			if diff > 0 {
+				lastTime = reader.timestamp
+				time.Sleep(time.Duration(diff))
+			}
+		} else {
+			lastTime = reader.timestamp
+		}
+
+		select {
+		case <-i.exit:
+			return
+		case i.data <- reader.ReadPayload():
+		}
+	}
+
+	log.Printf("[%s] end of objects '%s'\n", i.name, i.path)
+}
+
+func (i *objectInput) Read(data []byte) (int, error) {
+	var buf []byte
+	select {
+	case <-i.exit:
+		return 0, ErrorStopped
+	case buf = <-i.data:
+	}
+	n := copy(data, buf)
+	return n, nil
+}
+
+// Close closes the objects open
+func (i *objectInput) Close() error {
+	i.stop.Do(func() {
+		close(i.exit)
+	})
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	for _, r := range i.readers {
+		r.Close()
+	}
+	return nil
+}
+
+// objectReader streams an object, it is requested on the first Read, and requested again from where it was
+// interrupted if reading it fails
+type objectReader struct {
+	name    string
+	store   objectStore
+	key     string
+	size    int64
+	offset  int64
+	body    io.ReadCloser
+	retries int
+}
+
+func (r *objectReader) Read(b []byte) (n int, err error) {
+	for {
+		if r.size > 0 && r.offset >= r.size {
+			return 0, io.EOF
+		}
+		if r.body == nil {
+			if r.body, err = r.store.get(r.key, r.offset); err != nil {
+				r.body = nil
+				return 0, err
+			}
+		}
+		n, err = r.body.Read(b)
+		r.offset += int64(n)
+		if err == nil || err == io.EOF || n > 0 || r.retries >= 3 {
+			if err == nil || err == io.EOF {
+				r.retries = 0
+			}
+			return n, err
+		}
+		Debug(1, fmt.Sprintf("[%s] reading %s again from %d: %v", r.name, r.key, r.offset, err))
+		r.retries++
+		r.body.Close()
+		r.body = nil
+	}
+}
+
+func (r *objectReader) Close() error {
+	if r.body != nil {
+		return r.body.Close()
+	}
+	return nil
+}
@@ -1,11 +1,13 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"log"
 	"net"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -23,6 +25,34 @@ const (
 	ProtocolHTTP TCPProtocol = iota
 	// ProtocolBinary ...
 	ProtocolBinary
+	// ProtocolHTTP2 is h2c, its streams are converted to HTTP/1.1 messages
+	ProtocolHTTP2
+	// ProtocolGRPC is the gRPC calls of h2c connections
+	ProtocolGRPC
+	// ProtocolWebSocket is HTTP/1.x, the frames of the connections upgraded to WebSocket are recorded
+	ProtocolWebSocket
+	// ProtocolHTTP3 is HTTP/3 over QUIC, decrypted with a key log, its streams are converted to HTTP/1.1 messages
+	ProtocolHTTP3
+	// ProtocolMySQL is the MySQL client protocol, a message holds a command or its response
+	ProtocolMySQL
+	// ProtocolPostgres is the PostgreSQL frontend/backend protocol, a message holds the messages up to a Query or a Sync, or their response
+	ProtocolPostgres
+	// ProtocolRedis is RESP2 and RESP3, a message holds a command, or a reply or a push
+	ProtocolRedis
+	// ProtocolMongo is the MongoDB wire protocol, a message holds a message of the protocol, decompressed
+	ProtocolMongo
+	// ProtocolThrift is Thrift over the binary or the compact protocol, framed or not, a message holds a call or its reply
+	ProtocolThrift
+	// ProtocolMQTT is MQTT 3.1, 3.1.1 and 5, a message holds a PUBLISH packet of a client
+	ProtocolMQTT
+	// ProtocolAMQP is AMQP 0-9-1, a message holds a basic.publish command of a client with its content
+	ProtocolAMQP
+	// ProtocolDNS is DNS over udp or tcp, a message holds a query or a response
+	ProtocolDNS
+	// ProtocolSIP is SIP over udp or tcp, a message holds a request or a response, the messages of a dialog share the UUID of its Call-ID
+	ProtocolSIP
+	// ProtocolKafka is the Kafka protocol, a message holds a request or a response
+	ProtocolKafka
 )
 
 // Set is here so that TCPProtocol can implement flag.Var
@@ -32,6 +62,34 @@ func (protocol *TCPProtocol) Set(v string) error {
 		*protocol = ProtocolHTTP
 	case "binary":
 		*protocol = ProtocolBinary
+	case "http2":
+		*protocol = ProtocolHTTP2
+	case "grpc":
+		*protocol = ProtocolGRPC
+	case "websocket":
+		*protocol = ProtocolWebSocket
+	case "http3":
+		*protocol = ProtocolHTTP3
+	case "mysql":
+		*protocol = ProtocolMySQL
+	case "postgres":
+		*protocol = ProtocolPostgres
+	case "redis":
+		*protocol = ProtocolRedis
+	case "mongo":
+		*protocol = ProtocolMongo
+	case "thrift":
+		*protocol = ProtocolThrift
+	case "mqtt":
+		*protocol = ProtocolMQTT
+	case "amqp":
+		*protocol = ProtocolAMQP
+	case "dns":
+		*protocol = ProtocolDNS
+	case "sip":
+		*protocol = ProtocolSIP
+	case "kafka":
+		*protocol = ProtocolKafka
 	default:
 		return fmt.Errorf("unsupported protocol %s", v)
 	}
@@ -42,6 +100,34 @@ func (protocol *TCPProtocol) String() string {
 	switch *protocol {
 	case ProtocolBinary:
 		return "binary"
+	case ProtocolHTTP2:
+		return "http2"
+	case ProtocolGRPC:
+		return "grpc"
+	case ProtocolWebSocket:
+		return "websocket"
+	case ProtocolHTTP3:
+		return "http3"
+	case ProtocolMySQL:
+		return "mysql"
+	case ProtocolPostgres:
+		return "postgres"
+	case ProtocolRedis:
+		return "redis"
+	case ProtocolMongo:
+		return "mongo"
+	case ProtocolThrift:
+		return "thrift"
+	case ProtocolMQTT:
+		return "mqtt"
+	case ProtocolAMQP:
+		return "amqp"
+	case ProtocolDNS:
+		return "dns"
+	case ProtocolSIP:
+		return "sip"
+	case ProtocolKafka:
+		return "kafka"
 	case ProtocolHTTP:
 		return "http"
 	default:
@@ -52,16 +138,43 @@ func (protocol *TCPProtocol) String() string {
 // RAWInputConfig represents configuration that can be applied on raw input
 type RAWInputConfig struct {
 	capture.PcapOptions
-	Expire         time.Duration      `json:"input-raw-expire"`
-	CopyBufferSize size.Size          `json:"copy-buffer-size"`
-	Engine         capture.EngineType `json:"input-raw-engine"`
-	TrackResponse  bool               `json:"input-raw-track-response"`
-	Protocol       TCPProtocol        `json:"input-raw-protocol"`
-	RealIPHeader   string             `json:"input-raw-realip-header"`
-	Stats          bool               `json:"input-raw-stats"`
-	quit           chan bool          // Channel used only to indicate goroutine should shutdown
-	host           string
-	port           uint16
+	Expire            time.Duration      `json:"input-raw-expire"`
+	IdleExpire        time.Duration      `json:"input-raw-idle-expire"`
+	HalfOpenExpire    time.Duration      `json:"input-raw-half-open-expire"`
+	CopyBufferSize    size.Size          `json:"copy-buffer-size"`
+	Engine            capture.EngineType `json:"input-raw-engine"`
+	TrackResponse     bool               `json:"input-raw-track-response"`
+	Protocol          TCPProtocol        `json:"input-raw-protocol"`
+	Transport         string             `json:"input-raw-transport"`
+	UDPWindow         time.Duration      `json:"input-raw-udp-window"`
+	UDPWindowSize     size.Size          `json:"input-raw-udp-window-size"`
+	RealIPHeader      string             `json:"input-raw-realip-header"`
+	Stats             bool               `json:"input-raw-stats"`
+	Overlap           tcp.OverlapPolicy  `json:"input-raw-overlap-policy"`
+	MaxPoolSize       size.Size          `json:"input-raw-max-pool-size"`
+	LimitPolicy       tcp.LimitPolicy    `json:"input-raw-limit-policy"`
+	Checksum          bool               `json:"input-raw-validate-checksum"`
+	UUID              tcp.UUIDMode       `json:"input-raw-uuid-mode"`
+	MPTCP             bool               `json:"input-raw-mptcp"`
+	VLANs             tcp.VLANs          `json:"input-raw-vlan"`
+	Tunnels           tcp.Tunnels        `json:"input-raw-tunnel"`
+	TunnelIDs         tcp.TunnelIDs      `json:"input-raw-tunnel-id"`
+	ERSPANTime        bool               `json:"input-raw-erspan-timestamp"`
+	Netns             string             `json:"input-raw-netns"`
+	Sample            tcp.Sampling       `json:"input-raw-sample"`
+	TLSKeyLog         string             `json:"input-raw-tls-keylog"`
+	TLSKey            string             `json:"input-raw-tls-key"`
+	Uprobes           MultiOption        `json:"input-raw-uprobe"`
+	MySQLStripAuth    bool               `json:"input-raw-mysql-strip-auth"`
+	PostgresStripAuth bool               `json:"input-raw-postgres-strip-auth"`
+	MQTTVersion       int                `json:"input-raw-mqtt-version"`
+	SIPRTPSummary     bool               `json:"input-raw-sip-rtp-summary"`
+	HTTPParser        string             `json:"input-raw-http-parser"`
+	MaxHeaderSize     size.Size          `json:"input-raw-max-header-size"`
+	MaxHeaderCount    int                `json:"input-raw-max-header-count"`
+	quit              chan bool          // Channel used only to indicate goroutine should shutdown
+	host              string
+	port              uint16
 }
 
 // RAWInput used for intercepting traffic for given address
@@ -70,8 +183,26 @@ type RAWInput struct {
 	RAWInputConfig
 	messageStats   []tcp.Stats
 	listener       *capture.Listener
+	pool           *tcp.MessagePool
+	sctp           *tcp.SCTPPool // reassembles the messages when the transport is sctp
+	udp            *tcp.UDPPool  // makes messages of the datagrams when the transport is udp
+	h2             *tcp.HTTP2Demuxer
+	ws             *tcp.WebSocketDemuxer
+	mysql          *tcp.MySQLDemuxer
+	postgres       *tcp.PostgresDemuxer
+	mqtt           *tcp.MQTTDemuxer
+	amqp           *tcp.AMQPDemuxer
+	sip            *tcp.SIPDemuxer
+	kafka          *tcp.KafkaDemuxer
+	tls            *tcp.TLSDecryptor
+	tlsPool        *tcp.MessagePool // reassembles the tls records, decrypted into pool
+	quic           *tcp.QUICDecoder // decrypts the datagrams of http3
+	uprobes        *capture.Uprobes // captures the plaintext of tls connections instead of the listener
+	streams        *tcp.Streams
 	message        chan *tcp.Message
 	cancelListener context.CancelFunc
+	flush          sync.Once
+	drained        chan bool // closed once messages flushed from the pool have been read
 }
 
 // NewRAWInput constructor for RAWInput. Accepts raw input config as arguments.
@@ -80,6 +211,7 @@ func NewRAWInput(address string, config RAWInputConfig) (i *RAWInput) {
 	i.RAWInputConfig = config
 	i.message = make(chan *tcp.Message, 1000)
 	i.quit = make(chan bool)
+	i.drained = make(chan bool)
 	var host, _port string
 	var err error
 	var port int
@@ -105,68 +237,422 @@ func NewRAWInput(address string, config RAWInputConfig) (i *RAWInput) {
 func (i *RAWInput) Read(data []byte) (n int, err error) {
 	var msg *tcp.Message
 	var buf []byte
-	select {
-	case <-i.quit:
-		return 0, ErrorStopped
-	case msg = <-i.message:
-		buf = msg.Data()
+	for {
+		select {
+		case <-i.quit:
+			return 0, ErrorStopped
+		case msg = <-i.message:
+			if msg == nil {
+				// all the flushed messages have been read, see RAWInput.Flush
+				close(i.drained)
+				<-i.quit
+				return 0, ErrorStopped
+			}
+			buf = msg.Data()
+		}
+		if i.Protocol != ProtocolHTTP {
+			break
+		}
+		err := checkHeaderLimits(buf, i.MaxHeaderSize, i.MaxHeaderCount, msg.Truncated)
+		if err == nil {
+			break
+		}
+		headerLimitStats.add("input-raw", err)
+		go Debug(2, "[INPUT-RAW] message dropped:", err)
+		msg.Release()
 	}
 	var header []byte
 
 	var msgType byte = ResponsePayload
 	if msg.IsIncoming {
 		msgType = RequestPayload
-		if i.RealIPHeader != "" {
+		if i.RealIPHeader != "" && proto.HasRequestTitle(buf) {
 			buf = proto.SetHeader(buf, []byte(i.RealIPHeader), []byte(msg.SrcAddr))
 		}
 	}
+	if i.HTTPParser == "lenient" {
+		buf = tagMalformed(buf)
+	}
 	header = payloadHeader(msgType, msg.UUID(), msg.Start.UnixNano(), msg.End.UnixNano()-msg.Start.UnixNano())
 
 	n = copy(data, header)
 	if len(data) > len(header) {
 		n += copy(data[len(header):], buf)
 	}
+	msg.Release()
 	dis := len(header) + len(buf) - n
 	if dis > 0 {
 		go Debug(2, "[INPUT-RAW] discarded", dis, "bytes increase copy buffer size")
 	}
 	if msg.Truncated {
-		go Debug(2, "[INPUT-RAW] message truncated, copy-buffer-size")
+		go Debug(2, "[INPUT-RAW] message truncated, increase copy-buffer-size or input-raw-max-pool-size")
 	}
 	go i.addStats(msg.Stats)
 	return n, nil
 }
 
+// malformedHeader tags the HTTP messages salvaged by the lenient parser with the reason they are malformed
+const malformedHeader = "X-Gor-Malformed"
+
+// tagMalformed adds the malformed header after the start line of a message salvaged by
+// proto.LenientMessageLength, the data without a start line can't be tagged and are returned as is
+func tagMalformed(buf []byte) []byte {
+	_, err := proto.LenientMessageLength(buf)
+	if err == nil || err == proto.ErrMissingTitle {
+		return buf
+	}
+	nl := bytes.IndexByte(buf, '\n') + 1
+	header := malformedHeader + ": " + err.Error() + "\r\n"
+	tagged := make([]byte, 0, len(buf)+len(header))
+	return append(append(append(tagged, buf[:nl]...), header...), buf[nl:]...)
+}
+
 func (i *RAWInput) listen(address string) {
+	switch i.Transport {
+	case "", "tcp", "sctp", "udp":
+	default:
+		log.Fatalf("input-raw: unsupported transport %q, it is tcp, sctp or udp", i.Transport)
+	}
+	hints := i.Protocol.String()
+	switch i.HTTPParser {
+	case "", "strict":
+	case "lenient":
+		if i.Protocol != ProtocolHTTP {
+			log.Fatalf("input-raw: the lenient http parser only parses --input-raw-protocol http")
+		}
+		hints = "http-lenient"
+	default:
+		log.Fatalf("input-raw: unsupported http parser %q, it is strict or lenient", i.HTTPParser)
+	}
 	var err error
-	i.listener, err = capture.NewListener(i.host, i.port, "", i.Engine, i.TrackResponse)
-	if err != nil {
-		log.Fatal(err)
+	if i.Protocol == ProtocolHTTP3 {
+		if i.Transport != "" && i.Transport != "udp" {
+			log.Fatalf("input-raw: http3 is only captured over udp")
+		}
+		i.Transport = "udp"
+		if i.TLSKeyLog == "" || i.TLSKey != "" {
+			log.Fatalf("input-raw: http3 is decrypted with the secrets of --input-raw-tls-keylog only")
+		}
+		if i.UDPWindow != 0 {
+			log.Fatalf("input-raw: the datagrams of http3 can't be aggregated by input-raw-udp-window")
+		}
+		i.quic = tcp.NewQUICDecoder(i.CopyBufferSize, Debug, i.handler)
+		if i.quic.KeyLog, err = tcp.NewKeyLog(i.TLSKeyLog); err != nil {
+			log.Fatal(err)
+		}
 	}
-	i.listener.SetPcapOptions(i.PcapOptions)
-	err = i.listener.Activate()
-	if err != nil {
-		log.Fatal(err)
+	if len(i.Uprobes) > 0 {
+		if i.Transport != "" && i.Transport != "tcp" {
+			log.Fatalf("input-raw: uprobes only capture tcp connections")
+		}
+		if i.TLSKeyLog != "" || i.TLSKey != "" {
+			log.Fatalf("input-raw: uprobes capture the plaintext, tls is not decrypted")
+		}
+		if i.uprobes, err = capture.NewUprobes(i.Uprobes...); err != nil {
+			log.Fatal(err)
+		}
+		i.uprobes.Debugger = Debug
+	} else {
+		// the interfaces are looked up and the handles opened in the network namespace
+		err = capture.WithNetns(i.Netns, func() (err error) {
+			i.listener, err = capture.NewListener(i.host, i.port, i.Transport, i.Engine, i.TrackResponse)
+			if err != nil {
+				return
+			}
+			i.listener.SetPcapOptions(i.PcapOptions)
+			i.listener.Debugger = Debug
+			i.listener.Tunnels = i.Tunnels.Names()
+			i.listener.Sample = [2]uint32{i.Sample.Keep, i.Sample.Of}
+			return i.listener.Activate()
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	messageHandler := i.handler
+	if i.Protocol == ProtocolHTTP2 || i.Protocol == ProtocolGRPC {
+		if i.Transport != "" && i.Transport != "tcp" {
+			log.Fatalf("input-raw: %s is only captured over tcp", i.Protocol.String())
+		}
+		i.h2 = tcp.NewHTTP2Demuxer(i.CopyBufferSize, Debug, i.handler)
+		i.h2.Port = i.port
+		i.h2.GRPC = i.Protocol == ProtocolGRPC
+		messageHandler = i.h2.Handler
+	}
+	if i.Protocol == ProtocolWebSocket {
+		if i.Transport != "" && i.Transport != "tcp" {
+			log.Fatalf("input-raw: websocket is only captured over tcp")
+		}
+		i.ws = tcp.NewWebSocketDemuxer(i.CopyBufferSize, Debug, i.handler)
+		messageHandler = i.ws.Handler
+	}
+	if i.Protocol == ProtocolMySQL {
+		if i.Transport != "" && i.Transport != "tcp" {
+			log.Fatalf("input-raw: mysql is only captured over tcp")
+		}
+		i.mysql = tcp.NewMySQLDemuxer(i.CopyBufferSize, Debug, i.handler)
+		i.mysql.Port = i.port
+		i.mysql.StripAuth = i.MySQLStripAuth
+		messageHandler = i.mysql.Handler
+	}
+	if i.Protocol == ProtocolPostgres {
+		if i.Transport != "" && i.Transport != "tcp" {
+			log.Fatalf("input-raw: postgres is only captured over tcp")
+		}
+		i.postgres = tcp.NewPostgresDemuxer(i.CopyBufferSize, Debug, i.handler)
+		i.postgres.Port = i.port
+		i.postgres.StripAuth = i.PostgresStripAuth
+		messageHandler = i.postgres.Handler
+	}
+	if i.Protocol == ProtocolMongo {
+		messageHandler = tcp.MongoDecompressor(Debug, i.handler)
+	}
+	if i.Protocol == ProtocolMQTT {
+		if i.Transport != "" && i.Transport != "tcp" {
+			log.Fatalf("input-raw: mqtt is only captured over tcp")
+		}
+		i.mqtt = tcp.NewMQTTDemuxer(i.CopyBufferSize, Debug, i.handler)
+		i.mqtt.Port = i.port
+		if i.MQTTVersion != 0 {
+			i.mqtt.Version = byte(i.MQTTVersion)
+		}
+		messageHandler = i.mqtt.Handler
+	}
+	if i.Protocol == ProtocolAMQP {
+		if i.Transport != "" && i.Transport != "tcp" {
+			log.Fatalf("input-raw: amqp is only captured over tcp")
+		}
+		i.amqp = tcp.NewAMQPDemuxer(i.CopyBufferSize, Debug, i.handler)
+		i.amqp.Port = i.port
+		messageHandler = i.amqp.Handler
+	}
+	if i.Protocol == ProtocolDNS {
+		switch i.Transport {
+		case "", "tcp":
+			messageHandler = tcp.DNSTransactions(true, Debug, i.handler)
+		case "udp":
+			if i.UDPWindow != 0 {
+				log.Fatalf("input-raw: the datagrams of dns can't be aggregated by input-raw-udp-window")
+			}
+			messageHandler = tcp.DNSTransactions(false, Debug, i.handler)
+		default:
+			log.Fatalf("input-raw: dns is only captured over udp or tcp")
+		}
+	}
+	if i.Protocol == ProtocolSIP {
+		switch i.Transport {
+		case "", "tcp":
+		case "udp":
+			if i.UDPWindow != 0 {
+				log.Fatalf("input-raw: the datagrams of sip can't be aggregated by input-raw-udp-window")
+			}
+		default:
+			log.Fatalf("input-raw: sip is only captured over udp or tcp")
+		}
+		i.sip = tcp.NewSIPDemuxer(Debug, i.handler)
+		if i.SIPRTPSummary {
+			i.sip.Summary = func(callID string, streams []tcp.RTPStream) {
+				log.Printf("[INPUT-RAW] call %s ended with %d rtp streams", callID, len(streams))
+				for j := range streams {
+					log.Printf("[INPUT-RAW] call %s: %s", callID, &streams[j])
+				}
+			}
+		}
+		messageHandler = i.sip.Handler
+	}
+	if i.Protocol == ProtocolKafka {
+		if i.Transport != "" && i.Transport != "tcp" {
+			log.Fatalf("input-raw: kafka is only captured over tcp")
+		}
+		i.kafka = tcp.NewKafkaDemuxer(Debug, i.handler)
+		i.kafka.Port = i.port
+		messageHandler = i.kafka.Handler
+	}
+	i.pool = tcp.NewMessagePool(i.CopyBufferSize, i.Expire, Debug, messageHandler)
+	if i.quic == nil {
+		if err = i.pool.SetHints(hints); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if i.h2 != nil {
+		i.pool.Start = i.h2.Start
+	}
+	if i.ws != nil {
+		i.pool.Start, i.pool.End, i.pool.Split = i.ws.Start, i.ws.End, i.ws.Split
+	}
+	if i.mysql != nil {
+		i.pool.Start = i.mysql.Start
+	}
+	if i.postgres != nil {
+		i.pool.Start, i.pool.Split = i.postgres.Start, i.postgres.Split
+	}
+	if i.Protocol == ProtocolRedis {
+		i.pool.Start = tcp.RedisStart(i.port)
+	}
+	if i.Protocol == ProtocolMongo {
+		i.pool.Start = tcp.MongoStart(i.port)
+	}
+	if i.Protocol == ProtocolThrift {
+		i.pool.Start = tcp.ThriftStart(i.port)
+	}
+	if i.mqtt != nil {
+		i.pool.Start = i.mqtt.Start
+	}
+	if i.amqp != nil {
+		i.pool.Start = i.amqp.Start
+	}
+	if i.Protocol == ProtocolDNS {
+		i.pool.Start = tcp.DNSStart(i.port)
+	}
+	if i.kafka != nil {
+		i.pool.Start = i.kafka.Start
+	}
+	i.pool.MaxTotalSize = i.MaxPoolSize
+	i.pool.Limit = i.LimitPolicy
+	i.pool.UUID = i.UUID
+	i.pool.SetIdleExpire(i.IdleExpire, i.HalfOpenExpire)
+	// the pool receiving the packets, it holds the records of tls connections when they are decrypted
+	pool := i.pool
+	if (i.TLSKeyLog != "" || i.TLSKey != "") && i.quic == nil {
+		if i.Transport != "" && i.Transport != "tcp" {
+			log.Fatalf("input-raw: tls is only decrypted over tcp")
+		}
+		i.tls = tcp.NewTLSDecryptor(i.pool, Debug)
+		if i.TLSKeyLog != "" {
+			if i.tls.KeyLog, err = tcp.NewKeyLog(i.TLSKeyLog); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if i.TLSKey != "" {
+			if i.tls.RSAKeys, err = tcp.LoadRSAKeys(i.TLSKey); err != nil {
+				log.Fatal(err)
+			}
+		}
+		i.tlsPool = tcp.NewMessagePool(i.CopyBufferSize, i.Expire, Debug, i.tls.Handler)
+		i.tlsPool.Start, i.tlsPool.Split = i.tls.Start, tcp.TLSSplit
+		i.tlsPool.MaxTotalSize = i.MaxPoolSize
+		i.tlsPool.Limit = i.LimitPolicy
+		i.tlsPool.SetIdleExpire(i.IdleExpire, i.HalfOpenExpire)
+		pool = i.tlsPool
+	}
+	pool.Overlap = i.Overlap
+	pool.ValidateChecksum = i.Checksum
+	pool.MPTCP = i.MPTCP
+	pool.VLANs = i.VLANs
+	pool.Tunnels = i.Tunnels
+	pool.TunnelIDs = i.TunnelIDs
+	pool.TunnelPort = i.port
+	pool.TunnelTimestamps = i.ERSPANTime
+	pool.Sampling = i.Sample
+	handler := pool.Handler
+	switch i.Transport {
+	case "sctp":
+		i.sctp = tcp.NewSCTPPool(i.CopyBufferSize, i.Expire, Debug, i.handler)
+		if err = i.sctp.SetHints(hints); err != nil {
+			log.Fatal(err)
+		}
+		i.sctp.Port = i.port
+		handler = i.sctp.Handler
+	case "udp":
+		windowSize := i.UDPWindowSize
+		if windowSize == 0 {
+			windowSize = i.CopyBufferSize
+		}
+		udpHandler := messageHandler
+		if i.quic != nil {
+			udpHandler = i.quic.Handler
+		}
+		i.udp = tcp.NewUDPPool(windowSize, i.UDPWindow, Debug, udpHandler)
+		i.udp.Port = i.port
+		handler = i.udp.Handler
 	}
-	pool := tcp.NewMessagePool(i.CopyBufferSize, i.Expire, Debug, i.handler)
-	pool.End = endHint
-	pool.Start = startHint
 	var ctx context.Context
 	ctx, i.cancelListener = context.WithCancel(context.Background())
-	errCh := i.listener.ListenBackground(ctx, pool.Handler)
+	if i.uprobes != nil {
+		i.streams = tcp.NewStreams(i.pool)
+		go func() {
+			if err := i.uprobes.Listen(ctx, i.uprobeHandler); err != nil {
+				log.Printf("[INPUT-RAW] uprobes: %s", err)
+			}
+		}()
+		Debug(1, i)
+		return
+	}
+	errCh := i.listener.ListenBackground(ctx, handler)
 	select {
 	case err := <-errCh:
 		log.Fatal(err)
 	case <-i.listener.Reading:
 		Debug(1, i)
 	}
+	go i.watchDrops(captureStatsInterval)
+}
+
+// captureStatsInterval is the interval at which the drops of the capture are checked
+const captureStatsInterval = 5 * time.Second
+
+// watchDrops warns when the capture handles drop packets, and reports their statistics with --stats
+func (i *RAWInput) watchDrops(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var last capture.CaptureStats
+	for {
+		select {
+		case <-i.quit:
+			return
+		case <-ticker.C:
+		}
+		var total capture.CaptureStats
+		for _, st := range i.CaptureStats() {
+			total = total.Add(st)
+		}
+		if Settings.Stats {
+			Debug(0, fmt.Sprintf("[INPUT-RAW] capture received:%d,dropped:%d,if_dropped:%d", total.Received, total.Dropped, total.IfDropped))
+		}
+		// counters restart when handles are closed
+		if total.Dropped > last.Dropped || total.IfDropped > last.IfDropped {
+			log.Printf("[INPUT-RAW] the capture dropped %d packets and the interfaces %d in the last %s, increase input-raw-buffer-size or sample the traffic",
+				counterDelta(total.Dropped, last.Dropped), counterDelta(total.IfDropped, last.IfDropped), interval)
+		}
+		last = total
+	}
+}
+
+func counterDelta(a, b uint64) uint64 {
+	if a < b {
+		return 0
+	}
+	return a - b
 }
 
 func (i *RAWInput) handler(m *tcp.Message) {
 	i.message <- m
 }
 
+// uprobeHandler feeds the pool with the plaintext of a tls connection. the addresses of the connections whose
+// sockets are not known are made of the pid of the process and the address of the connection in it.
+func (i *RAWInput) uprobeHandler(ev capture.UprobeEvent) {
+	local, remote := ev.Local, ev.Remote
+	if local == "" || remote == "" {
+		local, remote = fmt.Sprintf("pid:%d", ev.Pid), fmt.Sprintf("conn:%x", ev.Conn)
+	} else if i.port != 0 && !strings.HasSuffix(local, ":"+strconv.Itoa(int(i.port))) && !strings.HasSuffix(remote, ":"+strconv.Itoa(int(i.port))) {
+		return
+	}
+	src, dst := local, remote
+	if ev.Read {
+		src, dst = remote, local
+	}
+	var version byte = 4
+	if strings.Count(src, ":") > 1 {
+		version = 6
+	}
+	i.streams.Data(fmt.Sprintf("%d/%x", ev.Pid, ev.Conn), src, dst, version, ev.Data, ev.Lost, ev.Timestamp)
+}
+
 func (i *RAWInput) String() string {
+	if i.uprobes != nil {
+		return fmt.Sprintf("Intercepting the tls plaintext of: %s", strings.Join(i.Uprobes, ", "))
+	}
 	return fmt.Sprintf("Intercepting traffic from: %s:%d", i.host, i.port)
 }
 
@@ -180,13 +666,68 @@ func (i *RAWInput) GetStats() []tcp.Stats {
 	return i.messageStats
 }
 
+// Snapshot returns the state of the messages being reassembled, the tls records included
+func (i *RAWInput) Snapshot() tcp.Snapshot {
+	snap := i.pool.Snapshot()
+	if i.tlsPool != nil {
+		records := i.tlsPool.Snapshot()
+		snap.Size += records.Size
+		snap.Limits.Truncated += records.Limits.Truncated
+		snap.Limits.Dropped += records.Limits.Dropped
+		snap.Limits.Blocked += records.Limits.Blocked
+		snap.Sessions = append(snap.Sessions, records.Sessions...)
+	}
+	return snap
+}
+
+// CaptureStats returns the statistics of the capture handles, keyed by interface
+func (i *RAWInput) CaptureStats() map[string]capture.CaptureStats {
+	if i.listener == nil {
+		return nil
+	}
+	return i.listener.Stats()
+}
+
+// Flush stops capturing traffic, and waits for the messages still in progress to be read.
+// it gives up waiting after the expiration of messages.
+func (i *RAWInput) Flush() {
+	i.flush.Do(func() {
+		i.cancelListener()
+		i.closePools()
+		select {
+		case i.message <- nil:
+		case <-time.After(i.Expire):
+			return
+		}
+		select {
+		case <-i.drained:
+		case <-time.After(i.Expire):
+		}
+	})
+}
+
 // Close closes the input raw listener
 func (i *RAWInput) Close() error {
 	i.cancelListener()
+	i.closePools()
 	close(i.quit)
 	return nil
 }
 
+// closePools dispatches the messages still in progress
+func (i *RAWInput) closePools() {
+	if i.tlsPool != nil {
+		i.tlsPool.Close()
+	}
+	i.pool.Close()
+	if i.sctp != nil {
+		i.sctp.Close()
+	}
+	if i.udp != nil {
+		i.udp.Close()
+	}
+}
+
 func (i *RAWInput) addStats(mStats tcp.Stats) {
 	if i.Stats {
 		i.Lock()
@@ -198,11 +739,3 @@ func (i *RAWInput) addStats(mStats tcp.Stats) {
 		i.Unlock()
 	}
 }
-
-func startHint(pckt *tcp.Packet) (isIncoming, isOutgoing bool) {
-	return proto.HasRequestTitle(pckt.Payload), proto.HasResponseTitle(pckt.Payload)
-}
-
-func endHint(m *tcp.Message) bool {
-	return proto.HasFullPayload(m.Data())
-}
@@ -17,6 +17,9 @@ import (
 
 	"github.com/buger/goreplay/capture"
 	"github.com/buger/goreplay/proto"
+	"github.com/buger/goreplay/tcp"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
 )
 
 const testRawExpire = time.Millisecond * 200
@@ -368,3 +371,46 @@ func BenchmarkRAWInputWithReplay(b *testing.B) {
 	b.Logf("%d/%d Requests, %d/%d Responses, %d/%d Replayed, %d Bytes in %s\n", reqCounter, b.N, respCounter, b.N, replayCounter, b.N, capturedBody, time.Since(now))
 	emitter.Close()
 }
+
+func TestTagMalformed(t *testing.T) {
+	for _, tt := range []struct {
+		payload, expected string
+	}{
+		{"GET / HTTP/1.1\r\nHost: a\r\n\r\n", "GET / HTTP/1.1\r\nHost: a\r\n\r\n"},
+		{"GET / HTTP/1.1\nHost: a\n\n", "GET / HTTP/1.1\nX-Gor-Malformed: bare lf line ending\r\nHost: a\n\n"},
+		{"POST / HTTP/1.1\r\nContent-Length: abc\r\n\r\n", "POST / HTTP/1.1\r\nX-Gor-Malformed: invalid content-length\r\nContent-Length: abc\r\n\r\n"},
+		{"Network\r\n", "Network\r\n"},
+	} {
+		if tagged := tagMalformed([]byte(tt.payload)); string(tagged) != tt.expected {
+			t.Errorf("expected %q, got %q", tt.expected, tagged)
+		}
+	}
+}
+
+func TestRAWInputSnapshot(t *testing.T) {
+	segment := func(sport layers.TCPPort, payload string) gopacket.Packet {
+		eth := &layers.Ethernet{SrcMAC: net.HardwareAddr{0, 1, 2, 3, 4, 5}, DstMAC: net.HardwareAddr{0, 1, 2, 3, 4, 6}, EthernetType: layers.EthernetTypeIPv4}
+		ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: net.ParseIP("192.168.1.2"), DstIP: net.ParseIP("192.168.1.3")}
+		l4 := &layers.TCP{SrcPort: sport, DstPort: 443, Seq: 1, ACK: true, PSH: true}
+		l4.SetNetworkLayerForChecksum(ip)
+		buf := gopacket.NewSerializeBuffer()
+		if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, eth, ip, l4, gopacket.Payload(payload)); err != nil {
+			t.Fatal(err)
+		}
+		return gopacket.NewPacket(buf.Bytes(), layers.LinkTypeEthernet, gopacket.Default)
+	}
+	i := &RAWInput{
+		pool:    tcp.NewMessagePool(1<<20, time.Second, nil, func(*tcp.Message) {}),
+		tlsPool: tcp.NewMessagePool(1<<20, time.Second, nil, func(*tcp.Message) {}),
+	}
+	defer i.pool.Close()
+	defer i.tlsPool.Close()
+	i.pool.Start = func(*tcp.Packet) (bool, bool) { return true, false }
+	i.tlsPool.Start = i.pool.Start
+	i.pool.Handler(segment(45678, "GET / HTTP/1.1\r\n"))
+	i.tlsPool.Handler(segment(45679, "\x16\x03\x01\x00\x10"))
+	snap := i.Snapshot()
+	if len(snap.Sessions) != 2 || snap.Size != 21 {
+		t.Errorf("expected the sessions of both pools, 21 bytes, got %d sessions of %d bytes", len(snap.Sessions), snap.Size)
+	}
+}
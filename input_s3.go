@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// S3InputConfig is the configuration of the S3 input
+type S3InputConfig struct {
+	From string `json:"input-s3-from"` // RFC 3339
+	To   string `json:"input-s3-to"`
+}
+
+// S3Input replays the objects written by --output-file s3:// under a prefix, in the order of the timestamps of
+// their payloads across the objects. the objects are streamed and merged like with GCSInput
+type S3Input struct {
+	*objectInput
+}
+
+// NewS3Input constructor for S3Input, path is the s3://bucket/prefix of the objects
+func NewS3Input(path string, config *S3InputConfig) *S3Input {
+	if !PRO {
+		log.Fatal("Using S3 output and input requires PRO license")
+		return nil
+	}
+	if !strings.HasPrefix(path, "s3://") || !strings.Contains(path[5:], "/") {
+		log.Fatalf("input-s3: invalid path %q, expected s3://bucket/prefix", path)
+	}
+	from, to, err := parseObjectInputRange(config.From, config.To)
+	if err != nil {
+		log.Fatalf("input-s3: %v", err)
+	}
+
+	awsConf := awsConfig()
+	if os.Getenv("AWS_ENDPOINT_URL") != "" {
+		// the S3 compatible services are rarely reachable by bucket subdomains
+		awsConf.S3ForcePathStyle = aws.Bool(true)
+	}
+	bucket, prefix := parseS3Url(path)
+	store := &s3Store{svc: s3.New(session.Must(session.NewSession(awsConf))), bucket: bucket}
+
+	i := new(S3Input)
+	if i.objectInput, err = newObjectInput("INPUT-S3", path, prefix, store, from, to); err != nil {
+		log.Fatalf("input-s3: %v", err)
+	}
+	return i
+}
+
+func (i *S3Input) String() string {
+	return "S3 input: " + i.path
+}
+
+// s3Store is the objectStore of an S3 bucket
+type s3Store struct {
+	svc    *s3.S3
+	bucket string
+}
+
+func (s *s3Store) list(prefix string) ([]*storeObject, error) {
+	var objects []*storeObject
+	err := s.svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, _ bool) bool {
+		for _, o := range page.Contents {
+			objects = append(objects, &storeObject{
+				key:     aws.StringValue(o.Key),
+				size:    aws.Int64Value(o.Size),
+				updated: aws.TimeValue(o.LastModified),
+			})
+		}
+		return true
+	})
+	return objects, err
+}
+
+func (s *s3Store) get(key string, offset int64) (io.ReadCloser, error) {
+	input := &s3.GetObjectInput{Bucket: aws.String(s.bucket), Key: aws.String(key)}
+	if offset > 0 {
+		input.Range = aws.String(fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := s.svc.GetObject(input)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
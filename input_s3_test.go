@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeS3 serves the ListObjectsV2 and the ranged GetObject requests of the objects of a bucket
+func fakeS3(objects map[string][]byte) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimPrefix(r.URL.Path, "/bucket")
+		if path == "" || path == "/" {
+			prefix := r.URL.Query().Get("prefix")
+			var keys []string
+			for key := range objects {
+				if strings.HasPrefix(key, prefix) {
+					keys = append(keys, key)
+				}
+			}
+			sort.Strings(keys)
+			fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?><ListBucketResult><Name>bucket</Name>`)
+			for _, key := range keys {
+				fmt.Fprintf(w, "<Contents><Key>%s</Key><Size>%d</Size><LastModified>%s</LastModified></Contents>",
+					key, len(objects[key]), time.Now().UTC().Format(time.RFC3339))
+			}
+			fmt.Fprintf(w, "<KeyCount>%d</KeyCount><IsTruncated>false</IsTruncated></ListBucketResult>", len(keys))
+			return
+		}
+		data, ok := objects[path[1:]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if rng := r.Header.Get("Range"); rng != "" {
+			offset, _ := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(rng, "bytes="), "-"))
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, len(data)-1, len(data)))
+			w.WriteHeader(http.StatusPartialContent)
+			data = data[offset:]
+		}
+		w.Write(data)
+	}))
+}
+
+func s3InputPayloads(ts ...int64) []byte {
+	var buf bytes.Buffer
+	for _, t := range ts {
+		fmt.Fprintf(&buf, "1 %d %d\nGET /%d HTTP/1.1\r\n\r\n%s", t, t, t, payloadSeparator)
+	}
+	return buf.Bytes()
+}
+
+func TestS3Input(t *testing.T) {
+	base := time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC).UnixNano()
+	ms := int64(time.Millisecond)
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write(s3InputPayloads(base+2*ms, base+5*ms))
+	w.Close()
+	server := fakeS3(map[string][]byte{
+		"logs/a.gor":     s3InputPayloads(base, base+3*ms, base+4*ms),
+		"logs/b.gz":      gz.Bytes(),
+		"logs/c.gor":     s3InputPayloads(base + 6*ms),
+		"logs/empty.gor": nil,
+		"other/d.gor":    s3InputPayloads(base + ms),
+	})
+	defer server.Close()
+
+	defer func(pro bool) { PRO = pro }(PRO)
+	PRO = true
+	os.Setenv("AWS_ENDPOINT_URL", server.URL)
+	os.Setenv("AWS_ACCESS_KEY_ID", "test")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	defer os.Unsetenv("AWS_ENDPOINT_URL")
+	defer os.Unsetenv("AWS_ACCESS_KEY_ID")
+	defer os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+
+	read := func(config *S3InputConfig, count int) (timestamps []int64) {
+		input := NewS3Input("s3://bucket/logs/", config)
+		defer input.Close()
+		buf := make([]byte, 1000)
+		for n := 0; n < count; n++ {
+			done := make(chan int)
+			go func() {
+				n, _ := input.Read(buf)
+				done <- n
+			}()
+			select {
+			case n := <-done:
+				ts, _ := strconv.ParseInt(string(payloadMeta(buf[:n])[2]), 10, 64)
+				timestamps = append(timestamps, (ts-base)/ms)
+			case <-time.After(time.Second):
+				t.Fatalf("expected %d payloads, got %v", count, timestamps)
+			}
+		}
+		return
+	}
+
+	if ts := read(&S3InputConfig{}, 6); fmt.Sprint(ts) != "[0 2 3 4 5 6]" {
+		t.Errorf("expected the payloads of the objects in the order of their timestamps, got %v", ts)
+	}
+
+	config := &S3InputConfig{
+		From: time.Unix(0, base).Add(-time.Hour).Format(time.RFC3339),
+		To:   time.Unix(0, base).Add(time.Hour).Format(time.RFC3339),
+	}
+	if ts := read(config, 6); fmt.Sprint(ts) != "[0 2 3 4 5 6]" {
+		t.Errorf("expected the payloads of the range, got %v", ts)
+	}
+}
+
+func TestS3InputRange(t *testing.T) {
+	base := time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC).UnixNano()
+	sec := int64(time.Second)
+	server := fakeS3(map[string][]byte{
+		"logs/a.gor": s3InputPayloads(base, base+2*sec, base+4*sec),
+		"logs/b.gor": s3InputPayloads(base+sec, base+3*sec),
+		"logs/c.gor": s3InputPayloads(base + 5*sec),
+	})
+	defer server.Close()
+
+	defer func(pro bool) { PRO = pro }(PRO)
+	PRO = true
+	os.Setenv("AWS_ENDPOINT_URL", server.URL)
+	os.Setenv("AWS_ACCESS_KEY_ID", "test")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	defer os.Unsetenv("AWS_ENDPOINT_URL")
+	defer os.Unsetenv("AWS_ACCESS_KEY_ID")
+	defer os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+
+	input := NewS3Input("s3://bucket/logs/", &S3InputConfig{
+		From: time.Unix(0, base+2*sec).UTC().Format(time.RFC3339),
+		To:   time.Unix(0, base+3*sec).UTC().Format(time.RFC3339),
+	})
+	defer input.Close()
+
+	buf := make([]byte, 1000)
+	var timestamps []int64
+	for n := 0; n < 2; n++ {
+		n, _ := input.Read(buf)
+		ts, _ := strconv.ParseInt(string(payloadMeta(buf[:n])[2]), 10, 64)
+		timestamps = append(timestamps, (ts-base)/sec)
+	}
+	if fmt.Sprint(timestamps) != "[2 3]" {
+		t.Errorf("expected the payloads between From and To, got %v", timestamps)
+	}
+	select {
+	case data := <-input.data:
+		t.Errorf("expected no payload after To, got %q", data)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -24,6 +24,7 @@ type TCPInputConfig struct {
 	Secure          bool   `json:"input-tcp-secure"`
 	CertificatePath string `json:"input-tcp-certificate"`
 	KeyPath         string `json:"input-tcp-certificate-key"`
+	ClientCAPath    string `json:"input-tcp-client-ca"` // the clients must present a certificate of these CAs
 }
 
 // NewTCPInput constructor for TCPInput, accepts address with port
@@ -58,12 +59,12 @@ func (i *TCPInput) Close() error {
 
 func (i *TCPInput) listen(address string) {
 	if i.config.Secure {
-		cer, err := tls.LoadX509KeyPair(i.config.CertificatePath, i.config.KeyPath)
+		// the certificate is loaded again when it is rotated
+		config, err := newServerTLSConfig(i.config.CertificatePath, i.config.KeyPath, i.config.ClientCAPath)
 		if err != nil {
-			log.Fatal("Error while loading --input-file certificate:", err)
+			log.Fatal("Error while loading --input-tcp certificate:", err)
 		}
 
-		config := &tls.Config{Certificates: []tls.Certificate{cer}}
 		listener, err := tls.Listen("tcp", address, config)
 		if err != nil {
 			log.Fatal("Can't start --input-tcp with secure connection:", err)
@@ -78,18 +79,25 @@ func (i *TCPInput) listen(address string) {
 		i.listener = listener
 	}
 
-	go func() {
-		for {
-			conn, err := i.listener.Accept()
+	go i.accept()
+}
 
-			if err != nil {
-				log.Println("Error while Accept()", err)
-				continue
-			}
+func (i *TCPInput) accept() {
+	for {
+		conn, err := i.listener.Accept()
 
-			go i.handleConnection(conn)
+		if err != nil {
+			select {
+			case <-i.stop:
+				return
+			default:
+			}
+			log.Println("Error while Accept()", err)
+			continue
 		}
-	}()
+
+		go i.handleConnection(conn)
+	}
 }
 
 func (i *TCPInput) handleConnection(conn net.Conn) {
@@ -6,6 +6,7 @@ import (
 	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/pem"
 	"io"
 	"io/ioutil"
@@ -13,6 +14,8 @@ import (
 	"math/big"
 	"net"
 	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -140,3 +143,79 @@ func TestTCPInputSecure(t *testing.T) {
 	wg.Wait()
 	emitter.Close()
 }
+
+func TestTCPInputMutualTLS(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gor_tcp_tls")
+	defer os.RemoveAll(dir)
+	write := func(name string, data []byte) string {
+		path := filepath.Join(dir, name)
+		ioutil.WriteFile(path, data, 0600)
+		return path
+	}
+	serverCertPem, serverPrivPem := genCertificate(&x509.Certificate{IPAddresses: []net.IP{net.ParseIP("127.0.0.1")}})
+	clientCertPem, clientPrivPem := genCertificate(&x509.Certificate{Subject: pkix.Name{CommonName: "gor"}})
+
+	serverCert, serverKey := write("server.crt", serverCertPem), write("server.key", serverPrivPem)
+	input := NewTCPInput("127.0.0.1:0", &TCPInputConfig{
+		Secure:          true,
+		CertificatePath: serverCert,
+		KeyPath:         serverKey,
+		ClientCAPath:    write("client-ca.crt", clientCertPem),
+	})
+	defer input.Close()
+	read := func() string {
+		data := make(chan string, 1)
+		go func() {
+			buf := make([]byte, 1024)
+			n, _ := input.Read(buf)
+			data <- string(buf[:n])
+		}()
+		select {
+		case d := <-data:
+			return d
+		case <-time.After(2 * time.Second):
+			return ""
+		}
+	}
+
+	output := NewTCPOutput(input.listener.Addr().String(), &TCPOutputConfig{
+		TLSCert: write("client.crt", clientCertPem),
+		TLSKey:  write("client.key", clientPrivPem),
+		TLSCA:   write("ca.crt", serverCertPem),
+	})
+	msg := "1 1 1\nGET / HTTP/1.1\r\n\r\n"
+	output.Write([]byte(msg))
+	if data := read(); data != msg {
+		t.Errorf("expected the payload over mTLS, got %q", data)
+	}
+
+	// the clients without certificate are rejected
+	conn, err := tls.Dial("tcp", input.listener.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err == nil {
+		conn.Write([]byte(msg + payloadSeparator))
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err = conn.Read(make([]byte, 1)); err == nil || strings.Contains(err.Error(), "timeout") {
+			t.Errorf("expected the client without certificate to be rejected, got %v", err)
+		}
+		conn.Close()
+	}
+
+	// the rotated certificate of the server is used by the next connections
+	rotatedCertPem, rotatedPrivPem := genCertificate(&x509.Certificate{IPAddresses: []net.IP{net.ParseIP("127.0.0.1")}})
+	write("server.crt", rotatedCertPem)
+	write("server.key", rotatedPrivPem)
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(serverKey, future, future)
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(rotatedCertPem)
+	cert, _ := tls.X509KeyPair(clientCertPem, clientPrivPem)
+	conn, err = tls.Dial("tcp", input.listener.Addr().String(), &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatalf("expected the rotated certificate, got %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte(msg + payloadSeparator))
+	if data := read(); data != msg {
+		t.Errorf("expected the payload, got %q", data)
+	}
+}
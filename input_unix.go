@@ -0,0 +1,45 @@
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+)
+
+// UnixInput receives the payloads of --output-unix on a Unix domain socket, with the framing of the TCP transport
+type UnixInput struct {
+	*TCPInput
+}
+
+// NewUnixInput constructor for UnixInput, accepts the path of the socket
+func NewUnixInput(path string) *UnixInput {
+	i := &TCPInput{
+		data:    make(chan []byte, 1000),
+		address: path,
+		config:  &TCPInputConfig{},
+		stop:    make(chan bool),
+	}
+
+	// the socket left by a previous instance is replaced
+	if stat, err := os.Stat(path); err == nil && stat.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		log.Fatalf("input-unix: can't listen on %s: %v", path, err)
+	}
+	i.listener = listener
+	go i.accept()
+
+	return &UnixInput{i}
+}
+
+// Close stops the input and removes the socket
+func (i *UnixInput) Close() error {
+	close(i.stop)
+	return i.listener.Close()
+}
+
+func (i *UnixInput) String() string {
+	return "Unix input: " + i.address
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUnixInputOutput(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gor_unix")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "gor.sock")
+
+	input := NewUnixInput(path)
+	output := NewUnixOutput(path)
+
+	msgs := []string{"1 1 1\nGET / HTTP/1.1\r\n\r\n", "2 1 1\nHTTP/1.1 200 OK\r\n\r\n"}
+	for _, msg := range msgs {
+		output.Write([]byte(msg))
+	}
+	received := make(map[string]bool)
+	buf := make([]byte, 1024)
+	for range msgs {
+		data := make(chan string, 1)
+		go func() {
+			n, _ := input.Read(buf)
+			data <- string(buf[:n])
+		}()
+		select {
+		case d := <-data:
+			received[d] = true
+		case <-time.After(2 * time.Second):
+			t.Fatal("expected the payloads on the socket")
+		}
+	}
+	for _, msg := range msgs {
+		if !received[msg] {
+			t.Errorf("expected %q, got %v", msg, received)
+		}
+	}
+
+	input.Close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected the socket to be removed, got %v", err)
+	}
+}
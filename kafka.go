@@ -2,11 +2,16 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
+	"hash"
 	"io/ioutil"
 	"log"
+	"strings"
 
 	"github.com/Shopify/sarama"
 	"github.com/buger/goreplay/proto"
@@ -21,6 +26,9 @@ type InputKafkaConfig struct {
 	Host     string `json:"input-kafka-host"`
 	Topic    string `json:"input-kafka-topic"`
 	UseJSON  bool   `json:"input-kafka-json-format"`
+	Group    string `json:"input-kafka-group"`
+	Offset   string `json:"input-kafka-offset"` // earliest, latest or an RFC 3339 timestamp
+	Balance  string `json:"input-kafka-balance-strategy"`
 }
 
 type OutputKafkaConfig struct {
@@ -29,65 +37,191 @@ type OutputKafkaConfig struct {
 	Host     string `json:"output-kafka-host"`
 	Topic    string `json:"output-kafka-topic"`
 	UseJSON  bool   `json:"output-kafka-json-format"`
+	Key      string `json:"output-kafka-key"`     // uuid, or the name of an HTTP header
+	Headers  bool   `json:"output-kafka-headers"` // the meta of the payloads as record headers
+
+	Serialization  string `json:"output-kafka-serialization"` // avro or protobuf
+	SchemaRegistry string `json:"output-kafka-schema-registry"`
+}
+
+// KafkaProduceOutputConfig is the configuration of the output re-producing the recorded Produce requests
+type KafkaProduceOutputConfig struct {
+	producer      sarama.AsyncProducer
+	KeepPartition bool `json:"output-kafka-produce-keep-partition"`
 }
 
-// KafkaTLSConfig should contains TLS certificates for connecting to secured Kafka clusters
+// KafkaTLSConfig should contains TLS certificates and SASL credentials for connecting to secured Kafka clusters
 type KafkaTLSConfig struct {
+	Enable     bool   `json:"kafka-tls"`
 	CACert     string `json:"kafka-tls-ca-cert"`
 	clientCert string `json:"kafka-tls-client-cert"`
 	clientKey  string `json:"kafka-tls-client-key"`
+	SASL       KafkaSASLConfig
+}
+
+// isSet reports whether any of the TLS or SASL options is set
+func (c *KafkaTLSConfig) isSet() bool {
+	return c.Enable || c.CACert != "" || c.clientCert != "" || c.clientKey != "" || c.SASL != (KafkaSASLConfig{})
+}
+
+// KafkaSASLConfig should contains the SASL mechanism and credentials of the Kafka clients
+type KafkaSASLConfig struct {
+	Mechanism string `json:"kafka-sasl-mechanism"`
+	User      string `json:"kafka-sasl-user"`
+	Password  string `json:"kafka-sasl-password"`
+	Token     string `json:"kafka-sasl-token"`
+	TokenFile string `json:"kafka-sasl-token-file"`
 }
 
 // KafkaMessage should contains catched request information that should be
 // passed as Json to Apache Kafka.
 type KafkaMessage struct {
-	ReqURL     string            `json:"Req_URL"`
-	ReqType    string            `json:"Req_Type"`
-	ReqID      string            `json:"Req_ID"`
-	ReqTs      string            `json:"Req_Ts"`
-	ReqMethod  string            `json:"Req_Method"`
-	ReqBody    string            `json:"Req_Body,omitempty"`
-	ReqHeaders map[string]string `json:"Req_Headers,omitempty"`
+	ReqURL           string            `json:"Req_URL"`
+	ReqURLNormalized string            `json:"Req_URL-Normalized,omitempty"`
+	ReqType          string            `json:"Req_Type"`
+	ReqID            string            `json:"Req_ID"`
+	ReqTs            string            `json:"Req_Ts"`
+	ReqMethod        string            `json:"Req_Method"`
+	ReqBody          string            `json:"Req_Body,omitempty"`
+	ReqHeaders       map[string]string `json:"Req_Headers,omitempty"`
 }
 
-// NewTLSConfig loads TLS certificates
+// NewTLSConfig loads TLS certificates, without a client certificate the client is not authenticated and
+// without a CA certificate the brokers are verified with the CAs of the system
 func NewTLSConfig(clientCertFile, clientKeyFile, caCertFile string) (*tls.Config, error) {
 	tlsConfig := tls.Config{}
 
 	// Load client cert
-	cert, err := tls.LoadX509KeyPair(clientCertFile, clientKeyFile)
-	if err != nil {
-		return &tlsConfig, err
+	if clientCertFile != "" || clientKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(clientCertFile, clientKeyFile)
+		if err != nil {
+			return &tlsConfig, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
 	}
-	tlsConfig.Certificates = []tls.Certificate{cert}
 
 	// Load CA cert
-	caCert, err := ioutil.ReadFile(caCertFile)
-	if err != nil {
-		return &tlsConfig, err
+	if caCertFile != "" {
+		caCert, err := ioutil.ReadFile(caCertFile)
+		if err != nil {
+			return &tlsConfig, err
+		}
+		caCertPool := x509.NewCertPool()
+		if !caCertPool.AppendCertsFromPEM(caCert) {
+			return &tlsConfig, fmt.Errorf("no certificate in %q", caCertFile)
+		}
+		tlsConfig.RootCAs = caCertPool
 	}
-	caCertPool := x509.NewCertPool()
-	caCertPool.AppendCertsFromPEM(caCert)
-	tlsConfig.RootCAs = caCertPool
 
-	return &tlsConfig, err
+	return &tlsConfig, nil
 }
 
-// NewKafkaConfig returns Kafka config with or without TLS
+// NewKafkaConfig returns Kafka config with or without TLS and SASL
 func NewKafkaConfig(tlsConfig *KafkaTLSConfig) *sarama.Config {
 	config := sarama.NewConfig()
-	// Configuration options go here
-	if (tlsConfig != nil) && (tlsConfig.CACert != "") && (tlsConfig.clientCert != "") && (tlsConfig.clientKey != "") {
-		config.Net.TLS.Enable = true
-		tlsConfig, err := NewTLSConfig(tlsConfig.clientCert, tlsConfig.clientKey, tlsConfig.CACert)
+	if tlsConfig == nil {
+		return config
+	}
+	if tlsConfig.Enable || tlsConfig.CACert != "" || tlsConfig.clientCert != "" || tlsConfig.clientKey != "" {
+		if (tlsConfig.clientCert == "") != (tlsConfig.clientKey == "") {
+			log.Fatal("kafka: --kafka-tls-client-cert and --kafka-tls-client-key must be set together")
+		}
+		c, err := NewTLSConfig(tlsConfig.clientCert, tlsConfig.clientKey, tlsConfig.CACert)
 		if err != nil {
-			log.Fatal(err)
+			log.Fatalf("kafka: %v", err)
 		}
-		config.Net.TLS.Config = tlsConfig
+		config.Net.TLS.Enable = true
+		config.Net.TLS.Config = c
+	}
+	if err := tlsConfig.SASL.configure(config); err != nil {
+		log.Fatalf("kafka: %v", err)
 	}
 	return config
 }
 
+// configure enables the SASL mechanism of the config, if any
+func (s *KafkaSASLConfig) configure(config *sarama.Config) error {
+	if s.Mechanism == "" {
+		return nil
+	}
+	config.Net.SASL.Enable = true
+	config.Net.SASL.Version = sarama.SASLHandshakeV1
+	config.Net.SASL.Mechanism = sarama.SASLMechanism(strings.ToUpper(s.Mechanism))
+	config.Net.SASL.User = s.User
+	config.Net.SASL.Password = s.Password
+
+	switch config.Net.SASL.Mechanism {
+	case sarama.SASLTypePlaintext:
+	case sarama.SASLTypeSCRAMSHA256:
+		config.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient { return &kafkaSCRAMClient{hash: sha256.New} }
+	case sarama.SASLTypeSCRAMSHA512:
+		config.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient { return &kafkaSCRAMClient{hash: sha512.New} }
+	case sarama.SASLTypeOAuth:
+		if s.Token == "" && s.TokenFile == "" {
+			return errors.New("--kafka-sasl-token or --kafka-sasl-token-file is required by OAUTHBEARER")
+		}
+		config.Net.SASL.TokenProvider = kafkaTokenProvider{token: s.Token, file: s.TokenFile}
+		return nil
+	default:
+		return fmt.Errorf("unsupported SASL mechanism %q, expected PLAIN, SCRAM-SHA-256, SCRAM-SHA-512 or OAUTHBEARER", s.Mechanism)
+	}
+	if s.User == "" || s.Password == "" {
+		return fmt.Errorf("--kafka-sasl-user and --kafka-sasl-password are required by %s", config.Net.SASL.Mechanism)
+	}
+	return nil
+}
+
+// kafkaSCRAMClient runs the SASL/SCRAM exchange of the brokers
+type kafkaSCRAMClient struct {
+	hash  func() hash.Hash
+	scram *scramClient
+	done  bool
+}
+
+func (c *kafkaSCRAMClient) Begin(user, password, _ string) error {
+	c.scram = newSCRAMClient(user, password)
+	c.scram.hash = c.hash
+	return nil
+}
+
+// Step returns the client-first-message, then the client-final-message, then verifies the server-final-message
+func (c *kafkaSCRAMClient) Step(challenge string) (string, error) {
+	switch {
+	case challenge == "" && c.scram.auth == nil:
+		return string(c.scram.first()), nil
+	case c.scram.auth == nil:
+		final, err := c.scram.final([]byte(challenge))
+		return string(final), err
+	}
+	c.done = true
+	if !c.scram.verify([]byte(challenge)) {
+		return "", errors.New("invalid SCRAM server-final-message")
+	}
+	return "", nil
+}
+
+func (c *kafkaSCRAMClient) Done() bool {
+	return c.done
+}
+
+// kafkaTokenProvider provides the OAUTHBEARER token, its file is read on each connection so that the token
+// can be refreshed by another process
+type kafkaTokenProvider struct {
+	token string
+	file  string
+}
+
+func (p kafkaTokenProvider) Token() (*sarama.AccessToken, error) {
+	if p.file == "" {
+		return &sarama.AccessToken{Token: p.token}, nil
+	}
+	token, err := ioutil.ReadFile(p.file)
+	if err != nil {
+		return nil, err
+	}
+	return &sarama.AccessToken{Token: string(bytes.TrimSpace(token))}, nil
+}
+
 // Dump returns the given request in its HTTP/1.x wire
 // representation.
 func (m KafkaMessage) Dump() ([]byte, error) {
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/buger/goreplay/proto"
+)
+
+// KafkaModifierConfig is the configuration of the filters of Kafka requests
+type KafkaModifierConfig struct {
+	APIs           KafkaAPIs        `json:"kafka-allow-api"`
+	NegativeAPIs   KafkaAPIs        `json:"kafka-disallow-api"`
+	Topics         KafkaTopicRegexp `json:"kafka-allow-topic"`
+	NegativeTopics KafkaTopicRegexp `json:"kafka-disallow-topic"`
+}
+
+// KafkaAPIs holds the keys of Kafka APIs, given by their names like Produce or Fetch
+type KafkaAPIs []int16
+
+func (a *KafkaAPIs) String() string {
+	names := make([]string, 0, len(*a))
+	for _, key := range *a {
+		names = append(names, proto.KafkaAPIName(key))
+	}
+	return fmt.Sprint(names)
+}
+
+// Set is here so that KafkaAPIs can implement flag.Var
+func (a *KafkaAPIs) Set(value string) error {
+	key, ok := proto.KafkaAPIKey(value)
+	if !ok {
+		return fmt.Errorf("unknown kafka api %q", value)
+	}
+	*a = append(*a, key)
+	return nil
+}
+
+func (a KafkaAPIs) match(key int16) bool {
+	for _, k := range a {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// KafkaTopicRegexp holds the regexps matched against the topics of Kafka requests
+type KafkaTopicRegexp []*regexp.Regexp
+
+func (r *KafkaTopicRegexp) String() string {
+	return fmt.Sprint(*r)
+}
+
+// Set is here so that KafkaTopicRegexp can implement flag.Var
+func (r *KafkaTopicRegexp) Set(value string) error {
+	re, err := regexp.Compile(value)
+	if err != nil {
+		return err
+	}
+	*r = append(*r, re)
+	return nil
+}
+
+func (r KafkaTopicRegexp) match(topic string) bool {
+	for _, re := range r {
+		if re.MatchString(topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// KafkaModifier filters the requests recorded with --input-raw-protocol kafka by their API and their topics. the
+// Produce requests keep the topics that are allowed, the other requests are kept when one of their topics is
+// allowed, and the requests without topics are dropped when topics are allowed. the payloads that are not Kafka
+// requests are returned as is.
+type KafkaModifier struct {
+	config *KafkaModifierConfig
+}
+
+// NewKafkaModifier returns nil when nothing is filtered
+func NewKafkaModifier(config *KafkaModifierConfig) *KafkaModifier {
+	if len(config.APIs) == 0 && len(config.NegativeAPIs) == 0 &&
+		len(config.Topics) == 0 && len(config.NegativeTopics) == 0 {
+		return nil
+	}
+	return &KafkaModifier{config: config}
+}
+
+// Rewrite returns the request with the topics that are allowed, or nothing if it is filtered out
+func (m *KafkaModifier) Rewrite(payload []byte) []byte {
+	r, ok := proto.ParseKafkaRequest(payload)
+	if !ok {
+		return payload
+	}
+	if len(m.config.APIs) > 0 && !m.config.APIs.match(r.APIKey) {
+		return nil
+	}
+	if m.config.NegativeAPIs.match(r.APIKey) {
+		return nil
+	}
+	if len(m.config.Topics) == 0 && len(m.config.NegativeTopics) == 0 {
+		return payload
+	}
+	if r.APIKey == proto.KafkaProduce {
+		p, ok := proto.ParseKafkaProduce(r)
+		if !ok {
+			return payload
+		}
+		topics := p.Topics[:0]
+		for _, t := range p.Topics {
+			if m.allowed(t.Name) {
+				topics = append(topics, t)
+			}
+		}
+		if len(topics) == 0 {
+			return nil
+		}
+		if len(topics) == len(p.Topics) {
+			return payload
+		}
+		p.Topics = topics
+		return proto.AppendKafkaProduce(nil, r, p)
+	}
+	topics := proto.KafkaTopics(r)
+	if len(topics) == 0 && len(m.config.Topics) == 0 {
+		return payload
+	}
+	for _, topic := range topics {
+		if m.allowed(topic) {
+			return payload
+		}
+	}
+	return nil
+}
+
+func (m *KafkaModifier) allowed(topic string) bool {
+	if len(m.config.Topics) > 0 && !m.config.Topics.match(topic) {
+		return false
+	}
+	return !m.config.NegativeTopics.match(topic)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/buger/goreplay/proto"
+)
+
+func TestKafkaModifier(t *testing.T) {
+	if NewKafkaModifier(&KafkaModifierConfig{}) != nil {
+		t.Error("expected no modifier without filters")
+	}
+	produce := func(topics ...string) []byte {
+		p := proto.KafkaProduceRequest{Acks: 1, Timeout: 1000}
+		for _, topic := range topics {
+			p.Topics = append(p.Topics, proto.KafkaProduceTopic{Name: topic, Partitions: []proto.KafkaProducePartition{{Records: []byte{}}}})
+		}
+		return proto.AppendKafkaProduce(nil, proto.KafkaRequest{APIVersion: 8, CorrelationID: 1}, p)
+	}
+	metadata := proto.AppendKafkaRequest(nil, proto.KafkaRequest{APIKey: proto.KafkaMetadata, APIVersion: 1, Body: []byte{0, 0, 0, 0}})
+	tests := []struct {
+		config  func(*KafkaModifierConfig)
+		payload []byte
+		kept    bool
+	}{
+		{func(c *KafkaModifierConfig) { c.APIs.Set("produce") }, produce("orders"), true},
+		{func(c *KafkaModifierConfig) { c.APIs.Set("Produce") }, metadata, false},
+		{func(c *KafkaModifierConfig) { c.NegativeAPIs.Set("Metadata") }, metadata, false},
+		{func(c *KafkaModifierConfig) { c.Topics.Set("^orders$") }, produce("orders"), true},
+		{func(c *KafkaModifierConfig) { c.Topics.Set("^orders$") }, produce("events"), false},
+		{func(c *KafkaModifierConfig) { c.Topics.Set("^orders$") }, metadata, false},
+		{func(c *KafkaModifierConfig) { c.NegativeTopics.Set("^__") }, metadata, true},
+		{func(c *KafkaModifierConfig) { c.NegativeTopics.Set("^__") }, produce("__consumer_offsets"), false},
+		// not a Kafka request
+		{func(c *KafkaModifierConfig) { c.APIs.Set("Produce") }, []byte("GET / HTTP/1.1\r\n\r\n"), true},
+	}
+	for i, tt := range tests {
+		config := new(KafkaModifierConfig)
+		tt.config(config)
+		got := NewKafkaModifier(config).Rewrite(tt.payload)
+		if kept := bytes.Equal(got, tt.payload); kept != tt.kept || !kept && len(got) != 0 {
+			t.Errorf("%d: expected %q to be kept %v, got %q", i, tt.payload, tt.kept, got)
+		}
+	}
+
+	// the produce requests lose the topics that are not allowed
+	config := new(KafkaModifierConfig)
+	config.NegativeTopics.Set("^events$")
+	r, _ := proto.ParseKafkaRequest(NewKafkaModifier(config).Rewrite(produce("orders", "events", "payments")))
+	if topics := proto.KafkaTopics(r); !reflect.DeepEqual(topics, []string{"orders", "payments"}) {
+		t.Errorf("unexpected topics %v", topics)
+	}
+	var apis KafkaAPIs
+	if apis.Set("Publish") == nil {
+		t.Error("expected an unknown api to be rejected")
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// the serializations of the records of the Kafka output registered in a Confluent Schema Registry
+const (
+	KafkaAvro     = "avro"
+	KafkaProtobuf = "protobuf"
+)
+
+// kafkaAvroSchema is the Avro schema of the KafkaMessage records, the body is kept as bytes since it may not be
+// valid UTF-8
+const kafkaAvroSchema = `{"type":"record","name":"KafkaMessage","namespace":"goreplay","fields":[` +
+	`{"name":"Req_URL","type":"string"},` +
+	`{"name":"Req_URL_Normalized","type":"string","default":""},` +
+	`{"name":"Req_Type","type":"string"},` +
+	`{"name":"Req_ID","type":"string"},` +
+	`{"name":"Req_Ts","type":"string"},` +
+	`{"name":"Req_Method","type":"string"},` +
+	`{"name":"Req_Body","type":"bytes"},` +
+	`{"name":"Req_Headers","type":{"type":"map","values":"string"}}]}`
+
+// kafkaProtobufSchema is the Protobuf schema of the KafkaMessage records
+const kafkaProtobufSchema = `syntax = "proto3";
+package goreplay;
+
+message KafkaMessage {
+  string Req_URL = 1;
+  string Req_URL_Normalized = 2;
+  string Req_Type = 3;
+  string Req_ID = 4;
+  string Req_Ts = 5;
+  string Req_Method = 6;
+  bytes Req_Body = 7;
+  map<string, string> Req_Headers = 8;
+}
+`
+
+// registerKafkaSchema registers the schema of the serialization in the subject <topic>-value of the registry,
+// the user and password of the registry URL are sent with basic authentication. it returns the id of the schema.
+func registerKafkaSchema(registry, topic, serialization string) (int, error) {
+	u, err := url.Parse(registry)
+	if err != nil {
+		return 0, err
+	}
+	subject := struct {
+		Schema     string `json:"schema"`
+		SchemaType string `json:"schemaType,omitempty"`
+	}{Schema: kafkaAvroSchema}
+	if serialization == KafkaProtobuf {
+		subject.Schema, subject.SchemaType = kafkaProtobufSchema, "PROTOBUF"
+	}
+	body, _ := json.Marshal(&subject)
+
+	user := u.User
+	u.User = nil
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/subjects/" + url.PathEscape(topic+"-value") + "/versions"
+	req, err := http.NewRequest(http.MethodPost, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/vnd.schemaregistry.v1+json")
+	if user != nil {
+		password, _ := user.Password()
+		req.SetBasicAuth(user.Username(), password)
+	}
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	body, _ = ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("schema registry: %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	var registered struct {
+		ID int `json:"id"`
+	}
+	if err = json.Unmarshal(body, &registered); err != nil {
+		return 0, fmt.Errorf("schema registry: %v", err)
+	}
+	return registered.ID, nil
+}
+
+// serializeKafkaMessage encodes the message in the wire format of the Confluent serializers: a magic byte, the
+// id of the schema, the indexes of the message type for Protobuf, then the Avro or Protobuf binary encoding
+func serializeKafkaMessage(m *KafkaMessage, serialization string, schemaID int) []byte {
+	buf := []byte{0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(buf[1:], uint32(schemaID))
+	if serialization == KafkaProtobuf {
+		// KafkaMessage is the first message type of the schema
+		buf = append(buf, 0)
+		return appendProtobufMessage(buf, m)
+	}
+	return appendAvroMessage(buf, m)
+}
+
+// sortedKeys returns the keys of the headers in order, so that the encoding is deterministic
+func sortedKeys(headers map[string]string) []string {
+	keys := make([]string, 0, len(headers))
+	for k := range headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func appendAvroMessage(buf []byte, m *KafkaMessage) []byte {
+	for _, s := range []string{m.ReqURL, m.ReqURLNormalized, m.ReqType, m.ReqID, m.ReqTs, m.ReqMethod, m.ReqBody} {
+		buf = appendAvroString(buf, s)
+	}
+	if len(m.ReqHeaders) > 0 {
+		buf = appendAvroLong(buf, int64(len(m.ReqHeaders)))
+		for _, k := range sortedKeys(m.ReqHeaders) {
+			buf = appendAvroString(buf, k)
+			buf = appendAvroString(buf, m.ReqHeaders[k])
+		}
+	}
+	// the end of the blocks of the map
+	return appendAvroLong(buf, 0)
+}
+
+// appendAvroLong appends a zig-zag varint, like binary.PutVarint
+func appendAvroLong(buf []byte, n int64) []byte {
+	var b [binary.MaxVarintLen64]byte
+	return append(buf, b[:binary.PutVarint(b[:], n)]...)
+}
+
+func appendAvroString(buf []byte, s string) []byte {
+	return append(appendAvroLong(buf, int64(len(s))), s...)
+}
+
+func appendProtobufMessage(buf []byte, m *KafkaMessage) []byte {
+	for i, s := range []string{m.ReqURL, m.ReqURLNormalized, m.ReqType, m.ReqID, m.ReqTs, m.ReqMethod, m.ReqBody} {
+		buf = appendProtobufString(buf, i+1, s)
+	}
+	for _, k := range sortedKeys(m.ReqHeaders) {
+		// a map field is a repeated message of a key and a value
+		entry := appendProtobufString(nil, 1, k)
+		entry = appendProtobufString(entry, 2, m.ReqHeaders[k])
+		buf = appendProtobufBytes(buf, 8, entry)
+	}
+	return buf
+}
+
+// appendProtobufString appends a length-delimited field, the empty ones are omitted like in proto3
+func appendProtobufString(buf []byte, field int, s string) []byte {
+	if s == "" {
+		return buf
+	}
+	return append(appendProtobufTag(buf, field, len(s)), s...)
+}
+
+func appendProtobufBytes(buf []byte, field int, b []byte) []byte {
+	return append(appendProtobufTag(buf, field, len(b)), b...)
+}
+
+func appendProtobufTag(buf []byte, field, length int) []byte {
+	var b [binary.MaxVarintLen64]byte
+	buf = append(buf, b[:binary.PutUvarint(b[:], uint64(field)<<3|2)]...)
+	return append(buf, b[:binary.PutUvarint(b[:], uint64(length))]...)
+}
@@ -78,6 +78,15 @@ func (m *Middleware) copy(to io.Writer, from io.Reader) {
 
 		payload := buf[0:nr]
 
+		if Settings.DecodeHTTPBody {
+			payload = decodeHTTPBody(payload)
+			nr = len(payload)
+
+			if nr*2 > len(dst) {
+				continue
+			}
+		}
+
 		if Settings.PrettifyHTTP {
 			payload = prettifyHTTP(payload)
 			nr = len(payload)
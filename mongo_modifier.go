@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/buger/goreplay/proto"
+)
+
+// MongoModifierConfig is the configuration of the filters of MongoDB requests
+type MongoModifierConfig struct {
+	Commands           MongoCommands        `json:"mongo-allow-command"`
+	NegativeCommands   MongoCommands        `json:"mongo-disallow-command"`
+	Namespaces         MongoNamespaceRegexp `json:"mongo-allow-namespace"`
+	NegativeNamespaces MongoNamespaceRegexp `json:"mongo-disallow-namespace"`
+}
+
+// MongoCommands holds names of MongoDB commands, they are matched case insensitively
+type MongoCommands []string
+
+func (c *MongoCommands) String() string {
+	return fmt.Sprint(*c)
+}
+
+// Set is here so that MongoCommands can implement flag.Var
+func (c *MongoCommands) Set(value string) error {
+	if value == "" {
+		return fmt.Errorf("empty mongo command")
+	}
+	*c = append(*c, value)
+	return nil
+}
+
+// MongoNamespaceRegexp holds the regexps matched against the namespaces of MongoDB requests, the database
+// and the collection separated by a dot, or the database alone
+type MongoNamespaceRegexp []*regexp.Regexp
+
+func (r *MongoNamespaceRegexp) String() string {
+	return fmt.Sprint(*r)
+}
+
+// Set is here so that MongoNamespaceRegexp can implement flag.Var
+func (r *MongoNamespaceRegexp) Set(value string) error {
+	re, err := regexp.Compile(value)
+	if err != nil {
+		return err
+	}
+	*r = append(*r, re)
+	return nil
+}
+
+// MongoModifier filters the requests recorded with --input-raw-protocol mongo by their command, database and
+// collection, see proto.ParseMongoCommand. the payloads that are not MongoDB requests are returned as is.
+type MongoModifier struct {
+	config *MongoModifierConfig
+}
+
+// NewMongoModifier returns nil when nothing is filtered
+func NewMongoModifier(config *MongoModifierConfig) *MongoModifier {
+	if len(config.Commands) == 0 && len(config.NegativeCommands) == 0 &&
+		len(config.Namespaces) == 0 && len(config.NegativeNamespaces) == 0 {
+		return nil
+	}
+	return &MongoModifier{config: config}
+}
+
+// Rewrite returns the request, or nothing if it is filtered out
+func (m *MongoModifier) Rewrite(payload []byte) []byte {
+	if proto.MongoMessageLength(payload) != len(payload) {
+		return payload
+	}
+	c, ok := proto.ParseMongoCommand(payload)
+	if !ok {
+		return payload
+	}
+	if len(m.config.Commands) > 0 && !matchMongoCommand(m.config.Commands, c.Name) {
+		return nil
+	}
+	if matchMongoCommand(m.config.NegativeCommands, c.Name) {
+		return nil
+	}
+	ns := c.Namespace()
+	if len(m.config.Namespaces) > 0 && !matchNamespace(m.config.Namespaces, ns) {
+		return nil
+	}
+	if matchNamespace(m.config.NegativeNamespaces, ns) {
+		return nil
+	}
+	return payload
+}
+
+func matchMongoCommand(commands MongoCommands, name string) bool {
+	for _, c := range commands {
+		if strings.EqualFold(c, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchNamespace(regexps MongoNamespaceRegexp, ns string) bool {
+	for _, re := range regexps {
+		if re.MatchString(ns) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/buger/goreplay/proto"
+)
+
+func TestMongoModifier(t *testing.T) {
+	if NewMongoModifier(&MongoModifierConfig{}) != nil {
+		t.Error("expected no modifier without filters")
+	}
+	command := func(name, collection, db string) []byte {
+		return proto.AppendMongoMsg(nil, 1, proto.BSONDoc(proto.AppendBSONString(proto.AppendBSONString(nil, name, collection), "$db", db)))
+	}
+	tests := []struct {
+		config  func(*MongoModifierConfig)
+		request []byte
+		kept    bool
+	}{
+		{func(c *MongoModifierConfig) { c.Commands.Set("find") }, command("find", "users", "shop"), true},
+		{func(c *MongoModifierConfig) { c.Commands.Set("FIND") }, command("find", "users", "shop"), true},
+		{func(c *MongoModifierConfig) { c.Commands.Set("find") }, command("delete", "users", "shop"), false},
+		{func(c *MongoModifierConfig) { c.NegativeCommands.Set("drop") }, command("drop", "users", "shop"), false},
+		{func(c *MongoModifierConfig) { c.NegativeCommands.Set("drop") }, command("insert", "users", "shop"), true},
+		{func(c *MongoModifierConfig) { c.Namespaces.Set(`^shop\.`) }, command("find", "users", "shop"), true},
+		{func(c *MongoModifierConfig) { c.Namespaces.Set(`^shop\.`) }, command("find", "users", "admin"), false},
+		{func(c *MongoModifierConfig) { c.NegativeNamespaces.Set(`\.sessions$`) }, command("find", "sessions", "shop"), false},
+		// not mongo
+		{func(c *MongoModifierConfig) { c.Commands.Set("find") }, []byte("GET / HTTP/1.1\r\n\r\n"), true},
+	}
+	for i, tt := range tests {
+		config := new(MongoModifierConfig)
+		tt.config(config)
+		got := NewMongoModifier(config).Rewrite(tt.request)
+		if kept := bytes.Equal(got, tt.request); kept != tt.kept || !kept && len(got) != 0 {
+			t.Errorf("%d: expected the request to be kept %v, got %q", i, tt.kept, got)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/buger/goreplay/proto"
+)
+
+// MQTTModifierConfig is the configuration of the filters of MQTT messages
+type MQTTModifierConfig struct {
+	Topics         MQTTTopics `json:"mqtt-allow-topic"`
+	NegativeTopics MQTTTopics `json:"mqtt-disallow-topic"`
+}
+
+// MQTTTopics holds MQTT topic filters, + matches a level of topics and # the levels that follow
+type MQTTTopics []string
+
+func (t *MQTTTopics) String() string {
+	return fmt.Sprint(*t)
+}
+
+// Set is here so that MQTTTopics can implement flag.Var
+func (t *MQTTTopics) Set(value string) error {
+	if value == "" {
+		return fmt.Errorf("empty mqtt topic filter")
+	}
+	levels := strings.Split(value, "/")
+	for i, level := range levels {
+		if level != "+" && level != "#" && strings.ContainsAny(level, "+#") || level == "#" && i != len(levels)-1 {
+			return fmt.Errorf("invalid mqtt topic filter %q", value)
+		}
+	}
+	*t = append(*t, value)
+	return nil
+}
+
+// Match reports whether the topic matches one of the filters
+func (t MQTTTopics) Match(topic string) bool {
+	for _, filter := range t {
+		if proto.MatchMQTTTopic(filter, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// MQTTModifier filters the messages recorded with --input-raw-protocol mqtt by their topic. the payloads that are
+// not PUBLISH packets are returned as is.
+type MQTTModifier struct {
+	config *MQTTModifierConfig
+}
+
+// NewMQTTModifier returns nil when nothing is filtered
+func NewMQTTModifier(config *MQTTModifierConfig) *MQTTModifier {
+	if len(config.Topics) == 0 && len(config.NegativeTopics) == 0 {
+		return nil
+	}
+	return &MQTTModifier{config: config}
+}
+
+// Rewrite returns the message, or nothing if it is filtered out
+func (m *MQTTModifier) Rewrite(payload []byte) []byte {
+	typ, flags, body, n := proto.MQTTPacket(payload)
+	if n != len(payload) || typ != proto.MQTTPublish {
+		return payload
+	}
+	// the messages are recorded in the encoding of MQTT 5
+	p, ok := proto.ParseMQTTPublish(flags, body, proto.MQTT5)
+	if !ok {
+		return payload
+	}
+	if len(m.config.Topics) > 0 && !m.config.Topics.Match(p.Topic) {
+		return nil
+	}
+	if m.config.NegativeTopics.Match(p.Topic) {
+		return nil
+	}
+	return payload
+}
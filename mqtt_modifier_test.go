@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/buger/goreplay/proto"
+)
+
+func TestMQTTModifier(t *testing.T) {
+	if NewMQTTModifier(&MQTTModifierConfig{}) != nil {
+		t.Error("expected no modifier without filters")
+	}
+	publish := func(topic string) []byte {
+		return proto.AppendMQTTPublish(nil, proto.MQTTPublishPacket{Topic: topic, Payload: []byte("1")}, proto.MQTT5)
+	}
+	tests := []struct {
+		config  func(*MQTTModifierConfig)
+		payload []byte
+		kept    bool
+	}{
+		{func(c *MQTTModifierConfig) { c.Topics.Set("sensors/+/temp") }, publish("sensors/1/temp"), true},
+		{func(c *MQTTModifierConfig) { c.Topics.Set("sensors/+/temp") }, publish("sensors/1/humidity"), false},
+		{func(c *MQTTModifierConfig) { c.NegativeTopics.Set("devices/#") }, publish("devices/1/firmware"), false},
+		{func(c *MQTTModifierConfig) { c.NegativeTopics.Set("devices/#") }, publish("sensors/1/temp"), true},
+		// not a PUBLISH packet
+		{func(c *MQTTModifierConfig) { c.Topics.Set("sensors/#") }, proto.AppendMQTTPacket(nil, proto.MQTTPingReq, 0, nil), true},
+	}
+	for i, tt := range tests {
+		config := new(MQTTModifierConfig)
+		tt.config(config)
+		got := NewMQTTModifier(config).Rewrite(tt.payload)
+		if kept := bytes.Equal(got, tt.payload); kept != tt.kept || !kept && len(got) != 0 {
+			t.Errorf("%d: expected %q to be kept %v, got %q", i, tt.payload, tt.kept, got)
+		}
+	}
+	var topics MQTTTopics
+	for _, filter := range []string{"", "a/#/b", "a/b+"} {
+		if topics.Set(filter) == nil {
+			t.Errorf("expected the filter %q to be rejected", filter)
+		}
+	}
+}
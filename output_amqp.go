@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+)
+
+// amqpFrameMax is the maximum size of the frames sent to the broker, the one of RabbitMQ by default
+const amqpFrameMax = 128 << 10
+
+// AMQPOutputConfig is the configuration of the AMQP output
+type AMQPOutputConfig struct {
+	User        string        `json:"output-amqp-user"`
+	Password    string        `json:"output-amqp-password"`
+	VHost       string        `json:"output-amqp-vhost"`
+	Timeout     time.Duration `json:"output-amqp-timeout"`
+	IdleTimeout time.Duration `json:"output-amqp-idle-timeout"`
+
+	// the messages of --output-amqp-publish
+	Exchange   string `json:"output-amqp-exchange"`
+	RoutingKey string `json:"output-amqp-routing-key"`
+	Persistent bool   `json:"output-amqp-persistent"`
+	Confirm    bool   `json:"output-amqp-confirm"`
+}
+
+// AMQPOutput republishes the basic.publish commands recorded with --input-raw-protocol amqp to an AMQP 0-9-1
+// broker. each recorded connection gets its own connection authenticated with PLAIN, the commands of all its
+// channels are published on a single channel with the delays they were recorded with, and keep their exchange,
+// routing key, flags, properties and body. the broker must have the exchanges of the commands, a channel closed by
+// the broker closes its session, the commands that follow open a new one.
+type AMQPOutput struct {
+	sync.Mutex
+	address  string
+	config   *AMQPOutputConfig
+	sessions map[string]*amqpSession // by the id of the recorded connection
+}
+
+type amqpCommand struct {
+	data      []byte
+	timestamp int64 // recorded
+}
+
+// amqpSession is a connection replayed against the broker
+type amqpSession struct {
+	output    *AMQPOutput
+	id        string
+	timestamp int64 // of the first command
+	commands  chan amqpCommand
+	done      chan struct{}
+	stop      sync.Once
+	lock      sync.Mutex // guards conn
+	conn      net.Conn
+	writeLock sync.Mutex // the replies to the broker are written by receive
+	frameMax  int        // negotiated with the broker
+}
+
+// NewAMQPOutput constructor for AMQPOutput, address is the host:port of the broker
+func NewAMQPOutput(address string, config *AMQPOutputConfig) io.Writer {
+	o := new(AMQPOutput)
+	o.address = address
+	o.config = config
+	if o.config.User == "" {
+		o.config.User, o.config.Password = "guest", "guest"
+	}
+	if o.config.VHost == "" {
+		o.config.VHost = "/"
+	}
+	if o.config.Timeout < time.Millisecond {
+		o.config.Timeout = 5 * time.Second
+	}
+	if o.config.IdleTimeout < time.Millisecond {
+		o.config.IdleTimeout = 5 * time.Minute
+	}
+	o.sessions = make(map[string]*amqpSession)
+	return o
+}
+
+// Write queues the command to the session of its connection, the session is opened by its first command
+func (o *AMQPOutput) Write(data []byte) (n int, err error) {
+	n = len(data)
+	if !isRequestPayload(data) {
+		return
+	}
+	meta := payloadMeta(data)
+	if len(meta) < 3 {
+		return
+	}
+	id := string(meta[1])
+	timestamp, _ := strconv.ParseInt(string(meta[2]), 10, 64)
+	body := payloadBody(data)
+	if _, ok := proto.ParseAMQPPublish(body); !ok {
+		return
+	}
+	o.Lock()
+	s, ok := o.sessions[id]
+	if !ok {
+		s = &amqpSession{
+			output:    o,
+			id:        id,
+			timestamp: timestamp,
+			commands:  make(chan amqpCommand, 1000),
+			done:      make(chan struct{}),
+		}
+		o.sessions[id] = s
+		go s.run()
+	}
+	o.Unlock()
+	select {
+	case s.commands <- amqpCommand{data: append([]byte(nil), body...), timestamp: timestamp}:
+	case <-s.done:
+	}
+	return
+}
+
+// remove forgets the session, unless it was replaced by a session with the same id
+func (o *AMQPOutput) remove(s *amqpSession) {
+	o.Lock()
+	if o.sessions[s.id] == s {
+		delete(o.sessions, s.id)
+	}
+	o.Unlock()
+}
+
+func (o *AMQPOutput) String() string {
+	return fmt.Sprintf("AMQP output: %s", o.address)
+}
+
+// Close closes the sessions in progress
+func (o *AMQPOutput) Close() error {
+	o.Lock()
+	for _, s := range o.sessions {
+		s.close()
+	}
+	o.Unlock()
+	return nil
+}
+
+// run connects to the broker and publishes the commands until the broker closes the connection or the channel,
+// or it is idle for longer than IdleTimeout. the session is forgotten on errors, the commands that follow open a
+// new one.
+func (s *amqpSession) run() {
+	defer s.output.remove(s)
+	defer s.close()
+	r, err := s.connect()
+	if err != nil {
+		Debug(1, fmt.Sprintf("[AMQP-OUTPUT] session %s: %v", s.id, err))
+		return
+	}
+	go s.receive(r)
+	started := time.Now()
+	idle := time.NewTimer(s.output.config.IdleTimeout)
+	defer idle.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-idle.C:
+			s.write(proto.AppendAMQPMethod(nil, 0, proto.AMQPConnection, proto.AMQPConnectionClose, []byte{0, 200, 0, 0, 0, 0, 0}))
+			return
+		case c := <-s.commands:
+			// the delay since the first command is preserved
+			if wait := time.Duration(c.timestamp-s.timestamp) - time.Since(started); wait > 0 {
+				select {
+				case <-time.After(wait):
+				case <-s.done:
+					return
+				}
+			}
+			p, _ := proto.ParseAMQPPublish(c.data)
+			p.Channel = 1
+			if err := s.write(proto.AppendAMQPPublish(nil, p, s.frameMax)); err != nil {
+				Debug(1, fmt.Sprintf("[AMQP-OUTPUT] session %s: %v", s.id, err))
+				return
+			}
+			if !idle.Stop() {
+				<-idle.C
+			}
+			idle.Reset(s.output.config.IdleTimeout)
+		}
+	}
+}
+
+// connect connects to the broker, authenticates with PLAIN, opens the virtual host of the configuration and the
+// channel 1
+func (s *amqpSession) connect() (r *bufio.Reader, err error) {
+	o := s.output
+	conn, err := net.DialTimeout("tcp", o.address, o.config.Timeout)
+	if err != nil {
+		return
+	}
+	s.lock.Lock()
+	s.conn = conn
+	s.lock.Unlock()
+	select {
+	case <-s.done:
+		// closed while dialing
+		conn.Close()
+		return nil, errors.New("session closed")
+	default:
+	}
+	conn.SetDeadline(time.Now().Add(o.config.Timeout))
+	r = bufio.NewReader(conn)
+	if err = s.write([]byte(proto.AMQPProtocolHeader)); err != nil {
+		return
+	}
+	if _, err = readAMQPMethod(r, proto.AMQPConnection, proto.AMQPConnectionStart); err != nil {
+		return
+	}
+	// empty client properties
+	args := proto.AppendAMQPShortString([]byte{0, 0, 0, 0}, "PLAIN")
+	args = proto.AppendAMQPLongString(args, "\x00"+o.config.User+"\x00"+o.config.Password)
+	args = proto.AppendAMQPShortString(args, "en_US")
+	if err = s.write(proto.AppendAMQPMethod(nil, 0, proto.AMQPConnection, proto.AMQPConnectionStartOk, args)); err != nil {
+		return
+	}
+	tune, err := readAMQPMethod(r, proto.AMQPConnection, proto.AMQPConnectionTune)
+	if err != nil {
+		return
+	}
+	if len(tune) < 8 {
+		return nil, errors.New("invalid amqp connection.tune")
+	}
+	s.frameMax = int(binary.BigEndian.Uint32(tune[2:]))
+	if s.frameMax == 0 || s.frameMax > amqpFrameMax {
+		s.frameMax = amqpFrameMax
+	}
+	// the channel max of the broker, without heartbeats
+	args = append(append([]byte(nil), tune[:2]...), byte(s.frameMax>>24), byte(s.frameMax>>16), byte(s.frameMax>>8), byte(s.frameMax), 0, 0)
+	if err = s.write(proto.AppendAMQPMethod(nil, 0, proto.AMQPConnection, proto.AMQPConnectionTuneOk, args)); err != nil {
+		return
+	}
+	args = append(proto.AppendAMQPShortString(nil, o.config.VHost), 0, 0)
+	if err = s.write(proto.AppendAMQPMethod(nil, 0, proto.AMQPConnection, proto.AMQPConnectionOpen, args)); err != nil {
+		return
+	}
+	if _, err = readAMQPMethod(r, proto.AMQPConnection, proto.AMQPConnectionOpenOk); err != nil {
+		return
+	}
+	if err = s.write(proto.AppendAMQPMethod(nil, 1, proto.AMQPChannel, proto.AMQPChannelOpen, []byte{0})); err != nil {
+		return
+	}
+	if _, err = readAMQPMethod(r, proto.AMQPChannel, proto.AMQPChannelOpenOk); err != nil {
+		return
+	}
+	return r, conn.SetDeadline(time.Time{})
+}
+
+// readAMQPFrame reads a frame of at most proto.AMQPMaxFrame bytes
+func readAMQPFrame(r *bufio.Reader) (typ byte, channel uint16, payload []byte, err error) {
+	header := make([]byte, 7)
+	if _, err = io.ReadFull(r, header); err != nil {
+		return
+	}
+	size := binary.BigEndian.Uint32(header[3:])
+	if size > proto.AMQPMaxFrame {
+		return 0, 0, nil, errors.New("amqp frame too large")
+	}
+	payload = make([]byte, size+1)
+	if _, err = io.ReadFull(r, payload); err != nil {
+		return
+	}
+	if payload[size] != proto.AMQPFrameEnd {
+		return 0, 0, nil, errors.New("invalid amqp frame end")
+	}
+	return header[0], binary.BigEndian.Uint16(header[1:]), payload[:size], nil
+}
+
+// readAMQPMethod reads frames until a method, it returns the arguments of the method if it is the expected one
+func readAMQPMethod(r *bufio.Reader, class, method uint16) ([]byte, error) {
+	for {
+		typ, _, payload, err := readAMQPFrame(r)
+		if err != nil {
+			return nil, err
+		}
+		if typ != proto.AMQPFrameMethod {
+			continue
+		}
+		c, m, args, ok := proto.AMQPMethod(payload)
+		switch {
+		case !ok:
+			return nil, errors.New("invalid amqp method")
+		case c == class && m == method:
+			return args, nil
+		case m == proto.AMQPConnectionClose && c == proto.AMQPConnection, m == proto.AMQPChannelClose && c == proto.AMQPChannel:
+			return nil, fmt.Errorf("closed by the broker: %s", amqpReplyText(args))
+		}
+		return nil, fmt.Errorf("unexpected amqp method %d.%d", c, m)
+	}
+}
+
+// amqpReplyText returns the reply code and text of the arguments of connection.close and channel.close
+func amqpReplyText(args []byte) string {
+	if len(args) < 2 {
+		return ""
+	}
+	text, _, _ := proto.AMQPShortString(args[2:])
+	return fmt.Sprintf("%d %s", binary.BigEndian.Uint16(args), text)
+}
+
+// receive reads the frames of the broker until it closes the connection or the channel, the session is closed
+// with the connection
+func (s *amqpSession) receive(r *bufio.Reader) {
+	defer s.close()
+	for {
+		typ, _, payload, err := readAMQPFrame(r)
+		if err != nil {
+			return
+		}
+		if typ != proto.AMQPFrameMethod {
+			continue
+		}
+		c, m, args, _ := proto.AMQPMethod(payload)
+		switch {
+		case c == proto.AMQPConnection && m == proto.AMQPConnectionClose:
+			Debug(1, fmt.Sprintf("[AMQP-OUTPUT] session %s: connection closed by the broker: %s", s.id, amqpReplyText(args)))
+			s.write(proto.AppendAMQPMethod(nil, 0, proto.AMQPConnection, proto.AMQPConnectionCloseOk, nil))
+			return
+		case c == proto.AMQPChannel && m == proto.AMQPChannelClose:
+			Debug(1, fmt.Sprintf("[AMQP-OUTPUT] session %s: channel closed by the broker: %s", s.id, amqpReplyText(args)))
+			return
+		}
+	}
+}
+
+// write sends frames to the broker
+func (s *amqpSession) write(data []byte) error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	s.conn.SetWriteDeadline(time.Now().Add(s.output.config.Timeout))
+	_, err := s.conn.Write(data)
+	return err
+}
+
+func (s *amqpSession) close() {
+	s.stop.Do(func() {
+		close(s.done)
+		s.lock.Lock()
+		if s.conn != nil {
+			s.conn.Close()
+		}
+		s.lock.Unlock()
+	})
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+)
+
+// AMQPPublishOutput publishes the requests and the responses, in the format of the payloads, to an exchange of an
+// AMQP 0-9-1 broker, with routing keys made from a template of the method, the host and the path of the requests.
+// the messages get a message-id of their UUID and type and the timestamp of the payload, and are persistent with
+// Persistent. with Confirm, the channel is in confirm mode and the acks and nacks of the broker are counted
+// without waiting for them.
+type AMQPPublishOutput struct {
+	// Keep this as first element of struct because it guarantees 64bit
+	// alignment. atomic.* functions crash on 32bit machines if operand is not
+	// aligned at 64bit. See https://github.com/golang/go/issues/599
+	published uint64
+	acked     uint64
+	nacked    uint64
+	dropped   uint64 // left queued when the connection failed once closed
+
+	address  string
+	config   *AMQPOutputConfig
+	messages chan []byte
+	queuing  sync.RWMutex // done is closed once the payloads being written are queued
+	done     chan struct{}
+	finished chan struct{}
+	stop     sync.Once
+	lock     sync.Mutex // guards session
+	session  *amqpSession
+}
+
+// NewAMQPPublishOutput constructor for AMQPPublishOutput, address is the host:port of the broker
+func NewAMQPPublishOutput(address string, config *AMQPOutputConfig) io.Writer {
+	o := new(AMQPPublishOutput)
+	o.address = address
+	o.config = config
+	if o.config.User == "" {
+		o.config.User, o.config.Password = "guest", "guest"
+	}
+	if o.config.VHost == "" {
+		o.config.VHost = "/"
+	}
+	if o.config.Timeout < time.Millisecond {
+		o.config.Timeout = 5 * time.Second
+	}
+	o.messages = make(chan []byte, 1000)
+	o.done = make(chan struct{})
+	o.finished = make(chan struct{})
+	go o.run()
+	return o
+}
+
+// Write queues the payload to be published, the payloads written after Close are refused
+func (o *AMQPPublishOutput) Write(data []byte) (n int, err error) {
+	if !isOriginPayload(data) {
+		return len(data), nil
+	}
+	o.queuing.RLock()
+	defer o.queuing.RUnlock()
+	select {
+	case <-o.done:
+		return 0, ErrorStopped
+	default:
+	}
+	// run receives the messages until done, and publishes the ones queued then
+	o.messages <- append([]byte(nil), data...)
+	return len(data), nil
+}
+
+// run connects to the broker and publishes the messages, it reconnects every second after errors. once the output
+// is closed, it finishes when the messages queued are published, they are dropped if the connection fails then
+func (o *AMQPPublishOutput) run() {
+	defer close(o.finished)
+	var pending []byte
+	for retries := 0; ; retries++ {
+		if retries > 0 {
+			select {
+			case <-o.done:
+				o.drop(pending)
+				return
+			case <-time.After(time.Second):
+			}
+		}
+		// the session holds the connection and the channel 1
+		s := &amqpSession{
+			output: &AMQPOutput{address: o.address, config: o.config},
+			id:     "publish",
+			done:   make(chan struct{}),
+		}
+		o.lock.Lock()
+		o.session = s
+		o.lock.Unlock()
+		r, err := o.connect(s)
+		if err != nil {
+			Debug(1, fmt.Sprintf("[AMQP-PUBLISH-OUTPUT] %s: %v", o.address, err))
+			s.close()
+			continue
+		}
+		go o.receive(s, r)
+		if pending, err = o.publishAll(s, pending); err != nil {
+			Debug(1, fmt.Sprintf("[AMQP-PUBLISH-OUTPUT] %s: %v", o.address, err))
+		}
+		s.close()
+		select {
+		case <-o.done:
+			if pending == nil && len(o.messages) == 0 {
+				return
+			}
+		default:
+		}
+	}
+}
+
+// drop counts the messages left, when the connection fails once the output is closed
+func (o *AMQPPublishOutput) drop(pending []byte) {
+	n := len(o.messages)
+	if pending != nil {
+		n++
+	}
+	if n > 0 {
+		atomic.AddUint64(&o.dropped, uint64(n))
+		Debug(1, fmt.Sprintf("[AMQP-PUBLISH-OUTPUT] %s: %d messages dropped on close", o.address, n))
+	}
+}
+
+// connect opens the connection and the channel, in confirm mode with Confirm
+func (o *AMQPPublishOutput) connect(s *amqpSession) (r *bufio.Reader, err error) {
+	if r, err = s.connect(); err != nil || !o.config.Confirm {
+		return
+	}
+	// no nowait
+	if err = s.write(proto.AppendAMQPMethod(nil, 1, proto.AMQPConfirm, proto.AMQPConfirmSelect, []byte{0})); err != nil {
+		return
+	}
+	s.conn.SetReadDeadline(time.Now().Add(o.config.Timeout))
+	if _, err = readAMQPMethod(r, proto.AMQPConfirm, proto.AMQPConfirmSelectOk); err != nil {
+		return
+	}
+	return r, s.conn.SetReadDeadline(time.Time{})
+}
+
+// publishAll publishes the messages until the output is closed and the messages queued are published, the
+// session is closed, or a write fails. it returns the message that failed to be retried on the next connection
+func (o *AMQPPublishOutput) publishAll(s *amqpSession, pending []byte) ([]byte, error) {
+	for {
+		data := pending
+		if data == nil {
+			select {
+			case data = <-o.messages:
+			case <-s.done:
+				return nil, nil
+			case <-o.done:
+				select {
+				case data = <-o.messages:
+				default:
+					return nil, nil
+				}
+			}
+		}
+		p := proto.AMQPPublishCommand{
+			Channel:    1,
+			Exchange:   o.config.Exchange,
+			RoutingKey: payloadKey(o.config.RoutingKey, data),
+			Properties: amqpPublishProperties(data, o.config.Persistent),
+			Body:       data,
+		}
+		if err := s.write(proto.AppendAMQPPublish(nil, p, s.frameMax)); err != nil {
+			return data, err
+		}
+		pending = nil
+		atomic.AddUint64(&o.published, 1)
+	}
+}
+
+// amqpPublishProperties returns the property flags and list of the message of the payload: its delivery-mode,
+// its message-id and its timestamp, in seconds, and the app-id goreplay
+func amqpPublishProperties(data []byte, persistent bool) []byte {
+	const (
+		deliveryMode = 0x1000
+		messageID    = 0x0080
+		timestamp    = 0x0040
+		appID        = 0x0008
+	)
+	meta := payloadMeta(data)
+	flags := uint16(appID)
+	var properties []byte
+	if persistent {
+		flags |= deliveryMode
+		properties = append(properties, 2)
+	}
+	if len(meta) > 1 {
+		flags |= messageID
+		properties = proto.AppendAMQPShortString(properties, string(meta[1])+"-"+string(meta[0]))
+	}
+	if len(meta) > 2 {
+		if ts, err := strconv.ParseInt(string(meta[2]), 10, 64); err == nil {
+			flags |= timestamp
+			properties = append(properties, 0, 0, 0, 0, 0, 0, 0, 0)
+			binary.BigEndian.PutUint64(properties[len(properties)-8:], uint64(time.Duration(ts)/time.Second))
+		}
+	}
+	properties = proto.AppendAMQPShortString(properties, "goreplay")
+	return append([]byte{byte(flags >> 8), byte(flags)}, properties...)
+}
+
+// receive reads the frames of the broker until it closes the connection or the channel, it counts the acks and
+// the nacks of the published messages
+func (o *AMQPPublishOutput) receive(s *amqpSession, r *bufio.Reader) {
+	defer s.close()
+	var confirmed uint64 // the last delivery tag confirmed
+	for {
+		typ, _, payload, err := readAMQPFrame(r)
+		if err != nil {
+			return
+		}
+		if typ != proto.AMQPFrameMethod {
+			continue
+		}
+		c, m, args, _ := proto.AMQPMethod(payload)
+		switch {
+		case c == proto.AMQPConnection && m == proto.AMQPConnectionClose:
+			Debug(1, fmt.Sprintf("[AMQP-PUBLISH-OUTPUT] %s: connection closed by the broker: %s", o.address, amqpReplyText(args)))
+			s.write(proto.AppendAMQPMethod(nil, 0, proto.AMQPConnection, proto.AMQPConnectionCloseOk, nil))
+			return
+		case c == proto.AMQPChannel && m == proto.AMQPChannelClose:
+			Debug(1, fmt.Sprintf("[AMQP-PUBLISH-OUTPUT] %s: channel closed by the broker: %s", o.address, amqpReplyText(args)))
+			return
+		case c == proto.AMQPBasic && (m == proto.AMQPBasicAck || m == proto.AMQPBasicNack) && len(args) >= 9:
+			// the delivery tag, then the multiple bit
+			tag := binary.BigEndian.Uint64(args)
+			n := uint64(1)
+			if args[8]&0x01 != 0 && tag > confirmed {
+				n = tag - confirmed
+			}
+			if tag > confirmed {
+				confirmed = tag
+			}
+			if m == proto.AMQPBasicAck {
+				atomic.AddUint64(&o.acked, n)
+			} else {
+				atomic.AddUint64(&o.nacked, n)
+				Debug(1, fmt.Sprintf("[AMQP-PUBLISH-OUTPUT] %s: %d messages nacked by the broker", o.address, n))
+			}
+		}
+	}
+}
+
+func (o *AMQPPublishOutput) String() string {
+	return fmt.Sprintf("AMQP publish output: %s, published: %d, acked: %d, nacked: %d, dropped: %d", o.address,
+		atomic.LoadUint64(&o.published), atomic.LoadUint64(&o.acked), atomic.LoadUint64(&o.nacked), atomic.LoadUint64(&o.dropped))
+}
+
+// Close publishes the messages queued, waiting for Timeout at most, and closes the connection
+func (o *AMQPPublishOutput) Close() error {
+	o.stop.Do(func() {
+		o.queuing.Lock()
+		close(o.done)
+		o.queuing.Unlock()
+		select {
+		case <-o.finished:
+		case <-time.After(o.config.Timeout):
+		}
+		o.lock.Lock()
+		if o.session != nil {
+			o.session.close()
+		}
+		o.lock.Unlock()
+	})
+	return nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+)
+
+func TestAMQPPublishOutput(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	published := make(chan proto.AMQPPublishCommand, 20)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		header := make([]byte, 8)
+		if _, err := io.ReadFull(reader, header); err != nil || string(header) != proto.AMQPProtocolHeader {
+			return
+		}
+		conn.Write(proto.AppendAMQPMethod(nil, 0, proto.AMQPConnection, proto.AMQPConnectionStart, []byte{0, 9}))
+		var command []byte
+		var tag uint64
+		for {
+			typ, channel, payload, err := readAMQPFrame(reader)
+			if err != nil {
+				return
+			}
+			class, method, _, _ := proto.AMQPMethod(payload)
+			switch {
+			case typ != proto.AMQPFrameMethod:
+			case class == proto.AMQPConnection && method == proto.AMQPConnectionStartOk:
+				conn.Write(proto.AppendAMQPMethod(nil, 0, proto.AMQPConnection, proto.AMQPConnectionTune, []byte{0x07, 0xff, 0, 2, 0, 0, 0, 60}))
+			case class == proto.AMQPConnection && method == proto.AMQPConnectionOpen:
+				conn.Write(proto.AppendAMQPMethod(nil, 0, proto.AMQPConnection, proto.AMQPConnectionOpenOk, []byte{0}))
+			case class == proto.AMQPChannel && method == proto.AMQPChannelOpen:
+				conn.Write(proto.AppendAMQPMethod(nil, channel, proto.AMQPChannel, proto.AMQPChannelOpenOk, []byte{0, 0, 0, 0}))
+			case class == proto.AMQPConfirm && method == proto.AMQPConfirmSelect:
+				conn.Write(proto.AppendAMQPMethod(nil, channel, proto.AMQPConfirm, proto.AMQPConfirmSelectOk, nil))
+			}
+			if typ == proto.AMQPFrameMethod && class != proto.AMQPBasic {
+				continue
+			}
+			command = proto.AppendAMQPFrame(command, typ, channel, payload)
+			if p, ok := proto.ParseAMQPPublish(command); ok {
+				published <- p
+				command = nil
+				// the first message is acked, the second nacked
+				tag++
+				ack := make([]byte, 9)
+				binary.BigEndian.PutUint64(ack, tag)
+				if tag == 1 {
+					conn.Write(proto.AppendAMQPMethod(nil, channel, proto.AMQPBasic, proto.AMQPBasicAck, ack))
+				} else {
+					conn.Write(proto.AppendAMQPMethod(nil, channel, proto.AMQPBasic, proto.AMQPBasicNack, append(ack, 0)))
+				}
+			}
+		}
+	}()
+
+	output := NewAMQPPublishOutput(ln.Addr().String(), &AMQPOutputConfig{
+		Exchange:   "goreplay",
+		RoutingKey: "http.{method}.{path}",
+		Persistent: true,
+		Confirm:    true,
+	})
+	defer output.(*AMQPPublishOutput).Close()
+	request := []byte("1 a1b2 1500000000000000000 -1\nGET /users/42 HTTP/1.1\r\n\r\n")
+	response := []byte("2 a1b2 1500000000000000000 10\nHTTP/1.1 200 OK\r\n\r\n")
+	output.Write(request)
+	output.Write(response)
+
+	expected := []struct {
+		data []byte
+		key  string
+		id   string
+	}{
+		{request, "http.GET.users.42", "a1b2-1"},
+		{response, "http._._", "a1b2-2"},
+	}
+	for _, e := range expected {
+		var p proto.AMQPPublishCommand
+		select {
+		case p = <-published:
+		case <-time.After(time.Second):
+			t.Fatal("expected a message to be published")
+		}
+		if p.Exchange != "goreplay" || p.RoutingKey != e.key || !bytes.Equal(p.Body, e.data) {
+			t.Errorf("expected %q to be published to goreplay with %q, got %q to %q with %q", e.data, e.key, p.Body, p.Exchange, p.RoutingKey)
+		}
+		// delivery-mode, message-id, timestamp and app-id
+		properties := append([]byte{0x10, 0xc8, 2}, proto.AppendAMQPShortString(nil, e.id)...)
+		properties = append(properties, 0, 0, 0, 0, 0x59, 0x68, 0x2f, 0)
+		properties = proto.AppendAMQPShortString(properties, "goreplay")
+		if !bytes.Equal(p.Properties, properties) {
+			t.Errorf("expected properties %x, got %x", properties, p.Properties)
+		}
+	}
+
+	o := output.(*AMQPPublishOutput)
+	for i := 0; i < 100 && atomic.LoadUint64(&o.acked)+atomic.LoadUint64(&o.nacked) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if atomic.LoadUint64(&o.acked) != 1 || atomic.LoadUint64(&o.nacked) != 1 {
+		t.Errorf("expected an ack and a nack, got %s", o)
+	}
+
+	queued := []byte("1 c3d4 1500000000000000000 -1\nGET / HTTP/1.1\r\n\r\n")
+	o.Write(queued)
+	o.Close()
+	select {
+	case p := <-published:
+		if !bytes.Equal(p.Body, queued) {
+			t.Errorf("expected %q to be published on Close, got %q", queued, p.Body)
+		}
+	case <-time.After(time.Second):
+		t.Error("expected the message queued to be published on Close")
+	}
+	if n, err := o.Write(queued); n != 0 || err != ErrorStopped {
+		t.Errorf("expected the payload written after Close to be refused, got %d %v", n, err)
+	}
+}
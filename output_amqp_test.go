@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+)
+
+func TestAMQPOutput(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	frames := make(chan []byte, 20)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		header := make([]byte, 8)
+		if _, err := io.ReadFull(reader, header); err != nil || string(header) != proto.AMQPProtocolHeader {
+			return
+		}
+		conn.Write(proto.AppendAMQPMethod(nil, 0, proto.AMQPConnection, proto.AMQPConnectionStart, []byte{0, 9}))
+		for {
+			typ, channel, payload, err := readAMQPFrame(reader)
+			if err != nil {
+				return
+			}
+			frames <- proto.AppendAMQPFrame(nil, typ, channel, payload)
+			class, method, _, _ := proto.AMQPMethod(payload)
+			switch {
+			case typ != proto.AMQPFrameMethod:
+			case class == proto.AMQPConnection && method == proto.AMQPConnectionStartOk:
+				// channel max 2047, frame max 24, heartbeat 60s
+				conn.Write(proto.AppendAMQPMethod(nil, 0, proto.AMQPConnection, proto.AMQPConnectionTune, []byte{0x07, 0xff, 0, 0, 0, 24, 0, 60}))
+			case class == proto.AMQPConnection && method == proto.AMQPConnectionOpen:
+				conn.Write(proto.AppendAMQPMethod(nil, 0, proto.AMQPConnection, proto.AMQPConnectionOpenOk, []byte{0}))
+			case class == proto.AMQPChannel && method == proto.AMQPChannelOpen:
+				conn.Write(proto.AppendAMQPMethod(nil, channel, proto.AMQPChannel, proto.AMQPChannelOpenOk, []byte{0, 0, 0, 0}))
+			}
+		}
+	}()
+
+	output := NewAMQPOutput(ln.Addr().String(), &AMQPOutputConfig{User: "replay", Password: "secret", VHost: "staging"})
+	defer output.(*AMQPOutput).Close()
+	start := time.Now().UnixNano()
+	publish := proto.AMQPPublishCommand{Channel: 5, Exchange: "orders", RoutingKey: "created", Body: []byte("{\"id\":12345}")}
+	output.Write(append(payloadHeader(RequestPayload, []byte("a1b2"), start, 0), proto.AppendAMQPPublish(nil, publish, 0)...))
+
+	startOk := proto.AppendAMQPShortString([]byte{0, 0, 0, 0}, "PLAIN")
+	startOk = proto.AppendAMQPLongString(startOk, "\x00replay\x00secret")
+	startOk = proto.AppendAMQPShortString(startOk, "en_US")
+	expected := [][]byte{
+		proto.AppendAMQPMethod(nil, 0, proto.AMQPConnection, proto.AMQPConnectionStartOk, startOk),
+		// the frame max of the broker, without heartbeats
+		proto.AppendAMQPMethod(nil, 0, proto.AMQPConnection, proto.AMQPConnectionTuneOk, []byte{0x07, 0xff, 0, 0, 0, 24, 0, 0}),
+		proto.AppendAMQPMethod(nil, 0, proto.AMQPConnection, proto.AMQPConnectionOpen, []byte{7, 's', 't', 'a', 'g', 'i', 'n', 'g', 0, 0}),
+		proto.AppendAMQPMethod(nil, 1, proto.AMQPChannel, proto.AMQPChannelOpen, []byte{0}),
+	}
+	// the command is published on the channel 1, in frames of at most 24 bytes
+	publish.Channel = 1
+	for rest := proto.AppendAMQPPublish(nil, publish, 24); len(rest) > 0; {
+		_, _, _, n := proto.AMQPFrame(rest)
+		expected = append(expected, rest[:n])
+		rest = rest[n:]
+	}
+	if len(expected) != 7 {
+		t.Fatalf("expected the body to be split in 2 frames, got %d frames", len(expected)-4)
+	}
+	for i := range expected {
+		select {
+		case got := <-frames:
+			if !bytes.Equal(got, expected[i]) {
+				t.Errorf("expected %q, got %q", expected[i], got)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("expected %d frames, got %d", len(expected), i)
+		}
+	}
+}
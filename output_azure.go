@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/buger/goreplay/size"
+)
+
+// the version of the Blob service API, the managed identities need 2017-11-09 at least
+const azureStorageVersion = "2020-04-08"
+
+// the token endpoint of the managed identities of the Azure Instance Metadata Service
+var azureIMDSTokenURL = "http://169.254.169.254/metadata/identity/oauth2/token"
+
+// AzureOutputConfig is the configuration of the uploads of the file output to Azure Blob Storage
+type AzureOutputConfig struct {
+	SAS        string    `json:"output-file-azure-sas"`
+	ClientID   string    `json:"output-file-azure-client-id"` // the user-assigned managed identity
+	BlockSize  size.Size `json:"output-file-azure-block-size"`
+	MaxRetries int       `json:"output-file-azure-max-retries"`
+}
+
+// AzureOutput output plugin. like the S3 output, the payloads are written to a buffer file with the chunking and
+// the rotation of the file output, and each file is uploaded to a block blob when it is closed, in blocks of
+// BlockSize committed at once. each request is retried MaxRetries times. the requests are authorized by the SAS
+// token of the URL or of SAS, or else by the tokens of the managed identity of the Instance Metadata Service
+type AzureOutput struct {
+	// Keep this as first element of struct because it guarantees 64bit
+	// alignment. atomic.* functions crash on 32bit machines if operand is not
+	// aligned at 64bit. See https://github.com/golang/go/issues/599
+	uploaded int64
+	failed   int64
+
+	pathTemplate string
+	blobURL      *url.URL // the URL of the template, without the SAS
+
+	buffer  *FileOutput
+	config  *FileOutputConfig
+	client  *http.Client
+	closeCh chan struct{}
+
+	mu          sync.Mutex
+	token       string // the access token of the managed identity
+	tokenExpiry time.Time
+}
+
+// NewAzureOutput constructor for AzureOutput, accepts the URL of the blob,
+// https://<account>.blob.core.windows.net/<container>/<blob>
+func NewAzureOutput(pathTemplate string, config *FileOutputConfig) *AzureOutput {
+	o := new(AzureOutput)
+	o.pathTemplate = pathTemplate
+	u, err := url.Parse(pathTemplate)
+	if err != nil || u.Host == "" || strings.Count(strings.Trim(u.Path, "/"), "/") < 1 {
+		log.Fatalf("output-file: invalid Azure blob URL %q, expected https://<account>.blob.core.windows.net/<container>/<blob>", pathTemplate)
+	}
+	// the config is copied, the callback of the buffer is the one of this output
+	c := *config
+	o.config = &c
+	o.config.onClose = o.onBufferUpdate
+	if u.RawQuery != "" && o.config.Azure.SAS == "" {
+		o.config.Azure.SAS = u.RawQuery
+	}
+	o.config.Azure.SAS = strings.TrimPrefix(o.config.Azure.SAS, "?")
+	u.RawQuery = ""
+	o.blobURL = u
+
+	if o.config.BufferPath == "" {
+		o.config.BufferPath = "/tmp"
+	}
+	if o.config.Azure.BlockSize <= 0 || o.config.Azure.BlockSize > 4000<<20 {
+		o.config.Azure.BlockSize = 4 << 20
+	}
+	if o.config.Azure.MaxRetries < 0 {
+		o.config.Azure.MaxRetries = 0
+	}
+	o.client = &http.Client{Timeout: 5 * time.Minute}
+
+	bufferName := fmt.Sprintf("gor_output_azure_%d_buf_", rand.Int63())
+	bufferName += filepath.Base(u.Path)
+	if strings.HasSuffix(u.Path, ".gz") {
+		bufferName += ".gz"
+	} else if strings.HasSuffix(u.Path, ".zst") {
+		bufferName += ".zst"
+	}
+
+	o.buffer = NewFileOutput(filepath.Join(o.config.BufferPath, bufferName), o.config)
+
+	return o
+}
+
+func (o *AzureOutput) Write(data []byte) (n int, err error) {
+	return o.buffer.Write(data)
+}
+
+func (o *AzureOutput) String() string {
+	return fmt.Sprintf("Azure output: %s, uploaded: %d, failed: %d", o.blobURL,
+		atomic.LoadInt64(&o.uploaded), atomic.LoadInt64(&o.failed))
+}
+
+// Close closes the buffer, uploading it
+func (o *AzureOutput) Close() error {
+	return o.buffer.Close()
+}
+
+// keyPath returns the URL of the blob of the buffer, with the SAS
+func (o *AzureOutput) keyPath(idx int) string {
+	u := *o.blobURL
+	for name, fn := range dateFileNameFuncs {
+		u.Path = strings.Replace(u.Path, name, fn(o.buffer), -1)
+	}
+	// the buffers of the appending outputs have no index
+	if idx != -1 {
+		u.Path = setFileIndex(u.Path, idx)
+	}
+	u.RawPath = ""
+	u.RawQuery = o.config.Azure.SAS
+	return u.String()
+}
+
+func (o *AzureOutput) onBufferUpdate(path string) {
+	defer os.Remove(path)
+	blob := o.keyPath(getFileIndex(path))
+
+	if err := o.upload(path, blob); err != nil {
+		atomic.AddInt64(&o.failed, 1)
+		log.Printf("[Azure Output] Failed to upload data to %s, %s\n", strings.SplitN(blob, "?", 2)[0], err)
+		return
+	}
+	atomic.AddInt64(&o.uploaded, 1)
+	Debug(2, fmt.Sprintf("[AZURE-OUTPUT] uploaded %s", strings.SplitN(blob, "?", 2)[0]))
+
+	if o.closeCh != nil {
+		o.closeCh <- struct{}{}
+	}
+}
+
+// upload uploads the file to the block blob, with a single request if it fits a block, or else with a request per
+// block and a request committing the list of the blocks
+func (o *AzureOutput) upload(path, blob string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	block := make([]byte, o.config.Azure.BlockSize)
+	if stat.Size() <= int64(len(block)) {
+		n, err := io.ReadFull(file, block)
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return err
+		}
+		return o.put(blob, "", block[:n], http.Header{"X-Ms-Blob-Type": {"BlockBlob"}})
+	}
+
+	var list bytes.Buffer
+	list.WriteString(`<?xml version="1.0" encoding="utf-8"?><BlockList>`)
+	for i := 0; ; i++ {
+		n, err := io.ReadFull(file, block)
+		if n > 0 {
+			// the IDs of the blocks of a blob have the same length
+			id := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%08d", i)))
+			if err := o.put(blob, "comp=block&blockid="+url.QueryEscape(id), block[:n], nil); err != nil {
+				return err
+			}
+			list.WriteString("<Latest>" + id + "</Latest>")
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	list.WriteString("</BlockList>")
+	return o.put(blob, "comp=blocklist", list.Bytes(), nil)
+}
+
+// put sends a PUT request to the blob, the requests failing with a retryable status are retried with a backoff of
+// 100ms doubled on each retry up to 5s
+func (o *AzureOutput) put(blob, query string, body []byte, header http.Header) error {
+	if query != "" {
+		if strings.Contains(blob, "?") {
+			blob += "&" + query
+		} else {
+			blob += "?" + query
+		}
+	}
+	for retry := 1; ; retry++ {
+		retryable, err := o.send(blob, body, header)
+		if err == nil || !retryable || retry > o.config.Azure.MaxRetries {
+			return err
+		}
+		Debug(1, fmt.Sprintf("[AZURE-OUTPUT] retrying the upload: %v", err))
+		backoff := time.Duration(100<<uint(retry-1)) * time.Millisecond
+		if backoff > 5*time.Second {
+			backoff = 5 * time.Second
+		}
+		time.Sleep(backoff)
+	}
+}
+
+// send sends a PUT request, it reports whether the request can be retried on errors
+func (o *AzureOutput) send(blob string, body []byte, header http.Header) (retryable bool, err error) {
+	req, err := http.NewRequest(http.MethodPut, blob, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("X-Ms-Version", azureStorageVersion)
+	req.Header.Set("X-Ms-Date", time.Now().UTC().Format(http.TimeFormat))
+	if o.config.Azure.SAS == "" {
+		token, err := o.accessToken()
+		if err != nil {
+			return true, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	switch resp.StatusCode {
+	case http.StatusCreated:
+		return false, nil
+	case http.StatusUnauthorized:
+		// the token is requested again
+		o.mu.Lock()
+		o.token = ""
+		o.mu.Unlock()
+		return true, fmt.Errorf("status %d: %s", resp.StatusCode, bytes.TrimSpace(respBody))
+	case http.StatusRequestTimeout, http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true, fmt.Errorf("status %d: %s", resp.StatusCode, bytes.TrimSpace(respBody))
+	}
+	return false, fmt.Errorf("status %d: %s", resp.StatusCode, bytes.TrimSpace(respBody))
+}
+
+// accessToken returns the access token of the managed identity, of ClientID with a user-assigned identity. it is
+// requested again a minute before it expires
+func (o *AzureOutput) accessToken() (string, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.token != "" && time.Now().Before(o.tokenExpiry) {
+		return o.token, nil
+	}
+	query := url.Values{"api-version": {"2018-02-01"}, "resource": {"https://storage.azure.com/"}}
+	if o.config.Azure.ClientID != "" {
+		query.Set("client_id", o.config.Azure.ClientID)
+	}
+	req, _ := http.NewRequest(http.MethodGet, azureIMDSTokenURL+"?"+query.Encode(), nil)
+	req.Header.Set("Metadata", "true")
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	// the expiration of the tokens of the metadata service is a string
+	var token struct {
+		AccessToken string      `json:"access_token"`
+		ExpiresIn   json.Number `json:"expires_in"`
+	}
+	if resp.StatusCode != http.StatusOK || json.Unmarshal(body, &token) != nil || token.AccessToken == "" {
+		return "", fmt.Errorf("token request failed with status %d: %s", resp.StatusCode, bytes.TrimSpace(body))
+	}
+	expiresIn, _ := token.ExpiresIn.Int64()
+	if expiresIn <= 0 {
+		expiresIn = 3600
+	}
+	o.token = token.AccessToken
+	o.tokenExpiry = time.Now().Add(time.Duration(expiresIn)*time.Second - time.Minute)
+	return o.token, nil
+}
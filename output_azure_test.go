@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAzureOutputBlocks(t *testing.T) {
+	var mu sync.Mutex
+	blocks := make(map[string][]byte)
+	var blob []byte
+	failed := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.Method != http.MethodPut || r.URL.Path != "/logs/requests.gor" || r.URL.Query().Get("sig") != "secret" ||
+			r.Header.Get("Authorization") != "" || r.Header.Get("X-Ms-Version") == "" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		switch r.URL.Query().Get("comp") {
+		case "block":
+			// the first block fails once
+			if !failed {
+				failed = true
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			blocks[r.URL.Query().Get("blockid")] = body
+		case "blocklist":
+			for _, latest := range strings.Split(string(body), "<Latest>")[1:] {
+				blob = append(blob, blocks[strings.Split(latest, "</Latest>")[0]]...)
+			}
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	o := NewAzureOutput(server.URL+"/logs/requests.gor?sv=2020-08-04&sig=secret", &FileOutputConfig{
+		Append:        true,
+		FlushInterval: time.Minute,
+		Azure:         AzureOutputConfig{BlockSize: 1000, MaxRetries: 1},
+	})
+	payload := []byte("1 1 1\n" + strings.Repeat("a", 2500))
+	o.Write(payload)
+	o.Close()
+
+	if len(blocks) != 3 {
+		t.Errorf("expected 3 blocks, got %d", len(blocks))
+	}
+	if !bytes.Equal(blob, append(payload, payloadSeparator...)) {
+		t.Errorf("unexpected blob of %d bytes", len(blob))
+	}
+	if _, ok := blocks[base64.StdEncoding.EncodeToString([]byte("00000002"))]; !ok || o.uploaded != 1 {
+		t.Errorf("expected the blob to be uploaded, got %s", o)
+	}
+}
+
+func TestAzureOutputManagedIdentity(t *testing.T) {
+	var blob []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/metadata/identity/oauth2/token":
+			if r.Header.Get("Metadata") != "true" || r.URL.Query().Get("client_id") != "identity" ||
+				r.URL.Query().Get("resource") != "https://storage.azure.com/" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.Write([]byte(`{"access_token":"token","expires_in":"3599","token_type":"Bearer"}`))
+		case "/logs/requests_0.gor":
+			if r.Header.Get("Authorization") != "Bearer token" || r.Header.Get("X-Ms-Blob-Type") != "BlockBlob" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			blob, _ = ioutil.ReadAll(r.Body)
+			w.WriteHeader(http.StatusCreated)
+		}
+	}))
+	defer server.Close()
+	defer func(url string) { azureIMDSTokenURL = url }(azureIMDSTokenURL)
+	azureIMDSTokenURL = server.URL + "/metadata/identity/oauth2/token"
+
+	o := NewAzureOutput(server.URL+"/logs/requests.gor", &FileOutputConfig{
+		FlushInterval: time.Minute,
+		Azure:         AzureOutputConfig{ClientID: "identity"},
+	})
+	o.Write([]byte("1 1 1\nGET / HTTP/1.1\r\n\r\n"))
+	o.Close()
+
+	if string(blob) != "1 1 1\nGET / HTTP/1.1\r\n\r\n"+payloadSeparator || o.uploaded != 1 {
+		t.Errorf("expected the blob to be uploaded, got %q %s", blob, o)
+	}
+}
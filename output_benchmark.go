@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// benchmarkMaxSamples bounds the latencies kept per interval, the later ones replace random ones
+const benchmarkMaxSamples = 100000
+
+// BenchmarkOutput drops the payloads like NullOutput, and reports every interval the throughput of the pipeline
+// in payloads and bytes per second, the latency from the capture of the payloads to the output, and the
+// allocations of the process. the latency is only meaningful for live inputs, the payloads of --input-file have
+// their recorded timestamps. a summary of the whole run is reported on Close.
+type BenchmarkOutput struct {
+	sync.Mutex
+	interval time.Duration
+	start    time.Time
+	total    benchmarkStats
+	current  benchmarkStats
+	memStats runtime.MemStats // at the start of the current interval
+	startMem runtime.MemStats
+	done     chan struct{}
+	stop     sync.Once
+	rand     uint32
+}
+
+type benchmarkStats struct {
+	start     time.Time
+	payloads  int64
+	requests  int64
+	responses int64
+	bytes     int64
+	seen      int64 // latencies seen, some are not kept past benchmarkMaxSamples
+	latencies []time.Duration
+}
+
+// NewBenchmarkOutput constructor for BenchmarkOutput, reporting every interval
+func NewBenchmarkOutput(interval time.Duration) *BenchmarkOutput {
+	o := new(BenchmarkOutput)
+	o.interval = interval
+	if o.interval <= 0 {
+		o.interval = 5 * time.Second
+	}
+	o.start = time.Now()
+	o.total.start = o.start
+	o.current.start = o.start
+	o.rand = uint32(o.start.UnixNano()) | 1
+	runtime.ReadMemStats(&o.startMem)
+	o.memStats = o.startMem
+	o.done = make(chan struct{})
+	go o.report()
+	return o
+}
+
+func (o *BenchmarkOutput) Write(data []byte) (int, error) {
+	now := time.Now()
+	var latency time.Duration
+	meta := payloadMeta(data)
+	if len(meta) > 2 {
+		if ts, err := strconv.ParseInt(string(meta[2]), 10, 64); err == nil && ts > 0 {
+			latency = now.Sub(time.Unix(0, ts))
+		}
+	}
+	o.Lock()
+	for _, s := range []*benchmarkStats{&o.total, &o.current} {
+		s.payloads++
+		s.bytes += int64(len(data))
+		switch {
+		case isRequestPayload(data):
+			s.requests++
+		case len(data) > 0 && data[0] == ResponsePayload:
+			s.responses++
+		}
+		if latency > 0 {
+			o.sample(s, latency)
+		}
+	}
+	o.Unlock()
+	return len(data), nil
+}
+
+// sample keeps the latency, or replaces a random latency kept with it once there are benchmarkMaxSamples of
+// them, so that the latencies kept are a uniform sample of the ones seen
+func (o *BenchmarkOutput) sample(s *benchmarkStats, latency time.Duration) {
+	s.seen++
+	if len(s.latencies) < benchmarkMaxSamples {
+		s.latencies = append(s.latencies, latency)
+		return
+	}
+	// xorshift
+	o.rand ^= o.rand << 13
+	o.rand ^= o.rand >> 17
+	o.rand ^= o.rand << 5
+	if i := int64(o.rand) % s.seen; i < benchmarkMaxSamples {
+		s.latencies[i] = latency
+	}
+}
+
+func (o *BenchmarkOutput) report() {
+	ticker := time.NewTicker(o.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			o.Lock()
+			current := o.current
+			o.current = benchmarkStats{start: time.Now()}
+			o.Unlock()
+			var mem runtime.MemStats
+			runtime.ReadMemStats(&mem)
+			log.Printf("[BENCHMARK] %s", current.format(time.Now(), &o.memStats, &mem))
+			o.memStats = mem
+		case <-o.done:
+			return
+		}
+	}
+}
+
+// format returns the report of the stats until now, with the allocations between the two memory stats
+func (s *benchmarkStats) format(now time.Time, before, after *runtime.MemStats) string {
+	elapsed := now.Sub(s.start).Seconds()
+	if elapsed <= 0 {
+		elapsed = 1
+	}
+	report := fmt.Sprintf("%d payloads (%d requests, %d responses), %.1f payloads/s, %.2f MB/s",
+		s.payloads, s.requests, s.responses, float64(s.payloads)/elapsed, float64(s.bytes)/elapsed/(1<<20))
+	if len(s.latencies) > 0 {
+		sort.Slice(s.latencies, func(i, j int) bool { return s.latencies[i] < s.latencies[j] })
+		percentile := func(p float64) time.Duration {
+			return s.latencies[int(p*float64(len(s.latencies)-1))]
+		}
+		report += fmt.Sprintf(", latency p50 %s p90 %s p99 %s max %s", percentile(0.5), percentile(0.9),
+			percentile(0.99), s.latencies[len(s.latencies)-1])
+	}
+	mallocs := after.Mallocs - before.Mallocs
+	report += fmt.Sprintf(", %.0f allocs/s, %.2f MB/s allocated, heap %.1f MB, %d GC",
+		float64(mallocs)/elapsed, float64(after.TotalAlloc-before.TotalAlloc)/elapsed/(1<<20),
+		float64(after.HeapAlloc)/(1<<20), after.NumGC-before.NumGC)
+	if s.payloads > 0 {
+		report += fmt.Sprintf(", %.1f allocs/payload", float64(mallocs)/float64(s.payloads))
+	}
+	return report
+}
+
+func (o *BenchmarkOutput) String() string {
+	o.Lock()
+	defer o.Unlock()
+	return fmt.Sprintf("Benchmark output: %d payloads, %d bytes", o.total.payloads, o.total.bytes)
+}
+
+// Close stops the reports and reports the whole run
+func (o *BenchmarkOutput) Close() error {
+	o.stop.Do(func() {
+		close(o.done)
+		var mem runtime.MemStats
+		runtime.ReadMemStats(&mem)
+		o.Lock()
+		defer o.Unlock()
+		log.Printf("[BENCHMARK] total: %s", o.total.format(time.Now(), &o.startMem, &mem))
+	})
+	return nil
+}
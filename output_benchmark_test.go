@@ -0,0 +1,67 @@
+package main
+
+import (
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBenchmarkOutput(t *testing.T) {
+	output := NewBenchmarkOutput(time.Hour)
+	defer output.Close()
+
+	ts := strconv.FormatInt(time.Now().Add(-10*time.Millisecond).UnixNano(), 10)
+	output.Write([]byte("1 a1 " + ts + " 0\nGET / HTTP/1.1\r\n\r\n"))
+	output.Write([]byte("2 a1 " + ts + " 1\nHTTP/1.1 200 OK\r\n\r\n"))
+	output.Write([]byte("3 a1 " + ts + " 1\nHTTP/1.1 200 OK\r\n\r\n"))
+
+	s := output.total
+	if s.payloads != 3 || s.requests != 1 || s.responses != 1 || len(s.latencies) != 3 {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+	if s.latencies[0] < 10*time.Millisecond {
+		t.Errorf("expected the latency from the capture, got %s", s.latencies[0])
+	}
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	report := s.format(s.start.Add(time.Second), &output.startMem, &mem)
+	if !strings.HasPrefix(report, "3 payloads (1 requests, 1 responses), 3.0 payloads/s") ||
+		!strings.Contains(report, "latency p50 ") || !strings.Contains(report, "allocs/payload") {
+		t.Errorf("unexpected report %q", report)
+	}
+}
+
+func TestBenchmarkOutputSample(t *testing.T) {
+	output := NewBenchmarkOutput(time.Hour)
+	defer output.Close()
+
+	var s benchmarkStats
+	for i := 0; i < 2*benchmarkMaxSamples; i++ {
+		output.sample(&s, time.Duration(i))
+	}
+	if s.seen != 2*benchmarkMaxSamples || len(s.latencies) != benchmarkMaxSamples {
+		t.Fatalf("expected %d latencies of %d, got %d of %d", benchmarkMaxSamples, 2*benchmarkMaxSamples, len(s.latencies), s.seen)
+	}
+	replaced := 0
+	for _, l := range s.latencies {
+		if l >= benchmarkMaxSamples {
+			replaced++
+		}
+	}
+	// half of the latencies kept are expected to be from the second half
+	if replaced < benchmarkMaxSamples/3 || replaced > 2*benchmarkMaxSamples/3 {
+		t.Errorf("expected about %d latencies replaced, got %d", benchmarkMaxSamples/2, replaced)
+	}
+}
+
+func BenchmarkBenchmarkOutput(b *testing.B) {
+	output := NewBenchmarkOutput(time.Hour)
+	defer output.Close()
+	data := []byte("1 a1 " + strconv.FormatInt(time.Now().UnixNano(), 10) + " 0\nGET / HTTP/1.1\r\n\r\n")
+	for i := 0; i < b.N; i++ {
+		output.Write(data)
+	}
+}
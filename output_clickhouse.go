@@ -0,0 +1,723 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+)
+
+// the packets and the revision of the ClickHouse native protocol spoken by the output. this revision predates the
+// LowCardinality types and the settings serialized as strings, the servers convert the sample blocks of the
+// inserts to the full types for it.
+const (
+	clickHouseRevision = 54213
+
+	clickHouseClientHello = 0
+	clickHouseClientQuery = 1
+	clickHouseClientData  = 2
+
+	clickHouseServerHello       = 0
+	clickHouseServerData        = 1
+	clickHouseServerException   = 2
+	clickHouseServerProgress    = 3
+	clickHouseServerEndOfStream = 5
+	clickHouseServerProfileInfo = 6
+	clickHouseServerTotals      = 7
+	clickHouseServerExtremes    = 8
+	clickHouseServerLog         = 10
+)
+
+// clickHouseDefaultColumns are the columns of the rows without --output-clickhouse-column, like in:
+//
+//	CREATE TABLE goreplay (
+//		timestamp DateTime64(3), id String, method LowCardinality(String), host LowCardinality(String),
+//		path String, status UInt16, request_size UInt32, response_size UInt32, latency_ms Float64
+//	) ENGINE = MergeTree ORDER BY timestamp
+var clickHouseDefaultColumns = []string{
+	"timestamp=timestamp", "id=id", "method=method", "host=host", "path=path",
+	"status=status", "request_size=request_size", "response_size=response_size", "latency_ms=latency_ms",
+}
+
+// ClickHouseOutputConfig is the configuration of the ClickHouse output
+type ClickHouseOutputConfig struct {
+	Table           string        `json:"output-clickhouse-table"`
+	Database        string        `json:"output-clickhouse-database"`
+	User            string        `json:"output-clickhouse-user"`
+	Password        string        `json:"output-clickhouse-password"`
+	Columns         MultiOption   `json:"output-clickhouse-column"` // column=source
+	Secure          bool          `json:"output-clickhouse-tls"`
+	BatchSize       int           `json:"output-clickhouse-batch-size"`
+	BatchDelay      time.Duration `json:"output-clickhouse-batch-delay"`
+	ResponseTimeout time.Duration `json:"output-clickhouse-response-timeout"`
+	Timeout         time.Duration `json:"output-clickhouse-timeout"`
+}
+
+// ClickHouseOutput inserts a row per HTTP request, with the metadata of the request and of its response, into a
+// ClickHouse table over the native protocol. the columns are filled from sources, see clickHouseValue, and their
+// values are converted to the types of the table. a row waits for the response of its request for
+// ResponseTimeout, the requests without responses are inserted without them. the rows are inserted in batches of
+// BatchSize rows, or every BatchDelay.
+type ClickHouseOutput struct {
+	// Keep this as first element of struct because it guarantees 64bit
+	// alignment. atomic.* functions crash on 32bit machines if operand is not
+	// aligned at 64bit. See https://github.com/golang/go/issues/599
+	inserted int64
+	failed   int64
+
+	address  string
+	config   *ClickHouseOutputConfig
+	columns  []string
+	sources  []string
+	messages chan []byte
+	queuing  sync.RWMutex // done is closed once the payloads being written are queued
+	done     chan struct{}
+	finished chan struct{}
+	stop     sync.Once
+
+	pending map[string]*clickHouseRow // by UUID, waiting for their responses
+	batch   [][]string
+	conn    net.Conn
+	reader  *bufio.Reader
+}
+
+type clickHouseRow struct {
+	values  []string
+	created time.Time
+}
+
+// NewClickHouseOutput constructor for ClickHouseOutput, address is the host:port of the native protocol
+func NewClickHouseOutput(address string, config *ClickHouseOutputConfig) io.Writer {
+	o := new(ClickHouseOutput)
+	o.address = address
+	o.config = config
+	if o.config.Table == "" {
+		o.config.Table = "goreplay"
+	}
+	if o.config.User == "" {
+		o.config.User = "default"
+	}
+	columns := []string(o.config.Columns)
+	if len(columns) == 0 {
+		columns = clickHouseDefaultColumns
+	}
+	for _, c := range columns {
+		i := strings.IndexByte(c, '=')
+		if i <= 0 || !isClickHouseSource(c[i+1:]) {
+			log.Fatalf("output-clickhouse: invalid column %q, expected column=source", c)
+		}
+		o.columns = append(o.columns, c[:i])
+		o.sources = append(o.sources, c[i+1:])
+	}
+	if o.config.BatchSize <= 0 {
+		o.config.BatchSize = 10000
+	}
+	if o.config.BatchDelay <= 0 {
+		o.config.BatchDelay = time.Second
+	}
+	if o.config.ResponseTimeout <= 0 {
+		o.config.ResponseTimeout = 5 * time.Second
+	}
+	if o.config.Timeout < time.Millisecond {
+		o.config.Timeout = 10 * time.Second
+	}
+	o.pending = make(map[string]*clickHouseRow)
+	o.messages = make(chan []byte, 10000)
+	o.done = make(chan struct{})
+	o.finished = make(chan struct{})
+	go o.run()
+	return o
+}
+
+// isClickHouseSource reports whether the source of a column is known
+func isClickHouseSource(source string) bool {
+	switch source {
+	case "timestamp", "id", "method", "host", "path", "url", "request_size",
+		"status", "response_size", "latency", "latency_ms":
+		return true
+	}
+	return strings.HasPrefix(source, "header:") || strings.HasPrefix(source, "response_header:")
+}
+
+// clickHouseValue returns the value of the source for the payload, and whether the source is one of its type:
+// timestamp (in nanoseconds), method, host, path (without the query), url, request_size and header:<name> for
+// the requests, status, response_size, latency (in nanoseconds), latency_ms and response_header:<name> for the
+// responses, and id for both
+func clickHouseValue(source string, data []byte) (string, bool) {
+	body := payloadBody(data)
+	request := isRequestPayload(data)
+	switch {
+	case source == "id":
+		if meta := payloadMeta(data); len(meta) > 1 {
+			return string(meta[1]), true
+		}
+		return "", true
+	case source == "timestamp" && request:
+		if meta := payloadMeta(data); len(meta) > 2 {
+			return string(meta[2]), true
+		}
+		return "", true
+	case source == "method" && request:
+		return string(proto.Method(body)), true
+	case source == "host" && request:
+		return string(proto.Header(body, []byte("Host"))), true
+	case source == "url" && request:
+		return string(proto.Path(body)), true
+	case source == "path" && request:
+		path := string(proto.Path(body))
+		if i := strings.IndexByte(path, '?'); i != -1 {
+			path = path[:i]
+		}
+		return path, true
+	case source == "request_size" && request, source == "response_size" && !request:
+		return strconv.Itoa(len(body)), true
+	case strings.HasPrefix(source, "header:") && request:
+		return string(proto.Header(body, []byte(source[len("header:"):]))), true
+	case source == "status" && !request:
+		return string(proto.Status(body)), true
+	case (source == "latency" || source == "latency_ms") && !request:
+		meta := payloadMeta(data)
+		if len(meta) < 4 {
+			return "", true
+		}
+		if source == "latency" {
+			return string(meta[3]), true
+		}
+		latency, _ := strconv.ParseInt(string(meta[3]), 10, 64)
+		return strconv.FormatFloat(float64(latency)/float64(time.Millisecond), 'f', -1, 64), true
+	case strings.HasPrefix(source, "response_header:") && !request:
+		return string(proto.Header(body, []byte(source[len("response_header:"):]))), true
+	}
+	return "", false
+}
+
+// Write queues the payload to be inserted, the payloads written after Close are refused
+func (o *ClickHouseOutput) Write(data []byte) (n int, err error) {
+	if !isOriginPayload(data) {
+		return len(data), nil
+	}
+	o.queuing.RLock()
+	defer o.queuing.RUnlock()
+	select {
+	case <-o.done:
+		return 0, ErrorStopped
+	default:
+	}
+	// run receives the messages until done, and inserts the ones queued then
+	o.messages <- append([]byte(nil), data...)
+	return len(data), nil
+}
+
+// run fills the rows with the payloads and inserts them
+func (o *ClickHouseOutput) run() {
+	defer close(o.finished)
+	ticker := time.NewTicker(o.config.BatchDelay)
+	defer ticker.Stop()
+	for {
+		select {
+		case data := <-o.messages:
+			o.add(data)
+			if len(o.batch) >= o.config.BatchSize {
+				o.flush()
+			}
+		case <-ticker.C:
+			o.expire(time.Now().Add(-o.config.ResponseTimeout))
+			o.flush()
+		case <-o.done:
+			for len(o.messages) > 0 {
+				o.add(<-o.messages)
+			}
+			o.expire(time.Now())
+			o.flush()
+			if o.conn != nil {
+				o.conn.Close()
+			}
+			return
+		}
+	}
+}
+
+// add fills the row of the payload, the row of a request is completed by its response
+func (o *ClickHouseOutput) add(data []byte) {
+	id, _ := clickHouseValue("id", data)
+	row, ok := o.pending[id]
+	if !ok {
+		if !isRequestPayload(data) {
+			// the request was not captured
+			return
+		}
+		row = &clickHouseRow{values: make([]string, len(o.columns)), created: time.Now()}
+		o.pending[id] = row
+	}
+	for i, source := range o.sources {
+		if value, ok := clickHouseValue(source, data); ok {
+			row.values[i] = value
+		}
+	}
+	if !isRequestPayload(data) {
+		delete(o.pending, id)
+		o.batch = append(o.batch, row.values)
+	}
+}
+
+// expire moves the rows of the requests created before t to the batch, without their responses
+func (o *ClickHouseOutput) expire(t time.Time) {
+	for id, row := range o.pending {
+		if row.created.Before(t) {
+			delete(o.pending, id)
+			o.batch = append(o.batch, row.values)
+		}
+	}
+}
+
+// flush inserts the batch, retrying once on a new connection
+func (o *ClickHouseOutput) flush() {
+	if len(o.batch) == 0 {
+		return
+	}
+	err := o.insert(o.batch)
+	if err != nil {
+		Debug(1, fmt.Sprintf("[CLICKHOUSE-OUTPUT] %s: %v", o.address, err))
+		if _, ok := err.(*clickHouseException); !ok {
+			err = o.insert(o.batch)
+		}
+	}
+	if err != nil {
+		atomic.AddInt64(&o.failed, int64(len(o.batch)))
+	} else {
+		atomic.AddInt64(&o.inserted, int64(len(o.batch)))
+	}
+	o.batch = nil
+}
+
+// insert sends the INSERT query, reads the types of the columns from the sample block of the server and sends
+// the rows in a block
+func (o *ClickHouseOutput) insert(rows [][]string) (err error) {
+	defer func() {
+		if _, ok := err.(*clickHouseException); err != nil && !ok && o.conn != nil {
+			o.conn.Close()
+			o.conn = nil
+		}
+	}()
+	if o.conn == nil {
+		if err = o.connect(); err != nil {
+			return
+		}
+	}
+	o.conn.SetDeadline(time.Now().Add(o.config.Timeout))
+	columns := make([]string, len(o.columns))
+	for i, c := range o.columns {
+		columns[i] = "`" + strings.Replace(c, "`", "\\`", -1) + "`"
+	}
+	query := "INSERT INTO " + o.config.Table + " (" + strings.Join(columns, ", ") + ") VALUES"
+	if _, err = o.conn.Write(append(appendClickHouseQuery(nil, query), appendClickHouseBlock(nil, 0, 0)...)); err != nil {
+		return
+	}
+	sample, err := o.readUntil(clickHouseServerData)
+	if err != nil {
+		return
+	}
+	if len(sample) != len(o.columns) {
+		return fmt.Errorf("the server expects %d columns, got %d", len(sample), len(o.columns))
+	}
+	block := appendClickHouseBlock(nil, len(sample), len(rows))
+	for i, typ := range sample {
+		values := make([]string, len(rows))
+		for j, row := range rows {
+			values[j] = row[i]
+		}
+		block = appendClickHouseString(block, o.columns[i])
+		block = appendClickHouseString(block, typ)
+		if block, err = appendClickHouseColumn(block, typ, values); err != nil {
+			// the query waits for the data, the connection is closed
+			return fmt.Errorf("column %s: %v", o.columns[i], err)
+		}
+	}
+	if _, err = o.conn.Write(appendClickHouseBlock(block, 0, 0)); err != nil {
+		return
+	}
+	_, err = o.readUntil(clickHouseServerEndOfStream)
+	return
+}
+
+// connect opens the connection and exchanges the hellos
+func (o *ClickHouseOutput) connect() (err error) {
+	conn, err := net.DialTimeout("tcp", o.address, o.config.Timeout)
+	if err != nil {
+		return
+	}
+	if o.config.Secure {
+		host, _, _ := net.SplitHostPort(o.address)
+		conn = tls.Client(conn, &tls.Config{ServerName: host})
+	}
+	o.conn, o.reader = conn, bufio.NewReader(conn)
+	conn.SetDeadline(time.Now().Add(o.config.Timeout))
+	hello := appendUvarint(nil, clickHouseClientHello)
+	hello = appendClickHouseString(hello, "goreplay")
+	hello = appendUvarint(hello, 1)
+	hello = appendUvarint(hello, 0)
+	hello = appendUvarint(hello, clickHouseRevision)
+	hello = appendClickHouseString(hello, o.config.Database)
+	hello = appendClickHouseString(hello, o.config.User)
+	hello = appendClickHouseString(hello, o.config.Password)
+	if _, err = conn.Write(hello); err != nil {
+		return
+	}
+	packet, err := binary.ReadUvarint(o.reader)
+	if err != nil {
+		return
+	}
+	switch packet {
+	case clickHouseServerException:
+		return readClickHouseException(o.reader)
+	case clickHouseServerHello:
+		// the name, the version, the revision of the server and its timezone
+		for _, read := range []func() error{o.skipString, o.skipUvarint, o.skipUvarint, o.skipUvarint, o.skipString} {
+			if err = read(); err != nil {
+				return
+			}
+		}
+		return
+	}
+	return fmt.Errorf("unexpected packet %d", packet)
+}
+
+func (o *ClickHouseOutput) skipString() error {
+	_, err := readClickHouseString(o.reader)
+	return err
+}
+
+func (o *ClickHouseOutput) skipUvarint() error {
+	_, err := binary.ReadUvarint(o.reader)
+	return err
+}
+
+// readUntil reads the packets of the server until the packet expected, it returns the types of the columns of the
+// data packets
+func (o *ClickHouseOutput) readUntil(expected uint64) (types []string, err error) {
+	for {
+		packet, err := binary.ReadUvarint(o.reader)
+		if err != nil {
+			return nil, err
+		}
+		switch packet {
+		case clickHouseServerException:
+			return nil, readClickHouseException(o.reader)
+		case clickHouseServerProgress:
+			// rows, bytes and total rows
+			for i := 0; i < 3; i++ {
+				if err = o.skipUvarint(); err != nil {
+					return nil, err
+				}
+			}
+		case clickHouseServerProfileInfo:
+			// rows, blocks, bytes, applied limit, rows before limit and calculated rows before limit
+			for _, read := range []func() error{o.skipUvarint, o.skipUvarint, o.skipUvarint, o.skipByte, o.skipUvarint, o.skipByte} {
+				if err = read(); err != nil {
+					return nil, err
+				}
+			}
+		case clickHouseServerData, clickHouseServerTotals, clickHouseServerExtremes, clickHouseServerLog:
+			if types, err = readClickHouseSampleBlock(o.reader); err != nil {
+				return nil, err
+			}
+		case clickHouseServerEndOfStream:
+		default:
+			return nil, fmt.Errorf("unexpected packet %d", packet)
+		}
+		if packet == expected {
+			return types, nil
+		}
+	}
+}
+
+func (o *ClickHouseOutput) skipByte() error {
+	_, err := o.reader.ReadByte()
+	return err
+}
+
+// clickHouseException is an exception of the server, the connection is still usable after it
+type clickHouseException struct {
+	code    int32
+	name    string
+	message string
+}
+
+func (e *clickHouseException) Error() string {
+	return fmt.Sprintf("%s (%d): %s", e.name, e.code, e.message)
+}
+
+// readClickHouseException reads an exception, the nested exceptions are skipped
+func readClickHouseException(r *bufio.Reader) error {
+	var e *clickHouseException
+	for {
+		var code int32
+		if err := binary.Read(r, binary.LittleEndian, &code); err != nil {
+			return err
+		}
+		var fields [3]string // name, message, stack trace
+		for i := range fields {
+			s, err := readClickHouseString(r)
+			if err != nil {
+				return err
+			}
+			fields[i] = s
+		}
+		if e == nil {
+			e = &clickHouseException{code: code, name: fields[0], message: fields[1]}
+		}
+		nested, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if nested == 0 {
+			return e
+		}
+	}
+}
+
+// readClickHouseSampleBlock reads a data packet without rows, it returns the types of its columns
+func readClickHouseSampleBlock(r *bufio.Reader) (types []string, err error) {
+	// the name of the table
+	if _, err = readClickHouseString(r); err != nil {
+		return
+	}
+	// the info of the block: the field 1 is a bool, the field 2 an int32, 0 ends the fields
+	for {
+		field, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		if field == 0 {
+			break
+		}
+		n := 1
+		if field == 2 {
+			n = 4
+		}
+		if _, err = r.Discard(n); err != nil {
+			return nil, err
+		}
+	}
+	columns, err := binary.ReadUvarint(r)
+	if err != nil {
+		return
+	}
+	rows, err := binary.ReadUvarint(r)
+	if err != nil {
+		return
+	}
+	if rows > 0 {
+		return nil, errors.New("unexpected rows in the response")
+	}
+	for i := uint64(0); i < columns; i++ {
+		if _, err = readClickHouseString(r); err != nil {
+			return
+		}
+		typ, err := readClickHouseString(r)
+		if err != nil {
+			return nil, err
+		}
+		types = append(types, typ)
+	}
+	return
+}
+
+func readClickHouseString(r *bufio.Reader) (string, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", err
+	}
+	if n > 1<<20 {
+		return "", errors.New("string too long")
+	}
+	b := make([]byte, n)
+	_, err = io.ReadFull(r, b)
+	return string(b), err
+}
+
+func appendClickHouseString(buf []byte, s string) []byte {
+	return append(appendUvarint(buf, uint64(len(s))), s...)
+}
+
+// appendClickHouseQuery appends the query packet, with the info of the client and without settings
+func appendClickHouseQuery(buf []byte, query string) []byte {
+	hostname, _ := os.Hostname()
+	buf = appendUvarint(buf, clickHouseClientQuery)
+	buf = appendClickHouseString(buf, "") // the id of the query
+	// the info of the client: an initial query, its user, id and address, then the TCP interface
+	buf = append(buf, 1)
+	buf = appendClickHouseString(buf, "")
+	buf = appendClickHouseString(buf, "")
+	buf = appendClickHouseString(buf, "[::ffff:127.0.0.1]:0")
+	buf = append(buf, 1)
+	buf = appendClickHouseString(buf, os.Getenv("USER"))
+	buf = appendClickHouseString(buf, hostname)
+	buf = appendClickHouseString(buf, "goreplay")
+	buf = appendUvarint(buf, 1)
+	buf = appendUvarint(buf, 0)
+	buf = appendUvarint(buf, clickHouseRevision)
+	buf = appendClickHouseString(buf, "") // the quota key
+	buf = appendClickHouseString(buf, "") // the end of the settings
+	buf = appendUvarint(buf, 2)           // the stage, complete
+	buf = appendUvarint(buf, 0)           // no compression
+	return appendClickHouseString(buf, query)
+}
+
+// appendClickHouseBlock appends the header of a data packet: the block info and the numbers of columns and rows.
+// the name, the type and the data of each column follow it, the block without columns ends the data
+func appendClickHouseBlock(buf []byte, columns, rows int) []byte {
+	buf = appendUvarint(buf, clickHouseClientData)
+	buf = appendClickHouseString(buf, "") // the name of the table
+	// is_overflows false, bucket_num -1
+	buf = append(buf, 1, 0, 2, 0xff, 0xff, 0xff, 0xff, 0)
+	buf = appendUvarint(buf, uint64(columns))
+	return appendUvarint(buf, uint64(rows))
+}
+
+// appendClickHouseColumn appends the values of a column converted to its type. the
+// numbers are parsed from the values, the timestamps in nanoseconds are converted to the dates and times, and the
+// empty values are NULL for the Nullable types
+func appendClickHouseColumn(buf []byte, typ string, values []string) ([]byte, error) {
+	inner := func(prefix string) (string, bool) {
+		if strings.HasPrefix(typ, prefix+"(") && strings.HasSuffix(typ, ")") {
+			return typ[len(prefix)+1 : len(typ)-1], true
+		}
+		return "", false
+	}
+	if t, ok := inner("LowCardinality"); ok {
+		return appendClickHouseColumn(buf, t, values)
+	}
+	if t, ok := inner("Nullable"); ok {
+		for _, v := range values {
+			if v == "" {
+				buf = append(buf, 1)
+			} else {
+				buf = append(buf, 0)
+			}
+		}
+		return appendClickHouseColumn(buf, t, values)
+	}
+	if t, ok := inner("FixedString"); ok {
+		n, err := strconv.Atoi(t)
+		if err != nil {
+			return nil, fmt.Errorf("invalid type %s", typ)
+		}
+		for _, v := range values {
+			if len(v) > n {
+				v = v[:n]
+			}
+			buf = append(append(buf, v...), make([]byte, n-len(v))...)
+		}
+		return buf, nil
+	}
+	if typ == "DateTime" || strings.HasPrefix(typ, "DateTime(") {
+		for _, v := range values {
+			buf = appendClickHouseInt(buf, clickHouseInt(v)/int64(time.Second), 4)
+		}
+		return buf, nil
+	}
+	if t, ok := inner("DateTime64"); ok {
+		precision, _ := strconv.Atoi(strings.TrimSpace(strings.SplitN(t, ",", 2)[0]))
+		if precision < 0 || precision > 9 {
+			return nil, fmt.Errorf("invalid type %s", typ)
+		}
+		unit := int64(math.Pow10(9 - precision))
+		for _, v := range values {
+			buf = appendClickHouseInt(buf, clickHouseInt(v)/unit, 8)
+		}
+		return buf, nil
+	}
+	switch typ {
+	case "String":
+		for _, v := range values {
+			buf = appendClickHouseString(buf, v)
+		}
+	case "Date", "Date32":
+		size := 2
+		if typ == "Date32" {
+			size = 4
+		}
+		for _, v := range values {
+			buf = appendClickHouseInt(buf, clickHouseInt(v)/int64(24*time.Hour), size)
+		}
+	case "UInt8", "Int8", "Bool":
+		for _, v := range values {
+			buf = appendClickHouseInt(buf, clickHouseInt(v), 1)
+		}
+	case "UInt16", "Int16":
+		for _, v := range values {
+			buf = appendClickHouseInt(buf, clickHouseInt(v), 2)
+		}
+	case "UInt32", "Int32":
+		for _, v := range values {
+			buf = appendClickHouseInt(buf, clickHouseInt(v), 4)
+		}
+	case "UInt64", "Int64":
+		for _, v := range values {
+			buf = appendClickHouseInt(buf, clickHouseInt(v), 8)
+		}
+	case "Float32":
+		for _, v := range values {
+			f, _ := strconv.ParseFloat(v, 32)
+			buf = appendClickHouseInt(buf, int64(math.Float32bits(float32(f))), 4)
+		}
+	case "Float64":
+		for _, v := range values {
+			f, _ := strconv.ParseFloat(v, 64)
+			buf = appendClickHouseInt(buf, int64(math.Float64bits(f)), 8)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported type %s", typ)
+	}
+	return buf, nil
+}
+
+// clickHouseInt parses the value as an integer, or a float truncated, 0 if it is not a number
+func clickHouseInt(v string) int64 {
+	if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return n
+	}
+	f, _ := strconv.ParseFloat(v, 64)
+	return int64(f)
+}
+
+// appendClickHouseInt appends the size low bytes of n in little endian
+func appendClickHouseInt(buf []byte, n int64, size int) []byte {
+	for i := 0; i < size; i++ {
+		buf = append(buf, byte(n>>(8*uint(i))))
+	}
+	return buf
+}
+
+func (o *ClickHouseOutput) String() string {
+	return fmt.Sprintf("ClickHouse output: %s, table: %s, inserted: %d, failed: %d", o.address, o.config.Table,
+		atomic.LoadInt64(&o.inserted), atomic.LoadInt64(&o.failed))
+}
+
+// Close inserts the rows pending, waiting for Timeout at most
+func (o *ClickHouseOutput) Close() error {
+	o.stop.Do(func() {
+		o.queuing.Lock()
+		close(o.done)
+		o.queuing.Unlock()
+	})
+	select {
+	case <-o.finished:
+	case <-time.After(o.config.Timeout):
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"math"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// readClickHouseTestBlock reads a data packet of the client, with the columns of the types of the test
+func readClickHouseTestBlock(t *testing.T, r *bufio.Reader) (columns map[string][]interface{}) {
+	if packet, _ := binary.ReadUvarint(r); packet != clickHouseClientData {
+		t.Fatalf("expected a data packet, got %d", packet)
+	}
+	readClickHouseString(r)
+	info := make([]byte, 8)
+	io.ReadFull(r, info)
+	n, _ := binary.ReadUvarint(r)
+	rows, _ := binary.ReadUvarint(r)
+	columns = make(map[string][]interface{})
+	for i := uint64(0); i < n; i++ {
+		name, _ := readClickHouseString(r)
+		typ, _ := readClickHouseString(r)
+		var nulls []byte
+		if typ == "Nullable(String)" {
+			nulls = make([]byte, rows)
+			io.ReadFull(r, nulls)
+		}
+		for j := uint64(0); j < rows; j++ {
+			var v interface{}
+			switch typ {
+			case "String", "Nullable(String)":
+				s, _ := readClickHouseString(r)
+				v = s
+				if nulls != nil && nulls[j] == 1 {
+					v = nil
+				}
+			case "UInt16":
+				var n uint16
+				binary.Read(r, binary.LittleEndian, &n)
+				v = n
+			case "DateTime64(3)":
+				var n int64
+				binary.Read(r, binary.LittleEndian, &n)
+				v = n
+			case "Float64":
+				var n uint64
+				binary.Read(r, binary.LittleEndian, &n)
+				v = math.Float64frombits(n)
+			}
+			columns[name] = append(columns[name], v)
+		}
+	}
+	return
+}
+
+func TestClickHouseOutput(t *testing.T) {
+	types := []string{"DateTime64(3)", "String", "String", "UInt16", "Float64", "Nullable(String)"}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	inserted := make(chan map[string][]interface{}, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		// the hello of the client: the packet, its name, version and revision, the database, user and password
+		binary.ReadUvarint(r)
+		readClickHouseString(r)
+		for i := 0; i < 3; i++ {
+			binary.ReadUvarint(r)
+		}
+		for i := 0; i < 3; i++ {
+			readClickHouseString(r)
+		}
+		hello := appendUvarint(nil, clickHouseServerHello)
+		hello = appendClickHouseString(hello, "ClickHouse")
+		hello = appendUvarint(append(appendUvarint(hello, 21), 8), 54449)
+		conn.Write(appendClickHouseString(hello, "UTC"))
+
+		// the query packet
+		binary.ReadUvarint(r)
+		readClickHouseString(r)
+		r.ReadByte()
+		for i := 0; i < 3; i++ {
+			readClickHouseString(r)
+		}
+		r.ReadByte()
+		for i := 0; i < 3; i++ {
+			readClickHouseString(r)
+		}
+		for i := 0; i < 3; i++ {
+			binary.ReadUvarint(r)
+		}
+		readClickHouseString(r)
+		readClickHouseString(r)
+		binary.ReadUvarint(r)
+		binary.ReadUvarint(r)
+		if query, _ := readClickHouseString(r); query != "INSERT INTO traffic (`timestamp`, `id`, `method`, `status`, `latency_ms`, `ua`) VALUES" {
+			t.Errorf("unexpected query %q", query)
+		}
+		readClickHouseTestBlock(t, r)
+
+		sample := appendUvarint(nil, clickHouseServerData)
+		sample = appendClickHouseString(sample, "")
+		sample = append(sample, 1, 0, 2, 0xff, 0xff, 0xff, 0xff, 0)
+		sample = appendUvarint(appendUvarint(sample, uint64(len(types))), 0)
+		for i, typ := range types {
+			sample = appendClickHouseString(sample, []string{"timestamp", "id", "method", "status", "latency_ms", "ua"}[i])
+			sample = appendClickHouseString(sample, typ)
+		}
+		conn.Write(sample)
+		inserted <- readClickHouseTestBlock(t, r)
+		readClickHouseTestBlock(t, r)
+		conn.Write([]byte{clickHouseServerProgress, 2, 100, 0, clickHouseServerEndOfStream})
+	}()
+
+	o := NewClickHouseOutput(ln.Addr().String(), &ClickHouseOutputConfig{
+		Table:   "traffic",
+		Columns: MultiOption{"timestamp=timestamp", "id=id", "method=method", "status=status", "latency_ms=latency_ms", "ua=header:User-Agent"},
+	}).(*ClickHouseOutput)
+	o.Write([]byte("1 a 1500000000 0\nGET /a HTTP/1.1\r\nUser-Agent: curl\r\n\r\n"))
+	o.Write([]byte("2 a 1500000000 2500000\nHTTP/1.1 404 Not Found\r\n\r\n"))
+	o.Write([]byte("1 b 2000000000 0\nPOST /b HTTP/1.1\r\n\r\n"))
+	o.Close()
+	if n, err := o.Write([]byte("1 c 2000000000 0\nGET /c HTTP/1.1\r\n\r\n")); n != 0 || err != ErrorStopped {
+		t.Errorf("expected the payload written after Close to be refused, got %d %v", n, err)
+	}
+
+	select {
+	case columns := <-inserted:
+		expected := map[string][]interface{}{
+			"timestamp":  {int64(1500), int64(2000)},
+			"id":         {"a", "b"},
+			"method":     {"GET", "POST"},
+			"status":     {uint16(404), uint16(0)},
+			"latency_ms": {2.5, 0.0},
+			"ua":         {"curl", nil},
+		}
+		if !reflect.DeepEqual(columns, expected) {
+			t.Errorf("unexpected rows %v", columns)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no rows inserted")
+	}
+	if o.inserted != 2 {
+		t.Errorf("expected 2 rows inserted, got %s", o)
+	}
+}
+
+func TestClickHouseColumn(t *testing.T) {
+	for _, c := range []struct {
+		typ      string
+		values   []string
+		expected []byte
+	}{
+		{"UInt32", []string{"1", ""}, []byte{1, 0, 0, 0, 0, 0, 0, 0}},
+		{"DateTime", []string{"2000000000"}, []byte{2, 0, 0, 0}},
+		{"LowCardinality(String)", []string{"a"}, []byte{1, 'a'}},
+		{"FixedString(2)", []string{"abc", "a"}, []byte{'a', 'b', 'a', 0}},
+		{"Nullable(UInt8)", []string{"", "3"}, []byte{1, 0, 0, 3}},
+	} {
+		data, err := appendClickHouseColumn(nil, c.typ, c.values)
+		if err != nil || !reflect.DeepEqual(data, c.expected) {
+			t.Errorf("%s: expected %v, got %v %v", c.typ, c.expected, data, err)
+		}
+	}
+	if _, err := appendClickHouseColumn(nil, "Array(String)", []string{""}); err == nil {
+		t.Error("expected unsupported types to fail")
+	}
+}
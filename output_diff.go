@@ -0,0 +1,431 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+)
+
+// diffCompareExpire is how long a recorded or replayed response waits for the other one to be compared with
+const diffCompareExpire = time.Minute
+
+// the headers ignored by default, the ones of the connection, of the framing and of the encoding of the body
+// which is compared decoded
+var diffIgnoredHeaders = []string{"Date", "Connection", "Keep-Alive", "Content-Length", "Transfer-Encoding", "Content-Encoding"}
+
+// DiffOutputConfig is the configuration of the diff output
+type DiffOutputConfig struct {
+	Primary      string        `json:"output-diff-primary"`
+	Workers      int           `json:"output-diff-workers"`
+	Timeout      time.Duration `json:"output-diff-timeout"`
+	File         string        `json:"output-diff-file"`
+	IgnoreHeader MultiOption   `json:"output-diff-ignore-header"`
+	IgnoreBody   MultiOption   `json:"output-diff-ignore-body"`
+	IgnoreField  MultiOption   `json:"output-diff-ignore-field"`
+}
+
+// DiffOutput replays the HTTP requests against a candidate and compares its responses with the recorded ones, or
+// with the responses of Primary when the requests are sent to it too. the responses are compared by their
+// status, their headers and their body, decoded, with the JSON bodies compared field by field. each difference
+// is written as a JSON line to File or to stdout. the headers of IgnoreHeader, the parts of the bodies matching
+// the regexps of IgnoreBody and the JSON fields of IgnoreField, dotted paths with * for any key or index, are
+// not compared
+type DiffOutput struct {
+	// Keep this as first element of struct because it guarantees 64bit
+	// alignment. atomic.* functions crash on 32bit machines if operand is not
+	// aligned at 64bit. See https://github.com/golang/go/issues/599
+	compared int64
+	differed int64
+
+	sync.Mutex
+	address       string
+	config        *DiffOutputConfig
+	ignoreHeaders map[string]bool
+	ignoreBody    []*regexp.Regexp
+	ignoreFields  [][]string
+	requests      chan diffRequest
+	pending       map[string]*diffComparison // by the id of the request
+	lastPurge     time.Time
+	out           io.Writer
+	outMu         sync.Mutex
+	done          chan struct{}
+	wg            sync.WaitGroup
+}
+
+type diffRequest struct {
+	id   string
+	data []byte
+}
+
+// diffComparison holds the request and the first of the recorded and the replayed response of a request
+type diffComparison struct {
+	request  []byte
+	recorded []byte
+	replayed []byte
+	seen     time.Time
+}
+
+// httpDiff is a difference between two responses, written as a JSON line
+type httpDiff struct {
+	ID      string               `json:"id"`
+	Method  string               `json:"method"`
+	URL     string               `json:"url"`
+	Status  *diffValue           `json:"status,omitempty"`
+	Headers map[string]diffValue `json:"headers,omitempty"`
+	Body    map[string]diffValue `json:"body,omitempty"` // by the path of the JSON fields, or "" for the other bodies
+}
+
+// diffValue is a value of the expected response, recorded or of the primary, and of the candidate
+type diffValue struct {
+	Expected interface{} `json:"expected"`
+	Actual   interface{} `json:"actual"`
+}
+
+// NewDiffOutput constructor for DiffOutput, address is the URL of the candidate
+func NewDiffOutput(address string, config *DiffOutputConfig) io.Writer {
+	o := new(DiffOutput)
+	o.address = address
+	o.config = config
+	if o.config.Workers < 1 {
+		o.config.Workers = 10
+	}
+	if o.config.Timeout < time.Millisecond {
+		o.config.Timeout = 5 * time.Second
+	}
+	o.ignoreHeaders = make(map[string]bool)
+	for _, h := range append(diffIgnoredHeaders, o.config.IgnoreHeader...) {
+		o.ignoreHeaders[strings.ToLower(h)] = true
+	}
+	for _, expr := range o.config.IgnoreBody {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			log.Fatalf("output-diff: invalid regexp %q: %v", expr, err)
+		}
+		o.ignoreBody = append(o.ignoreBody, re)
+	}
+	for _, field := range o.config.IgnoreField {
+		o.ignoreFields = append(o.ignoreFields, strings.Split(field, "."))
+	}
+	o.out = os.Stdout
+	if o.config.File != "" {
+		f, err := os.OpenFile(o.config.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0660)
+		if err != nil {
+			log.Fatalf("output-diff: %v", err)
+		}
+		o.out = f
+	}
+
+	o.requests = make(chan diffRequest, 1000)
+	o.pending = make(map[string]*diffComparison)
+	o.lastPurge = time.Now()
+	o.done = make(chan struct{})
+	for i := 0; i < o.config.Workers; i++ {
+		o.wg.Add(1)
+		go o.worker()
+	}
+	return o
+}
+
+// Write queues the requests, and keeps the recorded responses to compare them
+func (o *DiffOutput) Write(data []byte) (n int, err error) {
+	n = len(data)
+	meta := payloadMeta(data)
+	if len(meta) < 2 || !isOriginPayload(data) {
+		return
+	}
+	body := append([]byte(nil), payloadBody(data)...)
+	if isRequestPayload(data) {
+		if !proto.HasRequestTitle(body) {
+			return
+		}
+		select {
+		case o.requests <- diffRequest{id: string(meta[1]), data: body}:
+		case <-o.done:
+		}
+		return
+	}
+	// the responses of the primary are compared instead of the recorded ones
+	if o.config.Primary == "" && proto.HasResponseTitle(body) {
+		o.compare(string(meta[1]), nil, body, nil)
+	}
+	return
+}
+
+// worker sends the requests to the candidate, and to the primary if any, with its own clients
+func (o *DiffOutput) worker() {
+	defer o.wg.Done()
+	config := &HTTPClientConfig{Timeout: o.config.Timeout, ResponseBufferSize: int(Settings.CopyBufferSize)}
+	candidate := NewHTTPClient(o.address, config)
+	defer candidate.Disconnect()
+	var primary *HTTPClient
+	if o.config.Primary != "" {
+		primary = NewHTTPClient(o.config.Primary, config)
+		defer primary.Disconnect()
+	}
+	for {
+		var req diffRequest
+		select {
+		case req = <-o.requests:
+		case <-o.done:
+			return
+		}
+		if primary == nil {
+			resp, _ := candidate.Send(req.data)
+			o.compare(req.id, req.data, nil, append([]byte(nil), resp...))
+			continue
+		}
+		var expected []byte
+		sent := make(chan struct{})
+		go func() {
+			resp, _ := primary.Send(req.data)
+			expected = append([]byte(nil), resp...)
+			close(sent)
+		}()
+		resp, _ := candidate.Send(req.data)
+		actual := append([]byte(nil), resp...)
+		<-sent
+		o.diff(req.id, req.data, expected, actual)
+	}
+}
+
+// compare keeps the request and the first of the recorded and the replayed response of a request, and compares
+// the responses when the second one is received
+func (o *DiffOutput) compare(id string, request, recorded, replayed []byte) {
+	o.Lock()
+	now := time.Now()
+	if now.Sub(o.lastPurge) > diffCompareExpire/10 {
+		o.lastPurge = now
+		for id, c := range o.pending {
+			if now.Sub(c.seen) > diffCompareExpire {
+				delete(o.pending, id)
+			}
+		}
+	}
+	c, ok := o.pending[id]
+	if !ok {
+		o.pending[id] = &diffComparison{request: request, recorded: recorded, replayed: replayed, seen: now}
+		o.Unlock()
+		return
+	}
+	if request == nil {
+		request = c.request
+	}
+	if recorded == nil {
+		recorded = c.recorded
+	}
+	if replayed == nil {
+		replayed = c.replayed
+	}
+	if recorded == nil || replayed == nil {
+		// the same response twice
+		o.Unlock()
+		return
+	}
+	delete(o.pending, id)
+	o.Unlock()
+	o.diff(id, request, recorded, replayed)
+}
+
+// diff compares the responses, and writes their differences
+func (o *DiffOutput) diff(id string, request, expected, actual []byte) {
+	d := o.responseDiff(expected, actual)
+	atomic.AddInt64(&o.compared, 1)
+	if d == nil {
+		return
+	}
+	atomic.AddInt64(&o.differed, 1)
+	d.ID = id
+	d.Method = string(proto.Method(request))
+	d.URL = string(proto.Path(request))
+	line, err := json.Marshal(d)
+	if err != nil {
+		Debug(1, fmt.Sprintf("[DIFF-OUTPUT] %v", err))
+		return
+	}
+	o.outMu.Lock()
+	o.out.Write(append(line, '\n'))
+	o.outMu.Unlock()
+}
+
+// responseDiff returns the differences of the responses, nil if they are the same
+func (o *DiffOutput) responseDiff(expected, actual []byte) *httpDiff {
+	d := new(httpDiff)
+	same := true
+	expectedStatus, _ := strconv.Atoi(string(httpStatus(expected)))
+	actualStatus, _ := strconv.Atoi(string(httpStatus(actual)))
+	if expectedStatus != actualStatus {
+		d.Status = &diffValue{expectedStatus, actualStatus}
+		same = false
+	}
+
+	expectedHeaders, actualHeaders := o.headers(expected), o.headers(actual)
+	for name, values := range expectedHeaders {
+		if strings.Join(values, ", ") != strings.Join(actualHeaders[name], ", ") {
+			if d.Headers == nil {
+				d.Headers = make(map[string]diffValue)
+			}
+			d.Headers[name] = diffValue{values, actualHeaders[name]}
+		}
+	}
+	for name, values := range actualHeaders {
+		if _, ok := expectedHeaders[name]; !ok {
+			if d.Headers == nil {
+				d.Headers = make(map[string]diffValue)
+			}
+			d.Headers[name] = diffValue{nil, values}
+		}
+	}
+	if d.Headers != nil {
+		same = false
+	}
+
+	if d.Body = o.bodyDiff(messageBody(expected), messageBody(actual)); d.Body != nil {
+		same = false
+	}
+	if same {
+		return nil
+	}
+	return d
+}
+
+// headers returns the headers of the response which are compared
+func (o *DiffOutput) headers(resp []byte) map[string][]string {
+	headers := make(map[string][]string)
+	proto.ParseHeaders([][]byte{resp}, func(name, value []byte) {
+		if !o.ignoreHeaders[strings.ToLower(string(name))] {
+			headers[string(name)] = append(headers[string(name)], string(value))
+		}
+	})
+	return headers
+}
+
+// bodyDiff compares the bodies, field by field when both are JSON, nil if they are the same
+func (o *DiffOutput) bodyDiff(expected, actual []byte) map[string]diffValue {
+	for _, re := range o.ignoreBody {
+		expected = re.ReplaceAll(expected, []byte("<ignored>"))
+		actual = re.ReplaceAll(actual, []byte("<ignored>"))
+	}
+	var expectedJSON, actualJSON interface{}
+	if json.Unmarshal(expected, &expectedJSON) == nil && json.Unmarshal(actual, &actualJSON) == nil {
+		diffs := make(map[string]diffValue)
+		o.jsonDiff(nil, expectedJSON, actualJSON, diffs)
+		if len(diffs) == 0 {
+			return nil
+		}
+		return diffs
+	}
+	expected, actual = bytes.TrimSpace(expected), bytes.TrimSpace(actual)
+	if bytes.Equal(expected, actual) {
+		return nil
+	}
+	// the bodies from their first difference
+	i := 0
+	for i < len(expected) && i < len(actual) && expected[i] == actual[i] {
+		i++
+	}
+	excerpt := func(b []byte) string {
+		end := i + 64
+		if end > len(b) {
+			end = len(b)
+		}
+		return string(b[i:end])
+	}
+	return map[string]diffValue{"": {Expected: excerpt(expected), Actual: excerpt(actual)}}
+}
+
+// jsonDiff adds the differences of the JSON values at the path to diffs
+func (o *DiffOutput) jsonDiff(path []string, expected, actual interface{}, diffs map[string]diffValue) {
+	if o.ignoredField(path) {
+		return
+	}
+	switch e := expected.(type) {
+	case map[string]interface{}:
+		if a, ok := actual.(map[string]interface{}); ok {
+			keys := make([]string, 0, len(e)+len(a))
+			for k := range e {
+				keys = append(keys, k)
+			}
+			for k := range a {
+				if _, ok := e[k]; !ok {
+					keys = append(keys, k)
+				}
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				o.jsonDiff(append(path[:len(path):len(path)], k), e[k], a[k], diffs)
+			}
+			return
+		}
+	case []interface{}:
+		if a, ok := actual.([]interface{}); ok {
+			for i := 0; i < len(e) || i < len(a); i++ {
+				var ev, av interface{}
+				if i < len(e) {
+					ev = e[i]
+				}
+				if i < len(a) {
+					av = a[i]
+				}
+				o.jsonDiff(append(path[:len(path):len(path)], strconv.Itoa(i)), ev, av, diffs)
+			}
+			return
+		}
+	}
+	eJSON, _ := json.Marshal(expected)
+	aJSON, _ := json.Marshal(actual)
+	if !bytes.Equal(eJSON, aJSON) {
+		diffs[strings.Join(path, ".")] = diffValue{expected, actual}
+	}
+}
+
+// ignoredField reports whether the JSON field at the path is ignored
+func (o *DiffOutput) ignoredField(path []string) bool {
+	for _, ignored := range o.ignoreFields {
+		if len(ignored) != len(path) {
+			continue
+		}
+		match := true
+		for i, p := range ignored {
+			if p != "*" && p != path[i] {
+				match = false
+				break
+			}
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
+
+func (o *DiffOutput) String() string {
+	return fmt.Sprintf("Diff output: %s, %d responses compared, %d differed", o.address,
+		atomic.LoadInt64(&o.compared), atomic.LoadInt64(&o.differed))
+}
+
+// Close stops the workers and closes the file of the diffs
+func (o *DiffOutput) Close() error {
+	select {
+	case <-o.done:
+		return nil
+	default:
+	}
+	close(o.done)
+	o.wg.Wait()
+	if f, ok := o.out.(*os.File); ok && f != os.Stdout {
+		return f.Close()
+	}
+	return nil
+}
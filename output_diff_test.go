@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// diffOutputBuffer collects the lines written by the diff output
+type diffOutputBuffer struct {
+	sync.Mutex
+	bytes.Buffer
+}
+
+func (b *diffOutputBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.Buffer.Write(p)
+}
+
+func (b *diffOutputBuffer) diffs(t *testing.T, n int) []httpDiff {
+	for i := 0; i < 200; i++ {
+		b.Lock()
+		lines := bytes.Count(b.Bytes(), []byte("\n"))
+		b.Unlock()
+		if lines >= n {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	b.Lock()
+	defer b.Unlock()
+	var diffs []httpDiff
+	for _, line := range bytes.Split(bytes.TrimSpace(b.Bytes()), []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		var d httpDiff
+		if err := json.Unmarshal(line, &d); err != nil {
+			t.Fatalf("invalid diff %q: %v", line, err)
+		}
+		diffs = append(diffs, d)
+	}
+	return diffs
+}
+
+func TestDiffOutputRecorded(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Version", "2")
+		w.Write([]byte(`{"id":1,"name":"b","updated_at":"now","items":[{"id":1,"ts":2}]}`))
+	}))
+	defer server.Close()
+
+	output := NewDiffOutput(server.URL, &DiffOutputConfig{IgnoreField: MultiOption{"updated_at", "items.*.ts"}}).(*DiffOutput)
+	buf := new(diffOutputBuffer)
+	output.out = buf
+	defer output.Close()
+
+	output.Write([]byte("1 a1 1 0\nGET /users/1 HTTP/1.1\r\nHost: api\r\n\r\n"))
+	output.Write([]byte("2 a1 1 1\nHTTP/1.1 200 OK\r\nContent-Type: application/json\r\nDate: today\r\nX-Version: 1\r\nContent-Length: 64\r\n\r\n" +
+		`{"id":1,"name":"a","updated_at":"before","items":[{"id":1,"ts":1}]}`))
+
+	diffs := buf.diffs(t, 1)
+	if len(diffs) != 1 {
+		t.Fatalf("expected a diff, got %v", diffs)
+	}
+	d := diffs[0]
+	if d.ID != "a1" || d.Method != "GET" || d.URL != "/users/1" || d.Status != nil {
+		t.Errorf("unexpected diff %+v", d)
+	}
+	if len(d.Headers) != 1 || d.Headers["X-Version"].Actual == nil {
+		t.Errorf("expected the X-Version header to differ, got %v", d.Headers)
+	}
+	if len(d.Body) != 1 || d.Body["name"].Expected != "a" || d.Body["name"].Actual != "b" {
+		t.Errorf("expected the name field to differ, got %v", d.Body)
+	}
+}
+
+func TestDiffOutputPrimary(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello 2020-01-01 world"))
+	}))
+	defer primary.Close()
+	candidate := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+		w.Write([]byte("hello 2021-02-02 world"))
+	}))
+	defer candidate.Close()
+
+	output := NewDiffOutput(candidate.URL, &DiffOutputConfig{Primary: primary.URL, Workers: 1, IgnoreBody: MultiOption{`\d{4}-\d{2}-\d{2}`}}).(*DiffOutput)
+	buf := new(diffOutputBuffer)
+	output.out = buf
+	defer output.Close()
+
+	output.Write([]byte("1 b1 1 0\nGET /same HTTP/1.1\r\n\r\n"))
+	output.Write([]byte("1 b2 1 0\nGET /missing HTTP/1.1\r\n\r\n"))
+
+	diffs := buf.diffs(t, 1)
+	if len(diffs) != 1 || diffs[0].ID != "b2" || diffs[0].Status == nil ||
+		diffs[0].Status.Expected != float64(200) || diffs[0].Status.Actual != float64(404) || diffs[0].Body != nil {
+		t.Errorf("expected the status of /missing to differ, got %+v", diffs)
+	}
+	for i := 0; i < 100 && output.String() != "Diff output: "+candidate.URL+", 2 responses compared, 1 differed"; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if output.String() != "Diff output: "+candidate.URL+", 2 responses compared, 1 differed" {
+		t.Errorf("unexpected counters %s", output)
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+)
+
+// dnsCompareExpire is how long a recorded or replayed response waits for the other one to be compared with
+const dnsCompareExpire = time.Minute
+
+// DNSOutputConfig is the configuration of the DNS output
+type DNSOutputConfig struct {
+	Transport      string        `json:"output-dns-transport"`
+	Workers        int           `json:"output-dns-workers"`
+	Timeout        time.Duration `json:"output-dns-timeout"`
+	Compare        bool          `json:"output-dns-compare"`
+	TrackResponses bool          `json:"output-dns-track-response"`
+}
+
+// DNSOutput replays the DNS queries recorded with --input-raw-protocol dns against a candidate resolver, over
+// udp or tcp whatever the transport they were recorded over. the queries are sent by a fixed number of workers
+// as soon as they are received. when Compare is set, the responses of the candidate are compared with the
+// recorded ones by their response code and their answers, and the differences are logged.
+type DNSOutput struct {
+	// Keep this as first element of struct because it guarantees 64bit
+	// alignment. atomic.* functions crash on 32bit machines if operand is not
+	// aligned at 64bit. See https://github.com/golang/go/issues/599
+	compared int64
+	drifted  int64
+
+	sync.Mutex
+	address   string
+	config    *DNSOutputConfig
+	queries   chan dnsQuery
+	responses chan response
+	pending   map[string]*dnsComparison // by the id of the query
+	lastPurge time.Time
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+type dnsQuery struct {
+	id   []byte
+	data []byte
+}
+
+// dnsComparison holds the first of the recorded and the replayed response of a query
+type dnsComparison struct {
+	recorded []byte
+	replayed []byte
+	seen     time.Time
+}
+
+// NewDNSOutput constructor for DNSOutput, address is the host:port of the resolver
+func NewDNSOutput(address string, config *DNSOutputConfig) io.Writer {
+	o := new(DNSOutput)
+	o.address = address
+	o.config = config
+	switch o.config.Transport {
+	case "":
+		o.config.Transport = "udp"
+	case "udp", "tcp":
+	default:
+		log.Fatalf("output-dns: unsupported transport %q, it is udp or tcp", o.config.Transport)
+	}
+	if o.config.Workers < 1 {
+		o.config.Workers = 10
+	}
+	if o.config.Timeout < time.Millisecond {
+		o.config.Timeout = 2 * time.Second
+	}
+	o.queries = make(chan dnsQuery, 1000)
+	o.responses = make(chan response, 1000)
+	o.pending = make(map[string]*dnsComparison)
+	o.lastPurge = time.Now()
+	o.done = make(chan struct{})
+	for i := 0; i < o.config.Workers; i++ {
+		go o.worker()
+	}
+	return o
+}
+
+// Write queues the queries, and keeps the recorded responses to compare them
+func (o *DNSOutput) Write(data []byte) (n int, err error) {
+	n = len(data)
+	meta := payloadMeta(data)
+	if len(meta) < 2 {
+		return
+	}
+	body := payloadBody(data)
+	if _, response, ok := proto.DNSHeader(body); !ok || response == isRequestPayload(data) {
+		return
+	}
+	if isRequestPayload(data) {
+		select {
+		case o.queries <- dnsQuery{id: append([]byte(nil), meta[1]...), data: append([]byte(nil), body...)}:
+		case <-o.done:
+		}
+		return
+	}
+	if o.config.Compare && isOriginPayload(data) {
+		o.compare(string(meta[1]), append([]byte(nil), body...), nil)
+	}
+	return
+}
+
+// Read returns the responses of the candidate, when TrackResponses is set
+func (o *DNSOutput) Read(data []byte) (int, error) {
+	var resp response
+	select {
+	case resp = <-o.responses:
+	case <-o.done:
+		return 0, ErrorStopped
+	}
+	header := payloadHeader(ReplayedResponsePayload, resp.uuid, resp.startedAt, resp.roundTripTime)
+	n := copy(data, header)
+	n += copy(data[n:], resp.payload)
+	return n, nil
+}
+
+// worker sends the queries on its own connection, opened again after errors
+func (o *DNSOutput) worker() {
+	var conn net.Conn
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+	for {
+		var q dnsQuery
+		select {
+		case q = <-o.queries:
+		case <-o.done:
+			return
+		}
+		var err error
+		if conn == nil {
+			if conn, err = net.DialTimeout(o.config.Transport, o.address, o.config.Timeout); err != nil {
+				Debug(1, fmt.Sprintf("[DNS-OUTPUT] %v", err))
+				conn = nil
+				continue
+			}
+		}
+		start := time.Now()
+		resp, err := o.exchange(conn, q.data)
+		stop := time.Now()
+		if err != nil {
+			Debug(1, fmt.Sprintf("[DNS-OUTPUT] %v", err))
+			if ne, ok := err.(net.Error); !ok || !ne.Timeout() || o.config.Transport == "tcp" {
+				conn.Close()
+				conn = nil
+			}
+			continue
+		}
+		if o.config.TrackResponses {
+			select {
+			case o.responses <- response{payload: resp, uuid: q.id, startedAt: start.UnixNano(), roundTripTime: stop.UnixNano() - start.UnixNano()}:
+			case <-o.done:
+				return
+			}
+		}
+		if o.config.Compare {
+			o.compare(string(q.id), nil, resp)
+		}
+	}
+}
+
+// exchange sends the query and returns the response with the same id, the responses of earlier queries that
+// timed out are skipped
+func (o *DNSOutput) exchange(conn net.Conn, query []byte) ([]byte, error) {
+	id, _, _ := proto.DNSHeader(query)
+	conn.SetDeadline(time.Now().Add(o.config.Timeout))
+	buf := make([]byte, 64<<10)
+	if o.config.Transport == "tcp" {
+		if _, err := conn.Write(append([]byte{byte(len(query) >> 8), byte(len(query))}, query...)); err != nil {
+			return nil, err
+		}
+	} else if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	for {
+		var n int
+		var err error
+		if o.config.Transport == "tcp" {
+			if _, err = io.ReadFull(conn, buf[:2]); err == nil {
+				n = int(binary.BigEndian.Uint16(buf))
+				_, err = io.ReadFull(conn, buf[:n])
+			}
+		} else {
+			n, err = conn.Read(buf)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if rid, response, ok := proto.DNSHeader(buf[:n]); ok && response && rid == id {
+			return append([]byte(nil), buf[:n]...), nil
+		}
+		if n < proto.DNSHeaderLen {
+			return nil, errors.New("invalid dns response")
+		}
+	}
+}
+
+// compare keeps the first of the recorded and the replayed response of a query, and compares them when the
+// second one is received
+func (o *DNSOutput) compare(id string, recorded, replayed []byte) {
+	o.Lock()
+	now := time.Now()
+	if now.Sub(o.lastPurge) > dnsCompareExpire/10 {
+		o.lastPurge = now
+		for id, c := range o.pending {
+			if now.Sub(c.seen) > dnsCompareExpire {
+				delete(o.pending, id)
+			}
+		}
+	}
+	c, ok := o.pending[id]
+	if !ok {
+		o.pending[id] = &dnsComparison{recorded: recorded, replayed: replayed, seen: now}
+		o.Unlock()
+		return
+	}
+	if recorded == nil {
+		recorded = c.recorded
+	}
+	if replayed == nil {
+		replayed = c.replayed
+	}
+	if recorded == nil || replayed == nil {
+		// the same response twice
+		o.Unlock()
+		return
+	}
+	delete(o.pending, id)
+	o.Unlock()
+	a, ok := proto.ParseDNS(recorded)
+	b, ok2 := proto.ParseDNS(replayed)
+	if !ok || !ok2 {
+		return
+	}
+	atomic.AddInt64(&o.compared, 1)
+	if diff := proto.DNSDiff(a, b); diff != "" {
+		atomic.AddInt64(&o.drifted, 1)
+		question := "?"
+		if len(a.Questions) > 0 {
+			question = a.Questions[0].String()
+		}
+		log.Printf("[DNS-OUTPUT] answer drift for %s: %s", question, diff)
+	}
+}
+
+func (o *DNSOutput) String() string {
+	return fmt.Sprintf("DNS output: %s://%s, %d responses compared, %d drifted", o.config.Transport, o.address,
+		atomic.LoadInt64(&o.compared), atomic.LoadInt64(&o.drifted))
+}
+
+// Close stops the workers
+func (o *DNSOutput) Close() error {
+	o.closeOnce.Do(func() {
+		close(o.done)
+	})
+	return nil
+}
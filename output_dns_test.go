@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+)
+
+func TestDNSOutput(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	answer := proto.DNSRecord{Name: "example.com.", Type: proto.DNSTypeA, Class: 1, TTL: 60, Data: []byte{1, 2, 3, 4}}
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			m, _ := proto.ParseDNS(buf[:n])
+			m.Response = true
+			if m.Questions[0].Name == "example.com." {
+				m.Answers = []proto.DNSRecord{answer}
+			} else {
+				m.Rcode = 3
+			}
+			conn.WriteTo(proto.AppendDNS(nil, m), addr)
+		}
+	}()
+
+	output := NewDNSOutput(conn.LocalAddr().String(), &DNSOutputConfig{Compare: true, TrackResponses: true, Workers: 1})
+	o := output.(*DNSOutput)
+	defer o.Close()
+	query := func(id uint16, name string) proto.DNSMessage {
+		return proto.DNSMessage{ID: id, Questions: []proto.DNSQuestion{{Name: name, Type: proto.DNSTypeA, Class: 1}}}
+	}
+	start := time.Now().UnixNano()
+	record := func(uuid string, m proto.DNSMessage, recorded []proto.DNSRecord) {
+		output.Write(append(payloadHeader(RequestPayload, []byte(uuid), start, 0), proto.AppendDNS(nil, m)...))
+		m.Response, m.Answers = true, recorded
+		output.Write(append(payloadHeader(ResponsePayload, []byte(uuid), start, 0), proto.AppendDNS(nil, m)...))
+	}
+	// the same answer with another TTL, and a name the candidate doesn't resolve anymore
+	same := answer
+	same.TTL = 300
+	record("a1", query(1, "example.com."), []proto.DNSRecord{same})
+	record("a2", query(2, "example.org."), []proto.DNSRecord{{Name: "example.org.", Type: proto.DNSTypeA, Class: 1, Data: []byte{5, 6, 7, 8}}})
+
+	buf := make([]byte, 1024)
+	for i := 0; i < 2; i++ {
+		n, err := o.Read(buf)
+		if err != nil || buf[0] != ReplayedResponsePayload {
+			t.Fatalf("expected a replayed response, got %q(%v)", buf[:n], err)
+		}
+		if m, ok := proto.ParseDNS(payloadBody(buf[:n])); !ok || !m.Response {
+			t.Errorf("expected a dns response, got %q", payloadBody(buf[:n]))
+		}
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt64(&o.compared) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if compared, drifted := atomic.LoadInt64(&o.compared), atomic.LoadInt64(&o.drifted); compared != 2 || drifted != 1 {
+		t.Errorf("expected 2 responses compared and 1 drifted, got %d and %d", compared, drifted)
+	}
+}
@@ -17,20 +17,27 @@ import (
 	"time"
 
 	"github.com/buger/goreplay/size"
+	"github.com/klauspost/compress/zstd"
 )
 
 var dateFileNameFuncs = map[string]func(*FileOutput) string{
-	"%Y":  func(o *FileOutput) string { return time.Now().Format("2006") },
-	"%m":  func(o *FileOutput) string { return time.Now().Format("01") },
-	"%d":  func(o *FileOutput) string { return time.Now().Format("02") },
-	"%H":  func(o *FileOutput) string { return time.Now().Format("15") },
-	"%M":  func(o *FileOutput) string { return time.Now().Format("04") },
-	"%S":  func(o *FileOutput) string { return time.Now().Format("05") },
-	"%NS": func(o *FileOutput) string { return fmt.Sprint(time.Now().Nanosecond()) },
-	"%r":  func(o *FileOutput) string { return string(o.currentID) },
-	"%t":  func(o *FileOutput) string { return string(o.payloadType) },
+	"%Y":    func(o *FileOutput) string { return time.Now().Format("2006") },
+	"%m":    func(o *FileOutput) string { return time.Now().Format("01") },
+	"%d":    func(o *FileOutput) string { return time.Now().Format("02") },
+	"%H":    func(o *FileOutput) string { return time.Now().Format("15") },
+	"%M":    func(o *FileOutput) string { return time.Now().Format("04") },
+	"%S":    func(o *FileOutput) string { return time.Now().Format("05") },
+	"%NS":   func(o *FileOutput) string { return fmt.Sprint(time.Now().Nanosecond()) },
+	"%r":    func(o *FileOutput) string { return string(o.currentID) },
+	"%t":    func(o *FileOutput) string { return string(o.payloadType) },
+	"%host": func(o *FileOutput) string { return hostname },
 }
 
+var hostname, _ = os.Hostname()
+
+// the extensions of the compressions of the closed files
+var fileCompressions = map[string]string{"gzip": ".gz", "zstd": ".zst"}
+
 // FileOutputConfig ...
 type FileOutputConfig struct {
 	FlushInterval     time.Duration `json:"output-file-flush-interval"`
@@ -39,7 +46,17 @@ type FileOutputConfig struct {
 	QueueLimit        int           `json:"output-file-queue-limit"`
 	Append            bool          `json:"output-file-append"`
 	BufferPath        string        `json:"output-file-buffer"`
+	S3                S3OutputConfig
+	GCS               GCSOutputConfig
+	Azure             AzureOutputConfig
 	onClose           func(string)
+
+	// the chunks are rotated on this interval too, compressed with Compress once they are closed, and the oldest
+	// files of the template are deleted beyond RetentionFiles files or RetentionSize bytes
+	RotateInterval time.Duration `json:"output-file-rotate-interval"`
+	Compress       string        `json:"output-file-compress"`
+	RetentionFiles int           `json:"output-file-retention-files"`
+	RetentionSize  size.Size     `json:"output-file-retention-size"`
 }
 
 // FileOutput output plugin
@@ -56,6 +73,10 @@ type FileOutput struct {
 	payloadType    []byte
 	closed         bool
 	totalFileSize  size.Size
+	openedAt       time.Time // when the current file was opened
+
+	rotating sync.WaitGroup // the compressions and the retention of the closed files
+	rotateMu sync.Mutex
 
 	config *FileOutputConfig
 }
@@ -65,6 +86,9 @@ func NewFileOutput(pathTemplate string, config *FileOutputConfig) *FileOutput {
 	o := new(FileOutput)
 	o.pathTemplate = pathTemplate
 	o.config = config
+	if _, ok := fileCompressions[config.Compress]; config.Compress != "" && !ok {
+		log.Fatalf("output-file: unsupported compression %q, it is gzip or zstd", config.Compress)
+	}
 	o.updateName()
 
 	if strings.Contains(pathTemplate, "%r") {
@@ -157,7 +181,8 @@ func (o *FileOutput) filename() string {
 
 		if o.currentName == "" ||
 			((o.config.QueueLimit > 0 && o.QueueLength >= o.config.QueueLimit) ||
-				(o.config.SizeLimit > 0 && o.chunkSize >= int(o.config.SizeLimit))) {
+				(o.config.SizeLimit > 0 && o.chunkSize >= int(o.config.SizeLimit)) ||
+				(o.config.RotateInterval > 0 && !o.openedAt.IsZero() && time.Since(o.openedAt) >= o.config.RotateInterval)) {
 			nextChunk = true
 		}
 
@@ -165,6 +190,13 @@ func (o *FileOutput) filename() string {
 		withoutExt := strings.TrimSuffix(path, ext)
 
 		if matches, err := filepath.Glob(withoutExt + "*" + ext); err == nil {
+			// the compressed chunks keep their index
+			if compressionExt := fileCompressions[o.config.Compress]; compressionExt != "" && ext != compressionExt {
+				compressed, _ := filepath.Glob(withoutExt + "*" + ext + compressionExt)
+				for _, name := range compressed {
+					matches = append(matches, strings.TrimSuffix(name, compressionExt))
+				}
+			}
 			if len(matches) == 0 {
 				return setFileIndex(path, 0)
 			}
@@ -214,9 +246,12 @@ func (o *FileOutput) Write(data []byte) (n int, err error) {
 		o.file, err = os.OpenFile(o.currentName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0660)
 		o.file.Sync()
 
-		if strings.HasSuffix(o.currentName, ".gz") {
+		switch {
+		case strings.HasSuffix(o.currentName, ".gz"):
 			o.writer = gzip.NewWriter(o.file)
-		} else {
+		case strings.HasSuffix(o.currentName, ".zst"):
+			o.writer, _ = zstd.NewWriter(o.file, zstd.WithEncoderConcurrency(1))
+		default:
 			o.writer = bufio.NewWriter(o.file)
 		}
 
@@ -225,6 +260,7 @@ func (o *FileOutput) Write(data []byte) (n int, err error) {
 		}
 
 		o.QueueLength = 0
+		o.openedAt = time.Now()
 	}
 
 	n, _ = o.writer.Write(data)
@@ -254,11 +290,8 @@ func (o *FileOutput) flush() {
 	defer o.Unlock()
 
 	if o.file != nil {
-		if strings.HasSuffix(o.currentName, ".gz") {
-			o.writer.(*gzip.Writer).Flush()
-		} else {
-			o.writer.(*bufio.Writer).Flush()
-		}
+		// gzip, zstd and bufio writers
+		o.writer.(interface{ Flush() error }).Flush()
 
 		if stat, err := o.file.Stat(); err == nil {
 			o.chunkSize = int(stat.Size())
@@ -274,8 +307,8 @@ func (o *FileOutput) String() string {
 
 func (o *FileOutput) closeLocked() error {
 	if o.file != nil {
-		if strings.HasSuffix(o.currentName, ".gz") {
-			o.writer.(*gzip.Writer).Close()
+		if w, ok := o.writer.(io.Closer); ok {
+			w.Close()
 		} else {
 			o.writer.(*bufio.Writer).Flush()
 		}
@@ -283,6 +316,14 @@ func (o *FileOutput) closeLocked() error {
 
 		if o.config.onClose != nil {
 			o.config.onClose(o.file.Name())
+		} else if o.config.Compress != "" || o.config.RetentionFiles > 0 || o.config.RetentionSize > 0 {
+			// the file is closed with the output when it is still the current one
+			current := o.currentName
+			if current == o.file.Name() {
+				current = ""
+			}
+			o.rotating.Add(1)
+			go o.rotate(o.file.Name(), current)
 		}
 	}
 
@@ -290,11 +331,112 @@ func (o *FileOutput) closeLocked() error {
 	return nil
 }
 
-// Close closes the output file that is being written to.
+// rotate compresses the closed file, then deletes the oldest files of the template beyond the retention, the
+// current file is kept
+func (o *FileOutput) rotate(closed, current string) {
+	defer o.rotating.Done()
+	o.rotateMu.Lock()
+	defer o.rotateMu.Unlock()
+
+	if ext := fileCompressions[o.config.Compress]; ext != "" && filepath.Ext(closed) != ext {
+		if err := compressFile(closed, o.config.Compress); err != nil {
+			log.Printf("[FILE-OUTPUT] can't compress %s: %v", closed, err)
+		}
+	}
+	if o.config.RetentionFiles <= 0 && o.config.RetentionSize <= 0 {
+		return
+	}
+
+	// the files of the template, with any date, host, index and compression
+	pattern := o.pathTemplate
+	for name := range dateFileNameFuncs {
+		pattern = strings.Replace(pattern, name, "*", -1)
+	}
+	ext := filepath.Ext(pattern)
+	names, _ := filepath.Glob(strings.TrimSuffix(pattern, ext) + "*" + ext + "*")
+	type file struct {
+		name string
+		os.FileInfo
+	}
+	var files []file
+	var total int64
+	for _, name := range names {
+		if stat, err := os.Stat(name); err == nil && stat.Mode().IsRegular() {
+			files = append(files, file{name, stat})
+			total += stat.Size()
+		}
+	}
+	// the oldest first
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].ModTime().Equal(files[j].ModTime()) {
+			return sortByFileIndex{files[i].name, files[j].name}.Less(0, 1)
+		}
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+
+	count := len(files)
+	for _, f := range files {
+		if (o.config.RetentionFiles <= 0 || count <= o.config.RetentionFiles) &&
+			(o.config.RetentionSize <= 0 || total <= int64(o.config.RetentionSize)) {
+			break
+		}
+		if filepath.Clean(f.name) == filepath.Clean(current) {
+			continue
+		}
+		if err := os.Remove(f.name); err != nil {
+			log.Printf("[FILE-OUTPUT] can't delete %s: %v", f.name, err)
+			continue
+		}
+		Debug(2, fmt.Sprintf("[FILE-OUTPUT] deleted %s beyond the retention", f.name))
+		count--
+		total -= f.Size()
+	}
+}
+
+// compressFile compresses the file to the file with the extension of the compression, and removes it
+func compressFile(name, compression string) (err error) {
+	src, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dstName := name + fileCompressions[compression]
+	dst, err := os.OpenFile(dstName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0660)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(dstName)
+		}
+	}()
+
+	var w io.WriteCloser
+	if compression == "zstd" {
+		w, _ = zstd.NewWriter(dst, zstd.WithEncoderConcurrency(1))
+	} else {
+		w = gzip.NewWriter(dst)
+	}
+	if _, err = io.Copy(w, src); err == nil {
+		err = w.Close()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	src.Close()
+	return os.Remove(name)
+}
+
+// Close closes the output file that is being written to, and waits for its compression.
 func (o *FileOutput) Close() error {
 	o.Lock()
 	defer o.Unlock()
-	return o.closeLocked()
+	err := o.closeLocked()
+	o.rotating.Wait()
+	return err
 }
 
 // IsClosed returns if the output file is closed or not.
@@ -3,8 +3,10 @@ package main
 import (
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"reflect"
 	"sort"
 	"sync"
@@ -165,6 +167,76 @@ func TestFileOutputCompression(t *testing.T) {
 	os.Remove(name)
 }
 
+func TestFileOutputZstd(t *testing.T) {
+	name := fmt.Sprintf("/tmp/%d.zst", rand.Int63())
+	output := NewFileOutput(name, &FileOutputConfig{Append: true, FlushInterval: time.Minute})
+	for i := 0; i < 1000; i++ {
+		output.Write([]byte("1 1 1\r\ntest"))
+	}
+	output.Close()
+	defer os.Remove(name)
+
+	if s, _ := os.Stat(name); s.Size() >= 12*1000 {
+		t.Error("Should be compressed file:", s.Size())
+	}
+	reader := NewFileInputReader(name)
+	if reader == nil {
+		t.Fatal("expected the zstd file to be read")
+	}
+	if data := reader.ReadPayload(); string(data) != "1 1 1\r\ntest" {
+		t.Errorf("unexpected payload %q", data)
+	}
+	reader.Close()
+}
+
+func TestFileOutputRotation(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gor_rotation")
+	defer os.RemoveAll(dir)
+
+	output := NewFileOutput(filepath.Join(dir, "%host.gor"), &FileOutputConfig{
+		FlushInterval:  time.Minute,
+		RotateInterval: 50 * time.Millisecond,
+		Compress:       "gzip",
+		RetentionFiles: 3,
+	})
+	for i := 0; i < 5; i++ {
+		output.Write([]byte("1 1 1\r\ntest"))
+		time.Sleep(60 * time.Millisecond)
+	}
+	output.Close()
+
+	names, _ := filepath.Glob(filepath.Join(dir, "*"))
+	sort.Strings(names)
+	var expected []string
+	for i := 2; i < 5; i++ {
+		expected = append(expected, filepath.Join(dir, fmt.Sprintf("%s_%d.gor.gz", hostname, i)))
+	}
+	if !reflect.DeepEqual(names, expected) {
+		t.Fatalf("expected the 3 last chunks compressed, got %q", names)
+	}
+	reader := NewFileInputReader(names[0])
+	if reader == nil {
+		t.Fatal("expected the compressed chunk to be read")
+	}
+	if data := reader.ReadPayload(); string(data) != "1 1 1\r\ntest" {
+		t.Errorf("unexpected payload %q", data)
+	}
+	reader.Close()
+}
+
+func TestS3OutputKeyPath(t *testing.T) {
+	o := &S3Output{
+		pathTemplate: "s3://bucket/logs/requests.gz",
+		buffer:       &FileOutput{},
+		config:       &FileOutputConfig{S3: S3OutputConfig{Partition: true, Service: "my api"}},
+	}
+	bucket, key := o.keyPath(2)
+	expected := "logs/dt=" + time.Now().Format("2006-01-02") + "/hour=" + time.Now().Format("15") + "/service=my%20api/requests_2.gz"
+	if bucket != "bucket" || key != expected {
+		t.Errorf("expected the key %q, got %q %q", expected, bucket, key)
+	}
+}
+
 func TestGetFileIndex(t *testing.T) {
 	var tests = []struct {
 		path  string
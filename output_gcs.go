@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/buger/goreplay/size"
+)
+
+// gcsScope is the OAuth scope of the access tokens of the GCS output
+const gcsScope = "https://www.googleapis.com/auth/devstorage.read_write"
+
+// GCSOutputConfig is the configuration of the uploads of the file output to Google Cloud Storage
+type GCSOutputConfig struct {
+	Credentials string    `json:"output-file-gcs-credentials"`
+	ChunkSize   size.Size `json:"output-file-gcs-chunk-size"`
+	MaxRetries  int       `json:"output-file-gcs-max-retries"`
+}
+
+// GCSOutput output plugin. like the S3 output, the payloads are written to a buffer file with the chunking and the
+// rotation of the file output, and the files are uploaded to the bucket when they are closed. the files are
+// uploaded with the resumable uploads of the JSON API, in chunks of ChunkSize, each chunk is retried MaxRetries
+// times. the access tokens are the ones of the service account of Credentials, or of the metadata server, like
+// with workload identity on GKE. the output uploads to the emulator at STORAGE_EMULATOR_HOST if it is set
+type GCSOutput struct {
+	// Keep this as first element of struct because it guarantees 64bit
+	// alignment. atomic.* functions crash on 32bit machines if operand is not
+	// aligned at 64bit. See https://github.com/golang/go/issues/599
+	uploaded int64
+	failed   int64
+
+	pathTemplate string
+	endpoint     string
+	emulator     bool // no authentication
+
+	buffer  *FileOutput
+	config  *FileOutputConfig
+	client  *http.Client
+	auth    *googleAuth
+	closeCh chan struct{}
+}
+
+// NewGCSOutput constructor for GCSOutput, accepts path, gs://<bucket>/<object>
+func NewGCSOutput(pathTemplate string, config *FileOutputConfig) *GCSOutput {
+	o := new(GCSOutput)
+	o.pathTemplate = pathTemplate
+	if bucket, object := parseGCSUrl(pathTemplate); bucket == "" || object == "" {
+		log.Fatalf("output-file: invalid GCS path %q, expected gs://<bucket>/<object>", pathTemplate)
+	}
+	// the config is copied, the callback of the buffer is the one of this output
+	c := *config
+	o.config = &c
+	o.config.onClose = o.onBufferUpdate
+
+	if o.config.BufferPath == "" {
+		o.config.BufferPath = "/tmp"
+	}
+	// the chunks of the resumable uploads are multiples of 256KB
+	if o.config.GCS.ChunkSize <= 0 {
+		o.config.GCS.ChunkSize = 8 << 20
+	}
+	o.config.GCS.ChunkSize = (o.config.GCS.ChunkSize + 256<<10 - 1) / (256 << 10) * (256 << 10)
+	if o.config.GCS.MaxRetries < 0 {
+		o.config.GCS.MaxRetries = 0
+	}
+
+	o.endpoint = "https://storage.googleapis.com"
+	if host := os.Getenv("STORAGE_EMULATOR_HOST"); host != "" {
+		o.endpoint = host
+		if !strings.Contains(host, "://") {
+			o.endpoint = "http://" + host
+		}
+		o.emulator = true
+	}
+	o.client = &http.Client{Timeout: 5 * time.Minute}
+	o.auth = &googleAuth{credentials: o.config.GCS.Credentials, scope: gcsScope, client: o.client}
+
+	bufferName := fmt.Sprintf("gor_output_gcs_%d_buf_", rand.Int63())
+	pathParts := strings.Split(pathTemplate, "/")
+	bufferName += pathParts[len(pathParts)-1]
+	if strings.HasSuffix(o.pathTemplate, ".gz") {
+		bufferName += ".gz"
+	} else if strings.HasSuffix(o.pathTemplate, ".zst") {
+		bufferName += ".zst"
+	}
+
+	o.buffer = NewFileOutput(filepath.Join(o.config.BufferPath, bufferName), o.config)
+
+	return o
+}
+
+func (o *GCSOutput) Write(data []byte) (n int, err error) {
+	return o.buffer.Write(data)
+}
+
+func (o *GCSOutput) String() string {
+	return fmt.Sprintf("GCS output: %s, uploaded: %d, failed: %d", o.pathTemplate,
+		atomic.LoadInt64(&o.uploaded), atomic.LoadInt64(&o.failed))
+}
+
+// Close closes the buffer, uploading it
+func (o *GCSOutput) Close() error {
+	return o.buffer.Close()
+}
+
+func parseGCSUrl(path string) (bucket, object string) {
+	path = strings.TrimPrefix(path, "gs://")
+	if sep := strings.IndexByte(path, '/'); sep != -1 {
+		return path[:sep], path[sep+1:]
+	}
+	return path, ""
+}
+
+func (o *GCSOutput) keyPath(idx int) (bucket, object string) {
+	bucket, object = parseGCSUrl(o.pathTemplate)
+
+	for name, fn := range dateFileNameFuncs {
+		object = strings.Replace(object, name, fn(o.buffer), -1)
+	}
+
+	// the buffers of the appending outputs have no index
+	if idx != -1 {
+		object = setFileIndex(object, idx)
+	}
+	return
+}
+
+func (o *GCSOutput) onBufferUpdate(path string) {
+	defer os.Remove(path)
+	bucket, object := o.keyPath(getFileIndex(path))
+
+	if err := o.upload(path, bucket, object); err != nil {
+		atomic.AddInt64(&o.failed, 1)
+		log.Printf("[GCS Output] Failed to upload data to %s/%s, %s\n", bucket, object, err)
+		return
+	}
+	atomic.AddInt64(&o.uploaded, 1)
+	Debug(2, fmt.Sprintf("[GCS-OUTPUT] uploaded %s/%s", bucket, object))
+
+	if o.closeCh != nil {
+		o.closeCh <- struct{}{}
+	}
+}
+
+// upload uploads the file with a resumable upload, the chunks failing with a retryable status are sent again
+func (o *GCSOutput) upload(path, bucket, object string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	total := stat.Size()
+
+	var session string
+	err = o.retry(func() (bool, error) {
+		metadata, _ := json.Marshal(map[string]string{"name": object})
+		req, err := http.NewRequest(http.MethodPost, o.endpoint+"/upload/storage/v1/b/"+url.PathEscape(bucket)+"/o?uploadType=resumable", bytes.NewReader(metadata))
+		if err != nil {
+			return false, err
+		}
+		req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+		req.Header.Set("X-Upload-Content-Length", fmt.Sprint(total))
+		resp, body, retryable, err := o.do(req)
+		if err != nil {
+			return retryable, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return gcsRetryable(resp.StatusCode), fmt.Errorf("status %d: %s", resp.StatusCode, bytes.TrimSpace(body))
+		}
+		if session = resp.Header.Get("Location"); session == "" {
+			return false, fmt.Errorf("no session URI in the response")
+		}
+		return false, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	chunk := make([]byte, o.config.GCS.ChunkSize)
+	for offset := int64(0); ; {
+		n, err := file.ReadAt(chunk, offset)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		var done bool
+		err = o.retry(func() (bool, error) {
+			req, err := http.NewRequest(http.MethodPut, session, bytes.NewReader(chunk[:n]))
+			if err != nil {
+				return false, err
+			}
+			if n == 0 {
+				req.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", total))
+			} else {
+				req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+int64(n)-1, total))
+			}
+			resp, body, retryable, err := o.do(req)
+			if err != nil {
+				return retryable, err
+			}
+			switch resp.StatusCode {
+			case http.StatusOK, http.StatusCreated:
+				done = true
+				return false, nil
+			case http.StatusPermanentRedirect:
+				// the chunk is persisted
+				return false, nil
+			}
+			return gcsRetryable(resp.StatusCode), fmt.Errorf("status %d: %s", resp.StatusCode, bytes.TrimSpace(body))
+		})
+		if err != nil || done {
+			return err
+		}
+		if n == 0 {
+			return fmt.Errorf("the upload of %d bytes was not completed", total)
+		}
+		offset += int64(n)
+	}
+}
+
+// do sends the request with the access token, it reports whether the request can be retried on errors
+func (o *GCSOutput) do(req *http.Request) (resp *http.Response, body []byte, retryable bool, err error) {
+	if !o.emulator {
+		token, err := o.auth.accessToken()
+		if err != nil {
+			return nil, nil, true, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if resp, err = o.client.Do(req); err != nil {
+		return nil, nil, true, err
+	}
+	defer resp.Body.Close()
+	body, _ = ioutil.ReadAll(resp.Body)
+	if resp.StatusCode == http.StatusUnauthorized {
+		// the token is requested again
+		o.auth.reset()
+	}
+	return resp, body, false, nil
+}
+
+// retry calls fn until it succeeds, fails with an error that can't be retried, or was retried MaxRetries times, with
+// a backoff of 100ms doubled on each retry up to 5s
+func (o *GCSOutput) retry(fn func() (bool, error)) error {
+	for retry := 1; ; retry++ {
+		retryable, err := fn()
+		if err == nil || !retryable || retry > o.config.GCS.MaxRetries {
+			return err
+		}
+		Debug(1, fmt.Sprintf("[GCS-OUTPUT] retrying the upload: %v", err))
+		backoff := time.Duration(100<<uint(retry-1)) * time.Millisecond
+		if backoff > 5*time.Second {
+			backoff = 5 * time.Second
+		}
+		time.Sleep(backoff)
+	}
+}
+
+// gcsRetryable reports whether the requests failing with the status can be retried
+func gcsRetryable(status int) bool {
+	switch status {
+	case http.StatusUnauthorized, http.StatusRequestTimeout, http.StatusTooManyRequests, http.StatusInternalServerError,
+		http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
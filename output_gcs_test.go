@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGCSOutput(t *testing.T) {
+	var mu sync.Mutex
+	var object string
+	var uploaded bytes.Buffer
+	var ranges []string
+	failed := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/upload/storage/v1/b/bucket/o" && r.URL.Query().Get("uploadType") == "resumable":
+			body, _ := ioutil.ReadAll(r.Body)
+			object = string(body)
+			w.Header().Set("Location", "http://"+r.Host+"/session")
+		case r.Method == http.MethodPut && r.URL.Path == "/session":
+			// the second chunk fails once
+			if len(ranges) == 1 && !failed {
+				failed = true
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			ranges = append(ranges, r.Header.Get("Content-Range"))
+			data, _ := ioutil.ReadAll(r.Body)
+			uploaded.Write(data)
+			if !strings.HasSuffix(r.Header.Get("Content-Range"), "/300000") || uploaded.Len() < 300000 {
+				w.WriteHeader(http.StatusPermanentRedirect)
+			}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	os.Setenv("STORAGE_EMULATOR_HOST", server.URL)
+	defer os.Unsetenv("STORAGE_EMULATOR_HOST")
+
+	o := NewGCSOutput("gs://bucket/logs/requests.gor", &FileOutputConfig{
+		Append:        true,
+		FlushInterval: time.Minute,
+		GCS:           GCSOutputConfig{ChunkSize: 200 << 10, MaxRetries: 1},
+	})
+	payload := []byte("1 1 1\n" + strings.Repeat("a", 300000-len("1 1 1\n")-len(payloadSeparator)))
+	o.Write(payload)
+	o.Close()
+
+	if object != `{"name":"logs/requests.gor"}` {
+		t.Errorf("unexpected object %s", object)
+	}
+	if len(ranges) != 2 || ranges[0] != "bytes 0-262143/300000" || ranges[1] != "bytes 262144-299999/300000" {
+		t.Errorf("expected 2 chunks of 256kb, got %q", ranges)
+	}
+	if uploaded.String() != string(payload)+payloadSeparator {
+		t.Errorf("unexpected data of %d bytes", uploaded.Len())
+	}
+	if o.uploaded != 1 || o.failed != 0 {
+		t.Errorf("expected the file to be uploaded, got %s", o)
+	}
+}
+
+func TestGCSOutputKeyPath(t *testing.T) {
+	o := &GCSOutput{pathTemplate: "gs://bucket/logs/%Y/requests.gz", buffer: &FileOutput{}}
+	bucket, object := o.keyPath(1)
+	if expected := "logs/" + time.Now().Format("2006") + "/requests_1.gz"; bucket != "bucket" || object != expected {
+		t.Errorf("expected the object %q, got %q %q", expected, bucket, object)
+	}
+}
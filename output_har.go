@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/buger/goreplay/proto"
+)
+
+// HAROutputConfig is the configuration of the HAR output
+type HAROutputConfig struct {
+	MaxEntries      int           `json:"output-har-max-entries"`
+	ResponseTimeout time.Duration `json:"output-har-response-timeout"`
+}
+
+// HAROutput writes the HTTP requests and their responses as an HTTP Archive, which opens in the network panel of
+// the browsers. the archive is written on Close, or every MaxEntries entries to files numbered after the path:
+// capture.har, capture-1.har, capture-2.har... the requests whose response is not received in ResponseTimeout
+// are written without it
+type HAROutput struct {
+	sync.Mutex
+	path     string
+	config   *HAROutputConfig
+	entries  []*harEntry
+	pending  map[string]*harPending // by the id of the request
+	files    int
+	written  int
+	lastScan time.Time
+}
+
+type harPending struct {
+	entry *harEntry
+	seen  time.Time
+}
+
+// the HAR 1.2 format, see http://www.softwareishard.com/blog/har-12-spec/
+
+type harFile struct {
+	Log harLog `json:"log"`
+}
+
+type harLog struct {
+	Version string      `json:"version"`
+	Creator harCreator  `json:"creator"`
+	Entries []*harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"` // in milliseconds
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	Comment         string      `json:"comment,omitempty"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type harContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+// harTimings are in milliseconds, -1 for the ones which are not known. the latency of the recorded responses is
+// the wait, from the end of the request to the start of the response
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// NewHAROutput constructor for HAROutput, path is the file of the archive
+func NewHAROutput(path string, config *HAROutputConfig) io.Writer {
+	o := new(HAROutput)
+	o.path = path
+	o.config = config
+	if o.config.ResponseTimeout <= 0 {
+		o.config.ResponseTimeout = 5 * time.Second
+	}
+	if err := ioutil.WriteFile(path, nil, 0660); err != nil {
+		log.Fatalf("output-har: %v", err)
+	}
+	o.pending = make(map[string]*harPending)
+	o.lastScan = time.Now()
+	return o
+}
+
+// Write adds the requests to the archive, their entries are completed by their recorded responses
+func (o *HAROutput) Write(data []byte) (n int, err error) {
+	n = len(data)
+	meta := payloadMeta(data)
+	if len(meta) < 3 || !isOriginPayload(data) {
+		return
+	}
+	id := string(meta[1])
+	msg := payloadBody(data)
+
+	o.Lock()
+	defer o.Unlock()
+	now := time.Now()
+	if now.Sub(o.lastScan) > o.config.ResponseTimeout/2 {
+		o.lastScan = now
+		o.expire(now.Add(-o.config.ResponseTimeout))
+	}
+	if isRequestPayload(data) {
+		if !proto.HasRequestTitle(msg) {
+			return
+		}
+		ts, _ := strconv.ParseInt(string(meta[2]), 10, 64)
+		o.pending[id] = &harPending{entry: harRequestEntry(msg, ts), seen: now}
+		return
+	}
+	p, ok := o.pending[id]
+	if !ok || !proto.HasResponseTitle(msg) {
+		return
+	}
+	delete(o.pending, id)
+	var latency int64
+	if len(meta) > 3 {
+		latency, _ = strconv.ParseInt(string(meta[3]), 10, 64)
+	}
+	p.entry.Response = harHTTPResponse(msg)
+	p.entry.Time = float64(latency) / float64(time.Millisecond)
+	p.entry.Timings = harTimings{Send: 0, Wait: p.entry.Time, Receive: 0}
+	err = o.add(p.entry)
+	return
+}
+
+// expire adds the entries of the requests seen before t without their response
+func (o *HAROutput) expire(t time.Time) {
+	var expired []*harEntry
+	for id, p := range o.pending {
+		if p.seen.Before(t) {
+			delete(o.pending, id)
+			expired = append(expired, p.entry)
+		}
+	}
+	sort.Slice(expired, func(i, j int) bool {
+		return expired[i].StartedDateTime < expired[j].StartedDateTime
+	})
+	for _, e := range expired {
+		e.Comment = "no response"
+		o.add(e)
+	}
+}
+
+// add adds the entry, and writes the archive when it has MaxEntries entries
+func (o *HAROutput) add(e *harEntry) error {
+	o.entries = append(o.entries, e)
+	if o.config.MaxEntries > 0 && len(o.entries) >= o.config.MaxEntries {
+		return o.flush()
+	}
+	return nil
+}
+
+// flush writes the entries to the next file of the archive
+func (o *HAROutput) flush() error {
+	if len(o.entries) == 0 && o.files > 0 {
+		return nil
+	}
+	path := o.path
+	if o.files > 0 {
+		ext := filepath.Ext(path)
+		path = fmt.Sprintf("%s-%d%s", strings.TrimSuffix(path, ext), o.files, ext)
+	}
+	entries := o.entries
+	if entries == nil {
+		entries = []*harEntry{}
+	}
+	data, err := json.MarshalIndent(harFile{Log: harLog{
+		Version: "1.2",
+		Creator: harCreator{Name: "goreplay", Version: VERSION},
+		Entries: entries,
+	}}, "", "  ")
+	if err == nil {
+		err = ioutil.WriteFile(path, data, 0660)
+	}
+	if err != nil {
+		Debug(1, fmt.Sprintf("[HAR-OUTPUT] %s: %v", path, err))
+		return err
+	}
+	o.files++
+	o.written += len(o.entries)
+	o.entries = nil
+	return nil
+}
+
+// harRequestEntry returns the entry of the request, ts is its timestamp in nanoseconds
+func harRequestEntry(msg []byte, ts int64) *harEntry {
+	e := new(harEntry)
+	e.StartedDateTime = time.Unix(0, ts).UTC().Format("2006-01-02T15:04:05.000Z07:00")
+	e.Timings = harTimings{Send: 0, Wait: -1, Receive: -1}
+	r := &e.Request
+	r.Method = string(proto.Method(msg))
+	r.HTTPVersion = harTitleProto(msg, true)
+	headers := harHeaders(msg)
+	r.Headers = headers
+	path := string(proto.Path(msg))
+	r.URL = path
+	if !strings.Contains(path, "://") {
+		r.URL = "http://" + string(proto.Header(msg, []byte("Host"))) + path
+	}
+	r.QueryString = []harNameValue{}
+	if u, err := url.Parse(path); err == nil {
+		query := u.Query()
+		names := make([]string, 0, len(query))
+		for name := range query {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			for _, value := range query[name] {
+				r.QueryString = append(r.QueryString, harNameValue{name, value})
+			}
+		}
+	}
+	r.Cookies = []harNameValue{}
+	for _, c := range (&http.Request{Header: harHTTPHeader(headers)}).Cookies() {
+		r.Cookies = append(r.Cookies, harNameValue{c.Name, c.Value})
+	}
+	r.HeadersSize, r.BodySize = harSizes(msg)
+	if body := messageBody(msg); len(body) > 0 {
+		r.PostData = &harPostData{MimeType: string(proto.Header(msg, []byte("Content-Type"))), Text: string(body)}
+	}
+	return e
+}
+
+// harHTTPResponse returns the response of an entry
+func harHTTPResponse(msg []byte) harResponse {
+	var r harResponse
+	r.Status, _ = strconv.Atoi(string(proto.Status(msg)))
+	r.HTTPVersion = harTitleProto(msg, false)
+	if end := bytes.IndexByte(msg, '\n'); end > 13 {
+		r.StatusText = string(bytes.TrimRight(msg[13:end], "\r"))
+	}
+	r.Headers = harHeaders(msg)
+	r.Cookies = []harNameValue{}
+	for _, c := range (&http.Response{Header: harHTTPHeader(r.Headers)}).Cookies() {
+		r.Cookies = append(r.Cookies, harNameValue{c.Name, c.Value})
+	}
+	r.RedirectURL = string(proto.Header(msg, []byte("Location")))
+	r.HeadersSize, r.BodySize = harSizes(msg)
+	body := messageBody(msg)
+	r.Content = harContent{Size: len(body), MimeType: string(proto.Header(msg, []byte("Content-Type")))}
+	if utf8.Valid(body) {
+		r.Content.Text = string(body)
+	} else {
+		r.Content.Text = base64.StdEncoding.EncodeToString(body)
+		r.Content.Encoding = "base64"
+	}
+	return r
+}
+
+// harTitleProto returns the protocol of the title of the message, the last word of the requests or the first one of
+// the responses
+func harTitleProto(msg []byte, request bool) string {
+	end := bytes.IndexByte(msg, '\n')
+	if end == -1 {
+		return ""
+	}
+	title := bytes.TrimRight(msg[:end], "\r")
+	if request {
+		return string(title[bytes.LastIndexByte(title, ' ')+1:])
+	}
+	if i := bytes.IndexByte(title, ' '); i > 0 {
+		return string(title[:i])
+	}
+	return ""
+}
+
+// harHeaders returns the headers of the message in their order
+func harHeaders(msg []byte) []harNameValue {
+	headers := []harNameValue{}
+	proto.ParseHeaders([][]byte{msg}, func(name, value []byte) {
+		headers = append(headers, harNameValue{string(name), string(value)})
+	})
+	return headers
+}
+
+func harHTTPHeader(headers []harNameValue) http.Header {
+	h := make(http.Header)
+	for _, nv := range headers {
+		h.Add(nv.Name, nv.Value)
+	}
+	return h
+}
+
+// harSizes returns the size of the title and the headers of the message, and of its body as it was sent
+func harSizes(msg []byte) (headers, body int) {
+	end := proto.MIMEHeadersEndPos(msg)
+	if end == -1 {
+		return len(msg), 0
+	}
+	return end, len(msg) - end
+}
+
+func (o *HAROutput) String() string {
+	o.Lock()
+	defer o.Unlock()
+	return fmt.Sprintf("HAR output: %s, %d entries written", o.path, o.written)
+}
+
+// Close writes the entries left, with the requests still waiting for their response
+func (o *HAROutput) Close() error {
+	o.Lock()
+	defer o.Unlock()
+	o.expire(time.Now().Add(time.Hour))
+	return o.flush()
+}
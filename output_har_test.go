@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func readHAR(t *testing.T, path string) harFile {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var har harFile
+	if err := json.Unmarshal(data, &har); err != nil {
+		t.Fatalf("invalid archive %s: %v", data, err)
+	}
+	return har
+}
+
+func TestHAROutput(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gor_har")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "capture.har")
+
+	output := NewHAROutput(path, &HAROutputConfig{})
+	output.Write([]byte("1 a1 1600000000123000000 0\nPOST /users?b=2&a=1 HTTP/1.1\r\nHost: api\r\nCookie: s=1\r\nContent-Type: application/json\r\nContent-Length: 7\r\n\r\n{\"a\":1}"))
+	output.Write([]byte("1 a2 1600000001000000000 0\nGET /slow HTTP/1.1\r\nHost: api\r\n\r\n"))
+	output.Write([]byte("2 a1 1600000000123000000 25000000\nHTTP/1.1 201 Created\r\nSet-Cookie: t=2\r\nTransfer-Encoding: chunked\r\n\r\n2\r\nok\r\n0\r\n\r\n"))
+	output.(*HAROutput).Close()
+
+	har := readHAR(t, path)
+	if har.Log.Version != "1.2" || har.Log.Creator.Name != "goreplay" || len(har.Log.Entries) != 2 {
+		t.Fatalf("unexpected archive %+v", har.Log)
+	}
+	e := har.Log.Entries[0]
+	if e.StartedDateTime != "2020-09-13T12:26:40.123Z" || e.Time != 25 || e.Timings.Wait != 25 {
+		t.Errorf("unexpected timings %+v", e)
+	}
+	r := e.Request
+	if r.Method != "POST" || r.URL != "http://api/users?b=2&a=1" || r.HTTPVersion != "HTTP/1.1" || r.BodySize != 7 ||
+		r.PostData == nil || r.PostData.Text != `{"a":1}` || r.PostData.MimeType != "application/json" {
+		t.Errorf("unexpected request %+v", r)
+	}
+	if len(r.QueryString) != 2 || r.QueryString[0] != (harNameValue{"a", "1"}) || len(r.Cookies) != 1 || r.Cookies[0] != (harNameValue{"s", "1"}) {
+		t.Errorf("unexpected query or cookies %+v", r)
+	}
+	resp := e.Response
+	if resp.Status != 201 || resp.StatusText != "Created" || resp.Content.Text != "ok" || resp.Content.Size != 2 ||
+		len(resp.Cookies) != 1 || resp.Cookies[0] != (harNameValue{"t", "2"}) {
+		t.Errorf("unexpected response %+v", resp)
+	}
+	if slow := har.Log.Entries[1]; slow.Request.URL != "http://api/slow" || slow.Response.Status != 0 || slow.Comment != "no response" {
+		t.Errorf("expected the request without response, got %+v", slow)
+	}
+}
+
+func TestHAROutputMaxEntries(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gor_har")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "capture.har")
+
+	output := NewHAROutput(path, &HAROutputConfig{MaxEntries: 1})
+	for _, id := range []string{"a1", "a2"} {
+		output.Write([]byte("1 " + id + " 1 0\nGET / HTTP/1.1\r\nHost: api\r\n\r\n"))
+		output.Write([]byte("2 " + id + " 1 1\nHTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"))
+	}
+	output.(*HAROutput).Close()
+
+	for _, p := range []string{path, filepath.Join(dir, "capture-1.har")} {
+		if har := readHAR(t, p); len(har.Log.Entries) != 1 {
+			t.Errorf("expected an entry in %s, got %d", p, len(har.Log.Entries))
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "capture-2.har")); !os.IsNotExist(err) {
+		t.Errorf("expected no third file, got %v", err)
+	}
+}
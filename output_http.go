@@ -1,9 +1,13 @@
 package main
 
 import (
+	"bytes"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"log"
+	"net"
+	"strings"
 	"sync/atomic"
 	"time"
 
@@ -28,6 +32,10 @@ func newHTTPWorker(output *HTTPOutput, queue chan []byte) *httpWorker {
 		OriginalHost:       output.config.OriginalHost,
 		Timeout:            output.config.Timeout,
 		ResponseBufferSize: int(output.config.BufferSize),
+		HTTP2:              output.config.HTTP2,
+		ExpectContinue:     output.config.ExpectContinue,
+		Dialer:             output.dialer,
+		TLSConfig:          output.tlsConfig,
 	})
 
 	w := &httpWorker{client: client}
@@ -44,6 +52,7 @@ func newHTTPWorker(output *HTTPOutput, queue chan []byte) *httpWorker {
 			case payload := <-w.queue:
 				output.sendRequest(client, payload)
 			case <-w.stop:
+				client.Disconnect()
 				return
 			}
 		}
@@ -70,13 +79,57 @@ type HTTPOutputConfig struct {
 	Workers    int
 	QueueLen   int `json:"output-http-queue-len"`
 
-	ElasticSearch string `json:"output-http-elasticsearch"`
+	ElasticSearch       string `json:"output-http-elasticsearch"`
+	ElasticSearchConfig ESConfig
 
 	Timeout      time.Duration `json:"output-http-timeout"`
 	OriginalHost bool          `json:"output-http-original-host"`
 	BufferSize   size.Size     `json:"output-http-response-buffer"`
 
-	CompatibilityMode bool `json:"output-http-compatibility-mode"`
+	CompatibilityMode bool   `json:"output-http-compatibility-mode"`
+	HTTP2             bool   `json:"output-http-http2"`
+	ExpectContinue    string `json:"output-http-expect-continue"`
+	Recompress        bool   `json:"output-http-recompress"`
+
+	// the HTTP/2 connections shared by the workers, and the limit of the streams in progress on each of them
+	HTTP2Connections int `json:"output-http-http2-connections"`
+	HTTP2MaxStreams  int `json:"output-http-http2-max-streams"`
+
+	// the connections of the workers, see httpDialer
+	MaxIdleConns    int           `json:"output-http-max-idle-conns"`
+	MaxConnsPerHost int           `json:"output-http-max-conns-per-host"`
+	IdleConnTimeout time.Duration `json:"output-http-idle-timeout"`
+	DNSRefresh      time.Duration `json:"output-http-dns-refresh"`
+	KeepAlive       time.Duration `json:"output-http-keepalive"`
+
+	// the resolution of the host of the target, see dnsResolver
+	DNSResolver string        `json:"output-http-dns-resolver"`
+	DNSHosts    MultiOption   `json:"output-http-dns-host"`
+	DNSTTL      time.Duration `json:"output-http-dns-ttl"`
+
+	// the TLS of the connections to the target, see newClientTLSConfig
+	TLSCert       string `json:"output-http-tls-cert"`
+	TLSKey        string `json:"output-http-tls-key"`
+	TLSCA         string `json:"output-http-tls-ca"`
+	TLSServerName string `json:"output-http-tls-server-name"`
+	TLSSkipVerify bool   `json:"output-http-tls-skip-verify"`
+
+	// the requests failing with a connection error, a timeout, 429, 502, 503 or 504 are retried MaxRetries times,
+	// with a backoff from RetryBackoff doubled on each retry, if their method is one of RetryMethods, the idempotent
+	// methods by default
+	MaxRetries   int           `json:"output-http-max-retries"`
+	RetryBackoff time.Duration `json:"output-http-retry-backoff"`
+	RetryMethods MultiOption   `json:"output-http-retry-method"`
+
+	// the circuit of the target opens when BreakerThreshold of the requests of BreakerWindow fail, with
+	// BreakerMinRequests requests at least, and the requests are dropped for BreakerCooldown
+	BreakerThreshold   float64       `json:"output-http-breaker-threshold"`
+	BreakerMinRequests int           `json:"output-http-breaker-min-requests"`
+	BreakerWindow      time.Duration `json:"output-http-breaker-window"`
+	BreakerCooldown    time.Duration `json:"output-http-breaker-cooldown"`
+
+	MaxHeaderSize  size.Size `json:"output-http-max-header-size"`
+	MaxHeaderCount int       `json:"output-http-max-header-count"`
 
 	RequestGroup string
 
@@ -93,6 +146,9 @@ type HTTPOutput struct {
 	// alignment. atomic.* functions crash on 32bit machines if operand is not
 	// aligned at 64bit. See https://github.com/golang/go/issues/599
 	activeWorkers int64
+	retried       int64 // the retries of the failed requests
+	failed        int64 // the requests still failing after their retries
+	dropped       int64 // the requests dropped while the circuit of the target is open
 
 	workerSessions map[string]*httpWorker
 
@@ -110,6 +166,13 @@ type HTTPOutput struct {
 
 	elasticSearch *ESPlugin
 
+	http2Pool *http2Pool
+	dialer    *httpDialer
+	tlsConfig *tls.Config
+
+	breaker      *circuitBreaker
+	retryMethods map[string]bool // nil for all the methods
+
 	stop chan bool // Channel used only to indicate goroutine should shutdown
 }
 
@@ -122,6 +185,14 @@ func NewHTTPOutput(address string, config *HTTPOutputConfig) io.Writer {
 	o.config = config
 	o.stop = make(chan bool)
 
+	switch o.config.ExpectContinue {
+	case "":
+		o.config.ExpectContinue = "wait"
+	case "wait", "strip":
+	default:
+		log.Fatalf("output-http: unsupported expect-continue %q, it is wait or strip", o.config.ExpectContinue)
+	}
+
 	if o.config.Stats {
 		o.queueStats = NewGorStat("output_http", o.config.StatsMs)
 	}
@@ -137,9 +208,49 @@ func NewHTTPOutput(address string, config *HTTPOutputConfig) io.Writer {
 		o.needWorker <- o.config.WorkersMax
 	}
 
+	resolver, err := newDNSResolver(o.config.DNSResolver, o.config.DNSHosts, o.config.DNSTTL)
+	if err != nil {
+		log.Fatalf("output-http: %v", err)
+	}
+	o.dialer = newHTTPDialer(o.config.KeepAlive, o.config.MaxConnsPerHost, o.config.MaxIdleConns, o.config.IdleConnTimeout, o.config.DNSRefresh, resolver)
+	if o.tlsConfig, err = newClientTLSConfig(o.config.TLSCert, o.config.TLSKey, o.config.TLSCA, o.config.TLSServerName, o.config.TLSSkipVerify); err != nil {
+		log.Fatalf("output-http: %v", err)
+	}
+
+	// the requests of the workers are multiplexed on the streams of the HTTP/2 connections, the workers of the
+	// TCP sessions have their own connection
+	if o.config.HTTP2 && !o.config.CompatibilityMode {
+		dialer := NewHTTPClient(o.address, &HTTPClientConfig{Timeout: o.config.Timeout, HTTP2: true, Dialer: o.dialer, TLSConfig: o.tlsConfig})
+		o.http2Pool = newHTTP2Pool(dialer.dial, o.config.HTTP2Connections, o.config.HTTP2MaxStreams)
+	}
+
+	if o.config.MaxRetries > 0 {
+		if o.config.RetryBackoff <= 0 {
+			o.config.RetryBackoff = 100 * time.Millisecond
+		}
+		methods := o.config.RetryMethods
+		if len(methods) == 0 {
+			methods = MultiOption{"GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE"}
+		}
+		o.retryMethods = make(map[string]bool)
+		for _, m := range methods {
+			if m == "*" {
+				o.retryMethods = nil
+				break
+			}
+			o.retryMethods[strings.ToUpper(m)] = true
+		}
+	}
+	if o.config.BreakerThreshold < 0 || o.config.BreakerThreshold > 1 {
+		log.Fatalf("output-http: the breaker threshold %v is not a ratio between 0 and 1", o.config.BreakerThreshold)
+	}
+	if o.config.BreakerThreshold > 0 {
+		o.breaker = newCircuitBreaker(o.address, o.config.BreakerThreshold, o.config.BreakerMinRequests, o.config.BreakerWindow, o.config.BreakerCooldown)
+	}
+
 	if o.config.ElasticSearch != "" {
 		o.elasticSearch = new(ESPlugin)
-		o.elasticSearch.Init(o.config.ElasticSearch)
+		o.elasticSearch.Init(o.config.ElasticSearch, &o.config.ElasticSearchConfig)
 	}
 
 	if Settings.RecognizeTCPSessions {
@@ -205,7 +316,14 @@ func (o *HTTPOutput) startWorker() {
 		Timeout:            o.config.Timeout,
 		ResponseBufferSize: int(o.config.BufferSize),
 		CompatibilityMode:  o.config.CompatibilityMode,
+		HTTP2:              o.config.HTTP2,
+		ExpectContinue:     o.config.ExpectContinue,
+		HTTP2Pool:          o.http2Pool,
+		Dialer:             o.dialer,
+		TLSConfig:          o.tlsConfig,
 	})
+	// the connection of the worker is closed when it stops
+	defer client.Disconnect()
 
 	for {
 		select {
@@ -303,13 +421,68 @@ func (o *HTTPOutput) sendRequest(client *HTTPClient, request []byte) {
 	if !proto.HasRequestTitle(body) {
 		return
 	}
+	if err := checkHeaderLimits(body, o.config.MaxHeaderSize, o.config.MaxHeaderCount, false); err != nil {
+		headerLimitStats.add("output-http", err)
+		Debug(2, "[OUTPUT-HTTP] request dropped:", err)
+		return
+	}
+	if o.config.Recompress {
+		body = recompressHTTPBody(body)
+	} else {
+		body = proto.DeleteHeader(body, decodedEncodingHeader)
+	}
+
+	if o.breaker != nil && !o.breaker.allow() {
+		atomic.AddInt64(&o.dropped, 1)
+		Debug(2, "[OUTPUT-HTTP] request dropped, the circuit of", o.address, "is open")
+		return
+	}
+
+	retries := 0
+	if o.config.MaxRetries > 0 && (o.retryMethods == nil || o.retryMethods[string(proto.Method(body))]) {
+		retries = o.config.MaxRetries
+	}
 
-	start := time.Now()
-	resp, err := client.Send(body)
-	stop := time.Now()
+	var start, stop time.Time
+	var resp []byte
+	for retry := 0; ; retry++ {
+		data := body
+		if retries > 0 {
+			// the client may rewrite the request in place
+			data = append([]byte(nil), body...)
+		}
+		start = time.Now()
+		var err error
+		resp, err = client.Send(data)
+		stop = time.Now()
 
-	if err != nil {
-		Debug(1, "Error when sending ", err)
+		if err != nil {
+			Debug(1, "Error when sending ", err)
+		}
+
+		failed := httpRetryable(resp, err)
+		if o.breaker != nil {
+			o.breaker.record(failed)
+		}
+		if !failed {
+			break
+		}
+		if retry >= retries {
+			atomic.AddInt64(&o.failed, 1)
+			break
+		}
+		if o.breaker != nil && !o.breaker.allow() {
+			atomic.AddInt64(&o.dropped, 1)
+			Debug(2, "[OUTPUT-HTTP] retry dropped, the circuit of", o.address, "is open")
+			break
+		}
+		atomic.AddInt64(&o.retried, 1)
+		backoff := o.config.RetryBackoff << uint(retry)
+		if backoff > 10*time.Second || backoff <= 0 {
+			backoff = 10 * time.Second
+		}
+		Debug(2, fmt.Sprintf("[OUTPUT-HTTP] retrying the request %s in %s, status %s", uuid, backoff, httpStatus(resp)))
+		time.Sleep(backoff)
 	}
 
 	if o.config.TrackResponses {
@@ -322,11 +495,40 @@ func (o *HTTPOutput) sendRequest(client *HTTPClient, request []byte) {
 }
 
 func (o *HTTPOutput) String() string {
-	return "HTTP output: " + o.address
+	return fmt.Sprintf("HTTP output: %s, retried: %d, failed: %d, dropped: %d", o.address,
+		atomic.LoadInt64(&o.retried), atomic.LoadInt64(&o.failed), atomic.LoadInt64(&o.dropped))
+}
+
+// httpRetryable reports whether the response is a failure of the target that can be retried: an error of the
+// client, like a connection error or a timeout, 429, 502, 503 or 504
+func httpRetryable(resp []byte, err error) bool {
+	if len(resp) == 0 {
+		_, ok := err.(net.Error)
+		return ok
+	}
+	switch string(httpStatus(resp)) {
+	case HTTP_UNKNOWN_ERROR, HTTP_CONNECTION_ERROR, HTTP_TIMEOUT, "429", "502", "503", "504":
+		return true
+	}
+	return false
+}
+
+// httpStatus returns the status of the response, the error payloads of the client have no valid reason phrase
+func httpStatus(resp []byte) []byte {
+	if len(resp) < 12 || !bytes.HasPrefix(resp, []byte("HTTP/")) {
+		return nil
+	}
+	return resp[9:12]
 }
 
 // Close closes the data channel so that data
 func (o *HTTPOutput) Close() error {
 	close(o.stop)
+	if o.http2Pool != nil {
+		o.http2Pool.Close()
+	}
+	if o.elasticSearch != nil {
+		o.elasticSearch.IndexerShutdown()
+	}
 	return nil
 }
@@ -212,3 +212,79 @@ func BenchmarkHTTPOutput(b *testing.B) {
 	wg.Wait()
 	emitter.Close()
 }
+
+func TestHTTPOutputRetries(t *testing.T) {
+	var mu sync.Mutex
+	calls := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		calls[req.Method]++
+		n := calls[req.Method]
+		mu.Unlock()
+		// the first 2 GET requests and all the POST requests fail
+		if req.Method == "POST" || n <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	o := NewHTTPOutput(server.URL, &HTTPOutputConfig{MaxRetries: 3, RetryBackoff: time.Millisecond}).(*HTTPOutput)
+	defer o.Close()
+	client := NewHTTPClient(server.URL, &HTTPClientConfig{})
+	o.sendRequest(client, []byte("1 a 1 0\nGET / HTTP/1.1\r\n\r\n"))
+	o.sendRequest(client, []byte("1 b 1 0\nPOST / HTTP/1.1\r\nContent-Length: 1\r\n\r\na"))
+
+	if calls["GET"] != 3 || calls["POST"] != 1 {
+		t.Errorf("expected the GET request to be retried only, got %v", calls)
+	}
+	if o.retried != 2 || o.failed != 1 || o.dropped != 0 {
+		t.Errorf("unexpected counters %s", o)
+	}
+}
+
+func TestHTTPOutputCircuitBreaker(t *testing.T) {
+	var mu sync.Mutex
+	var calls int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	o := NewHTTPOutput(server.URL, &HTTPOutputConfig{BreakerThreshold: 0.5, BreakerMinRequests: 4, BreakerCooldown: time.Minute}).(*HTTPOutput)
+	defer o.Close()
+	client := NewHTTPClient(server.URL, &HTTPClientConfig{})
+	for i := 0; i < 10; i++ {
+		o.sendRequest(client, []byte("1 a 1 0\nGET / HTTP/1.1\r\n\r\n"))
+	}
+
+	if calls != 4 || o.dropped != 6 || o.failed != 4 {
+		t.Errorf("expected the requests to be dropped once 4 requests failed, got %d requests, %s", calls, o)
+	}
+}
+
+func TestHTTPOutputRetryTimeout(t *testing.T) {
+	var mu sync.Mutex
+	var calls int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		calls++
+		n := calls
+		mu.Unlock()
+		if n == 1 {
+			time.Sleep(100 * time.Millisecond)
+		}
+	}))
+	defer server.Close()
+
+	o := NewHTTPOutput(server.URL, &HTTPOutputConfig{MaxRetries: 1, RetryBackoff: time.Millisecond, Timeout: 50 * time.Millisecond}).(*HTTPOutput)
+	defer o.Close()
+	client := NewHTTPClient(server.URL, &HTTPClientConfig{Timeout: 50 * time.Millisecond})
+	o.sendRequest(client, []byte("1 a 1 0\nGET / HTTP/1.1\r\n\r\n"))
+
+	if calls != 2 || o.retried != 1 || o.failed != 0 {
+		t.Errorf("expected the request timing out to be retried, got %d requests, %s", calls, o)
+	}
+}
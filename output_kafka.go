@@ -17,6 +17,7 @@ import (
 type KafkaOutput struct {
 	config   *OutputKafkaConfig
 	producer sarama.AsyncProducer
+	schemaID int // the id of the schema of the serialization in the registry
 }
 
 // KafkaOutputFrequency in milliseconds
@@ -39,6 +40,10 @@ func NewKafkaOutputWithTLS(address string, config *OutputKafkaConfig, tlsConfig
 		c.Producer.RequiredAcks = sarama.WaitForLocal
 		c.Producer.Compression = sarama.CompressionSnappy
 		c.Producer.Flush.Frequency = KafkaOutputFrequency * time.Millisecond
+		if config.Headers && !c.Version.IsAtLeast(sarama.V0_11_0_0) {
+			// the record headers are part of the message format v2
+			c.Version = sarama.V0_11_0_0
+		}
 
 		brokerList := strings.Split(config.Host, ",")
 
@@ -54,6 +59,19 @@ func NewKafkaOutputWithTLS(address string, config *OutputKafkaConfig, tlsConfig
 		producer: producer,
 	}
 
+	if config.Serialization != "" {
+		if config.Serialization != KafkaAvro && config.Serialization != KafkaProtobuf {
+			log.Fatalf("output-kafka: unsupported serialization %q, expected avro or protobuf", config.Serialization)
+		}
+		if config.SchemaRegistry == "" {
+			log.Fatal("output-kafka: --output-kafka-schema-registry is required by --output-kafka-serialization")
+		}
+		var err error
+		if o.schemaID, err = registerKafkaSchema(config.SchemaRegistry, config.Topic, config.Serialization); err != nil {
+			log.Fatalf("output-kafka: %v", err)
+		}
+	}
+
 	// Start infinite loop for tracking errors for kafka producer.
 	go o.ErrorHandler()
 
@@ -68,36 +86,77 @@ func (o *KafkaOutput) ErrorHandler() {
 }
 
 func (o *KafkaOutput) Write(data []byte) (n int, err error) {
-	var message sarama.StringEncoder
+	var message sarama.Encoder
 
-	if !o.config.UseJSON {
-		message = sarama.StringEncoder(data)
-	} else {
-		headers := make(map[string]string)
-		proto.ParseHeaders([][]byte{data}, func(header []byte, value []byte) {
-			headers[string(header)] = string(value)
-		})
-
-		meta := payloadMeta(data)
-		req := payloadBody(data)
-
-		kafkaMessage := KafkaMessage{
-			ReqURL:     string(proto.Path(req)),
-			ReqType:    string(meta[0]),
-			ReqID:      string(meta[1]),
-			ReqTs:      string(meta[2]),
-			ReqMethod:  string(proto.Method(req)),
-			ReqBody:    string(proto.Body(req)),
-			ReqHeaders: headers,
-		}
-		jsonMessage, _ := json.Marshal(&kafkaMessage)
+	switch {
+	case o.config.Serialization != "":
+		message = sarama.ByteEncoder(serializeKafkaMessage(kafkaMessage(data), o.config.Serialization, o.schemaID))
+	case o.config.UseJSON:
+		jsonMessage, _ := json.Marshal(kafkaMessage(data))
 		message = sarama.StringEncoder(jsonMessage)
+	default:
+		message = sarama.StringEncoder(data)
 	}
 
-	o.producer.Input() <- &sarama.ProducerMessage{
+	msg := &sarama.ProducerMessage{
 		Topic: o.config.Topic,
 		Value: message,
 	}
+	if key := o.key(data); key != nil {
+		msg.Key = sarama.ByteEncoder(key)
+	}
+	if o.config.Headers {
+		msg.Headers = kafkaRecordHeaders(data)
+	}
+	o.producer.Input() <- msg
 
-	return len(message), nil
+	return message.Length(), nil
+}
+
+// kafkaMessage returns the KafkaMessage of the payload
+func kafkaMessage(data []byte) *KafkaMessage {
+	meta := payloadMeta(data)
+	req := payloadBody(data)
+
+	headers := make(map[string]string)
+	proto.ParseHeaders([][]byte{req}, func(header []byte, value []byte) {
+		headers[string(header)] = string(value)
+	})
+
+	return &KafkaMessage{
+		ReqURL:           string(proto.Path(req)),
+		ReqURLNormalized: normalizedURL(req),
+		ReqType:          string(meta[0]),
+		ReqID:            string(meta[1]),
+		ReqTs:            string(meta[2]),
+		ReqMethod:        string(proto.Method(req)),
+		ReqBody:          string(proto.Body(req)),
+		ReqHeaders:       headers,
+	}
+}
+
+// key returns the key of the record of the payload, so that the payloads with the same key go to the same
+// partition. the payloads without the header of the key, like the responses, are keyed by their UUID
+func (o *KafkaOutput) key(data []byte) []byte {
+	if o.config.Key == "" {
+		return nil
+	}
+	return payloadPartitionKey(o.config.Key, data)
+}
+
+// kafkaRecordHeaders returns the meta of the payload as record headers: gor-type, gor-id, gor-timestamp,
+// gor-latency, and gor-src with the address of the client of the requests if --input-raw-realip-header is set
+func kafkaRecordHeaders(data []byte) (headers []sarama.RecordHeader) {
+	meta := payloadMeta(data)
+	for i, key := range []string{"gor-type", "gor-id", "gor-timestamp", "gor-latency"} {
+		if i < len(meta) {
+			headers = append(headers, sarama.RecordHeader{Key: []byte(key), Value: meta[i]})
+		}
+	}
+	if Settings.RealIPHeader != "" && isRequestPayload(data) {
+		if src := proto.Header(payloadBody(data), []byte(Settings.RealIPHeader)); len(src) > 0 {
+			headers = append(headers, sarama.RecordHeader{Key: []byte("gor-src"), Value: src})
+		}
+	}
+	return
 }
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+	"github.com/buger/goreplay/proto"
+)
+
+// KafkaProduceOutput re-produces the records of the Produce requests recorded with --input-raw-protocol kafka to
+// a cluster, e.g. a staging one. the records keep their key, value and headers, and are sent to the partition
+// they were produced to when KeepPartition is set, else to the partition of their key. their timestamp is the
+// time they are re-produced at, and the batches of transaction markers are skipped.
+type KafkaProduceOutput struct {
+	// Keep this as first element of struct because it guarantees 64bit
+	// alignment. atomic.* functions crash on 32bit machines if operand is not
+	// aligned at 64bit. See https://github.com/golang/go/issues/599
+	records int64
+	bytes   int64
+
+	brokers  string
+	config   *KafkaProduceOutputConfig
+	producer sarama.AsyncProducer
+}
+
+// NewKafkaProduceOutput constructor for KafkaProduceOutput, address is the comma separated list of the brokers
+func NewKafkaProduceOutput(address string, config *KafkaProduceOutputConfig, tlsConfig *KafkaTLSConfig) io.Writer {
+	o := &KafkaProduceOutput{brokers: address, config: config}
+	if mock, ok := config.producer.(*mocks.AsyncProducer); ok && mock != nil {
+		o.producer = config.producer
+	} else {
+		c := NewKafkaConfig(tlsConfig)
+		// the records have headers
+		c.Version = sarama.V0_11_0_0
+		c.Producer.RequiredAcks = sarama.WaitForLocal
+		c.Producer.Flush.Frequency = KafkaOutputFrequency * time.Millisecond
+		if config.KeepPartition {
+			c.Producer.Partitioner = sarama.NewManualPartitioner
+		}
+		var err error
+		if o.producer, err = sarama.NewAsyncProducer(strings.Split(address, ","), c); err != nil {
+			log.Fatalln("output-kafka-produce: failed to start the producer:", err)
+		}
+	}
+	go func() {
+		for err := range o.producer.Errors() {
+			Debug(1, "[KAFKA-PRODUCE-OUTPUT]", err)
+		}
+	}()
+	return o
+}
+
+// Write re-produces the records of the Produce requests
+func (o *KafkaProduceOutput) Write(data []byte) (n int, err error) {
+	n = len(data)
+	if !isRequestPayload(data) {
+		return
+	}
+	r, ok := proto.ParseKafkaRequest(payloadBody(data))
+	if !ok || r.APIKey != proto.KafkaProduce {
+		return
+	}
+	p, ok := proto.ParseKafkaProduce(r)
+	if !ok {
+		Debug(1, "[KAFKA-PRODUCE-OUTPUT] invalid produce request")
+		return
+	}
+	for _, t := range p.Topics {
+		for _, partition := range t.Partitions {
+			batches, err := proto.ParseKafkaRecordBatches(partition.Records)
+			if err != nil {
+				Debug(1, fmt.Sprintf("[KAFKA-PRODUCE-OUTPUT] records of %s/%d: %v", t.Name, partition.Index, err))
+				continue
+			}
+			for _, b := range batches {
+				if b.IsControl() {
+					continue
+				}
+				for _, rec := range b.Records {
+					o.produce(t.Name, partition.Index, rec)
+				}
+			}
+		}
+	}
+	return
+}
+
+func (o *KafkaProduceOutput) produce(topic string, partition int32, rec proto.KafkaRecord) {
+	msg := &sarama.ProducerMessage{Topic: topic, Partition: partition}
+	// the null keys and values are kept null
+	if rec.Key != nil {
+		msg.Key = sarama.ByteEncoder(rec.Key)
+	}
+	if rec.Value != nil {
+		msg.Value = sarama.ByteEncoder(rec.Value)
+	}
+	for _, h := range rec.Headers {
+		msg.Headers = append(msg.Headers, sarama.RecordHeader{Key: []byte(h.Key), Value: h.Value})
+	}
+	o.producer.Input() <- msg
+	atomic.AddInt64(&o.records, 1)
+	atomic.AddInt64(&o.bytes, int64(len(rec.Key)+len(rec.Value)))
+}
+
+func (o *KafkaProduceOutput) String() string {
+	return fmt.Sprintf("Kafka produce output: %s, %d records, %d bytes", o.brokers, atomic.LoadInt64(&o.records), atomic.LoadInt64(&o.bytes))
+}
+
+// Close flushes the records in flight
+func (o *KafkaProduceOutput) Close() error {
+	return o.producer.Close()
+}
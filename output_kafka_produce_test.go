@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+	"github.com/buger/goreplay/proto"
+)
+
+func TestKafkaProduceOutput(t *testing.T) {
+	config := sarama.NewConfig()
+	config.Producer.Return.Successes = true
+	producer := mocks.NewAsyncProducer(t, config)
+	producer.ExpectInputAndSucceed()
+	producer.ExpectInputAndSucceed()
+
+	output := NewKafkaProduceOutput("", &KafkaProduceOutputConfig{producer: producer, KeepPartition: true}, nil)
+	records := []proto.KafkaRecord{
+		{Key: []byte("k"), Value: []byte("v"), Headers: []proto.KafkaHeader{{Key: "h", Value: []byte("x")}}},
+		{Key: []byte("deleted")},
+	}
+	batches := append(proto.AppendKafkaRecordBatch(nil, proto.KafkaRecordBatch{Records: records}),
+		// the marker of a transaction
+		proto.AppendKafkaRecordBatch(nil, proto.KafkaRecordBatch{Attributes: 0x30, Records: []proto.KafkaRecord{{Key: []byte{0, 0, 0, 0}}}})...)
+	request := proto.AppendKafkaProduce(nil, proto.KafkaRequest{APIVersion: 9}, proto.KafkaProduceRequest{Acks: -1, Topics: []proto.KafkaProduceTopic{
+		{Name: "orders", Partitions: []proto.KafkaProducePartition{{Index: 2, Records: batches}}},
+	}})
+	output.Write(append(payloadHeader(RequestPayload, []byte("1"), 1, 0), request...))
+	// the responses are not produced
+	output.Write(append(payloadHeader(ResponsePayload, []byte("1"), 1, 0), 0, 0, 0, 4, 0, 0, 0, 0))
+
+	for _, e := range records {
+		msg := <-producer.Successes()
+		key, _ := msg.Key.Encode()
+		if msg.Topic != "orders" || msg.Partition != 2 || string(key) != string(e.Key) {
+			t.Errorf("unexpected message %+v", msg)
+		}
+		if e.Value == nil {
+			if msg.Value != nil {
+				t.Error("expected a null value")
+			}
+			continue
+		}
+		if value, _ := msg.Value.Encode(); string(value) != string(e.Value) || len(msg.Headers) != 1 || string(msg.Headers[0].Key) != "h" {
+			t.Errorf("unexpected message %+v", msg)
+		}
+	}
+	if err := output.(*KafkaProduceOutput).Close(); err != nil {
+		t.Error(err)
+	}
+}
@@ -1,6 +1,14 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/Shopify/sarama"
@@ -52,3 +60,171 @@ func TestOutputKafkaJSON(t *testing.T) {
 		t.Error("Message not properly encoded: ", string(data))
 	}
 }
+
+func TestKafkaSASLConfig(t *testing.T) {
+	tests := []struct {
+		sasl KafkaSASLConfig
+		ok   bool
+	}{
+		{KafkaSASLConfig{}, true},
+		{KafkaSASLConfig{Mechanism: "PLAIN", User: "gor", Password: "secret"}, true},
+		{KafkaSASLConfig{Mechanism: "scram-sha-256", User: "gor", Password: "secret"}, true},
+		{KafkaSASLConfig{Mechanism: "SCRAM-SHA-512", User: "gor", Password: "secret"}, true},
+		{KafkaSASLConfig{Mechanism: "OAUTHBEARER", Token: "token"}, true},
+		{KafkaSASLConfig{Mechanism: "SCRAM-SHA-512", User: "gor"}, false},
+		{KafkaSASLConfig{Mechanism: "OAUTHBEARER"}, false},
+		{KafkaSASLConfig{Mechanism: "GSSAPI", User: "gor", Password: "secret"}, false},
+	}
+	for _, tt := range tests {
+		config := sarama.NewConfig()
+		err := tt.sasl.configure(config)
+		if (err == nil) != tt.ok {
+			t.Errorf("%+v: unexpected error %v", tt.sasl, err)
+			continue
+		}
+		if err == nil {
+			if err = config.Validate(); err != nil {
+				t.Errorf("%+v: invalid sarama config %v", tt.sasl, err)
+			}
+		}
+	}
+}
+
+func TestKafkaSCRAMClient(t *testing.T) {
+	// the exchange of RFC 7677
+	c := &kafkaSCRAMClient{hash: sha256.New}
+	c.Begin("user", "pencil", "")
+	c.scram.nonce = "rOprNGfwEbeRWgbNEkqO"
+
+	steps := []struct{ challenge, response string }{
+		{"", "n,,n=user,r=rOprNGfwEbeRWgbNEkqO"},
+		{"r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096", "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="},
+		{"v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=", ""},
+	}
+	for i, s := range steps {
+		if c.Done() {
+			t.Fatalf("step %d: done too early", i)
+		}
+		response, err := c.Step(s.challenge)
+		if err != nil || response != s.response {
+			t.Fatalf("step %d: expected %q, got %q %v", i, s.response, response, err)
+		}
+	}
+	if !c.Done() {
+		t.Error("expected the exchange to be done")
+	}
+
+	c = &kafkaSCRAMClient{hash: sha256.New}
+	c.Begin("user", "pencil", "")
+	c.scram.nonce = "rOprNGfwEbeRWgbNEkqO"
+	c.Step("")
+	c.Step(steps[1].challenge)
+	if _, err := c.Step("v=AAAA"); err == nil || !c.Done() {
+		t.Error("expected the server signature to be rejected")
+	}
+}
+
+func TestKafkaTokenProvider(t *testing.T) {
+	f, _ := ioutil.TempFile("", "token")
+	defer os.Remove(f.Name())
+	f.WriteString("first\n")
+	f.Close()
+
+	p := kafkaTokenProvider{file: f.Name()}
+	if token, err := p.Token(); err != nil || token.Token != "first" {
+		t.Errorf("expected the token of the file, got %+v %v", token, err)
+	}
+	ioutil.WriteFile(f.Name(), []byte("second"), 0600)
+	if token, _ := p.Token(); token.Token != "second" {
+		t.Errorf("expected the refreshed token, got %+v", token)
+	}
+}
+
+func TestOutputKafkaKeyAndHeaders(t *testing.T) {
+	config := sarama.NewConfig()
+	config.Producer.Return.Successes = true
+	producer := mocks.NewAsyncProducer(t, config)
+
+	output := NewKafkaOutput("", &OutputKafkaConfig{
+		producer: producer,
+		Topic:    "test",
+		Key:      "X-Session-Id",
+		Headers:  true,
+	})
+
+	tests := []struct {
+		payload string
+		key     string
+	}{
+		{"1 2 3 -1\nGET / HTTP/1.1\r\nX-Session-Id: abc\r\n\r\n", "abc"},
+		{"2 2 4 1\nHTTP/1.1 200 OK\r\n\r\n", "2"},
+	}
+	for _, tt := range tests {
+		producer.ExpectInputAndSucceed()
+		output.Write([]byte(tt.payload))
+		msg := <-producer.Successes()
+
+		if key, _ := msg.Key.Encode(); string(key) != tt.key {
+			t.Errorf("expected key %q, got %q", tt.key, key)
+		}
+		meta := payloadMeta([]byte(tt.payload))
+		if len(msg.Headers) != 4 {
+			t.Fatalf("expected 4 headers, got %d", len(msg.Headers))
+		}
+		for i, key := range []string{"gor-type", "gor-id", "gor-timestamp", "gor-latency"} {
+			if h := msg.Headers[i]; string(h.Key) != key || string(h.Value) != string(meta[i]) {
+				t.Errorf("expected header %s: %s, got %s: %s", key, meta[i], h.Key, h.Value)
+			}
+		}
+	}
+}
+
+func TestOutputKafkaSchemaRegistry(t *testing.T) {
+	var subjects []string
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, _ := r.BasicAuth()
+		var body struct{ Schema, SchemaType string }
+		json.NewDecoder(r.Body).Decode(&body)
+		if r.Method != http.MethodPost || user != "gor" || password != "secret" || body.Schema == "" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		subjects = append(subjects, r.URL.Path+" "+body.SchemaType)
+		w.Write([]byte(`{"id":258}`))
+	}))
+	defer registry.Close()
+	registryURL := strings.Replace(registry.URL, "://", "://gor:secret@", 1)
+
+	payload := "1 2 3 -1\nGET /a HTTP/1.1\r\nB: b\r\nA: a\r\n\r\nhi"
+	tests := []struct {
+		serialization string
+		record        string
+	}{
+		{KafkaAvro, "\x00\x00\x00\x01\x02" + "\x04/a" + "\x00" + "\x021" + "\x022" + "\x023" + "\x06GET" + "\x04hi" +
+			"\x04" + "\x02A\x02a" + "\x02B\x02b" + "\x00"},
+		{KafkaProtobuf, "\x00\x00\x00\x01\x02" + "\x00" + "\x0a\x02/a" + "\x1a\x011" + "\x22\x012" + "\x2a\x013" +
+			"\x32\x03GET" + "\x3a\x02hi" + "\x42\x06\x0a\x01A\x12\x01a" + "\x42\x06\x0a\x01B\x12\x01b"},
+	}
+	for _, tt := range tests {
+		config := sarama.NewConfig()
+		config.Producer.Return.Successes = true
+		producer := mocks.NewAsyncProducer(t, config)
+		producer.ExpectInputAndSucceed()
+
+		output := NewKafkaOutput("", &OutputKafkaConfig{
+			producer:       producer,
+			Topic:          "requests",
+			Serialization:  tt.serialization,
+			SchemaRegistry: registryURL,
+		})
+		output.Write([]byte(payload))
+		msg := <-producer.Successes()
+
+		if record, _ := msg.Value.Encode(); string(record) != tt.record {
+			t.Errorf("%s: expected %q, got %q", tt.serialization, tt.record, record)
+		}
+	}
+	if expected := []string{"/subjects/requests-value/versions ", "/subjects/requests-value/versions PROTOBUF"}; !reflect.DeepEqual(subjects, expected) {
+		t.Errorf("expected subjects %q, got %q", expected, subjects)
+	}
+}
@@ -0,0 +1,519 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+)
+
+// the limits of the PutRecords requests
+const (
+	kinesisMaxRecords     = 500
+	kinesisMaxRecordSize  = 1 << 20
+	kinesisMaxRequestSize = 5 << 20
+)
+
+// kinesisAggregateMagic starts the records aggregated like the Kinesis Producer Library does, see
+// https://github.com/awslabs/amazon-kinesis-producer/blob/master/aggregation-format.md
+var kinesisAggregateMagic = []byte{0xf3, 0x89, 0x9a, 0xc2}
+
+// KinesisOutputConfig is the configuration of the Kinesis output
+type KinesisOutputConfig struct {
+	Region        string        `json:"output-kinesis-region"`
+	Endpoint      string        `json:"output-kinesis-endpoint"`
+	PartitionKey  string        `json:"output-kinesis-partition-key"` // uuid, random, or the name of an HTTP header
+	Aggregate     bool          `json:"output-kinesis-aggregate"`
+	AggregateSize int           `json:"output-kinesis-aggregate-size"`
+	BatchDelay    time.Duration `json:"output-kinesis-batch-delay"`
+	MaxRetries    int           `json:"output-kinesis-max-retries"`
+	Timeout       time.Duration `json:"output-kinesis-timeout"`
+}
+
+// KinesisOutput puts the requests and the responses, in the format of the payloads, to a Kinesis data stream
+// with the PutRecords API. the payloads are sent in batches, the records failing for the throughput of their
+// shard are retried with an exponential backoff, up to MaxRetries times. with Aggregate, the payloads going to
+// the same shard are aggregated in records of at most AggregateSize bytes, in the format of the Kinesis Producer
+// Library, the Kinesis Client Library and the Lambda deaggregation modules restore them.
+type KinesisOutput struct {
+	// Keep this as first element of struct because it guarantees 64bit
+	// alignment. atomic.* functions crash on 32bit machines if operand is not
+	// aligned at 64bit. See https://github.com/golang/go/issues/599
+	put     int64 // payloads
+	records int64 // records of the stream, with aggregated payloads
+	retries int64
+	failed  int64
+
+	stream   string
+	config   *KinesisOutputConfig
+	signer   *v4.Signer
+	client   *http.Client
+	messages chan []byte
+	queuing  sync.RWMutex // done is closed once the payloads being written are queued
+	done     chan struct{}
+	finished chan struct{}
+	stop     sync.Once
+
+	shards        []kinesisShard // by starting hash key, for the aggregation
+	shardsUpdated time.Time
+}
+
+// kinesisShard is the range of hash keys of a shard
+type kinesisShard struct {
+	start, end *big.Int
+}
+
+// kinesisRecord is a record of the PutRecords requests
+type kinesisRecord struct {
+	Data            []byte `json:"Data"`
+	PartitionKey    string `json:"PartitionKey"`
+	ExplicitHashKey string `json:"ExplicitHashKey,omitempty"`
+
+	payloads int
+}
+
+// NewKinesisOutput constructor for KinesisOutput, address is the name of the stream. the credentials are the ones
+// of the AWS SDK: the environment, the shared credentials and the roles of the instances and the tasks
+func NewKinesisOutput(address string, config *KinesisOutputConfig) io.Writer {
+	o := new(KinesisOutput)
+	o.stream = address
+	o.config = config
+	if o.config.Region == "" {
+		if o.config.Region = os.Getenv("AWS_REGION"); o.config.Region == "" {
+			o.config.Region = os.Getenv("AWS_DEFAULT_REGION")
+		}
+	}
+	if o.config.Region == "" {
+		log.Fatal("output-kinesis: the region of the stream is required, set --output-kinesis-region or AWS_REGION")
+	}
+	if o.config.Endpoint == "" {
+		if o.config.Endpoint = os.Getenv("AWS_ENDPOINT_URL"); o.config.Endpoint == "" {
+			o.config.Endpoint = "https://kinesis." + o.config.Region + ".amazonaws.com"
+		}
+	}
+	if o.config.PartitionKey == "" {
+		o.config.PartitionKey = "uuid"
+	}
+	if o.config.AggregateSize <= 0 || o.config.AggregateSize > kinesisMaxRecordSize-1024 {
+		o.config.AggregateSize = 50 << 10
+	}
+	if o.config.BatchDelay <= 0 {
+		o.config.BatchDelay = 100 * time.Millisecond
+	}
+	if o.config.MaxRetries < 0 {
+		o.config.MaxRetries = 0
+	}
+	if o.config.Timeout < time.Millisecond {
+		o.config.Timeout = 10 * time.Second
+	}
+	o.signer = awsSigner("output-kinesis", o.config.Region)
+	o.client = &http.Client{Timeout: o.config.Timeout}
+	o.messages = make(chan []byte, 10000)
+	o.done = make(chan struct{})
+	o.finished = make(chan struct{})
+	go o.run()
+	return o
+}
+
+// Write queues the payload to be put, the payloads written after Close are refused
+func (o *KinesisOutput) Write(data []byte) (n int, err error) {
+	if !isOriginPayload(data) || len(data) > kinesisMaxRecordSize-256 {
+		return len(data), nil
+	}
+	o.queuing.RLock()
+	defer o.queuing.RUnlock()
+	select {
+	case <-o.done:
+		return 0, ErrorStopped
+	default:
+	}
+	// run receives the messages until done, and puts the ones queued then
+	o.messages <- append([]byte(nil), data...)
+	return len(data), nil
+}
+
+// run collects the payloads for BatchDelay, or until a request is full, and puts them
+func (o *KinesisOutput) run() {
+	defer close(o.finished)
+	for {
+		var batch [][]byte
+		var size int
+		select {
+		case data := <-o.messages:
+			batch, size = append(batch, data), len(data)
+		case <-o.done:
+			// the payloads queued are put before closing
+			for len(o.messages) > 0 {
+				data := <-o.messages
+				batch, size = append(batch, data), size+len(data)
+			}
+			if len(batch) > 0 {
+				o.putPayloads(batch)
+			}
+			return
+		}
+		timer := time.NewTimer(o.config.BatchDelay)
+	collect:
+		for size < kinesisMaxRequestSize/2 && (o.config.Aggregate || len(batch) < kinesisMaxRecords) {
+			select {
+			case data := <-o.messages:
+				batch, size = append(batch, data), size+len(data)
+			case <-timer.C:
+				break collect
+			case <-o.done:
+				break collect
+			}
+		}
+		timer.Stop()
+		o.putPayloads(batch)
+	}
+}
+
+// putPayloads puts the payloads, aggregated or not, in requests within the limits of PutRecords
+func (o *KinesisOutput) putPayloads(payloads [][]byte) {
+	var records []kinesisRecord
+	if o.config.Aggregate {
+		records = o.aggregate(payloads)
+	} else {
+		for _, data := range payloads {
+			records = append(records, kinesisRecord{Data: data, PartitionKey: o.partitionKey(data), payloads: 1})
+		}
+	}
+	for len(records) > 0 {
+		n, size := 0, 0
+		for n < len(records) && n < kinesisMaxRecords && size+len(records[n].Data)+len(records[n].PartitionKey) <= kinesisMaxRequestSize {
+			size += len(records[n].Data) + len(records[n].PartitionKey)
+			n++
+		}
+		o.putRecords(records[:n])
+		records = records[n:]
+	}
+}
+
+// partitionKey returns the partition key of the payload, its UUID by default. the payloads without the header of
+// PartitionKey, like the responses, use their UUID
+func (o *KinesisOutput) partitionKey(data []byte) string {
+	if o.config.PartitionKey == "random" {
+		return string(uuid())
+	}
+	key := payloadPartitionKey(o.config.PartitionKey, data)
+	if len(key) > 256 {
+		key = key[:256]
+	}
+	if len(key) == 0 {
+		return "-"
+	}
+	return string(key)
+}
+
+// putRecords puts the records, the records failing with a retryable error are retried with a backoff of 100ms
+// doubled on each retry
+func (o *KinesisOutput) putRecords(records []kinesisRecord) {
+	for retry := 0; len(records) > 0; retry++ {
+		if retry > 0 {
+			if retry > o.config.MaxRetries {
+				break
+			}
+			atomic.AddInt64(&o.retries, int64(len(records)))
+			backoff := time.Duration(100<<uint(retry-1)) * time.Millisecond
+			if backoff > 5*time.Second {
+				backoff = 5 * time.Second
+			}
+			time.Sleep(backoff)
+		}
+		failed, err := o.send("PutRecords", map[string]interface{}{"StreamName": o.stream, "Records": records})
+		if err != nil {
+			Debug(1, fmt.Sprintf("[KINESIS-OUTPUT] %s: %v", o.stream, err))
+			if !isKinesisRetryable(err) {
+				break
+			}
+			continue
+		}
+		var result struct {
+			Records []struct {
+				ErrorCode    string
+				ErrorMessage string
+			}
+		}
+		json.Unmarshal(failed, &result)
+		var retried []kinesisRecord
+		for i, r := range records {
+			switch {
+			case i >= len(result.Records) || result.Records[i].ErrorCode == "":
+				atomic.AddInt64(&o.records, 1)
+				atomic.AddInt64(&o.put, int64(r.payloads))
+			case result.Records[i].ErrorCode == "ProvisionedThroughputExceededException", result.Records[i].ErrorCode == "InternalFailure":
+				retried = append(retried, r)
+			default:
+				atomic.AddInt64(&o.failed, int64(r.payloads))
+				Debug(1, fmt.Sprintf("[KINESIS-OUTPUT] %s: %s %s", o.stream, result.Records[i].ErrorCode, result.Records[i].ErrorMessage))
+			}
+		}
+		records = retried
+	}
+	for _, r := range records {
+		atomic.AddInt64(&o.failed, int64(r.payloads))
+	}
+}
+
+// kinesisError is an error of the Kinesis API
+type kinesisError struct {
+	status int
+	typ    string
+	msg    string
+}
+
+func (e *kinesisError) Error() string {
+	return fmt.Sprintf("status %d: %s %s", e.status, e.typ, e.msg)
+}
+
+// isKinesisRetryable reports whether the error is a throttling, an internal error or a network error
+func isKinesisRetryable(err error) bool {
+	e, ok := err.(*kinesisError)
+	if !ok {
+		return true
+	}
+	switch e.typ {
+	case "ProvisionedThroughputExceededException", "LimitExceededException", "ThrottlingException", "KMSThrottlingException":
+		return true
+	}
+	return e.status >= 500
+}
+
+// send calls an action of the Kinesis API, it returns the body of the response
+func (o *KinesisOutput) send(action string, input interface{}) ([]byte, error) {
+	body, _ := json.Marshal(input)
+	req, err := http.NewRequest(http.MethodPost, o.config.Endpoint+"/", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "Kinesis_20131202."+action)
+	if _, err = o.signer.Sign(req, bytes.NewReader(body), "kinesis", o.config.Region, time.Now()); err != nil {
+		return nil, err
+	}
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Type    string `json:"__type"`
+			Message string `json:"message"`
+		}
+		json.Unmarshal(respBody, &e)
+		return nil, &kinesisError{status: resp.StatusCode, typ: e.Type, msg: e.Message}
+	}
+	return respBody, nil
+}
+
+// updateShards lists the open shards of the stream, at most every minute
+func (o *KinesisOutput) updateShards() {
+	if time.Since(o.shardsUpdated) < time.Minute {
+		return
+	}
+	o.shardsUpdated = time.Now()
+	var shards []kinesisShard
+	input := map[string]interface{}{"StreamName": o.stream}
+	for {
+		body, err := o.send("ListShards", input)
+		if err != nil {
+			Debug(1, fmt.Sprintf("[KINESIS-OUTPUT] %s: listing the shards: %v", o.stream, err))
+			return
+		}
+		var result struct {
+			Shards []struct {
+				HashKeyRange struct {
+					StartingHashKey string
+					EndingHashKey   string
+				}
+				SequenceNumberRange struct {
+					EndingSequenceNumber string
+				}
+			}
+			NextToken string
+		}
+		json.Unmarshal(body, &result)
+		for _, s := range result.Shards {
+			start, ok1 := new(big.Int).SetString(s.HashKeyRange.StartingHashKey, 10)
+			end, ok2 := new(big.Int).SetString(s.HashKeyRange.EndingHashKey, 10)
+			// the closed shards, split or merged, have an ending sequence number
+			if ok1 && ok2 && s.SequenceNumberRange.EndingSequenceNumber == "" {
+				shards = append(shards, kinesisShard{start: start, end: end})
+			}
+		}
+		if result.NextToken == "" {
+			break
+		}
+		input = map[string]interface{}{"NextToken": result.NextToken}
+	}
+	sort.Slice(shards, func(i, j int) bool { return shards[i].start.Cmp(shards[j].start) < 0 })
+	o.shards = shards
+}
+
+// shard returns the index of the shard of the partition key, the one whose range holds the MD5 of the key, or -1
+func (o *KinesisOutput) shard(key string) int {
+	sum := md5.Sum([]byte(key))
+	hash := new(big.Int).SetBytes(sum[:])
+	i := sort.Search(len(o.shards), func(i int) bool { return o.shards[i].end.Cmp(hash) >= 0 })
+	if i < len(o.shards) && o.shards[i].start.Cmp(hash) <= 0 {
+		return i
+	}
+	return -1
+}
+
+// aggregate returns the records aggregating the payloads going to the same shard, with the explicit hash key of
+// the shard. without the shards of the stream, the payloads are aggregated by partition key
+func (o *KinesisOutput) aggregate(payloads [][]byte) []kinesisRecord {
+	o.updateShards()
+	type group struct {
+		hashKey string
+		agg     kinesisAggregator
+	}
+	var groups []*group
+	byShard := make(map[string]*group)
+	var records []kinesisRecord
+	for _, data := range payloads {
+		key := o.partitionKey(data)
+		id, hashKey := key, ""
+		if i := o.shard(key); i != -1 {
+			hashKey = o.shards[i].start.String()
+			id = hashKey
+		}
+		g, ok := byShard[id]
+		if !ok {
+			g = &group{hashKey: hashKey}
+			byShard[id] = g
+			groups = append(groups, g)
+		}
+		if g.agg.size(key, data) > o.config.AggregateSize && g.agg.count() > 0 {
+			records = append(records, g.agg.record(g.hashKey))
+			g.agg = kinesisAggregator{}
+		}
+		g.agg.add(key, data)
+	}
+	for _, g := range groups {
+		if g.agg.count() > 0 {
+			records = append(records, g.agg.record(g.hashKey))
+		}
+	}
+	return records
+}
+
+// kinesisAggregator builds an aggregated record, the AggregatedRecord protobuf message of the KPL
+type kinesisAggregator struct {
+	keys    []string
+	keyIdx  map[string]int
+	records []byte // the encoded records
+	first   []byte // the data of the first record
+	n       int
+}
+
+func (a *kinesisAggregator) count() int {
+	return a.n
+}
+
+// size returns the size of the aggregated record with the payload
+func (a *kinesisAggregator) size(key string, data []byte) int {
+	n := len(kinesisAggregateMagic) + md5.Size + len(a.records) + protobufFieldSize(protobufFieldSize(len(data))+11)
+	for _, k := range a.keys {
+		n += protobufFieldSize(len(k))
+	}
+	if _, ok := a.keyIdx[key]; !ok {
+		n += protobufFieldSize(len(key))
+	}
+	return n
+}
+
+func (a *kinesisAggregator) add(key string, data []byte) {
+	if a.keyIdx == nil {
+		a.keyIdx = make(map[string]int)
+	}
+	i, ok := a.keyIdx[key]
+	if !ok {
+		i = len(a.keys)
+		a.keyIdx[key] = i
+		a.keys = append(a.keys, key)
+	}
+	if a.n == 0 {
+		a.first = data
+	}
+	a.n++
+	// Record: partition_key_index = 1, data = 3
+	var record []byte
+	record = append(record, 1<<3)
+	record = appendUvarint(record, uint64(i))
+	record = appendProtobufBytes(record, 3, data)
+	a.records = appendProtobufBytes(a.records, 3, record)
+}
+
+// record returns the Kinesis record, a single payload is not aggregated
+func (a *kinesisAggregator) record(hashKey string) kinesisRecord {
+	if a.n == 1 {
+		return kinesisRecord{Data: a.first, PartitionKey: a.keys[0], ExplicitHashKey: hashKey, payloads: 1}
+	}
+	// AggregatedRecord: partition_key_table = 1, records = 3
+	var msg []byte
+	for _, k := range a.keys {
+		msg = appendProtobufBytes(msg, 1, []byte(k))
+	}
+	msg = append(msg, a.records...)
+	sum := md5.Sum(msg)
+	data := append(append(append([]byte(nil), kinesisAggregateMagic...), msg...), sum[:]...)
+	return kinesisRecord{Data: data, PartitionKey: a.keys[0], ExplicitHashKey: hashKey, payloads: a.n}
+}
+
+// protobufFieldSize returns the size of a length-delimited field of a small field number
+func protobufFieldSize(length int) int {
+	return len(appendProtobufTag(nil, 1, length)) + length
+}
+
+func appendUvarint(buf []byte, n uint64) []byte {
+	var b [binary.MaxVarintLen64]byte
+	return append(buf, b[:binary.PutUvarint(b[:], n)]...)
+}
+
+// awsSigner returns the SigV4 signer of the requests of the plugin to the AWS APIs, with the credentials of the AWS SDK
+func awsSigner(plugin, region string) *v4.Signer {
+	sess, err := session.NewSession(&aws.Config{Region: aws.String(region)})
+	if err != nil {
+		log.Fatalf("%s: %v", plugin, err)
+	}
+	return v4.NewSigner(sess.Config.Credentials)
+}
+
+func (o *KinesisOutput) String() string {
+	return fmt.Sprintf("Kinesis output: %s, put: %d, records: %d, retries: %d, failed: %d", o.stream,
+		atomic.LoadInt64(&o.put), atomic.LoadInt64(&o.records), atomic.LoadInt64(&o.retries), atomic.LoadInt64(&o.failed))
+}
+
+// Close puts the payloads queued, waiting for Timeout at most
+func (o *KinesisOutput) Close() error {
+	o.stop.Do(func() {
+		o.queuing.Lock()
+		close(o.done)
+		o.queuing.Unlock()
+	})
+	select {
+	case <-o.finished:
+	case <-time.After(o.config.Timeout):
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// deaggregateKinesisRecord returns the partition keys and the data of the records of an aggregated record
+func deaggregateKinesisRecord(t *testing.T, data []byte) (keys []string, records [][]byte) {
+	if !bytes.HasPrefix(data, kinesisAggregateMagic) {
+		return nil, [][]byte{data}
+	}
+	msg := data[len(kinesisAggregateMagic) : len(data)-md5.Size]
+	if sum := md5.Sum(msg); !bytes.Equal(sum[:], data[len(data)-md5.Size:]) {
+		t.Fatal("the checksum of the aggregated record is invalid")
+	}
+	var table []string
+	var indexes []uint64
+	fields := func(b []byte, f func(field uint64, value []byte, n uint64)) {
+		for len(b) > 0 {
+			tag, n := binary.Uvarint(b)
+			b = b[n:]
+			if tag&7 == 0 {
+				v, n := binary.Uvarint(b)
+				b = b[n:]
+				f(tag>>3, nil, v)
+				continue
+			}
+			length, n := binary.Uvarint(b)
+			f(tag>>3, b[n:n+int(length)], 0)
+			b = b[n+int(length):]
+		}
+	}
+	fields(msg, func(field uint64, value []byte, _ uint64) {
+		switch field {
+		case 1:
+			table = append(table, string(value))
+		case 3:
+			fields(value, func(field uint64, value []byte, n uint64) {
+				switch field {
+				case 1:
+					indexes = append(indexes, n)
+				case 3:
+					records = append(records, value)
+				}
+			})
+		}
+	})
+	for _, i := range indexes {
+		keys = append(keys, table[i])
+	}
+	return
+}
+
+func TestKinesisOutput(t *testing.T) {
+	os.Setenv("AWS_ACCESS_KEY_ID", "id")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	defer os.Unsetenv("AWS_ACCESS_KEY_ID")
+	defer os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+
+	var mu sync.Mutex
+	var calls int
+	received := make(map[string]string) // data by partition key
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=id/") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.Header.Get("X-Amz-Target") {
+		case "Kinesis_20131202.ListShards":
+			w.Write([]byte(`{"Shards":[
+				{"ShardId":"1","HashKeyRange":{"StartingHashKey":"0","EndingHashKey":"170141183460469231731687303715884105727"},"SequenceNumberRange":{"StartingSequenceNumber":"1"}},
+				{"ShardId":"2","HashKeyRange":{"StartingHashKey":"170141183460469231731687303715884105728","EndingHashKey":"340282366920938463463374607431768211455"},"SequenceNumberRange":{"StartingSequenceNumber":"1"}}]}`))
+		case "Kinesis_20131202.PutRecords":
+			var request struct {
+				StreamName string
+				Records    []kinesisRecord
+			}
+			json.NewDecoder(r.Body).Decode(&request)
+			mu.Lock()
+			defer mu.Unlock()
+			calls++
+			var results []map[string]string
+			for i, record := range request.Records {
+				// the first record of the first request is throttled
+				if calls == 1 && i == 0 {
+					results = append(results, map[string]string{"ErrorCode": "ProvisionedThroughputExceededException"})
+					continue
+				}
+				keys, data := deaggregateKinesisRecord(t, record.Data)
+				if keys == nil {
+					keys = []string{record.PartitionKey}
+				}
+				for j := range keys {
+					received[keys[j]] = string(data[j])
+				}
+				results = append(results, map[string]string{"SequenceNumber": "1"})
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"Records": results})
+		}
+	}))
+	defer server.Close()
+
+	o := NewKinesisOutput("traffic", &KinesisOutputConfig{
+		Region:     "us-east-1",
+		Endpoint:   server.URL,
+		Aggregate:  true,
+		BatchDelay: 50 * time.Millisecond,
+		MaxRetries: 3,
+	}).(*KinesisOutput)
+	var payloads []string
+	for i := 0; i < 20; i++ {
+		payload := "1 " + string(uuid()) + " 1 0\nGET / HTTP/1.1\r\n\r\n"
+		payloads = append(payloads, payload)
+		o.Write([]byte(payload))
+	}
+	o.Close()
+	if n, err := o.Write([]byte("1 " + string(uuid()) + " 1 0\nGET / HTTP/1.1\r\n\r\n")); n != 0 || err != ErrorStopped {
+		t.Errorf("expected the payload written after Close to be refused, got %d %v", n, err)
+	}
+
+	if len(o.shards) != 2 {
+		t.Fatalf("expected 2 shards, got %d", len(o.shards))
+	}
+	for _, payload := range payloads {
+		id := string(payloadMeta([]byte(payload))[1])
+		if received[id] != payload {
+			t.Errorf("the payload %s was not put", id)
+		}
+	}
+	if o.retries == 0 || o.failed != 0 || o.put != 20 {
+		t.Errorf("expected the throttled record to be retried, got %s", o)
+	}
+}
+
+func TestKinesisPartitionKey(t *testing.T) {
+	o := &KinesisOutput{config: &KinesisOutputConfig{PartitionKey: "X-Session"}}
+	if key := o.partitionKey([]byte("1 a 1 0\nGET / HTTP/1.1\r\nX-Session: s\r\n\r\n")); key != "s" {
+		t.Errorf("expected the header as key, got %q", key)
+	}
+	if key := o.partitionKey([]byte("2 a 1 0\nHTTP/1.1 200 OK\r\nX-Session: s\r\n\r\n")); key != "a" {
+		t.Errorf("expected the responses to be keyed by UUID, got %q", key)
+	}
+	o.config.PartitionKey = "random"
+	if o.partitionKey([]byte("1 a 1 0\nGET / HTTP/1.1\r\n\r\n")) == o.partitionKey([]byte("1 a 1 0\nGET / HTTP/1.1\r\n\r\n")) {
+		t.Error("expected random keys")
+	}
+}
+
+func TestKinesisAggregatorSize(t *testing.T) {
+	var a kinesisAggregator
+	for i := 0; i < 10; i++ {
+		key, data := string(uuid()), bytes.Repeat([]byte{'a'}, 100*i)
+		size := a.size(key, data)
+		a.add(key, data)
+		if n := len(a.record("").Data); n > size && i > 0 {
+			t.Errorf("the size %d of the aggregated record is over the estimate %d", n, size)
+		}
+	}
+}
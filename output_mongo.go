@@ -0,0 +1,303 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+)
+
+// MongoOutputConfig is the configuration of the MongoDB output
+type MongoOutputConfig struct {
+	User         string        `json:"output-mongo-user"`
+	Password     string        `json:"output-mongo-password"`
+	AuthDatabase string        `json:"output-mongo-auth-database"`
+	Timeout      time.Duration `json:"output-mongo-timeout"`
+	IdleTimeout  time.Duration `json:"output-mongo-idle-timeout"`
+}
+
+// MongoOutput replays the MongoDB connections recorded with --input-raw-protocol mongo against a shadow
+// deployment. each recorded connection is replayed on a connection authenticated with SCRAM-SHA-256 as the user
+// of the configuration, its requests are sent with the delays they were recorded with, without waiting for the
+// replies, and the replies of the target are discarded. the recorded authentication commands are skipped.
+type MongoOutput struct {
+	sync.Mutex
+	address  string
+	config   *MongoOutputConfig
+	sessions map[string]*mongoSession // by the id of the recorded connection
+}
+
+type mongoRequest struct {
+	data      []byte
+	timestamp int64 // recorded
+}
+
+// mongoSession is a connection replayed against the target
+type mongoSession struct {
+	output    *MongoOutput
+	id        string
+	timestamp int64 // of the first request
+	requests  chan mongoRequest
+	done      chan struct{}
+	stop      sync.Once
+	lock      sync.Mutex // guards conn
+	conn      net.Conn
+}
+
+// NewMongoOutput constructor for MongoOutput, address is the host:port of the target
+func NewMongoOutput(address string, config *MongoOutputConfig) io.Writer {
+	o := new(MongoOutput)
+	o.address = address
+	o.config = config
+	if o.config.AuthDatabase == "" {
+		o.config.AuthDatabase = "admin"
+	}
+	if o.config.Timeout < time.Millisecond {
+		o.config.Timeout = 5 * time.Second
+	}
+	if o.config.IdleTimeout < time.Millisecond {
+		o.config.IdleTimeout = 5 * time.Minute
+	}
+	o.sessions = make(map[string]*mongoSession)
+	return o
+}
+
+// Write queues the request to the session of its connection, the session is opened by its first request
+func (o *MongoOutput) Write(data []byte) (n int, err error) {
+	n = len(data)
+	if !isRequestPayload(data) {
+		return
+	}
+	meta := payloadMeta(data)
+	if len(meta) < 3 {
+		return
+	}
+	id := string(meta[1])
+	timestamp, _ := strconv.ParseInt(string(meta[2]), 10, 64)
+	body := payloadBody(data)
+	if proto.MongoMessageLength(body) != len(body) {
+		return
+	}
+	o.Lock()
+	s, ok := o.sessions[id]
+	if !ok {
+		s = &mongoSession{
+			output:    o,
+			id:        id,
+			timestamp: timestamp,
+			requests:  make(chan mongoRequest, 1000),
+			done:      make(chan struct{}),
+		}
+		o.sessions[id] = s
+		go s.run()
+	}
+	o.Unlock()
+	select {
+	case s.requests <- mongoRequest{data: append([]byte(nil), body...), timestamp: timestamp}:
+	case <-s.done:
+	}
+	return
+}
+
+// remove forgets the session, unless it was replaced by a session with the same id
+func (o *MongoOutput) remove(s *mongoSession) {
+	o.Lock()
+	if o.sessions[s.id] == s {
+		delete(o.sessions, s.id)
+	}
+	o.Unlock()
+}
+
+func (o *MongoOutput) String() string {
+	return fmt.Sprintf("MongoDB output: %s", o.address)
+}
+
+// Close closes the sessions in progress
+func (o *MongoOutput) Close() error {
+	o.Lock()
+	for _, s := range o.sessions {
+		s.close()
+	}
+	o.Unlock()
+	return nil
+}
+
+// run connects to the target and sends the requests until the target closes the connection, or it is idle for
+// longer than IdleTimeout. the session is forgotten on errors, the requests that follow open a new one.
+func (s *mongoSession) run() {
+	defer s.output.remove(s)
+	defer s.close()
+	if err := s.connect(); err != nil {
+		Debug(1, fmt.Sprintf("[MONGO-OUTPUT] session %s: %v", s.id, err))
+		return
+	}
+	go s.discard()
+	started := time.Now()
+	idle := time.NewTimer(s.output.config.IdleTimeout)
+	defer idle.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-idle.C:
+			return
+		case r := <-s.requests:
+			// the delay since the first request is preserved
+			if wait := time.Duration(r.timestamp-s.timestamp) - time.Since(started); wait > 0 {
+				select {
+				case <-time.After(wait):
+				case <-s.done:
+					return
+				}
+			}
+			if !mongoAuthRequest(r.data) {
+				if err := s.write(r.data); err != nil {
+					Debug(1, fmt.Sprintf("[MONGO-OUTPUT] session %s: %v", s.id, err))
+					return
+				}
+			}
+			if !idle.Stop() {
+				<-idle.C
+			}
+			idle.Reset(s.output.config.IdleTimeout)
+		}
+	}
+}
+
+// mongoAuthRequest reports whether the request is a command of the authentication of its connection
+func mongoAuthRequest(data []byte) bool {
+	c, ok := proto.ParseMongoCommand(data)
+	if !ok {
+		return false
+	}
+	switch strings.ToLower(c.Name) {
+	case "saslstart", "saslcontinue", "authenticate", "logout":
+		return true
+	}
+	return false
+}
+
+// connect connects to the target and authenticates as the user of the configuration, if any
+func (s *mongoSession) connect() (err error) {
+	o := s.output
+	conn, err := net.DialTimeout("tcp", o.address, o.config.Timeout)
+	if err != nil {
+		return
+	}
+	s.lock.Lock()
+	s.conn = conn
+	s.lock.Unlock()
+	select {
+	case <-s.done:
+		// closed while dialing
+		conn.Close()
+		return errors.New("session closed")
+	default:
+	}
+	if o.config.User == "" {
+		return
+	}
+	conn.SetDeadline(time.Now().Add(o.config.Timeout))
+	scram := newSCRAMClient(o.config.User, o.config.Password)
+	cmd := proto.AppendBSONInt32(nil, "saslStart", 1)
+	cmd = proto.AppendBSONString(cmd, "mechanism", "SCRAM-SHA-256")
+	cmd = proto.AppendBSONBinary(cmd, "payload", scram.first())
+	cmd = proto.AppendBSON(cmd, proto.BSONDocument, "options", proto.BSONDoc(proto.AppendBSONBoolean(nil, "skipEmptyExchange", true)))
+	reply, err := s.command(1, cmd)
+	if err != nil {
+		return
+	}
+	typ, id, _ := proto.BSONLookup(reply, "conversationId")
+	_, payload, _ := proto.BSONLookup(reply, "payload")
+	serverFirst, _ := proto.BSONBinaryValue(payload)
+	final, err := scram.final(serverFirst)
+	if err != nil {
+		return
+	}
+	for i := int32(2); ; i++ {
+		cmd = proto.AppendBSONInt32(nil, "saslContinue", 1)
+		cmd = proto.AppendBSON(cmd, typ, "conversationId", id)
+		cmd = proto.AppendBSONBinary(cmd, "payload", final)
+		if reply, err = s.command(i, cmd); err != nil {
+			return
+		}
+		if final != nil {
+			_, payload, _ = proto.BSONLookup(reply, "payload")
+			if serverFinal, _ := proto.BSONBinaryValue(payload); !scram.verify(serverFinal) {
+				return errors.New("invalid signature of the server")
+			}
+			final = nil
+		}
+		if typ, done, _ := proto.BSONLookup(reply, "done"); typ == proto.BSONBoolean && len(done) == 1 && done[0] == 1 {
+			break
+		}
+		if i > 4 {
+			return errors.New("authentication not done")
+		}
+	}
+	return conn.SetDeadline(time.Time{})
+}
+
+// command runs a command on the authentication database and returns its reply
+func (s *mongoSession) command(requestID int32, elements []byte) (reply []byte, err error) {
+	elements = proto.AppendBSONString(elements, "$db", s.output.config.AuthDatabase)
+	if err = s.write(proto.AppendMongoMsg(nil, requestID, proto.BSONDoc(elements))); err != nil {
+		return
+	}
+	header := make([]byte, proto.MongoHeaderLen)
+	if _, err = io.ReadFull(s.conn, header); err != nil {
+		return
+	}
+	h, ok := proto.ParseMongoHeader(header)
+	if !ok {
+		return nil, errors.New("invalid mongo message")
+	}
+	msg := append(header, make([]byte, int(h.Length)-proto.MongoHeaderLen)...)
+	if _, err = io.ReadFull(s.conn, msg[proto.MongoHeaderLen:]); err != nil {
+		return
+	}
+	if msg, err = proto.MongoDecompress(msg); err != nil {
+		return
+	}
+	if reply, ok = proto.MongoMsgBody(msg); !ok {
+		return nil, errors.New("invalid mongo reply")
+	}
+	typ, value, _ := proto.BSONLookup(reply, "ok")
+	if n, _ := proto.BSONNumber(typ, value); n != 1 {
+		_, value, _ = proto.BSONLookup(reply, "errmsg")
+		msg, _ := proto.BSONStringValue(value)
+		return nil, fmt.Errorf("authentication failed: %s", msg)
+	}
+	return
+}
+
+// discard reads and drops the replies of the target, the session is closed with the connection
+func (s *mongoSession) discard() {
+	io.Copy(ioutil.Discard, s.conn)
+	s.close()
+}
+
+// write sends messages to the target
+func (s *mongoSession) write(data []byte) error {
+	s.conn.SetWriteDeadline(time.Now().Add(s.output.config.Timeout))
+	_, err := s.conn.Write(data)
+	return err
+}
+
+func (s *mongoSession) close() {
+	s.stop.Do(func() {
+		close(s.done)
+		s.lock.Lock()
+		if s.conn != nil {
+			s.conn.Close()
+		}
+		s.lock.Unlock()
+	})
+}
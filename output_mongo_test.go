@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+func TestMongoOutput(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	commands := make(chan proto.MongoCommand, 20)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		read := func() []byte {
+			header := make([]byte, proto.MongoHeaderLen)
+			if _, err := io.ReadFull(conn, header); err != nil {
+				return nil
+			}
+			h, _ := proto.ParseMongoHeader(header)
+			msg := append(header, make([]byte, int(h.Length)-proto.MongoHeaderLen)...)
+			io.ReadFull(conn, msg[proto.MongoHeaderLen:])
+			return msg
+		}
+		reply := func(elements []byte) {
+			elements = proto.AppendBSONInt32(elements, "ok", 1)
+			conn.Write(proto.AppendMongoMsg(nil, 100, proto.BSONDoc(elements)))
+		}
+		payload := func(msg []byte) string {
+			doc, _ := proto.MongoMsgBody(msg)
+			_, value, _ := proto.BSONLookup(doc, "payload")
+			data, _ := proto.BSONBinaryValue(value)
+			return string(data)
+		}
+		// SCRAM-SHA-256
+		start := read()
+		if c, _ := proto.ParseMongoCommand(start); c.Name != "saslStart" || c.Database != "admin" {
+			t.Errorf("unexpected command %+v", c)
+			return
+		}
+		clientFirstBare := strings.TrimPrefix(payload(start), "n,,")
+		if !strings.HasPrefix(clientFirstBare, "n=replay,r=") {
+			t.Errorf("unexpected client-first-message %q", clientFirstBare)
+			return
+		}
+		salt := []byte("salt")
+		serverFirst := "r=" + strings.TrimPrefix(clientFirstBare, "n=replay,r=") + "server,s=" + base64.StdEncoding.EncodeToString(salt) + ",i=4096"
+		reply(proto.AppendBSONBinary(proto.AppendBSONBoolean(proto.AppendBSONInt32(nil, "conversationId", 1), "done", false), "payload", []byte(serverFirst)))
+		final := payload(read())
+		withoutProof := final[:strings.Index(final, ",p=")]
+		proof, _ := base64.StdEncoding.DecodeString(final[len(withoutProof)+3:])
+		salted := pbkdf2.Key([]byte("secret"), salt, 4096, sha256.Size, sha256.New)
+		storedKey := sha256.Sum256(scramHMAC(salted, []byte("Client Key")))
+		auth := []byte(clientFirstBare + "," + serverFirst + "," + withoutProof)
+		signature := scramHMAC(storedKey[:], auth)
+		for i := range proof {
+			proof[i] ^= signature[i]
+		}
+		if sum := sha256.Sum256(proof); !bytes.Equal(sum[:], storedKey[:]) {
+			t.Error("invalid SCRAM proof")
+			return
+		}
+		serverFinal := "v=" + base64.StdEncoding.EncodeToString(scramHMAC(scramHMAC(salted, []byte("Server Key")), auth))
+		reply(proto.AppendBSONBinary(proto.AppendBSONBoolean(proto.AppendBSONInt32(nil, "conversationId", 1), "done", true), "payload", []byte(serverFinal)))
+		for {
+			msg := read()
+			if msg == nil {
+				return
+			}
+			c, _ := proto.ParseMongoCommand(msg)
+			commands <- c
+			reply(nil)
+		}
+	}()
+
+	output := NewMongoOutput(ln.Addr().String(), &MongoOutputConfig{User: "replay", Password: "secret"})
+	defer output.(*MongoOutput).Close()
+	start := time.Now().UnixNano()
+	payload := func(name, collection, db string) []byte {
+		msg := proto.AppendMongoMsg(nil, 1, proto.BSONDoc(proto.AppendBSONString(proto.AppendBSONString(nil, name, collection), "$db", db)))
+		return append(payloadHeader(RequestPayload, []byte("a1b2"), start, 0), msg...)
+	}
+	output.Write(payload("saslStart", "", "admin"))
+	output.Write(payload("find", "users", "shop"))
+	// the responses are not replayed
+	output.Write(append(payloadHeader(ResponsePayload, []byte("a1b2"), start, 0), proto.AppendMongoMsg(nil, 2, proto.BSONDoc(nil))...))
+	output.Write(payload("insert", "logs", "shop"))
+
+	expected := []proto.MongoCommand{{Name: "find", Database: "shop", Collection: "users"}, {Name: "insert", Database: "shop", Collection: "logs"}}
+	for i := range expected {
+		select {
+		case got := <-commands:
+			if got != expected[i] {
+				t.Errorf("expected %+v, got %+v", expected[i], got)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("expected %d commands, got %d", len(expected), i)
+		}
+	}
+}
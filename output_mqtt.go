@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+)
+
+// mqttMaxPacket is the maximum size of the packets read from the broker
+const mqttMaxPacket = 1 << 20
+
+// MQTTOutputConfig is the configuration of the MQTT output
+type MQTTOutputConfig struct {
+	Version     int           `json:"output-mqtt-version"`
+	User        string        `json:"output-mqtt-user"`
+	Password    string        `json:"output-mqtt-password"`
+	Timeout     time.Duration `json:"output-mqtt-timeout"`
+	IdleTimeout time.Duration `json:"output-mqtt-idle-timeout"`
+}
+
+// MQTTOutput republishes the messages recorded with --input-raw-protocol mqtt to a broker. each recorded client
+// gets its own connection with a clean session, its messages are published with the delays they were recorded
+// with, and the acknowledgements of the broker are read without waiting for them. the messages keep their topic,
+// QoS and retain flag, the MQTT 5 properties are only sent when the protocol level of the output is 5.
+type MQTTOutput struct {
+	sync.Mutex
+	address  string
+	config   *MQTTOutputConfig
+	sessions map[string]*mqttSession // by the id of the recorded connection
+}
+
+type mqttMessage struct {
+	data      []byte
+	timestamp int64 // recorded
+}
+
+// mqttSession is a client replayed against the broker
+type mqttSession struct {
+	output    *MQTTOutput
+	id        string
+	timestamp int64 // of the first message
+	messages  chan mqttMessage
+	done      chan struct{}
+	stop      sync.Once
+	lock      sync.Mutex // guards conn
+	conn      net.Conn
+	writeLock sync.Mutex // the acknowledgements are written by receive
+	packetID  uint16     // of the last message with QoS > 0
+}
+
+// NewMQTTOutput constructor for MQTTOutput, address is the host:port of the broker
+func NewMQTTOutput(address string, config *MQTTOutputConfig) io.Writer {
+	o := new(MQTTOutput)
+	o.address = address
+	o.config = config
+	switch byte(o.config.Version) {
+	case proto.MQTT31, proto.MQTT311, proto.MQTT5:
+	default:
+		o.config.Version = int(proto.MQTT311)
+	}
+	if o.config.Timeout < time.Millisecond {
+		o.config.Timeout = 5 * time.Second
+	}
+	if o.config.IdleTimeout < time.Millisecond {
+		o.config.IdleTimeout = 5 * time.Minute
+	}
+	o.sessions = make(map[string]*mqttSession)
+	return o
+}
+
+// Write queues the message to the session of its client, the session is opened by its first message
+func (o *MQTTOutput) Write(data []byte) (n int, err error) {
+	n = len(data)
+	if !isRequestPayload(data) {
+		return
+	}
+	meta := payloadMeta(data)
+	if len(meta) < 3 {
+		return
+	}
+	id := string(meta[1])
+	timestamp, _ := strconv.ParseInt(string(meta[2]), 10, 64)
+	body := payloadBody(data)
+	if typ, _, _, size := proto.MQTTPacket(body); typ != proto.MQTTPublish || size != len(body) {
+		return
+	}
+	o.Lock()
+	s, ok := o.sessions[id]
+	if !ok {
+		s = &mqttSession{
+			output:    o,
+			id:        id,
+			timestamp: timestamp,
+			messages:  make(chan mqttMessage, 1000),
+			done:      make(chan struct{}),
+		}
+		o.sessions[id] = s
+		go s.run()
+	}
+	o.Unlock()
+	select {
+	case s.messages <- mqttMessage{data: append([]byte(nil), body...), timestamp: timestamp}:
+	case <-s.done:
+	}
+	return
+}
+
+// remove forgets the session, unless it was replaced by a session with the same id
+func (o *MQTTOutput) remove(s *mqttSession) {
+	o.Lock()
+	if o.sessions[s.id] == s {
+		delete(o.sessions, s.id)
+	}
+	o.Unlock()
+}
+
+func (o *MQTTOutput) String() string {
+	return fmt.Sprintf("MQTT output: %s", o.address)
+}
+
+// Close closes the sessions in progress
+func (o *MQTTOutput) Close() error {
+	o.Lock()
+	for _, s := range o.sessions {
+		s.close()
+	}
+	o.Unlock()
+	return nil
+}
+
+// run connects to the broker and publishes the messages until the broker closes the connection, or it is idle
+// for longer than IdleTimeout. the session is forgotten on errors, the messages that follow open a new one.
+func (s *mqttSession) run() {
+	defer s.output.remove(s)
+	defer s.close()
+	r, err := s.connect()
+	if err != nil {
+		Debug(1, fmt.Sprintf("[MQTT-OUTPUT] session %s: %v", s.id, err))
+		return
+	}
+	go s.receive(r)
+	started := time.Now()
+	idle := time.NewTimer(s.output.config.IdleTimeout)
+	defer idle.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-idle.C:
+			s.write(proto.AppendMQTTPacket(nil, proto.MQTTDisconnect, 0, nil))
+			return
+		case m := <-s.messages:
+			// the delay since the first message is preserved
+			if wait := time.Duration(m.timestamp-s.timestamp) - time.Since(started); wait > 0 {
+				select {
+				case <-time.After(wait):
+				case <-s.done:
+					return
+				}
+			}
+			if data := s.publish(m.data); len(data) > 0 {
+				if err := s.write(data); err != nil {
+					Debug(1, fmt.Sprintf("[MQTT-OUTPUT] session %s: %v", s.id, err))
+					return
+				}
+			}
+			if !idle.Stop() {
+				<-idle.C
+			}
+			idle.Reset(s.output.config.IdleTimeout)
+		}
+	}
+}
+
+// publish returns the PUBLISH packet sent to the broker, in the encoding of the protocol level of the output and
+// with a packet identifier of the session
+func (s *mqttSession) publish(data []byte) []byte {
+	_, flags, body, _ := proto.MQTTPacket(data)
+	p, ok := proto.ParseMQTTPublish(flags, body, proto.MQTT5)
+	if !ok {
+		return nil
+	}
+	if p.QoS > 0 {
+		s.packetID++
+		if s.packetID == 0 {
+			s.packetID++
+		}
+		p.PacketID = s.packetID
+	}
+	p.Dup = false
+	return proto.AppendMQTTPublish(nil, p, byte(s.output.config.Version))
+}
+
+// connect connects to the broker and waits for its CONNACK, the client identifier is derived from the id of the
+// recorded connection
+func (s *mqttSession) connect() (r *bufio.Reader, err error) {
+	o := s.output
+	conn, err := net.DialTimeout("tcp", o.address, o.config.Timeout)
+	if err != nil {
+		return
+	}
+	s.lock.Lock()
+	s.conn = conn
+	s.lock.Unlock()
+	select {
+	case <-s.done:
+		// closed while dialing
+		conn.Close()
+		return nil, errors.New("session closed")
+	default:
+	}
+	// client identifiers of MQTT 3.1 are at most 23 characters long
+	clientID := "gor-" + s.id
+	if len(clientID) > 23 {
+		clientID = clientID[:23]
+	}
+	if err = s.write(proto.AppendMQTTConnect(nil, byte(o.config.Version), clientID, o.config.User, o.config.Password, 0)); err != nil {
+		return
+	}
+	conn.SetReadDeadline(time.Now().Add(o.config.Timeout))
+	r = bufio.NewReader(conn)
+	typ, _, body, err := readMQTTPacket(r)
+	if err != nil {
+		return
+	}
+	code, ok := proto.ParseMQTTConnAck(body)
+	if typ != proto.MQTTConnAck || !ok {
+		return nil, errors.New("invalid mqtt connack")
+	}
+	if code != 0 {
+		return nil, fmt.Errorf("connection refused with code %d", code)
+	}
+	return r, conn.SetReadDeadline(time.Time{})
+}
+
+// readMQTTPacket reads a packet of at most mqttMaxPacket bytes
+func readMQTTPacket(r *bufio.Reader) (typ, flags byte, body []byte, err error) {
+	first, err := r.ReadByte()
+	if err != nil {
+		return
+	}
+	length := 0
+	for i := 0; ; i++ {
+		if i == 4 {
+			return 0, 0, nil, errors.New("invalid mqtt remaining length")
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		length |= int(b&0x7f) << (7 * uint(i))
+		if b < 0x80 {
+			break
+		}
+	}
+	if length > mqttMaxPacket {
+		return 0, 0, nil, errors.New("mqtt packet too large")
+	}
+	body = make([]byte, length)
+	if _, err = io.ReadFull(r, body); err != nil {
+		return
+	}
+	return first >> 4, first & 0x0f, body, nil
+}
+
+// receive reads the packets of the broker and releases the messages with QoS 2, the session is closed with the
+// connection
+func (s *mqttSession) receive(r *bufio.Reader) {
+	defer s.close()
+	for {
+		typ, _, body, err := readMQTTPacket(r)
+		if err != nil {
+			return
+		}
+		if typ == proto.MQTTPubRec && len(body) >= 2 {
+			if s.write(proto.AppendMQTTPacket(nil, proto.MQTTPubRel, 0x02, body[:2])) != nil {
+				return
+			}
+		}
+	}
+}
+
+// write sends packets to the broker
+func (s *mqttSession) write(data []byte) error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	s.conn.SetWriteDeadline(time.Now().Add(s.output.config.Timeout))
+	_, err := s.conn.Write(data)
+	return err
+}
+
+func (s *mqttSession) close() {
+	s.stop.Do(func() {
+		close(s.done)
+		s.lock.Lock()
+		if s.conn != nil {
+			s.conn.Close()
+		}
+		s.lock.Unlock()
+	})
+}
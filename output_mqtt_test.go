@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+)
+
+func TestMQTTOutput(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	packets := make(chan []byte, 20)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		for {
+			typ, flags, body, err := readMQTTPacket(reader)
+			if err != nil {
+				return
+			}
+			packets <- proto.AppendMQTTPacket(nil, typ, flags, body)
+			switch typ {
+			case proto.MQTTConnect:
+				conn.Write(proto.AppendMQTTPacket(nil, proto.MQTTConnAck, 0, []byte{0, 0}))
+			case proto.MQTTPublish:
+				if p, _ := proto.ParseMQTTPublish(flags, body, proto.MQTT311); p.QoS == 2 {
+					conn.Write(proto.AppendMQTTPacket(nil, proto.MQTTPubRec, 0, []byte{byte(p.PacketID >> 8), byte(p.PacketID)}))
+				}
+			}
+		}
+	}()
+
+	output := NewMQTTOutput(ln.Addr().String(), &MQTTOutputConfig{User: "replay", Password: "secret"})
+	defer output.(*MQTTOutput).Close()
+	start := time.Now().UnixNano()
+	payload := func(p proto.MQTTPublishPacket) []byte {
+		return append(payloadHeader(RequestPayload, []byte("a1b2c3d4e5f6a7b8c9d0e1f2"), start, 0), proto.AppendMQTTPublish(nil, p, proto.MQTT5)...)
+	}
+	output.Write(payload(proto.MQTTPublishPacket{Topic: "sensors/1/temp", Properties: []byte{0x01, 1}, Payload: []byte("21.5")}))
+	output.Write(payload(proto.MQTTPublishPacket{Topic: "sensors/1/temp", QoS: 2, PacketID: 40, Dup: true, Payload: []byte("21.7")}))
+
+	expected := [][]byte{
+		proto.AppendMQTTConnect(nil, proto.MQTT311, "gor-a1b2c3d4e5f6a7b8c9d", "replay", "secret", 0),
+		// the properties are not sent to MQTT 3.1.1
+		proto.AppendMQTTPublish(nil, proto.MQTTPublishPacket{Topic: "sensors/1/temp", Payload: []byte("21.5")}, proto.MQTT311),
+		proto.AppendMQTTPublish(nil, proto.MQTTPublishPacket{Topic: "sensors/1/temp", QoS: 2, PacketID: 1, Payload: []byte("21.7")}, proto.MQTT311),
+		proto.AppendMQTTPacket(nil, proto.MQTTPubRel, 0x02, []byte{0, 1}),
+	}
+	for i := range expected {
+		select {
+		case got := <-packets:
+			if !bytes.Equal(got, expected[i]) {
+				t.Errorf("expected %q, got %q", expected[i], got)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("expected %d packets, got %d", len(expected), i)
+		}
+	}
+}
@@ -0,0 +1,505 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+)
+
+// mysqlMaxResponse is the maximum size of the packets read from the target
+const mysqlMaxResponse = 64 << 20
+
+// MySQLOutputConfig is the configuration of the MySQL output
+type MySQLOutputConfig struct {
+	User        string        `json:"output-mysql-user"`
+	Password    string        `json:"output-mysql-password"`
+	Database    string        `json:"output-mysql-database"`
+	Timeout     time.Duration `json:"output-mysql-timeout"`
+	IdleTimeout time.Duration `json:"output-mysql-idle-timeout"`
+}
+
+// MySQLOutput replays the MySQL connections recorded with --input-raw-protocol mysql against a shadow database.
+// each recorded connection is replayed on a connection authenticated with the user of the configuration, its
+// commands are sent with the delays they were recorded with and the responses of the target are discarded. the
+// recorded handshake and authentication packets are skipped, the database of the recorded handshake is selected
+// when the configuration has none. the statements are prepared again, the commands on statements are sent with
+// the ids given by the target.
+type MySQLOutput struct {
+	sync.Mutex
+	address  string
+	config   *MySQLOutputConfig
+	sessions map[string]*mysqlSession // by the id of the recorded connection
+}
+
+type mysqlCommand struct {
+	data      []byte // packets
+	timestamp int64  // recorded
+}
+
+// mysqlSession is a connection replayed against the target
+type mysqlSession struct {
+	output     *MySQLOutput
+	id         string
+	database   string
+	timestamp  int64 // of the first command
+	commands   chan mysqlCommand
+	done       chan struct{}
+	stop       sync.Once
+	lock       sync.Mutex // guards conn
+	conn       net.Conn
+	reader     *bufio.Reader
+	statements map[uint32]uint32 // ids by rank
+	prepares   uint32
+	infile     bool  // the target requested the content of a file
+	seq        uint8 // of the next packet sent
+}
+
+// NewMySQLOutput constructor for MySQLOutput, address is the host:port of the target
+func NewMySQLOutput(address string, config *MySQLOutputConfig) io.Writer {
+	o := new(MySQLOutput)
+	o.address = address
+	o.config = config
+	if o.config.Timeout < time.Millisecond {
+		o.config.Timeout = 5 * time.Second
+	}
+	if o.config.IdleTimeout < time.Millisecond {
+		o.config.IdleTimeout = 5 * time.Minute
+	}
+	o.sessions = make(map[string]*mysqlSession)
+	return o
+}
+
+// Write queues the command to the session of its connection, the session is opened by its first command
+func (o *MySQLOutput) Write(data []byte) (n int, err error) {
+	n = len(data)
+	if !isRequestPayload(data) {
+		return
+	}
+	meta := payloadMeta(data)
+	if len(meta) < 3 {
+		return
+	}
+	id := string(meta[1])
+	timestamp, _ := strconv.ParseInt(string(meta[2]), 10, 64)
+	body := payloadBody(data)
+	payload, seq, size := proto.MySQLPacket(body)
+	if size == 0 {
+		return
+	}
+	o.Lock()
+	s, ok := o.sessions[id]
+	if !ok {
+		s = &mysqlSession{
+			output:     o,
+			id:         id,
+			database:   o.config.Database,
+			timestamp:  timestamp,
+			commands:   make(chan mysqlCommand, 1000),
+			done:       make(chan struct{}),
+			statements: make(map[uint32]uint32),
+		}
+		if r, ok := proto.ParseMySQLHandshakeResponse(payload); ok && seq == 1 && s.database == "" {
+			s.database = r.Database
+		}
+		o.sessions[id] = s
+		go s.run()
+	}
+	o.Unlock()
+	select {
+	case s.commands <- mysqlCommand{data: append([]byte(nil), body...), timestamp: timestamp}:
+	case <-s.done:
+	}
+	return
+}
+
+// remove forgets the session, unless it was replaced by a session with the same id
+func (o *MySQLOutput) remove(s *mysqlSession) {
+	o.Lock()
+	if o.sessions[s.id] == s {
+		delete(o.sessions, s.id)
+	}
+	o.Unlock()
+}
+
+func (o *MySQLOutput) String() string {
+	return fmt.Sprintf("MySQL output: %s", o.address)
+}
+
+// Close closes the sessions in progress
+func (o *MySQLOutput) Close() error {
+	o.Lock()
+	for _, s := range o.sessions {
+		s.close()
+	}
+	o.Unlock()
+	return nil
+}
+
+// run connects to the target and sends the commands until the connection is closed, or idle for longer than
+// IdleTimeout. the session is forgotten on errors, the commands that follow open a new one.
+func (s *mysqlSession) run() {
+	defer s.output.remove(s)
+	defer s.close()
+	if err := s.handshake(); err != nil {
+		Debug(1, fmt.Sprintf("[MYSQL-OUTPUT] session %s: %v", s.id, err))
+		return
+	}
+	started := time.Now()
+	idle := time.NewTimer(s.output.config.IdleTimeout)
+	defer idle.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-idle.C:
+			return
+		case c := <-s.commands:
+			// the delay since the first command is preserved
+			if wait := time.Duration(c.timestamp-s.timestamp) - time.Since(started); wait > 0 {
+				select {
+				case <-time.After(wait):
+				case <-s.done:
+					return
+				}
+			}
+			quit, err := s.command(c.data)
+			if err != nil {
+				Debug(1, fmt.Sprintf("[MYSQL-OUTPUT] session %s: %v", s.id, err))
+				return
+			}
+			if quit {
+				return
+			}
+			if !idle.Stop() {
+				<-idle.C
+			}
+			idle.Reset(s.output.config.IdleTimeout)
+		}
+	}
+}
+
+// command sends the recorded packets to the target and reads its response
+func (s *mysqlSession) command(data []byte) (quit bool, err error) {
+	payload, seq, _ := proto.MySQLPacket(data)
+	if seq != 0 {
+		if !s.infile {
+			// authentication
+			return false, nil
+		}
+		// the content of the file requested, until an empty packet
+		var packets []byte
+		for len(data) > 0 {
+			p, _, n := proto.MySQLPacket(data)
+			if n == 0 {
+				break
+			}
+			packets = proto.AppendMySQLPacket(packets, s.seq, p)
+			s.seq++
+			data = data[n:]
+		}
+		s.infile = false
+		if err = s.write(packets); err != nil {
+			return
+		}
+		_, err = s.response(proto.MySQLComQuery)
+		return
+	}
+	if s.infile {
+		// the file was not recorded
+		s.infile = false
+		if err = s.write(proto.AppendMySQLPacket(nil, s.seq, nil)); err != nil {
+			return
+		}
+		if _, err = s.response(proto.MySQLComQuery); err != nil {
+			return
+		}
+	}
+	if len(payload) == 0 {
+		return
+	}
+	command := payload[0]
+	switch command {
+	case proto.MySQLComChangeUser:
+		// the session keeps the user of the configuration
+		return
+	case proto.MySQLComStmtPrepare:
+		s.prepares++
+	}
+	if rank, ok := proto.MySQLStatementID(payload); ok {
+		id, found := s.statements[rank]
+		if !found {
+			return
+		}
+		payload = append([]byte(nil), payload...)
+		binary.LittleEndian.PutUint32(payload[1:], id)
+		if command == proto.MySQLComStmtClose {
+			delete(s.statements, rank)
+		}
+	}
+	if err = s.write(proto.AppendMySQLPacket(nil, 0, payload)); err != nil {
+		return
+	}
+	switch command {
+	case proto.MySQLComQuit:
+		return true, nil
+	case proto.MySQLComStmtSendLongData, proto.MySQLComStmtClose:
+		return
+	}
+	r, err := s.response(command)
+	if err != nil {
+		return
+	}
+	switch {
+	case command == proto.MySQLComStmtPrepare && !r.Err:
+		s.statements[s.prepares] = r.StatementID
+	case command == proto.MySQLComResetConnection:
+		s.statements = make(map[uint32]uint32)
+	}
+	return
+}
+
+// response reads the response of the target to a command
+func (s *mysqlSession) response(command byte) (r proto.MySQLResponse, err error) {
+	r.Command = command
+	s.conn.SetReadDeadline(time.Now().Add(s.output.config.Timeout))
+	for {
+		payload, seq, err := s.read()
+		if err != nil {
+			return r, err
+		}
+		if r.Packet(payload) {
+			s.infile, s.seq = r.Infile, seq+1
+			return r, nil
+		}
+	}
+}
+
+// handshake connects to the target and authenticates with the user of the configuration, using
+// mysql_native_password or caching_sha2_password
+func (s *mysqlSession) handshake() (err error) {
+	o := s.output
+	conn, err := net.DialTimeout("tcp", o.address, o.config.Timeout)
+	if err != nil {
+		return
+	}
+	s.lock.Lock()
+	s.conn = conn
+	s.lock.Unlock()
+	select {
+	case <-s.done:
+		// closed while dialing
+		conn.Close()
+		return errors.New("session closed")
+	default:
+	}
+	conn.SetDeadline(time.Now().Add(o.config.Timeout))
+	s.reader = bufio.NewReader(conn)
+	payload, seq, err := s.read()
+	if err != nil {
+		return
+	}
+	if len(payload) > 0 && payload[0] == 0xff {
+		return mysqlError(payload)
+	}
+	h, ok := proto.ParseMySQLHandshake(payload)
+	if !ok {
+		return errors.New("invalid handshake")
+	}
+	caps := proto.MySQLClientProtocol41 | proto.MySQLClientSecureConnection | proto.MySQLClientPluginAuth |
+		proto.MySQLClientPluginAuthLenencData | proto.MySQLClientTransactions | proto.MySQLClientMultiStatements |
+		proto.MySQLClientMultiResults | proto.MySQLClientPSMultiResults | proto.MySQLClientLocalFiles
+	plugin := h.AuthPlugin
+	if plugin == "" {
+		plugin = mysqlNativePassword
+	}
+	scramble := h.AuthData
+	r := proto.MySQLHandshakeResponse{
+		Capabilities:  caps & h.Capabilities,
+		MaxPacketSize: proto.MySQLMaxPayload,
+		Charset:       h.Charset,
+		User:          o.config.User,
+		AuthResponse:  mysqlScramble(plugin, o.config.Password, scramble),
+		Database:      s.database,
+		AuthPlugin:    plugin,
+	}
+	if err = s.write(proto.AppendMySQLPacket(nil, seq+1, proto.AppendMySQLHandshakeResponse(nil, r))); err != nil {
+		return
+	}
+	for {
+		if payload, seq, err = s.read(); err != nil {
+			return
+		}
+		if len(payload) == 0 {
+			return errors.New("invalid authentication packet")
+		}
+		var auth []byte
+		switch payload[0] {
+		case 0x00:
+			return conn.SetDeadline(time.Time{})
+		case 0xff:
+			return mysqlError(payload)
+		case 0xfe:
+			// auth switch request
+			name := payload[1:]
+			if i := bytes.IndexByte(name, 0); i >= 0 {
+				name, scramble = name[:i], bytes.TrimRight(name[i+1:], "\x00")
+			}
+			plugin = string(name)
+			auth = mysqlScramble(plugin, o.config.Password, scramble)
+		case 0x01:
+			// more data of caching_sha2_password
+			switch {
+			case len(payload) == 2 && payload[1] == 3:
+				// fast authentication succeeded
+				continue
+			case len(payload) == 2 && payload[1] == 4:
+				// full authentication, the public key of the server is requested
+				auth = []byte{2}
+			default:
+				if auth, err = mysqlEncryptPassword(payload[1:], o.config.Password, scramble); err != nil {
+					return
+				}
+			}
+		default:
+			return errors.New("invalid authentication packet")
+		}
+		if err = s.write(proto.AppendMySQLPacket(nil, seq+1, auth)); err != nil {
+			return
+		}
+	}
+}
+
+// read reads a packet of at most mysqlMaxResponse bytes, joined with the packets it continues in
+func (s *mysqlSession) read() (payload []byte, seq uint8, err error) {
+	var header [proto.MySQLPacketHeaderLen]byte
+	for {
+		if _, err = io.ReadFull(s.reader, header[:]); err != nil {
+			return
+		}
+		length := int(header[0]) | int(header[1])<<8 | int(header[2])<<16
+		if len(payload)+length > mysqlMaxResponse {
+			return nil, 0, errors.New("mysql packet too large")
+		}
+		buf := make([]byte, len(payload)+length)
+		copy(buf, payload)
+		if _, err = io.ReadFull(s.reader, buf[len(payload):]); err != nil {
+			return
+		}
+		payload, seq = buf, header[3]
+		if length < proto.MySQLMaxPayload {
+			return
+		}
+	}
+}
+
+// write sends packets to the target
+func (s *mysqlSession) write(packets []byte) error {
+	s.conn.SetWriteDeadline(time.Now().Add(s.output.config.Timeout))
+	_, err := s.conn.Write(packets)
+	return err
+}
+
+func (s *mysqlSession) close() {
+	s.stop.Do(func() {
+		close(s.done)
+		s.lock.Lock()
+		if s.conn != nil {
+			s.conn.Close()
+		}
+		s.lock.Unlock()
+	})
+}
+
+// authentication plugins
+const (
+	mysqlNativePassword      = "mysql_native_password"
+	mysqlCachingSHA2Password = "caching_sha2_password"
+)
+
+// mysqlScramble returns the response to the challenge of the authentication plugin, empty passwords are sent as is
+func mysqlScramble(plugin, password string, scramble []byte) []byte {
+	if password == "" {
+		return []byte{}
+	}
+	if len(scramble) > 20 {
+		scramble = scramble[:20]
+	}
+	switch plugin {
+	case mysqlNativePassword:
+		// SHA1(password) XOR SHA1(scramble + SHA1(SHA1(password)))
+		stage1 := sha1.Sum([]byte(password))
+		stage2 := sha1.Sum(stage1[:])
+		h := sha1.New()
+		h.Write(scramble)
+		h.Write(stage2[:])
+		return mysqlXOR(stage1[:], h.Sum(nil))
+	case mysqlCachingSHA2Password:
+		// SHA256(password) XOR SHA256(SHA256(SHA256(password)) + scramble)
+		stage1 := sha256.Sum256([]byte(password))
+		stage2 := sha256.Sum256(stage1[:])
+		h := sha256.New()
+		h.Write(stage2[:])
+		h.Write(scramble)
+		return mysqlXOR(stage1[:], h.Sum(nil))
+	}
+	// mysql_clear_password, and unknown plugins
+	return append([]byte(password), 0)
+}
+
+// mysqlEncryptPassword encrypts the password XOR the scramble with the public key of the server, for the full
+// authentication of caching_sha2_password on connections without TLS
+func mysqlEncryptPassword(key []byte, password string, scramble []byte) ([]byte, error) {
+	block, _ := pem.Decode(key)
+	if block == nil {
+		return nil, errors.New("invalid public key of the server")
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := pub.(*rsa.PublicKey)
+	if !ok || len(scramble) == 0 {
+		return nil, errors.New("invalid public key of the server")
+	}
+	plain := append([]byte(password), 0)
+	for i := range plain {
+		plain[i] ^= scramble[i%len(scramble)]
+	}
+	return rsa.EncryptOAEP(sha1.New(), rand.Reader, rsaKey, plain, nil)
+}
+
+func mysqlXOR(a, b []byte) []byte {
+	for i := range a {
+		a[i] ^= b[i]
+	}
+	return a
+}
+
+// mysqlError returns the error of an ERR packet
+func mysqlError(payload []byte) error {
+	if len(payload) < 3 {
+		return errors.New("mysql error")
+	}
+	code := binary.LittleEndian.Uint16(payload[1:])
+	msg := payload[3:]
+	if len(msg) > 6 && msg[0] == '#' {
+		// the SQL state
+		msg = msg[6:]
+	}
+	return fmt.Errorf("mysql error %d: %s", code, msg)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+)
+
+func TestMySQLOutput(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	pub := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	scramble := []byte("0123456789abcdefghij")
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	received := make(chan []byte, 10)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		s := &mysqlSession{conn: conn, reader: bufio.NewReader(conn), output: &MySQLOutput{config: &MySQLOutputConfig{Timeout: time.Second}}}
+		write := func(seq uint8, payload []byte) {
+			conn.Write(proto.AppendMySQLPacket(nil, seq, payload))
+		}
+		write(0, proto.AppendMySQLHandshake(nil, proto.MySQLHandshake{ServerVersion: "8.0.36", Capabilities: ^uint32(0) &^ proto.MySQLClientSSL, AuthData: scramble, AuthPlugin: "caching_sha2_password"}))
+		payload, _, err := s.read()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		r, ok := proto.ParseMySQLHandshakeResponse(payload)
+		if !ok || r.User != "replay" || r.Database != "shop" || !bytes.Equal(r.AuthResponse, mysqlScramble("caching_sha2_password", "secret", scramble)) {
+			t.Errorf("unexpected handshake response %+v", r)
+			return
+		}
+		// full authentication with the public key
+		write(2, []byte{1, 4})
+		if payload, _, _ = s.read(); !bytes.Equal(payload, []byte{2}) {
+			t.Errorf("expected the public key to be requested, got %x", payload)
+			return
+		}
+		write(4, append([]byte{1}, pub...))
+		payload, _, _ = s.read()
+		plain, err := rsa.DecryptOAEP(sha1.New(), nil, key, payload, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		for i := range plain {
+			plain[i] ^= scramble[i%len(scramble)]
+		}
+		if string(plain) != "secret\x00" {
+			t.Errorf("unexpected password %q", plain)
+			return
+		}
+		write(6, []byte{0, 0, 0, 2, 0, 0, 0})
+		for {
+			payload, _, err := s.read()
+			if err != nil {
+				return
+			}
+			received <- payload
+			switch payload[0] {
+			case proto.MySQLComQuit:
+				return
+			case proto.MySQLComStmtPrepare:
+				write(1, []byte{0, 100, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0})
+				write(2, []byte("\x03def\x00"))
+				write(3, []byte{0xfe, 0, 0, 2, 0})
+			default:
+				write(1, []byte{0, 0, 0, 2, 0, 0, 0})
+			}
+		}
+	}()
+
+	output := NewMySQLOutput(ln.Addr().String(), &MySQLOutputConfig{User: "replay", Password: "secret"})
+	defer output.(*MySQLOutput).Close()
+	start := time.Now().UnixNano()
+	payload := func(body []byte) []byte {
+		return append(payloadHeader(RequestPayload, []byte("a1b2"), start, 0), body...)
+	}
+	execute := func(rank uint32) []byte {
+		p := []byte("\x17\x00\x00\x00\x00\x00\x01\x00\x00\x00\x00\x01\x01\x00\x2a")
+		binary.LittleEndian.PutUint32(p[1:], rank)
+		return p
+	}
+	output.Write(payload(proto.AppendMySQLPacket(nil, 1, proto.AppendMySQLHandshakeResponse(nil, proto.MySQLHandshakeResponse{User: "app", AuthResponse: []byte{1}, Database: "shop"}))))
+	output.Write(payload(proto.AppendMySQLPacket(nil, 0, []byte("\x16SELECT ?"))))
+	output.Write(payload(proto.AppendMySQLPacket(nil, 0, execute(1))))
+	// the statement 2 was not prepared
+	output.Write(payload(proto.AppendMySQLPacket(nil, 0, execute(2))))
+	// the responses are not replayed
+	output.Write(append(payloadHeader(ResponsePayload, []byte("a1b2"), start, 0), proto.AppendMySQLPacket(nil, 1, []byte{0, 0, 0, 2, 0, 0, 0})...))
+	output.Write(payload(proto.AppendMySQLPacket(nil, 0, []byte("\x03SELECT 1"))))
+	output.Write(payload(proto.AppendMySQLPacket(nil, 0, []byte{proto.MySQLComQuit})))
+
+	executed := execute(100)
+	expected := [][]byte{[]byte("\x16SELECT ?"), executed, []byte("\x03SELECT 1"), {proto.MySQLComQuit}}
+	for i := range expected {
+		select {
+		case got := <-received:
+			if !bytes.Equal(got, expected[i]) {
+				t.Errorf("expected %x, got %x", expected[i], got)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("expected %d commands, got %d", len(expected), i)
+		}
+	}
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// NATSOutputConfig is the configuration of the NATS output
+type NATSOutputConfig struct {
+	Subject   string        `json:"output-nats-subject"`
+	JetStream bool          `json:"output-nats-jetstream"`
+	User      string        `json:"output-nats-user"`
+	Password  string        `json:"output-nats-password"`
+	Token     string        `json:"output-nats-token"`
+	Secure    bool          `json:"output-nats-tls"`
+	Timeout   time.Duration `json:"output-nats-timeout"`
+}
+
+// NATSOutput publishes the requests and the responses, in the format of the payloads, to the subjects of a NATS
+// server. the subjects are made from a template of the method, the host and the path of the requests. with
+// JetStream, the messages get a Nats-Msg-Id of their UUID and type, so that the stream drops the duplicates, and
+// the acknowledgements of the stream are read without waiting for them.
+type NATSOutput struct {
+	// Keep this as first element of struct because it guarantees 64bit
+	// alignment. atomic.* functions crash on 32bit machines if operand is not
+	// aligned at 64bit. See https://github.com/golang/go/issues/599
+	published  int64
+	acked      int64
+	duplicates int64
+	failed     int64
+
+	address  string
+	config   *NATSOutputConfig
+	inbox    string // the prefix of the reply subjects of the acknowledgements
+	messages chan []byte
+	queuing  sync.RWMutex // done is closed once the payloads being written are queued
+	done     chan struct{}
+	finished chan struct{}
+	stop     sync.Once
+	lock     sync.Mutex // guards conn
+	conn     net.Conn
+}
+
+// natsInfo is the part of the INFO of the server the output depends on
+type natsInfo struct {
+	TLSRequired bool `json:"tls_required"`
+	Headers     bool `json:"headers"`
+}
+
+// NewNATSOutput constructor for NATSOutput, address is the host:port of the server
+func NewNATSOutput(address string, config *NATSOutputConfig) io.Writer {
+	o := new(NATSOutput)
+	o.address = address
+	o.config = config
+	if o.config.Subject == "" {
+		o.config.Subject = "goreplay"
+	}
+	if o.config.Timeout < time.Millisecond {
+		o.config.Timeout = 5 * time.Second
+	}
+	id := make([]byte, 8)
+	rand.Read(id)
+	o.inbox = "_INBOX." + hex.EncodeToString(id)
+	o.messages = make(chan []byte, 1000)
+	o.done = make(chan struct{})
+	o.finished = make(chan struct{})
+	go o.run()
+	return o
+}
+
+// Write queues the payload to be published, the payloads written after Close are refused
+func (o *NATSOutput) Write(data []byte) (n int, err error) {
+	if !isOriginPayload(data) {
+		return len(data), nil
+	}
+	o.queuing.RLock()
+	defer o.queuing.RUnlock()
+	select {
+	case <-o.done:
+		return 0, ErrorStopped
+	default:
+	}
+	// run receives the messages until done, and publishes the ones queued then
+	o.messages <- append([]byte(nil), data...)
+	return len(data), nil
+}
+
+// run connects to the server and publishes the messages, it reconnects every second after errors. once the output
+// is closed, it finishes when the messages queued are published, they are dropped if the connection fails then.
+func (o *NATSOutput) run() {
+	defer close(o.finished)
+	var pending []byte
+	for retries := 0; ; retries++ {
+		if retries > 0 {
+			select {
+			case <-o.done:
+				o.drop(pending)
+				return
+			case <-time.After(time.Second):
+			}
+		}
+		r, err := o.connect()
+		if err != nil {
+			Debug(1, fmt.Sprintf("[NATS-OUTPUT] %s: %v", o.address, err))
+			o.closeConn()
+			continue
+		}
+		go o.receive(r)
+		if pending, err = o.publishAll(pending); err != nil {
+			Debug(1, fmt.Sprintf("[NATS-OUTPUT] %s: %v", o.address, err))
+		}
+		o.closeConn()
+		if err == nil {
+			return
+		}
+	}
+}
+
+// drop counts the messages left as failed, when the connection fails once the output is closed
+func (o *NATSOutput) drop(pending []byte) {
+	n := len(o.messages)
+	if pending != nil {
+		n++
+	}
+	if n > 0 {
+		atomic.AddInt64(&o.failed, int64(n))
+		Debug(1, fmt.Sprintf("[NATS-OUTPUT] %s: %d messages dropped on close", o.address, n))
+	}
+}
+
+// publishAll publishes the messages until the output is closed and the messages queued are published, or a write
+// fails. it returns the message that failed to be retried on the next connection
+func (o *NATSOutput) publishAll(pending []byte) ([]byte, error) {
+	for {
+		data := pending
+		if data == nil {
+			select {
+			case data = <-o.messages:
+			case <-o.done:
+				select {
+				case data = <-o.messages:
+				default:
+					return nil, nil
+				}
+			}
+		}
+		if err := o.write(o.publish(data)); err != nil {
+			return data, err
+		}
+		pending = nil
+		atomic.AddInt64(&o.published, 1)
+	}
+}
+
+// connect dials the server, upgrades the connection to TLS when the server or the config requires it, and
+// authenticates. the PONG answering the first PING confirms the CONNECT was accepted.
+func (o *NATSOutput) connect() (r *bufio.Reader, err error) {
+	conn, err := net.DialTimeout("tcp", o.address, o.config.Timeout)
+	if err != nil {
+		return
+	}
+	o.setConn(conn)
+	conn.SetReadDeadline(time.Now().Add(o.config.Timeout))
+	r = bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return
+	}
+	var info natsInfo
+	if !strings.HasPrefix(line, "INFO ") || json.Unmarshal([]byte(line[5:]), &info) != nil {
+		return nil, errors.New("invalid nats INFO")
+	}
+	if o.config.JetStream && !info.Headers {
+		return nil, errors.New("the server does not support headers, required by JetStream")
+	}
+	if info.TLSRequired || o.config.Secure {
+		host, _, _ := net.SplitHostPort(o.address)
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: host})
+		if err = tlsConn.Handshake(); err != nil {
+			return
+		}
+		o.setConn(tlsConn)
+		r = bufio.NewReader(tlsConn)
+	}
+
+	connect, _ := json.Marshal(map[string]interface{}{
+		"verbose":      false,
+		"pedantic":     false,
+		"tls_required": info.TLSRequired || o.config.Secure,
+		"name":         "goreplay",
+		"lang":         "go",
+		"version":      VERSION,
+		"protocol":     1,
+		"headers":      info.Headers,
+		"user":         o.config.User,
+		"pass":         o.config.Password,
+		"auth_token":   o.config.Token,
+	})
+	msg := "CONNECT " + string(connect) + "\r\nPING\r\n"
+	if o.config.JetStream {
+		msg += "SUB " + o.inbox + ".* 1\r\n"
+	}
+	if err = o.write([]byte(msg)); err != nil {
+		return
+	}
+	for {
+		if line, err = r.ReadString('\n'); err != nil {
+			return
+		}
+		switch {
+		case strings.HasPrefix(line, "PONG"):
+			conn.SetReadDeadline(time.Time{})
+			return
+		case strings.HasPrefix(line, "-ERR"):
+			return nil, errors.New(strings.TrimSpace(line))
+		}
+	}
+}
+
+// publish returns the PUB, or the HPUB with the Nats-Msg-Id of JetStream, of the payload
+func (o *NATSOutput) publish(data []byte) []byte {
+	subject := o.subject(data)
+	if !o.config.JetStream {
+		return []byte(fmt.Sprintf("PUB %s %d\r\n%s\r\n", subject, len(data), data))
+	}
+	meta := payloadMeta(data)
+	header := fmt.Sprintf("NATS/1.0\r\nNats-Msg-Id: %s-%s\r\n\r\n", meta[1], meta[0])
+	return []byte(fmt.Sprintf("HPUB %s %s.%d %d %d\r\n%s%s\r\n", subject, o.inbox, atomic.LoadInt64(&o.published),
+		len(header), len(header)+len(data), header, data))
+}
+
+// subject returns the subject of the payload, see payloadKey
+func (o *NATSOutput) subject(data []byte) string {
+	return payloadKey(o.config.Subject, data)
+}
+
+// receive reads the messages of the server: it answers the PINGs, and counts the acknowledgements of JetStream
+func (o *NATSOutput) receive(r *bufio.Reader) {
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			o.closeConn()
+			return
+		}
+		args := strings.Fields(line)
+		if len(args) == 0 {
+			continue
+		}
+		switch args[0] {
+		case "PING":
+			o.write([]byte("PONG\r\n"))
+		case "-ERR":
+			Debug(1, fmt.Sprintf("[NATS-OUTPUT] %s: %s", o.address, strings.TrimSpace(line)))
+		case "MSG", "HMSG":
+			// MSG <subject> <sid> [reply] <size>, HMSG <subject> <sid> [reply] <header size> <size>
+			size, _ := strconv.Atoi(args[len(args)-1])
+			hsize := 0
+			if args[0] == "HMSG" && len(args) > 4 {
+				hsize, _ = strconv.Atoi(args[len(args)-2])
+			}
+			msg := make([]byte, size+2)
+			if _, err = io.ReadFull(r, msg); err != nil || hsize > size {
+				o.closeConn()
+				return
+			}
+			o.ack(msg[:hsize], msg[hsize:size])
+		}
+	}
+}
+
+// ack counts the acknowledgement of JetStream, the status 503 of the header tells no stream matched the subject
+func (o *NATSOutput) ack(header, body []byte) {
+	var ack struct {
+		Duplicate bool `json:"duplicate"`
+		Error     *struct {
+			Description string `json:"description"`
+		} `json:"error"`
+	}
+	switch {
+	case bytes.HasPrefix(header, []byte("NATS/1.0 503")):
+		atomic.AddInt64(&o.failed, 1)
+		Debug(1, fmt.Sprintf("[NATS-OUTPUT] %s: no stream for the subject", o.address))
+	case json.Unmarshal(body, &ack) != nil:
+		atomic.AddInt64(&o.failed, 1)
+	case ack.Error != nil:
+		atomic.AddInt64(&o.failed, 1)
+		Debug(1, fmt.Sprintf("[NATS-OUTPUT] %s: %s", o.address, ack.Error.Description))
+	case ack.Duplicate:
+		atomic.AddInt64(&o.duplicates, 1)
+	default:
+		atomic.AddInt64(&o.acked, 1)
+	}
+}
+
+func (o *NATSOutput) write(data []byte) error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.conn == nil {
+		return errors.New("not connected")
+	}
+	o.conn.SetWriteDeadline(time.Now().Add(o.config.Timeout))
+	_, err := o.conn.Write(data)
+	return err
+}
+
+func (o *NATSOutput) setConn(conn net.Conn) {
+	o.lock.Lock()
+	o.conn = conn
+	o.lock.Unlock()
+}
+
+func (o *NATSOutput) closeConn() {
+	o.lock.Lock()
+	if o.conn != nil {
+		o.conn.Close()
+	}
+	o.lock.Unlock()
+}
+
+func (o *NATSOutput) String() string {
+	return fmt.Sprintf("NATS output: %s, published: %d, acked: %d, duplicates: %d, failed: %d", o.address,
+		atomic.LoadInt64(&o.published), atomic.LoadInt64(&o.acked), atomic.LoadInt64(&o.duplicates), atomic.LoadInt64(&o.failed))
+}
+
+// Close publishes the messages queued, waiting for Timeout at most, and closes the connection
+func (o *NATSOutput) Close() error {
+	o.stop.Do(func() {
+		o.queuing.Lock()
+		close(o.done)
+		o.queuing.Unlock()
+		select {
+		case <-o.finished:
+		case <-time.After(o.config.Timeout):
+		}
+		o.closeConn()
+	})
+	return nil
+}
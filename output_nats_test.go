@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNATSOutputSubject(t *testing.T) {
+	o := &NATSOutput{config: &NATSOutputConfig{Subject: "gor.{type}.{method}.{host}.{path}"}}
+	tests := []struct {
+		payload string
+		subject string
+	}{
+		{"1 a 1 -1\nGET /users/42?x=1 HTTP/1.1\r\nHost: api.example.com\r\n\r\n", "gor.1.GET.api_example_com.users.42"},
+		{"1 a 1 -1\nPOST / HTTP/1.1\r\n\r\n", "gor.1.POST._._"},
+		{"1 a 1 -1\nGET //a*b/c>d/ HTTP/1.1\r\n\r\n", "gor.1.GET._.a_b.c_d"},
+		{"2 a 1 1\nHTTP/1.1 200 OK\r\n\r\n", "gor.2._._._"},
+	}
+	for _, tt := range tests {
+		if subject := o.subject([]byte(tt.payload)); subject != tt.subject {
+			t.Errorf("%q: expected subject %q, got %q", tt.payload, tt.subject, subject)
+		}
+	}
+}
+
+func TestNATSOutputJetStream(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	commands := make(chan string, 20)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		fmt.Fprintf(conn, "INFO {\"server_id\":\"test\",\"headers\":true}\r\n")
+		r := bufio.NewReader(conn)
+		seen := make(map[string]bool)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			args := strings.Fields(line)
+			switch args[0] {
+			case "PING":
+				conn.Write([]byte("PONG\r\n"))
+			case "HPUB":
+				size, _ := strconv.Atoi(args[4])
+				msg := make([]byte, size+2)
+				io.ReadFull(r, msg)
+				hsize, _ := strconv.Atoi(args[3])
+				line += string(msg[:hsize])
+				ack := `{"stream":"gor","seq":1}`
+				if seen[string(msg[:hsize])] {
+					ack = `{"stream":"gor","seq":1,"duplicate":true}`
+				}
+				seen[string(msg[:hsize])] = true
+				fmt.Fprintf(conn, "MSG %s 1 %d\r\n%s\r\n", args[2], len(ack), ack)
+			}
+			commands <- line
+		}
+	}()
+
+	output := NewNATSOutput(ln.Addr().String(), &NATSOutputConfig{Subject: "gor.{method}", JetStream: true, Token: "secret"})
+	defer output.(*NATSOutput).Close()
+	payload := "1 a1b2 1 -1\nGET / HTTP/1.1\r\n\r\n"
+	output.Write([]byte(payload))
+	output.Write([]byte(payload))
+
+	expected := []string{"CONNECT ", "PING", "SUB _INBOX.", "HPUB gor.GET _INBOX.", "HPUB gor.GET _INBOX."}
+	for i, prefix := range expected {
+		select {
+		case line := <-commands:
+			if !strings.HasPrefix(line, prefix) {
+				t.Errorf("%d: expected %q, got %q", i, prefix, line)
+			}
+			if prefix == "CONNECT " && !strings.Contains(line, `"auth_token":"secret"`) {
+				t.Errorf("expected the token in %q", line)
+			}
+			if strings.HasPrefix(prefix, "HPUB") && !strings.Contains(line, "Nats-Msg-Id: a1b2-1\r\n") {
+				t.Errorf("expected the message id in %q", line)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%d: expected %q", i, prefix)
+		}
+	}
+	o := output.(*NATSOutput)
+	for i := 0; i < 100 && atomic.LoadInt64(&o.acked)+atomic.LoadInt64(&o.duplicates) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if atomic.LoadInt64(&o.acked) != 1 || atomic.LoadInt64(&o.duplicates) != 1 {
+		t.Errorf("expected an ack and a duplicate, got %s", o)
+	}
+
+	// the messages queued are published on Close, the ones written after are refused
+	queued := "1 c3d4 2 -1\nGET / HTTP/1.1\r\n\r\n"
+	o.Write([]byte(queued))
+	o.Close()
+	select {
+	case line := <-commands:
+		if !strings.HasPrefix(line, "HPUB gor.GET _INBOX.") || !strings.Contains(line, "Nats-Msg-Id: c3d4-1\r\n") {
+			t.Errorf("expected the message queued to be published, got %q", line)
+		}
+	case <-time.After(time.Second):
+		t.Error("expected the message queued to be published on Close")
+	}
+	if n, err := o.Write([]byte(queued)); n != 0 || err != ErrorStopped {
+		t.Errorf("expected the payload written after Close to be refused, got %d %v", n, err)
+	}
+}
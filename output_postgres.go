@@ -0,0 +1,491 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// postgresMaxResponse is the maximum size of the messages read from the target
+const postgresMaxResponse = 64 << 20
+
+// PostgresOutputConfig is the configuration of the PostgreSQL output
+type PostgresOutputConfig struct {
+	User        string        `json:"output-postgres-user"`
+	Password    string        `json:"output-postgres-password"`
+	Database    string        `json:"output-postgres-database"`
+	Timeout     time.Duration `json:"output-postgres-timeout"`
+	IdleTimeout time.Duration `json:"output-postgres-idle-timeout"`
+}
+
+// PostgresOutput replays the PostgreSQL connections recorded with --input-raw-protocol postgres against a standby
+// cluster. each recorded connection is replayed on a connection authenticated with the user of the configuration,
+// its requests are sent with the delays they were recorded with and the responses of the target are discarded.
+// the recorded startup message gives the database, when the configuration has none, and the run-time parameters
+// of the connection. the recorded password messages are skipped.
+type PostgresOutput struct {
+	sync.Mutex
+	address  string
+	config   *PostgresOutputConfig
+	sessions map[string]*postgresSession // by the id of the recorded connection
+}
+
+type postgresRequest struct {
+	data      []byte // messages
+	timestamp int64  // recorded
+}
+
+// postgresSession is a connection replayed against the target
+type postgresSession struct {
+	output    *PostgresOutput
+	id        string
+	database  string
+	params    []string // run-time parameters of the recorded startup message
+	timestamp int64    // of the first request
+	requests  chan postgresRequest
+	done      chan struct{}
+	stop      sync.Once
+	lock      sync.Mutex // guards conn
+	conn      net.Conn
+	reader    *bufio.Reader
+	copying   bool // the target waits for the data of a COPY FROM STDIN
+}
+
+// NewPostgresOutput constructor for PostgresOutput, address is the host:port of the target
+func NewPostgresOutput(address string, config *PostgresOutputConfig) io.Writer {
+	o := new(PostgresOutput)
+	o.address = address
+	o.config = config
+	if o.config.Timeout < time.Millisecond {
+		o.config.Timeout = 5 * time.Second
+	}
+	if o.config.IdleTimeout < time.Millisecond {
+		o.config.IdleTimeout = 5 * time.Minute
+	}
+	o.sessions = make(map[string]*postgresSession)
+	return o
+}
+
+// Write queues the request to the session of its connection, the session is opened by its first request
+func (o *PostgresOutput) Write(data []byte) (n int, err error) {
+	n = len(data)
+	if !isRequestPayload(data) {
+		return
+	}
+	meta := payloadMeta(data)
+	if len(meta) < 3 {
+		return
+	}
+	id := string(meta[1])
+	timestamp, _ := strconv.ParseInt(string(meta[2]), 10, 64)
+	body := payloadBody(data)
+	if len(body) == 0 {
+		return
+	}
+	o.Lock()
+	s, ok := o.sessions[id]
+	if !ok {
+		s = &postgresSession{
+			output:    o,
+			id:        id,
+			database:  o.config.Database,
+			timestamp: timestamp,
+			requests:  make(chan postgresRequest, 1000),
+			done:      make(chan struct{}),
+		}
+		if params, ok := proto.ParsePostgresStartup(body); ok {
+			if s.database == "" {
+				s.database = proto.PostgresStartupParam(params, "database")
+			}
+			for i := 0; i+1 < len(params); i += 2 {
+				switch params[i] {
+				case "user", "database", "replication":
+				default:
+					s.params = append(s.params, params[i], params[i+1])
+				}
+			}
+		}
+		o.sessions[id] = s
+		go s.run()
+	}
+	o.Unlock()
+	select {
+	case s.requests <- postgresRequest{data: append([]byte(nil), body...), timestamp: timestamp}:
+	case <-s.done:
+	}
+	return
+}
+
+// remove forgets the session, unless it was replaced by a session with the same id
+func (o *PostgresOutput) remove(s *postgresSession) {
+	o.Lock()
+	if o.sessions[s.id] == s {
+		delete(o.sessions, s.id)
+	}
+	o.Unlock()
+}
+
+func (o *PostgresOutput) String() string {
+	return fmt.Sprintf("PostgreSQL output: %s", o.address)
+}
+
+// Close closes the sessions in progress
+func (o *PostgresOutput) Close() error {
+	o.Lock()
+	for _, s := range o.sessions {
+		s.close()
+	}
+	o.Unlock()
+	return nil
+}
+
+// run connects to the target and sends the requests until the connection is terminated, or idle for longer than
+// IdleTimeout. the session is forgotten on errors, the requests that follow open a new one.
+func (s *postgresSession) run() {
+	defer s.output.remove(s)
+	defer s.close()
+	if err := s.startup(); err != nil {
+		Debug(1, fmt.Sprintf("[POSTGRES-OUTPUT] session %s: %v", s.id, err))
+		return
+	}
+	started := time.Now()
+	idle := time.NewTimer(s.output.config.IdleTimeout)
+	defer idle.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-idle.C:
+			return
+		case r := <-s.requests:
+			// the delay since the first request is preserved
+			if wait := time.Duration(r.timestamp-s.timestamp) - time.Since(started); wait > 0 {
+				select {
+				case <-time.After(wait):
+				case <-s.done:
+					return
+				}
+			}
+			terminate, err := s.request(r.data)
+			if err != nil {
+				Debug(1, fmt.Sprintf("[POSTGRES-OUTPUT] session %s: %v", s.id, err))
+				return
+			}
+			if terminate {
+				return
+			}
+			if !idle.Stop() {
+				<-idle.C
+			}
+			idle.Reset(s.output.config.IdleTimeout)
+		}
+	}
+}
+
+// request sends the recorded messages to the target and reads its response
+func (s *postgresSession) request(data []byte) (terminate bool, err error) {
+	typ, _, n := proto.PostgresMessage(data)
+	if data[0] == 0 || n == 0 || typ == proto.PostgresPassword {
+		// the startup message and the authentication
+		return
+	}
+	copyData := typ == proto.PostgresCopyData || typ == proto.PostgresCopyDone || typ == proto.PostgresCopyFail
+	if s.copying && !copyData {
+		// the data of the copy were not recorded
+		if err = s.write(proto.AppendPostgresMessage(nil, proto.PostgresCopyFail, []byte("copy data not recorded\x00"))); err != nil {
+			return
+		}
+		if err = s.response(); err != nil {
+			return
+		}
+	}
+	if !s.copying && copyData {
+		return
+	}
+	if err = s.write(data); err != nil {
+		return
+	}
+	// the type of the last message
+	for len(data) > n {
+		data = data[n:]
+		if typ, _, n = proto.PostgresMessage(data); n == 0 {
+			return false, errors.New("invalid message")
+		}
+	}
+	if typ == proto.PostgresTerminate {
+		return true, nil
+	}
+	return false, s.response()
+}
+
+// response reads the messages of the target until it waits for the client
+func (s *postgresSession) response() error {
+	s.conn.SetReadDeadline(time.Now().Add(s.output.config.Timeout))
+	for {
+		typ, _, err := s.read()
+		if err != nil {
+			return err
+		}
+		switch typ {
+		case proto.PostgresReadyForQuery:
+			s.copying = false
+			return nil
+		case proto.PostgresCopyInResponse, proto.PostgresCopyBoth:
+			s.copying = true
+			return nil
+		}
+	}
+}
+
+// startup connects to the target and authenticates with the user of the configuration, using a cleartext or
+// md5 password, or SCRAM-SHA-256
+func (s *postgresSession) startup() (err error) {
+	o := s.output
+	conn, err := net.DialTimeout("tcp", o.address, o.config.Timeout)
+	if err != nil {
+		return
+	}
+	s.lock.Lock()
+	s.conn = conn
+	s.lock.Unlock()
+	select {
+	case <-s.done:
+		// closed while dialing
+		conn.Close()
+		return errors.New("session closed")
+	default:
+	}
+	conn.SetDeadline(time.Now().Add(o.config.Timeout))
+	s.reader = bufio.NewReader(conn)
+	params := []string{"user", o.config.User}
+	if s.database != "" {
+		params = append(params, "database", s.database)
+	}
+	if err = s.write(proto.AppendPostgresStartup(nil, append(params, s.params...)...)); err != nil {
+		return
+	}
+	var scram *scramClient
+	for {
+		typ, body, err := s.read()
+		if err != nil {
+			return err
+		}
+		switch typ {
+		case proto.PostgresReadyForQuery:
+			return conn.SetDeadline(time.Time{})
+		case proto.PostgresErrorResponse:
+			return postgresError(body)
+		case proto.PostgresAuthentication:
+		default:
+			// ParameterStatus, BackendKeyData and notices
+			continue
+		}
+		code, ok := proto.PostgresAuthRequest(body)
+		if !ok {
+			return errors.New("invalid authentication request")
+		}
+		var password []byte
+		switch code {
+		case proto.PostgresAuthOK:
+			continue
+		case proto.PostgresAuthCleartextPassword:
+			password = append([]byte(o.config.Password), 0)
+		case proto.PostgresAuthMD5Password:
+			if len(body) < 8 {
+				return errors.New("invalid authentication request")
+			}
+			password = append([]byte(postgresMD5(o.config.User, o.config.Password, body[4:8])), 0)
+		case proto.PostgresAuthSASL:
+			if !bytes.Contains(body[4:], []byte("SCRAM-SHA-256\x00")) {
+				return errors.New("unsupported SASL mechanisms")
+			}
+			// the user name is the one of the startup message
+			scram = newSCRAMClient("", o.config.Password)
+			first := scram.first()
+			password = append([]byte("SCRAM-SHA-256\x00"), 0, 0, 0, 0)
+			binary.BigEndian.PutUint32(password[len(password)-4:], uint32(len(first)))
+			password = append(password, first...)
+		case proto.PostgresAuthSASLContinue:
+			if scram == nil {
+				return errors.New("unexpected SASL continuation")
+			}
+			if password, err = scram.final(body[4:]); err != nil {
+				return err
+			}
+		case proto.PostgresAuthSASLFinal:
+			if scram == nil || !scram.verify(body[4:]) {
+				return errors.New("invalid signature of the server")
+			}
+			continue
+		default:
+			return fmt.Errorf("unsupported authentication %d", code)
+		}
+		if err = s.write(proto.AppendPostgresMessage(nil, proto.PostgresPassword, password)); err != nil {
+			return err
+		}
+	}
+}
+
+// read reads a message of at most postgresMaxResponse bytes
+func (s *postgresSession) read() (typ byte, body []byte, err error) {
+	var header [5]byte
+	if _, err = io.ReadFull(s.reader, header[:]); err != nil {
+		return
+	}
+	length := binary.BigEndian.Uint32(header[1:])
+	if length < 4 || length-4 > postgresMaxResponse {
+		return 0, nil, errors.New("invalid postgres message length")
+	}
+	body = make([]byte, length-4)
+	if _, err = io.ReadFull(s.reader, body); err != nil {
+		return
+	}
+	return header[0], body, nil
+}
+
+// write sends messages to the target
+func (s *postgresSession) write(data []byte) error {
+	s.conn.SetWriteDeadline(time.Now().Add(s.output.config.Timeout))
+	_, err := s.conn.Write(data)
+	return err
+}
+
+func (s *postgresSession) close() {
+	s.stop.Do(func() {
+		close(s.done)
+		s.lock.Lock()
+		if s.conn != nil {
+			s.conn.Close()
+		}
+		s.lock.Unlock()
+	})
+}
+
+// postgresMD5 returns the md5 password, "md5" followed by md5(md5(password + user) + salt) in hex
+func postgresMD5(user, password string, salt []byte) string {
+	inner := md5.Sum([]byte(password + user))
+	h := md5.New()
+	h.Write([]byte(hex.EncodeToString(inner[:])))
+	h.Write(salt)
+	return "md5" + hex.EncodeToString(h.Sum(nil))
+}
+
+// scramClient is the client side of SCRAM-SHA-256(RFC 5802 and RFC 7677), or SCRAM-SHA-512, without channel binding
+type scramClient struct {
+	hash      func() hash.Hash // sha256.New, or sha512.New for SCRAM-SHA-512
+	user      string
+	password  string
+	nonce     string
+	auth      []byte // AuthMessage
+	serverKey []byte
+}
+
+func newSCRAMClient(user, password string) *scramClient {
+	nonce := make([]byte, 18)
+	rand.Read(nonce)
+	user = strings.NewReplacer("=", "=3D", ",", "=2C").Replace(user)
+	return &scramClient{hash: sha256.New, user: user, password: password, nonce: base64.StdEncoding.EncodeToString(nonce)}
+}
+
+// firstBare is the client-first-message without its GS2 header
+func (c *scramClient) firstBare() string {
+	return "n=" + c.user + ",r=" + c.nonce
+}
+
+func (c *scramClient) first() []byte {
+	return []byte("n,," + c.firstBare())
+}
+
+// final returns the client-final-message answering the server-first-message
+func (c *scramClient) final(serverFirst []byte) ([]byte, error) {
+	var nonce, salt string
+	var iterations int
+	for _, attr := range strings.Split(string(serverFirst), ",") {
+		if len(attr) < 2 || attr[1] != '=' {
+			continue
+		}
+		switch attr[0] {
+		case 'r':
+			nonce = attr[2:]
+		case 's':
+			salt = attr[2:]
+		case 'i':
+			iterations, _ = strconv.Atoi(attr[2:])
+		}
+	}
+	saltBytes, err := base64.StdEncoding.DecodeString(salt)
+	if err != nil || !strings.HasPrefix(nonce, c.nonce) || iterations < 1 {
+		return nil, errors.New("invalid SCRAM server-first-message")
+	}
+	salted := pbkdf2.Key([]byte(c.password), saltBytes, iterations, c.hash().Size(), c.hash)
+	clientKey := c.mac(salted, []byte("Client Key"))
+	h := c.hash()
+	h.Write(clientKey)
+	storedKey := h.Sum(nil)
+	withoutProof := "c=biws,r=" + nonce
+	c.auth = []byte(c.firstBare() + "," + string(serverFirst) + "," + withoutProof)
+	proof := c.mac(storedKey, c.auth)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+	c.serverKey = c.mac(salted, []byte("Server Key"))
+	return []byte(withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)), nil
+}
+
+// verify checks the signature of the server-final-message
+func (c *scramClient) verify(serverFinal []byte) bool {
+	if c.auth == nil || !bytes.HasPrefix(serverFinal, []byte("v=")) {
+		return false
+	}
+	signature, err := base64.StdEncoding.DecodeString(string(serverFinal[2:]))
+	return err == nil && hmac.Equal(signature, c.mac(c.serverKey, c.auth))
+}
+
+func (c *scramClient) mac(key, data []byte) []byte {
+	h := hmac.New(c.hash, key)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+func scramHMAC(key, data []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// postgresError returns the error of an ErrorResponse message
+func postgresError(body []byte) error {
+	var code, message string
+	for len(body) > 1 {
+		i := bytes.IndexByte(body[1:], 0)
+		if i < 0 {
+			break
+		}
+		switch body[0] {
+		case 'C':
+			code = string(body[1 : 1+i])
+		case 'M':
+			message = string(body[1 : 1+i])
+		}
+		body = body[2+i:]
+	}
+	return fmt.Errorf("postgres error %s: %s", code, message)
+}
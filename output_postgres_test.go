@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+func TestPostgresOutput(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	type received struct {
+		typ  byte
+		body string
+	}
+	messages := make(chan received, 20)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		head := make([]byte, 8)
+		if _, err = io.ReadFull(reader, head); err != nil {
+			t.Error(err)
+			return
+		}
+		body := make([]byte, int(head[3])-8)
+		io.ReadFull(reader, body)
+		params, ok := proto.ParsePostgresStartup(append(head, body...))
+		if !ok || proto.PostgresStartupParam(params, "user") != "replay" || proto.PostgresStartupParam(params, "database") != "shop" || proto.PostgresStartupParam(params, "application_name") != "api" {
+			t.Errorf("unexpected startup parameters %q", params)
+			return
+		}
+		s := &postgresSession{conn: conn, reader: reader}
+		write := func(typ byte, body string) {
+			conn.Write(proto.AppendPostgresMessage(nil, typ, []byte(body)))
+		}
+		// SCRAM-SHA-256
+		write('R', "\x00\x00\x00\x0aSCRAM-SHA-256\x00\x00")
+		_, first, _ := s.read()
+		i := bytes.Index(first, []byte("n,,"))
+		if i < 0 {
+			t.Errorf("unexpected SASLInitialResponse %q", first)
+			return
+		}
+		clientFirstBare := string(first[i+3:])
+		salt := []byte("salt")
+		serverFirst := "r=" + strings.TrimPrefix(clientFirstBare, "n=,r=") + "server,s=" + base64.StdEncoding.EncodeToString(salt) + ",i=4096"
+		write('R', "\x00\x00\x00\x0b"+serverFirst)
+		_, final, _ := s.read()
+		withoutProof := final[:bytes.Index(final, []byte(",p="))]
+		proof, _ := base64.StdEncoding.DecodeString(string(final[len(withoutProof)+3:]))
+		salted := pbkdf2.Key([]byte("secret"), salt, 4096, sha256.Size, sha256.New)
+		storedKey := sha256.Sum256(scramHMAC(salted, []byte("Client Key")))
+		auth := []byte(clientFirstBare + "," + serverFirst + "," + string(withoutProof))
+		signature := scramHMAC(storedKey[:], auth)
+		for i := range proof {
+			proof[i] ^= signature[i]
+		}
+		if sum := sha256.Sum256(proof); !bytes.Equal(sum[:], storedKey[:]) {
+			t.Error("invalid SCRAM proof")
+			return
+		}
+		write('R', "\x00\x00\x00\x0cv="+base64.StdEncoding.EncodeToString(scramHMAC(scramHMAC(salted, []byte("Server Key")), auth)))
+		write('R', "\x00\x00\x00\x00")
+		write('Z', "I")
+		for {
+			typ, body, err := s.read()
+			if err != nil {
+				return
+			}
+			messages <- received{typ, string(body)}
+			switch typ {
+			case proto.PostgresQuery:
+				if strings.HasPrefix(string(body), "COPY") {
+					write('G', "\x00\x00\x00")
+					continue
+				}
+				write('C', "SELECT 1\x00")
+				write('Z', "I")
+			case proto.PostgresSync, proto.PostgresCopyFail:
+				write('Z', "I")
+			}
+		}
+	}()
+
+	output := NewPostgresOutput(ln.Addr().String(), &PostgresOutputConfig{User: "replay", Password: "secret"})
+	defer output.(*PostgresOutput).Close()
+	start := time.Now().UnixNano()
+	payload := func(body []byte) []byte {
+		return append(payloadHeader(RequestPayload, []byte("a1b2"), start, 0), body...)
+	}
+	msg := func(typ byte, body string) []byte {
+		return proto.AppendPostgresMessage(nil, typ, []byte(body))
+	}
+	output.Write(payload(proto.AppendPostgresStartup(nil, "user", "app", "database", "shop", "application_name", "api")))
+	output.Write(payload(msg('p', "md5abcdef\x00")))
+	output.Write(payload(msg('Q', "SELECT 1\x00")))
+	// the responses are not replayed
+	output.Write(append(payloadHeader(ResponsePayload, []byte("a1b2"), start, 0), msg('Z', "I")...))
+	output.Write(payload(msg('Q', "COPY t FROM STDIN\x00")))
+	// the copy data were not recorded
+	output.Write(payload(append(msg('P', "\x00SELECT 2\x00\x00\x00"), msg('S', "")...)))
+	output.Write(payload(msg('X', "")))
+
+	expected := []received{
+		{'Q', "SELECT 1\x00"},
+		{'Q', "COPY t FROM STDIN\x00"},
+		{'f', "copy data not recorded\x00"},
+		{'P', "\x00SELECT 2\x00\x00\x00"},
+		{'S', ""},
+		{'X', ""},
+	}
+	for i := range expected {
+		select {
+		case got := <-messages:
+			if got != expected[i] {
+				t.Errorf("expected %q, got %q", expected[i], got)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("expected %d messages, got %d", len(expected), i)
+		}
+	}
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// pubSubScope is the OAuth scope of the access tokens of the Pub/Sub output
+const pubSubScope = "https://www.googleapis.com/auth/pubsub"
+
+// the metadata server of Google Cloud, it provides the tokens of the service account of the GCE instances and of
+// the GKE workloads
+const gceTokenURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+
+// PubSubOutputConfig is the configuration of the Pub/Sub output
+type PubSubOutputConfig struct {
+	Endpoint    string        `json:"output-pubsub-endpoint"`
+	Credentials string        `json:"output-pubsub-credentials"`
+	OrderingKey bool          `json:"output-pubsub-ordering-key"`
+	Timeout     time.Duration `json:"output-pubsub-timeout"`
+
+	// batching
+	BatchMessages int           `json:"output-pubsub-batch-messages"`
+	BatchBytes    int           `json:"output-pubsub-batch-bytes"`
+	BatchDelay    time.Duration `json:"output-pubsub-batch-delay"`
+
+	// flow control, the payloads queued or being published
+	MaxOutstandingMessages int  `json:"output-pubsub-max-outstanding-messages"`
+	MaxOutstandingBytes    int  `json:"output-pubsub-max-outstanding-bytes"`
+	DropOnLimit            bool `json:"output-pubsub-drop-on-limit"`
+}
+
+// PubSubOutput publishes the requests and the responses, in the format of the payloads, to a topic of Google Cloud
+// Pub/Sub with its REST API. the messages carry the meta of the payloads as attributes, and with OrderingKey the
+// UUID of the payloads as ordering key, so that a request and its response are delivered in order. the messages
+// are published in batches, one batch at a time, and the payloads beyond the outstanding limits block Write, or
+// are dropped with DropOnLimit. the batches failing with a retryable status are retried 3 times.
+type PubSubOutput struct {
+	// Keep this as first element of struct because it guarantees 64bit
+	// alignment. atomic.* functions crash on 32bit machines if operand is not
+	// aligned at 64bit. See https://github.com/golang/go/issues/599
+	published int64
+	failed    int64
+	dropped   int64
+
+	topic    string // projects/<project>/topics/<topic>
+	config   *PubSubOutputConfig
+	client   *http.Client
+	emulator bool // no authentication
+
+	lock             sync.Mutex
+	cond             *sync.Cond // signaled when the queue changes
+	queue            [][]byte
+	outstanding      int // the payloads queued or being published
+	outstandingBytes int
+	closed           bool
+	finished         chan struct{}
+
+	auth *googleAuth
+}
+
+// pubSubMessage is a message of the publish method
+type pubSubMessage struct {
+	Data        string            `json:"data"`
+	Attributes  map[string]string `json:"attributes"`
+	OrderingKey string            `json:"orderingKey,omitempty"`
+}
+
+// NewPubSubOutput constructor for PubSubOutput, address is the topic, projects/<project>/topics/<topic>. the
+// output connects to the emulator at PUBSUB_EMULATOR_HOST if it is set
+func NewPubSubOutput(address string, config *PubSubOutputConfig) io.Writer {
+	o := new(PubSubOutput)
+	o.topic = address
+	o.config = config
+	if parts := strings.Split(address, "/"); len(parts) != 4 || parts[0] != "projects" || parts[2] != "topics" || parts[1] == "" || parts[3] == "" {
+		log.Fatalf("output-pubsub: invalid topic %q, expected projects/<project>/topics/<topic>", address)
+	}
+	if host := os.Getenv("PUBSUB_EMULATOR_HOST"); host != "" {
+		o.config.Endpoint = "http://" + host
+		o.emulator = true
+	}
+	if o.config.Endpoint == "" {
+		o.config.Endpoint = "https://pubsub.googleapis.com"
+	}
+	if o.config.Timeout < time.Millisecond {
+		o.config.Timeout = 10 * time.Second
+	}
+	if o.config.BatchMessages <= 0 || o.config.BatchMessages > 1000 {
+		o.config.BatchMessages = 100
+	}
+	// the publish requests are at most 10MB, their data is base64 encoded
+	if o.config.BatchBytes <= 0 || o.config.BatchBytes > 7<<20 {
+		o.config.BatchBytes = 1 << 20
+	}
+	if o.config.MaxOutstandingMessages <= 0 {
+		o.config.MaxOutstandingMessages = 1000
+	}
+	if o.config.MaxOutstandingBytes <= 0 {
+		o.config.MaxOutstandingBytes = 100 << 20
+	}
+	o.client = &http.Client{Timeout: o.config.Timeout}
+	o.auth = &googleAuth{credentials: o.config.Credentials, scope: pubSubScope, client: o.client}
+	o.cond = sync.NewCond(&o.lock)
+	o.finished = make(chan struct{})
+	go o.run()
+	return o
+}
+
+// Write queues the payload to be published, it blocks while the outstanding limits are exceeded
+func (o *PubSubOutput) Write(data []byte) (n int, err error) {
+	if !isOriginPayload(data) {
+		return len(data), nil
+	}
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	for !o.closed && o.outstanding > 0 &&
+		(o.outstanding >= o.config.MaxOutstandingMessages || o.outstandingBytes+len(data) > o.config.MaxOutstandingBytes) {
+		if o.config.DropOnLimit {
+			atomic.AddInt64(&o.dropped, 1)
+			return len(data), nil
+		}
+		o.cond.Wait()
+	}
+	if o.closed {
+		return len(data), nil
+	}
+	o.queue = append(o.queue, append([]byte(nil), data...))
+	o.outstanding++
+	o.outstandingBytes += len(data)
+	o.cond.Broadcast()
+	return len(data), nil
+}
+
+// run publishes the queue in batches, a batch is sent when it is full or BatchDelay after its first payload
+func (o *PubSubOutput) run() {
+	defer close(o.finished)
+	for {
+		o.lock.Lock()
+		for len(o.queue) == 0 && !o.closed {
+			o.cond.Wait()
+		}
+		if len(o.queue) == 0 {
+			o.lock.Unlock()
+			return
+		}
+		if !o.closed && len(o.queue) < o.config.BatchMessages && o.config.BatchDelay > 0 {
+			o.lock.Unlock()
+			time.Sleep(o.config.BatchDelay)
+			o.lock.Lock()
+		}
+		var batch [][]byte
+		var size int
+		for len(o.queue) > 0 && len(batch) < o.config.BatchMessages {
+			if len(batch) > 0 && size+len(o.queue[0]) > o.config.BatchBytes {
+				break
+			}
+			size += len(o.queue[0])
+			batch = append(batch, o.queue[0])
+			o.queue[0] = nil
+			o.queue = o.queue[1:]
+		}
+		o.lock.Unlock()
+
+		if err := o.publish(batch); err != nil {
+			atomic.AddInt64(&o.failed, int64(len(batch)))
+			Debug(1, fmt.Sprintf("[PUBSUB-OUTPUT] %s: %d messages not published: %v", o.topic, len(batch), err))
+		} else {
+			atomic.AddInt64(&o.published, int64(len(batch)))
+		}
+
+		o.lock.Lock()
+		o.outstanding -= len(batch)
+		o.outstandingBytes -= size
+		o.cond.Broadcast()
+		o.lock.Unlock()
+	}
+}
+
+// publish sends the batch, retried 3 times when the status is retryable
+func (o *PubSubOutput) publish(batch [][]byte) error {
+	var request struct {
+		Messages []pubSubMessage `json:"messages"`
+	}
+	for _, data := range batch {
+		meta := payloadMeta(data)
+		msg := pubSubMessage{Data: base64.StdEncoding.EncodeToString(data), Attributes: make(map[string]string)}
+		for i, key := range []string{"gor-type", "gor-id", "gor-timestamp", "gor-latency"} {
+			if i < len(meta) {
+				msg.Attributes[key] = string(meta[i])
+			}
+		}
+		if o.config.OrderingKey && len(meta) > 1 {
+			msg.OrderingKey = string(meta[1])
+		}
+		request.Messages = append(request.Messages, msg)
+	}
+	body, _ := json.Marshal(&request)
+
+	var err error
+	for retry := 0; retry < 4; retry++ {
+		if retry > 0 {
+			time.Sleep(time.Duration(100<<uint(retry-1)) * time.Millisecond)
+		}
+		var retryable bool
+		if retryable, err = o.send(body); err == nil || !retryable {
+			return err
+		}
+	}
+	return err
+}
+
+// send sends a publish request, it reports whether the request can be retried on errors
+func (o *PubSubOutput) send(body []byte) (retryable bool, err error) {
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(o.config.Endpoint, "/")+"/v1/"+o.topic+":publish", bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if !o.emulator {
+		token, err := o.auth.accessToken()
+		if err != nil {
+			return true, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return false, nil
+	case http.StatusUnauthorized:
+		// the token is requested again
+		o.auth.reset()
+		return true, fmt.Errorf("status %d: %s", resp.StatusCode, bytes.TrimSpace(respBody))
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true, fmt.Errorf("status %d: %s", resp.StatusCode, bytes.TrimSpace(respBody))
+	}
+	return false, fmt.Errorf("status %d: %s", resp.StatusCode, bytes.TrimSpace(respBody))
+}
+
+// googleAuth provides the OAuth access tokens of the service account of the credentials file, or of the metadata
+// server without credentials file, like the service account of the GCE instances and of the GKE workloads with
+// workload identity
+type googleAuth struct {
+	credentials string
+	scope       string
+	client      *http.Client
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+// accessToken returns the access token of the scope, it is requested again a minute before it expires
+func (a *googleAuth) accessToken() (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.token != "" && time.Now().Before(a.expiry) {
+		return a.token, nil
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	var resp *http.Response
+	var err error
+	if a.credentials != "" {
+		resp, err = a.serviceAccountToken()
+	} else {
+		req, _ := http.NewRequest(http.MethodGet, gceTokenURL+"?scopes="+url.QueryEscape(a.scope), nil)
+		req.Header.Set("Metadata-Flavor", "Google")
+		resp, err = a.client.Do(req)
+	}
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || json.Unmarshal(body, &token) != nil || token.AccessToken == "" {
+		return "", fmt.Errorf("token request failed with status %d: %s", resp.StatusCode, bytes.TrimSpace(body))
+	}
+	if token.ExpiresIn <= 0 {
+		token.ExpiresIn = 3600
+	}
+	a.token = token.AccessToken
+	a.expiry = time.Now().Add(time.Duration(token.ExpiresIn)*time.Second - time.Minute)
+	return a.token, nil
+}
+
+// reset drops the access token, when it is rejected
+func (a *googleAuth) reset() {
+	a.mu.Lock()
+	a.token = ""
+	a.mu.Unlock()
+}
+
+// serviceAccountToken requests an access token with a JWT signed by the key of the service account of the
+// credentials file
+func (a *googleAuth) serviceAccountToken() (*http.Response, error) {
+	data, err := ioutil.ReadFile(a.credentials)
+	if err != nil {
+		return nil, err
+	}
+	var account struct {
+		ClientEmail string `json:"client_email"`
+		PrivateKey  string `json:"private_key"`
+		TokenURI    string `json:"token_uri"`
+	}
+	if err = json.Unmarshal(data, &account); err != nil {
+		return nil, fmt.Errorf("invalid credentials: %v", err)
+	}
+	if account.TokenURI == "" {
+		account.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+	block, _ := pem.Decode([]byte(account.PrivateKey))
+	if block == nil {
+		return nil, errors.New("invalid credentials: no private key")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		if key, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+			return nil, fmt.Errorf("invalid credentials: %v", err)
+		}
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("invalid credentials: the private key is not an RSA key")
+	}
+
+	now := time.Now().Unix()
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   account.ClientEmail,
+		"scope": a.scope,
+		"aud":   account.TokenURI,
+		"iat":   now,
+		"exp":   now + 3600,
+	})
+	jwt := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`)) + "." +
+		base64.RawURLEncoding.EncodeToString(claims)
+	hash := sha256.Sum256([]byte(jwt))
+	signature, err := rsa.SignPKCS1v15(nil, rsaKey, crypto.SHA256, hash[:])
+	if err != nil {
+		return nil, err
+	}
+	jwt += "." + base64.RawURLEncoding.EncodeToString(signature)
+	return a.client.PostForm(account.TokenURI, url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {jwt},
+	})
+}
+
+func (o *PubSubOutput) String() string {
+	return fmt.Sprintf("Pub/Sub output: %s, published: %d, failed: %d, dropped: %d", o.topic,
+		atomic.LoadInt64(&o.published), atomic.LoadInt64(&o.failed), atomic.LoadInt64(&o.dropped))
+}
+
+// Close publishes the payloads queued, waiting for Timeout at most
+func (o *PubSubOutput) Close() error {
+	o.lock.Lock()
+	o.closed = true
+	o.cond.Broadcast()
+	o.lock.Unlock()
+	select {
+	case <-o.finished:
+	case <-time.After(o.config.Timeout):
+	}
+	return nil
+}
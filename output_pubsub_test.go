@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestPubSubOutput(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var failures int32
+	published := make(chan pubSubMessage, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/token":
+			// the assertion is a JWT signed by the key of the service account
+			parts := strings.Split(r.FormValue("assertion"), ".")
+			signature, _ := base64.RawURLEncoding.DecodeString(parts[len(parts)-1])
+			hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+			claims, _ := base64.RawURLEncoding.DecodeString(parts[1])
+			if rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, hash[:], signature) != nil || !strings.Contains(string(claims), `"iss":"gor@project.iam.gserviceaccount.com"`) {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte(`{"access_token":"token","expires_in":3600}`))
+		case "/v1/projects/project/topics/traffic:publish":
+			if r.Header.Get("Authorization") != "Bearer token" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			// the first request is retried
+			if atomic.AddInt32(&failures, 1) == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			var request struct{ Messages []pubSubMessage }
+			json.NewDecoder(r.Body).Decode(&request)
+			for _, m := range request.Messages {
+				published <- m
+			}
+			w.Write([]byte(`{"messageIds":["1"]}`))
+		}
+	}))
+	defer server.Close()
+
+	der, _ := x509.MarshalPKCS8PrivateKey(key)
+	credentials, _ := json.Marshal(map[string]string{
+		"type":         "service_account",
+		"client_email": "gor@project.iam.gserviceaccount.com",
+		"private_key":  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"token_uri":    server.URL + "/token",
+	})
+	f, _ := ioutil.TempFile("", "credentials")
+	defer os.Remove(f.Name())
+	f.Write(credentials)
+	f.Close()
+
+	output := NewPubSubOutput("projects/project/topics/traffic", &PubSubOutputConfig{
+		Endpoint:    server.URL,
+		Credentials: f.Name(),
+		OrderingKey: true,
+	})
+	request := "1 a1b2 1 -1\nGET / HTTP/1.1\r\n\r\n"
+	response := "2 a1b2 2 1\nHTTP/1.1 200 OK\r\n\r\n"
+	output.Write([]byte(request))
+	output.Write([]byte(response))
+	output.(*PubSubOutput).Close()
+
+	for _, payload := range []string{request, response} {
+		var m pubSubMessage
+		select {
+		case m = <-published:
+		default:
+			t.Fatalf("expected %q to be published, got %s", payload, output)
+		}
+		data, _ := base64.StdEncoding.DecodeString(m.Data)
+		meta := payloadMeta([]byte(payload))
+		if string(data) != payload || m.OrderingKey != "a1b2" || m.Attributes["gor-type"] != string(meta[0]) || m.Attributes["gor-latency"] != string(meta[3]) {
+			t.Errorf("unexpected message %+v of %q", m, payload)
+		}
+	}
+}
+
+func TestPubSubOutputFlowControl(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Write([]byte(`{"messageIds":["1"]}`))
+	}))
+	defer server.Close()
+	os.Setenv("PUBSUB_EMULATOR_HOST", strings.TrimPrefix(server.URL, "http://"))
+	defer os.Unsetenv("PUBSUB_EMULATOR_HOST")
+
+	output := NewPubSubOutput("projects/project/topics/traffic", &PubSubOutputConfig{MaxOutstandingMessages: 1, DropOnLimit: true})
+	for i := 0; i < 3; i++ {
+		output.Write([]byte("1 a1b2 1 -1\nGET / HTTP/1.1\r\n\r\n"))
+	}
+	close(release)
+	output.(*PubSubOutput).Close()
+	if s := output.(*PubSubOutput).String(); !strings.HasSuffix(s, "published: 1, failed: 0, dropped: 2") {
+		t.Errorf("expected a payload published and 2 dropped, got %s", s)
+	}
+}
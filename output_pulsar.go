@@ -0,0 +1,464 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+)
+
+// PulsarOutputConfig is the configuration of the Pulsar output
+type PulsarOutputConfig struct {
+	Topic   string        `json:"output-pulsar-topic"`
+	Token   string        `json:"output-pulsar-token"`
+	Dedup   int           `json:"output-pulsar-dedup"`
+	Timeout time.Duration `json:"output-pulsar-timeout"`
+
+	// the client credentials flow of OAuth 2.0
+	OAuthIssuer       string `json:"output-pulsar-oauth-issuer-url"`
+	OAuthClientID     string `json:"output-pulsar-oauth-client-id"`
+	OAuthClientSecret string `json:"output-pulsar-oauth-client-secret"`
+	OAuthAudience     string `json:"output-pulsar-oauth-audience"`
+}
+
+// PulsarOutput produces the requests and the responses, in the format of the payloads, to the topics of a Pulsar
+// cluster through the WebSocket API of its brokers or proxies. the topics are made from a template of the method,
+// the host and the path of the requests, each topic gets its own producer. the messages are keyed by their UUID,
+// so that a request and its response go to the same partition, and carry the meta of the payloads as properties.
+// with Dedup, the payloads whose UUID and type were produced within the last Dedup payloads are dropped.
+type PulsarOutput struct {
+	// Keep this as first element of struct because it guarantees 64bit
+	// alignment. atomic.* functions crash on 32bit machines if operand is not
+	// aligned at 64bit. See https://github.com/golang/go/issues/599
+	produced   int64
+	acked      int64
+	failed     int64
+	duplicates int64
+
+	address  string // host:port dialed
+	host     string // Host header of the upgrade requests
+	secure   bool
+	config   *PulsarOutputConfig
+	messages chan []byte
+	queuing  sync.RWMutex // done is closed once the payloads being written are queued
+	done     chan struct{}
+	finished chan struct{}
+	stop     sync.Once
+
+	lock      sync.Mutex // guards producers
+	producers map[string]*pulsarProducer
+
+	context  int64               // of the last message produced, by run
+	seen     map[string]struct{} // the ids produced, for Dedup
+	seenRing []string
+
+	token       string // the OAuth access token
+	tokenExpiry time.Time
+}
+
+// pulsarProducer is a WebSocket connection producing to a topic
+type pulsarProducer struct {
+	output  *PulsarOutput
+	topic   string
+	conn    net.Conn
+	writing sync.Mutex
+	stop    sync.Once
+}
+
+// pulsarMessage is a message of the WebSocket producer API
+type pulsarMessage struct {
+	Payload    string            `json:"payload"`
+	Properties map[string]string `json:"properties"`
+	Context    string            `json:"context"`
+	Key        string            `json:"key,omitempty"`
+}
+
+// NewPulsarOutput constructor for PulsarOutput, address is the ws:// or wss:// url of the WebSocket API
+func NewPulsarOutput(address string, config *PulsarOutputConfig) io.Writer {
+	o := new(PulsarOutput)
+	o.config = config
+	if o.config.Topic == "" {
+		o.config.Topic = "goreplay"
+	}
+	if o.config.Timeout < time.Millisecond {
+		o.config.Timeout = 5 * time.Second
+	}
+	if !strings.Contains(address, "://") {
+		address = "ws://" + address
+	}
+	u, err := url.Parse(address)
+	if err != nil || (u.Scheme != "ws" && u.Scheme != "wss") {
+		log.Fatalf("output-pulsar: invalid address %q, expected ws://host:port or wss://host:port", address)
+	}
+	if o.config.OAuthIssuer != "" && o.config.OAuthClientID == "" {
+		log.Fatal("output-pulsar: --output-pulsar-oauth-client-id is required by --output-pulsar-oauth-issuer-url")
+	}
+	o.secure = u.Scheme == "wss"
+	o.host = u.Host
+	o.address = u.Host
+	if u.Port() == "" {
+		port := "8080"
+		if o.secure {
+			port = "8443"
+		}
+		o.address = net.JoinHostPort(u.Hostname(), port)
+	}
+	o.producers = make(map[string]*pulsarProducer)
+	o.seen = make(map[string]struct{})
+	o.messages = make(chan []byte, 1000)
+	o.done = make(chan struct{})
+	o.finished = make(chan struct{})
+	go o.run()
+	return o
+}
+
+// Write queues the payload to be produced, the payloads written after Close are refused
+func (o *PulsarOutput) Write(data []byte) (n int, err error) {
+	if !isOriginPayload(data) {
+		return len(data), nil
+	}
+	o.queuing.RLock()
+	defer o.queuing.RUnlock()
+	select {
+	case <-o.done:
+		return 0, ErrorStopped
+	default:
+	}
+	// run receives the messages until done, and produces the ones queued then
+	o.messages <- append([]byte(nil), data...)
+	return len(data), nil
+}
+
+// run produces the messages until the output is closed, the messages queued then are produced before closing
+func (o *PulsarOutput) run() {
+	defer close(o.finished)
+	for {
+		select {
+		case data := <-o.messages:
+			o.produce(data)
+		case <-o.done:
+			for len(o.messages) > 0 {
+				o.produce(<-o.messages)
+			}
+			return
+		}
+	}
+}
+
+// produce produces the message of the payload, a message whose producer fails is retried once with a new producer
+func (o *PulsarOutput) produce(data []byte) {
+	meta := payloadMeta(data)
+	if len(meta) < 3 || o.duplicate(string(meta[1])+"-"+string(meta[0])) {
+		return
+	}
+	topic := payloadKey(o.config.Topic, data)
+	o.context++
+	msg, _ := json.Marshal(&pulsarMessage{
+		Payload: base64.StdEncoding.EncodeToString(data),
+		Properties: map[string]string{
+			"gor-type":      string(meta[0]),
+			"gor-id":        string(meta[1]),
+			"gor-timestamp": string(meta[2]),
+		},
+		Context: strconv.FormatInt(o.context, 10),
+		Key:     string(meta[1]),
+	})
+	var err error
+	for retry := 0; retry < 2; retry++ {
+		var p *pulsarProducer
+		if p, err = o.producer(topic); err == nil {
+			if err = p.write(proto.WebSocketFrame{Fin: true, Opcode: proto.WebSocketText, Payload: msg}); err == nil {
+				break
+			}
+			p.close()
+		}
+	}
+	if err != nil {
+		atomic.AddInt64(&o.failed, 1)
+		Debug(1, fmt.Sprintf("[PULSAR-OUTPUT] %s: %v", topic, err))
+		return
+	}
+	atomic.AddInt64(&o.produced, 1)
+}
+
+// duplicate reports whether the id was produced within the last Dedup payloads, and remembers it
+func (o *PulsarOutput) duplicate(id string) bool {
+	if o.config.Dedup <= 0 {
+		return false
+	}
+	if _, ok := o.seen[id]; ok {
+		atomic.AddInt64(&o.duplicates, 1)
+		return true
+	}
+	if len(o.seenRing) >= o.config.Dedup {
+		delete(o.seen, o.seenRing[0])
+		o.seenRing = o.seenRing[1:]
+	}
+	o.seen[id] = struct{}{}
+	o.seenRing = append(o.seenRing, id)
+	return false
+}
+
+// producer returns the producer of the topic, connected on its first message
+func (o *PulsarOutput) producer(topic string) (*pulsarProducer, error) {
+	o.lock.Lock()
+	p, ok := o.producers[topic]
+	o.lock.Unlock()
+	if ok {
+		return p, nil
+	}
+	path, err := pulsarProducerPath(topic)
+	if err != nil {
+		return nil, err
+	}
+	p = &pulsarProducer{output: o, topic: topic}
+	r, err := p.connect(path)
+	if err != nil {
+		p.close()
+		return nil, err
+	}
+	o.lock.Lock()
+	o.producers[topic] = p
+	o.lock.Unlock()
+	go p.read(r)
+	return p, nil
+}
+
+// pulsarProducerPath returns the path of the WebSocket producer API of the topic, a topic name without a tenant
+// and a namespace is in public/default, and is persistent without a domain
+func pulsarProducerPath(topic string) (string, error) {
+	domain := "persistent"
+	if i := strings.Index(topic, "://"); i != -1 {
+		domain, topic = topic[:i], topic[i+3:]
+	}
+	parts := strings.Split(topic, "/")
+	switch {
+	case len(parts) == 1:
+		parts = []string{"public", "default", parts[0]}
+	case len(parts) != 3:
+		return "", fmt.Errorf("invalid topic %q, expected [persistent://]tenant/namespace/topic", topic)
+	}
+	if domain != "persistent" && domain != "non-persistent" {
+		return "", fmt.Errorf("invalid domain %q of the topic %q", domain, topic)
+	}
+	for i, part := range parts {
+		if part == "" {
+			return "", fmt.Errorf("invalid topic %q", topic)
+		}
+		parts[i] = url.PathEscape(part)
+	}
+	return "/ws/v2/producer/" + domain + "/" + strings.Join(parts, "/"), nil
+}
+
+// authorization returns the value of the Authorization header of the upgrade requests, the OAuth access token
+// is requested again when it expires
+func (o *PulsarOutput) authorization() (string, error) {
+	if o.config.OAuthIssuer == "" {
+		if o.config.Token == "" {
+			return "", nil
+		}
+		return "Bearer " + o.config.Token, nil
+	}
+	if o.token == "" || time.Now().After(o.tokenExpiry) {
+		token, expiresIn, err := oauthClientCredentials(o.config, o.config.Timeout)
+		if err != nil {
+			return "", err
+		}
+		o.token = token
+		// renewed a minute before it expires
+		o.tokenExpiry = time.Now().Add(time.Duration(expiresIn)*time.Second - time.Minute)
+	}
+	return "Bearer " + o.token, nil
+}
+
+// oauthClientCredentials requests an access token to the token endpoint of the OpenID configuration of the issuer
+// with the client credentials grant. it returns the token and its lifetime in seconds
+func oauthClientCredentials(config *PulsarOutputConfig, timeout time.Duration) (string, int64, error) {
+	client := http.Client{Timeout: timeout}
+	resp, err := client.Get(strings.TrimSuffix(config.OAuthIssuer, "/") + "/.well-known/openid-configuration")
+	if err != nil {
+		return "", 0, err
+	}
+	var discovery struct {
+		TokenEndpoint string `json:"token_endpoint"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&discovery)
+	resp.Body.Close()
+	if err != nil || discovery.TokenEndpoint == "" {
+		return "", 0, errors.New("oauth: no token endpoint in the openid configuration of the issuer")
+	}
+	form := url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {config.OAuthClientID},
+		"client_secret": {config.OAuthClientSecret},
+	}
+	if config.OAuthAudience != "" {
+		form.Set("audience", config.OAuthAudience)
+	}
+	if resp, err = client.PostForm(discovery.TokenEndpoint, form); err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if resp.StatusCode != http.StatusOK || json.Unmarshal(body, &token) != nil || token.AccessToken == "" {
+		return "", 0, fmt.Errorf("oauth: token request failed with status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	if token.ExpiresIn <= 0 {
+		token.ExpiresIn = 3600
+	}
+	return token.AccessToken, token.ExpiresIn, nil
+}
+
+// connect upgrades a connection to the WebSocket producer API of the topic
+func (p *pulsarProducer) connect(path string) (r *bufio.Reader, err error) {
+	o := p.output
+	auth, err := o.authorization()
+	if err != nil {
+		return
+	}
+	dialer := &net.Dialer{Timeout: o.config.Timeout}
+	var conn net.Conn
+	if o.secure {
+		host, _, _ := net.SplitHostPort(o.address)
+		conn, err = tls.DialWithDialer(dialer, "tcp", o.address, &tls.Config{ServerName: host})
+	} else {
+		conn, err = dialer.Dial("tcp", o.address)
+	}
+	if err != nil {
+		return
+	}
+	p.conn = conn
+
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	key := base64.StdEncoding.EncodeToString(nonce)
+	req := "GET " + path + " HTTP/1.1\r\nHost: " + o.host + "\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: " + key + "\r\nSec-WebSocket-Version: 13\r\n"
+	if auth != "" {
+		req += "Authorization: " + auth + "\r\n"
+	}
+	conn.SetDeadline(time.Now().Add(o.config.Timeout))
+	if _, err = conn.Write([]byte(req + "\r\n")); err != nil {
+		return
+	}
+	r = bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("upgrade refused with status %d", resp.StatusCode)
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != proto.WebSocketAccept([]byte(key)) {
+		return nil, errors.New("invalid Sec-WebSocket-Accept header")
+	}
+	return r, conn.SetDeadline(time.Time{})
+}
+
+// read reads the acknowledgements of the messages, pings are answered and the producer is closed with the
+// connection
+func (p *pulsarProducer) read(r *bufio.Reader) {
+	defer p.close()
+	for {
+		f, err := readWebSocketFrame(r)
+		if err != nil {
+			return
+		}
+		switch f.Opcode {
+		case proto.WebSocketPing:
+			if p.write(proto.WebSocketFrame{Fin: true, Opcode: proto.WebSocketPong, Payload: f.Unmask()}) != nil {
+				return
+			}
+		case proto.WebSocketClose:
+			p.write(proto.WebSocketFrame{Fin: true, Opcode: proto.WebSocketClose, Payload: f.Unmask()})
+			return
+		case proto.WebSocketText:
+			var ack struct {
+				Result   string `json:"result"`
+				ErrorMsg string `json:"errorMsg"`
+			}
+			json.Unmarshal(f.Unmask(), &ack)
+			if ack.Result == "ok" {
+				atomic.AddInt64(&p.output.acked, 1)
+			} else {
+				atomic.AddInt64(&p.output.failed, 1)
+				Debug(1, fmt.Sprintf("[PULSAR-OUTPUT] %s: %s %s", p.topic, ack.Result, ack.ErrorMsg))
+			}
+		}
+	}
+}
+
+// write sends a frame to the broker, masked with a random key
+func (p *pulsarProducer) write(f proto.WebSocketFrame) error {
+	f.Masked = true
+	rand.Read(f.Key[:])
+	p.writing.Lock()
+	defer p.writing.Unlock()
+	p.conn.SetWriteDeadline(time.Now().Add(p.output.config.Timeout))
+	_, err := p.conn.Write(proto.AppendWebSocketFrame(nil, f))
+	return err
+}
+
+// close closes the connection and forgets the producer, the next message of its topic connects a new one
+func (p *pulsarProducer) close() {
+	p.stop.Do(func() {
+		if p.conn != nil {
+			p.conn.Close()
+		}
+		o := p.output
+		o.lock.Lock()
+		if o.producers[p.topic] == p {
+			delete(o.producers, p.topic)
+		}
+		o.lock.Unlock()
+	})
+}
+
+func (o *PulsarOutput) String() string {
+	return fmt.Sprintf("Pulsar output: %s, produced: %d, acked: %d, failed: %d, duplicates: %d", o.address,
+		atomic.LoadInt64(&o.produced), atomic.LoadInt64(&o.acked), atomic.LoadInt64(&o.failed), atomic.LoadInt64(&o.duplicates))
+}
+
+// Close produces the messages queued, waiting for Timeout at most, and closes the producers
+func (o *PulsarOutput) Close() error {
+	o.stop.Do(func() {
+		o.queuing.Lock()
+		close(o.done)
+		o.queuing.Unlock()
+		select {
+		case <-o.finished:
+		case <-time.After(o.config.Timeout):
+		}
+		o.lock.Lock()
+		producers := make([]*pulsarProducer, 0, len(o.producers))
+		for _, p := range o.producers {
+			producers = append(producers, p)
+		}
+		o.lock.Unlock()
+		for _, p := range producers {
+			p.close()
+		}
+	})
+	return nil
+}
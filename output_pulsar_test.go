@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+)
+
+func TestPulsarProducerPath(t *testing.T) {
+	tests := []struct {
+		topic, path string
+	}{
+		{"requests", "/ws/v2/producer/persistent/public/default/requests"},
+		{"traffic/http/GET.users", "/ws/v2/producer/persistent/traffic/http/GET.users"},
+		{"non-persistent://traffic/http/all", "/ws/v2/producer/non-persistent/traffic/http/all"},
+		{"traffic/requests", ""},
+		{"other://traffic/http/all", ""},
+	}
+	for _, tt := range tests {
+		if path, err := pulsarProducerPath(tt.topic); path != tt.path || (err == nil) != (tt.path != "") {
+			t.Errorf("%s: expected %q, got %q %v", tt.topic, tt.path, path, err)
+		}
+	}
+}
+
+func TestPulsarOutput(t *testing.T) {
+	issuer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			fmt.Fprintf(w, `{"token_endpoint":"http://%s/oauth/token"}`, r.Host)
+		case "/oauth/token":
+			if r.FormValue("grant_type") != "client_credentials" || r.FormValue("client_id") != "gor" ||
+				r.FormValue("client_secret") != "secret" || r.FormValue("audience") != "urn:pulsar" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte(`{"access_token":"token","expires_in":3600}`))
+		}
+	}))
+	defer issuer.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	messages := make(chan string, 20)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				req, err := http.ReadRequest(r)
+				if err != nil {
+					return
+				}
+				if req.Header.Get("Authorization") != "Bearer token" {
+					conn.Write([]byte("HTTP/1.1 401 Unauthorized\r\n\r\n"))
+					return
+				}
+				fmt.Fprintf(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n",
+					proto.WebSocketAccept([]byte(req.Header.Get("Sec-WebSocket-Key"))))
+				for {
+					f, err := readWebSocketFrame(r)
+					if err != nil {
+						return
+					}
+					var msg pulsarMessage
+					json.Unmarshal(f.Unmask(), &msg)
+					payload, _ := base64.StdEncoding.DecodeString(msg.Payload)
+					messages <- fmt.Sprintf("%s %s %s %s %q", req.URL.Path, msg.Key, msg.Properties["gor-type"], msg.Properties["gor-timestamp"], payload)
+					ack := fmt.Sprintf(`{"result":"ok","messageId":"CAAQAw==","context":%q}`, msg.Context)
+					conn.Write(proto.AppendWebSocketFrame(nil, proto.WebSocketFrame{Fin: true, Opcode: proto.WebSocketText, Payload: []byte(ack)}))
+				}
+			}()
+		}
+	}()
+
+	output := NewPulsarOutput("ws://"+ln.Addr().String(), &PulsarOutputConfig{
+		Topic:             "traffic/http/{method}",
+		Dedup:             10,
+		OAuthIssuer:       issuer.URL,
+		OAuthClientID:     "gor",
+		OAuthClientSecret: "secret",
+		OAuthAudience:     "urn:pulsar",
+	})
+	defer output.(*PulsarOutput).Close()
+	request := "1 a1b2 1 -1\nGET / HTTP/1.1\r\n\r\n"
+	response := "2 a1b2 2 1\nHTTP/1.1 200 OK\r\n\r\n"
+	output.Write([]byte(request))
+	output.Write([]byte(response))
+	// captured twice
+	output.Write([]byte(request))
+
+	expected := []string{
+		fmt.Sprintf("/ws/v2/producer/persistent/traffic/http/GET a1b2 1 1 %q", request),
+		fmt.Sprintf("/ws/v2/producer/persistent/traffic/http/_ a1b2 2 2 %q", response),
+	}
+	got := make(map[string]bool)
+	for range expected {
+		select {
+		case m := <-messages:
+			got[m] = true
+		case <-time.After(time.Second):
+			t.Fatal("expected a message to be produced")
+		}
+	}
+	for _, e := range expected {
+		if !got[e] {
+			t.Errorf("expected %s to be produced, got %v", e, got)
+		}
+	}
+	select {
+	case m := <-messages:
+		t.Errorf("expected the duplicate to be dropped, got %s", m)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	o := output.(*PulsarOutput)
+	for i := 0; i < 100 && atomic.LoadInt64(&o.acked) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !strings.Contains(o.String(), "produced: 2, acked: 2, failed: 0, duplicates: 1") {
+		t.Errorf("unexpected stats %s", o)
+	}
+
+	// the messages queued are produced on Close, the ones written after are refused
+	queued := "1 c3d4 3 -1\nGET / HTTP/1.1\r\n\r\n"
+	o.Write([]byte(queued))
+	o.Close()
+	select {
+	case m := <-messages:
+		if e := fmt.Sprintf("/ws/v2/producer/persistent/traffic/http/GET c3d4 1 3 %q", queued); m != e {
+			t.Errorf("expected %s to be produced, got %s", e, m)
+		}
+	case <-time.After(time.Second):
+		t.Error("expected the message queued to be produced on Close")
+	}
+	if n, err := o.Write([]byte(queued)); n != 0 || err != ErrorStopped {
+		t.Errorf("expected the payload written after Close to be refused, got %d %v", n, err)
+	}
+}
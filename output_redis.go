@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+)
+
+// redisMaxReply is the maximum size of the replies read from the target while authenticating
+const redisMaxReply = 1 << 20
+
+// RedisOutputConfig is the configuration of the Redis output
+type RedisOutputConfig struct {
+	User        string        `json:"output-redis-user"`
+	Password    string        `json:"output-redis-password"`
+	Timeout     time.Duration `json:"output-redis-timeout"`
+	IdleTimeout time.Duration `json:"output-redis-idle-timeout"`
+}
+
+// RedisOutput replays the Redis connections recorded with --input-raw-protocol redis against a candidate server.
+// each recorded connection is replayed on a connection authenticated with the password of the configuration, its
+// commands are sent with the delays they were recorded with, without waiting for the replies, and the replies of
+// the target are discarded. the recorded AUTH commands are skipped, and the credentials of HELLO are removed.
+// the MOVED and ASK redirections of clusters are not followed.
+type RedisOutput struct {
+	sync.Mutex
+	address  string
+	config   *RedisOutputConfig
+	sessions map[string]*redisSession // by the id of the recorded connection
+}
+
+type redisCommand struct {
+	data      []byte
+	timestamp int64 // recorded
+}
+
+// redisSession is a connection replayed against the target
+type redisSession struct {
+	output    *RedisOutput
+	id        string
+	timestamp int64 // of the first command
+	commands  chan redisCommand
+	done      chan struct{}
+	stop      sync.Once
+	lock      sync.Mutex // guards conn
+	conn      net.Conn
+}
+
+// NewRedisOutput constructor for RedisOutput, address is the host:port of the target
+func NewRedisOutput(address string, config *RedisOutputConfig) io.Writer {
+	o := new(RedisOutput)
+	o.address = address
+	o.config = config
+	if o.config.Timeout < time.Millisecond {
+		o.config.Timeout = 5 * time.Second
+	}
+	if o.config.IdleTimeout < time.Millisecond {
+		o.config.IdleTimeout = 5 * time.Minute
+	}
+	o.sessions = make(map[string]*redisSession)
+	return o
+}
+
+// Write queues the command to the session of its connection, the session is opened by its first command
+func (o *RedisOutput) Write(data []byte) (n int, err error) {
+	n = len(data)
+	if !isRequestPayload(data) {
+		return
+	}
+	meta := payloadMeta(data)
+	if len(meta) < 3 {
+		return
+	}
+	id := string(meta[1])
+	timestamp, _ := strconv.ParseInt(string(meta[2]), 10, 64)
+	body := payloadBody(data)
+	if len(body) == 0 {
+		return
+	}
+	o.Lock()
+	s, ok := o.sessions[id]
+	if !ok {
+		s = &redisSession{
+			output:    o,
+			id:        id,
+			timestamp: timestamp,
+			commands:  make(chan redisCommand, 1000),
+			done:      make(chan struct{}),
+		}
+		o.sessions[id] = s
+		go s.run()
+	}
+	o.Unlock()
+	select {
+	case s.commands <- redisCommand{data: append([]byte(nil), body...), timestamp: timestamp}:
+	case <-s.done:
+	}
+	return
+}
+
+// remove forgets the session, unless it was replaced by a session with the same id
+func (o *RedisOutput) remove(s *redisSession) {
+	o.Lock()
+	if o.sessions[s.id] == s {
+		delete(o.sessions, s.id)
+	}
+	o.Unlock()
+}
+
+func (o *RedisOutput) String() string {
+	return fmt.Sprintf("Redis output: %s", o.address)
+}
+
+// Close closes the sessions in progress
+func (o *RedisOutput) Close() error {
+	o.Lock()
+	for _, s := range o.sessions {
+		s.close()
+	}
+	o.Unlock()
+	return nil
+}
+
+// run connects to the target and sends the commands until the target closes the connection, or it is idle for
+// longer than IdleTimeout. the session is forgotten on errors, the commands that follow open a new one.
+func (s *redisSession) run() {
+	defer s.output.remove(s)
+	defer s.close()
+	if err := s.connect(); err != nil {
+		Debug(1, fmt.Sprintf("[REDIS-OUTPUT] session %s: %v", s.id, err))
+		return
+	}
+	go s.discard()
+	started := time.Now()
+	idle := time.NewTimer(s.output.config.IdleTimeout)
+	defer idle.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-idle.C:
+			return
+		case c := <-s.commands:
+			// the delay since the first command is preserved
+			if wait := time.Duration(c.timestamp-s.timestamp) - time.Since(started); wait > 0 {
+				select {
+				case <-time.After(wait):
+				case <-s.done:
+					return
+				}
+			}
+			if data := redisReplayed(c.data); len(data) > 0 {
+				if err := s.write(data); err != nil {
+					Debug(1, fmt.Sprintf("[REDIS-OUTPUT] session %s: %v", s.id, err))
+					return
+				}
+			}
+			if !idle.Stop() {
+				<-idle.C
+			}
+			idle.Reset(s.output.config.IdleTimeout)
+		}
+	}
+}
+
+// redisReplayed returns the command sent to the target: AUTH is skipped and HELLO is sent without its AUTH
+// and SETNAME options
+func redisReplayed(data []byte) []byte {
+	args, ok := proto.RESPCommand(data)
+	if !ok {
+		return data
+	}
+	switch {
+	case bytes.EqualFold(args[0], []byte("AUTH")):
+		return nil
+	case bytes.EqualFold(args[0], []byte("HELLO")):
+		if len(args) > 2 {
+			return proto.AppendRESPCommand(nil, args[:2]...)
+		}
+	}
+	return data
+}
+
+// connect connects to the target and authenticates with the password of the configuration, if any
+func (s *redisSession) connect() (err error) {
+	o := s.output
+	conn, err := net.DialTimeout("tcp", o.address, o.config.Timeout)
+	if err != nil {
+		return
+	}
+	s.lock.Lock()
+	s.conn = conn
+	s.lock.Unlock()
+	select {
+	case <-s.done:
+		// closed while dialing
+		conn.Close()
+		return errors.New("session closed")
+	default:
+	}
+	if o.config.Password == "" {
+		return
+	}
+	args := [][]byte{[]byte("AUTH"), []byte(o.config.Password)}
+	if o.config.User != "" {
+		args = append(args[:1], []byte(o.config.User), args[1])
+	}
+	if err = s.write(proto.AppendRESPCommand(nil, args...)); err != nil {
+		return
+	}
+	conn.SetReadDeadline(time.Now().Add(o.config.Timeout))
+	reply, err := readRESP(bufio.NewReaderSize(conn, 64))
+	if err != nil {
+		return
+	}
+	if reply[0] == proto.RESPError {
+		return fmt.Errorf("authentication failed: %s", bytes.TrimSpace(reply[1:]))
+	}
+	return conn.SetReadDeadline(time.Time{})
+}
+
+// readRESP reads a RESP value of at most redisMaxReply bytes
+func readRESP(r *bufio.Reader) (data []byte, err error) {
+	for {
+		line, err := r.ReadSlice('\n')
+		if err != nil && err != bufio.ErrBufferFull {
+			return nil, err
+		}
+		data = append(data, line...)
+		if proto.RESPLength(data) > 0 {
+			return data, nil
+		}
+		if len(data) > redisMaxReply {
+			return nil, errors.New("redis reply too large")
+		}
+	}
+}
+
+// discard reads and drops the replies of the target, the session is closed with the connection
+func (s *redisSession) discard() {
+	io.Copy(ioutil.Discard, s.conn)
+	s.close()
+}
+
+// write sends commands to the target
+func (s *redisSession) write(data []byte) error {
+	s.conn.SetWriteDeadline(time.Now().Add(s.output.config.Timeout))
+	_, err := s.conn.Write(data)
+	return err
+}
+
+func (s *redisSession) close() {
+	s.stop.Do(func() {
+		close(s.done)
+		s.lock.Lock()
+		if s.conn != nil {
+			s.conn.Close()
+		}
+		s.lock.Unlock()
+	})
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+)
+
+func TestRedisOutput(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	commands := make(chan string, 20)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		for {
+			command, err := readRESP(reader)
+			if err != nil {
+				return
+			}
+			commands <- string(command)
+			args, _ := proto.RESPCommand(command)
+			if string(args[0]) == "AUTH" {
+				conn.Write([]byte("+OK\r\n"))
+				continue
+			}
+			// the replies are not waited for
+			if string(args[0]) == "GET" {
+				conn.Write([]byte("$-1\r\n"))
+			}
+		}
+	}()
+
+	output := NewRedisOutput(ln.Addr().String(), &RedisOutputConfig{User: "replay", Password: "secret"})
+	defer output.(*RedisOutput).Close()
+	start := time.Now().UnixNano()
+	payload := func(args ...string) []byte {
+		var b [][]byte
+		for _, arg := range args {
+			b = append(b, []byte(arg))
+		}
+		return append(payloadHeader(RequestPayload, []byte("a1b2"), start, 0), proto.AppendRESPCommand(nil, b...)...)
+	}
+	output.Write(payload("HELLO", "3", "AUTH", "app", "recorded"))
+	output.Write(payload("AUTH", "recorded"))
+	output.Write(payload("GET", "a"))
+	// the responses are not replayed
+	output.Write(append(payloadHeader(ResponsePayload, []byte("a1b2"), start, 0), "$-1\r\n"...))
+	output.Write(payload("SET", "b", "1"))
+
+	expected := []string{
+		"*3\r\n$4\r\nAUTH\r\n$6\r\nreplay\r\n$6\r\nsecret\r\n",
+		"*2\r\n$5\r\nHELLO\r\n$1\r\n3\r\n",
+		"*2\r\n$3\r\nGET\r\n$1\r\na\r\n",
+		"*3\r\n$3\r\nSET\r\n$1\r\nb\r\n$1\r\n1\r\n",
+	}
+	for i := range expected {
+		select {
+		case got := <-commands:
+			if got != expected[i] {
+				t.Errorf("expected %q, got %q", expected[i], got)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("expected %d commands, got %d", len(expected), i)
+		}
+	}
+}
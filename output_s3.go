@@ -6,17 +6,37 @@ import (
 	_ "io"
 	"log"
 	"math/rand"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
-	_ "github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/buger/goreplay/size"
 )
 
-// S3Output output plugin
+// S3OutputConfig is the configuration of the uploads of the file output to S3
+type S3OutputConfig struct {
+	Partition   bool          `json:"output-file-s3-partition"`
+	Service     string        `json:"output-file-s3-service"`
+	SSE         string        `json:"output-file-s3-sse"` // AES256 or aws:kms
+	KMSKeyID    string        `json:"output-file-s3-kms-key-id"`
+	PartSize    size.Size     `json:"output-file-s3-part-size"`
+	Concurrency int           `json:"output-file-s3-concurrency"`
+	MaxRetries  int           `json:"output-file-s3-max-retries"`
+	RetryDelay  time.Duration `json:"output-file-s3-retry-delay"`
+}
+
+// S3Output output plugin. the chunks are uploaded in multiple parts of PartSize, encrypted with SSE, and the
+// requests are retried MaxRetries times with a backoff from RetryDelay. with Partition, the keys are partitioned
+// like Hive, dt=YYYY-MM-DD/hour=HH/service=Service/ before the name of the chunk, on the time of the upload.
 type S3Output struct {
 	pathTemplate string
 
@@ -50,6 +70,19 @@ func NewS3Output(pathTemplate string, config *FileOutputConfig) *S3Output {
 
 	if strings.HasSuffix(o.pathTemplate, ".gz") {
 		bufferName += ".gz"
+	} else if strings.HasSuffix(o.pathTemplate, ".zst") {
+		bufferName += ".zst"
+	}
+	if o.config.S3.Partition && o.config.S3.Service == "" {
+		o.config.S3.Service, _ = os.Hostname()
+	}
+	if o.config.S3.KMSKeyID != "" && o.config.S3.SSE == "" {
+		o.config.S3.SSE = s3.ServerSideEncryptionAwsKms
+	}
+	switch o.config.S3.SSE {
+	case "", s3.ServerSideEncryptionAes256, s3.ServerSideEncryptionAwsKms:
+	default:
+		log.Fatalf("output-file-s3-sse: %q is not AES256 or aws:kms", o.config.S3.SSE)
 	}
 
 	bufferPath := filepath.Join(config.BufferPath, bufferName)
@@ -62,7 +95,17 @@ func NewS3Output(pathTemplate string, config *FileOutputConfig) *S3Output {
 
 func (o *S3Output) connect() {
 	if o.session == nil {
-		o.session = session.Must(session.NewSession(awsConfig()))
+		config := awsConfig()
+		if o.config.S3.MaxRetries > 0 || o.config.S3.RetryDelay > 0 {
+			config = request.WithRetryer(config, client.DefaultRetryer{
+				NumMaxRetries:    o.config.S3.MaxRetries,
+				MinRetryDelay:    o.config.S3.RetryDelay,
+				MinThrottleDelay: o.config.S3.RetryDelay,
+				MaxRetryDelay:    time.Minute,
+				MaxThrottleDelay: time.Minute,
+			})
+		}
+		o.session = session.Must(session.NewSession(config))
 		log.Println("[S3 Output] S3 connection succesfully initialized")
 	}
 }
@@ -99,22 +142,43 @@ func (o *S3Output) keyPath(idx int) (bucket, key string) {
 
 	key = setFileIndex(key, idx)
 
+	if o.config.S3.Partition {
+		now := time.Now()
+		dir, name := path.Split(key)
+		key = fmt.Sprintf("%sdt=%s/hour=%s/service=%s/%s", dir, now.Format("2006-01-02"), now.Format("15"),
+			url.PathEscape(o.config.S3.Service), name)
+	}
+
 	return
 }
 
 func (o *S3Output) onBufferUpdate(path string) {
-	svc := s3.New(o.session)
+	uploader := s3manager.NewUploader(o.session, func(u *s3manager.Uploader) {
+		if o.config.S3.PartSize > 0 {
+			u.PartSize = int64(o.config.S3.PartSize)
+		}
+		if o.config.S3.Concurrency > 0 {
+			u.Concurrency = o.config.S3.Concurrency
+		}
+	})
 	idx := getFileIndex(path)
 	bucket, key := o.keyPath(idx)
 
 	file, _ := os.Open(path)
-	// reader := bufio.NewReader(file)
+	defer file.Close()
 
-	_, err := svc.PutObject(&s3.PutObjectInput{
+	input := &s3manager.UploadInput{
 		Body:   file,
 		Bucket: aws.String(bucket),
 		Key:    aws.String(key),
-	})
+	}
+	if o.config.S3.SSE != "" {
+		input.ServerSideEncryption = aws.String(o.config.S3.SSE)
+	}
+	if o.config.S3.KMSKeyID != "" {
+		input.SSEKMSKeyId = aws.String(o.config.S3.KMSKeyID)
+	}
+	_, err := uploader.Upload(input)
 	if err != nil {
 		log.Printf("[S3 Output] Failed to upload data to %s/%s, %s\n", bucket, key, err)
 		os.Remove(path)
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+)
+
+// SIPOutputConfig is the configuration of the SIP output
+type SIPOutputConfig struct {
+	Transport   string        `json:"output-sip-transport"`
+	Timeout     time.Duration `json:"output-sip-timeout"`
+	IdleTimeout time.Duration `json:"output-sip-idle-timeout"`
+}
+
+// SIPOutput mirrors the calls recorded with --input-raw-protocol sip to a SIP server of a test environment. each
+// call gets its own socket, its requests are sent with the delays they were recorded with, and the responses of
+// the server are read from the socket. the top Via of the requests is rewritten with the address and the
+// transport of the socket so that the responses come back to it, and the To tag of the requests inside the
+// dialog is the one the server answered the INVITE with. the SDP bodies are sent as they were recorded, so the
+// media of the calls still goes to the recorded addresses.
+type SIPOutput struct {
+	sync.Mutex
+	address  string
+	config   *SIPOutputConfig
+	sessions map[string]*sipSession // by the UUID of the call
+}
+
+type sipRequest struct {
+	data      []byte
+	timestamp int64 // recorded
+}
+
+// sipSession is a call mirrored to the server
+type sipSession struct {
+	output    *SIPOutput
+	id        string
+	timestamp int64 // of the first request
+	requests  chan sipRequest
+	done      chan struct{}
+	stop      sync.Once
+	lock      sync.Mutex // guards conn and tag
+	conn      net.Conn
+	tag       string // To tag of the server
+}
+
+// NewSIPOutput constructor for SIPOutput, address is the host:port of the server
+func NewSIPOutput(address string, config *SIPOutputConfig) io.Writer {
+	o := new(SIPOutput)
+	o.address = address
+	o.config = config
+	switch o.config.Transport {
+	case "":
+		o.config.Transport = "udp"
+	case "udp", "tcp":
+	default:
+		log.Fatalf("output-sip: unsupported transport %q, it is udp or tcp", o.config.Transport)
+	}
+	if o.config.Timeout < time.Millisecond {
+		o.config.Timeout = 5 * time.Second
+	}
+	if o.config.IdleTimeout < time.Millisecond {
+		o.config.IdleTimeout = 5 * time.Minute
+	}
+	o.sessions = make(map[string]*sipSession)
+	return o
+}
+
+// Write queues the request to the session of its call, the session is opened by its first request
+func (o *SIPOutput) Write(data []byte) (n int, err error) {
+	n = len(data)
+	if !isRequestPayload(data) {
+		return
+	}
+	meta := payloadMeta(data)
+	if len(meta) < 3 {
+		return
+	}
+	id := string(meta[1])
+	timestamp, _ := strconv.ParseInt(string(meta[2]), 10, 64)
+	body := payloadBody(data)
+	if m, ok := proto.ParseSIP(body); !ok || !m.IsRequest() {
+		return
+	}
+	o.Lock()
+	s, ok := o.sessions[id]
+	if !ok {
+		s = &sipSession{
+			output:    o,
+			id:        id,
+			timestamp: timestamp,
+			requests:  make(chan sipRequest, 100),
+			done:      make(chan struct{}),
+		}
+		o.sessions[id] = s
+		go s.run()
+	}
+	o.Unlock()
+	select {
+	case s.requests <- sipRequest{data: append([]byte(nil), body...), timestamp: timestamp}:
+	case <-s.done:
+	}
+	return
+}
+
+// remove forgets the session, unless it was replaced by a session with the same id
+func (o *SIPOutput) remove(s *sipSession) {
+	o.Lock()
+	if o.sessions[s.id] == s {
+		delete(o.sessions, s.id)
+	}
+	o.Unlock()
+}
+
+func (o *SIPOutput) String() string {
+	return fmt.Sprintf("SIP output: %s://%s", o.config.Transport, o.address)
+}
+
+// Close closes the sessions in progress
+func (o *SIPOutput) Close() error {
+	o.Lock()
+	for _, s := range o.sessions {
+		s.close()
+	}
+	o.Unlock()
+	return nil
+}
+
+// run sends the requests of the call until the call ends, the socket fails, or it is idle for longer than
+// IdleTimeout
+func (s *sipSession) run() {
+	defer s.output.remove(s)
+	defer s.close()
+	o := s.output
+	conn, err := net.DialTimeout(o.config.Transport, o.address, o.config.Timeout)
+	if err != nil {
+		Debug(1, fmt.Sprintf("[SIP-OUTPUT] call %s: %v", s.id, err))
+		return
+	}
+	s.lock.Lock()
+	s.conn = conn
+	s.lock.Unlock()
+	select {
+	case <-s.done:
+		// closed while dialing
+		conn.Close()
+		return
+	default:
+	}
+	go s.receive()
+	started := time.Now()
+	idle := time.NewTimer(o.config.IdleTimeout)
+	defer idle.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-idle.C:
+			return
+		case r := <-s.requests:
+			// the delay since the first request is preserved
+			if wait := time.Duration(r.timestamp-s.timestamp) - time.Since(started); wait > 0 {
+				select {
+				case <-time.After(wait):
+				case <-s.done:
+					return
+				}
+			}
+			conn.SetWriteDeadline(time.Now().Add(o.config.Timeout))
+			if _, err := conn.Write(s.rewrite(r.data)); err != nil {
+				Debug(1, fmt.Sprintf("[SIP-OUTPUT] call %s: %v", s.id, err))
+				return
+			}
+			if !idle.Stop() {
+				<-idle.C
+			}
+			idle.Reset(o.config.IdleTimeout)
+		}
+	}
+}
+
+// rewrite sets the top Via of the request to the socket of the session, and the To tag of the requests inside
+// the dialog to the one of the server
+func (s *sipSession) rewrite(data []byte) []byte {
+	s.lock.Lock()
+	tag := s.tag
+	s.lock.Unlock()
+	transport := strings.ToUpper(s.output.config.Transport)
+	sentBy := s.conn.LocalAddr().String()
+	top := true
+	return proto.RewriteSIPHeaders(data, func(name, value string) string {
+		switch {
+		case name == "via" && top:
+			top = false
+			// the first of the Vias of a list
+			rest := ""
+			if i := strings.IndexByte(value, ','); i >= 0 {
+				value, rest = value[:i], value[i:]
+			}
+			params := ""
+			if i := strings.IndexByte(value, ';'); i >= 0 {
+				params = value[i:]
+			}
+			return proto.SIPVersion + "/" + transport + " " + sentBy + params + rest
+		case name == "to" && tag != "" && proto.SIPTag(value) != "":
+			return proto.SIPWithTag(value, tag)
+		}
+		return value
+	})
+}
+
+// receive reads the responses of the server, it learns the To tag of the dialog from the responses to the INVITE
+// and ends the call with the final response to its BYE
+func (s *sipSession) receive() {
+	defer s.close()
+	r := bufio.NewReader(s.conn)
+	buf := make([]byte, 64<<10)
+	for {
+		var data []byte
+		var err error
+		if s.output.config.Transport == "tcp" {
+			data, err = readSIPMessage(r)
+		} else {
+			var n int
+			n, err = s.conn.Read(buf)
+			data = buf[:n]
+		}
+		if err != nil {
+			return
+		}
+		m, ok := proto.ParseSIP(data)
+		if !ok {
+			continue
+		}
+		if m.IsRequest() {
+			Debug(1, fmt.Sprintf("[SIP-OUTPUT] call %s: %s request of the server ignored", s.id, m.Method))
+			continue
+		}
+		_, method := m.CSeq()
+		switch {
+		case method == "INVITE" && m.Status > 100 && m.Status < 300:
+			if tag := proto.SIPTag(m.Get("to")); tag != "" {
+				s.lock.Lock()
+				s.tag = tag
+				s.lock.Unlock()
+			}
+		case method == "BYE" && m.Status >= 200:
+			return
+		}
+		if m.Status >= 300 {
+			Debug(1, fmt.Sprintf("[SIP-OUTPUT] call %s: %s answered with %d %s", s.id, method, m.Status, m.Reason))
+		}
+	}
+}
+
+// readSIPMessage reads a SIP message of a stream, the keep-alives are skipped
+func readSIPMessage(r *bufio.Reader) ([]byte, error) {
+	var header []byte
+	for {
+		line, err := r.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			return nil, errors.New("sip header too large")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(header) == 0 && (string(line) == "\r\n" || string(line) == "\n") {
+			continue
+		}
+		header = append(header, line...)
+		if string(line) == "\r\n" || string(line) == "\n" {
+			break
+		}
+		if len(header) > 64<<10 {
+			return nil, errors.New("sip header too large")
+		}
+	}
+	length := 0
+	for _, line := range strings.Split(string(header), "\n")[1:] {
+		i := strings.IndexByte(line, ':')
+		if i <= 0 {
+			continue
+		}
+		if name := strings.ToLower(strings.TrimSpace(line[:i])); name == "content-length" || name == "l" {
+			length, _ = strconv.Atoi(strings.TrimSpace(line[i+1:]))
+		}
+	}
+	if length < 0 || length > 1<<20 {
+		return nil, errors.New("invalid sip content-length")
+	}
+	data := make([]byte, len(header)+length)
+	copy(data, header)
+	_, err := io.ReadFull(r, data[len(header):])
+	return data, err
+}
+
+func (s *sipSession) close() {
+	s.stop.Do(func() {
+		close(s.done)
+		s.lock.Lock()
+		if s.conn != nil {
+			s.conn.Close()
+		}
+		s.lock.Unlock()
+	})
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+)
+
+func TestSIPOutput(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	received := make(chan *proto.SIPMessage, 10)
+	go func() {
+		buf := make([]byte, 64<<10)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			m, ok := proto.ParseSIP(buf[:n])
+			if !ok {
+				continue
+			}
+			received <- m
+			if m.Method == "ACK" {
+				continue
+			}
+			// the responses go to the top Via
+			via := strings.Fields(strings.SplitN(m.Get("via"), ";", 2)[0])
+			to, _ := net.ResolveUDPAddr("udp", via[1])
+			if to.String() != addr.String() {
+				t.Errorf("expected the top Via to be %s, got %s", addr, via[1])
+			}
+			response := fmt.Sprintf("SIP/2.0 200 OK\r\nVia: %s\r\nTo: %s\r\nCall-ID: %s\r\nCSeq: %s\r\nContent-Length: 0\r\n\r\n",
+				m.Get("via"), proto.SIPWithTag(m.Get("to"), "server-tag"), m.CallID(), m.Get("cseq"))
+			conn.WriteTo([]byte(response), addr)
+		}
+	}()
+
+	output := NewSIPOutput(conn.LocalAddr().String(), &SIPOutputConfig{Timeout: time.Second})
+	defer output.(*SIPOutput).Close()
+	start := time.Now().UnixNano()
+	request := func(method, cseq, toTag string, delay time.Duration) {
+		to := "<sip:bob@example.com>"
+		if toTag != "" {
+			to += ";tag=" + toTag
+		}
+		data := fmt.Sprintf("%s sip:bob@example.com SIP/2.0\r\nVia: SIP/2.0/UDP 10.0.0.1:5060;branch=z9hG4bK%s\r\nFrom: <sip:alice@example.com>;tag=a1\r\nTo: %s\r\nCall-ID: call-1\r\nCSeq: %s\r\nContent-Length: 0\r\n\r\n",
+			method, method, to, cseq)
+		output.Write(append(payloadHeader(RequestPayload, []byte("call-1"), start+int64(delay), 0), data...))
+		// the responses are not sent
+		output.Write(append(payloadHeader(ResponsePayload, []byte("call-1"), start, 0), "SIP/2.0 200 OK\r\n\r\n"...))
+	}
+	request("INVITE", "1 INVITE", "", 0)
+	expect := func(method, toTag string) {
+		select {
+		case m := <-received:
+			if m.Method != method || proto.SIPTag(m.Get("to")) != toTag || !strings.HasPrefix(m.Get("via"), "SIP/2.0/UDP 127.0.0.1:") {
+				t.Errorf("expected %s with the To tag %q, got %s with %v", method, toTag, m.Method, m.Header)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("expected %s", method)
+		}
+	}
+	expect("INVITE", "")
+	// the requests inside the dialog get the tag of the server, they are sent after its answer as they were recorded
+	request("ACK", "1 ACK", "recorded-tag", 100*time.Millisecond)
+	request("BYE", "2 BYE", "recorded-tag", 200*time.Millisecond)
+	expect("ACK", "server-tag")
+	expect("BYE", "server-tag")
+}
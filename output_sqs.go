@@ -0,0 +1,366 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+)
+
+// the limits of the SendMessageBatch requests
+const (
+	sqsMaxBatch       = 10
+	sqsMaxMessageSize = 256 << 10
+)
+
+// SQSOutputConfig is the configuration of the SQS output
+type SQSOutputConfig struct {
+	Region     string        `json:"output-sqs-region"`
+	BatchDelay time.Duration `json:"output-sqs-batch-delay"`
+	MaxRetries int           `json:"output-sqs-max-retries"`
+	Timeout    time.Duration `json:"output-sqs-timeout"`
+}
+
+// SQSOutput sends the requests and the responses, in the format of the payloads, to an SQS queue, in batches of
+// SendMessageBatch. the messages carry the meta of the payload as the attributes gor-type, gor-id, gor-timestamp
+// and gor-latency. the payloads that are not valid SQS text are encoded in base64, with the attribute
+// gor-encoding. on FIFO queues, the messages are grouped by the UUID of the payload, so that a request and its
+// response are received in order, and deduplicated by their UUID and type.
+type SQSOutput struct {
+	// Keep this as first element of struct because it guarantees 64bit
+	// alignment. atomic.* functions crash on 32bit machines if operand is not
+	// aligned at 64bit. See https://github.com/golang/go/issues/599
+	sent    int64
+	retries int64
+	failed  int64
+	dropped int64 // too large
+
+	queue    string
+	fifo     bool
+	config   *SQSOutputConfig
+	signer   *v4.Signer
+	client   *http.Client
+	messages chan []byte
+	queuing  sync.RWMutex // done is closed once the payloads being written are queued
+	done     chan struct{}
+	finished chan struct{}
+	stop     sync.Once
+}
+
+// sqsMessage is an entry of the SendMessageBatch requests
+type sqsMessage struct {
+	body       string
+	attributes [][2]string
+	group      string
+	dedup      string
+}
+
+// NewSQSOutput constructor for SQSOutput, address is the URL of the queue
+func NewSQSOutput(address string, config *SQSOutputConfig) io.Writer {
+	o := new(SQSOutput)
+	o.queue = address
+	o.config = config
+	u, err := url.Parse(address)
+	if err != nil || u.Host == "" {
+		log.Fatalf("output-sqs: invalid queue URL %q", address)
+	}
+	o.fifo = strings.HasSuffix(u.Path, ".fifo")
+	if o.config.Region == "" {
+		o.config.Region = sqsRegion(u.Hostname())
+	}
+	if o.config.Region == "" {
+		if o.config.Region = os.Getenv("AWS_REGION"); o.config.Region == "" {
+			o.config.Region = os.Getenv("AWS_DEFAULT_REGION")
+		}
+	}
+	if o.config.Region == "" {
+		log.Fatal("output-sqs: the region of the queue is required, set --output-sqs-region or AWS_REGION")
+	}
+	if o.config.BatchDelay <= 0 {
+		o.config.BatchDelay = 100 * time.Millisecond
+	}
+	if o.config.MaxRetries < 0 {
+		o.config.MaxRetries = 0
+	}
+	if o.config.Timeout < time.Millisecond {
+		o.config.Timeout = 10 * time.Second
+	}
+	o.signer = awsSigner("output-sqs", o.config.Region)
+	o.client = &http.Client{Timeout: o.config.Timeout}
+	o.messages = make(chan []byte, 1000)
+	o.done = make(chan struct{})
+	o.finished = make(chan struct{})
+	go o.run()
+	return o
+}
+
+// sqsRegion returns the region of the host of a queue URL, sqs.<region>.amazonaws.com or the legacy
+// <region>.queue.amazonaws.com, or "" for the other hosts
+func sqsRegion(host string) string {
+	parts := strings.Split(host, ".")
+	switch {
+	case len(parts) >= 4 && parts[0] == "sqs":
+		return parts[1]
+	case len(parts) >= 4 && parts[1] == "queue":
+		return parts[0]
+	}
+	return ""
+}
+
+// Write queues the payload to be sent, the payloads written after Close are refused
+func (o *SQSOutput) Write(data []byte) (n int, err error) {
+	if !isOriginPayload(data) {
+		return len(data), nil
+	}
+	o.queuing.RLock()
+	defer o.queuing.RUnlock()
+	select {
+	case <-o.done:
+		return 0, ErrorStopped
+	default:
+	}
+	// run receives the messages until done, and sends the ones queued then
+	o.messages <- append([]byte(nil), data...)
+	return len(data), nil
+}
+
+// run collects the messages for BatchDelay, or until a batch is full, and sends them
+func (o *SQSOutput) run() {
+	defer close(o.finished)
+	for {
+		var batch []sqsMessage
+		var size int
+		add := func(data []byte) {
+			m := o.message(data)
+			if m.size() > sqsMaxMessageSize {
+				atomic.AddInt64(&o.dropped, 1)
+				Debug(1, fmt.Sprintf("[SQS-OUTPUT] %s: payload of %d bytes over the size limit dropped", o.queue, len(data)))
+				return
+			}
+			if size+m.size() > sqsMaxMessageSize {
+				o.send(batch)
+				batch, size = nil, 0
+			}
+			batch, size = append(batch, m), size+m.size()
+		}
+		select {
+		case data := <-o.messages:
+			add(data)
+		case <-o.done:
+			// the messages queued are sent before closing
+			for len(o.messages) > 0 {
+				add(<-o.messages)
+				if len(batch) == sqsMaxBatch {
+					o.send(batch)
+					batch, size = nil, 0
+				}
+			}
+			o.send(batch)
+			return
+		}
+		timer := time.NewTimer(o.config.BatchDelay)
+	collect:
+		for len(batch) < sqsMaxBatch {
+			select {
+			case data := <-o.messages:
+				add(data)
+			case <-timer.C:
+				break collect
+			case <-o.done:
+				// the messages queued are added to the batch before closing
+				for len(batch) < sqsMaxBatch && len(o.messages) > 0 {
+					add(<-o.messages)
+				}
+				break collect
+			}
+		}
+		timer.Stop()
+		o.send(batch)
+	}
+}
+
+// message returns the message of the payload
+func (o *SQSOutput) message(data []byte) (m sqsMessage) {
+	meta := payloadMeta(data)
+	for i, name := range []string{"gor-type", "gor-id", "gor-timestamp", "gor-latency"} {
+		if i < len(meta) {
+			m.attributes = append(m.attributes, [2]string{name, string(meta[i])})
+		}
+	}
+	if isSQSText(data) {
+		m.body = string(data)
+	} else {
+		m.body = base64.StdEncoding.EncodeToString(data)
+		m.attributes = append(m.attributes, [2]string{"gor-encoding", "base64"})
+	}
+	if o.fifo && len(meta) > 1 {
+		m.group = string(meta[1])
+		m.dedup = string(meta[1]) + "-" + string(meta[0])
+	}
+	return
+}
+
+// size returns the size of the message counted by SQS: the body, and the names, the types and the values of the
+// attributes
+func (m *sqsMessage) size() int {
+	n := len(m.body)
+	for _, a := range m.attributes {
+		n += len(a[0]) + len("String") + len(a[1])
+	}
+	return n
+}
+
+// isSQSText reports whether the data only has the characters allowed in the messages: #x9, #xA, #xD, #x20 to
+// #xD7FF, #xE000 to #xFFFD and #x10000 to #x10FFFF
+func isSQSText(data []byte) bool {
+	if !utf8.Valid(data) {
+		return false
+	}
+	for _, r := range string(data) {
+		switch {
+		case r == '\t', r == '\n', r == '\r':
+		case r < 0x20, r > 0xD7FF && r < 0xE000, r == 0xFFFE, r == 0xFFFF:
+			return false
+		}
+	}
+	return true
+}
+
+// send sends the batch, the messages failing with an error of SQS are retried with a backoff of 100ms doubled on
+// each retry
+func (o *SQSOutput) send(batch []sqsMessage) {
+	for retry := 0; len(batch) > 0; retry++ {
+		if retry > 0 {
+			if retry > o.config.MaxRetries {
+				break
+			}
+			atomic.AddInt64(&o.retries, int64(len(batch)))
+			backoff := time.Duration(100<<uint(retry-1)) * time.Millisecond
+			if backoff > 5*time.Second {
+				backoff = 5 * time.Second
+			}
+			time.Sleep(backoff)
+		}
+		failed, err := o.sendBatch(batch)
+		if err != nil {
+			Debug(1, fmt.Sprintf("[SQS-OUTPUT] %s: %v", o.queue, err))
+			if e, ok := err.(*sqsError); ok && e.status < 500 && e.code != "ThrottlingException" && e.code != "RequestThrottled" {
+				break
+			}
+			continue
+		}
+		batch = failed
+	}
+	atomic.AddInt64(&o.failed, int64(len(batch)))
+}
+
+// sqsError is an error of the SQS API
+type sqsError struct {
+	status int
+	code   string
+	msg    string
+}
+
+func (e *sqsError) Error() string {
+	return fmt.Sprintf("status %d: %s %s", e.status, e.code, e.msg)
+}
+
+// sendBatch sends the messages with SendMessageBatch, it returns the messages that failed on the side of SQS to be
+// retried, the ones failing for the sender, like a FIFO message without group, are dropped
+func (o *SQSOutput) sendBatch(batch []sqsMessage) (failed []sqsMessage, err error) {
+	form := url.Values{"Action": {"SendMessageBatch"}, "Version": {"2012-11-05"}}
+	for i, m := range batch {
+		entry := "SendMessageBatchRequestEntry." + strconv.Itoa(i+1) + "."
+		form.Set(entry+"Id", strconv.Itoa(i))
+		form.Set(entry+"MessageBody", m.body)
+		if m.group != "" {
+			form.Set(entry+"MessageGroupId", m.group)
+			form.Set(entry+"MessageDeduplicationId", m.dedup)
+		}
+		for j, a := range m.attributes {
+			attribute := entry + "MessageAttribute." + strconv.Itoa(j+1) + "."
+			form.Set(attribute+"Name", a[0])
+			form.Set(attribute+"Value.DataType", "String")
+			form.Set(attribute+"Value.StringValue", a[1])
+		}
+	}
+	body := strings.NewReader(form.Encode())
+	req, err := http.NewRequest(http.MethodPost, o.queue, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if _, err = o.signer.Sign(req, body, "sqs", o.config.Region, time.Now()); err != nil {
+		return nil, err
+	}
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Code    string `xml:"Error>Code"`
+			Message string `xml:"Error>Message"`
+		}
+		xml.Unmarshal(respBody, &e)
+		return nil, &sqsError{status: resp.StatusCode, code: e.Code, msg: e.Message}
+	}
+	var result struct {
+		Errors []struct {
+			ID          int    `xml:"Id"`
+			SenderFault bool   `xml:"SenderFault"`
+			Code        string `xml:"Code"`
+			Message     string `xml:"Message"`
+		} `xml:"SendMessageBatchResult>BatchResultErrorEntry"`
+	}
+	if err = xml.Unmarshal(respBody, &result); err != nil {
+		return nil, err
+	}
+	for _, e := range result.Errors {
+		if e.ID < 0 || e.ID >= len(batch) {
+			continue
+		}
+		if e.SenderFault {
+			atomic.AddInt64(&o.failed, 1)
+			Debug(1, fmt.Sprintf("[SQS-OUTPUT] %s: %s %s", o.queue, e.Code, e.Message))
+			continue
+		}
+		failed = append(failed, batch[e.ID])
+	}
+	atomic.AddInt64(&o.sent, int64(len(batch)-len(result.Errors)))
+	return failed, nil
+}
+
+func (o *SQSOutput) String() string {
+	return fmt.Sprintf("SQS output: %s, sent: %d, retries: %d, failed: %d, dropped: %d", o.queue,
+		atomic.LoadInt64(&o.sent), atomic.LoadInt64(&o.retries), atomic.LoadInt64(&o.failed), atomic.LoadInt64(&o.dropped))
+}
+
+// Close sends the messages queued, waiting for Timeout at most
+func (o *SQSOutput) Close() error {
+	o.stop.Do(func() {
+		o.queuing.Lock()
+		close(o.done)
+		o.queuing.Unlock()
+	})
+	select {
+	case <-o.finished:
+	case <-time.After(o.config.Timeout):
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSQSOutput(t *testing.T) {
+	os.Setenv("AWS_ACCESS_KEY_ID", "id")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	defer os.Unsetenv("AWS_ACCESS_KEY_ID")
+	defer os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+
+	var mu sync.Mutex
+	var calls int
+	var bodies, groups []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.Header.Get("Authorization"), "/eu-west-1/sqs/aws4_request") || r.FormValue("Action") != "SendMessageBatch" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		if calls == 1 {
+			// the second message of the first batch fails on the side of SQS
+			w.Write([]byte(`<SendMessageBatchResponse><SendMessageBatchResult>
+				<SendMessageBatchResultEntry><Id>0</Id></SendMessageBatchResultEntry>
+				<BatchResultErrorEntry><Id>1</Id><SenderFault>false</SenderFault><Code>InternalError</Code></BatchResultErrorEntry>
+				</SendMessageBatchResult></SendMessageBatchResponse>`))
+			bodies = append(bodies, r.FormValue("SendMessageBatchRequestEntry.1.MessageBody"))
+			groups = append(groups, r.FormValue("SendMessageBatchRequestEntry.1.MessageGroupId"))
+			return
+		}
+		for i := 1; r.FormValue("SendMessageBatchRequestEntry."+strconv.Itoa(i)+".Id") != ""; i++ {
+			entry := "SendMessageBatchRequestEntry." + strconv.Itoa(i) + "."
+			body := r.FormValue(entry + "MessageBody")
+			if r.FormValue(entry+"MessageAttribute.5.Name") == "gor-encoding" {
+				decoded, _ := base64.StdEncoding.DecodeString(body)
+				body = string(decoded)
+			}
+			bodies = append(bodies, body)
+			groups = append(groups, r.FormValue(entry+"MessageGroupId"))
+		}
+		w.Write([]byte(`<SendMessageBatchResponse><SendMessageBatchResult></SendMessageBatchResult></SendMessageBatchResponse>`))
+	}))
+	defer server.Close()
+
+	o := NewSQSOutput(server.URL+"/123456789012/traffic.fifo", &SQSOutputConfig{
+		Region:     "eu-west-1",
+		BatchDelay: 50 * time.Millisecond,
+		MaxRetries: 3,
+	}).(*SQSOutput)
+	o.Write([]byte("1 a 1 0\nGET / HTTP/1.1\r\n\r\n"))
+	o.Write([]byte("2 a 1 1\nHTTP/1.1 200 OK\r\n\r\n\x00\x01"))
+	o.Close()
+	if n, err := o.Write([]byte("1 b 1 0\nGET / HTTP/1.1\r\n\r\n")); n != 0 || err != ErrorStopped {
+		t.Errorf("expected the payload written after Close to be refused, got %d %v", n, err)
+	}
+
+	if len(bodies) != 2 || bodies[0] != "1 a 1 0\nGET / HTTP/1.1\r\n\r\n" || bodies[1] != "2 a 1 1\nHTTP/1.1 200 OK\r\n\r\n\x00\x01" {
+		t.Errorf("unexpected messages: %q", bodies)
+	}
+	if len(groups) != 2 || groups[0] != "a" || groups[1] != "a" {
+		t.Errorf("expected the messages to be grouped by UUID, got %q", groups)
+	}
+	if o.sent != 2 || o.retries != 1 || o.failed != 0 {
+		t.Errorf("expected the failed message to be retried, got %s", o)
+	}
+}
+
+func TestSQSRegion(t *testing.T) {
+	for host, region := range map[string]string{
+		"sqs.us-east-1.amazonaws.com":     "us-east-1",
+		"eu-west-1.queue.amazonaws.com":   "eu-west-1",
+		"sqs.cn-north-1.amazonaws.com.cn": "cn-north-1",
+		"localhost":                       "",
+		"elasticmq.internal.example.com":  "",
+	} {
+		if r := sqsRegion(host); r != region {
+			t.Errorf("%s: expected %q, got %q", host, region, r)
+		}
+	}
+}
+
+func TestIsSQSText(t *testing.T) {
+	if !isSQSText([]byte("GET / HTTP/1.1\r\n\té\r\n")) || isSQSText([]byte("\x00")) || isSQSText([]byte{0xff}) {
+		t.Error("unexpected text check")
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/buger/goreplay/proto"
+)
+
+// NewStdOutput returns the output of --output-stdout, the DummyOutput printing the raw payloads or the
+// JSONStdOutput
+func NewStdOutput(format string) io.Writer {
+	switch format {
+	case "", "raw":
+		return NewDummyOutput()
+	case "json":
+		return new(JSONStdOutput)
+	}
+	log.Fatalf("output-stdout: unsupported format %q, it is raw or json", format)
+	return nil
+}
+
+// JSONStdOutput prints each payload as a JSON object on its own line, for jq pipelines
+type JSONStdOutput struct {
+	mu sync.Mutex
+}
+
+// stdoutMessage is a payload printed by JSONStdOutput. the HTTP messages are parsed, the body is a string if
+// it is valid UTF-8, or else it is encoded with base64 like the other payloads
+type stdoutMessage struct {
+	Type       string              `json:"type"` // request, response or replayed_response
+	ID         string              `json:"id"`
+	Timestamp  int64               `json:"timestamp"`         // in nanoseconds
+	Latency    int64               `json:"latency,omitempty"` // in nanoseconds, of the responses
+	Method     string              `json:"method,omitempty"`
+	URL        string              `json:"url,omitempty"`
+	Proto      string              `json:"proto,omitempty"`
+	Status     int                 `json:"status,omitempty"`
+	Headers    map[string][]string `json:"headers,omitempty"`
+	Body       *string             `json:"body,omitempty"`
+	BodyBase64 string              `json:"body_base64,omitempty"`
+	Payload    string              `json:"payload,omitempty"` // the payloads other than HTTP, in base64
+}
+
+var stdoutPayloadTypes = map[byte]string{
+	RequestPayload:          "request",
+	ResponsePayload:         "response",
+	ReplayedResponsePayload: "replayed_response",
+}
+
+func (o *JSONStdOutput) Write(data []byte) (int, error) {
+	line, err := json.Marshal(stdoutJSON(data))
+	if err != nil {
+		return 0, err
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if _, err := os.Stdout.Write(append(line, '\n')); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+func (o *JSONStdOutput) String() string {
+	return "JSON stdout output"
+}
+
+// stdoutJSON returns the stdoutMessage of the payload
+func stdoutJSON(data []byte) *stdoutMessage {
+	m := new(stdoutMessage)
+	meta := payloadMeta(data)
+	if len(meta) > 0 && len(meta[0]) == 1 {
+		m.Type = stdoutPayloadTypes[meta[0][0]]
+	}
+	if m.Type == "" {
+		m.Type = "unknown"
+	}
+	if len(meta) > 1 {
+		m.ID = string(meta[1])
+	}
+	if len(meta) > 2 {
+		m.Timestamp, _ = strconv.ParseInt(string(meta[2]), 10, 64)
+	}
+	if len(meta) > 3 {
+		m.Latency, _ = strconv.ParseInt(string(meta[3]), 10, 64)
+	}
+	body := payloadBody(data)
+
+	switch {
+	case proto.HasRequestTitle(body):
+		m.Method = string(proto.Method(body))
+		m.URL = string(proto.Path(body))
+		if end := bytes.IndexByte(body, '\n'); end > 0 {
+			title := bytes.TrimRight(body[:end], "\r")
+			m.Proto = string(title[bytes.LastIndexByte(title, ' ')+1:])
+		}
+	case proto.HasResponseTitle(body):
+		m.Proto = string(body[:8])
+		m.Status, _ = strconv.Atoi(string(proto.Status(body)))
+	default:
+		m.Payload = base64.StdEncoding.EncodeToString(body)
+		return m
+	}
+
+	m.Headers = make(map[string][]string)
+	proto.ParseHeaders([][]byte{body}, func(header []byte, value []byte) {
+		m.Headers[string(header)] = append(m.Headers[string(header)], string(value))
+	})
+	if b := proto.Body(body); len(b) > 0 {
+		if utf8.Valid(b) {
+			s := string(b)
+			m.Body = &s
+		} else {
+			m.BodyBase64 = base64.StdEncoding.EncodeToString(b)
+		}
+	}
+	return m
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestStdoutJSON(t *testing.T) {
+	req := stdoutJSON([]byte("1 a1b2 1600000000000000000 0\nPOST /users?id=1 HTTP/1.1\r\nHost: api\r\nX-Tag: a\r\nX-Tag: b\r\nContent-Length: 7\r\n\r\n{\"a\":1}"))
+	if req.Type != "request" || req.ID != "a1b2" || req.Timestamp != 1600000000000000000 || req.Method != "POST" ||
+		req.URL != "/users?id=1" || req.Proto != "HTTP/1.1" || req.Body == nil || *req.Body != `{"a":1}` {
+		t.Errorf("unexpected request %+v", req)
+	}
+	if !reflect.DeepEqual(req.Headers["X-Tag"], []string{"a", "b"}) || req.Headers["Host"][0] != "api" {
+		t.Errorf("unexpected headers %v", req.Headers)
+	}
+
+	resp := stdoutJSON([]byte("2 a1b2 1600000000000000000 1500000\nHTTP/1.1 201 Created\r\nContent-Length: 2\r\n\r\n\xff\xfe"))
+	if resp.Type != "response" || resp.Latency != 1500000 || resp.Status != 201 || resp.Proto != "HTTP/1.1" ||
+		resp.Body != nil || resp.BodyBase64 != "//4=" {
+		t.Errorf("unexpected response %+v", resp)
+	}
+
+	line, _ := json.Marshal(stdoutJSON([]byte("1 c3d4 1 0\n\x00\x01binary")))
+	if string(line) != `{"type":"request","id":"c3d4","timestamp":1,"payload":"AAFiaW5hcnk="}` {
+		t.Errorf("unexpected JSON %s", line)
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// syslogFacilities are the facilities of RFC 5424 the events can be sent with
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+	"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19, "local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// syslogParams are the parameters of the structured data of the events, filled like the columns of
+// --output-clickhouse, see clickHouseValue
+var syslogParams = []string{"id", "method", "host", "url", "request_size", "status", "response_size", "latency_ms"}
+
+const (
+	syslogSeverityInfo    = 6
+	syslogSeverityWarning = 4
+)
+
+// SyslogOutputConfig is the configuration of the syslog output
+type SyslogOutputConfig struct {
+	Transport       string        `json:"output-syslog-transport"`
+	Facility        string        `json:"output-syslog-facility"`
+	AppName         string        `json:"output-syslog-app-name"`
+	TLSCA           string        `json:"output-syslog-tls-ca"`
+	TLSSkipVerify   bool          `json:"output-syslog-tls-skip-verify"`
+	ResponseTimeout time.Duration `json:"output-syslog-response-timeout"`
+	Timeout         time.Duration `json:"output-syslog-timeout"`
+}
+
+// SyslogOutput sends an RFC 5424 event per HTTP request to a syslog collector, over udp, tcp or tls. the
+// request and its response are in the structured data of the event, with the SD-ID request@32473, and its
+// message is a summary like "GET /users 200 12.5ms". the events wait for the response of their request for
+// ResponseTimeout, the requests without responses are sent without them with the warning severity, like the
+// responses with a 5xx status. over tcp and tls the events are framed with their length, see RFC 6587.
+type SyslogOutput struct {
+	// Keep this as first element of struct because it guarantees 64bit
+	// alignment. atomic.* functions crash on 32bit machines if operand is not
+	// aligned at 64bit. See https://github.com/golang/go/issues/599
+	sent   int64
+	failed int64
+
+	address   string
+	config    *SyslogOutputConfig
+	facility  int
+	tlsConfig *tls.Config
+	messages  chan []byte
+	queuing   sync.RWMutex // done is closed once the payloads being written are queued
+	done      chan struct{}
+	finished  chan struct{}
+	stop      sync.Once
+
+	pending map[string]*syslogEvent // by UUID, waiting for their responses
+	conn    net.Conn
+}
+
+type syslogEvent struct {
+	timestamp int64
+	values    map[string]string
+	created   time.Time
+}
+
+// NewSyslogOutput constructor for SyslogOutput, address is the host:port of the collector
+func NewSyslogOutput(address string, config *SyslogOutputConfig) io.Writer {
+	o := new(SyslogOutput)
+	o.address = address
+	o.config = config
+	switch o.config.Transport {
+	case "":
+		o.config.Transport = "udp"
+	case "udp", "tcp":
+	case "tls":
+		tlsConfig, err := newClientTLSConfig("", "", o.config.TLSCA, "", o.config.TLSSkipVerify)
+		if err != nil {
+			log.Fatalf("output-syslog: %v", err)
+		}
+		if tlsConfig == nil {
+			tlsConfig = new(tls.Config)
+		}
+		o.tlsConfig = tlsConfig
+	default:
+		log.Fatalf("output-syslog: unsupported transport %q, it is udp, tcp or tls", o.config.Transport)
+	}
+	if o.config.Facility == "" {
+		o.config.Facility = "local0"
+	}
+	facility, ok := syslogFacilities[o.config.Facility]
+	if !ok {
+		log.Fatalf("output-syslog: unknown facility %q", o.config.Facility)
+	}
+	o.facility = facility
+	if o.config.AppName == "" {
+		o.config.AppName = "goreplay"
+	}
+	if o.config.ResponseTimeout <= 0 {
+		o.config.ResponseTimeout = 5 * time.Second
+	}
+	if o.config.Timeout < time.Millisecond {
+		o.config.Timeout = 5 * time.Second
+	}
+	o.pending = make(map[string]*syslogEvent)
+	o.messages = make(chan []byte, 10000)
+	o.done = make(chan struct{})
+	o.finished = make(chan struct{})
+	go o.run()
+	return o
+}
+
+// Write queues the payload to be sent, the payloads written after Close are refused
+func (o *SyslogOutput) Write(data []byte) (n int, err error) {
+	if !isOriginPayload(data) {
+		return len(data), nil
+	}
+	o.queuing.RLock()
+	defer o.queuing.RUnlock()
+	select {
+	case <-o.done:
+		return 0, ErrorStopped
+	default:
+	}
+	// run receives the messages until done, and sends the ones queued then
+	o.messages <- append([]byte(nil), data...)
+	return len(data), nil
+}
+
+// run completes the events with the responses and sends them
+func (o *SyslogOutput) run() {
+	defer close(o.finished)
+	ticker := time.NewTicker(o.config.ResponseTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case data := <-o.messages:
+			o.add(data)
+		case <-ticker.C:
+			o.expire(time.Now().Add(-o.config.ResponseTimeout))
+		case <-o.done:
+			for len(o.messages) > 0 {
+				o.add(<-o.messages)
+			}
+			o.expire(time.Now())
+			if o.conn != nil {
+				o.conn.Close()
+			}
+			return
+		}
+	}
+}
+
+// add fills the event of the payload, the event of a request is sent with its response
+func (o *SyslogOutput) add(data []byte) {
+	id, _ := clickHouseValue("id", data)
+	event, ok := o.pending[id]
+	if !ok {
+		if !isRequestPayload(data) {
+			// the request was not captured
+			return
+		}
+		ts, _ := clickHouseValue("timestamp", data)
+		event = &syslogEvent{values: make(map[string]string), created: time.Now()}
+		event.timestamp, _ = strconv.ParseInt(ts, 10, 64)
+		o.pending[id] = event
+	}
+	for _, param := range syslogParams {
+		if value, ok := clickHouseValue(param, data); ok {
+			event.values[param] = value
+		}
+	}
+	if !isRequestPayload(data) {
+		delete(o.pending, id)
+		o.send(event)
+	}
+}
+
+// expire sends the events of the requests created before t, without their responses
+func (o *SyslogOutput) expire(t time.Time) {
+	for id, event := range o.pending {
+		if event.created.Before(t) {
+			delete(o.pending, id)
+			o.send(event)
+		}
+	}
+}
+
+// send sends the event, on a new connection if the one of the previous events failed
+func (o *SyslogOutput) send(event *syslogEvent) {
+	msg := o.format(event)
+	if o.config.Transport != "udp" {
+		msg = append([]byte(strconv.Itoa(len(msg))+" "), msg...)
+	}
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if o.conn == nil {
+			if o.conn, err = o.connect(); err != nil {
+				break
+			}
+		}
+		o.conn.SetWriteDeadline(time.Now().Add(o.config.Timeout))
+		if _, err = o.conn.Write(msg); err == nil {
+			atomic.AddInt64(&o.sent, 1)
+			return
+		}
+		o.conn.Close()
+		o.conn = nil
+	}
+	atomic.AddInt64(&o.failed, 1)
+	Debug(1, fmt.Sprintf("[SYSLOG-OUTPUT] %s: %v", o.address, err))
+}
+
+func (o *SyslogOutput) connect() (net.Conn, error) {
+	if o.tlsConfig != nil {
+		return tls.DialWithDialer(&net.Dialer{Timeout: o.config.Timeout}, "tcp", o.address, o.tlsConfig)
+	}
+	return net.DialTimeout(o.config.Transport, o.address, o.config.Timeout)
+}
+
+// format returns the RFC 5424 message of the event:
+//
+//	<PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID [request@32473 id="..." ...] GET /users 200 12.5ms
+func (o *SyslogOutput) format(event *syslogEvent) []byte {
+	severity := syslogSeverityInfo
+	status := event.values["status"]
+	if status == "" || status[0] == '5' {
+		severity = syslogSeverityWarning
+	}
+	host := hostname
+	if host == "" {
+		host = "-"
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "<%d>1 %s %s %s - request [request@32473", o.facility*8+severity,
+		time.Unix(0, event.timestamp).UTC().Format("2006-01-02T15:04:05.000000Z07:00"), host, o.config.AppName)
+	for _, param := range syslogParams {
+		if value := event.values[param]; value != "" {
+			fmt.Fprintf(&b, " %s=\"%s\"", param, syslogEscape(value))
+		}
+	}
+	b.WriteString("] ")
+	b.WriteString(event.values["method"])
+	b.WriteByte(' ')
+	b.WriteString(event.values["url"])
+	if status != "" {
+		fmt.Fprintf(&b, " %s %sms", status, event.values["latency_ms"])
+	} else {
+		b.WriteString(" no response")
+	}
+	return []byte(b.String())
+}
+
+// syslogEscape escapes the characters of the values of the structured data, see section 6.3.3 of RFC 5424
+func syslogEscape(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(value)
+}
+
+func (o *SyslogOutput) String() string {
+	return fmt.Sprintf("Syslog output: %s://%s, sent: %d, failed: %d", o.config.Transport, o.address,
+		atomic.LoadInt64(&o.sent), atomic.LoadInt64(&o.failed))
+}
+
+// Close sends the events pending, waiting for Timeout at most
+func (o *SyslogOutput) Close() error {
+	o.stop.Do(func() {
+		o.queuing.Lock()
+		close(o.done)
+		o.queuing.Unlock()
+	})
+	select {
+	case <-o.finished:
+	case <-time.After(o.config.Timeout):
+	}
+	return nil
+}
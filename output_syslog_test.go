@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSyslogOutputUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	output := NewSyslogOutput(conn.LocalAddr().String(), &SyslogOutputConfig{Facility: "local1"})
+	output.Write([]byte("1 a1 1600000000123000000 0\nGET /users?q=\"x\" HTTP/1.1\r\nHost: api\r\n\r\n"))
+	output.Write([]byte("2 a1 1600000000123000000 12500000\nHTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"))
+	output.Write([]byte("1 a2 1600000001000000000 0\nPOST /slow HTTP/1.1\r\nHost: api\r\n\r\n"))
+	output.(*SyslogOutput).Close()
+	if n, err := output.Write([]byte("1 a3 1600000002000000000 0\nGET / HTTP/1.1\r\n\r\n")); n != 0 || err != ErrorStopped {
+		t.Errorf("expected the payload written after Close to be refused, got %d %v", n, err)
+	}
+
+	buf := make([]byte, 2048)
+	var events []string
+	for i := 0; i < 2; i++ {
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, string(buf[:n]))
+	}
+
+	// local1.info
+	prefix := "<142>1 2020-09-13T12:26:40.123000Z " + hostname + " goreplay - request [request@32473 id=\"a1\" method=\"GET\" host=\"api\" "
+	if !strings.HasPrefix(events[0], prefix) {
+		t.Errorf("expected %q to start with %q", events[0], prefix)
+	}
+	if !strings.Contains(events[0], `url="/users?q=\"x\""`) || !strings.Contains(events[0], `status="200"`) ||
+		!strings.HasSuffix(events[0], `latency_ms="12.5"] GET /users?q="x" 200 12.5ms`) {
+		t.Errorf("unexpected event %q", events[0])
+	}
+	// local1.warning, without response
+	if !strings.HasPrefix(events[1], "<140>1 ") || !strings.HasSuffix(events[1], "] POST /slow no response") {
+		t.Errorf("unexpected event %q", events[1])
+	}
+}
+
+func TestSyslogOutputTCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	events := make(chan string, 2)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for {
+			length, err := r.ReadString(' ')
+			if err != nil {
+				return
+			}
+			n, _ := strconv.Atoi(strings.TrimSpace(length))
+			msg := make([]byte, n)
+			if _, err := io.ReadFull(r, msg); err != nil {
+				return
+			}
+			events <- string(msg)
+		}
+	}()
+
+	output := NewSyslogOutput(ln.Addr().String(), &SyslogOutputConfig{Transport: "tcp"})
+	for _, id := range []string{"b1", "b2"} {
+		output.Write([]byte("1 " + id + " 1 0\nGET / HTTP/1.1\r\nHost: api\r\n\r\n"))
+		output.Write([]byte("2 " + id + " 1 1000000\nHTTP/1.1 503 Service Unavailable\r\n\r\n"))
+	}
+	defer output.(*SyslogOutput).Close()
+
+	for _, id := range []string{"b1", "b2"} {
+		select {
+		case e := <-events:
+			if !strings.HasPrefix(e, "<132>1 ") || !strings.Contains(e, `id="`+id+`"`) || !strings.HasSuffix(e, "] GET / 503 1ms") {
+				t.Errorf("unexpected event %q", e)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("expected the events on the connection")
+		}
+	}
+}
@@ -14,27 +14,62 @@ import (
 // Currently used for internal communication between listener and replay server
 // Can be used for transfering binary payloads like protocol buffers
 type TCPOutput struct {
-	address  string
-	limit    int
-	buf      []chan []byte
-	bufStats *GorStat
-	config   *TCPOutputConfig
+	network   string // tcp, or unix for UnixOutput
+	address   string
+	limit     int
+	buf       []chan []byte
+	bufStats  *GorStat
+	config    *TCPOutputConfig
+	resolver  *dnsResolver
+	tlsConfig *tls.Config
 }
 
 // TCPOutputConfig tcp output configuration
 type TCPOutputConfig struct {
 	Secure bool `json:"output-tcp-secure"`
 	Sticky bool `json:"output-tcp-sticky"`
+
+	// the resolution of the host of the address, see dnsResolver
+	DNSResolver string        `json:"output-tcp-dns-resolver"`
+	DNSHosts    MultiOption   `json:"output-tcp-dns-host"`
+	DNSTTL      time.Duration `json:"output-tcp-dns-ttl"`
+
+	// the TLS of Secure, see newClientTLSConfig
+	TLSCert       string `json:"output-tcp-tls-cert"`
+	TLSKey        string `json:"output-tcp-tls-key"`
+	TLSCA         string `json:"output-tcp-tls-ca"`
+	TLSServerName string `json:"output-tcp-tls-server-name"`
+	TLSSkipVerify bool   `json:"output-tcp-tls-skip-verify"`
 }
 
 // NewTCPOutput constructor for TCPOutput
 // Initialize 10 workers which hold keep-alive connection
 func NewTCPOutput(address string, config *TCPOutputConfig) io.Writer {
+	return newTCPOutput("tcp", address, config)
+}
+
+func newTCPOutput(network, address string, config *TCPOutputConfig) *TCPOutput {
 	o := new(TCPOutput)
 
+	o.network = network
 	o.address = address
 	o.config = config
 
+	resolver, err := newDNSResolver(config.DNSResolver, config.DNSHosts, config.DNSTTL)
+	if err != nil {
+		log.Fatalf("output-tcp: %v", err)
+	}
+	o.resolver = resolver
+	if o.tlsConfig, err = newClientTLSConfig(config.TLSCert, config.TLSKey, config.TLSCA, config.TLSServerName, config.TLSSkipVerify); err != nil {
+		log.Fatalf("output-tcp: %v", err)
+	}
+	// the certificate of the other instance is verified with the CAs of the system by default
+	if o.tlsConfig != nil {
+		o.config.Secure = true
+	} else if o.config.Secure {
+		o.tlsConfig = &tls.Config{}
+	}
+
 	if Settings.OutputTCPStats {
 		o.bufStats = NewGorStat("output_tcp", 5000)
 	}
@@ -123,13 +158,22 @@ func (o *TCPOutput) Write(data []byte) (n int, err error) {
 }
 
 func (o *TCPOutput) connect(address string) (conn net.Conn, err error) {
-	if o.config.Secure {
-		conn, err = tls.Dial("tcp", address, &tls.Config{})
-	} else {
-		conn, err = net.Dial("tcp", address)
+	conn, err = o.resolver.dial(o.network, address, 0)
+	if err != nil || !o.config.Secure {
+		return
+	}
+
+	config := o.tlsConfig.Clone()
+	if config.ServerName == "" {
+		config.ServerName, _, _ = net.SplitHostPort(address)
+	}
+	tlsConn := tls.Client(conn, config)
+	if err = tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
 	}
 
-	return
+	return tlsConn, nil
 }
 
 func (o *TCPOutput) String() string {
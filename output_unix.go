@@ -0,0 +1,21 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// UnixOutput sends the payloads to a Unix domain socket with the framing of the TCP transport, for a local
+// consumer like --input-unix of another instance
+type UnixOutput struct {
+	*TCPOutput
+}
+
+// NewUnixOutput constructor for UnixOutput, accepts the path of the socket
+func NewUnixOutput(path string) io.Writer {
+	return &UnixOutput{newTCPOutput("unix", path, &TCPOutputConfig{})}
+}
+
+func (o *UnixOutput) String() string {
+	return fmt.Sprintf("Unix output %s", o.address)
+}
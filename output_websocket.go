@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+)
+
+// webSocketMaxFrame is the maximum size of the frames read from the target
+const webSocketMaxFrame = 64 << 20
+
+// WebSocketOutputConfig is the configuration of the WebSocket output
+type WebSocketOutputConfig struct {
+	Timeout     time.Duration `json:"output-websocket-timeout"`
+	IdleTimeout time.Duration `json:"output-websocket-idle-timeout"`
+
+	// the resolution of the host of the target, see dnsResolver
+	DNSResolver string        `json:"output-websocket-dns-resolver"`
+	DNSHosts    MultiOption   `json:"output-websocket-dns-host"`
+	DNSTTL      time.Duration `json:"output-websocket-dns-ttl"`
+}
+
+// WebSocketOutput replays the WebSocket sessions recorded with --input-raw-protocol websocket. each recorded
+// upgrade request opens a session with the target, the frames the client sent are then sent on it with the
+// delays they were recorded with. the frames of sessions whose upgrade was not recorded are dropped, and the
+// frames of the target are discarded.
+type WebSocketOutput struct {
+	sync.Mutex
+	address  string // host:port dialed
+	host     string // Host header of the upgrade requests
+	secure   bool
+	config   *WebSocketOutputConfig
+	resolver *dnsResolver
+	sessions map[string]*webSocketSession // by the id of the recorded session
+}
+
+type webSocketFrame struct {
+	frame     proto.WebSocketFrame
+	timestamp int64 // recorded
+}
+
+// webSocketSession is a session replayed against the target
+type webSocketSession struct {
+	output    *WebSocketOutput
+	id        string
+	request   []byte
+	timestamp int64 // of the upgrade request
+	frames    chan webSocketFrame
+	done      chan struct{}
+	stop      sync.Once
+	lock      sync.Mutex // guards conn
+	conn      net.Conn
+	reader    *bufio.Reader
+	writing   sync.Mutex
+}
+
+// NewWebSocketOutput constructor for WebSocketOutput, address is a ws:// or wss:// url
+func NewWebSocketOutput(address string, config *WebSocketOutputConfig) io.Writer {
+	o := new(WebSocketOutput)
+	o.config = config
+	if o.config.Timeout < time.Millisecond {
+		o.config.Timeout = 5 * time.Second
+	}
+	if o.config.IdleTimeout < time.Millisecond {
+		o.config.IdleTimeout = 5 * time.Minute
+	}
+	if !strings.Contains(address, "://") {
+		address = "ws://" + address
+	}
+	u, err := url.Parse(address)
+	if err != nil || (u.Scheme != "ws" && u.Scheme != "wss") {
+		log.Fatalf("output-websocket: invalid address %q, expected ws://host:port or wss://host:port", address)
+	}
+	o.secure = u.Scheme == "wss"
+	o.host = u.Host
+	o.address = u.Host
+	if u.Port() == "" {
+		port := "80"
+		if o.secure {
+			port = "443"
+		}
+		o.address = net.JoinHostPort(u.Hostname(), port)
+	}
+	if o.resolver, err = newDNSResolver(o.config.DNSResolver, o.config.DNSHosts, o.config.DNSTTL); err != nil {
+		log.Fatalf("output-websocket: %v", err)
+	}
+	o.sessions = make(map[string]*webSocketSession)
+	return o
+}
+
+func (o *WebSocketOutput) Write(data []byte) (n int, err error) {
+	if !isRequestPayload(data) {
+		return len(data), nil
+	}
+	meta := payloadMeta(data)
+	if len(meta) < 3 {
+		return len(data), nil
+	}
+	id := string(meta[1])
+	timestamp, _ := strconv.ParseInt(string(meta[2]), 10, 64)
+	body := payloadBody(data)
+
+	if proto.IsWebSocketUpgrade(body) {
+		s := &webSocketSession{
+			output:    o,
+			id:        id,
+			request:   append([]byte(nil), body...),
+			timestamp: timestamp,
+			frames:    make(chan webSocketFrame, 1000),
+			done:      make(chan struct{}),
+		}
+		o.Lock()
+		if old, ok := o.sessions[id]; ok {
+			old.close()
+		}
+		o.sessions[id] = s
+		o.Unlock()
+		go s.run()
+		return len(data), nil
+	}
+
+	f, size := proto.ParseWebSocketFrame(body)
+	if size == 0 {
+		return len(data), nil
+	}
+	o.Lock()
+	s, ok := o.sessions[id]
+	o.Unlock()
+	if !ok {
+		return len(data), nil
+	}
+	// the buffer of data is reused
+	f.Payload = f.Unmask()
+	select {
+	case s.frames <- webSocketFrame{frame: f, timestamp: timestamp}:
+	case <-s.done:
+	}
+	return len(data), nil
+}
+
+// remove forgets the session, unless it was replaced by a session with the same id
+func (o *WebSocketOutput) remove(s *webSocketSession) {
+	o.Lock()
+	if o.sessions[s.id] == s {
+		delete(o.sessions, s.id)
+	}
+	o.Unlock()
+}
+
+func (o *WebSocketOutput) String() string {
+	return fmt.Sprintf("WebSocket output: %s", o.address)
+}
+
+// Close closes the sessions in progress
+func (o *WebSocketOutput) Close() error {
+	o.Lock()
+	for _, s := range o.sessions {
+		s.close()
+	}
+	o.Unlock()
+	return nil
+}
+
+// run opens the session and sends its frames until it is closed, or idle for longer than IdleTimeout
+func (s *webSocketSession) run() {
+	defer s.output.remove(s)
+	defer s.close()
+	if err := s.handshake(); err != nil {
+		Debug(1, fmt.Sprintf("[WEBSOCKET-OUTPUT] session %s: %v", s.id, err))
+		return
+	}
+	go s.read()
+	started := time.Now()
+	idle := time.NewTimer(s.output.config.IdleTimeout)
+	defer idle.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-idle.C:
+			return
+		case f := <-s.frames:
+			// the delay since the upgrade request is preserved
+			if wait := time.Duration(f.timestamp-s.timestamp) - time.Since(started); wait > 0 {
+				select {
+				case <-time.After(wait):
+				case <-s.done:
+					return
+				}
+			}
+			if err := s.write(f.frame); err != nil {
+				Debug(1, fmt.Sprintf("[WEBSOCKET-OUTPUT] session %s: %v", s.id, err))
+				return
+			}
+			if !idle.Stop() {
+				<-idle.C
+			}
+			idle.Reset(s.output.config.IdleTimeout)
+		}
+	}
+}
+
+// handshake connects to the target and upgrades the connection with the recorded request,
+// its Host and Sec-WebSocket-Key headers are replaced
+func (s *webSocketSession) handshake() (err error) {
+	o := s.output
+	conn, err := o.resolver.dial("tcp", o.address, o.config.Timeout)
+	if err != nil {
+		return
+	}
+	if o.secure {
+		host, _, _ := net.SplitHostPort(o.address)
+		tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true, ServerName: host})
+		tlsConn.SetDeadline(time.Now().Add(o.config.Timeout))
+		if err = tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return
+		}
+		tlsConn.SetDeadline(time.Time{})
+		conn = tlsConn
+	}
+	s.lock.Lock()
+	s.conn = conn
+	s.lock.Unlock()
+	select {
+	case <-s.done:
+		// closed while dialing
+		conn.Close()
+		return errors.New("session closed")
+	default:
+	}
+
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	key := []byte(base64.StdEncoding.EncodeToString(nonce))
+	req := proto.SetHeader(s.request, []byte("Host"), []byte(o.host))
+	req = proto.SetHeader(req, []byte("Sec-WebSocket-Key"), key)
+	conn.SetDeadline(time.Now().Add(o.config.Timeout))
+	if _, err = conn.Write(req); err != nil {
+		return
+	}
+	s.reader = bufio.NewReader(conn)
+	resp, err := http.ReadResponse(s.reader, nil)
+	if err != nil {
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return fmt.Errorf("upgrade refused with status %d", resp.StatusCode)
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != proto.WebSocketAccept(key) {
+		return errors.New("invalid Sec-WebSocket-Accept header")
+	}
+	return conn.SetDeadline(time.Time{})
+}
+
+// read reads the frames of the target, pings are answered and the session is closed with the connection
+func (s *webSocketSession) read() {
+	defer s.close()
+	for {
+		f, err := readWebSocketFrame(s.reader)
+		if err != nil {
+			return
+		}
+		switch f.Opcode {
+		case proto.WebSocketPing:
+			if s.write(proto.WebSocketFrame{Fin: true, Opcode: proto.WebSocketPong, Payload: f.Unmask()}) != nil {
+				return
+			}
+		case proto.WebSocketClose:
+			s.write(proto.WebSocketFrame{Fin: true, Opcode: proto.WebSocketClose, Payload: f.Unmask()})
+			return
+		}
+	}
+}
+
+// write sends a frame to the target, masked with a random key
+func (s *webSocketSession) write(f proto.WebSocketFrame) error {
+	f.Masked = true
+	rand.Read(f.Key[:])
+	s.writing.Lock()
+	defer s.writing.Unlock()
+	s.conn.SetWriteDeadline(time.Now().Add(s.output.config.Timeout))
+	_, err := s.conn.Write(proto.AppendWebSocketFrame(nil, f))
+	return err
+}
+
+func (s *webSocketSession) close() {
+	s.stop.Do(func() {
+		close(s.done)
+		s.lock.Lock()
+		if s.conn != nil {
+			s.conn.Close()
+		}
+		s.lock.Unlock()
+	})
+}
+
+// readWebSocketFrame reads a frame of at most webSocketMaxFrame bytes
+func readWebSocketFrame(r *bufio.Reader) (f proto.WebSocketFrame, err error) {
+	head, err := r.Peek(2)
+	if err != nil {
+		return
+	}
+	if head, err = r.Peek(proto.WebSocketHeaderLen(head)); err != nil {
+		return
+	}
+	n := proto.WebSocketFrameLength(head)
+	if n < 0 || n > webSocketMaxFrame {
+		return f, errors.New("websocket frame too large")
+	}
+	buf := make([]byte, n)
+	if _, err = io.ReadFull(r, buf); err != nil {
+		return
+	}
+	f, _ = proto.ParseWebSocketFrame(buf)
+	return f, nil
+}
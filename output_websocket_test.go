@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+)
+
+type webSocketReceived struct {
+	frame proto.WebSocketFrame
+	at    time.Time
+}
+
+func TestWebSocketOutput(t *testing.T) {
+	received := make(chan webSocketReceived, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/chat" || r.Header.Get("Upgrade") != "websocket" {
+			http.Error(w, "not a websocket upgrade", http.StatusBadRequest)
+			return
+		}
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		accept := proto.WebSocketAccept([]byte(r.Header.Get("Sec-WebSocket-Key")))
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: " + accept + "\r\n\r\n")
+		rw.Flush()
+		reader := bufio.NewReader(rw)
+		for {
+			f, err := readWebSocketFrame(reader)
+			if err != nil {
+				return
+			}
+			received <- webSocketReceived{f, time.Now()}
+			if f.Opcode == proto.WebSocketClose {
+				conn.Write(proto.AppendWebSocketFrame(nil, proto.WebSocketFrame{Fin: true, Opcode: proto.WebSocketClose}))
+				return
+			}
+		}
+	}))
+	defer server.Close()
+
+	output := NewWebSocketOutput(strings.Replace(server.URL, "http://", "ws://", 1), &WebSocketOutputConfig{})
+	defer output.(*WebSocketOutput).Close()
+
+	start := time.Now().UnixNano()
+	payload := func(ts time.Duration, body []byte) []byte {
+		return append(payloadHeader(RequestPayload, []byte("a1b2"), start+int64(ts), 0), body...)
+	}
+	output.Write(payload(0, []byte("GET /chat HTTP/1.1\r\nHost: example.com\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n")))
+	output.Write(payload(0, proto.AppendWebSocketFrame(nil, proto.WebSocketFrame{Fin: true, Opcode: proto.WebSocketText, Payload: []byte("hello")})))
+	// the frames of the server are not replayed
+	output.Write(append(payloadHeader(ResponsePayload, []byte("a1b2"), start, 0), proto.AppendWebSocketFrame(nil, proto.WebSocketFrame{Fin: true, Opcode: proto.WebSocketText, Payload: []byte("hi")})...))
+	output.Write(payload(200*time.Millisecond, proto.AppendWebSocketFrame(nil, proto.WebSocketFrame{Fin: true, Opcode: proto.WebSocketClose})))
+
+	var got []webSocketReceived
+	for len(got) < 2 {
+		select {
+		case r := <-received:
+			got = append(got, r)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("expected 2 frames, got %d", len(got))
+		}
+	}
+	if !got[0].frame.Masked || string(got[0].frame.Unmask()) != "hello" || got[1].frame.Opcode != proto.WebSocketClose {
+		t.Errorf("unexpected frames %+v", got)
+	}
+	if delay := got[1].at.Sub(got[0].at); delay < 150*time.Millisecond {
+		t.Errorf("expected the frames to be sent 200ms apart, got %s", delay)
+	}
+}
@@ -84,13 +84,17 @@ func NewPlugins() *InOutPlugins {
 	}
 
 	if Settings.OutputStdout {
-		plugins.registerPlugin(NewDummyOutput)
+		plugins.registerPlugin(NewStdOutput, Settings.OutputStdoutFormat)
 	}
 
 	if Settings.OutputNull {
 		plugins.registerPlugin(NewNullOutput)
 	}
 
+	if Settings.OutputBenchmark {
+		plugins.registerPlugin(NewBenchmarkOutput, Settings.OutputBenchmarkInterval)
+	}
+
 	for _, options := range Settings.InputRAW {
 		plugins.registerPlugin(NewRAWInput, options, Settings.RAWInputConfig)
 	}
@@ -103,13 +107,33 @@ func NewPlugins() *InOutPlugins {
 		plugins.registerPlugin(NewTCPOutput, options, &Settings.OutputTCPConfig)
 	}
 
+	for _, options := range Settings.InputUnix {
+		plugins.registerPlugin(NewUnixInput, options)
+	}
+
+	for _, options := range Settings.OutputUnix {
+		plugins.registerPlugin(NewUnixOutput, options)
+	}
+
 	for _, options := range Settings.InputFile {
 		plugins.registerPlugin(NewFileInput, options, Settings.InputFileLoop)
 	}
 
+	for _, path := range Settings.InputS3 {
+		plugins.registerPlugin(NewS3Input, path, &Settings.InputS3Config)
+	}
+
+	for _, path := range Settings.InputGCS {
+		plugins.registerPlugin(NewGCSInput, path, &Settings.InputGCSConfig)
+	}
+
 	for _, path := range Settings.OutputFile {
 		if strings.HasPrefix(path, "s3://") {
 			plugins.registerPlugin(NewS3Output, path, &Settings.OutputFileConfig)
+		} else if strings.HasPrefix(path, "gs://") {
+			plugins.registerPlugin(NewGCSOutput, path, &Settings.OutputFileConfig)
+		} else if strings.HasPrefix(path, "https://") || strings.HasPrefix(path, "http://") {
+			plugins.registerPlugin(NewAzureOutput, path, &Settings.OutputFileConfig)
 		} else {
 			plugins.registerPlugin(NewFileOutput, path, &Settings.OutputFileConfig)
 		}
@@ -136,12 +160,96 @@ func NewPlugins() *InOutPlugins {
 		plugins.registerPlugin(NewBinaryOutput, options, &Settings.OutputBinaryConfig)
 	}
 
+	for _, options := range Settings.OutputWebSocket {
+		plugins.registerPlugin(NewWebSocketOutput, options, &Settings.OutputWebSocketConfig)
+	}
+
+	for _, options := range Settings.OutputMySQL {
+		plugins.registerPlugin(NewMySQLOutput, options, &Settings.OutputMySQLConfig)
+	}
+
+	for _, options := range Settings.OutputPostgres {
+		plugins.registerPlugin(NewPostgresOutput, options, &Settings.OutputPostgresConfig)
+	}
+
+	for _, options := range Settings.OutputRedis {
+		plugins.registerPlugin(NewRedisOutput, options, &Settings.OutputRedisConfig)
+	}
+
+	for _, options := range Settings.OutputMongo {
+		plugins.registerPlugin(NewMongoOutput, options, &Settings.OutputMongoConfig)
+	}
+
+	for _, options := range Settings.OutputMQTT {
+		plugins.registerPlugin(NewMQTTOutput, options, &Settings.OutputMQTTConfig)
+	}
+
+	for _, options := range Settings.OutputAMQP {
+		plugins.registerPlugin(NewAMQPOutput, options, &Settings.OutputAMQPConfig)
+	}
+
+	for _, options := range Settings.OutputAMQPPublish {
+		plugins.registerPlugin(NewAMQPPublishOutput, options, &Settings.OutputAMQPConfig)
+	}
+
+	for _, options := range Settings.OutputNATS {
+		plugins.registerPlugin(NewNATSOutput, options, &Settings.OutputNATSConfig)
+	}
+
+	for _, options := range Settings.OutputPulsar {
+		plugins.registerPlugin(NewPulsarOutput, options, &Settings.OutputPulsarConfig)
+	}
+
+	for _, options := range Settings.OutputPubSub {
+		plugins.registerPlugin(NewPubSubOutput, options, &Settings.OutputPubSubConfig)
+	}
+
+	for _, options := range Settings.OutputKinesis {
+		plugins.registerPlugin(NewKinesisOutput, options, &Settings.OutputKinesisConfig)
+	}
+
+	for _, options := range Settings.OutputSQS {
+		plugins.registerPlugin(NewSQSOutput, options, &Settings.OutputSQSConfig)
+	}
+
+	for _, options := range Settings.OutputClickHouse {
+		plugins.registerPlugin(NewClickHouseOutput, options, &Settings.OutputClickHouseConfig)
+	}
+
+	for _, options := range Settings.OutputDNS {
+		plugins.registerPlugin(NewDNSOutput, options, &Settings.OutputDNSConfig)
+	}
+
+	for _, options := range Settings.OutputDiff {
+		plugins.registerPlugin(NewDiffOutput, options, &Settings.OutputDiffConfig)
+	}
+
+	for _, options := range Settings.OutputHAR {
+		plugins.registerPlugin(NewHAROutput, options, &Settings.OutputHARConfig)
+	}
+
+	for _, options := range Settings.OutputSyslog {
+		plugins.registerPlugin(NewSyslogOutput, options, &Settings.OutputSyslogConfig)
+	}
+
+	for _, options := range Settings.OutputSIP {
+		plugins.registerPlugin(NewSIPOutput, options, &Settings.OutputSIPConfig)
+	}
+
+	for _, options := range Settings.OutputKafkaProduce {
+		plugins.registerPlugin(NewKafkaProduceOutput, options, &Settings.OutputKafkaProduceConfig, &Settings.KafkaTLSConfig)
+	}
+
 	if Settings.OutputKafkaConfig.Host != "" && Settings.OutputKafkaConfig.Topic != "" {
-		plugins.registerPlugin(NewKafkaOutput, "", &Settings.OutputKafkaConfig, &Settings.KafkaTLSConfig)
+		plugins.registerPlugin(NewKafkaOutputWithTLS, "", &Settings.OutputKafkaConfig, &Settings.KafkaTLSConfig)
 	}
 
 	if Settings.InputKafkaConfig.Host != "" && Settings.InputKafkaConfig.Topic != "" {
-		plugins.registerPlugin(NewKafkaInput, "", &Settings.InputKafkaConfig, &Settings.KafkaTLSConfig)
+		tlsConfig := &Settings.KafkaTLSConfig
+		if Settings.InputKafkaTLSConfig.isSet() {
+			tlsConfig = &Settings.InputKafkaTLSConfig
+		}
+		plugins.registerPlugin(NewKafkaInputWithTLS, "", &Settings.InputKafkaConfig, tlsConfig)
 	}
 
 	return plugins
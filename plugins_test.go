@@ -1,16 +1,34 @@
 package main
 
 import (
+	"io"
 	"testing"
+
+	"github.com/Shopify/sarama"
 )
 
+// closePlugins closes the plugins registered, the ones wrapped in a Limiter included
+func closePlugins(plugins *InOutPlugins) {
+	for _, p := range plugins.All {
+		if c, ok := p.(io.Closer); ok {
+			c.Close()
+		}
+	}
+}
+
+// the tests only set the fields of the plugins they register, the whole Settings is not replaced: the goroutines
+// of the plugins, like the workers of the HTTP output, keep reading their configuration in Settings
 func TestPluginsRegistration(t *testing.T) {
+	defer func(inputDummy, outputDummy, outputHTTP, inputFile MultiOption) {
+		Settings.InputDummy, Settings.OutputDummy, Settings.OutputHTTP, Settings.InputFile = inputDummy, outputDummy, outputHTTP, inputFile
+	}(Settings.InputDummy, Settings.OutputDummy, Settings.OutputHTTP, Settings.InputFile)
 	Settings.InputDummy = MultiOption{"[]"}
 	Settings.OutputDummy = MultiOption{"[]"}
 	Settings.OutputHTTP = MultiOption{"www.example.com|10"}
 	Settings.InputFile = MultiOption{"/dev/null"}
 
 	plugins := NewPlugins()
+	defer closePlugins(plugins)
 
 	if len(plugins.Inputs) != 2 {
 		t.Errorf("Should be 2 inputs %d", len(plugins.Inputs))
@@ -41,3 +59,35 @@ func TestPluginsRegistration(t *testing.T) {
 	}
 
 }
+
+func TestPluginsKafkaRegistration(t *testing.T) {
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("test", 0, broker.BrokerID()),
+		"OffsetRequest": sarama.NewMockOffsetResponse(t).
+			SetOffset("test", 0, sarama.OffsetOldest, 0).
+			SetOffset("test", 0, sarama.OffsetNewest, 0),
+		"FetchRequest": sarama.NewMockFetchResponse(t, 1),
+	})
+
+	defer func(input InputKafkaConfig, output OutputKafkaConfig) {
+		Settings.InputKafkaConfig, Settings.OutputKafkaConfig = input, output
+	}(Settings.InputKafkaConfig, Settings.OutputKafkaConfig)
+	Settings.InputKafkaConfig = InputKafkaConfig{Host: broker.Addr(), Topic: "test"}
+	Settings.OutputKafkaConfig = OutputKafkaConfig{Host: broker.Addr(), Topic: "test"}
+
+	plugins := NewPlugins()
+	defer closePlugins(plugins)
+	if len(plugins.Inputs) != 1 || len(plugins.Outputs) != 1 {
+		t.Fatalf("expected the Kafka input and output, got %v and %v", plugins.Inputs, plugins.Outputs)
+	}
+	if _, ok := plugins.Inputs[0].(*KafkaInput); !ok {
+		t.Errorf("expected KafkaInput, got %T", plugins.Inputs[0])
+	}
+	if _, ok := plugins.Outputs[0].(*KafkaOutput); !ok {
+		t.Errorf("expected KafkaOutput, got %T", plugins.Outputs[0])
+	}
+}
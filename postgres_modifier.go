@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/buger/goreplay/proto"
+)
+
+// PostgresModifierConfig is the configuration of the filters and of the scrubbing of PostgreSQL requests
+type PostgresModifierConfig struct {
+	QueryRegexp         PostgresQueryRegexp `json:"postgres-allow-query"`
+	QueryNegativeRegexp PostgresQueryRegexp `json:"postgres-disallow-query"`
+	Scrub               bool                `json:"postgres-scrub"`
+}
+
+// PostgresQueryRegexp holds the regexps matched against the SQL of PostgreSQL requests
+type PostgresQueryRegexp []*regexp.Regexp
+
+func (r *PostgresQueryRegexp) String() string {
+	return fmt.Sprint(*r)
+}
+
+// Set is here so that PostgresQueryRegexp can implement flag.Var
+func (r *PostgresQueryRegexp) Set(value string) error {
+	re, err := regexp.Compile(value)
+	if err != nil {
+		return err
+	}
+	*r = append(*r, re)
+	return nil
+}
+
+// PostgresModifier filters and scrubs the requests recorded with --input-raw-protocol postgres, a request holds
+// the messages of the client up to a Query or a Sync message. the requests are filtered by the SQL of their Query
+// and Parse messages, the requests without SQL(e.g: executing a statement prepared by a previous request) are
+// kept. scrubbing masks the literals of the SQL and the parameters of Bind messages in the text format.
+type PostgresModifier struct {
+	config *PostgresModifierConfig
+}
+
+// NewPostgresModifier returns nil when nothing is filtered nor scrubbed
+func NewPostgresModifier(config *PostgresModifierConfig) *PostgresModifier {
+	if len(config.QueryRegexp) == 0 && len(config.QueryNegativeRegexp) == 0 && !config.Scrub {
+		return nil
+	}
+	return &PostgresModifier{config: config}
+}
+
+// Rewrite returns the request scrubbed in place, or nothing if the request is filtered out. the payloads that are
+// not PostgreSQL requests are returned as is.
+func (m *PostgresModifier) Rewrite(payload []byte) []byte {
+	if !proto.PostgresMessages(payload) {
+		return payload
+	}
+	var queries [][]byte
+	for data := payload; len(data) > 0; {
+		typ, body, n := proto.PostgresMessage(data)
+		data = data[n:]
+		if query, ok := proto.PostgresQueryText(typ, body); ok {
+			queries = append(queries, query)
+		}
+	}
+	if len(queries) > 0 {
+		if len(m.config.QueryRegexp) > 0 && !matchQueries(m.config.QueryRegexp, queries) {
+			return nil
+		}
+		if matchQueries(m.config.QueryNegativeRegexp, queries) {
+			return nil
+		}
+	}
+	if !m.config.Scrub {
+		return payload
+	}
+	for data := payload; len(data) > 0; {
+		typ, body, n := proto.PostgresMessage(data)
+		data = data[n:]
+		if query, ok := proto.PostgresQueryText(typ, body); ok {
+			proto.ScrubSQL(query)
+			continue
+		}
+		if typ != proto.PostgresBind {
+			continue
+		}
+		params, _ := proto.PostgresBindParams(body)
+		for _, p := range params {
+			proto.ScrubValue(p)
+		}
+	}
+	return payload
+}
+
+// matchQueries reports whether one of the regexps matches one of the queries
+func matchQueries(regexps PostgresQueryRegexp, queries [][]byte) bool {
+	for _, re := range regexps {
+		for _, query := range queries {
+			if re.Match(query) {
+				return true
+			}
+		}
+	}
+	return false
+}
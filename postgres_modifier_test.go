@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/buger/goreplay/proto"
+)
+
+func TestPostgresModifier(t *testing.T) {
+	if NewPostgresModifier(&PostgresModifierConfig{}) != nil {
+		t.Error("expected no modifier without filters nor scrubbing")
+	}
+	config := &PostgresModifierConfig{Scrub: true}
+	config.QueryRegexp.Set("(?i)^select")
+	config.QueryNegativeRegexp.Set("pg_sleep")
+	m := NewPostgresModifier(config)
+
+	query := func(sql string) []byte {
+		return proto.AppendPostgresMessage(nil, proto.PostgresQuery, []byte(sql+"\x00"))
+	}
+	if got := m.Rewrite(query("DELETE FROM users")); len(got) != 0 {
+		t.Errorf("expected the request to be filtered out, got %q", got)
+	}
+	if got := m.Rewrite(query("SELECT pg_sleep(1)")); len(got) != 0 {
+		t.Errorf("expected the request to be filtered out, got %q", got)
+	}
+	if got := m.Rewrite(query("SELECT * FROM users WHERE name = 'bob'")); !bytes.Equal(got, query("SELECT * FROM users WHERE name = 'xxx'")) {
+		t.Errorf("expected the literals to be scrubbed, got %q", got)
+	}
+	// executing a prepared statement, its text parameters are scrubbed
+	bind := proto.AppendPostgresMessage(nil, proto.PostgresBind, []byte("\x00s1\x00\x00\x00\x00\x01\x00\x00\x00\x05bob42\x00\x00"))
+	request := append(bind, proto.AppendPostgresMessage(nil, proto.PostgresSync, nil)...)
+	expected := append(proto.AppendPostgresMessage(nil, proto.PostgresBind, []byte("\x00s1\x00\x00\x00\x00\x01\x00\x00\x00\x05xxx11\x00\x00")), proto.AppendPostgresMessage(nil, proto.PostgresSync, nil)...)
+	if got := m.Rewrite(request); !bytes.Equal(got, expected) {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+	// not postgres
+	http := []byte("GET / HTTP/1.1\r\n\r\n")
+	if got := m.Rewrite(http); !bytes.Equal(got, http) {
+		t.Errorf("expected the payload to be kept, got %q", got)
+	}
+}
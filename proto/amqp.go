@@ -0,0 +1,229 @@
+package proto
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// AMQPProtocolHeader starts the AMQP 0-9-1 connections
+const AMQPProtocolHeader = "AMQP\x00\x00\x09\x01"
+
+// AMQP frame types(https://www.rabbitmq.com/resources/specs/amqp0-9-1.pdf)
+const (
+	AMQPFrameMethod    byte = 1
+	AMQPFrameHeader    byte = 2
+	AMQPFrameBody      byte = 3
+	AMQPFrameHeartbeat byte = 8
+)
+
+// AMQPFrameEnd ends the AMQP frames
+const AMQPFrameEnd byte = 0xCE
+
+// AMQPMaxFrame is the maximum size of the AMQP frames accepted, RabbitMQ defaults to 128kb
+const AMQPMaxFrame = 16 << 20
+
+// AMQP classes and the methods used to follow connections and to publish
+const (
+	AMQPConnection uint16 = 10
+	AMQPChannel    uint16 = 20
+	AMQPBasic      uint16 = 60
+	AMQPConfirm    uint16 = 85
+
+	AMQPConnectionStart   uint16 = 10
+	AMQPConnectionStartOk uint16 = 11
+	AMQPConnectionTune    uint16 = 30
+	AMQPConnectionTuneOk  uint16 = 31
+	AMQPConnectionOpen    uint16 = 40
+	AMQPConnectionOpenOk  uint16 = 41
+	AMQPConnectionClose   uint16 = 50
+	AMQPConnectionCloseOk uint16 = 51
+	AMQPChannelOpen       uint16 = 10
+	AMQPChannelOpenOk     uint16 = 11
+	AMQPChannelClose      uint16 = 40
+	AMQPChannelCloseOk    uint16 = 41
+	AMQPBasicPublish      uint16 = 40
+	AMQPBasicReturn       uint16 = 50
+	AMQPBasicAck          uint16 = 80
+	AMQPBasicNack         uint16 = 120
+	AMQPConfirmSelect     uint16 = 10
+	AMQPConfirmSelectOk   uint16 = 11
+)
+
+// AMQPFrame returns the type, the channel and the payload of the frame at the start of data, and the length of
+// the frame. n is 0 if the frame is not complete or not valid.
+func AMQPFrame(data []byte) (typ byte, channel uint16, payload []byte, n int) {
+	if len(data) < 8 {
+		return
+	}
+	size := binary.BigEndian.Uint32(data[3:])
+	if size > AMQPMaxFrame || uint32(len(data)-8) < size || data[7+size] != AMQPFrameEnd {
+		return
+	}
+	switch data[0] {
+	case AMQPFrameMethod, AMQPFrameHeader, AMQPFrameBody, AMQPFrameHeartbeat:
+	default:
+		return
+	}
+	return data[0], binary.BigEndian.Uint16(data[1:]), data[7 : 7+size], 8 + int(size)
+}
+
+// AMQPFrameLength returns the length of the frame, or of the protocol header, at the start of data, or -1 if it
+// is not complete
+func AMQPFrameLength(data []byte) int {
+	if bytes.HasPrefix(data, []byte("AMQP")) {
+		if len(data) < len(AMQPProtocolHeader) {
+			return -1
+		}
+		return len(AMQPProtocolHeader)
+	}
+	if _, _, _, n := AMQPFrame(data); n > 0 {
+		return n
+	}
+	return -1
+}
+
+// AppendAMQPFrame appends a frame to dst
+func AppendAMQPFrame(dst []byte, typ byte, channel uint16, payload []byte) []byte {
+	dst = append(dst, typ, byte(channel>>8), byte(channel))
+	dst = append(dst, byte(len(payload)>>24), byte(len(payload)>>16), byte(len(payload)>>8), byte(len(payload)))
+	return append(append(dst, payload...), AMQPFrameEnd)
+}
+
+// AMQPMethod returns the class, the method and the arguments of the payload of a method frame
+func AMQPMethod(payload []byte) (class, method uint16, args []byte, ok bool) {
+	if len(payload) < 4 {
+		return
+	}
+	return binary.BigEndian.Uint16(payload), binary.BigEndian.Uint16(payload[2:]), payload[4:], true
+}
+
+// AppendAMQPMethod appends a method frame to dst
+func AppendAMQPMethod(dst []byte, channel, class, method uint16, args []byte) []byte {
+	payload := append([]byte{byte(class >> 8), byte(class), byte(method >> 8), byte(method)}, args...)
+	return AppendAMQPFrame(dst, AMQPFrameMethod, channel, payload)
+}
+
+// AMQPShortString returns the short string at the start of data and the data following it
+func AMQPShortString(data []byte) (s, rest []byte, ok bool) {
+	if len(data) < 1 || len(data)-1 < int(data[0]) {
+		return
+	}
+	return data[1 : 1+data[0]], data[1+data[0]:], true
+}
+
+// AppendAMQPShortString appends a short string to dst, it is truncated to 255 bytes
+func AppendAMQPShortString(dst []byte, s string) []byte {
+	if len(s) > 255 {
+		s = s[:255]
+	}
+	return append(append(dst, byte(len(s))), s...)
+}
+
+// AppendAMQPLongString appends a long string to dst
+func AppendAMQPLongString(dst []byte, s string) []byte {
+	dst = append(dst, byte(len(s)>>24), byte(len(s)>>16), byte(len(s)>>8), byte(len(s)))
+	return append(dst, s...)
+}
+
+// AMQPContentHeader returns the class, the size of the body and the property flags and list of the payload of a
+// content header frame
+func AMQPContentHeader(payload []byte) (class uint16, bodySize uint64, properties []byte, ok bool) {
+	if len(payload) < 14 {
+		return
+	}
+	return binary.BigEndian.Uint16(payload), binary.BigEndian.Uint64(payload[4:]), payload[12:], true
+}
+
+// AppendAMQPContentHeader appends a content header frame to dst
+func AppendAMQPContentHeader(dst []byte, channel, class uint16, bodySize uint64, properties []byte) []byte {
+	payload := make([]byte, 12, 12+len(properties))
+	binary.BigEndian.PutUint16(payload, class)
+	binary.BigEndian.PutUint64(payload[4:], bodySize)
+	if len(properties) < 2 {
+		// no property flags
+		properties = []byte{0, 0}
+	}
+	return AppendAMQPFrame(dst, AMQPFrameHeader, channel, append(payload, properties...))
+}
+
+// AMQPPublishCommand is a basic.publish method with its content
+type AMQPPublishCommand struct {
+	Channel    uint16
+	Exchange   string
+	RoutingKey string
+	Mandatory  bool
+	Immediate  bool
+	Properties []byte // the property flags and list of the content header
+	Body       []byte
+}
+
+// ParseAMQPPublish returns the basic.publish command of data, its method frame, its content header frame and its
+// body frames, as recorded with --input-raw-protocol amqp
+func ParseAMQPPublish(data []byte) (p AMQPPublishCommand, ok bool) {
+	typ, channel, payload, n := AMQPFrame(data)
+	if typ != AMQPFrameMethod {
+		return
+	}
+	class, method, args, _ := AMQPMethod(payload)
+	if class != AMQPBasic || method != AMQPBasicPublish || len(args) < 2 {
+		return
+	}
+	// reserved ticket
+	exchange, rest, ok := AMQPShortString(args[2:])
+	if !ok {
+		return
+	}
+	key, rest, ok := AMQPShortString(rest)
+	if !ok || len(rest) < 1 {
+		return p, false
+	}
+	p.Channel = channel
+	p.Exchange, p.RoutingKey = string(exchange), string(key)
+	p.Mandatory, p.Immediate = rest[0]&0x01 != 0, rest[0]&0x02 != 0
+	data = data[n:]
+	typ, _, payload, n = AMQPFrame(data)
+	if typ != AMQPFrameHeader {
+		return p, false
+	}
+	_, size, properties, ok := AMQPContentHeader(payload)
+	if !ok {
+		return
+	}
+	p.Properties = properties
+	for data = data[n:]; uint64(len(p.Body)) < size; data = data[n:] {
+		if typ, _, payload, n = AMQPFrame(data); typ != AMQPFrameBody {
+			return p, false
+		}
+		p.Body = append(p.Body, payload...)
+	}
+	return p, uint64(len(p.Body)) == size
+}
+
+// AppendAMQPPublish appends the frames of the basic.publish command to dst, the body is split in frames of at
+// most frameMax bytes, 0 means no limit
+func AppendAMQPPublish(dst []byte, p AMQPPublishCommand, frameMax int) []byte {
+	args := AppendAMQPShortString([]byte{0, 0}, p.Exchange)
+	args = AppendAMQPShortString(args, p.RoutingKey)
+	var bits byte
+	if p.Mandatory {
+		bits |= 0x01
+	}
+	if p.Immediate {
+		bits |= 0x02
+	}
+	dst = AppendAMQPMethod(dst, p.Channel, AMQPBasic, AMQPBasicPublish, append(args, bits))
+	dst = AppendAMQPContentHeader(dst, p.Channel, AMQPBasic, uint64(len(p.Body)), p.Properties)
+	max := frameMax - 8
+	if frameMax <= 8 {
+		max = len(p.Body)
+	}
+	for body := p.Body; len(body) > 0; {
+		n := len(body)
+		if n > max {
+			n = max
+		}
+		dst = AppendAMQPFrame(dst, AMQPFrameBody, p.Channel, body[:n])
+		body = body[n:]
+	}
+	return dst
+}
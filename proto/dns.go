@@ -0,0 +1,347 @@
+package proto
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DNSHeaderLen is the length of the header of DNS messages
+const DNSHeaderLen = 12
+
+// DNS record types(https://www.iana.org/assignments/dns-parameters/dns-parameters.xhtml)
+const (
+	DNSTypeA      uint16 = 1
+	DNSTypeNS     uint16 = 2
+	DNSTypeCNAME  uint16 = 5
+	DNSTypeSOA    uint16 = 6
+	DNSTypePTR    uint16 = 12
+	DNSTypeMX     uint16 = 15
+	DNSTypeTXT    uint16 = 16
+	DNSTypeAAAA   uint16 = 28
+	DNSTypeSRV    uint16 = 33
+	DNSTypeNAPTR  uint16 = 35
+	DNSTypeDNAME  uint16 = 39
+	DNSTypeOPT    uint16 = 41
+	DNSTypeDS     uint16 = 43
+	DNSTypeRRSIG  uint16 = 46
+	DNSTypeNSEC   uint16 = 47
+	DNSTypeDNSKEY uint16 = 48
+	DNSTypeSVCB   uint16 = 64
+	DNSTypeHTTPS  uint16 = 65
+	DNSTypeANY    uint16 = 255
+	DNSTypeCAA    uint16 = 257
+)
+
+var dnsTypes = map[uint16]string{
+	DNSTypeA: "A", DNSTypeNS: "NS", DNSTypeCNAME: "CNAME", DNSTypeSOA: "SOA", DNSTypePTR: "PTR", DNSTypeMX: "MX",
+	DNSTypeTXT: "TXT", DNSTypeAAAA: "AAAA", DNSTypeSRV: "SRV", DNSTypeNAPTR: "NAPTR", DNSTypeDNAME: "DNAME",
+	DNSTypeOPT: "OPT", DNSTypeDS: "DS", DNSTypeRRSIG: "RRSIG", DNSTypeNSEC: "NSEC", DNSTypeDNSKEY: "DNSKEY",
+	DNSTypeSVCB: "SVCB", DNSTypeHTTPS: "HTTPS", DNSTypeANY: "ANY", DNSTypeCAA: "CAA",
+}
+
+// DNSTypeName returns the mnemonic of the record type, TYPEn for the unknown ones
+func DNSTypeName(t uint16) string {
+	if name, ok := dnsTypes[t]; ok {
+		return name
+	}
+	return "TYPE" + strconv.Itoa(int(t))
+}
+
+// DNSType returns the record type of a mnemonic or of TYPEn, case insensitively
+func DNSType(name string) (uint16, bool) {
+	name = strings.ToUpper(name)
+	for t, n := range dnsTypes {
+		if n == name {
+			return t, true
+		}
+	}
+	if strings.HasPrefix(name, "TYPE") {
+		t, err := strconv.ParseUint(name[4:], 10, 16)
+		return uint16(t), err == nil
+	}
+	return 0, false
+}
+
+var dnsRcodes = [...]string{"NOERROR", "FORMERR", "SERVFAIL", "NXDOMAIN", "NOTIMP", "REFUSED"}
+
+// DNSRcodeName returns the mnemonic of the response code
+func DNSRcodeName(rcode byte) string {
+	if int(rcode) < len(dnsRcodes) {
+		return dnsRcodes[rcode]
+	}
+	return "RCODE" + strconv.Itoa(int(rcode))
+}
+
+// DNSQuestion is a question of a DNS message
+type DNSQuestion struct {
+	Name  string // lower case, with a trailing dot
+	Type  uint16
+	Class uint16
+}
+
+func (q DNSQuestion) String() string {
+	return q.Name + " " + DNSTypeName(q.Type)
+}
+
+// DNSRecord is a resource record of a DNS message
+type DNSRecord struct {
+	Name  string // lower case, with a trailing dot
+	Type  uint16
+	Class uint16
+	TTL   uint32
+	Data  []byte // the names of the data of the well known types are lower case and not compressed
+}
+
+// String returns the record without its TTL and class
+func (r DNSRecord) String() string {
+	return r.Name + " " + DNSTypeName(r.Type) + " " + r.data()
+}
+
+// data formats the data of the record
+func (r DNSRecord) data() string {
+	switch r.Type {
+	case DNSTypeA, DNSTypeAAAA:
+		if len(r.Data) == net.IPv4len || len(r.Data) == net.IPv6len {
+			return net.IP(r.Data).String()
+		}
+	case DNSTypeCNAME, DNSTypeNS, DNSTypePTR, DNSTypeDNAME:
+		if name, _, ok := dnsName(r.Data, 0); ok {
+			return name
+		}
+	case DNSTypeMX:
+		if name, _, ok := dnsName(r.Data, 2); ok {
+			return fmt.Sprintf("%d %s", binary.BigEndian.Uint16(r.Data), name)
+		}
+	case DNSTypeTXT:
+		var s []string
+		for data := r.Data; len(data) > 0 && len(data) > int(data[0]); data = data[1+data[0]:] {
+			s = append(s, strconv.Quote(string(data[1:1+data[0]])))
+		}
+		return strings.Join(s, " ")
+	}
+	return hex.EncodeToString(r.Data)
+}
+
+// DNSMessage is a DNS query or response
+type DNSMessage struct {
+	ID         uint16
+	Response   bool
+	Opcode     byte
+	Rcode      byte
+	Flags      uint16 // the flags of the header, including the opcode and the response code
+	Questions  []DNSQuestion
+	Answers    []DNSRecord
+	Authority  []DNSRecord
+	Additional []DNSRecord
+}
+
+// DNSHeader returns the id of the DNS message and whether it is a response, ok is false if data is shorter than
+// the header
+func DNSHeader(data []byte) (id uint16, response, ok bool) {
+	if len(data) < DNSHeaderLen {
+		return
+	}
+	return binary.BigEndian.Uint16(data), data[2]&0x80 != 0, true
+}
+
+// ParseDNS parses a DNS message, without the length prefixing it over TCP
+func ParseDNS(data []byte) (m DNSMessage, ok bool) {
+	if len(data) < DNSHeaderLen {
+		return
+	}
+	m.ID = binary.BigEndian.Uint16(data)
+	m.Flags = binary.BigEndian.Uint16(data[2:])
+	m.Response = m.Flags&0x8000 != 0
+	m.Opcode = byte(m.Flags>>11) & 0x0f
+	m.Rcode = byte(m.Flags) & 0x0f
+	off := DNSHeaderLen
+	for i := binary.BigEndian.Uint16(data[4:]); i > 0; i-- {
+		var q DNSQuestion
+		if q.Name, off, ok = dnsName(data, off); !ok || len(data)-off < 4 {
+			return m, false
+		}
+		q.Type, q.Class = binary.BigEndian.Uint16(data[off:]), binary.BigEndian.Uint16(data[off+2:])
+		off += 4
+		m.Questions = append(m.Questions, q)
+	}
+	for i, section := range []*[]DNSRecord{&m.Answers, &m.Authority, &m.Additional} {
+		for j := binary.BigEndian.Uint16(data[6+2*i:]); j > 0; j-- {
+			var r DNSRecord
+			if r, off, ok = dnsRecord(data, off); !ok {
+				return m, false
+			}
+			*section = append(*section, r)
+		}
+	}
+	return m, true
+}
+
+// DNSTCPLength returns the length of the DNS message prefixed by its length over TCP at the start of data,
+// including its length, or -1 if it is not complete
+func DNSTCPLength(data []byte) int {
+	if len(data) < 2 {
+		return -1
+	}
+	n := 2 + int(binary.BigEndian.Uint16(data))
+	if n < 2+DNSHeaderLen || len(data) < n {
+		return -1
+	}
+	return n
+}
+
+// dnsRecord parses the resource record at off
+func dnsRecord(msg []byte, off int) (r DNSRecord, next int, ok bool) {
+	if r.Name, off, ok = dnsName(msg, off); !ok || len(msg)-off < 10 {
+		return r, 0, false
+	}
+	r.Type, r.Class = binary.BigEndian.Uint16(msg[off:]), binary.BigEndian.Uint16(msg[off+2:])
+	r.TTL = binary.BigEndian.Uint32(msg[off+4:])
+	size := int(binary.BigEndian.Uint16(msg[off+8:]))
+	off += 10
+	if len(msg)-off < size {
+		return r, 0, false
+	}
+	next = off + size
+	// the fixed fields preceding and following the names of the data
+	var before, names, after int
+	switch r.Type {
+	case DNSTypeCNAME, DNSTypeNS, DNSTypePTR, DNSTypeDNAME:
+		names = 1
+	case DNSTypeMX:
+		before, names = 2, 1
+	case DNSTypeSRV:
+		before, names = 6, 1
+	case DNSTypeSOA:
+		names, after = 2, 20
+	default:
+		r.Data = msg[off:next]
+		return r, next, true
+	}
+	if size < before {
+		return r, 0, false
+	}
+	r.Data = append(r.Data, msg[off:off+before]...)
+	off += before
+	for ; names > 0; names-- {
+		var name string
+		if name, off, ok = dnsName(msg, off); !ok || off > next {
+			return r, 0, false
+		}
+		r.Data = appendDNSName(r.Data, name)
+	}
+	if next-off != after {
+		return r, 0, false
+	}
+	r.Data = append(r.Data, msg[off:next]...)
+	return r, next, true
+}
+
+// dnsName returns the name at off, lower case and with a trailing dot, following the compression pointers, and
+// the position following it
+func dnsName(msg []byte, off int) (name string, next int, ok bool) {
+	var b strings.Builder
+	next = -1
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return
+		}
+		size := int(msg[off])
+		switch size & 0xc0 {
+		case 0x00:
+			if size == 0 {
+				if next < 0 {
+					next = off + 1
+				}
+				if b.Len() == 0 {
+					b.WriteByte('.')
+				}
+				return strings.ToLower(b.String()), next, true
+			}
+			if off+1+size > len(msg) {
+				return
+			}
+			if b.Len()+size > 255 {
+				return
+			}
+			b.Write(msg[off+1 : off+1+size])
+			b.WriteByte('.')
+			off += 1 + size
+		case 0xc0:
+			if off+2 > len(msg) || jumps > 64 {
+				return
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+			jumps++
+		default:
+			return
+		}
+	}
+}
+
+// appendDNSName appends the name, with its trailing dot, not compressed
+func appendDNSName(dst []byte, name string) []byte {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label != "" {
+			dst = append(append(dst, byte(len(label))), label...)
+		}
+	}
+	return append(dst, 0)
+}
+
+// AppendDNS appends the message to dst, its names are not compressed
+func AppendDNS(dst []byte, m DNSMessage) []byte {
+	flags := m.Flags&^0xf80f | uint16(m.Opcode&0x0f)<<11 | uint16(m.Rcode&0x0f)
+	if m.Response {
+		flags |= 0x8000
+	}
+	dst = append(dst, byte(m.ID>>8), byte(m.ID), byte(flags>>8), byte(flags))
+	for _, n := range []int{len(m.Questions), len(m.Answers), len(m.Authority), len(m.Additional)} {
+		dst = append(dst, byte(n>>8), byte(n))
+	}
+	for _, q := range m.Questions {
+		dst = appendDNSName(dst, q.Name)
+		dst = append(dst, byte(q.Type>>8), byte(q.Type), byte(q.Class>>8), byte(q.Class))
+	}
+	for _, section := range [][]DNSRecord{m.Answers, m.Authority, m.Additional} {
+		for _, r := range section {
+			dst = appendDNSName(dst, r.Name)
+			dst = append(dst, byte(r.Type>>8), byte(r.Type), byte(r.Class>>8), byte(r.Class))
+			dst = append(dst, byte(r.TTL>>24), byte(r.TTL>>16), byte(r.TTL>>8), byte(r.TTL))
+			dst = append(append(dst, byte(len(r.Data)>>8), byte(len(r.Data))), r.Data...)
+		}
+	}
+	return dst
+}
+
+// DNSDiff describes how the replayed response differs from the recorded one, by their response code and their
+// answers, regardless of the order and the TTL of the answers. it returns an empty string when they are the same.
+func DNSDiff(recorded, replayed DNSMessage) string {
+	if recorded.Rcode != replayed.Rcode {
+		return fmt.Sprintf("rcode %s, replayed %s", DNSRcodeName(recorded.Rcode), DNSRcodeName(replayed.Rcode))
+	}
+	a, b := dnsAnswers(recorded), dnsAnswers(replayed)
+	if strings.Join(a, "\n") != strings.Join(b, "\n") {
+		return fmt.Sprintf("answers [%s], replayed [%s]", strings.Join(a, ", "), strings.Join(b, ", "))
+	}
+	return ""
+}
+
+// dnsAnswers returns the sorted answers of the message, without their signatures
+func dnsAnswers(m DNSMessage) []string {
+	answers := make([]string, 0, len(m.Answers))
+	for _, r := range m.Answers {
+		if r.Type != DNSTypeRRSIG {
+			answers = append(answers, r.String())
+		}
+	}
+	sort.Strings(answers)
+	return answers
+}
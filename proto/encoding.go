@@ -0,0 +1,114 @@
+package proto
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// ErrContentTooLarge is returned when a body decodes to more bytes than allowed
+var ErrContentTooLarge = errors.New("decoded content too large")
+
+// zstdMaxWindow is the largest window of the zstd bodies decoded
+const zstdMaxWindow = 8 << 20
+
+var zstdEncoder struct {
+	sync.Once
+	*zstd.Encoder
+}
+
+// contentCodings returns the codings of a Content-Encoding header in the order they were applied
+func contentCodings(encoding string) (codings []string) {
+	for _, c := range strings.Split(encoding, ",") {
+		c = strings.ToLower(strings.TrimSpace(c))
+		if c != "" && c != "identity" {
+			codings = append(codings, c)
+		}
+	}
+	return
+}
+
+// DecodeContent returns the body decoded from the codings of its Content-Encoding header: gzip, deflate(zlib or
+// raw), br and zstd. max limits the size of the decoded body.
+func DecodeContent(encoding string, body []byte, max int) ([]byte, error) {
+	codings := contentCodings(encoding)
+	for i := len(codings) - 1; i >= 0; i-- {
+		var r io.Reader
+		var err error
+		switch codings[i] {
+		case "gzip", "x-gzip":
+			r, err = gzip.NewReader(bytes.NewReader(body))
+		case "deflate":
+			// the deflate coding is zlib, though some servers send raw deflate
+			if r, err = zlib.NewReader(bytes.NewReader(body)); err != nil {
+				r, err = flate.NewReader(bytes.NewReader(body)), nil
+			}
+		case "br":
+			r = brotli.NewReader(bytes.NewReader(body))
+		case "zstd":
+			// the body is streamed to be limited like the others, DecodeAll would inflate it whole. the window
+			// allocated from the frame header is limited to the 8MB of the http coding(RFC 9659)
+			var d *zstd.Decoder
+			d, err = zstd.NewReader(bytes.NewReader(body), zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(zstdMaxWindow))
+			if err == nil {
+				defer d.Close()
+				r = d
+			}
+		default:
+			return nil, fmt.Errorf("unsupported content encoding %q", codings[i])
+		}
+		if err != nil {
+			return nil, err
+		}
+		if body, err = ioutil.ReadAll(io.LimitReader(r, int64(max)+1)); err != nil {
+			return nil, err
+		}
+		if len(body) > max {
+			return nil, ErrContentTooLarge
+		}
+	}
+	return body, nil
+}
+
+// EncodeContent returns the body encoded with the codings of a Content-Encoding header, the ones supported by
+// DecodeContent
+func EncodeContent(encoding string, body []byte) ([]byte, error) {
+	for _, coding := range contentCodings(encoding) {
+		var buf bytes.Buffer
+		var w io.WriteCloser
+		switch coding {
+		case "gzip", "x-gzip":
+			w = gzip.NewWriter(&buf)
+		case "deflate":
+			w = zlib.NewWriter(&buf)
+		case "br":
+			w = brotli.NewWriter(&buf)
+		case "zstd":
+			zstdEncoder.Do(func() {
+				zstdEncoder.Encoder, _ = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+			})
+			body = zstdEncoder.EncodeAll(body, nil)
+			continue
+		default:
+			return nil, fmt.Errorf("unsupported content encoding %q", coding)
+		}
+		if _, err := w.Write(body); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		body = buf.Bytes()
+	}
+	return body, nil
+}
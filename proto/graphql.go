@@ -0,0 +1,220 @@
+package proto
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/url"
+	"strings"
+)
+
+// GraphQLOperation is the operation of a GraphQL request
+type GraphQLOperation struct {
+	Type   string   // query, mutation or subscription
+	Name   string   // empty for anonymous operations
+	Fields []string // the top-level fields of the operation, without their aliases
+}
+
+type graphQLRequest struct {
+	Query         string `json:"query"`
+	OperationName string `json:"operationName"`
+}
+
+// GraphQLOperations returns the operations of a GraphQL request: the POST requests with a JSON body, or a batch
+// of them, or with an application/graphql body, and the GET requests with a query param. a document holding
+// more than one operation runs the one named by operationName. it returns nil if the request is not a
+// GraphQL request, or if its body is chunked or encoded, see --http-decode-body.
+func GraphQLOperations(payload []byte) (ops []GraphQLOperation) {
+	var reqs []graphQLRequest
+	if bytes.Equal(Method(payload), []byte("GET")) {
+		query, _, _ := PathParam(payload, []byte("query"))
+		name, _, _ := PathParam(payload, []byte("operationName"))
+		req := graphQLRequest{}
+		req.Query, _ = url.QueryUnescape(string(query))
+		req.OperationName, _ = url.QueryUnescape(string(name))
+		reqs = append(reqs, req)
+	} else {
+		if len(Header(payload, []byte("Content-Encoding"))) > 0 || bytes.Contains(Header(payload, []byte("Transfer-Encoding")), []byte("chunked")) {
+			return nil
+		}
+		body := bytes.TrimSpace(Body(payload))
+		switch {
+		case bytes.HasPrefix(Header(payload, []byte("Content-Type")), []byte("application/graphql")):
+			reqs = append(reqs, graphQLRequest{Query: string(body)})
+		case len(body) > 0 && body[0] == '[':
+			if json.Unmarshal(body, &reqs) != nil {
+				return nil
+			}
+		case len(body) > 0 && body[0] == '{':
+			req := graphQLRequest{}
+			if json.Unmarshal(body, &req) != nil {
+				return nil
+			}
+			reqs = append(reqs, req)
+		}
+	}
+	for _, req := range reqs {
+		if op, ok := parseGraphQL(req.Query, req.OperationName); ok {
+			ops = append(ops, op)
+		}
+	}
+	return
+}
+
+// parseGraphQL returns the operation of the document named name, or its first operation if name is empty
+func parseGraphQL(doc, name string) (op GraphQLOperation, ok bool) {
+	lex := graphQLLexer{doc: doc}
+	for tok := lex.next(); tok != ""; tok = lex.next() {
+		var def GraphQLOperation
+		switch tok {
+		case "{":
+			def.Type = "query"
+		case "query", "mutation", "subscription":
+			def.Type = tok
+			// the name, variables and directives of the operation come before its selection set
+			tok = lex.next()
+			if isGraphQLName(tok) {
+				def.Name = tok
+				tok = lex.next()
+			}
+			for ; tok != "{" && tok != ""; tok = lex.next() {
+				if tok == "(" {
+					lex.skip("(", ")")
+				}
+			}
+		case "fragment":
+			for tok = lex.next(); tok != "{" && tok != ""; tok = lex.next() {
+			}
+			lex.skip("{", "}")
+			continue
+		default:
+			return
+		}
+		if tok != "{" {
+			return
+		}
+		def.Fields = lex.fields()
+		if name == "" || def.Name == name {
+			return def, true
+		}
+	}
+	return
+}
+
+type graphQLLexer struct {
+	doc string
+	pos int
+}
+
+// next returns the next token of the document, names, punctuators, or the first character of strings and
+// numbers. it returns an empty token at the end of the document
+func (l *graphQLLexer) next() string {
+	for l.pos < len(l.doc) {
+		c := l.doc[l.pos]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n' || c == ',':
+			l.pos++
+		case c == '#':
+			if nl := strings.IndexByte(l.doc[l.pos:], '\n'); nl != -1 {
+				l.pos += nl
+			} else {
+				l.pos = len(l.doc)
+			}
+		case c == '"':
+			l.skipString()
+			return `"`
+		case c == '.':
+			l.pos += 3
+			return "..."
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			start := l.pos
+			for l.pos < len(l.doc) && isGraphQLNameChar(l.doc[l.pos]) {
+				l.pos++
+			}
+			return l.doc[start:l.pos]
+		case c == '-' || c >= '0' && c <= '9':
+			start := l.pos
+			for l.pos++; l.pos < len(l.doc) && (isGraphQLNameChar(l.doc[l.pos]) || l.doc[l.pos] == '.' || l.doc[l.pos] == '+' || l.doc[l.pos] == '-'); l.pos++ {
+			}
+			return l.doc[start:l.pos]
+		default:
+			l.pos++
+			return l.doc[l.pos-1 : l.pos]
+		}
+	}
+	return ""
+}
+
+func (l *graphQLLexer) skipString() {
+	if strings.HasPrefix(l.doc[l.pos:], `"""`) {
+		if end := strings.Index(l.doc[l.pos+3:], `"""`); end != -1 {
+			l.pos += end + 6
+		} else {
+			l.pos = len(l.doc)
+		}
+		return
+	}
+	for l.pos++; l.pos < len(l.doc); l.pos++ {
+		switch l.doc[l.pos] {
+		case '\\':
+			l.pos++
+		case '"':
+			l.pos++
+			return
+		}
+	}
+}
+
+// skip skips the tokens up to the close token matching an open token already read
+func (l *graphQLLexer) skip(open, close string) {
+	for depth := 1; depth > 0; {
+		switch l.next() {
+		case open:
+			depth++
+		case close:
+			depth--
+		case "":
+			return
+		}
+	}
+}
+
+// fields returns the names of the fields of a selection set whose opening brace was read, nested selection
+// sets, arguments, directives and fragments are skipped
+func (l *graphQLLexer) fields() (fields []string) {
+	for tok := l.next(); tok != "}" && tok != ""; tok = l.next() {
+		switch {
+		case tok == "{":
+			l.skip("{", "}")
+		case tok == "(":
+			l.skip("(", ")")
+		case tok == "@":
+			l.next()
+		case tok == "...":
+			// a fragment spread, or an inline fragment with its type condition
+			switch l.next() {
+			case "on":
+				l.next()
+			case "{":
+				l.skip("{", "}")
+			case "@":
+				l.next()
+			}
+		case tok == ":":
+			// the previous name was an alias
+			if len(fields) > 0 {
+				fields = fields[:len(fields)-1]
+			}
+		case isGraphQLName(tok):
+			fields = append(fields, tok)
+		}
+	}
+	return
+}
+
+func isGraphQLName(tok string) bool {
+	return tok != "" && (tok[0] == '_' || tok[0] >= 'a' && tok[0] <= 'z' || tok[0] >= 'A' && tok[0] <= 'Z')
+}
+
+func isGraphQLNameChar(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
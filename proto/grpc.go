@@ -0,0 +1,37 @@
+package proto
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// GRPCPrefixLen is the length of the prefix of gRPC messages: a compressed flag and the length of the message
+const GRPCPrefixLen = 5
+
+// IsGRPC reports whether the content type of the request or the response is gRPC
+func IsGRPC(payload []byte) bool {
+	return bytes.HasPrefix(Header(payload, []byte("Content-Type")), []byte("application/grpc"))
+}
+
+// GRPCMethod returns the full method of a gRPC request, e.g: /users.v1.UserService/Get,
+// or nil if the payload is not a gRPC request
+func GRPCMethod(payload []byte) []byte {
+	if !HasRequestTitle(payload) || !IsGRPC(payload) {
+		return nil
+	}
+	return Path(payload)
+}
+
+// GRPCMessages returns the lengths of the length-prefixed messages of the body of a gRPC call, usually
+// protobuf encoded, ok is false if the last message is incomplete.
+func GRPCMessages(body []byte) (lengths []int, ok bool) {
+	for len(body) >= GRPCPrefixLen {
+		n := int(binary.BigEndian.Uint32(body[1:]))
+		if len(body)-GRPCPrefixLen < n {
+			return lengths, false
+		}
+		lengths = append(lengths, n)
+		body = body[GRPCPrefixLen+n:]
+	}
+	return lengths, len(body) == 0
+}
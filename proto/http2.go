@@ -0,0 +1,256 @@
+package proto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/http2/hpack"
+)
+
+// HTTP2Preface is sent by HTTP/2 clients when they open a connection, before their first frame
+var HTTP2Preface = []byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")
+
+// HTTP2FrameHeaderLen is the length of the header of HTTP/2 frames
+const HTTP2FrameHeaderLen = 9
+
+// HTTP/2 frame types(https://httpwg.org/specs/rfc7540.html#FrameTypes)
+const (
+	HTTP2FrameData uint8 = iota
+	HTTP2FrameHeaders
+	HTTP2FramePriority
+	HTTP2FrameRSTStream
+	HTTP2FrameSettings
+	HTTP2FramePushPromise
+	HTTP2FramePing
+	HTTP2FrameGoAway
+	HTTP2FrameWindowUpdate
+	HTTP2FrameContinuation
+)
+
+// HTTP/2 frame flags
+const (
+	HTTP2FlagEndStream  uint8 = 0x1 // DATA and HEADERS
+	HTTP2FlagAck        uint8 = 0x1 // SETTINGS and PING
+	HTTP2FlagEndHeaders uint8 = 0x4
+	HTTP2FlagPadded     uint8 = 0x8
+	HTTP2FlagPriority   uint8 = 0x20
+)
+
+// HTTP/2 settings, see https://httpwg.org/specs/rfc7540.html#SettingValues
+const (
+	HTTP2SettingHeaderTableSize      uint16 = 0x1
+	HTTP2SettingEnablePush           uint16 = 0x2
+	HTTP2SettingMaxConcurrentStreams uint16 = 0x3
+	HTTP2SettingInitialWindowSize    uint16 = 0x4
+	HTTP2SettingMaxFrameSize         uint16 = 0x5
+)
+
+// HTTP2ErrCodeCancel is the error code of the RST_STREAM frames of the streams no longer needed
+const HTTP2ErrCodeCancel uint32 = 0x8
+
+// HTTP2Frame is a frame of an HTTP/2 connection
+type HTTP2Frame struct {
+	Type    uint8
+	Flags   uint8
+	Stream  uint32
+	Payload []byte
+}
+
+// ParseHTTP2Frame returns the frame at the start of data and its length, n is 0 if the frame is not complete
+func ParseHTTP2Frame(data []byte) (f HTTP2Frame, n int) {
+	if len(data) < HTTP2FrameHeaderLen {
+		return
+	}
+	length := int(data[0])<<16 | int(data[1])<<8 | int(data[2])
+	if len(data) < HTTP2FrameHeaderLen+length {
+		return
+	}
+	f.Type = data[3]
+	f.Flags = data[4]
+	f.Stream = binary.BigEndian.Uint32(data[5:]) & (1<<31 - 1)
+	f.Payload = data[HTTP2FrameHeaderLen : HTTP2FrameHeaderLen+length]
+	return f, HTTP2FrameHeaderLen + length
+}
+
+// AppendHTTP2Frame appends the frame to dst and returns the extended buffer
+func AppendHTTP2Frame(dst []byte, f HTTP2Frame) []byte {
+	length := len(f.Payload)
+	dst = append(dst, byte(length>>16), byte(length>>8), byte(length), f.Type, f.Flags)
+	dst = append(dst, byte(f.Stream>>24), byte(f.Stream>>16), byte(f.Stream>>8), byte(f.Stream))
+	return append(dst, f.Payload...)
+}
+
+// HTTP2FramesLength returns the length of the complete frames at the start of data, or -1 if there is none.
+// the client preface counts as a frame.
+func HTTP2FramesLength(data []byte) int {
+	if bytes.HasPrefix(data, HTTP2Preface) {
+		return len(HTTP2Preface)
+	}
+	var length int
+	for {
+		_, n := ParseHTTP2Frame(data[length:])
+		if n == 0 {
+			break
+		}
+		length += n
+	}
+	if length == 0 {
+		return -1
+	}
+	return length
+}
+
+// ErrHTTP2Frame is returned for frames too short for their padding and priority fields
+var ErrHTTP2Frame = errors.New("invalid http2 frame")
+
+// Fragment returns the data of DATA frames, and the header block fragment of HEADERS, PUSH_PROMISE and
+// CONTINUATION frames, without their padding and priority fields
+func (f *HTTP2Frame) Fragment() ([]byte, error) {
+	p := f.Payload
+	var pad int
+	if f.Flags&HTTP2FlagPadded != 0 && (f.Type == HTTP2FrameData || f.Type == HTTP2FrameHeaders || f.Type == HTTP2FramePushPromise) {
+		if len(p) < 1 {
+			return nil, ErrHTTP2Frame
+		}
+		pad = int(p[0])
+		p = p[1:]
+	}
+	switch {
+	case f.Type == HTTP2FrameHeaders && f.Flags&HTTP2FlagPriority != 0:
+		if len(p) < 5 {
+			return nil, ErrHTTP2Frame
+		}
+		p = p[5:]
+	case f.Type == HTTP2FramePushPromise:
+		// the promised stream
+		if len(p) < 4 {
+			return nil, ErrHTTP2Frame
+		}
+		p = p[4:]
+	}
+	if pad > len(p) {
+		return nil, ErrHTTP2Frame
+	}
+	return p[:len(p)-pad], nil
+}
+
+// HTTP2Message returns the HTTP/1.1 message of the decoded header fields and the body of an HTTP/2 stream:
+// a request if the fields hold a :method, a response if they hold a :status, nil otherwise. trailers are
+// passed as fields following the headers. the :authority of requests is their Host header, the cookie
+// headers are merged, and a Content-Length header is added to messages with a body.
+func HTTP2Message(fields []hpack.HeaderField, body []byte) []byte {
+	var method, path, authority, status string
+	var cookies []string
+	var host, contentLength bool
+	var headers bytes.Buffer
+	for _, f := range fields {
+		switch f.Name {
+		case ":method":
+			method = f.Value
+		case ":path":
+			path = f.Value
+		case ":authority":
+			authority = f.Value
+		case ":status":
+			status = f.Value
+		case "cookie":
+			cookies = append(cookies, f.Value)
+		default:
+			if strings.HasPrefix(f.Name, ":") {
+				continue
+			}
+			host = host || f.Name == "host"
+			contentLength = contentLength || f.Name == "content-length"
+			headers.WriteString(textproto.CanonicalMIMEHeaderKey(f.Name) + ": " + f.Value + "\r\n")
+		}
+	}
+	var msg bytes.Buffer
+	switch {
+	case method != "":
+		if method == http.MethodConnect {
+			path = authority
+		}
+		msg.WriteString(method + " " + path + " HTTP/1.1\r\n")
+		if !host && authority != "" {
+			msg.WriteString("Host: " + authority + "\r\n")
+		}
+	case status != "":
+		code, _ := strconv.Atoi(status)
+		msg.WriteString("HTTP/1.1 " + status + " " + http.StatusText(code) + "\r\n")
+	default:
+		return nil
+	}
+	msg.Write(headers.Bytes())
+	if len(cookies) > 0 {
+		msg.WriteString("Cookie: " + strings.Join(cookies, "; ") + "\r\n")
+	}
+	if !contentLength && len(body) > 0 {
+		msg.WriteString("Content-Length: " + strconv.Itoa(len(body)) + "\r\n")
+	}
+	msg.WriteString("\r\n")
+	msg.Write(body)
+	return msg.Bytes()
+}
+
+// http2Hop are the connection-specific headers HTTP/2 forbids
+var http2Hop = map[string]bool{
+	"connection":        true,
+	"keep-alive":        true,
+	"proxy-connection":  true,
+	"transfer-encoding": true,
+	"upgrade":           true,
+	"host":              true,
+}
+
+// HTTP2Request returns the header fields and the body of the HTTP/2 request of an HTTP/1 request payload,
+// the connection-specific headers are left out and chunked bodies are decoded. gRPC requests get the
+// "te: trailers" header.
+func HTTP2Request(payload []byte, scheme string) (fields []hpack.HeaderField, body []byte, err error) {
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(payload)))
+	if err != nil {
+		return nil, nil, err
+	}
+	if body, err = ioutil.ReadAll(req.Body); err != nil {
+		return nil, nil, err
+	}
+	fields = append(fields, hpack.HeaderField{Name: ":method", Value: req.Method})
+	if req.Method != http.MethodConnect {
+		fields = append(fields,
+			hpack.HeaderField{Name: ":scheme", Value: scheme},
+			hpack.HeaderField{Name: ":path", Value: req.RequestURI})
+	}
+	fields = append(fields, hpack.HeaderField{Name: ":authority", Value: req.Host})
+	names := make([]string, 0, len(req.Header))
+	for name := range req.Header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		lower := strings.ToLower(name)
+		if http2Hop[lower] {
+			continue
+		}
+		for _, v := range req.Header[name] {
+			if lower == "te" && v != "trailers" {
+				continue
+			}
+			fields = append(fields, hpack.HeaderField{Name: lower, Value: v})
+		}
+	}
+	// gRPC servers require it to detect incompatible proxies
+	if strings.HasPrefix(req.Header.Get("Content-Type"), "application/grpc") && req.Header.Get("Te") != "trailers" {
+		fields = append(fields, hpack.HeaderField{Name: "te", Value: "trailers"})
+	}
+	if len(req.TransferEncoding) > 0 && req.Header.Get("Content-Length") == "" {
+		fields = append(fields, hpack.HeaderField{Name: "content-length", Value: strconv.Itoa(len(body))})
+	}
+	return
+}
@@ -0,0 +1,451 @@
+package proto
+
+import (
+	"errors"
+
+	"golang.org/x/net/http2/hpack"
+)
+
+// HTTP/3 frame types(https://www.rfc-editor.org/rfc/rfc9114.html#name-frame-definitions)
+const (
+	HTTP3FrameData     uint64 = 0x0
+	HTTP3FrameHeaders  uint64 = 0x1
+	HTTP3FrameSettings uint64 = 0x4
+)
+
+// HTTP/3 unidirectional stream types
+const (
+	HTTP3StreamControl      uint64 = 0x0
+	HTTP3StreamPush         uint64 = 0x1
+	HTTP3StreamQPACKEncoder uint64 = 0x2
+	HTTP3StreamQPACKDecoder uint64 = 0x3
+)
+
+// HTTP3SettingQPACKMaxTableCapacity is the setting of the capacity of the QPACK dynamic table of the decoder
+const HTTP3SettingQPACKMaxTableCapacity uint64 = 0x1
+
+// ParseHTTP3Frame returns the frame at the start of data and its length, n is 0 if the frame is not complete
+func ParseHTTP3Frame(data []byte) (typ uint64, payload []byte, n int) {
+	typ, i := QUICVarint(data)
+	if i == 0 {
+		return
+	}
+	length, j := QUICVarint(data[i:])
+	if j == 0 || uint64(len(data)-i-j) < length {
+		return 0, nil, 0
+	}
+	n = i + j + int(length)
+	return typ, data[i+j : n], n
+}
+
+// AppendHTTP3Frame appends a frame to dst and returns the extended buffer
+func AppendHTTP3Frame(dst []byte, typ uint64, payload []byte) []byte {
+	dst = AppendQUICVarint(dst, typ)
+	dst = AppendQUICVarint(dst, uint64(len(payload)))
+	return append(dst, payload...)
+}
+
+// QPACK errors
+var (
+	// ErrQPACKIncomplete is returned for instructions that are not complete
+	ErrQPACKIncomplete = errors.New("incomplete qpack instruction")
+	// ErrQPACKBlocked is returned for field sections referencing entries not inserted yet
+	ErrQPACKBlocked = errors.New("qpack field section blocked")
+	// ErrQPACKInvalid is returned for invalid field sections and instructions
+	ErrQPACKInvalid = errors.New("invalid qpack encoding")
+)
+
+// QPACKDecoder decodes the field sections of HTTP/3 streams(https://www.rfc-editor.org/rfc/rfc9204.html),
+// with the dynamic table maintained by the instructions of the encoder stream of the peer.
+type QPACKDecoder struct {
+	MaxCapacity uint64 // of the dynamic table, set by the decoder in its SETTINGS
+	capacity    uint64
+	size        uint64
+	inserts     uint64 // number of insertions in the dynamic table
+	entries     []hpack.HeaderField
+	instr       []byte // instructions of the encoder stream not complete yet
+}
+
+// Encoder handles data of the encoder stream, the instructions are buffered until they are complete
+func (d *QPACKDecoder) Encoder(data []byte) error {
+	d.instr = append(d.instr, data...)
+	for len(d.instr) > 0 {
+		n, err := d.instruction(d.instr)
+		if err == ErrQPACKIncomplete {
+			break
+		}
+		if err != nil {
+			d.instr = nil
+			return err
+		}
+		d.instr = d.instr[n:]
+	}
+	if len(d.instr) == 0 {
+		d.instr = nil
+	}
+	return nil
+}
+
+// instruction applies the encoder instruction at the start of p, and returns its length
+func (d *QPACKDecoder) instruction(p []byte) (n int, err error) {
+	var name hpack.HeaderField
+	switch {
+	case p[0]&0x80 != 0:
+		// insert with name reference
+		index, i, err := qpackInt(p, 6)
+		if err != nil {
+			return 0, err
+		}
+		if p[0]&0x40 != 0 {
+			if index >= uint64(len(qpackStatic)) {
+				return 0, ErrQPACKInvalid
+			}
+			name = qpackStatic[index]
+		} else if index >= d.inserts {
+			return 0, ErrQPACKInvalid
+		} else if name, err = d.entry(d.inserts - 1 - index); err != nil {
+			return 0, err
+		}
+		value, j, err := qpackString(p[i:], 7)
+		if err != nil {
+			return 0, err
+		}
+		return i + j, d.insert(name.Name, value)
+	case p[0]&0x40 != 0:
+		// insert with literal name
+		name, i, err := qpackString(p, 5)
+		if err != nil {
+			return 0, err
+		}
+		value, j, err := qpackString(p[i:], 7)
+		if err != nil {
+			return 0, err
+		}
+		return i + j, d.insert(name, value)
+	case p[0]&0x20 != 0:
+		capacity, i, err := qpackInt(p, 5)
+		if err != nil {
+			return 0, err
+		}
+		if d.MaxCapacity != 0 && capacity > d.MaxCapacity {
+			return 0, ErrQPACKInvalid
+		}
+		d.capacity = capacity
+		d.evict(0)
+		return i, nil
+	}
+	// duplicate
+	index, i, err := qpackInt(p, 5)
+	if err != nil {
+		return 0, err
+	}
+	if index >= d.inserts {
+		return 0, ErrQPACKInvalid
+	}
+	if name, err = d.entry(d.inserts - 1 - index); err != nil {
+		return 0, err
+	}
+	return i, d.insert(name.Name, name.Value)
+}
+
+// entry returns the entry of the dynamic table at the absolute index
+func (d *QPACKDecoder) entry(index uint64) (hpack.HeaderField, error) {
+	evicted := d.inserts - uint64(len(d.entries))
+	if index < evicted || index >= d.inserts {
+		return hpack.HeaderField{}, ErrQPACKInvalid
+	}
+	return d.entries[index-evicted], nil
+}
+
+func (d *QPACKDecoder) insert(name, value string) error {
+	size := uint64(len(name) + len(value) + 32)
+	if size > d.capacity {
+		return ErrQPACKInvalid
+	}
+	d.evict(size)
+	d.entries = append(d.entries, hpack.HeaderField{Name: name, Value: value})
+	d.size += size
+	d.inserts++
+	return nil
+}
+
+// evict evicts the oldest entries until there is room for size bytes
+func (d *QPACKDecoder) evict(size uint64) {
+	for len(d.entries) > 0 && d.size+size > d.capacity {
+		d.size -= uint64(len(d.entries[0].Name) + len(d.entries[0].Value) + 32)
+		d.entries = d.entries[1:]
+	}
+}
+
+// Decode decodes a field section, it returns ErrQPACKBlocked if it references entries of the dynamic table
+// whose insertion was not received yet.
+func (d *QPACKDecoder) Decode(p []byte) (fields []hpack.HeaderField, err error) {
+	encoded, i, err := qpackInt(p, 8)
+	if err != nil {
+		return nil, err
+	}
+	var required uint64
+	if encoded != 0 {
+		maxCapacity := d.MaxCapacity
+		if maxCapacity == 0 {
+			// the SETTINGS were not captured
+			maxCapacity = 1 << 16
+		}
+		full := 2 * (maxCapacity / 32)
+		if encoded > full {
+			return nil, ErrQPACKInvalid
+		}
+		maxValue := d.inserts + maxCapacity/32
+		required = maxValue/full*full + encoded - 1
+		if required > maxValue {
+			if required <= full {
+				return nil, ErrQPACKInvalid
+			}
+			required -= full
+		}
+		if required == 0 {
+			return nil, ErrQPACKInvalid
+		}
+	}
+	if required > d.inserts {
+		return nil, ErrQPACKBlocked
+	}
+	p = p[i:]
+	if len(p) == 0 {
+		return nil, ErrQPACKIncomplete
+	}
+	delta, i, err := qpackInt(p, 7)
+	if err != nil {
+		return nil, err
+	}
+	base := required + delta
+	if p[0]&0x80 != 0 {
+		if delta >= required {
+			return nil, ErrQPACKInvalid
+		}
+		base = required - delta - 1
+	}
+	for p = p[i:]; len(p) > 0; p = p[i:] {
+		var f hpack.HeaderField
+		switch {
+		case p[0]&0x80 != 0:
+			// indexed field line
+			var index uint64
+			if index, i, err = qpackInt(p, 6); err != nil {
+				return nil, err
+			}
+			f, err = d.field(p[0]&0x40 != 0, base, index, false)
+		case p[0]&0x40 != 0:
+			// literal field line with name reference
+			var index uint64
+			if index, i, err = qpackInt(p, 4); err != nil {
+				return nil, err
+			}
+			if f, err = d.field(p[0]&0x10 != 0, base, index, false); err != nil {
+				return nil, err
+			}
+			var j int
+			f.Value, j, err = qpackString(p[i:], 7)
+			i += j
+		case p[0]&0x20 != 0:
+			// literal field line with literal name
+			if f.Name, i, err = qpackString(p, 3); err != nil {
+				return nil, err
+			}
+			var j int
+			f.Value, j, err = qpackString(p[i:], 7)
+			i += j
+		case p[0]&0x10 != 0:
+			// indexed field line with post-base index
+			var index uint64
+			if index, i, err = qpackInt(p, 4); err != nil {
+				return nil, err
+			}
+			f, err = d.field(false, base, index, true)
+		default:
+			// literal field line with post-base name reference
+			var index uint64
+			if index, i, err = qpackInt(p, 3); err != nil {
+				return nil, err
+			}
+			if f, err = d.field(false, base, index, true); err != nil {
+				return nil, err
+			}
+			var j int
+			f.Value, j, err = qpackString(p[i:], 7)
+			i += j
+		}
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+// field returns the entry of the static table, or of the dynamic table at the index relative to base
+func (d *QPACKDecoder) field(static bool, base, index uint64, postBase bool) (hpack.HeaderField, error) {
+	switch {
+	case static:
+		if index >= uint64(len(qpackStatic)) {
+			return hpack.HeaderField{}, ErrQPACKInvalid
+		}
+		return qpackStatic[index], nil
+	case postBase:
+		return d.entry(base + index)
+	case index >= base:
+		return hpack.HeaderField{}, ErrQPACKInvalid
+	}
+	return d.entry(base - 1 - index)
+}
+
+// qpackInt returns the integer with a prefix of n bits at the start of p, and its length
+func qpackInt(p []byte, n uint) (v uint64, i int, err error) {
+	if len(p) == 0 {
+		return 0, 0, ErrQPACKIncomplete
+	}
+	mask := uint64(1)<<n - 1
+	v = uint64(p[0]) & mask
+	i = 1
+	if v < mask {
+		return
+	}
+	for shift := uint(0); ; shift += 7 {
+		if i >= len(p) {
+			return 0, 0, ErrQPACKIncomplete
+		}
+		if shift > 56 {
+			return 0, 0, ErrQPACKInvalid
+		}
+		b := p[i]
+		i++
+		v += uint64(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return
+		}
+	}
+}
+
+// qpackString returns the string literal whose length has a prefix of n bits at the start of p, the Huffman
+// flag being the bit preceding the prefix, and its length
+func qpackString(p []byte, n uint) (s string, i int, err error) {
+	length, i, err := qpackInt(p, n)
+	if err != nil {
+		return "", 0, err
+	}
+	if uint64(len(p)-i) < length {
+		return "", 0, ErrQPACKIncomplete
+	}
+	b := p[i : i+int(length)]
+	if p[0]&(1<<n) != 0 {
+		if s, err = hpack.HuffmanDecodeToString(b); err != nil {
+			return "", 0, ErrQPACKInvalid
+		}
+	} else {
+		s = string(b)
+	}
+	return s, i + int(length), nil
+}
+
+// qpackStatic is the static table of QPACK(https://www.rfc-editor.org/rfc/rfc9204.html#name-static-table-2)
+var qpackStatic = []hpack.HeaderField{
+	{Name: ":authority"},
+	{Name: ":path", Value: "/"},
+	{Name: "age", Value: "0"},
+	{Name: "content-disposition"},
+	{Name: "content-length", Value: "0"},
+	{Name: "cookie"},
+	{Name: "date"},
+	{Name: "etag"},
+	{Name: "if-modified-since"},
+	{Name: "if-none-match"},
+	{Name: "last-modified"},
+	{Name: "link"},
+	{Name: "location"},
+	{Name: "referer"},
+	{Name: "set-cookie"},
+	{Name: ":method", Value: "CONNECT"},
+	{Name: ":method", Value: "DELETE"},
+	{Name: ":method", Value: "GET"},
+	{Name: ":method", Value: "HEAD"},
+	{Name: ":method", Value: "OPTIONS"},
+	{Name: ":method", Value: "POST"},
+	{Name: ":method", Value: "PUT"},
+	{Name: ":scheme", Value: "http"},
+	{Name: ":scheme", Value: "https"},
+	{Name: ":status", Value: "103"},
+	{Name: ":status", Value: "200"},
+	{Name: ":status", Value: "304"},
+	{Name: ":status", Value: "404"},
+	{Name: ":status", Value: "503"},
+	{Name: "accept", Value: "*/*"},
+	{Name: "accept", Value: "application/dns-message"},
+	{Name: "accept-encoding", Value: "gzip, deflate, br"},
+	{Name: "accept-ranges", Value: "bytes"},
+	{Name: "access-control-allow-headers", Value: "cache-control"},
+	{Name: "access-control-allow-headers", Value: "content-type"},
+	{Name: "access-control-allow-origin", Value: "*"},
+	{Name: "cache-control", Value: "max-age=0"},
+	{Name: "cache-control", Value: "max-age=2592000"},
+	{Name: "cache-control", Value: "max-age=604800"},
+	{Name: "cache-control", Value: "no-cache"},
+	{Name: "cache-control", Value: "no-store"},
+	{Name: "cache-control", Value: "public, max-age=31536000"},
+	{Name: "content-encoding", Value: "br"},
+	{Name: "content-encoding", Value: "gzip"},
+	{Name: "content-type", Value: "application/dns-message"},
+	{Name: "content-type", Value: "application/javascript"},
+	{Name: "content-type", Value: "application/json"},
+	{Name: "content-type", Value: "application/x-www-form-urlencoded"},
+	{Name: "content-type", Value: "image/gif"},
+	{Name: "content-type", Value: "image/jpeg"},
+	{Name: "content-type", Value: "image/png"},
+	{Name: "content-type", Value: "text/css"},
+	{Name: "content-type", Value: "text/html; charset=utf-8"},
+	{Name: "content-type", Value: "text/plain"},
+	{Name: "content-type", Value: "text/plain;charset=utf-8"},
+	{Name: "range", Value: "bytes=0-"},
+	{Name: "strict-transport-security", Value: "max-age=31536000"},
+	{Name: "strict-transport-security", Value: "max-age=31536000; includesubdomains"},
+	{Name: "strict-transport-security", Value: "max-age=31536000; includesubdomains; preload"},
+	{Name: "vary", Value: "accept-encoding"},
+	{Name: "vary", Value: "origin"},
+	{Name: "x-content-type-options", Value: "nosniff"},
+	{Name: "x-xss-protection", Value: "1; mode=block"},
+	{Name: ":status", Value: "100"},
+	{Name: ":status", Value: "204"},
+	{Name: ":status", Value: "206"},
+	{Name: ":status", Value: "302"},
+	{Name: ":status", Value: "400"},
+	{Name: ":status", Value: "403"},
+	{Name: ":status", Value: "421"},
+	{Name: ":status", Value: "425"},
+	{Name: ":status", Value: "500"},
+	{Name: "accept-language"},
+	{Name: "access-control-allow-credentials", Value: "FALSE"},
+	{Name: "access-control-allow-credentials", Value: "TRUE"},
+	{Name: "access-control-allow-headers", Value: "*"},
+	{Name: "access-control-allow-methods", Value: "get"},
+	{Name: "access-control-allow-methods", Value: "get, post, options"},
+	{Name: "access-control-allow-methods", Value: "options"},
+	{Name: "access-control-expose-headers", Value: "content-length"},
+	{Name: "access-control-request-headers", Value: "content-type"},
+	{Name: "access-control-request-method", Value: "get"},
+	{Name: "access-control-request-method", Value: "post"},
+	{Name: "alt-svc", Value: "clear"},
+	{Name: "authorization"},
+	{Name: "content-security-policy", Value: "script-src 'none'; object-src 'none'; base-uri 'none'"},
+	{Name: "early-data", Value: "1"},
+	{Name: "expect-ct"},
+	{Name: "forwarded"},
+	{Name: "if-range"},
+	{Name: "origin"},
+	{Name: "purpose", Value: "prefetch"},
+	{Name: "server"},
+	{Name: "timing-allow-origin", Value: "*"},
+	{Name: "upgrade-insecure-requests", Value: "1"},
+	{Name: "user-agent"},
+	{Name: "x-forwarded-for"},
+	{Name: "x-frame-options", Value: "deny"},
+	{Name: "x-frame-options", Value: "sameorigin"},
+}
@@ -0,0 +1,762 @@
+package proto
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4"
+)
+
+// Kafka API keys(https://kafka.apache.org/protocol#protocol_api_keys)
+const (
+	KafkaProduce     int16 = 0
+	KafkaFetch       int16 = 1
+	KafkaListOffsets int16 = 2
+	KafkaMetadata    int16 = 3
+	KafkaAPIVersions int16 = 18
+)
+
+// kafkaAPIs are the names of the Kafka APIs and the first of their flexible versions, whose requests have the
+// header v2 with tagged fields, -1 when the API has none
+var kafkaAPIs = [...]struct {
+	name     string
+	flexible int16
+}{
+	{"Produce", 9}, {"Fetch", 12}, {"ListOffsets", 6}, {"Metadata", 9}, {"LeaderAndIsr", 4}, {"StopReplica", 2},
+	{"UpdateMetadata", 6}, {"ControlledShutdown", 3}, {"OffsetCommit", 8}, {"OffsetFetch", 6},
+	{"FindCoordinator", 3}, {"JoinGroup", 6}, {"Heartbeat", 4}, {"LeaveGroup", 4}, {"SyncGroup", 4},
+	{"DescribeGroups", 5}, {"ListGroups", 3}, {"SaslHandshake", -1}, {"ApiVersions", 3}, {"CreateTopics", 5},
+	{"DeleteTopics", 4}, {"DeleteRecords", 2}, {"InitProducerId", 2}, {"OffsetForLeaderEpoch", 4},
+	{"AddPartitionsToTxn", 3}, {"AddOffsetsToTxn", 3}, {"EndTxn", 3}, {"WriteTxnMarkers", 1},
+	{"TxnOffsetCommit", 3}, {"DescribeAcls", 2}, {"CreateAcls", 2}, {"DeleteAcls", 2}, {"DescribeConfigs", 4},
+	{"AlterConfigs", 2}, {"AlterReplicaLogDirs", 2}, {"DescribeLogDirs", 2}, {"SaslAuthenticate", 2},
+	{"CreatePartitions", 2}, {"CreateDelegationToken", 2}, {"RenewDelegationToken", 2},
+	{"ExpireDelegationToken", 2}, {"DescribeDelegationToken", 2}, {"DeleteGroups", 2}, {"ElectLeaders", 2},
+	{"IncrementalAlterConfigs", 1}, {"AlterPartitionReassignments", 0}, {"ListPartitionReassignments", 0},
+	{"OffsetDelete", -1},
+}
+
+// KafkaMaxMessage is the maximum size of the Kafka messages and of the records they decompress to
+const KafkaMaxMessage = 100 << 20
+
+// KafkaAPIName returns the name of the API key, or its number if it is unknown
+func KafkaAPIName(key int16) string {
+	if key >= 0 && int(key) < len(kafkaAPIs) {
+		return kafkaAPIs[key].name
+	}
+	return fmt.Sprint(key)
+}
+
+// KafkaAPIKey returns the key of the API with the name, matched case insensitively
+func KafkaAPIKey(name string) (int16, bool) {
+	for key, api := range kafkaAPIs {
+		if strings.EqualFold(api.name, name) {
+			return int16(key), true
+		}
+	}
+	return 0, false
+}
+
+// KafkaFlexible tells if the version of the API has the flexible encoding, with compact strings and arrays and
+// tagged fields
+func KafkaFlexible(key, version int16) bool {
+	if key < 0 || int(key) >= len(kafkaAPIs) {
+		return false
+	}
+	f := kafkaAPIs[key].flexible
+	return f >= 0 && version >= f
+}
+
+// KafkaMessageLength returns the length of the request or response at the start of data with its size prefix,
+// or -1 if it is not complete or too large
+func KafkaMessageLength(data []byte) int {
+	if len(data) < 4 {
+		return -1
+	}
+	n := int(int32(binary.BigEndian.Uint32(data)))
+	if n < 0 || n > KafkaMaxMessage || len(data)-4 < n {
+		return -1
+	}
+	return 4 + n
+}
+
+// KafkaRequest is a Kafka request, without its size
+type KafkaRequest struct {
+	APIKey        int16
+	APIVersion    int16
+	CorrelationID int32
+	ClientID      string
+	Body          []byte // following the header and its tagged fields
+}
+
+// ParseKafkaRequest parses the request in data, with its size prefix. ok is false if data doesn't hold a request
+// of a known API whose client id is valid.
+func ParseKafkaRequest(data []byte) (r KafkaRequest, ok bool) {
+	if KafkaMessageLength(data) != len(data) || len(data) < 14 {
+		return
+	}
+	k := kafkaReader{data: data[4:]}
+	r.APIKey, r.APIVersion, r.CorrelationID = k.int16(), k.int16(), k.int32()
+	if r.APIKey < 0 || int(r.APIKey) >= len(kafkaAPIs) || r.APIVersion < 0 || r.APIVersion > 20 {
+		return
+	}
+	r.ClientID = k.string(false)
+	if KafkaFlexible(r.APIKey, r.APIVersion) {
+		k.tags()
+	}
+	r.Body = k.data
+	return r, !k.err
+}
+
+// IsKafkaRequest tells if data starts with the header of a Kafka request, data may hold a part of the request only
+func IsKafkaRequest(data []byte) bool {
+	if len(data) < 14 {
+		return false
+	}
+	n := int32(binary.BigEndian.Uint32(data))
+	key, version := int16(binary.BigEndian.Uint16(data[4:])), int16(binary.BigEndian.Uint16(data[6:]))
+	client := int16(binary.BigEndian.Uint16(data[12:]))
+	return n >= 10 && n <= KafkaMaxMessage && key >= 0 && int(key) < len(kafkaAPIs) && version >= 0 && version <= 20 &&
+		client >= -1 && int32(client) <= n-10
+}
+
+// KafkaResponseCorrelation returns the correlation id of the response in data, with its size prefix
+func KafkaResponseCorrelation(data []byte) (id int32, ok bool) {
+	if len(data) < 8 {
+		return
+	}
+	return int32(binary.BigEndian.Uint32(data[4:])), true
+}
+
+// KafkaProduceRequest is the body of a Produce request, up to the version 12
+type KafkaProduceRequest struct {
+	TransactionalID string
+	Acks            int16
+	Timeout         int32
+	Topics          []KafkaProduceTopic
+}
+
+// KafkaProduceTopic holds the records produced to the partitions of a topic
+type KafkaProduceTopic struct {
+	Name       string
+	Partitions []KafkaProducePartition
+}
+
+// KafkaProducePartition holds the record batches produced to a partition
+type KafkaProducePartition struct {
+	Index   int32
+	Records []byte
+}
+
+// ParseKafkaProduce parses the body of a Produce request
+func ParseKafkaProduce(r KafkaRequest) (p KafkaProduceRequest, ok bool) {
+	if r.APIKey != KafkaProduce || r.APIVersion > 12 {
+		return
+	}
+	flexible := KafkaFlexible(r.APIKey, r.APIVersion)
+	k := kafkaReader{data: r.Body}
+	if r.APIVersion >= 3 {
+		p.TransactionalID = k.string(flexible)
+	}
+	p.Acks, p.Timeout = k.int16(), k.int32()
+	topics := k.array(flexible)
+	for i := 0; i < topics && !k.err; i++ {
+		t := KafkaProduceTopic{Name: k.string(flexible)}
+		partitions := k.array(flexible)
+		for j := 0; j < partitions && !k.err; j++ {
+			t.Partitions = append(t.Partitions, KafkaProducePartition{Index: k.int32(), Records: k.bytes(flexible)})
+			if flexible {
+				k.tags()
+			}
+		}
+		if flexible {
+			k.tags()
+		}
+		p.Topics = append(p.Topics, t)
+	}
+	if flexible {
+		k.tags()
+	}
+	return p, !k.err
+}
+
+// AppendKafkaProduce appends the Produce request to dst, with its size prefix
+func AppendKafkaProduce(dst []byte, r KafkaRequest, p KafkaProduceRequest) []byte {
+	r.APIKey = KafkaProduce
+	flexible := KafkaFlexible(r.APIKey, r.APIVersion)
+	var k kafkaWriter
+	if r.APIVersion >= 3 && p.TransactionalID == "" {
+		// the producers outside transactions have a null id
+		if flexible {
+			k.uvarint(0)
+		} else {
+			k.int16(-1)
+		}
+	} else if r.APIVersion >= 3 {
+		k.string(p.TransactionalID, flexible)
+	}
+	k.int16(p.Acks)
+	k.int32(p.Timeout)
+	k.array(len(p.Topics), flexible)
+	for _, t := range p.Topics {
+		k.string(t.Name, flexible)
+		k.array(len(t.Partitions), flexible)
+		for _, partition := range t.Partitions {
+			k.int32(partition.Index)
+			k.bytes(partition.Records, flexible)
+			if flexible {
+				k.tags()
+			}
+		}
+		if flexible {
+			k.tags()
+		}
+	}
+	if flexible {
+		k.tags()
+	}
+	r.Body = k.data
+	return AppendKafkaRequest(dst, r)
+}
+
+// AppendKafkaRequest appends the request to dst, with its size prefix
+func AppendKafkaRequest(dst []byte, r KafkaRequest) []byte {
+	var k kafkaWriter
+	k.int16(r.APIKey)
+	k.int16(r.APIVersion)
+	k.int32(r.CorrelationID)
+	k.string(r.ClientID, false)
+	if KafkaFlexible(r.APIKey, r.APIVersion) {
+		k.tags()
+	}
+	n := len(k.data) + len(r.Body)
+	dst = append(dst, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	return append(append(dst, k.data...), r.Body...)
+}
+
+// KafkaFetchTopics returns the topics of a Fetch request, the requests from the version 13 have the ids of the
+// topics only and have none
+func KafkaFetchTopics(r KafkaRequest) (topics []string, ok bool) {
+	if r.APIKey != KafkaFetch {
+		return
+	}
+	if r.APIVersion >= 13 {
+		return nil, true
+	}
+	flexible := KafkaFlexible(r.APIKey, r.APIVersion)
+	k := kafkaReader{data: r.Body}
+	// replica id, max wait and min bytes
+	k.skip(12)
+	if r.APIVersion >= 3 {
+		k.skip(4)
+	}
+	if r.APIVersion >= 4 {
+		k.skip(1)
+	}
+	if r.APIVersion >= 7 {
+		k.skip(8)
+	}
+	n := k.array(flexible)
+	for i := 0; i < n && !k.err; i++ {
+		topics = append(topics, k.string(flexible))
+		partitions := k.array(flexible)
+		size := 16
+		if r.APIVersion >= 5 {
+			size += 8
+		}
+		if r.APIVersion >= 9 {
+			size += 4
+		}
+		if r.APIVersion >= 12 {
+			size += 4
+		}
+		for j := 0; j < partitions && !k.err; j++ {
+			k.skip(size)
+			if flexible {
+				k.tags()
+			}
+		}
+		if flexible {
+			k.tags()
+		}
+	}
+	return topics, !k.err
+}
+
+// KafkaTopics returns the topics of the Produce and Fetch requests, the other requests have none
+func KafkaTopics(r KafkaRequest) []string {
+	switch r.APIKey {
+	case KafkaProduce:
+		p, _ := ParseKafkaProduce(r)
+		topics := make([]string, 0, len(p.Topics))
+		for _, t := range p.Topics {
+			topics = append(topics, t.Name)
+		}
+		return topics
+	case KafkaFetch:
+		topics, _ := KafkaFetchTopics(r)
+		return topics
+	}
+	return nil
+}
+
+// Kafka compression codecs of record batches
+const (
+	KafkaCompressionNone   = 0
+	KafkaCompressionGzip   = 1
+	KafkaCompressionSnappy = 2
+	KafkaCompressionLZ4    = 3
+	KafkaCompressionZstd   = 4
+)
+
+// KafkaRecordBatch is a record batch of the magic 2
+type KafkaRecordBatch struct {
+	BaseOffset     int64
+	Size           int // of the batch, with its base offset and its length
+	Attributes     int16
+	FirstTimestamp int64 // milliseconds since the epoch
+	MaxTimestamp   int64
+	ProducerID     int64
+	ProducerEpoch  int16
+	BaseSequence   int32
+	Count          int32
+	Records        []KafkaRecord
+}
+
+// Compression returns the compression codec of the batch
+func (b *KafkaRecordBatch) Compression() int {
+	return int(b.Attributes & 7)
+}
+
+// IsTransactional tells if the batch is part of a transaction
+func (b *KafkaRecordBatch) IsTransactional() bool {
+	return b.Attributes&0x10 != 0
+}
+
+// IsControl tells if the batch holds the markers of transactions rather than records
+func (b *KafkaRecordBatch) IsControl() bool {
+	return b.Attributes&0x20 != 0
+}
+
+// KafkaRecord is a record of a batch, the key and the value are nil when they are null
+type KafkaRecord struct {
+	Timestamp int64 // milliseconds since the epoch
+	Key       []byte
+	Value     []byte
+	Headers   []KafkaHeader
+}
+
+// KafkaHeader is a header of a record
+type KafkaHeader struct {
+	Key   string
+	Value []byte
+}
+
+// ParseKafkaRecordBatches parses the record batches of the records of a partition, their records are
+// decompressed. the message sets of the magics 0 and 1 are not supported.
+func ParseKafkaRecordBatches(data []byte) (batches []KafkaRecordBatch, err error) {
+	for len(data) > 0 {
+		if len(data) < 61 {
+			return nil, errors.New("truncated kafka record batch")
+		}
+		length := int(int32(binary.BigEndian.Uint32(data[8:])))
+		if length < 49 || len(data)-12 < length {
+			return nil, errors.New("invalid kafka record batch length")
+		}
+		if magic := data[16]; magic != 2 {
+			return nil, fmt.Errorf("unsupported kafka record batch magic %d", magic)
+		}
+		k := kafkaReader{data: data[:12+length]}
+		b := KafkaRecordBatch{BaseOffset: k.int64(), Size: 12 + length}
+		// length, partition leader epoch, magic and crc
+		k.skip(13)
+		b.Attributes = k.int16()
+		k.skip(4)
+		b.FirstTimestamp, b.MaxTimestamp = k.int64(), k.int64()
+		b.ProducerID, b.ProducerEpoch, b.BaseSequence = k.int64(), k.int16(), k.int32()
+		b.Count = k.int32()
+		if b.Count < 0 || int(b.Count) > KafkaMaxMessage/7 {
+			return nil, errors.New("invalid kafka record count")
+		}
+		records, err := kafkaDecompress(b.Compression(), k.data)
+		if err != nil {
+			return nil, err
+		}
+		k = kafkaReader{data: records}
+		for i := int32(0); i < b.Count && !k.err; i++ {
+			size := int(k.varint())
+			if size < 0 || size > len(k.data) {
+				return nil, errors.New("invalid kafka record length")
+			}
+			r := kafkaReader{data: k.data[:size]}
+			k.skip(size)
+			r.skip(1)
+			rec := KafkaRecord{Timestamp: b.FirstTimestamp + r.varint()}
+			r.varint()
+			rec.Key = r.varbytes()
+			rec.Value = r.varbytes()
+			headers := int(r.varint())
+			for j := 0; j < headers && !r.err; j++ {
+				rec.Headers = append(rec.Headers, KafkaHeader{Key: string(r.varbytes()), Value: r.varbytes()})
+			}
+			if r.err {
+				return nil, errors.New("invalid kafka record")
+			}
+			b.Records = append(b.Records, rec)
+		}
+		if k.err {
+			return nil, errors.New("truncated kafka records")
+		}
+		batches = append(batches, b)
+		data = data[12+length:]
+	}
+	return
+}
+
+// kafkaDecompress returns the records compressed with the codec, at most KafkaMaxMessage bytes
+func kafkaDecompress(codec int, data []byte) ([]byte, error) {
+	var r io.Reader
+	switch codec {
+	case KafkaCompressionNone:
+		return data, nil
+	case KafkaCompressionGzip:
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		r = gz
+	case KafkaCompressionSnappy:
+		return kafkaSnappy(data)
+	case KafkaCompressionLZ4:
+		r = lz4.NewReader(bytes.NewReader(data))
+	case KafkaCompressionZstd:
+		zstdDecoder.Do(func() {
+			zstdDecoder.Decoder, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+		})
+		out, err := zstdDecoder.DecodeAll(data, nil)
+		if err == nil && len(out) > KafkaMaxMessage {
+			err = errors.New("kafka records too large")
+		}
+		return out, err
+	default:
+		return nil, fmt.Errorf("unsupported kafka compression codec %d", codec)
+	}
+	out, err := ioutil.ReadAll(io.LimitReader(r, KafkaMaxMessage+1))
+	if err == nil && len(out) > KafkaMaxMessage {
+		err = errors.New("kafka records too large")
+	}
+	return out, err
+}
+
+// kafkaXerialHeader starts the snappy streams of the java clients, made of blocks prefixed by their size
+const kafkaXerialHeader = "\x82SNAPPY\x00"
+
+// kafkaSnappy decodes a snappy block, or the blocks of a xerial stream
+func kafkaSnappy(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, []byte(kafkaXerialHeader)) {
+		return kafkaSnappyBlock(nil, data)
+	}
+	// the header is followed by a version and a compatible version
+	if len(data) < 16 {
+		return nil, errors.New("truncated xerial snappy header")
+	}
+	var out []byte
+	var err error
+	for data = data[16:]; len(data) > 0; {
+		if len(data) < 4 {
+			return nil, errors.New("truncated xerial snappy block")
+		}
+		n := int(int32(binary.BigEndian.Uint32(data)))
+		if n < 0 || len(data)-4 < n {
+			return nil, errors.New("invalid xerial snappy block")
+		}
+		if out, err = kafkaSnappyBlock(out, data[4:4+n]); err != nil {
+			return nil, err
+		}
+		data = data[4+n:]
+	}
+	return out, nil
+}
+
+func kafkaSnappyBlock(dst, block []byte) ([]byte, error) {
+	n, err := snappy.DecodedLen(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(dst)+n > KafkaMaxMessage {
+		return nil, errors.New("kafka records too large")
+	}
+	out, err := snappy.Decode(nil, block)
+	return append(dst, out...), err
+}
+
+// AppendKafkaRecordBatch appends the records of the batch to dst, in a batch of the magic 2 whose attributes
+// have no compression. the timestamps and the count of the batch are the ones of the records.
+func AppendKafkaRecordBatch(dst []byte, b KafkaRecordBatch) []byte {
+	var records kafkaWriter
+	b.Count = int32(len(b.Records))
+	for i, rec := range b.Records {
+		if i == 0 || rec.Timestamp < b.FirstTimestamp {
+			b.FirstTimestamp = rec.Timestamp
+		}
+		if i == 0 || rec.Timestamp > b.MaxTimestamp {
+			b.MaxTimestamp = rec.Timestamp
+		}
+	}
+	for i, rec := range b.Records {
+		var r kafkaWriter
+		r.data = append(r.data, 0)
+		r.varint(rec.Timestamp - b.FirstTimestamp)
+		r.varint(int64(i))
+		r.varbytes(rec.Key)
+		r.varbytes(rec.Value)
+		r.varint(int64(len(rec.Headers)))
+		for _, h := range rec.Headers {
+			r.varbytes([]byte(h.Key))
+			r.varbytes(h.Value)
+		}
+		records.varint(int64(len(r.data)))
+		records.data = append(records.data, r.data...)
+	}
+	var k kafkaWriter
+	k.int16(b.Attributes &^ 7)
+	k.int32(b.Count - 1)
+	k.int64(b.FirstTimestamp)
+	k.int64(b.MaxTimestamp)
+	k.int64(b.ProducerID)
+	k.int16(b.ProducerEpoch)
+	k.int32(b.BaseSequence)
+	k.int32(b.Count)
+	k.data = append(k.data, records.data...)
+	var header kafkaWriter
+	header.int64(b.BaseOffset)
+	// the length counts the partition leader epoch, the magic and the crc of the attributes and what follows
+	header.int32(int32(9 + len(k.data)))
+	header.int32(-1)
+	header.data = append(header.data, 2)
+	header.int32(int32(crc32.Checksum(k.data, crc32.MakeTable(crc32.Castagnoli))))
+	return append(append(dst, header.data...), k.data...)
+}
+
+// kafkaReader reads the fields of Kafka messages, err is set when data is too short or a field is not valid
+type kafkaReader struct {
+	data []byte
+	err  bool
+}
+
+func (k *kafkaReader) skip(n int) {
+	if k.err || n < 0 || len(k.data) < n {
+		k.err = true
+		return
+	}
+	k.data = k.data[n:]
+}
+
+func (k *kafkaReader) int16() int16 {
+	if k.err || len(k.data) < 2 {
+		k.err = true
+		return 0
+	}
+	v := int16(binary.BigEndian.Uint16(k.data))
+	k.data = k.data[2:]
+	return v
+}
+
+func (k *kafkaReader) int32() int32 {
+	if k.err || len(k.data) < 4 {
+		k.err = true
+		return 0
+	}
+	v := int32(binary.BigEndian.Uint32(k.data))
+	k.data = k.data[4:]
+	return v
+}
+
+func (k *kafkaReader) int64() int64 {
+	if k.err || len(k.data) < 8 {
+		k.err = true
+		return 0
+	}
+	v := int64(binary.BigEndian.Uint64(k.data))
+	k.data = k.data[8:]
+	return v
+}
+
+func (k *kafkaReader) uvarint() uint64 {
+	if k.err {
+		return 0
+	}
+	v, n := binary.Uvarint(k.data)
+	if n <= 0 {
+		k.err = true
+		return 0
+	}
+	k.data = k.data[n:]
+	return v
+}
+
+func (k *kafkaReader) varint() int64 {
+	if k.err {
+		return 0
+	}
+	v, n := binary.Varint(k.data)
+	if n <= 0 {
+		k.err = true
+		return 0
+	}
+	k.data = k.data[n:]
+	return v
+}
+
+// length reads the length of a string, bytes or an array, -1 when it is null
+func (k *kafkaReader) length(compact bool, size32 bool) int {
+	switch {
+	case compact:
+		return int(k.uvarint()) - 1
+	case size32:
+		return int(k.int32())
+	default:
+		return int(k.int16())
+	}
+}
+
+func (k *kafkaReader) string(compact bool) string {
+	n := k.length(compact, false)
+	if n < 0 {
+		return ""
+	}
+	v := k.data
+	k.skip(n)
+	if k.err {
+		return ""
+	}
+	return string(v[:n])
+}
+
+func (k *kafkaReader) bytes(compact bool) []byte {
+	n := k.length(compact, true)
+	if n < 0 {
+		return nil
+	}
+	v := k.data
+	k.skip(n)
+	if k.err {
+		return nil
+	}
+	return v[:n:n]
+}
+
+func (k *kafkaReader) varbytes() []byte {
+	n := int(k.varint())
+	if n < 0 {
+		return nil
+	}
+	v := k.data
+	k.skip(n)
+	if k.err {
+		return nil
+	}
+	return v[:n:n]
+}
+
+func (k *kafkaReader) array(compact bool) int {
+	n := k.length(compact, true)
+	if n > len(k.data) {
+		// each element takes a byte at least
+		k.err = true
+	}
+	return n
+}
+
+// tags skips tagged fields
+func (k *kafkaReader) tags() {
+	n := int(k.uvarint())
+	for i := 0; i < n && !k.err; i++ {
+		k.uvarint()
+		k.skip(int(k.uvarint()))
+	}
+}
+
+// kafkaWriter appends the fields of Kafka messages to data
+type kafkaWriter struct {
+	data []byte
+}
+
+func (k *kafkaWriter) int16(v int16) {
+	k.data = append(k.data, byte(v>>8), byte(v))
+}
+
+func (k *kafkaWriter) int32(v int32) {
+	k.data = append(k.data, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func (k *kafkaWriter) int64(v int64) {
+	k.int32(int32(v >> 32))
+	k.int32(int32(v))
+}
+
+func (k *kafkaWriter) uvarint(v uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	k.data = append(k.data, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+func (k *kafkaWriter) varint(v int64) {
+	var buf [binary.MaxVarintLen64]byte
+	k.data = append(k.data, buf[:binary.PutVarint(buf[:], v)]...)
+}
+
+func (k *kafkaWriter) string(v string, compact bool) {
+	if compact {
+		k.uvarint(uint64(len(v)) + 1)
+	} else {
+		k.int16(int16(len(v)))
+	}
+	k.data = append(k.data, v...)
+}
+
+func (k *kafkaWriter) bytes(v []byte, compact bool) {
+	switch {
+	case v == nil && compact:
+		k.uvarint(0)
+		return
+	case v == nil:
+		k.int32(-1)
+		return
+	case compact:
+		k.uvarint(uint64(len(v)) + 1)
+	default:
+		k.int32(int32(len(v)))
+	}
+	k.data = append(k.data, v...)
+}
+
+func (k *kafkaWriter) varbytes(v []byte) {
+	if v == nil {
+		k.varint(-1)
+		return
+	}
+	k.varint(int64(len(v)))
+	k.data = append(k.data, v...)
+}
+
+func (k *kafkaWriter) array(n int, compact bool) {
+	if compact {
+		k.uvarint(uint64(n) + 1)
+	} else {
+		k.int32(int32(n))
+	}
+}
+
+// tags writes no tagged fields
+func (k *kafkaWriter) tags() {
+	k.uvarint(0)
+}
@@ -0,0 +1,561 @@
+package proto
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// MongoHeaderLen is the length of the header of MongoDB messages
+const MongoHeaderLen = 16
+
+// MongoMaxMessage is the maximum length of MongoDB messages accepted by servers
+const MongoMaxMessage = 48 << 20
+
+// MongoDB opcodes(https://www.mongodb.com/docs/manual/reference/mongodb-wire-protocol/)
+const (
+	MongoOpReply       int32 = 1
+	MongoOpUpdate      int32 = 2001
+	MongoOpInsert      int32 = 2002
+	MongoOpQuery       int32 = 2004
+	MongoOpGetMore     int32 = 2005
+	MongoOpDelete      int32 = 2006
+	MongoOpKillCursors int32 = 2007
+	MongoOpCompressed  int32 = 2012
+	MongoOpMsg         int32 = 2013
+)
+
+// MongoDB compressors of OP_COMPRESSED
+const (
+	MongoCompressorNoop   byte = 0
+	MongoCompressorSnappy byte = 1
+	MongoCompressorZlib   byte = 2
+	MongoCompressorZstd   byte = 3
+)
+
+// flags of OP_MSG
+const (
+	MongoMsgChecksumPresent uint32 = 1 << 0
+	MongoMsgMoreToCome      uint32 = 1 << 1
+	MongoMsgExhaustAllowed  uint32 = 1 << 16
+)
+
+// MongoHeader is the header of MongoDB messages
+type MongoHeader struct {
+	Length     int32
+	RequestID  int32
+	ResponseTo int32
+	OpCode     int32
+}
+
+// ParseMongoHeader returns the header at the start of data, ok is false if its length is not valid
+func ParseMongoHeader(data []byte) (h MongoHeader, ok bool) {
+	if len(data) < MongoHeaderLen {
+		return
+	}
+	h.Length = int32(binary.LittleEndian.Uint32(data))
+	h.RequestID = int32(binary.LittleEndian.Uint32(data[4:]))
+	h.ResponseTo = int32(binary.LittleEndian.Uint32(data[8:]))
+	h.OpCode = int32(binary.LittleEndian.Uint32(data[12:]))
+	return h, h.Length >= MongoHeaderLen && h.Length <= MongoMaxMessage
+}
+
+// MongoMessageLength returns the length of the message at the start of data, or -1 if it is not complete
+func MongoMessageLength(data []byte) int {
+	h, ok := ParseMongoHeader(data)
+	if !ok || len(data) < int(h.Length) {
+		return -1
+	}
+	return int(h.Length)
+}
+
+// AppendMongoMessage appends the message of the header and the body to dst, the length of the header is the one
+// of the message
+func AppendMongoMessage(dst []byte, h MongoHeader, body []byte) []byte {
+	var header [MongoHeaderLen]byte
+	binary.LittleEndian.PutUint32(header[:], uint32(MongoHeaderLen+len(body)))
+	binary.LittleEndian.PutUint32(header[4:], uint32(h.RequestID))
+	binary.LittleEndian.PutUint32(header[8:], uint32(h.ResponseTo))
+	binary.LittleEndian.PutUint32(header[12:], uint32(h.OpCode))
+	return append(append(dst, header[:]...), body...)
+}
+
+var zstdDecoder struct {
+	sync.Once
+	*zstd.Decoder
+}
+
+// MongoDecompress returns the message compressed by an OP_COMPRESSED message, with the header of the compressed
+// message and its original opcode. the other messages are returned as is.
+func MongoDecompress(msg []byte) ([]byte, error) {
+	h, ok := ParseMongoHeader(msg)
+	if !ok || len(msg) != int(h.Length) {
+		return nil, errors.New("invalid mongo message")
+	}
+	if h.OpCode != MongoOpCompressed {
+		return msg, nil
+	}
+	body := msg[MongoHeaderLen:]
+	if len(body) < 9 {
+		return nil, errors.New("invalid mongo compressed message")
+	}
+	h.OpCode = int32(binary.LittleEndian.Uint32(body))
+	size := int(int32(binary.LittleEndian.Uint32(body[4:])))
+	if size < 0 || size > MongoMaxMessage-MongoHeaderLen {
+		return nil, errors.New("invalid mongo uncompressed size")
+	}
+	compressor, data := body[8], body[9:]
+	var err error
+	switch compressor {
+	case MongoCompressorNoop:
+	case MongoCompressorSnappy:
+		var n int
+		if n, err = snappy.DecodedLen(data); err == nil && n != size {
+			err = errors.New("unexpected uncompressed size")
+		}
+		if err == nil {
+			data, err = snappy.Decode(nil, data)
+		}
+	case MongoCompressorZlib:
+		var r io.ReadCloser
+		if r, err = zlib.NewReader(bytes.NewReader(data)); err == nil {
+			data = make([]byte, size)
+			_, err = io.ReadFull(r, data)
+		}
+	case MongoCompressorZstd:
+		zstdDecoder.Do(func() {
+			zstdDecoder.Decoder, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+		})
+		data, err = zstdDecoder.DecodeAll(data, make([]byte, 0, size))
+	default:
+		return nil, fmt.Errorf("unsupported mongo compressor %d", compressor)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != size {
+		return nil, errors.New("unexpected uncompressed size")
+	}
+	return AppendMongoMessage(make([]byte, 0, MongoHeaderLen+size), h, data), nil
+}
+
+// MongoMsgBody returns the document of the body section of an OP_MSG message, or the first document of an
+// OP_REPLY message
+func MongoMsgBody(msg []byte) (doc []byte, ok bool) {
+	h, ok := ParseMongoHeader(msg)
+	if !ok || len(msg) < int(h.Length) {
+		return nil, false
+	}
+	body := msg[MongoHeaderLen:h.Length]
+	switch h.OpCode {
+	case MongoOpReply:
+		// responseFlags, cursorID, startingFrom and numberReturned
+		if len(body) < 20 {
+			return nil, false
+		}
+		return bsonDocument(body[20:])
+	case MongoOpMsg:
+	default:
+		return nil, false
+	}
+	if len(body) < 4 {
+		return nil, false
+	}
+	flags := binary.LittleEndian.Uint32(body)
+	body = body[4:]
+	if flags&MongoMsgChecksumPresent != 0 {
+		if len(body) < 4 {
+			return nil, false
+		}
+		body = body[:len(body)-4]
+	}
+	for len(body) > 0 {
+		kind := body[0]
+		body = body[1:]
+		switch kind {
+		case 0:
+			return bsonDocument(body)
+		case 1:
+			// document sequence
+			if len(body) < 4 {
+				return nil, false
+			}
+			n := int(int32(binary.LittleEndian.Uint32(body)))
+			if n < 4 || n > len(body) {
+				return nil, false
+			}
+			body = body[n:]
+		default:
+			return nil, false
+		}
+	}
+	return nil, false
+}
+
+// MongoMsgFlags returns the flags of an OP_MSG message
+func MongoMsgFlags(msg []byte) (flags uint32, ok bool) {
+	h, ok := ParseMongoHeader(msg)
+	if !ok || h.OpCode != MongoOpMsg || len(msg) < MongoHeaderLen+4 {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint32(msg[MongoHeaderLen:]), true
+}
+
+// AppendMongoMsg appends an OP_MSG message whose body is the document to dst
+func AppendMongoMsg(dst []byte, requestID int32, doc []byte) []byte {
+	body := append(make([]byte, 5, 5+len(doc)), doc...)
+	return AppendMongoMessage(dst, MongoHeader{RequestID: requestID, OpCode: MongoOpMsg}, body)
+}
+
+// MongoCommand describes a request: the name of its command, the database and the collection it applies to.
+// the collection is empty for the commands applying to databases.
+type MongoCommand struct {
+	Name       string
+	Database   string
+	Collection string
+}
+
+// Namespace returns the database and the collection, separated by a dot
+func (c MongoCommand) Namespace() string {
+	if c.Collection == "" {
+		return c.Database
+	}
+	return c.Database + "." + c.Collection
+}
+
+// ParseMongoCommand returns the command of a request, an OP_MSG or OP_QUERY message, or a legacy OP_INSERT,
+// OP_UPDATE, OP_DELETE, OP_GET_MORE or OP_KILL_CURSORS message. the queries of OP_QUERY messages that are not
+// commands are find commands. the compressed messages are decompressed.
+func ParseMongoCommand(msg []byte) (c MongoCommand, ok bool) {
+	h, ok := ParseMongoHeader(msg)
+	if !ok || len(msg) < int(h.Length) {
+		return c, false
+	}
+	if h.OpCode == MongoOpCompressed {
+		var err error
+		if msg, err = MongoDecompress(msg[:h.Length]); err != nil {
+			return c, false
+		}
+		h, _ = ParseMongoHeader(msg)
+	}
+	body := msg[MongoHeaderLen:h.Length]
+	switch h.OpCode {
+	case MongoOpMsg:
+		doc, ok := MongoMsgBody(msg)
+		if !ok {
+			return c, false
+		}
+		return mongoCommand(doc, "")
+	case MongoOpQuery:
+		if len(body) < 4 {
+			return c, false
+		}
+		ns, rest, ok := cstring(body[4:])
+		if !ok || len(rest) < 8 {
+			return c, false
+		}
+		db := strings.SplitN(ns, ".", 2)
+		if len(db) != 2 {
+			return c, false
+		}
+		doc, ok := bsonDocument(rest[8:])
+		if !ok {
+			return c, false
+		}
+		if db[1] != "$cmd" {
+			return MongoCommand{Name: "find", Database: db[0], Collection: db[1]}, true
+		}
+		// the commands may be wrapped with their options
+		if typ, key, value, ok := bsonFirst(doc); ok && typ == BSONDocument && (key == "$query" || key == "query") {
+			doc = value
+		}
+		return mongoCommand(doc, db[0])
+	case MongoOpInsert, MongoOpUpdate, MongoOpDelete, MongoOpGetMore:
+		// flags or ZERO, then the namespace
+		if len(body) < 4 {
+			return c, false
+		}
+		ns, _, ok := cstring(body[4:])
+		db := strings.SplitN(ns, ".", 2)
+		if !ok || len(db) != 2 {
+			return c, false
+		}
+		c.Database, c.Collection = db[0], db[1]
+		switch h.OpCode {
+		case MongoOpInsert:
+			c.Name = "insert"
+		case MongoOpUpdate:
+			c.Name = "update"
+		case MongoOpDelete:
+			c.Name = "delete"
+		default:
+			c.Name = "getMore"
+		}
+		return c, true
+	case MongoOpKillCursors:
+		return MongoCommand{Name: "killCursors"}, true
+	}
+	return c, false
+}
+
+// mongoCommand returns the command of a document, its first element is the name of the command and the
+// collection when it is a string
+func mongoCommand(doc []byte, db string) (c MongoCommand, ok bool) {
+	typ, key, value, ok := bsonFirst(doc)
+	if !ok {
+		return c, false
+	}
+	c.Name = key
+	if typ == BSONString {
+		c.Collection, _ = BSONStringValue(value)
+	}
+	if c.Collection == "" {
+		// e.g: getMore
+		if typ, value, ok := BSONLookup(doc, "collection"); ok && typ == BSONString {
+			c.Collection, _ = BSONStringValue(value)
+		}
+	}
+	c.Database = db
+	if typ, value, ok := BSONLookup(doc, "$db"); ok && typ == BSONString {
+		c.Database, _ = BSONStringValue(value)
+	}
+	return c, true
+}
+
+// cstring returns the NUL terminated string at the start of data and the data following it
+func cstring(data []byte) (s string, rest []byte, ok bool) {
+	i := bytes.IndexByte(data, 0)
+	if i < 0 {
+		return
+	}
+	return string(data[:i]), data[i+1:], true
+}
+
+// BSON types(https://bsonspec.org/spec.html)
+const (
+	BSONDouble     byte = 0x01
+	BSONString     byte = 0x02
+	BSONDocument   byte = 0x03
+	BSONArray      byte = 0x04
+	BSONBinary     byte = 0x05
+	BSONUndefined  byte = 0x06
+	BSONObjectID   byte = 0x07
+	BSONBoolean    byte = 0x08
+	BSONDateTime   byte = 0x09
+	BSONNull       byte = 0x0A
+	BSONRegex      byte = 0x0B
+	BSONDBPointer  byte = 0x0C
+	BSONJavaScript byte = 0x0D
+	BSONSymbol     byte = 0x0E
+	BSONCodeScope  byte = 0x0F
+	BSONInt32      byte = 0x10
+	BSONTimestamp  byte = 0x11
+	BSONInt64      byte = 0x12
+	BSONDecimal128 byte = 0x13
+	BSONMinKey     byte = 0xFF
+	BSONMaxKey     byte = 0x7F
+)
+
+// bsonDocument returns the document at the start of data
+func bsonDocument(data []byte) (doc []byte, ok bool) {
+	if len(data) < 5 {
+		return
+	}
+	n := int(int32(binary.LittleEndian.Uint32(data)))
+	if n < 5 || n > len(data) || data[n-1] != 0 {
+		return
+	}
+	return data[:n], true
+}
+
+// bsonValueLength returns the length of the value of the type at the start of data, or -1
+func bsonValueLength(typ byte, data []byte) int {
+	fixed := -1
+	switch typ {
+	case BSONUndefined, BSONNull, BSONMinKey, BSONMaxKey:
+		fixed = 0
+	case BSONBoolean:
+		fixed = 1
+	case BSONInt32:
+		fixed = 4
+	case BSONDouble, BSONDateTime, BSONTimestamp, BSONInt64:
+		fixed = 8
+	case BSONObjectID:
+		fixed = 12
+	case BSONDecimal128:
+		fixed = 16
+	case BSONString, BSONJavaScript, BSONSymbol, BSONDBPointer:
+		if len(data) < 4 {
+			return -1
+		}
+		n := int(int32(binary.LittleEndian.Uint32(data)))
+		if n < 1 || n > len(data)-4 || data[3+n] != 0 {
+			return -1
+		}
+		if typ == BSONDBPointer {
+			return 4 + n + 12
+		}
+		return 4 + n
+	case BSONDocument, BSONArray, BSONCodeScope:
+		doc, ok := bsonDocument(data)
+		if !ok {
+			return -1
+		}
+		return len(doc)
+	case BSONBinary:
+		if len(data) < 5 {
+			return -1
+		}
+		n := int(int32(binary.LittleEndian.Uint32(data)))
+		if n < 0 || n > len(data)-5 {
+			return -1
+		}
+		return 5 + n
+	case BSONRegex:
+		i := bytes.IndexByte(data, 0)
+		if i < 0 {
+			return -1
+		}
+		j := bytes.IndexByte(data[i+1:], 0)
+		if j < 0 {
+			return -1
+		}
+		return i + j + 2
+	}
+	if fixed > len(data) {
+		return -1
+	}
+	return fixed
+}
+
+// BSONElements calls fn with the elements of the document until it returns false, ok is false if the document is
+// not valid
+func BSONElements(doc []byte, fn func(typ byte, key string, value []byte) bool) (ok bool) {
+	doc, ok = bsonDocument(doc)
+	if !ok {
+		return
+	}
+	data := doc[4 : len(doc)-1]
+	for len(data) > 0 {
+		typ := data[0]
+		key, rest, ok := cstring(data[1:])
+		if !ok {
+			return false
+		}
+		n := bsonValueLength(typ, rest)
+		if n < 0 {
+			return false
+		}
+		if !fn(typ, key, rest[:n]) {
+			return true
+		}
+		data = rest[n:]
+	}
+	return true
+}
+
+// bsonFirst returns the first element of the document
+func bsonFirst(doc []byte) (typ byte, key string, value []byte, ok bool) {
+	BSONElements(doc, func(t byte, k string, v []byte) bool {
+		typ, key, value, ok = t, k, v, true
+		return false
+	})
+	return
+}
+
+// BSONLookup returns the type and the value of an element of the document
+func BSONLookup(doc []byte, key string) (typ byte, value []byte, ok bool) {
+	BSONElements(doc, func(t byte, k string, v []byte) bool {
+		if k == key {
+			typ, value, ok = t, v, true
+			return false
+		}
+		return true
+	})
+	return
+}
+
+// BSONStringValue returns the string of a string value
+func BSONStringValue(value []byte) (string, bool) {
+	if len(value) < 5 {
+		return "", false
+	}
+	return string(value[4 : len(value)-1]), true
+}
+
+// BSONBinaryValue returns the data of a binary value
+func BSONBinaryValue(value []byte) ([]byte, bool) {
+	if len(value) < 5 {
+		return nil, false
+	}
+	return value[5:], true
+}
+
+// BSONNumber returns a number value as a float64, booleans are 0 or 1
+func BSONNumber(typ byte, value []byte) (float64, bool) {
+	switch {
+	case typ == BSONInt32 && len(value) == 4:
+		return float64(int32(binary.LittleEndian.Uint32(value))), true
+	case typ == BSONInt64 && len(value) == 8:
+		return float64(int64(binary.LittleEndian.Uint64(value))), true
+	case typ == BSONDouble && len(value) == 8:
+		return math.Float64frombits(binary.LittleEndian.Uint64(value)), true
+	case typ == BSONBoolean && len(value) == 1:
+		return float64(value[0]), true
+	}
+	return 0, false
+}
+
+// BSONDoc returns the document of the elements, appended with the AppendBSON functions
+func BSONDoc(elements []byte) []byte {
+	doc := make([]byte, 4, len(elements)+5)
+	doc = append(append(doc, elements...), 0)
+	binary.LittleEndian.PutUint32(doc, uint32(len(doc)))
+	return doc
+}
+
+// AppendBSON appends an element to dst, value is the encoded value of the type
+func AppendBSON(dst []byte, typ byte, key string, value []byte) []byte {
+	return append(append(append(append(dst, typ), key...), 0), value...)
+}
+
+// AppendBSONString appends a string element to dst
+func AppendBSONString(dst []byte, key, s string) []byte {
+	dst = AppendBSON(dst, BSONString, key, nil)
+	var n [4]byte
+	binary.LittleEndian.PutUint32(n[:], uint32(len(s)+1))
+	return append(append(append(dst, n[:]...), s...), 0)
+}
+
+// AppendBSONInt32 appends an int32 element to dst
+func AppendBSONInt32(dst []byte, key string, i int32) []byte {
+	var v [4]byte
+	binary.LittleEndian.PutUint32(v[:], uint32(i))
+	return AppendBSON(dst, BSONInt32, key, v[:])
+}
+
+// AppendBSONBoolean appends a boolean element to dst
+func AppendBSONBoolean(dst []byte, key string, b bool) []byte {
+	v := byte(0)
+	if b {
+		v = 1
+	}
+	return AppendBSON(dst, BSONBoolean, key, []byte{v})
+}
+
+// AppendBSONBinary appends a binary element of the generic subtype to dst
+func AppendBSONBinary(dst []byte, key string, data []byte) []byte {
+	dst = AppendBSON(dst, BSONBinary, key, nil)
+	var n [4]byte
+	binary.LittleEndian.PutUint32(n[:], uint32(len(data)))
+	return append(append(append(dst, n[:]...), 0), data...)
+}
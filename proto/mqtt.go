@@ -0,0 +1,324 @@
+package proto
+
+import (
+	"encoding/binary"
+	"strings"
+)
+
+// MQTT control packet types(https://docs.oasis-open.org/mqtt/mqtt/v5.0/mqtt-v5.0.html)
+const (
+	MQTTConnect     byte = 1
+	MQTTConnAck     byte = 2
+	MQTTPublish     byte = 3
+	MQTTPubAck      byte = 4
+	MQTTPubRec      byte = 5
+	MQTTPubRel      byte = 6
+	MQTTPubComp     byte = 7
+	MQTTSubscribe   byte = 8
+	MQTTSubAck      byte = 9
+	MQTTUnsubscribe byte = 10
+	MQTTUnsubAck    byte = 11
+	MQTTPingReq     byte = 12
+	MQTTPingResp    byte = 13
+	MQTTDisconnect  byte = 14
+	MQTTAuth        byte = 15
+)
+
+// MQTT protocol levels
+const (
+	MQTT31  byte = 3
+	MQTT311 byte = 4
+	MQTT5   byte = 5
+)
+
+// MQTTTopicAlias is the property of MQTT 5 PUBLISH packets replacing their topic by a number
+const MQTTTopicAlias byte = 0x23
+
+// MQTTMaxRemaining is the maximum remaining length of MQTT packets
+const MQTTMaxRemaining = 268435455
+
+// MQTTPacket returns the type, the flags and the body of the packet at the start of data, and the length of the
+// packet. n is 0 if the packet is not complete or its remaining length is not valid.
+func MQTTPacket(data []byte) (typ, flags byte, body []byte, n int) {
+	if len(data) < 2 {
+		return
+	}
+	length, i := mqttVarint(data[1:])
+	if i <= 0 || len(data)-1-i < length {
+		return
+	}
+	n = 1 + i + length
+	return data[0] >> 4, data[0] & 0x0f, data[1+i : n], n
+}
+
+// MQTTPacketLength returns the length of the packet at the start of data, or -1 if it is not complete
+func MQTTPacketLength(data []byte) int {
+	if _, _, _, n := MQTTPacket(data); n > 0 {
+		return n
+	}
+	return -1
+}
+
+// AppendMQTTPacket appends a packet to dst
+func AppendMQTTPacket(dst []byte, typ, flags byte, body []byte) []byte {
+	dst = appendMQTTVarint(append(dst, typ<<4|flags&0x0f), len(body))
+	return append(dst, body...)
+}
+
+// mqttVarint returns the variable byte integer at the start of data and its length, n is 0 if it is not complete
+// and -1 if it is longer than 4 bytes
+func mqttVarint(data []byte) (v, n int) {
+	for i := 0; i < 4; i++ {
+		if i >= len(data) {
+			return 0, 0
+		}
+		v |= int(data[i]&0x7f) << (7 * uint(i))
+		if data[i] < 0x80 {
+			return v, i + 1
+		}
+	}
+	return 0, -1
+}
+
+func appendMQTTVarint(dst []byte, v int) []byte {
+	for {
+		b := byte(v & 0x7f)
+		v >>= 7
+		if v == 0 {
+			return append(dst, b)
+		}
+		dst = append(dst, b|0x80)
+	}
+}
+
+// mqttString returns the string prefixed by its length at the start of data and the data following it
+func mqttString(data []byte) (s, rest []byte, ok bool) {
+	if len(data) < 2 {
+		return
+	}
+	n := int(binary.BigEndian.Uint16(data))
+	if len(data)-2 < n {
+		return
+	}
+	return data[2 : 2+n], data[2+n:], true
+}
+
+func appendMQTTString(dst []byte, s string) []byte {
+	return append(append(dst, byte(len(s)>>8), byte(len(s))), s...)
+}
+
+// MQTTConnectInfo is the content of a CONNECT packet used to follow its connection
+type MQTTConnectInfo struct {
+	Version  byte
+	ClientID string
+}
+
+// ParseMQTTConnect returns the protocol level and the client identifier of the body of a CONNECT packet
+func ParseMQTTConnect(body []byte) (c MQTTConnectInfo, ok bool) {
+	name, rest, ok := mqttString(body)
+	if !ok || len(rest) < 4 {
+		return c, false
+	}
+	c.Version = rest[0]
+	switch {
+	case string(name) == "MQTT" && (c.Version == MQTT311 || c.Version == MQTT5):
+	case string(name) == "MQIsdp" && c.Version == MQTT31:
+	default:
+		return c, false
+	}
+	// the flags and the keep alive
+	rest = rest[4:]
+	if c.Version == MQTT5 {
+		props, n := mqttVarint(rest)
+		if n <= 0 || len(rest)-n < props {
+			return c, false
+		}
+		rest = rest[n+props:]
+	}
+	id, _, ok := mqttString(rest)
+	if !ok {
+		return c, false
+	}
+	c.ClientID = string(id)
+	return c, true
+}
+
+// AppendMQTTConnect appends a CONNECT packet with a clean session to dst, without will, the user and the password
+// are not sent when empty
+func AppendMQTTConnect(dst []byte, version byte, clientID, user, password string, keepAlive uint16) []byte {
+	name := "MQTT"
+	if version == MQTT31 {
+		name = "MQIsdp"
+	}
+	flags := byte(0x02)
+	if user != "" {
+		flags |= 0x80
+	}
+	if password != "" {
+		flags |= 0x40
+	}
+	body := appendMQTTString(nil, name)
+	body = append(body, version, flags, byte(keepAlive>>8), byte(keepAlive))
+	if version == MQTT5 {
+		body = append(body, 0)
+	}
+	body = appendMQTTString(body, clientID)
+	if user != "" {
+		body = appendMQTTString(body, user)
+	}
+	if password != "" {
+		body = appendMQTTString(body, password)
+	}
+	return AppendMQTTPacket(dst, MQTTConnect, 0, body)
+}
+
+// ParseMQTTConnAck returns the return code of MQTT 3 or the reason code of MQTT 5 of a CONNACK packet
+func ParseMQTTConnAck(body []byte) (code byte, ok bool) {
+	if len(body) < 2 {
+		return
+	}
+	return body[1], true
+}
+
+// MQTTPublishPacket is the content of a PUBLISH packet
+type MQTTPublishPacket struct {
+	Topic      string
+	QoS        byte
+	Retain     bool
+	Dup        bool
+	PacketID   uint16 // when QoS > 0
+	Properties []byte // of MQTT 5, without their length
+	Payload    []byte
+}
+
+// ParseMQTTPublish returns the content of a PUBLISH packet of the protocol level
+func ParseMQTTPublish(flags byte, body []byte, version byte) (p MQTTPublishPacket, ok bool) {
+	p.Dup = flags&0x08 != 0
+	p.QoS = flags >> 1 & 0x03
+	p.Retain = flags&0x01 != 0
+	if p.QoS > 2 {
+		return p, false
+	}
+	topic, rest, ok := mqttString(body)
+	if !ok {
+		return p, false
+	}
+	p.Topic = string(topic)
+	if p.QoS > 0 {
+		if len(rest) < 2 {
+			return p, false
+		}
+		p.PacketID = binary.BigEndian.Uint16(rest)
+		rest = rest[2:]
+	}
+	if version == MQTT5 {
+		n, i := mqttVarint(rest)
+		if i <= 0 || len(rest)-i < n {
+			return p, false
+		}
+		p.Properties = rest[i : i+n]
+		if !MQTTProperties(p.Properties, func(byte, []byte) bool { return true }) {
+			return p, false
+		}
+		rest = rest[i+n:]
+	}
+	p.Payload = rest
+	return p, true
+}
+
+// AppendMQTTPublish appends the PUBLISH packet to dst in the encoding of the protocol level, the properties are
+// only sent to MQTT 5
+func AppendMQTTPublish(dst []byte, p MQTTPublishPacket, version byte) []byte {
+	flags := p.QoS << 1
+	if p.Dup {
+		flags |= 0x08
+	}
+	if p.Retain {
+		flags |= 0x01
+	}
+	body := appendMQTTString(make([]byte, 0, len(p.Topic)+len(p.Properties)+len(p.Payload)+16), p.Topic)
+	if p.QoS > 0 {
+		body = append(body, byte(p.PacketID>>8), byte(p.PacketID))
+	}
+	if version == MQTT5 {
+		body = append(appendMQTTVarint(body, len(p.Properties)), p.Properties...)
+	}
+	return AppendMQTTPacket(dst, MQTTPublish, flags, append(body, p.Payload...))
+}
+
+// mqttPropertyLength returns the length of the value of the property at the start of data, or -1
+func mqttPropertyLength(id byte, data []byte) int {
+	switch id {
+	case 0x01, 0x17, 0x19, 0x24, 0x25, 0x28, 0x29, 0x2A:
+		return 1
+	case 0x13, 0x21, 0x22, 0x23:
+		return 2
+	case 0x02, 0x11, 0x18, 0x27:
+		return 4
+	case 0x0B:
+		if _, n := mqttVarint(data); n > 0 {
+			return n
+		}
+	case 0x03, 0x08, 0x09, 0x12, 0x15, 0x16, 0x1A, 0x1C, 0x1F:
+		if _, rest, ok := mqttString(data); ok {
+			return len(data) - len(rest)
+		}
+	case 0x26:
+		// user property, a pair of strings
+		if _, rest, ok := mqttString(data); ok {
+			if _, rest, ok = mqttString(rest); ok {
+				return len(data) - len(rest)
+			}
+		}
+	}
+	return -1
+}
+
+// MQTTProperties calls fn with the properties of MQTT 5 until it returns false, ok is false if the properties are
+// not valid
+func MQTTProperties(props []byte, fn func(id byte, value []byte) bool) (ok bool) {
+	for len(props) > 0 {
+		id := props[0]
+		n := mqttPropertyLength(id, props[1:])
+		if n < 0 || n > len(props)-1 {
+			return false
+		}
+		if !fn(id, props[1:1+n]) {
+			return true
+		}
+		props = props[1+n:]
+	}
+	return true
+}
+
+// MQTTWithoutProperty returns the properties without the ones of the id
+func MQTTWithoutProperty(props []byte, id byte) []byte {
+	var without []byte
+	MQTTProperties(props, func(i byte, value []byte) bool {
+		if i != id {
+			without = append(append(without, i), value...)
+		}
+		return true
+	})
+	return without
+}
+
+// MatchMQTTTopic reports whether the topic matches the topic filter, with its + and # wildcards. the topics
+// starting with $ are not matched by filters starting with a wildcard.
+func MatchMQTTTopic(filter, topic string) bool {
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+	levels := strings.Split(topic, "/")
+	for i, f := range strings.Split(filter, "/") {
+		switch {
+		case f == "#":
+			return true
+		case i >= len(levels):
+			return false
+		case f != "+" && f != levels[i]:
+			return false
+		}
+	}
+	return len(strings.Split(filter, "/")) == len(levels)
+}
@@ -0,0 +1,133 @@
+package proto
+
+import (
+	"bytes"
+	"errors"
+	"mime"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalidMultipart is returned when the body of a multipart request doesn't match its boundary
+var ErrInvalidMultipart = errors.New("invalid multipart body")
+
+// Part is a part of a multipart/form-data body, its offsets are relative to the payload it was parsed from
+type Part struct {
+	Name        string // name of the form field
+	Filename    string // name of the uploaded file, empty for the other fields
+	ContentType string
+	Start, End  int // the part, from its delimiter line to the end of its content
+	BodyStart   int // the content of the part, Size bytes after BodyStart
+}
+
+// Size returns the size of the content of the part
+func (p Part) Size() int {
+	return p.End - p.BodyStart
+}
+
+// MultipartBoundary returns the boundary of a multipart request or response, or nil if it is not multipart
+func MultipartBoundary(payload []byte) []byte {
+	mediaType, params, err := mime.ParseMediaType(string(Header(payload, []byte("Content-Type"))))
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") || params["boundary"] == "" {
+		return nil
+	}
+	return []byte(params["boundary"])
+}
+
+// MultipartParts returns the parts of the multipart body of the payload, without copying their content.
+// the chunked bodies are not parsed, they can be dechunked with --http-decode-body. it returns nil if the
+// payload is not multipart, and ErrInvalidMultipart with the parts parsed so far if the body is malformed or
+// truncated.
+func MultipartParts(payload []byte) ([]Part, error) {
+	boundary := MultipartBoundary(payload)
+	end := MIMEHeadersEndPos(payload)
+	if boundary == nil || end == -1 || bytes.Contains(Header(payload, []byte("Transfer-Encoding")), []byte("chunked")) {
+		return nil, nil
+	}
+	delim := append([]byte("\r\n--"), boundary...)
+	// the preamble is optional, the first delimiter may not follow a line ending
+	pos := end - 2
+	if !bytes.HasPrefix(payload[pos:], delim) {
+		i := bytes.Index(payload[end:], delim)
+		if i == -1 {
+			return nil, ErrInvalidMultipart
+		}
+		pos = end + i
+	}
+	var parts []Part
+	for {
+		start := pos
+		if start < end {
+			start = end // the CRLF before the first delimiter ends the headers of the message
+		}
+		pos += len(delim)
+		if bytes.HasPrefix(payload[pos:], []byte("--")) {
+			return parts, nil
+		}
+		nl := bytes.Index(payload[pos:], CRLF)
+		if nl == -1 {
+			return parts, ErrInvalidMultipart
+		}
+		pos += nl + 2
+		headersEnd := bytes.Index(payload[pos:], EmptyLine)
+		if bytes.HasPrefix(payload[pos:], CRLF) {
+			headersEnd = -2 // a part without headers
+		}
+		if headersEnd == -1 {
+			return parts, ErrInvalidMultipart
+		}
+		part := Part{Start: start, BodyStart: pos + headersEnd + 4}
+		part.Name, part.Filename, part.ContentType = partHeaders(payload[pos : pos+headersEnd+2])
+		i := bytes.Index(payload[part.BodyStart:], delim)
+		if i == -1 {
+			return parts, ErrInvalidMultipart
+		}
+		part.End = part.BodyStart + i
+		parts = append(parts, part)
+		pos = part.End
+	}
+}
+
+// partHeaders returns the field name and the file name of the Content-Disposition header, and the content type
+// of the headers of a part
+func partHeaders(headers []byte) (name, filename, contentType string) {
+	for _, line := range bytes.Split(headers, CRLF) {
+		colon := bytes.IndexByte(line, ':')
+		if colon == -1 {
+			continue
+		}
+		value := string(bytes.TrimSpace(line[colon+1:]))
+		switch key := line[:colon]; {
+		case bytes.EqualFold(key, []byte("Content-Disposition")):
+			if _, params, err := mime.ParseMediaType(value); err == nil {
+				name, filename = params["name"], params["filename"]
+			}
+		case bytes.EqualFold(key, []byte("Content-Type")):
+			contentType = value
+		}
+	}
+	return
+}
+
+// SetPartContent replaces the content of the part of the payload, the parts following it are moved, and
+// the Content-Length of the payload is updated. it returns the modified payload
+func SetPartContent(payload []byte, part Part, content []byte) []byte {
+	out := make([]byte, 0, len(payload)-part.Size()+len(content))
+	out = append(append(append(out, payload[:part.BodyStart]...), content...), payload[part.End:]...)
+	return setBodyLength(out)
+}
+
+// DeletePart removes the part of the payload, with its delimiter line and headers, the Content-Length of the
+// payload is updated. it returns the modified payload
+func DeletePart(payload []byte, part Part) []byte {
+	out := make([]byte, 0, len(payload)-(part.End-part.Start))
+	out = append(append(out, payload[:part.Start]...), payload[part.End:]...)
+	return setBodyLength(out)
+}
+
+func setBodyLength(payload []byte) []byte {
+	if len(Header(payload, []byte("Content-Length"))) == 0 {
+		return payload
+	}
+	return SetHeader(payload, []byte("Content-Length"), []byte(strconv.Itoa(len(Body(payload)))))
+}
@@ -0,0 +1,722 @@
+package proto
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// MySQLPacketHeaderLen is the length of the header of MySQL packets
+const MySQLPacketHeaderLen = 4
+
+// MySQLMaxPayload is the maximum length of the payload of a packet, longer payloads continue in the next packets
+const MySQLMaxPayload = 1<<24 - 1
+
+// MySQL commands(https://dev.mysql.com/doc/dev/mysql-server/latest/page_protocol_command_phase.html)
+const (
+	MySQLComQuit             byte = 0x01
+	MySQLComInitDB           byte = 0x02
+	MySQLComQuery            byte = 0x03
+	MySQLComFieldList        byte = 0x04
+	MySQLComStatistics       byte = 0x09
+	MySQLComPing             byte = 0x0e
+	MySQLComChangeUser       byte = 0x11
+	MySQLComStmtPrepare      byte = 0x16
+	MySQLComStmtExecute      byte = 0x17
+	MySQLComStmtSendLongData byte = 0x18
+	MySQLComStmtClose        byte = 0x19
+	MySQLComStmtReset        byte = 0x1a
+	MySQLComStmtFetch        byte = 0x1c
+	MySQLComResetConnection  byte = 0x1f
+)
+
+// MySQL capability flags
+const (
+	MySQLClientConnectWithDB             uint32 = 0x8
+	MySQLClientLocalFiles                uint32 = 0x80
+	MySQLClientProtocol41                uint32 = 0x200
+	MySQLClientSSL                       uint32 = 0x800
+	MySQLClientTransactions              uint32 = 0x2000
+	MySQLClientSecureConnection          uint32 = 0x8000
+	MySQLClientMultiStatements           uint32 = 0x10000
+	MySQLClientMultiResults              uint32 = 0x20000
+	MySQLClientPSMultiResults            uint32 = 0x40000
+	MySQLClientPluginAuth                uint32 = 0x80000
+	MySQLClientConnectAttrs              uint32 = 0x100000
+	MySQLClientPluginAuthLenencData      uint32 = 0x200000
+	MySQLClientDeprecateEOF              uint32 = 0x1000000
+	MySQLClientQueryAttributes           uint32 = 0x8000000
+	mysqlServerMoreResultsExists         uint16 = 0x8
+	mysqlStmtExecuteParameterCountExists byte   = 0x8
+)
+
+// MySQLPacket returns the payload and the sequence id of the packet at the start of data, and the length of its
+// packets: payloads of MySQLMaxPayload bytes continue in the next packet, their payloads are then joined in a
+// new buffer. n is 0 if the packet is not complete.
+func MySQLPacket(data []byte) (payload []byte, seq uint8, n int) {
+	for {
+		if len(data)-n < MySQLPacketHeaderLen {
+			return nil, 0, 0
+		}
+		length := int(data[n]) | int(data[n+1])<<8 | int(data[n+2])<<16
+		if len(data)-n-MySQLPacketHeaderLen < length {
+			return nil, 0, 0
+		}
+		part := data[n+MySQLPacketHeaderLen : n+MySQLPacketHeaderLen+length]
+		if n == 0 {
+			payload, seq = part, data[3]
+		} else {
+			payload = append(payload[:len(payload):len(payload)], part...)
+		}
+		n += MySQLPacketHeaderLen + length
+		if length < MySQLMaxPayload {
+			return
+		}
+	}
+}
+
+// MySQLPacketLength returns the length of the packet at the start of data, including the packets it continues in,
+// or -1 if it is not complete
+func MySQLPacketLength(data []byte) int {
+	if _, _, n := MySQLPacket(data); n > 0 {
+		return n
+	}
+	return -1
+}
+
+// AppendMySQLPacket appends the packets of the payload to dst, starting with the sequence id seq
+func AppendMySQLPacket(dst []byte, seq uint8, payload []byte) []byte {
+	for {
+		length := len(payload)
+		if length > MySQLMaxPayload {
+			length = MySQLMaxPayload
+		}
+		dst = append(dst, byte(length), byte(length>>8), byte(length>>16), seq)
+		dst = append(dst, payload[:length]...)
+		payload = payload[length:]
+		seq++
+		if length < MySQLMaxPayload {
+			return dst
+		}
+	}
+}
+
+// MySQLLenEnc returns the length-encoded integer at the start of data and its length, n is 0 if it is not complete
+// or if it is the NULL of text rows
+func MySQLLenEnc(data []byte) (v uint64, n int) {
+	if len(data) == 0 {
+		return
+	}
+	switch data[0] {
+	case 0xfc:
+		n = 3
+	case 0xfd:
+		n = 4
+	case 0xfe:
+		n = 9
+	case 0xfb, 0xff:
+		return 0, 0
+	default:
+		return uint64(data[0]), 1
+	}
+	if len(data) < n {
+		return 0, 0
+	}
+	for i := n - 1; i > 0; i-- {
+		v = v<<8 | uint64(data[i])
+	}
+	return v, n
+}
+
+// AppendMySQLLenEnc appends v as a length-encoded integer to dst
+func AppendMySQLLenEnc(dst []byte, v uint64) []byte {
+	switch {
+	case v < 0xfb:
+		return append(dst, byte(v))
+	case v < 1<<16:
+		return append(dst, 0xfc, byte(v), byte(v>>8))
+	case v < 1<<24:
+		return append(dst, 0xfd, byte(v), byte(v>>8), byte(v>>16))
+	}
+	dst = append(dst, 0xfe)
+	return append(dst, byte(v), byte(v>>8), byte(v>>16), byte(v>>24), byte(v>>32), byte(v>>40), byte(v>>48), byte(v>>56))
+}
+
+// mysqlLenEncString returns the length-encoded string at the start of data and its length
+func mysqlLenEncString(data []byte) (s []byte, n int) {
+	length, i := MySQLLenEnc(data)
+	if i == 0 || uint64(len(data)-i) < length {
+		return nil, 0
+	}
+	return data[i : i+int(length)], i + int(length)
+}
+
+// mysqlNulString returns the NUL terminated string at the start of data and its length
+func mysqlNulString(data []byte) (s []byte, n int) {
+	i := bytes.IndexByte(data, 0)
+	if i < 0 {
+		return nil, 0
+	}
+	return data[:i], i + 1
+}
+
+// MySQLHandshake is the initial handshake packet of servers, of the protocol version 10
+type MySQLHandshake struct {
+	ServerVersion string
+	ConnectionID  uint32
+	Capabilities  uint32
+	Charset       byte
+	AuthData      []byte // scramble
+	AuthPlugin    string
+}
+
+// ParseMySQLHandshake parses the payload of the initial handshake packet of a server
+func ParseMySQLHandshake(payload []byte) (h MySQLHandshake, ok bool) {
+	if len(payload) < 1 || payload[0] != 10 {
+		return
+	}
+	version, n := mysqlNulString(payload[1:])
+	p := payload[1+n:]
+	if n == 0 || len(p) < 4+8+1+2 {
+		return
+	}
+	h.ServerVersion = string(version)
+	h.ConnectionID = binary.LittleEndian.Uint32(p)
+	h.AuthData = append([]byte(nil), p[4:12]...)
+	h.Capabilities = uint32(binary.LittleEndian.Uint16(p[13:]))
+	p = p[15:]
+	if len(p) < 1+2+2+1+10 {
+		return h, true
+	}
+	h.Charset = p[0]
+	h.Capabilities |= uint32(binary.LittleEndian.Uint16(p[3:])) << 16
+	authLen := int(p[5])
+	p = p[16:]
+	if h.Capabilities&MySQLClientSecureConnection != 0 {
+		n := authLen - 8
+		if n < 13 {
+			n = 13
+		}
+		if len(p) < n {
+			return h, true
+		}
+		// the scramble is terminated by a NUL
+		h.AuthData = append(h.AuthData, bytes.TrimRight(p[:n], "\x00")...)
+		p = p[n:]
+	}
+	if h.Capabilities&MySQLClientPluginAuth != 0 {
+		name, n := mysqlNulString(p)
+		if n == 0 {
+			name = p
+		}
+		h.AuthPlugin = string(name)
+	}
+	return h, true
+}
+
+// AppendMySQLHandshake appends the payload of the initial handshake h to dst, its AuthData is the 20 bytes scramble
+func AppendMySQLHandshake(dst []byte, h MySQLHandshake) []byte {
+	caps := h.Capabilities | MySQLClientProtocol41 | MySQLClientSecureConnection | MySQLClientPluginAuth
+	scramble := make([]byte, 20)
+	copy(scramble, h.AuthData)
+	dst = append(append(append(dst, 10), h.ServerVersion...), 0)
+	dst = append(dst, byte(h.ConnectionID), byte(h.ConnectionID>>8), byte(h.ConnectionID>>16), byte(h.ConnectionID>>24))
+	dst = append(append(dst, scramble[:8]...), 0)
+	dst = append(dst, byte(caps), byte(caps>>8), h.Charset, 2, 0, byte(caps>>16), byte(caps>>24), 21)
+	dst = append(dst, make([]byte, 10)...)
+	dst = append(append(dst, scramble[8:]...), 0)
+	return append(append(dst, h.AuthPlugin...), 0)
+}
+
+// MySQLHandshakeResponse is the handshake response of clients, of the protocol 4.1
+type MySQLHandshakeResponse struct {
+	Capabilities  uint32
+	MaxPacketSize uint32
+	Charset       byte
+	User          string
+	AuthResponse  []byte
+	Database      string
+	AuthPlugin    string
+	Attributes    []byte // length-encoded keys and values
+}
+
+// ParseMySQLHandshakeResponse parses the payload of the handshake response of a client. the SSLRequest of clients
+// switching to TLS is a truncated response holding the capabilities, MaxPacketSize and Charset.
+func ParseMySQLHandshakeResponse(payload []byte) (r MySQLHandshakeResponse, ok bool) {
+	if len(payload) < 32 {
+		return
+	}
+	r.Capabilities = binary.LittleEndian.Uint32(payload)
+	if r.Capabilities&MySQLClientProtocol41 == 0 {
+		return
+	}
+	r.MaxPacketSize = binary.LittleEndian.Uint32(payload[4:])
+	r.Charset = payload[8]
+	p := payload[32:]
+	if len(p) == 0 {
+		return r, r.Capabilities&MySQLClientSSL != 0
+	}
+	user, n := mysqlNulString(p)
+	if n == 0 {
+		return
+	}
+	r.User = string(user)
+	p = p[n:]
+	switch {
+	case r.Capabilities&MySQLClientPluginAuthLenencData != 0:
+		r.AuthResponse, n = mysqlLenEncString(p)
+	case r.Capabilities&MySQLClientSecureConnection != 0:
+		if len(p) > 0 && len(p) > int(p[0]) {
+			r.AuthResponse, n = p[1:1+int(p[0])], 1+int(p[0])
+		} else {
+			n = 0
+		}
+	default:
+		r.AuthResponse, n = mysqlNulString(p)
+	}
+	if n == 0 {
+		return
+	}
+	p = p[n:]
+	if r.Capabilities&MySQLClientConnectWithDB != 0 && len(p) > 0 {
+		db, n := mysqlNulString(p)
+		if n == 0 {
+			return
+		}
+		r.Database = string(db)
+		p = p[n:]
+	}
+	if r.Capabilities&MySQLClientPluginAuth != 0 && len(p) > 0 {
+		name, n := mysqlNulString(p)
+		if n == 0 {
+			return
+		}
+		r.AuthPlugin = string(name)
+		p = p[n:]
+	}
+	if r.Capabilities&MySQLClientConnectAttrs != 0 && len(p) > 0 {
+		r.Attributes, _ = mysqlLenEncString(p)
+	}
+	return r, true
+}
+
+// AppendMySQLHandshakeResponse appends the payload of the handshake response r to dst
+func AppendMySQLHandshakeResponse(dst []byte, r MySQLHandshakeResponse) []byte {
+	caps := r.Capabilities | MySQLClientProtocol41 | MySQLClientSecureConnection | MySQLClientPluginAuthLenencData
+	if r.Database != "" {
+		caps |= MySQLClientConnectWithDB
+	}
+	if r.AuthPlugin != "" {
+		caps |= MySQLClientPluginAuth
+	}
+	if r.Attributes != nil {
+		caps |= MySQLClientConnectAttrs
+	}
+	dst = append(dst, byte(caps), byte(caps>>8), byte(caps>>16), byte(caps>>24))
+	dst = append(dst, byte(r.MaxPacketSize), byte(r.MaxPacketSize>>8), byte(r.MaxPacketSize>>16), byte(r.MaxPacketSize>>24))
+	dst = append(dst, r.Charset)
+	dst = append(dst, make([]byte, 23)...)
+	dst = append(append(dst, r.User...), 0)
+	dst = append(AppendMySQLLenEnc(dst, uint64(len(r.AuthResponse))), r.AuthResponse...)
+	if r.Database != "" {
+		dst = append(append(dst, r.Database...), 0)
+	}
+	if r.AuthPlugin != "" {
+		dst = append(append(dst, r.AuthPlugin...), 0)
+	}
+	if r.Attributes != nil {
+		dst = append(AppendMySQLLenEnc(dst, uint64(len(r.Attributes))), r.Attributes...)
+	}
+	return dst
+}
+
+// MySQLStatementID returns the id of the statement of COM_STMT_EXECUTE, COM_STMT_SEND_LONG_DATA, COM_STMT_CLOSE,
+// COM_STMT_RESET and COM_STMT_FETCH commands, ok is false for other commands
+func MySQLStatementID(payload []byte) (id uint32, ok bool) {
+	if len(payload) < 5 {
+		return
+	}
+	switch payload[0] {
+	case MySQLComStmtExecute, MySQLComStmtSendLongData, MySQLComStmtClose, MySQLComStmtReset, MySQLComStmtFetch:
+		return binary.LittleEndian.Uint32(payload[1:]), true
+	}
+	return
+}
+
+// MySQLQuery returns the statement of a COM_QUERY or COM_STMT_PREPARE command. the query attributes of COM_QUERY
+// commands sent with the capability MySQLClientQueryAttributes are skipped, ok is false if they can't be parsed.
+func MySQLQuery(payload []byte, queryAttributes bool) (query []byte, ok bool) {
+	if len(payload) < 1 || payload[0] != MySQLComQuery && payload[0] != MySQLComStmtPrepare {
+		return
+	}
+	p := payload[1:]
+	if payload[0] == MySQLComStmtPrepare || !queryAttributes {
+		return p, true
+	}
+	count, n := MySQLLenEnc(p)
+	if n == 0 {
+		return
+	}
+	p = p[n:]
+	if _, n = MySQLLenEnc(p); n == 0 {
+		// the parameter set count, always 1
+		return
+	}
+	p = p[n:]
+	if count == 0 {
+		return p, true
+	}
+	if count > uint64(len(p)) {
+		return
+	}
+	nulls := p[:(count+7)/8]
+	p = p[(count+7)/8:]
+	if len(p) < 1 || p[0] != 1 {
+		// the types are always sent
+		return
+	}
+	p = p[1:]
+	types := make([]byte, count)
+	for i := range types {
+		if len(p) < 2 {
+			return
+		}
+		types[i] = p[0]
+		p = p[2:]
+		if _, n = mysqlLenEncString(p); n == 0 {
+			// the name of the attribute
+			return
+		}
+		p = p[n:]
+	}
+	for i, typ := range types {
+		if nulls[i/8]&(1<<(uint(i)%8)) != 0 {
+			continue
+		}
+		n := MySQLBinaryValueLength(typ, p)
+		if n < 0 {
+			return
+		}
+		p = p[n:]
+	}
+	return p, true
+}
+
+// MySQL column types of the binary protocol
+const (
+	MySQLTypeTiny      byte = 1
+	MySQLTypeShort     byte = 2
+	MySQLTypeLong      byte = 3
+	MySQLTypeFloat     byte = 4
+	MySQLTypeDouble    byte = 5
+	MySQLTypeNull      byte = 6
+	MySQLTypeTimestamp byte = 7
+	MySQLTypeLongLong  byte = 8
+	MySQLTypeInt24     byte = 9
+	MySQLTypeDate      byte = 10
+	MySQLTypeTime      byte = 11
+	MySQLTypeDateTime  byte = 12
+	MySQLTypeYear      byte = 13
+)
+
+// MySQLBinaryValueLength returns the length of the value of the type at the start of data, in the binary protocol,
+// or -1 if it is not complete
+func MySQLBinaryValueLength(typ byte, data []byte) (n int) {
+	switch typ {
+	case MySQLTypeNull:
+		n = 0
+	case MySQLTypeTiny:
+		n = 1
+	case MySQLTypeShort, MySQLTypeYear:
+		n = 2
+	case MySQLTypeLong, MySQLTypeInt24, MySQLTypeFloat:
+		n = 4
+	case MySQLTypeLongLong, MySQLTypeDouble:
+		n = 8
+	case MySQLTypeTimestamp, MySQLTypeDate, MySQLTypeTime, MySQLTypeDateTime:
+		if len(data) < 1 {
+			return -1
+		}
+		n = 1 + int(data[0])
+	default:
+		if _, n = mysqlLenEncString(data); n == 0 {
+			return -1
+		}
+	}
+	if n > len(data) {
+		return -1
+	}
+	return n
+}
+
+// MySQLResponse follows the packets of the response of a server to a command, to find where it ends
+type MySQLResponse struct {
+	Command      byte
+	DeprecateEOF bool   // the capability MySQLClientDeprecateEOF was negotiated
+	Err          bool   // the response is an ERR packet
+	Infile       bool   // the server requested the content of a file, sent by the client before another response
+	StatementID  uint32 // of the statement prepared by COM_STMT_PREPARE
+	Params       uint16 // of the statement prepared
+	state        uint8
+	left         uint64 // definitions left to read
+	columns      uint64 // column definitions of a prepared statement
+}
+
+// states of MySQLResponse
+const (
+	mysqlFirst      uint8 = iota
+	mysqlParams           // parameter definitions of a prepared statement
+	mysqlParamsEOF        // EOF following them
+	mysqlColumns          // column definitions
+	mysqlColumnsEOF       // EOF following them
+	mysqlRows
+	mysqlDone
+)
+
+// Packet handles the payload of a packet of the response, it returns true once the response is complete
+func (r *MySQLResponse) Packet(payload []byte) (done bool) {
+	if r.state == mysqlDone {
+		return true
+	}
+	if len(payload) > 0 && payload[0] == 0xff {
+		// ERR
+		r.Err = r.state == mysqlFirst
+		r.state = mysqlDone
+		return true
+	}
+	switch r.state {
+	case mysqlFirst:
+		switch r.Command {
+		case MySQLComQuery, MySQLComStmtExecute:
+			return r.first(payload)
+		case MySQLComStmtFetch:
+			r.state = mysqlRows
+			return r.Packet(payload)
+		case MySQLComFieldList:
+			r.state = mysqlColumns
+			r.left = 1 << 63
+			return r.Packet(payload)
+		case MySQLComStmtPrepare:
+			if len(payload) < 9 || payload[0] != 0 {
+				r.state = mysqlDone
+				return true
+			}
+			r.StatementID = binary.LittleEndian.Uint32(payload[1:])
+			r.columns = uint64(binary.LittleEndian.Uint16(payload[5:]))
+			r.Params = binary.LittleEndian.Uint16(payload[7:])
+			r.left = uint64(r.Params)
+			r.state = mysqlParams
+			return r.definitions()
+		}
+		r.state = mysqlDone
+		return true
+	case mysqlParams:
+		r.left--
+		return r.definitions()
+	case mysqlParamsEOF:
+		return r.preparedColumns()
+	case mysqlColumns:
+		if r.Command == MySQLComFieldList && r.eof(payload) {
+			r.state = mysqlDone
+			return true
+		}
+		r.left--
+		return r.definitions()
+	case mysqlColumnsEOF:
+		r.state = mysqlRows
+		if r.Command == MySQLComStmtPrepare {
+			r.state = mysqlDone
+			return true
+		}
+		return false
+	case mysqlRows:
+		if !r.eof(payload) {
+			return false
+		}
+		if r.status(payload)&mysqlServerMoreResultsExists != 0 && r.Command != MySQLComStmtFetch {
+			r.state = mysqlFirst
+			return false
+		}
+		r.state = mysqlDone
+		return true
+	}
+	return true
+}
+
+// first handles the first packet of the response of a query: an OK, a request for a file or the column count
+func (r *MySQLResponse) first(payload []byte) bool {
+	if len(payload) > 0 && payload[0] == 0 {
+		if r.status(payload)&mysqlServerMoreResultsExists != 0 {
+			return false
+		}
+		r.state = mysqlDone
+		return true
+	}
+	if len(payload) > 0 && payload[0] == 0xfb {
+		r.Infile = true
+		r.state = mysqlDone
+		return true
+	}
+	count, n := MySQLLenEnc(payload)
+	if n == 0 || count == 0 {
+		r.state = mysqlDone
+		return true
+	}
+	r.state, r.left = mysqlColumns, count
+	return false
+}
+
+// definitions moves past the definitions read, it returns true if the response is complete
+func (r *MySQLResponse) definitions() bool {
+	if r.left > 0 {
+		return false
+	}
+	switch r.state {
+	case mysqlParams:
+		r.state = mysqlParamsEOF
+		if r.Params == 0 || r.DeprecateEOF {
+			return r.preparedColumns()
+		}
+	case mysqlColumns:
+		r.state = mysqlColumnsEOF
+		if r.DeprecateEOF {
+			r.state = mysqlRows
+			if r.Command == MySQLComStmtPrepare {
+				r.state = mysqlDone
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// preparedColumns moves to the column definitions of a prepared statement, the response is complete without them
+func (r *MySQLResponse) preparedColumns() bool {
+	if r.columns == 0 {
+		r.state = mysqlDone
+		return true
+	}
+	r.state, r.left = mysqlColumns, r.columns
+	return false
+}
+
+// eof reports whether the payload is an EOF packet, or an OK packet ending a result set with MySQLClientDeprecateEOF
+func (r *MySQLResponse) eof(payload []byte) bool {
+	if len(payload) == 0 || payload[0] != 0xfe {
+		return false
+	}
+	if r.DeprecateEOF {
+		return len(payload) < MySQLMaxPayload
+	}
+	return len(payload) < 9
+}
+
+// status returns the status flags of an OK or EOF packet
+func (r *MySQLResponse) status(payload []byte) uint16 {
+	if len(payload) == 0 {
+		return 0
+	}
+	p := payload[1:]
+	if payload[0] == 0xfe && !r.DeprecateEOF {
+		// EOF: warnings and status flags
+		if len(p) < 4 {
+			return 0
+		}
+		return binary.LittleEndian.Uint16(p[2:])
+	}
+	for i := 0; i < 2; i++ {
+		// affected rows and last insert id
+		_, n := MySQLLenEnc(p)
+		if n == 0 {
+			return 0
+		}
+		p = p[n:]
+	}
+	if len(p) < 2 {
+		return 0
+	}
+	return binary.LittleEndian.Uint16(p)
+}
+
+// MySQLExecuteWithoutAttributes returns the payload of a COM_STMT_EXECUTE command sent with the capability
+// MySQLClientQueryAttributes as if it was sent without it: its query attributes are removed, as well as the count
+// and the names of its parameters. params is the number of parameters of the statement. ok is false if the payload
+// can't be parsed, or if it holds query attributes whose types were bound by a previous execution.
+func MySQLExecuteWithoutAttributes(payload []byte, params uint16) (execute []byte, ok bool) {
+	if len(payload) < 10 || payload[0] != MySQLComStmtExecute {
+		return
+	}
+	flags := payload[5]
+	execute = append(execute, payload[:10]...)
+	execute[5] &^= mysqlStmtExecuteParameterCountExists
+	p := payload[10:]
+	if params == 0 && flags&mysqlStmtExecuteParameterCountExists == 0 {
+		return append(execute, p...), true
+	}
+	count := uint64(params)
+	if flags&mysqlStmtExecuteParameterCountExists != 0 {
+		var n int
+		if count, n = MySQLLenEnc(p); n == 0 || count < uint64(params) {
+			return nil, false
+		}
+		p = p[n:]
+	}
+	if count == 0 {
+		return execute, true
+	}
+	if count > uint64(len(p)) {
+		return nil, false
+	}
+	nulls := p[:(count+7)/8]
+	p = p[(count+7)/8:]
+	if params > 0 {
+		execute = append(execute, nulls[:(params+7)/8]...)
+		if params%8 != 0 {
+			// the bits of the attributes
+			execute[len(execute)-1] &= byte(1)<<(params%8) - 1
+		}
+	}
+	if len(p) < 1 {
+		return nil, false
+	}
+	bound := p[0] == 1
+	p = p[1:]
+	if !bound {
+		if count > uint64(params) {
+			return nil, false
+		}
+		return append(append(execute, 0), p...), true
+	}
+	if params > 0 {
+		execute = append(execute, 1)
+	}
+	types := make([]byte, count)
+	for i := range types {
+		if len(p) < 2 {
+			return nil, false
+		}
+		types[i] = p[0]
+		if i < int(params) {
+			execute = append(execute, p[:2]...)
+		}
+		p = p[2:]
+		_, n := mysqlLenEncString(p)
+		if n == 0 {
+			return nil, false
+		}
+		p = p[n:]
+	}
+	for i, typ := range types {
+		if nulls[i/8]&(1<<(uint(i)%8)) != 0 {
+			continue
+		}
+		n := MySQLBinaryValueLength(typ, p)
+		if n < 0 {
+			return nil, false
+		}
+		if i < int(params) {
+			execute = append(execute, p[:n]...)
+		}
+		p = p[n:]
+	}
+	return execute, true
+}
@@ -0,0 +1,362 @@
+package proto
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// PostgreSQL protocol version 3.0 and the codes of the special startup packets
+const (
+	PostgresProtocolVersion uint32 = 196608
+	PostgresCancelRequest   uint32 = 80877102
+	PostgresSSLRequest      uint32 = 80877103
+	PostgresGSSENCRequest   uint32 = 80877104
+)
+
+// PostgreSQL frontend messages(https://www.postgresql.org/docs/current/protocol-message-formats.html)
+const (
+	PostgresQuery        byte = 'Q'
+	PostgresParse        byte = 'P'
+	PostgresBind         byte = 'B'
+	PostgresDescribe     byte = 'D'
+	PostgresExecute      byte = 'E'
+	PostgresSync         byte = 'S'
+	PostgresFlush        byte = 'H'
+	PostgresClose        byte = 'C'
+	PostgresTerminate    byte = 'X'
+	PostgresFunctionCall byte = 'F'
+	PostgresPassword     byte = 'p' // and the SASL messages
+	PostgresCopyData     byte = 'd'
+	PostgresCopyDone     byte = 'c'
+	PostgresCopyFail     byte = 'f'
+)
+
+// PostgreSQL backend messages
+const (
+	PostgresAuthentication  byte = 'R'
+	PostgresReadyForQuery   byte = 'Z'
+	PostgresErrorResponse   byte = 'E'
+	PostgresCopyInResponse  byte = 'G'
+	PostgresCopyOutResponse byte = 'H'
+	PostgresCopyBoth        byte = 'W'
+	PostgresRowDescription  byte = 'T'
+	PostgresDataRow         byte = 'D'
+	PostgresCommandComplete byte = 'C'
+)
+
+// PostgreSQL authentication requests
+const (
+	PostgresAuthOK                uint32 = 0
+	PostgresAuthCleartextPassword uint32 = 3
+	PostgresAuthMD5Password       uint32 = 5
+	PostgresAuthSASL              uint32 = 10
+	PostgresAuthSASLContinue      uint32 = 11
+	PostgresAuthSASLFinal         uint32 = 12
+)
+
+// postgresMaxStartup is the maximum length of startup packets accepted by servers
+const postgresMaxStartup = 10000
+
+// PostgresStartupLength returns the length of the startup packet at the start of data(the startup message, or an
+// SSLRequest, GSSENCRequest or CancelRequest), -1 if it is not complete or not a startup packet
+func PostgresStartupLength(data []byte) int {
+	if len(data) < 8 {
+		return -1
+	}
+	n := binary.BigEndian.Uint32(data)
+	switch binary.BigEndian.Uint32(data[4:]) {
+	case PostgresSSLRequest, PostgresGSSENCRequest:
+		if n != 8 {
+			return -1
+		}
+	case PostgresCancelRequest:
+		if n != 16 {
+			return -1
+		}
+	case PostgresProtocolVersion:
+		if n < 8 || n > postgresMaxStartup {
+			return -1
+		}
+	default:
+		return -1
+	}
+	if uint32(len(data)) < n {
+		return -1
+	}
+	return int(n)
+}
+
+// PostgresMessage returns the type and the body of the message at the start of data, and the length of the
+// message. n is 0 if the message is not complete.
+func PostgresMessage(data []byte) (typ byte, body []byte, n int) {
+	if len(data) < 5 {
+		return
+	}
+	length := binary.BigEndian.Uint32(data[1:])
+	if length < 4 || uint64(len(data)-1) < uint64(length) {
+		return
+	}
+	return data[0], data[5 : 1+length], 1 + int(length)
+}
+
+// PostgresMessageLength returns the length of the message at the start of data, or -1 if it is not complete
+func PostgresMessageLength(data []byte) int {
+	if _, _, n := PostgresMessage(data); n > 0 {
+		return n
+	}
+	return -1
+}
+
+// PostgresMessages reports whether data is a sequence of complete messages
+func PostgresMessages(data []byte) bool {
+	for len(data) > 0 {
+		_, _, n := PostgresMessage(data)
+		if n == 0 {
+			return false
+		}
+		data = data[n:]
+	}
+	return true
+}
+
+// AppendPostgresMessage appends a message of the type to dst
+func AppendPostgresMessage(dst []byte, typ byte, body []byte) []byte {
+	n := uint32(len(body) + 4)
+	dst = append(dst, typ, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	return append(dst, body...)
+}
+
+// ParsePostgresStartup returns the parameters of the startup message, as name and value pairs
+func ParsePostgresStartup(data []byte) (params []string, ok bool) {
+	n := PostgresStartupLength(data)
+	if n < 0 || binary.BigEndian.Uint32(data[4:]) != PostgresProtocolVersion {
+		return
+	}
+	p := data[8:n]
+	for len(p) > 1 {
+		i := bytes.IndexByte(p, 0)
+		if i < 0 {
+			return nil, false
+		}
+		params = append(params, string(p[:i]))
+		p = p[i+1:]
+	}
+	if len(params)%2 != 0 {
+		return nil, false
+	}
+	return params, true
+}
+
+// AppendPostgresStartup appends the startup message of the parameters, name and value pairs, to dst
+func AppendPostgresStartup(dst []byte, params ...string) []byte {
+	start := len(dst)
+	dst = append(dst, 0, 0, 0, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(dst[start+4:], PostgresProtocolVersion)
+	for _, p := range params {
+		dst = append(append(dst, p...), 0)
+	}
+	dst = append(dst, 0)
+	binary.BigEndian.PutUint32(dst[start:], uint32(len(dst)-start))
+	return dst
+}
+
+// PostgresStartupParam returns the value of a parameter of a startup message
+func PostgresStartupParam(params []string, name string) string {
+	for i := 0; i+1 < len(params); i += 2 {
+		if params[i] == name {
+			return params[i+1]
+		}
+	}
+	return ""
+}
+
+// PostgresQueryText returns the SQL of a Query or Parse message
+func PostgresQueryText(typ byte, body []byte) (query []byte, ok bool) {
+	switch typ {
+	case PostgresQuery:
+	case PostgresParse:
+		// the name of the statement
+		i := bytes.IndexByte(body, 0)
+		if i < 0 {
+			return
+		}
+		body = body[i+1:]
+	default:
+		return
+	}
+	i := bytes.IndexByte(body, 0)
+	if i < 0 {
+		return
+	}
+	return body[:i], true
+}
+
+// PostgresBindParams returns the parameters of a Bind message in the text format, the others and the NULL
+// parameters are nil
+func PostgresBindParams(body []byte) (params [][]byte, ok bool) {
+	// the names of the portal and of the statement
+	for i := 0; i < 2; i++ {
+		j := bytes.IndexByte(body, 0)
+		if j < 0 {
+			return
+		}
+		body = body[j+1:]
+	}
+	if len(body) < 2 {
+		return
+	}
+	formats := make([]uint16, binary.BigEndian.Uint16(body))
+	body = body[2:]
+	if len(body) < 2*len(formats)+2 {
+		return
+	}
+	for i := range formats {
+		formats[i] = binary.BigEndian.Uint16(body[2*i:])
+	}
+	body = body[2*len(formats):]
+	params = make([][]byte, binary.BigEndian.Uint16(body))
+	body = body[2:]
+	for i := range params {
+		if len(body) < 4 {
+			return nil, false
+		}
+		n := int32(binary.BigEndian.Uint32(body))
+		body = body[4:]
+		if n < 0 {
+			continue
+		}
+		if int64(len(body)) < int64(n) {
+			return nil, false
+		}
+		// a single format applies to all the parameters
+		format := uint16(0)
+		switch {
+		case len(formats) == 1:
+			format = formats[0]
+		case i < len(formats):
+			format = formats[i]
+		}
+		if format == 0 {
+			params[i] = body[:n]
+		}
+		body = body[n:]
+	}
+	return params, true
+}
+
+// PostgresAuthRequest returns the code of an Authentication message
+func PostgresAuthRequest(body []byte) (code uint32, ok bool) {
+	if len(body) < 4 {
+		return
+	}
+	return binary.BigEndian.Uint32(body), true
+}
+
+// ScrubSQL masks in place the string and numeric literals of the SQL, keeping its syntax: letters are replaced
+// by x and digits by 1. the identifiers, the placeholders and the comments are kept.
+func ScrubSQL(query []byte) {
+	for i := 0; i < len(query); {
+		c := query[i]
+		switch {
+		case c == '-' && i+1 < len(query) && query[i+1] == '-':
+			for i < len(query) && query[i] != '\n' {
+				i++
+			}
+		case c == '/' && i+1 < len(query) && query[i+1] == '*':
+			end := bytes.Index(query[i+2:], []byte("*/"))
+			if end < 0 {
+				return
+			}
+			i += end + 4
+		case c == '"':
+			end := bytes.IndexByte(query[i+1:], '"')
+			if end < 0 {
+				return
+			}
+			i += end + 2
+		case c == '\'':
+			escapes := i > 0 && (query[i-1] == 'E' || query[i-1] == 'e')
+			i = scrubString(query, i+1, escapes)
+		case c == '$':
+			j := i + 1
+			for j < len(query) && isIdentChar(query[j]) && !(j == i+1 && isDigit(query[j])) {
+				j++
+			}
+			if j < len(query) && query[j] == '$' {
+				// dollar quoted string
+				tag := query[i : j+1]
+				end := bytes.Index(query[j+1:], tag)
+				if end < 0 {
+					end = len(query) - j - 1
+				}
+				scrub(query[j+1 : j+1+end])
+				i = j + 1 + end + len(tag)
+				continue
+			}
+			// a placeholder
+			i++
+			for i < len(query) && isDigit(query[i]) {
+				i++
+			}
+		case isDigit(c):
+			for i < len(query) && (isIdentChar(query[i]) || query[i] == '.') {
+				if isDigit(query[i]) {
+					query[i] = '1'
+				}
+				i++
+			}
+		case isIdentChar(c):
+			for i < len(query) && (isIdentChar(query[i]) || query[i] == '$') {
+				i++
+			}
+		default:
+			i++
+		}
+	}
+}
+
+// scrubString masks the string literal starting at i, after its opening quote, and returns the position
+// following its closing quote. the escape sequences of escaped strings are kept.
+func scrubString(query []byte, i int, escapes bool) int {
+	for i < len(query) {
+		switch c := query[i]; {
+		case c == '\'':
+			if i+1 < len(query) && query[i+1] == '\'' {
+				i += 2
+				continue
+			}
+			return i + 1
+		case c == '\\' && escapes:
+			i += 2
+			continue
+		}
+		scrub(query[i : i+1])
+		i++
+	}
+	return i
+}
+
+// scrub masks the letters and the digits of data
+func scrub(data []byte) {
+	for i, c := range data {
+		switch {
+		case isDigit(c):
+			data[i] = '1'
+		case c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			data[i] = 'x'
+		}
+	}
+}
+
+// ScrubValue masks in place the letters and the digits of a value, like ScrubSQL masks literals
+func ScrubValue(value []byte) {
+	scrub(value)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isIdentChar(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || isDigit(c) || c >= 0x80
+}
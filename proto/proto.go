@@ -19,6 +19,7 @@ package proto
 import (
 	"bufio"
 	"bytes"
+	"errors"
 	"net/http"
 	"net/textproto"
 	"strconv"
@@ -45,6 +46,22 @@ func MIMEHeadersEndPos(payload []byte) int {
 	return pos + 4
 }
 
+// HeaderSection returns the size of the start line and the header fields of the message, with the empty line
+// ending them, and the number of header fields. size is -1 if the header section is not complete.
+func HeaderSection(payload []byte) (size, count int) {
+	size = MIMEHeadersEndPos(payload)
+	if size == -1 {
+		return -1, 0
+	}
+	for _, c := range payload[:size-2] {
+		if c == '\n' {
+			count++
+		}
+	}
+	// the start line ends with a line feed too
+	return size, count - 1
+}
+
 // MIMEHeadersStartPos finds start of Headers section
 // It just finds position of second line (first contains location and method).
 func MIMEHeadersStartPos(payload []byte) int {
@@ -140,7 +157,8 @@ func ParseHeaders(payloads [][]byte, cb func(header []byte, value []byte)) {
 	return
 }
 
-// Header returns header value, if header not found, value will be blank
+// Header returns header value, if header not found, value will be blank.
+// the name is case-insensitive, only the first field is considered, see HeaderValues
 func Header(payload, name []byte) []byte {
 	val, _, _, _, _ := header(payload, name)
 
@@ -184,6 +202,103 @@ func DeleteHeader(payload, name []byte) []byte {
 	return payload
 }
 
+// headerValues calls fn with the value offsets of each header field named name, in order, until fn returns false
+func headerValues(payload, name []byte, fn func(valueStart, valueEnd int) bool) {
+	pos := MIMEHeadersStartPos(payload)
+	if pos < 0 {
+		return
+	}
+	for pos < len(payload) {
+		end := bytes.IndexByte(payload[pos:], '\n')
+		if end == -1 {
+			return
+		}
+		end += pos
+		colon := bytes.IndexByte(payload[pos:end], ':')
+		if colon == -1 {
+			return
+		}
+		colon += pos
+		if bytes.EqualFold(payload[pos:colon], name) {
+			vs, ve := colon+1, end
+			for vs < ve && payload[vs] < 0x21 {
+				vs++
+			}
+			for ve > vs && payload[ve-1] < 0x21 {
+				ve--
+			}
+			if !fn(vs, ve) {
+				return
+			}
+		}
+		pos = end + 1
+	}
+}
+
+// HeaderValues returns the values of all the header fields named name, the name is case-insensitive
+func HeaderValues(payload, name []byte) (values [][]byte) {
+	headerValues(payload, name, func(vs, ve int) bool {
+		values = append(values, payload[vs:ve])
+		return true
+	})
+	return
+}
+
+// HeaderList returns the elements of the comma-separated list of the header fields named name, commas within
+// quoted strings are kept. the values of Set-Cookie are not split, cookie expiry dates hold commas and the
+// fields can't be combined.
+func HeaderList(payload, name []byte) (elements [][]byte) {
+	for _, value := range HeaderValues(payload, name) {
+		if bytes.EqualFold(name, []byte("Set-Cookie")) {
+			elements = append(elements, value)
+			continue
+		}
+		start, quoted := 0, false
+		for i := 0; i <= len(value); i++ {
+			switch {
+			case i < len(value) && value[i] == '\\' && quoted:
+				i++
+			case i < len(value) && value[i] == '"':
+				quoted = !quoted
+			case i == len(value) || value[i] == ',' && !quoted:
+				if e := bytes.TrimSpace(value[start:i]); len(e) > 0 {
+					elements = append(elements, e)
+				}
+				start = i + 1
+			}
+		}
+	}
+	return
+}
+
+// ReplaceHeaderValues replaces the value of each header field named name with the value returned by fn.
+// Returns modified request payload
+func ReplaceHeaderValues(payload, name []byte, fn func(value []byte) []byte) []byte {
+	var offsets [][2]int
+	headerValues(payload, name, func(vs, ve int) bool {
+		offsets = append(offsets, [2]int{vs, ve})
+		return true
+	})
+	// the last fields are replaced first, the offsets of the others stay valid
+	for i := len(offsets) - 1; i >= 0; i-- {
+		vs, ve := offsets[i][0], offsets[i][1]
+		payload = byteutils.Replace(payload, vs, ve, fn(append([]byte(nil), payload[vs:ve]...)))
+	}
+	return payload
+}
+
+// DeleteHeaders takes http payload and removes all the header fields named name from headers section
+// Returns modified request payload
+func DeleteHeaders(payload, name []byte) []byte {
+	for {
+		_, hs, he, _, _ := header(payload, name)
+		if hs == -1 {
+			return payload
+		}
+		payload = byteutils.Cut(payload, hs, he+1)
+	}
+}
+
 // Body returns request/response body
 func Body(payload []byte) []byte {
 	pos := MIMEHeadersEndPos(payload)
@@ -395,9 +510,15 @@ func HasTitle(payload []byte) bool {
 }
 
 // CheckChunked checks HTTP/1 chunked data integrity and return the final index
-// of chunks(index after '0\r\n\r\n') or -1 if there is missing data
-// or there is bad format
+// of chunks(index after '0\r\n\r\n', or after the empty line ending the trailer fields
+// that follow the last chunk) or -1 if there is missing data or there is bad format
 func CheckChunked(buf []byte) (chunkEnd int) {
+	chunkEnd, _ = checkChunked(buf)
+	return
+}
+
+// checkChunked is CheckChunked, it also returns the index of the trailer section
+func checkChunked(buf []byte) (chunkEnd, trailerStart int) {
 	var (
 		ok     bool
 		chkLen int
@@ -407,7 +528,7 @@ func CheckChunked(buf []byte) (chunkEnd int) {
 	for {
 		sz = bytes.IndexByte(buf[chunkEnd:], '\r')
 		if sz < 1 {
-			return -1
+			return -1, -1
 		}
 		// ignoring chunks extensions https://github.com/golang/go/issues/13135
 		// but chunks extensions are no longer a thing
@@ -417,28 +538,89 @@ func CheckChunked(buf []byte) (chunkEnd int) {
 		}
 		chkLen, ok = atoI(buf[chunkEnd:chunkEnd+ext], 16)
 		if !ok {
-			return -1
+			return -1, -1
 		}
 		chunkEnd += (sz + 2)
 		if chkLen == 0 {
-			if !bytes.Equal(buf[chunkEnd:chunkEnd+2], CRLF) {
-				return -1
+			if n := trailerLength(buf[chunkEnd:]); n != -1 {
+				return chunkEnd + n, chunkEnd
 			}
-			return chunkEnd + 2
+			return -1, -1
 		}
 		// ideally chunck length and at least len("\r\n0\r\n\r\n")
 		if len(buf[chunkEnd:]) < chkLen+7 {
-			return -1
+			return -1, -1
 		}
 		chunkEnd += chkLen
 		// chunks must end with CRLF
 		if !bytes.Equal(buf[chunkEnd:chunkEnd+2], CRLF) {
-			return -1
+			return -1, -1
 		}
 		chunkEnd += 2
 	}
 }
 
+// trailerLength returns the length of the trailer section following the last chunk, the trailer
+// fields and the empty line ending them, or -1 if it is not complete or a line is not a field
+func trailerLength(buf []byte) int {
+	var n int
+	for {
+		end := bytes.Index(buf[n:], CRLF)
+		if end < 0 {
+			return -1
+		}
+		if end == 0 {
+			return n + 2
+		}
+		if bytes.IndexByte(buf[n:n+end], ':') < 1 {
+			return -1
+		}
+		n += end + 2
+	}
+}
+
+// Trailers returns the trailer section of a chunked HTTP/1 message, the fields sent after its last chunk
+// e.g: the status of gRPC-Web calls, ending with an empty line. it is nil if the message has no trailers
+// or is not complete. the fields can be read with ParseHeaders.
+func Trailers(payload []byte) []byte {
+	end := MIMEHeadersEndPos(payload)
+	if end == -1 || !bytes.Contains(Header(payload[:end], []byte("Transfer-Encoding")), []byte("chunked")) {
+		return nil
+	}
+	body := payload[end:]
+	chunkEnd, trailerStart := checkChunked(body)
+	// the empty line alone ends the bodies without trailers
+	if chunkEnd < 1 || chunkEnd-trailerStart == 2 {
+		return nil
+	}
+	return body[trailerStart:chunkEnd]
+}
+
+// IsChunkedEnd reports whether the data ends with the last chunk of a chunked body, followed by its
+// trailer section. data is the end of a message whose start may be missing.
+func IsChunkedEnd(data []byte) bool {
+	if !bytes.HasSuffix(data, CRLF) {
+		return false
+	}
+	// the lines before the empty line are the trailer fields, up to the line of the last chunk
+	rest := data[:len(data)-2]
+	for len(rest) >= 2 && bytes.HasSuffix(rest, CRLF) {
+		start := bytes.LastIndex(rest[:len(rest)-2], CRLF) + 2
+		if start == 1 {
+			start = 0
+		}
+		line := rest[start : len(rest)-2]
+		if bytes.Equal(line, []byte("0")) || bytes.HasPrefix(line, []byte("0;")) {
+			return true
+		}
+		if start == 0 || bytes.IndexByte(line, ':') < 1 {
+			return false
+		}
+		rest = rest[:start]
+	}
+	return false
+}
+
 // HasFullPayload reports if this http has full payloads
 func HasFullPayload(payload []byte) bool {
 	body := Body(payload)
@@ -447,21 +629,11 @@ func HasFullPayload(payload []byte) bool {
 	header := Header(payload, []byte("Transfer-Encoding"))
 	if bytes.Contains(header, []byte("chunked")) {
 
-		// check chunks
+		// check chunks, and the trailer fields following the last one
 		if len(body) < 1 {
 			return false
 		}
-		var chunkEnd int
-		if chunkEnd = CheckChunked(body); chunkEnd < 1 {
-			return false
-		}
-
-		// check trailer headers
-		if len(Header(payload, []byte("Trailer"))) < 1 {
-			return true
-		}
-		// trailer headers(whether chunked or plain) should end with empty line
-		return len(body) > chunkEnd && MIMEHeadersEndPos(body[chunkEnd:]) != -1
+		return CheckChunked(body) > 0
 	}
 
 	// check for content-length header
@@ -473,7 +645,247 @@ func HasFullPayload(payload []byte) bool {
 	}
 
 	// for empty body, check for emptyline
-	return MIMEHeadersEndPos(payload) != -1
+	end := MIMEHeadersEndPos(payload)
+	return end != -1 && !closeDelimited(payload, Header(payload[:end], []byte("Connection")))
+}
+
+// MessageLength returns the length of the first full http message of the payload,
+// the payload can hold more than one message e.g: pipelined requests on a keep-alive connection.
+// it returns -1 if the message is not complete, or if its body ends when the connection is closed.
+func MessageLength(payload []byte) int {
+	end := MIMEHeadersEndPos(payload)
+	if end == -1 {
+		return -1
+	}
+	// only headers of the first message are considered
+	headers := payload[:end]
+	body := payload[end:]
+
+	// check for chunked transfer-encoding
+	if bytes.Contains(Header(headers, []byte("Transfer-Encoding")), []byte("chunked")) {
+		chunkEnd := CheckChunked(body)
+		if chunkEnd < 1 {
+			return -1
+		}
+		return end + chunkEnd
+	}
+
+	// check for content-length header
+	if header := Header(headers, []byte("Content-Length")); len(header) > 0 {
+		num, ok := atoI(header, 10)
+		if !ok || num > len(body) {
+			return -1
+		}
+		return end + num
+	}
+
+	// the body ends with the connection, the message is complete once it is closed
+	if closeDelimited(headers, Header(headers, []byte("Connection"))) {
+		return -1
+	}
+	return end
+}
+
+// closeDelimited reports whether the body of a message without Content-Length nor chunked Transfer-Encoding
+// ends when the connection is closed: a response whose status allows a body, from an HTTP/1.0 server not
+// keeping the connection alive or with Connection: close. the responses of HTTP/1.1 servers keeping the
+// connection alive have no body, e.g: the responses to HEAD requests.
+func closeDelimited(payload, connection []byte) bool {
+	if len(payload) < 12 || !bytes.HasPrefix(payload, []byte("HTTP/1.")) {
+		return false
+	}
+	switch status := string(payload[9:12]); {
+	case status[0] == '1', status == "204", status == "304":
+		return false
+	}
+	connection = bytes.ToLower(connection)
+	if bytes.Contains(connection, []byte("close")) {
+		return true
+	}
+	return payload[7] == '0' && !bytes.Contains(connection, []byte("keep-alive"))
+}
+
+// the ways LenientMessageLength found a message malformed
+var (
+	ErrMissingTitle  = errors.New("missing start line")
+	ErrBareLF        = errors.New("bare lf line ending")
+	ErrInvalidLength = errors.New("invalid content-length")
+	ErrInvalidChunk  = errors.New("invalid chunk")
+)
+
+// maxChunkSize is the size of the largest chunk LenientMessageLength accepts
+const maxChunkSize = 1 << 30
+
+// LenientMessageLength is MessageLength for the messages that don't follow RFC 9112 to the letter: lines
+// may end with a bare LF, and chunk sizes may be followed by spaces or extensions. the messages that can't be
+// framed, e.g: a chunked body with an invalid or oversized chunk, or data without a start line, are salvaged,
+// they end where the next message starts or with the data received so far. err tells why the message is
+// malformed, the length is -1 if the message is not complete yet.
+func LenientMessageLength(payload []byte) (length int, err error) {
+	if request, response := LenientTitle(payload); !request && !response {
+		if bytes.IndexByte(payload, '\n') == -1 {
+			return -1, nil
+		}
+		return salvage(payload, 0), ErrMissingTitle
+	}
+	end, bareLF := lenientHeadersEnd(payload)
+	if end == -1 {
+		return -1, nil
+	}
+	if bareLF {
+		err = ErrBareLF
+	}
+	headers := payload[:end]
+	if bytes.Contains(lenientHeader(headers, "Transfer-Encoding"), []byte("chunked")) {
+		n, chunkErr := lenientChunked(payload, end)
+		if n == -1 {
+			return -1, nil
+		}
+		if chunkErr != nil {
+			err = chunkErr
+		}
+		return n, err
+	}
+	if header := lenientHeader(headers, "Content-Length"); len(header) > 0 {
+		num, parseErr := strconv.ParseUint(string(header), 10, 63)
+		if parseErr != nil {
+			return salvage(payload, end), ErrInvalidLength
+		}
+		if num > uint64(len(payload)-end) {
+			return -1, nil
+		}
+		return end + int(num), err
+	}
+	if closeDelimited(headers, lenientHeader(headers, "Connection")) {
+		return -1, nil
+	}
+	return end, err
+}
+
+// LenientTitle reports whether the payload starts with an HTTP/1 request or status line, ending with CRLF or
+// a bare LF
+func LenientTitle(payload []byte) (request, response bool) {
+	nl := bytes.IndexByte(payload, '\n')
+	if nl == -1 {
+		return
+	}
+	title := payload[:nl+1]
+	if nl == 0 || payload[nl-1] != '\r' {
+		title = append(append(make([]byte, 0, nl+2), payload[:nl]...), CRLF...)
+	}
+	return HasRequestTitle(title), HasResponseTitle(title)
+}
+
+// lenientLine returns the line starting at pos without its line ending, and the position of the next line, or
+// -1 if the line is not complete
+func lenientLine(buf []byte, pos int) (line []byte, next int, bareLF bool) {
+	nl := bytes.IndexByte(buf[pos:], '\n')
+	if nl == -1 {
+		return nil, -1, false
+	}
+	line = buf[pos : pos+nl]
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	} else {
+		bareLF = true
+	}
+	return line, pos + nl + 1, bareLF
+}
+
+// lenientHeadersEnd returns the position of the body of the message, or -1 if its headers are not complete
+func lenientHeadersEnd(payload []byte) (end int, bareLF bool) {
+	_, pos, bareLF := lenientLine(payload, 0)
+	for pos != -1 {
+		var line []byte
+		var lf bool
+		line, pos, lf = lenientLine(payload, pos)
+		bareLF = bareLF || lf
+		if pos != -1 && len(line) == 0 {
+			return pos, bareLF
+		}
+	}
+	return -1, false
+}
+
+// lenientHeader returns the value of the header of the headers of a message, whose lines may end with a bare LF
+func lenientHeader(headers []byte, name string) []byte {
+	_, pos, _ := lenientLine(headers, 0)
+	for pos != -1 {
+		var line []byte
+		line, pos, _ = lenientLine(headers, pos)
+		i := bytes.IndexByte(line, ':')
+		if i > 0 && strings.EqualFold(string(bytes.TrimSpace(line[:i])), name) {
+			return bytes.TrimSpace(line[i+1:])
+		}
+	}
+	return nil
+}
+
+// lenientChunked returns the end of the chunked body starting at pos and of its trailers, or -1 if it is not
+// complete
+func lenientChunked(buf []byte, pos int) (end int, err error) {
+	for {
+		line, next, lf := lenientLine(buf, pos)
+		if next == -1 {
+			return -1, nil
+		}
+		if lf {
+			err = ErrBareLF
+		}
+		if i := bytes.IndexByte(line, ';'); i >= 0 {
+			line = line[:i]
+		}
+		size, parseErr := strconv.ParseUint(string(bytes.TrimSpace(line)), 16, 32)
+		if parseErr != nil || size > maxChunkSize {
+			return salvage(buf, pos), ErrInvalidChunk
+		}
+		pos = next
+		if size == 0 {
+			// the trailer section ends with an empty line
+			for {
+				if line, pos, lf = lenientLine(buf, pos); pos == -1 {
+					return -1, nil
+				}
+				if lf {
+					err = ErrBareLF
+				}
+				if len(line) == 0 {
+					return pos, err
+				}
+			}
+		}
+		if len(buf)-pos < int(size)+1 {
+			return -1, nil
+		}
+		pos += int(size)
+		switch {
+		case bytes.HasPrefix(buf[pos:], CRLF):
+			pos += 2
+		case buf[pos] == '\n':
+			pos++
+			err = ErrBareLF
+		case buf[pos] == '\r' && pos+1 == len(buf):
+			return -1, nil
+		default:
+			return salvage(buf, pos), ErrInvalidChunk
+		}
+	}
+}
+
+// salvage returns the position of the next message of the buffer, starting at a line from the position from,
+// or the length of the buffer if there is none. the message at the start of the buffer is the one salvaged.
+func salvage(buf []byte, from int) int {
+	for i := from; i < len(buf); {
+		if request, response := LenientTitle(buf[i:]); i > 0 && (request || response) {
+			return i
+		}
+		nl := bytes.IndexByte(buf[i:], '\n')
+		if nl == -1 {
+			break
+		}
+		i += nl + 1
+	}
+	return len(buf)
 }
 
 // this works with positive integers
@@ -2,10 +2,21 @@ package proto
 
 import (
 	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/binary"
 	"fmt"
+	"hash/crc32"
 	"reflect"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/net/http2/hpack"
 )
 
 func TestHeader(t *testing.T) {
@@ -413,7 +424,7 @@ func TestHasFullPayload(t *testing.T) {
 	}
 
 	// check chunks with trailers
-	m = "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nTransfer-Encoding: chunked\r\nTrailer: Expires\r\n\r\n7\r\nMozilla\r\n9\r\nDeveloper\r\n7\r\nNetwork\r\n0\r\n\r\nExpires: Wed, 21 Oct 2015 07:28:00 GMT\r\n\r\n"
+	m = "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nTransfer-Encoding: chunked\r\nTrailer: Expires\r\n\r\n7\r\nMozilla\r\n9\r\nDeveloper\r\n7\r\nNetwork\r\n0\r\nExpires: Wed, 21 Oct 2015 07:28:00 GMT\r\n\r\n"
 	got = HasFullPayload([]byte(m))
 	expected = true
 	if got != expected {
@@ -421,7 +432,7 @@ func TestHasFullPayload(t *testing.T) {
 	}
 
 	// check with missing trailers
-	m = "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nTransfer-Encoding: chunked\r\nTrailer: Expires\r\n\r\n7\r\nMozilla\r\n9\r\nDeveloper\r\n7\r\nNetwork\r\n0\r\n\r\nExpires: Wed, 21 Oct 2015 07:28:00"
+	m = "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nTransfer-Encoding: chunked\r\nTrailer: Expires\r\n\r\n7\r\nMozilla\r\n9\r\nDeveloper\r\n7\r\nNetwork\r\n0\r\nExpires: Wed, 21 Oct 2015 07:28:00"
 	got = HasFullPayload([]byte(m))
 	expected = false
 	if got != expected {
@@ -453,6 +464,77 @@ func TestHasFullPayload(t *testing.T) {
 	}
 }
 
+func TestMessageLength(t *testing.T) {
+	for _, tt := range []struct {
+		payload  string
+		expected int
+	}{
+		{"GET / HTTP/1.1\r\nHost: a\r\n\r\nGET /b HTTP/1.1\r\nHost: a\r\n\r\n", 27},
+		{"POST / HTTP/1.1\r\nContent-Length: 7\r\n\r\nNetworkGET / HTTP/1.1\r\n", 45},
+		{"POST / HTTP/1.1\r\nContent-Length: 7\r\n\r\nNet", -1},
+		{"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n7\r\nNetwork\r\n0\r\n\r\nHTTP/1.1 200 OK\r\nContent-Length: 1\r\n\r\n1", 64},
+		{"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\nTrailer: Expires\r\n\r\n7\r\nNetwork\r\n0\r\nExpires: 0\r\n\r\n", 94},
+		{"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n7\r\nNetwork\r\n0\r\nGrpc-Status: 0\r\n\r\nHTTP/1.1 200 OK\r\n", 80},
+		{"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n7\r\nNetwork\r\n", -1},
+		{"GET / HTTP/1.1\r\nHost: a\r\n", -1},
+		// the body ends with the connection
+		{"HTTP/1.0 200 OK\r\nContent-Type: text/plain\r\n\r\nNetwork", -1},
+		{"HTTP/1.1 200 OK\r\nConnection: Close\r\n\r\nNetwork", -1},
+		{"HTTP/1.0 200 OK\r\nConnection: keep-alive\r\n\r\n", 43},
+		{"HTTP/1.0 304 Not Modified\r\n\r\n", 29},
+		{"HTTP/1.1 200 OK\r\n\r\n", 19},
+		{"GET / HTTP/1.0\r\nConnection: close\r\n\r\n", 37},
+	} {
+		if got := MessageLength([]byte(tt.payload)); got != tt.expected {
+			t.Errorf("expected %d to equal %d, payload: %q", got, tt.expected, tt.payload)
+		}
+	}
+}
+
+func TestTrailers(t *testing.T) {
+	for _, tt := range []struct {
+		payload  string
+		expected string
+	}{
+		{"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n7\r\nNetwork\r\n0\r\nGrpc-Status: 0\r\nGrpc-Message: ok\r\n\r\n", "Grpc-Status: 0\r\nGrpc-Message: ok\r\n\r\n"},
+		{"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n7\r\nNetwork\r\n0\r\n\r\n", ""},
+		{"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n7\r\nNetwork\r\n0\r\nGrpc-Status: 0\r\n", ""},
+		{"HTTP/1.1 200 OK\r\nContent-Length: 20\r\n\r\n0\r\nGrpc-Status: 0\r\n\r\n", ""},
+	} {
+		if got := Trailers([]byte(tt.payload)); string(got) != tt.expected {
+			t.Errorf("expected trailers %q, got %q, payload: %q", tt.expected, got, tt.payload)
+		}
+	}
+	var status []byte
+	ParseHeaders([][]byte{Trailers([]byte("POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n0\r\ngrpc-status: 14\r\n\r\n"))}, func(header, value []byte) {
+		if string(header) == "Grpc-Status" {
+			status = value
+		}
+	})
+	if string(status) != "14" {
+		t.Errorf("expected the grpc-status trailer to be 14, got %q", status)
+	}
+}
+
+func TestIsChunkedEnd(t *testing.T) {
+	for _, tt := range []struct {
+		data     string
+		expected bool
+	}{
+		{"0\r\n\r\n", true},
+		{"ork\r\n0\r\n\r\n", true},
+		{"ork\r\n0\r\nGrpc-Status: 0\r\nGrpc-Message: ok\r\n\r\n", true},
+		{"ork\r\n0\r\nGrpc-Status: 0\r\n", false},
+		{"\r\nGrpc-Status: 0\r\n\r\n", false},
+		{"7\r\nNetwork\r\n", false},
+		{"tus: 0\r\n\r\n", false},
+	} {
+		if got := IsChunkedEnd([]byte(tt.data)); got != tt.expected {
+			t.Errorf("expected %v, got %v for %q", tt.expected, got, tt.data)
+		}
+	}
+}
+
 func BenchmarkHasFullPayload(b *testing.B) {
 	now := time.Now()
 	payload := make([]byte, 0xfc00)
@@ -479,3 +561,1142 @@ func BenchmarkHasFullPayload(b *testing.B) {
 	}
 	b.Logf("%dKB chunks in %s", b.N*64, time.Since(now))
 }
+
+func TestHTTP2Frames(t *testing.T) {
+	// a padded HEADERS frame with priority
+	payload := append([]byte{2, 0, 0, 0, 0, 16}, "block"...)
+	payload = append(payload, 0, 0)
+	data := AppendHTTP2Frame(nil, HTTP2Frame{Type: HTTP2FrameHeaders, Flags: HTTP2FlagPadded | HTTP2FlagPriority, Stream: 3, Payload: payload})
+	data = AppendHTTP2Frame(data, HTTP2Frame{Type: HTTP2FrameData, Stream: 3, Payload: []byte("body")})
+	if n := HTTP2FramesLength(data[:len(data)-1]); n != HTTP2FrameHeaderLen+len(payload) {
+		t.Errorf("expected the length of the first frame, got %d", n)
+	}
+	if n := HTTP2FramesLength(append(append([]byte(nil), HTTP2Preface...), data...)); n != len(HTTP2Preface) {
+		t.Errorf("expected the length of the preface, got %d", n)
+	}
+	f, n := ParseHTTP2Frame(data)
+	if n != HTTP2FrameHeaderLen+len(payload) || f.Type != HTTP2FrameHeaders || f.Stream != 3 {
+		t.Fatalf("unexpected frame %+v", f)
+	}
+	if frag, err := f.Fragment(); err != nil || string(frag) != "block" {
+		t.Errorf("expected the header block fragment, got %q, %v", frag, err)
+	}
+	f.Payload = f.Payload[:3]
+	if _, err := f.Fragment(); err != ErrHTTP2Frame {
+		t.Errorf("expected %v, got %v", ErrHTTP2Frame, err)
+	}
+}
+
+func TestHTTP2Message(t *testing.T) {
+	fields, body, err := HTTP2Request([]byte("POST /post?a=1 HTTP/1.1\r\nHost: example.com\r\nConnection: keep-alive\r\n"+
+		"Transfer-Encoding: chunked\r\nCookie: a=1\r\n\r\n4\r\nWiki\r\n0\r\n\r\n"), "http")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []hpack.HeaderField{
+		{Name: ":method", Value: "POST"}, {Name: ":scheme", Value: "http"}, {Name: ":path", Value: "/post?a=1"},
+		{Name: ":authority", Value: "example.com"}, {Name: "cookie", Value: "a=1"}, {Name: "content-length", Value: "4"},
+	}
+	if !reflect.DeepEqual(fields, expected) || string(body) != "Wiki" {
+		t.Errorf("expected %v and %q, got %v and %q", expected, "Wiki", fields, body)
+	}
+
+	fields = append(fields, hpack.HeaderField{Name: "cookie", Value: "b=2"})
+	msg := HTTP2Message(fields, body)
+	if string(msg) != "POST /post?a=1 HTTP/1.1\r\nHost: example.com\r\nContent-Length: 4\r\nCookie: a=1; b=2\r\n\r\nWiki" {
+		t.Errorf("unexpected request %q", msg)
+	}
+	msg = HTTP2Message([]hpack.HeaderField{{Name: ":status", Value: "404"}, {Name: "server", Value: "test"}}, []byte("nope"))
+	if string(msg) != "HTTP/1.1 404 Not Found\r\nServer: test\r\nContent-Length: 4\r\n\r\nnope" || !HasResponseTitle(msg) {
+		t.Errorf("unexpected response %q", msg)
+	}
+	if HTTP2Message([]hpack.HeaderField{{Name: "server", Value: "test"}}, nil) != nil {
+		t.Error("expected no message without :method or :status")
+	}
+}
+
+func TestGRPC(t *testing.T) {
+	req := []byte("POST /users.v1.UserService/Get HTTP/1.1\r\nHost: users:50051\r\nContent-Type: application/grpc\r\n\r\n")
+	if m := GRPCMethod(req); string(m) != "/users.v1.UserService/Get" {
+		t.Errorf("expected the method of the call, got %q", m)
+	}
+	if m := GRPCMethod([]byte("POST /users.v1.UserService/Get HTTP/1.1\r\nContent-Type: application/json\r\n\r\n")); m != nil {
+		t.Errorf("expected no method, got %q", m)
+	}
+	if !IsGRPC([]byte("HTTP/1.1 200 OK\r\nContent-Type: application/grpc+proto\r\n\r\n")) {
+		t.Error("expected a gRPC response")
+	}
+
+	body := []byte("\x00\x00\x00\x00\x03abc\x01\x00\x00\x00\x00")
+	if lengths, ok := GRPCMessages(body); !ok || !reflect.DeepEqual(lengths, []int{3, 0}) {
+		t.Errorf("expected [3 0], got %v(%v)", lengths, ok)
+	}
+	if lengths, ok := GRPCMessages(body[:7]); ok || !reflect.DeepEqual(lengths, []int(nil)) {
+		t.Errorf("expected an incomplete message, got %v(%v)", lengths, ok)
+	}
+
+	fields, _, err := HTTP2Request([]byte("POST /users.v1.UserService/Get HTTP/1.1\r\nHost: users:50051\r\nContent-Type: application/grpc\r\nContent-Length: 0\r\n\r\n"), "http")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f := fields[len(fields)-1]; f.Name != "te" || f.Value != "trailers" {
+		t.Errorf("expected the te header in %v", fields)
+	}
+}
+
+func TestWebSocketFrames(t *testing.T) {
+	key := [4]byte{1, 2, 3, 4}
+	for _, length := range []int{5, 200, 70000} {
+		payload := bytes.Repeat([]byte("a"), length)
+		data := AppendWebSocketFrame(nil, WebSocketFrame{Fin: true, Rsv: 4, Opcode: WebSocketText, Masked: true, Key: key, Payload: payload})
+		if n := WebSocketFramesLength(data[:len(data)-1]); n != -1 {
+			t.Errorf("expected an incomplete frame, got %d", n)
+		}
+		f, n := ParseWebSocketFrame(append(data, 0x89, 0))
+		if n != len(data) || !f.Fin || f.Rsv != 4 || f.Opcode != WebSocketText || !f.Masked || f.Key != key {
+			t.Errorf("unexpected frame %+v(%d bytes)", f, n)
+		}
+		if bytes.Equal(f.Payload, payload) || !bytes.Equal(f.Unmask(), payload) {
+			t.Errorf("expected the payload of %d bytes to be masked", length)
+		}
+	}
+	data := AppendWebSocketFrame(nil, WebSocketFrame{Opcode: WebSocketBinary, Payload: []byte("ab")})
+	data = AppendWebSocketFrame(data, WebSocketFrame{Fin: true, Opcode: WebSocketPing})
+	if n := WebSocketFramesLength(data); n != 6 {
+		t.Errorf("expected the length of both frames, got %d", n)
+	}
+	if f, _ := ParseWebSocketFrame(data[4:]); !f.IsControl() {
+		t.Error("expected a control frame")
+	}
+
+	// https://tools.ietf.org/html/rfc6455#section-1.3
+	if accept := WebSocketAccept([]byte("dGhlIHNhbXBsZSBub25jZQ==")); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("unexpected accept value %s", accept)
+	}
+	if !IsWebSocketUpgrade([]byte("GET /chat HTTP/1.1\r\nHost: example.com\r\nUpgrade: WebSocket\r\nConnection: Upgrade\r\n\r\n")) {
+		t.Error("expected an upgrade request")
+	}
+	if IsWebSocketUpgrade([]byte("GET /chat HTTP/1.1\r\nHost: example.com\r\nUpgrade: h2c\r\n\r\n")) {
+		t.Error("expected no WebSocket upgrade")
+	}
+}
+
+func TestTLSRecords(t *testing.T) {
+	records := []byte{TLSHandshake, 3, 1, 0, 2, 1, 0, TLSApplicationData, 3, 3, 0, 1, 'a'}
+	r, n := ParseTLSRecord(records)
+	if n != 7 || r.Type != TLSHandshake || r.Version != 0x0301 || !bytes.Equal(r.Fragment, []byte{1, 0}) {
+		t.Errorf("unexpected record %+v of length %d", r, n)
+	}
+	if n := TLSRecordsLength(records); n != len(records) {
+		t.Errorf("expected %d, got %d", len(records), n)
+	}
+	if n := TLSRecordsLength(records[:len(records)-1]); n != 7 {
+		t.Errorf("expected the incomplete record to be left, got %d", n)
+	}
+	if n := TLSRecordsLength([]byte("GET / HTTP/1.1\r\n")); n != -1 {
+		t.Errorf("expected no record, got %d", n)
+	}
+}
+
+func TestQUICFrames(t *testing.T) {
+	// https://www.rfc-editor.org/rfc/rfc9000.html#appendix-A.1
+	for _, tt := range []struct {
+		data []byte
+		v    uint64
+	}{
+		{[]byte{0xc2, 0x19, 0x7c, 0x5e, 0xff, 0x14, 0xe8, 0x8c}, 151288809941952652},
+		{[]byte{0x9d, 0x7f, 0x3e, 0x7d}, 494878333},
+		{[]byte{0x7b, 0xbd}, 15293},
+		{[]byte{0x25}, 37},
+	} {
+		if v, n := QUICVarint(tt.data); v != tt.v || n != len(tt.data) {
+			t.Errorf("expected %d of %d bytes, got %d of %d bytes", tt.v, len(tt.data), v, n)
+		}
+		if b := AppendQUICVarint(nil, tt.v); !bytes.Equal(b, tt.data) {
+			t.Errorf("expected %d to be encoded as %x, got %x", tt.v, tt.data, b)
+		}
+	}
+	if _, n := QUICVarint([]byte{0x9d, 0x7f}); n != 0 {
+		t.Error("expected an incomplete varint")
+	}
+
+	var payload []byte
+	payload = append(payload, 0x03, 10, 0, 1, 2, 3, 4, 1, 2, 3) // ACK_ECN with a range
+	payload = append(payload, 0, 0)                             // PADDING
+	payload = append(payload, 0x18, 1, 0, 2, 0xaa, 0xbb)        // NEW_CONNECTION_ID
+	payload = append(payload, make([]byte, 16)...)
+	payload = append(payload, 0x1c, 0, 0, 2, 'n', 'o') // CONNECTION_CLOSE
+	payload = append(payload, 0x0d, 4, 0x40, 100, 'e', 'n', 'd')
+	var frames []QUICFrame
+	for len(payload) > 0 {
+		f, n := ParseQUICFrame(payload)
+		if n == 0 {
+			t.Fatalf("expected a frame at %x", payload)
+		}
+		frames = append(frames, f)
+		payload = payload[n:]
+	}
+	if len(frames) != 6 {
+		t.Fatalf("expected 6 frames, got %d", len(frames))
+	}
+	if f := frames[5]; f.Type != 0x0d || f.Stream != 4 || f.Offset != 100 || !f.Fin || string(f.Data) != "end" {
+		t.Errorf("unexpected STREAM frame %+v", f)
+	}
+	if _, n := ParseQUICFrame([]byte{0x06, 0, 5, 'a'}); n != 0 {
+		t.Error("expected an incomplete CRYPTO frame")
+	}
+
+	// an Initial packet of QUIC version 2, followed by a short header packet
+	packet := []byte{0xd0, 0x6b, 0x33, 0x43, 0xcf, 2, 'd', 'c', 1, 's', 1, 't', 3, 0, 0, 0}
+	h, ok := ParseQUICHeader(append(packet, 0x40, 'x', 'y'), 0)
+	if !ok || !h.Long || h.Type != QUICInitial || h.Version != QUICVersion2 || string(h.DCID) != "dc" || string(h.SCID) != "s" ||
+		string(h.Token) != "t" || h.PNOffset != 13 || h.Length != len(packet) {
+		t.Errorf("unexpected header %+v", h)
+	}
+	if h, ok = ParseQUICHeader([]byte{0x40, 'x', 'y', 0}, 2); !ok || h.Long || string(h.DCID) != "xy" || h.PNOffset != 3 {
+		t.Errorf("unexpected short header %+v", h)
+	}
+}
+
+func TestQPACK(t *testing.T) {
+	var d QPACKDecoder
+	d.MaxCapacity = 4096
+	// set the capacity, insert a static name with a value, split across two calls, and a literal name
+	instructions := []byte{0x3f, 0xe1, 0x1f, 0xc0 | 0x00, 4, 'h', 'o', 's', 't'}
+	instructions = append(instructions, 0x40|0x20|byte(len(hpack.AppendHuffmanString(nil, "x-id"))))
+	instructions = append(hpack.AppendHuffmanString(instructions, "x-id"), 1, '7')
+	instructions = append(instructions, 0x00) // duplicate of x-id
+	if err := d.Encoder(instructions[:5]); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Encoder(instructions[5:]); err != nil {
+		t.Fatal(err)
+	}
+	if d.inserts != 3 {
+		t.Fatalf("expected 3 insertions, got %d", d.inserts)
+	}
+	// a base of 1: the entry 0 is relative, the entries 1 and 2 are post-base
+	section := []byte{4, 0x81, 0xd1, 0x80, 0x10, 0x01 | 0x10, 0x00, 1, 'v', 0x20 | 0x08 | byte(len(hpack.AppendHuffmanString(nil, "name")))}
+	section = append(hpack.AppendHuffmanString(section, "name"), 5, 'v', 'a', 'l', 'u', 'e')
+	fields, err := d.Decode(section)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []hpack.HeaderField{
+		{Name: ":method", Value: "GET"},
+		{Name: ":authority", Value: "host"},
+		{Name: "x-id", Value: "7"},
+		{Name: "x-id", Value: "7"},
+		{Name: "x-id", Value: "v"},
+		{Name: "name", Value: "value"},
+	}
+	if !reflect.DeepEqual(fields, expected) {
+		t.Errorf("expected %v, got %v", expected, fields)
+	}
+	if _, err = d.Decode([]byte{5, 0, 0x80}); err != ErrQPACKBlocked {
+		t.Errorf("expected a blocked section, got %v", err)
+	}
+	if _, err = d.Decode([]byte{0, 0, 0xff, 0x7f}); err != ErrQPACKInvalid {
+		t.Errorf("expected an invalid static index, got %v", err)
+	}
+}
+
+func TestMySQLPackets(t *testing.T) {
+	long := bytes.Repeat([]byte{'a'}, MySQLMaxPayload+3)
+	data := AppendMySQLPacket(nil, 0, long)
+	data = AppendMySQLPacket(data, 0, []byte{MySQLComPing})
+	if n := MySQLPacketLength(data[:len(data)-6]); n != -1 {
+		t.Errorf("expected an incomplete packet, got %d", n)
+	}
+	payload, seq, n := MySQLPacket(data)
+	if !bytes.Equal(payload, long) || seq != 0 || n != len(long)+2*MySQLPacketHeaderLen {
+		t.Errorf("unexpected packet of %d bytes, seq %d, length %d", len(payload), seq, n)
+	}
+	if payload, seq, _ = MySQLPacket(data[n:]); !bytes.Equal(payload, []byte{MySQLComPing}) || seq != 0 {
+		t.Errorf("unexpected packet %x, seq %d", payload, seq)
+	}
+	// a payload of the maximum length is followed by an empty packet
+	if data = AppendMySQLPacket(nil, 3, long[:MySQLMaxPayload]); len(data) != MySQLMaxPayload+2*MySQLPacketHeaderLen || data[len(data)-1] != 4 {
+		t.Errorf("expected an empty packet to end the payload")
+	}
+
+	for _, v := range []uint64{0, 250, 251, 1<<16 - 1, 1 << 16, 1 << 24, 1 << 40} {
+		enc := AppendMySQLLenEnc(nil, v)
+		if got, n := MySQLLenEnc(enc); got != v || n != len(enc) {
+			t.Errorf("expected %d, got %d of length %d", v, got, n)
+		}
+		if _, n := MySQLLenEnc(enc[:len(enc)-1]); n != 0 && len(enc) > 1 {
+			t.Errorf("expected %x to be incomplete", enc[:len(enc)-1])
+		}
+	}
+}
+
+func TestMySQLHandshake(t *testing.T) {
+	h := MySQLHandshake{
+		ServerVersion: "8.0.36",
+		ConnectionID:  42,
+		Capabilities:  MySQLClientProtocol41 | MySQLClientSecureConnection | MySQLClientPluginAuth | MySQLClientDeprecateEOF,
+		Charset:       255,
+		AuthData:      []byte("abcdefghijklmnopqrst"),
+		AuthPlugin:    "caching_sha2_password",
+	}
+	got, ok := ParseMySQLHandshake(AppendMySQLHandshake(nil, h))
+	if !ok || !reflect.DeepEqual(got, h) {
+		t.Errorf("expected %+v, got %+v", h, got)
+	}
+
+	r := MySQLHandshakeResponse{
+		Capabilities:  MySQLClientProtocol41 | MySQLClientSecureConnection | MySQLClientPluginAuthLenencData | MySQLClientConnectWithDB | MySQLClientPluginAuth | MySQLClientConnectAttrs,
+		MaxPacketSize: 1 << 24,
+		Charset:       45,
+		User:          "app",
+		AuthResponse:  []byte{1, 2, 3},
+		Database:      "shop",
+		AuthPlugin:    "mysql_native_password",
+		Attributes:    []byte("\x04_pid\x0242"),
+	}
+	payload := AppendMySQLHandshakeResponse(nil, r)
+	if got, ok := ParseMySQLHandshakeResponse(payload); !ok || !reflect.DeepEqual(got, r) {
+		t.Errorf("expected %+v, got %+v", r, got)
+	}
+	// SSLRequest
+	if _, ok := ParseMySQLHandshakeResponse(payload[:32]); ok {
+		t.Errorf("expected a truncated response to be rejected without CLIENT_SSL")
+	}
+	ssl := append([]byte(nil), payload[:32]...)
+	ssl[1] |= byte(MySQLClientSSL >> 8)
+	if _, ok := ParseMySQLHandshakeResponse(ssl); !ok {
+		t.Errorf("expected a SSLRequest")
+	}
+}
+
+func TestMySQLResponse(t *testing.T) {
+	column := AppendMySQLLenEnc([]byte("\x03def"), 0)
+	eof := []byte{0xfe, 0, 0, 2, 0}
+	more := []byte{0xfe, 0, 0, 0x0a, 0}
+	tests := []struct {
+		name         string
+		command      byte
+		deprecateEOF bool
+		packets      [][]byte
+		err, infile  bool
+	}{
+		{"ok", MySQLComQuery, false, [][]byte{{0, 1, 0, 2, 0, 0, 0}}, false, false},
+		{"err", MySQLComStmtExecute, false, [][]byte{[]byte("\xff\x19\x04#42000syntax error")}, true, false},
+		{"infile", MySQLComQuery, false, [][]byte{[]byte("\xfb/tmp/data.csv")}, false, true},
+		{"result set", MySQLComQuery, false, [][]byte{{1}, column, eof, []byte("\x011"), []byte("\x012"), eof}, false, false},
+		{"deprecate eof", MySQLComQuery, true, [][]byte{{1}, column, []byte("\x011"), {0xfe, 0, 0, 2, 0, 0, 0}}, false, false},
+		{"multiple results", MySQLComQuery, false, [][]byte{{0, 0, 0, 0x0a, 0, 0, 0}, {1}, column, eof, []byte("\x011"), more, {0, 0, 0, 2, 0, 0, 0}}, false, false},
+		{"prepare", MySQLComStmtPrepare, false, [][]byte{{0, 7, 0, 0, 0, 1, 0, 2, 0, 0, 0, 0}, column, column, eof, column, eof}, false, false},
+		{"prepare without columns", MySQLComStmtPrepare, true, [][]byte{{0, 7, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0}, column}, false, false},
+		{"field list", MySQLComFieldList, false, [][]byte{column, column, eof}, false, false},
+		{"fetch", MySQLComStmtFetch, false, [][]byte{{0, 0, 1}, {0, 0, 2}, more}, false, false},
+		{"ping", MySQLComPing, false, [][]byte{{0, 0, 0, 2, 0, 0, 0}}, false, false},
+	}
+	for _, tt := range tests {
+		r := MySQLResponse{Command: tt.command, DeprecateEOF: tt.deprecateEOF}
+		for i, p := range tt.packets {
+			if done := r.Packet(p); done != (i == len(tt.packets)-1) {
+				t.Errorf("%s: expected the response to end with its packet %d, it ended at %d", tt.name, len(tt.packets)-1, i)
+				break
+			}
+		}
+		if r.Err != tt.err || r.Infile != tt.infile {
+			t.Errorf("%s: unexpected response %+v", tt.name, r)
+		}
+		if tt.command == MySQLComStmtPrepare && r.StatementID != 7 {
+			t.Errorf("%s: expected the statement 7, got %d", tt.name, r.StatementID)
+		}
+	}
+}
+
+func TestMySQLQueryAttributes(t *testing.T) {
+	query := []byte("\x03\x01\x01\x00\x01\xfe\x00\x01a\x01xSELECT 1")
+	if got, ok := MySQLQuery(query, true); !ok || string(got) != "SELECT 1" {
+		t.Errorf("expected the query without its attributes, got %q", got)
+	}
+	if got, ok := MySQLQuery([]byte("\x03SELECT 1"), false); !ok || string(got) != "SELECT 1" {
+		t.Errorf("expected the query, got %q", got)
+	}
+
+	// a parameter and an attribute
+	execute := []byte("\x17\x01\x00\x00\x00\x08\x01\x00\x00\x00\x02\x00\x01\x08\x00\x00\xfe\x00\x01a\x2a\x00\x00\x00\x00\x00\x00\x00\x01x")
+	expected := []byte("\x17\x01\x00\x00\x00\x00\x01\x00\x00\x00\x00\x01\x08\x00\x2a\x00\x00\x00\x00\x00\x00\x00")
+	if got, ok := MySQLExecuteWithoutAttributes(execute, 1); !ok || !bytes.Equal(got, expected) {
+		t.Errorf("expected %x, got %x", expected, got)
+	}
+	// the types of the attributes are unknown when they are not bound
+	execute = []byte("\x17\x01\x00\x00\x00\x08\x01\x00\x00\x00\x02\x00\x00\x2a\x00\x00\x00\x00\x00\x00\x00\x01x")
+	if _, ok := MySQLExecuteWithoutAttributes(execute, 1); ok {
+		t.Errorf("expected the attributes not to be removed")
+	}
+}
+
+func TestPostgresMessages(t *testing.T) {
+	startup := AppendPostgresStartup(nil, "user", "app", "database", "shop")
+	if n := PostgresStartupLength(startup); n != len(startup) {
+		t.Errorf("expected a startup message of %d bytes, got %d", len(startup), n)
+	}
+	if params, ok := ParsePostgresStartup(startup); !ok || PostgresStartupParam(params, "database") != "shop" || len(params) != 4 {
+		t.Errorf("unexpected parameters %q", params)
+	}
+	if n := PostgresStartupLength([]byte{0, 0, 0, 8, 4, 210, 22, 47}); n != 8 {
+		t.Errorf("expected a SSLRequest, got %d", n)
+	}
+
+	data := AppendPostgresMessage(nil, PostgresParse, []byte("s1\x00SELECT $1\x00\x00\x00"))
+	bind := []byte("\x00s1\x00\x00\x01\x00\x00\x00\x02\x00\x00\x00\x03abc\xff\xff\xff\xff\x00\x00")
+	data = AppendPostgresMessage(data, PostgresBind, bind)
+	data = AppendPostgresMessage(data, PostgresSync, nil)
+	if !PostgresMessages(data) || PostgresMessages(data[:len(data)-1]) {
+		t.Errorf("expected the messages to be complete only with the Sync")
+	}
+	typ, body, n := PostgresMessage(data)
+	if query, ok := PostgresQueryText(typ, body); !ok || string(query) != "SELECT $1" {
+		t.Errorf("unexpected query %q", query)
+	}
+	typ, body, _ = PostgresMessage(data[n:])
+	if params, ok := PostgresBindParams(body); typ != PostgresBind || !ok || len(params) != 2 || string(params[0]) != "abc" || params[1] != nil {
+		t.Errorf("unexpected parameters %q", params)
+	}
+}
+
+func TestScrubSQL(t *testing.T) {
+	tests := []struct{ query, expected string }{
+		{"SELECT * FROM users WHERE email = 'jo.doe@example.com' AND id = 42", "SELECT * FROM users WHERE email = 'xx.xxx@xxxxxxx.xxx' AND id = 11"},
+		{"SELECT t1.a FROM t1 WHERE b = $1 -- 'kept'", "SELECT t1.a FROM t1 WHERE b = $1 -- 'kept'"},
+		{`SELECT "Col 2" FROM t WHERE s = 'it''s' /* 7 */ AND n = 3.14`, `SELECT "Col 2" FROM t WHERE s = 'xx''x' /* 7 */ AND n = 1.11`},
+		{`SELECT E'a\nb', $tag$secret 9$tag$`, `SELECT E'x\nx', $tag$xxxxxx 1$tag$`},
+	}
+	for _, tt := range tests {
+		query := []byte(tt.query)
+		ScrubSQL(query)
+		if string(query) != tt.expected {
+			t.Errorf("expected %q, got %q", tt.expected, query)
+		}
+	}
+}
+
+func TestRESP(t *testing.T) {
+	tests := []struct {
+		data   string
+		length int
+	}{
+		{"+OK\r\n", 5},
+		{"-ERR unknown\r\n", 14},
+		{":42\r\n", 5},
+		{"$5\r\nhello\r\n", 11},
+		{"$5\r\nhel", -1},
+		{"$-1\r\n", 5},
+		{"*2\r\n$3\r\nGET\r\n$1\r\nk\r\n", 20},
+		{"*2\r\n$3\r\nGET\r\n", -1},
+		{"*-1\r\n", 5},
+		{"_\r\n", 3},
+		{",3.14\r\n", 7},
+		{"#t\r\n", 4},
+		{"%1\r\n+key\r\n:1\r\n", 14},
+		{"~2\r\n:1\r\n:2\r\n", 12},
+		{">2\r\n+message\r\n+hi\r\n", 19},
+		{"|1\r\n+ttl\r\n:3\r\n$1\r\nv\r\n", 21},
+		{"$?\r\n;2\r\nab\r\n;0\r\n", 16},
+		{"*?\r\n:1\r\n.\r\n", 11},
+		{"PING\r\n", 6},
+		{"PING", -1},
+	}
+	for _, tt := range tests {
+		if n := RESPLength([]byte(tt.data + "+next\r\n")); tt.length > 0 && n != tt.length {
+			t.Errorf("%q: expected %d, got %d", tt.data, tt.length, n)
+		}
+		if n := RESPLength([]byte(tt.data)); n != tt.length {
+			t.Errorf("%q: expected %d, got %d", tt.data, tt.length, n)
+		}
+	}
+
+	command := AppendRESPCommand(nil, []byte("SET"), []byte("key"), []byte("a b"))
+	if string(command) != "*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$3\r\na b\r\n" {
+		t.Errorf("unexpected command %q", command)
+	}
+	if args, ok := RESPCommand(command); !ok || len(args) != 3 || string(args[2]) != "a b" {
+		t.Errorf("unexpected arguments %q", args)
+	}
+	if args, ok := RESPCommand([]byte("get key\r\n")); !ok || len(args) != 2 || string(args[0]) != "get" {
+		t.Errorf("unexpected arguments of the inline command %q", args)
+	}
+	if _, ok := RESPCommand([]byte("*1\r\n:1\r\n")); ok {
+		t.Error("expected an array of integers not to be a command")
+	}
+	if _, ok := RESPCommand([]byte("+OK\r\n")); ok {
+		t.Error("expected a reply not to be a command")
+	}
+}
+
+func TestMongoCommand(t *testing.T) {
+	find := BSONDoc(AppendBSONString(AppendBSONString(nil, "find", "users"), "$db", "shop"))
+	msg := AppendMongoMsg(nil, 7, find)
+	if n := MongoMessageLength(msg); n != len(msg) {
+		t.Errorf("expected a message of %d bytes, got %d", len(msg), n)
+	}
+	if n := MongoMessageLength(msg[:len(msg)-1]); n != -1 {
+		t.Errorf("expected an incomplete message, got %d", n)
+	}
+	if c, ok := ParseMongoCommand(msg); !ok || c != (MongoCommand{"find", "shop", "users"}) || c.Namespace() != "shop.users" {
+		t.Errorf("unexpected command %+v", c)
+	}
+	getMore := BSONDoc(AppendBSONString(AppendBSON(nil, BSONInt64, "getMore", make([]byte, 8)), "collection", "users"))
+	getMore = BSONDoc(AppendBSONString(getMore[4:len(getMore)-1], "$db", "shop"))
+	if c, ok := ParseMongoCommand(AppendMongoMsg(nil, 8, getMore)); !ok || c != (MongoCommand{"getMore", "shop", "users"}) {
+		t.Errorf("unexpected command %+v", c)
+	}
+
+	query := func(ns string, doc []byte) []byte {
+		body := append(append(make([]byte, 4), ns...), 0)
+		body = append(append(body, make([]byte, 8)...), doc...)
+		return AppendMongoMessage(nil, MongoHeader{RequestID: 1, OpCode: MongoOpQuery}, body)
+	}
+	isMaster := BSONDoc(AppendBSONInt32(nil, "isMaster", 1))
+	if c, ok := ParseMongoCommand(query("admin.$cmd", isMaster)); !ok || c != (MongoCommand{"isMaster", "admin", ""}) {
+		t.Errorf("unexpected command %+v", c)
+	}
+	wrapped := BSONDoc(AppendBSON(nil, BSONDocument, "$query", BSONDoc(AppendBSONString(nil, "count", "orders"))))
+	if c, ok := ParseMongoCommand(query("shop.$cmd", wrapped)); !ok || c != (MongoCommand{"count", "shop", "orders"}) {
+		t.Errorf("unexpected command %+v", c)
+	}
+	if c, ok := ParseMongoCommand(query("shop.orders", BSONDoc(nil))); !ok || c != (MongoCommand{"find", "shop", "orders"}) {
+		t.Errorf("unexpected command %+v", c)
+	}
+
+	// the reply
+	reply := AppendMongoMessage(nil, MongoHeader{RequestID: 2, ResponseTo: 7, OpCode: MongoOpMsg}, append(make([]byte, 5), BSONDoc(AppendBSON(nil, BSONDouble, "ok", []byte{0, 0, 0, 0, 0, 0, 0xf0, 0x3f}))...))
+	doc, ok := MongoMsgBody(reply)
+	typ, value, _ := BSONLookup(doc, "ok")
+	if n, _ := BSONNumber(typ, value); !ok || n != 1 {
+		t.Errorf("expected the reply to be ok, got %v", n)
+	}
+}
+
+func TestMongoDecompress(t *testing.T) {
+	plain := AppendMongoMsg(nil, 9, BSONDoc(AppendBSONString(AppendBSONString(nil, "insert", "logs"), "$db", "app")))
+	body := plain[MongoHeaderLen:]
+	var zlibbed bytes.Buffer
+	w := zlib.NewWriter(&zlibbed)
+	w.Write(body)
+	w.Close()
+	encoder, _ := zstd.NewWriter(nil)
+	compressed := map[byte][]byte{
+		MongoCompressorNoop:   body,
+		MongoCompressorSnappy: snappy.Encode(nil, body),
+		MongoCompressorZlib:   zlibbed.Bytes(),
+		MongoCompressorZstd:   encoder.EncodeAll(body, nil),
+	}
+	for compressor, data := range compressed {
+		b := make([]byte, 9)
+		binary.LittleEndian.PutUint32(b, uint32(MongoOpMsg))
+		binary.LittleEndian.PutUint32(b[4:], uint32(len(body)))
+		b[8] = compressor
+		msg := AppendMongoMessage(nil, MongoHeader{RequestID: 9, OpCode: MongoOpCompressed}, append(b, data...))
+		got, err := MongoDecompress(msg)
+		if err != nil || !bytes.Equal(got, plain) {
+			t.Errorf("compressor %d: expected %q, got %q(%v)", compressor, plain, got, err)
+		}
+		if c, ok := ParseMongoCommand(msg); !ok || c != (MongoCommand{"insert", "app", "logs"}) {
+			t.Errorf("compressor %d: unexpected command %+v", compressor, c)
+		}
+	}
+}
+
+func TestThriftMessage(t *testing.T) {
+	// getUser(1: string name, 2: list<i32> ids, 3: struct {1: bool}) in the strict binary protocol
+	binaryArgs := []byte("\x0b\x00\x01\x00\x00\x00\x03bob" + "\x0f\x00\x02\x08\x00\x00\x00\x02\x00\x00\x00\x01\x00\x00\x00\x02" + "\x0c\x00\x03\x02\x00\x01\x01\x00" + "\x00")
+	strict := append([]byte("\x80\x01\x00\x01\x00\x00\x00\x07getUser\x00\x00\x00\x2a"), binaryArgs...)
+	nonStrict := append([]byte("\x00\x00\x00\x07getUser\x01\x00\x00\x00\x2a"), binaryArgs...)
+	// the same call in the compact protocol, the bool of the nested struct is in its field header
+	compactArgs := []byte("\x18\x03bob" + "\x19\x25\x02\x04" + "\x1c\x11\x00" + "\x00")
+	compact := append([]byte("\x82\x21\x2a\x07getUser"), compactArgs...)
+	framed := make([]byte, 4, 4+len(compact))
+	binary.BigEndian.PutUint32(framed, uint32(len(compact)))
+	framed = append(framed, compact...)
+	reply := []byte("\x80\x01\x00\x02\x00\x00\x00\x07getUser\x00\x00\x00\x2a\x0b\x00\x00\x00\x00\x00\x02ok\x00")
+
+	tests := []struct {
+		name     string
+		data     []byte
+		protocol ThriftProtocol
+		typ      byte
+		framed   bool
+	}{
+		{"strict", strict, ThriftBinary, ThriftCall, false},
+		{"non strict", nonStrict, ThriftBinary, ThriftCall, false},
+		{"compact", compact, ThriftCompact, ThriftCall, false},
+		{"framed", framed, ThriftCompact, ThriftCall, true},
+		{"reply", reply, ThriftBinary, ThriftReply, false},
+	}
+	for _, tt := range tests {
+		m, _, ok := ParseThriftHeader(tt.data)
+		if !ok || m.Name != "getUser" || m.SeqID != 42 || m.Protocol != tt.protocol || m.Type != tt.typ || m.Framed != tt.framed {
+			t.Errorf("%s: unexpected header %+v", tt.name, m)
+		}
+		if n := ThriftMessageLength(append(tt.data, "next"...)); n != len(tt.data) {
+			t.Errorf("%s: expected a message of %d bytes, got %d", tt.name, len(tt.data), n)
+		}
+		for i := range tt.data {
+			if n := ThriftMessageLength(tt.data[:i]); n != -1 {
+				t.Errorf("%s: expected %d bytes to be incomplete, got %d", tt.name, i, n)
+				break
+			}
+		}
+	}
+	if _, _, ok := ParseThriftHeader([]byte("GET / HTTP/1.1\r\n\r\n")); ok {
+		t.Error("expected http not to be a thrift message")
+	}
+}
+
+func TestMQTT(t *testing.T) {
+	connect := AppendMQTTConnect(nil, MQTT5, "sensor-1", "user", "secret", 60)
+	typ, _, body, n := MQTTPacket(connect)
+	if typ != MQTTConnect || n != len(connect) || MQTTPacketLength(connect[:n-1]) != -1 {
+		t.Fatalf("expected a CONNECT packet of %d bytes, got %d(type %d)", len(connect), n, typ)
+	}
+	if c, ok := ParseMQTTConnect(body); !ok || c.Version != MQTT5 || c.ClientID != "sensor-1" {
+		t.Errorf("expected the CONNECT of sensor-1, got %+v", c)
+	}
+	_, _, body, _ = MQTTPacket(AppendMQTTConnect(nil, MQTT31, "sensor-2", "", "", 0))
+	if c, ok := ParseMQTTConnect(body); !ok || c.Version != MQTT31 || c.ClientID != "sensor-2" {
+		t.Errorf("expected the MQTT 3.1 CONNECT of sensor-2, got %+v", c)
+	}
+
+	// a remaining length of 2 bytes
+	p := MQTTPublishPacket{Topic: "a/b", QoS: 2, Retain: true, PacketID: 9, Properties: []byte{0x01, 1, 0x26, 0, 1, 'k', 0, 1, 'v'}, Payload: bytes.Repeat([]byte("x"), 200)}
+	for _, version := range []byte{MQTT311, MQTT5} {
+		data := AppendMQTTPublish(nil, p, version)
+		typ, flags, body, n := MQTTPacket(data)
+		if typ != MQTTPublish || n != len(data) || flags != 0x05 {
+			t.Fatalf("expected a PUBLISH packet of %d bytes, got %d(type %d, flags %x)", len(data), n, typ, flags)
+		}
+		got, ok := ParseMQTTPublish(flags, body, version)
+		expected := p
+		if version != MQTT5 {
+			expected.Properties = nil
+		}
+		if !ok || !reflect.DeepEqual(got, expected) {
+			t.Errorf("%d: expected %+v, got %+v", version, expected, got)
+		}
+	}
+	if without := MQTTWithoutProperty(p.Properties, 0x26); !bytes.Equal(without, []byte{0x01, 1}) {
+		t.Errorf("expected the user property to be removed, got %x", without)
+	}
+	if _, ok := ParseMQTTPublish(0, []byte("\x00\x01a\x02\x7f\x00"), MQTT5); ok {
+		t.Error("expected an unknown property to be rejected")
+	}
+
+	topics := []struct {
+		filter, topic string
+		match         bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/+", "a/b", true},
+		{"a/+", "a/b/c", false},
+		{"a/#", "a", true},
+		{"a/#", "a/b/c", true},
+		{"#", "a/b", true},
+		{"+/+", "/b", true},
+		{"#", "$SYS/load", false},
+		{"$SYS/#", "$SYS/load", true},
+		{"a/b", "a/c", false},
+	}
+	for _, tt := range topics {
+		if MatchMQTTTopic(tt.filter, tt.topic) != tt.match {
+			t.Errorf("expected %q to match %q %v", tt.filter, tt.topic, tt.match)
+		}
+	}
+}
+
+func TestAMQP(t *testing.T) {
+	p := AMQPPublishCommand{Channel: 3, Exchange: "orders", RoutingKey: "order.created", Mandatory: true,
+		Properties: []byte{0x80, 0x00, 16, 'a', 'p', 'p', 'l', 'i', 'c', 'a', 't', 'i', 'o', 'n', '/', 'j', 's', 'o', 'n'},
+		Body:       bytes.Repeat([]byte("x"), 20)}
+	data := AppendAMQPPublish(nil, p, 16)
+	// the method, the content header and 3 body frames
+	var frames []byte
+	for rest := data; len(rest) > 0; {
+		typ, channel, _, n := AMQPFrame(rest)
+		if n == 0 || channel != 3 || AMQPFrameLength(rest) != n {
+			t.Fatalf("expected a frame of the channel 3 at %q", rest)
+		}
+		frames = append(frames, typ)
+		rest = rest[n:]
+	}
+	if !bytes.Equal(frames, []byte{AMQPFrameMethod, AMQPFrameHeader, AMQPFrameBody, AMQPFrameBody, AMQPFrameBody}) {
+		t.Errorf("expected a method, a header and 3 body frames, got %v", frames)
+	}
+	got, ok := ParseAMQPPublish(data)
+	if !ok || !reflect.DeepEqual(got, p) {
+		t.Errorf("expected %+v, got %+v", p, got)
+	}
+	if _, ok := ParseAMQPPublish(data[:len(data)-9]); ok {
+		t.Error("expected a publish without its last body frame to be incomplete")
+	}
+	if AMQPFrameLength([]byte(AMQPProtocolHeader+"\x01")) != 8 || AMQPFrameLength([]byte("AMQP")) != -1 {
+		t.Error("expected the protocol header to be split")
+	}
+	if _, _, _, n := AMQPFrame([]byte("\x01\x00\x00\x00\x00\x00\x00\x00")); n != 0 {
+		t.Error("expected a frame without its end to be rejected")
+	}
+}
+
+func TestDNS(t *testing.T) {
+	// a response to www.example.com A, with compressed names
+	data := []byte("\x12\x34\x81\x80\x00\x01\x00\x02\x00\x00\x00\x00" +
+		"\x03www\x07Example\x03com\x00\x00\x01\x00\x01" +
+		"\xc0\x0c\x00\x05\x00\x01\x00\x00\x00\x3c\x00\x06\x03web\xc0\x10" +
+		"\xc0\x2d\x00\x01\x00\x01\x00\x00\x00\x3c\x00\x04\x5d\xb8\xd8\x22")
+	m, ok := ParseDNS(data)
+	if !ok {
+		t.Fatal("expected the response to be parsed")
+	}
+	if m.ID != 0x1234 || !m.Response || m.Rcode != 0 || len(m.Questions) != 1 || m.Questions[0].String() != "www.example.com. A" {
+		t.Errorf("unexpected header or question %+v", m)
+	}
+	answers := dnsAnswers(m)
+	expected := []string{"web.example.com. A 93.184.216.34", "www.example.com. CNAME web.example.com."}
+	if !reflect.DeepEqual(answers, expected) {
+		t.Errorf("expected the answers %q, got %q", expected, answers)
+	}
+	// the names of the data are not compressed once parsed
+	if encoded, ok := ParseDNS(AppendDNS(nil, m)); !ok || !reflect.DeepEqual(dnsAnswers(encoded), expected) {
+		t.Errorf("expected the encoded response to have the same answers, got %q", dnsAnswers(encoded))
+	}
+	if _, ok := ParseDNS(data[:len(data)-1]); ok {
+		t.Error("expected a truncated response to be rejected")
+	}
+	if _, _, ok := dnsName([]byte("\xc0\x00"), 0); ok {
+		t.Error("expected a compression loop to be rejected")
+	}
+
+	replayed := m
+	replayed.Answers = []DNSRecord{m.Answers[1], m.Answers[0]}
+	replayed.Answers[0].TTL = 10
+	if diff := DNSDiff(m, replayed); diff != "" {
+		t.Errorf("expected the order and the TTLs of the answers to be ignored, got %q", diff)
+	}
+	replayed.Answers = replayed.Answers[1:]
+	if diff := DNSDiff(m, replayed); diff == "" {
+		t.Error("expected a missing answer to be a difference")
+	}
+	replayed.Rcode = 3
+	if diff := DNSDiff(m, replayed); diff != "rcode NOERROR, replayed NXDOMAIN" {
+		t.Errorf("expected the response codes to differ, got %q", diff)
+	}
+	if typ, ok := DNSType("aaaa"); !ok || typ != DNSTypeAAAA || DNSTypeName(99) != "TYPE99" {
+		t.Error("expected the record types to be named")
+	}
+}
+
+func TestSIP(t *testing.T) {
+	sdp := "v=0\r\no=alice 1 1 IN IP4 10.0.0.1\r\ns=-\r\nc=IN IP4 10.0.0.1\r\nt=0 0\r\n" +
+		"m=audio 49170 RTP/AVP 0\r\nm=video 0 RTP/AVP 31\r\nm=audio 49180 RTP/AVP 8\r\nc=IN IP4 10.0.0.9\r\n"
+	invite := "INVITE sip:bob@example.com SIP/2.0\r\n" +
+		"Via: SIP/2.0/UDP 10.0.0.1:5060;branch=z9hG4bK1\r\n" +
+		"f: <sip:alice@example.com>;tag=a1\r\n" +
+		"To: <sip:bob@example.com>\r\n" +
+		"i: call-1@10.0.0.1\r\n" +
+		"CSeq: 1 INVITE\r\n" +
+		"Subject: a folded\r\n header\r\n" +
+		"c: application/sdp\r\n" +
+		"l: " + strconv.Itoa(len(sdp)) + "\r\n\r\n" + sdp
+	data := []byte(invite + "\r\n\r\nSIP/2.0 100 Trying\r\n")
+	if n := SIPMessageLength(data); n != len(invite) {
+		t.Fatalf("expected the invite to be %d bytes, got %d", len(invite), n)
+	}
+	if n := SIPMessageLength(data[len(invite):]); n != 4 {
+		t.Errorf("expected the keep-alive to be 4 bytes, got %d", n)
+	}
+	if n := SIPMessageLength(data[:len(invite)-1]); n != -1 {
+		t.Errorf("expected the invite not to be complete, got %d", n)
+	}
+	m, ok := ParseSIP([]byte(invite))
+	if !ok || !m.IsRequest() || m.Method != "INVITE" || m.URI != "sip:bob@example.com" {
+		t.Fatalf("unexpected request %+v", m)
+	}
+	if seq, method := m.CSeq(); m.CallID() != "call-1@10.0.0.1" || seq != 1 || method != "INVITE" || m.Get("subject") != "a folded header" || SIPTag(m.Get("From")) != "a1" {
+		t.Errorf("unexpected headers %v", m.Header)
+	}
+	if media := SDPMedia(m.Body); !reflect.DeepEqual(media, []string{"10.0.0.1:49170", "10.0.0.9:49180"}) {
+		t.Errorf("unexpected media %v", media)
+	}
+
+	m, ok = ParseSIP([]byte("SIP/2.0 486 Busy Here\r\nCall-ID: x\r\nCSeq: 1 invite\r\nContent-Length: 0\r\n\r\n"))
+	if _, method := m.CSeq(); !ok || m.IsRequest() || m.Status != 486 || m.Reason != "Busy Here" || method != "INVITE" {
+		t.Errorf("unexpected response %+v", m)
+	}
+	for _, data := range []string{"GET / HTTP/1.1\r\n\r\n", "SIP/2.0 99 Odd\r\n\r\n", "invite sip:a SIP/2.0\r\n\r\n", "BYE sip:a SIP/2.0\r\nCall-ID: x\r\nContent-Length: 10\r\n\r\nshort"} {
+		if _, ok := ParseSIP([]byte(data)); ok {
+			t.Errorf("expected %q not to be parsed", data)
+		}
+	}
+
+	if v := SIPWithTag("\"Bob\" <sip:bob@example.com;transport=udp>;tag=b1;x=y", "b2"); v != "\"Bob\" <sip:bob@example.com;transport=udp>;tag=b2;x=y" {
+		t.Errorf("unexpected tagged header %q", v)
+	}
+	if v := SIPWithTag("sip:bob@example.com", "b2"); v != "sip:bob@example.com;tag=b2" || SIPTag(v) != "b2" {
+		t.Errorf("unexpected tagged header %q", v)
+	}
+	rewritten := RewriteSIPHeaders([]byte(invite), func(name, value string) string {
+		if name == "call-id" {
+			return "call-2"
+		}
+		return value
+	})
+	if m, ok := ParseSIP(rewritten); !ok || m.CallID() != "call-2" || string(m.Body) != sdp {
+		t.Errorf("unexpected rewritten message %q", rewritten)
+	}
+
+	rtp := []byte{0x80, 0x88, 0x01, 0x02, 0, 0, 0, 160, 0xde, 0xad, 0xbe, 0xef, 1, 2, 3}
+	if h, ok := ParseRTP(rtp); !ok || h.PayloadType != 8 || !h.Marker || h.Seq != 0x0102 || h.Timestamp != 160 || h.SSRC != 0xdeadbeef {
+		t.Errorf("unexpected rtp header %+v", h)
+	}
+	// a RTCP sender report
+	if _, ok := ParseRTP([]byte{0x80, 200, 0, 6, 0, 0, 0, 1, 0, 0, 0, 0}); ok {
+		t.Error("expected rtcp not to be taken for rtp")
+	}
+}
+
+func TestKafka(t *testing.T) {
+	records := []KafkaRecord{
+		{Timestamp: 1600000000000, Key: []byte("k1"), Value: []byte("v1"), Headers: []KafkaHeader{{Key: "h", Value: []byte("x")}}},
+		{Timestamp: 1600000000005, Value: []byte("v2")},
+		{Timestamp: 1600000000001, Key: []byte("tombstone")},
+	}
+	batch := AppendKafkaRecordBatch(nil, KafkaRecordBatch{ProducerID: -1, ProducerEpoch: -1, BaseSequence: -1, Records: records})
+	// the same records compressed with gzip
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write(batch[61:])
+	gz.Close()
+	compressed := append(append([]byte(nil), batch[:61]...), buf.Bytes()...)
+	binary.BigEndian.PutUint32(compressed[8:], uint32(len(compressed)-12))
+	binary.BigEndian.PutUint16(compressed[21:], KafkaCompressionGzip)
+
+	for _, version := range []int16{7, 9} {
+		r := KafkaRequest{APIVersion: version, CorrelationID: 42, ClientID: "producer-1"}
+		p := KafkaProduceRequest{Acks: -1, Timeout: 30000, Topics: []KafkaProduceTopic{
+			{Name: "orders", Partitions: []KafkaProducePartition{{Index: 3, Records: batch}}},
+			{Name: "events", Partitions: []KafkaProducePartition{{Index: 0, Records: compressed}}},
+		}}
+		data := AppendKafkaProduce(nil, r, p)
+		if n := KafkaMessageLength(append(data, 0, 0)); n != len(data) || !IsKafkaRequest(data[:14]) {
+			t.Fatalf("v%d: unexpected length %d of %d bytes", version, n, len(data))
+		}
+		parsed, ok := ParseKafkaRequest(data)
+		if !ok || parsed.APIKey != KafkaProduce || parsed.APIVersion != version || parsed.CorrelationID != 42 || parsed.ClientID != "producer-1" {
+			t.Fatalf("v%d: unexpected header %+v", version, parsed)
+		}
+		produce, ok := ParseKafkaProduce(parsed)
+		if !ok || produce.Acks != -1 || produce.Timeout != 30000 || !reflect.DeepEqual(KafkaTopics(parsed), []string{"orders", "events"}) {
+			t.Fatalf("v%d: unexpected produce %+v", version, produce)
+		}
+		for _, topic := range produce.Topics {
+			batches, err := ParseKafkaRecordBatches(topic.Partitions[0].Records)
+			if err != nil || len(batches) != 1 {
+				t.Fatalf("v%d: unexpected batches of %s: %v", version, topic.Name, err)
+			}
+			if b := batches[0]; b.Count != 3 || b.FirstTimestamp != 1600000000000 || b.MaxTimestamp != 1600000000005 || !reflect.DeepEqual(b.Records, records) {
+				t.Errorf("v%d: unexpected batch of %s %+v", version, topic.Name, b)
+			}
+		}
+	}
+	if crc := crc32.Checksum(batch[21:], crc32.MakeTable(crc32.Castagnoli)); crc != binary.BigEndian.Uint32(batch[17:]) {
+		t.Errorf("unexpected crc %08x", crc)
+	}
+
+	// a fetch v11 of two topics
+	var k kafkaWriter
+	k.int32(-1)
+	k.int32(500)
+	k.int32(1)
+	k.int32(50 << 20)
+	k.data = append(k.data, 0)
+	k.int32(0)
+	k.int32(-1)
+	k.array(2, false)
+	for _, topic := range []string{"orders", "events"} {
+		k.string(topic, false)
+		k.array(1, false)
+		k.data = append(k.data, make([]byte, 28)...)
+	}
+	fetch := AppendKafkaRequest(nil, KafkaRequest{APIKey: KafkaFetch, APIVersion: 11, CorrelationID: 7, Body: append(k.data, 0, 0, 0, 0, 0, 0)})
+	r, ok := ParseKafkaRequest(fetch)
+	if topics := KafkaTopics(r); !ok || !reflect.DeepEqual(topics, []string{"orders", "events"}) {
+		t.Errorf("unexpected fetch topics %v", topics)
+	}
+	if key, ok := KafkaAPIKey("fetch"); !ok || key != KafkaFetch || KafkaAPIName(KafkaAPIVersions) != "ApiVersions" {
+		t.Error("unexpected api names")
+	}
+	// a response whose correlation id looks like the key and version of a request, but too short for its header
+	if IsKafkaRequest([]byte{0, 0, 0, 8, 0, 0, 0, 1, 0, 0, 0, 0, 0, 1}) {
+		t.Error("expected the response not to be a request")
+	}
+}
+
+func TestContentEncoding(t *testing.T) {
+	body := bytes.Repeat([]byte("MozillaDeveloperNetwork"), 100)
+	for _, encoding := range []string{"gzip", "deflate", "br", "zstd", "gzip, zstd", "br, gzip", "identity", ""} {
+		encoded, err := EncodeContent(encoding, body)
+		if err != nil {
+			t.Fatalf("%s: %v", encoding, err)
+		}
+		decoded, err := DecodeContent(encoding, encoded, len(body))
+		if err != nil || !bytes.Equal(decoded, body) {
+			t.Errorf("expected the body encoded with %q to be decoded, got %d bytes %v", encoding, len(decoded), err)
+		}
+		if _, err = DecodeContent(encoding, encoded, len(body)-1); encoding != "identity" && encoding != "" && err != ErrContentTooLarge {
+			t.Errorf("expected the body encoded with %q to be too large, got %v", encoding, err)
+		}
+	}
+	// raw deflate, without the zlib header
+	var buf bytes.Buffer
+	w, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+	w.Write(body)
+	w.Close()
+	if decoded, err := DecodeContent("deflate", buf.Bytes(), len(body)); err != nil || !bytes.Equal(decoded, body) {
+		t.Errorf("expected the raw deflate body to be decoded, got %d bytes %v", len(decoded), err)
+	}
+	if _, err := DecodeContent("compress", body, len(body)); err == nil {
+		t.Error("expected compress to be unsupported")
+	}
+	// a zstd bomb is not inflated past the limit
+	var bomb bytes.Buffer
+	zw, _ := zstd.NewWriter(&bomb)
+	zw.Write(make([]byte, 64<<20))
+	zw.Close()
+	if _, err := DecodeContent("zstd", bomb.Bytes(), len(body)); err != ErrContentTooLarge {
+		t.Errorf("expected the zstd bomb to be too large, got %v", err)
+	}
+	// the window is not allocated from the frame header past the limit: a frame of 64MB window(descriptor 0x80)
+	// with a last raw block of 4 bytes
+	frame := []byte{0x28, 0xb5, 0x2f, 0xfd, 0x00, 0x80, 4<<3 | 1, 0, 0, 'd', 'a', 't', 'a'}
+	if _, err := DecodeContent("zstd", frame, len(body)); err == nil {
+		t.Error("expected an error for a zstd window too large")
+	}
+}
+
+func TestLenientMessageLength(t *testing.T) {
+	for _, tt := range []struct {
+		payload  string
+		expected int
+		err      error
+	}{
+		{"GET / HTTP/1.1\r\nHost: a\r\n\r\nGET /b HTTP/1.1\r\n", 27, nil},
+		{"GET / HTTP/1.1\nHost: a\n\nGET /b HTTP/1.1\n", 24, ErrBareLF},
+		{"POST / HTTP/1.1\nContent-Length: 7\n\nNetwork", 42, ErrBareLF},
+		{"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n7;name=value\r\nNetwork\r\n0\r\n\r\n", 75, nil},
+		{"HTTP/1.1 200 OK\nTransfer-Encoding: chunked\n\n7\nNetwork\n0\nGrpc-Status: 0\n\n", 72, ErrBareLF},
+		// salvaged up to the next message
+		{"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\nNetwork\r\nHTTP/1.1 200 OK\r\n", 60, ErrInvalidChunk},
+		{"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nNetwork\r\n0\r\n\r\n", 64, ErrInvalidChunk},
+		{"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\nffffffffff\r\nNetwork\r\n", 68, ErrInvalidChunk},
+		{"POST / HTTP/1.1\r\nContent-Length: abc\r\n\r\nNetwork\r\nGET / HTTP/1.1\r\n\r\n", 49, ErrInvalidLength},
+		{"Network\r\nGET / HTTP/1.1\r\n\r\n", 9, ErrMissingTitle},
+		// not complete yet
+		{"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n7\r\nNet", -1, nil},
+		{"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n7\r\nNetwork\r", -1, nil},
+		{"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n0\r\nGrpc-Status: 0\r\n", -1, nil},
+		{"GET / HTTP/1.1\nHost: a\n", -1, nil},
+		{"Netw", -1, nil},
+	} {
+		if n, err := LenientMessageLength([]byte(tt.payload)); n != tt.expected || err != tt.err {
+			t.Errorf("expected %d %v, got %d %v, payload: %q", tt.expected, tt.err, n, err, tt.payload)
+		}
+		// the strict parser agrees on the well formed messages
+		if tt.err == nil && tt.expected != -1 {
+			if n := MessageLength([]byte(tt.payload)); n != tt.expected {
+				t.Errorf("expected MessageLength %d, got %d, payload: %q", tt.expected, n, tt.payload)
+			}
+		}
+	}
+
+	// spaces after the chunk size are only accepted by the lenient parser
+	payload := []byte("HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n7 \r\nNetwork\r\n0\r\n\r\n")
+	if n, err := LenientMessageLength(payload); n != len(payload) || err != nil {
+		t.Errorf("expected %d <nil>, got %d %v", len(payload), n, err)
+	}
+}
+
+func TestMultipartParts(t *testing.T) {
+	body := "--xYzZY\r\nContent-Disposition: form-data; name=\"user\"\r\n\r\nbob\r\n" +
+		"--xYzZY\r\nContent-Disposition: form-data; name=\"avatar\"; filename=\"me.png\"\r\nContent-Type: image/png\r\n\r\n\x89PNG\r\n--xYz\r\n" +
+		"--xYzZY--\r\n"
+	head := "POST /upload HTTP/1.1\r\nContent-Type: multipart/form-data; boundary=\"xYzZY\"\r\nContent-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n"
+	payload := []byte(head + body)
+	parts, err := MultipartParts(payload)
+	if err != nil || len(parts) != 2 {
+		t.Fatalf("expected 2 parts, got %d %v", len(parts), err)
+	}
+	if p := parts[0]; p.Name != "user" || p.Filename != "" || string(payload[p.BodyStart:p.End]) != "bob" {
+		t.Errorf("unexpected first part %+v", p)
+	}
+	if p := parts[1]; p.Name != "avatar" || p.Filename != "me.png" || p.ContentType != "image/png" || p.Size() != 11 {
+		t.Errorf("unexpected second part %+v", p)
+	}
+
+	for _, tt := range []struct {
+		payload  []byte
+		expected string
+	}{
+		{DeletePart(payload, parts[1]), "--xYzZY\r\nContent-Disposition: form-data; name=\"user\"\r\n\r\nbob\r\n--xYzZY--\r\n"},
+		{DeletePart(payload, parts[0]), "\r\n--xYzZY\r\nContent-Disposition: form-data; name=\"avatar\"; filename=\"me.png\"\r\nContent-Type: image/png\r\n\r\n\x89PNG\r\n--xYz\r\n--xYzZY--\r\n"},
+		{SetPartContent(payload, parts[0], []byte("alice")), strings.Replace(body, "bob", "alice", 1)},
+	} {
+		if body := Body(tt.payload); string(body) != tt.expected {
+			t.Errorf("expected %q, got %q", tt.expected, body)
+		}
+		if n, _ := atoI(Header(tt.payload, []byte("Content-Length")), 10); n != len(tt.expected) {
+			t.Errorf("expected Content-Length %d, got %d", len(tt.expected), n)
+		}
+		// the modified bodies are still valid
+		if parts, err := MultipartParts(tt.payload); err != nil || len(parts) == 0 {
+			t.Errorf("expected the parts of %q, got %d %v", tt.expected, len(parts), err)
+		}
+	}
+
+	if parts, err := MultipartParts([]byte(head + body[:70])); err != ErrInvalidMultipart || len(parts) != 1 {
+		t.Errorf("expected the parts of the truncated body to be invalid, got %d %v", len(parts), err)
+	}
+	if parts, err := MultipartParts([]byte("POST / HTTP/1.1\r\nContent-Type: text/plain\r\n\r\n--xYzZY--\r\n")); parts != nil || err != nil {
+		t.Errorf("expected no parts, got %d %v", len(parts), err)
+	}
+}
+
+func TestGraphQLOperations(t *testing.T) {
+	post := func(contentType, body string) []byte {
+		return []byte("POST /graphql HTTP/1.1\r\nContent-Type: " + contentType + "\r\nContent-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n" + body)
+	}
+	for _, tt := range []struct {
+		payload  []byte
+		expected []GraphQLOperation
+	}{
+		{post("application/json", `{"query":"query GetUser($id: ID!) { user(id: $id) { name } me: viewer { id } }","variables":{"id":1}}`),
+			[]GraphQLOperation{{"query", "GetUser", []string{"user", "viewer"}}}},
+		{post("application/json", `{"query":"fragment F on User { name } query A { a } mutation B @audit(reason: \"x}\") { createUser(input: {name: \"}\"}) { ...F ... on User { id } } deleteUser }","operationName":"B"}`),
+			[]GraphQLOperation{{"mutation", "B", []string{"createUser", "deleteUser"}}}},
+		{post("application/json", `[{"query":"{ products(first: 10) { id } }"},{"query":"subscription OnOrder { order # the new orders\n }"}]`),
+			[]GraphQLOperation{{"query", "", []string{"products"}}, {"subscription", "OnOrder", []string{"order"}}}},
+		{post("application/graphql", `query Search { search(text: """a } b""") { total } count }`), []GraphQLOperation{{"query", "Search", []string{"search", "count"}}}},
+		{[]byte("GET /graphql?query=%7Bviewer%7Bid%7D%7D HTTP/1.1\r\n\r\n"), []GraphQLOperation{{"query", "", []string{"viewer"}}}},
+		{post("application/json", `{"user":"bob"}`), nil},
+		{[]byte("GET /users HTTP/1.1\r\n\r\n"), nil},
+	} {
+		if ops := GraphQLOperations(tt.payload); !reflect.DeepEqual(ops, tt.expected) {
+			t.Errorf("expected %+v, got %+v, payload: %q", tt.expected, ops, tt.payload)
+		}
+	}
+}
+
+func TestHeaderValues(t *testing.T) {
+	payload := []byte("HTTP/1.1 200 OK\r\nSet-Cookie: id=a; Expires=Wed, 21 Oct 2026 07:28:00 GMT\r\nvary: Accept\r\nset-cookie: lang=en\r\nVary: Accept-Encoding, \"x,y\" ,, Origin\r\nContent-Length: 0\r\n\r\nVary: body")
+
+	expected := [][]byte{[]byte("id=a; Expires=Wed, 21 Oct 2026 07:28:00 GMT"), []byte("lang=en")}
+	if values := HeaderValues(payload, []byte("Set-Cookie")); !reflect.DeepEqual(values, expected) {
+		t.Errorf("expected %q, got %q", expected, values)
+	}
+	if values := HeaderList(payload, []byte("set-cookie")); !reflect.DeepEqual(values, expected) {
+		t.Errorf("expected the cookies to not be split, got %q", values)
+	}
+	expected = [][]byte{[]byte("Accept"), []byte("Accept-Encoding"), []byte("\"x,y\""), []byte("Origin")}
+	if values := HeaderList(payload, []byte("VARY")); !reflect.DeepEqual(values, expected) {
+		t.Errorf("expected %q, got %q", expected, values)
+	}
+	if values := HeaderValues(payload, []byte("Expires")); values != nil {
+		t.Errorf("expected no values, got %q", values)
+	}
+
+	replaced := ReplaceHeaderValues(append([]byte(nil), payload...), []byte("set-cookie"), func(value []byte) []byte {
+		return append([]byte("secure_"), value...)
+	})
+	expected = [][]byte{[]byte("secure_id=a; Expires=Wed, 21 Oct 2026 07:28:00 GMT"), []byte("secure_lang=en")}
+	if values := HeaderValues(replaced, []byte("Set-Cookie")); !reflect.DeepEqual(values, expected) {
+		t.Errorf("expected %q, got %q", expected, values)
+	}
+
+	deleted := DeleteHeaders(append([]byte(nil), payload...), []byte("vary"))
+	if string(deleted) != "HTTP/1.1 200 OK\r\nSet-Cookie: id=a; Expires=Wed, 21 Oct 2026 07:28:00 GMT\r\nset-cookie: lang=en\r\nContent-Length: 0\r\n\r\nVary: body" {
+		t.Errorf("expected the Vary fields to be deleted, got %q", deleted)
+	}
+}
+
+func TestFramingError(t *testing.T) {
+	for _, tt := range []struct {
+		payload, normalized string
+		err                 error
+	}{
+		{"POST / HTTP/1.1\r\nContent-Length: 7\r\n\r\nNetwork", "", nil},
+		{"POST / HTTP/1.1\r\nContent-Length: 7\r\ncontent-length: 7, 7\r\n\r\nNetwork", "", nil},
+		{"POST / HTTP/1.1\r\nTransfer-Encoding: gzip, chunked\r\n\r\n0\r\n\r\n", "", nil},
+		{"POST / HTTP/1.1\r\nContent-Length: 4\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n",
+			"POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n", ErrLengthAndChunked},
+		{"POST / HTTP/1.1\r\nContent-Length: 7\r\nContent-Length: 3\r\n\r\nNetwork",
+			"POST / HTTP/1.1\r\nContent-Length: 7\r\n\r\nNetwork", ErrConflictingLengths},
+		{"POST / HTTP/1.1\r\nContent-Length: +7\r\n\r\nNetwork",
+			"POST / HTTP/1.1\r\nContent-Length: 7\r\n\r\nNetwork", ErrInvalidLength},
+		{"POST / HTTP/1.1\r\nTransfer-Encoding: chunked, identity\r\n\r\n0\r\n\r\n",
+			"POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n", ErrInvalidTransferEncoding},
+		{"POST / HTTP/1.1\r\nTransfer-Encoding: xchunked\r\nContent-Length: 7\r\n\r\nNetwork",
+			"POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\nNetwork", ErrInvalidTransferEncoding},
+		{"POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding : chunked\r\nContent-Length: 7\r\n\r\nNetwork",
+			"POST / HTTP/1.1\r\nContent-Length: 7\r\nHost: a\r\n\r\nNetwork", ErrObfuscatedHeader},
+		{"POST / HTTP/1.1\r\nContent-Length: 7\r\nTransfer-Encoding:\r\n chunked\r\nHost: a\r\n\r\nNetwork",
+			"POST / HTTP/1.1\r\nContent-Length: 7\r\nHost: a\r\n\r\nNetwork", ErrObfuscatedHeader},
+	} {
+		if err := FramingError([]byte(tt.payload)); err != tt.err {
+			t.Errorf("expected %v, got %v, payload: %q", tt.err, err, tt.payload)
+		}
+		if tt.err == nil {
+			continue
+		}
+		normalized := NormalizeFraming([]byte(tt.payload))
+		if string(normalized) != tt.normalized {
+			t.Errorf("expected %q, got %q", tt.normalized, normalized)
+		}
+		if err := FramingError(normalized); err != nil {
+			t.Errorf("expected the normalized framing to be unambiguous, got %v, payload: %q", err, normalized)
+		}
+	}
+}
+
+func TestHeaderSection(t *testing.T) {
+	for _, tt := range []struct {
+		payload     string
+		size, count int
+	}{
+		{"GET / HTTP/1.1\r\nHost: a\r\nCookie: a=1\r\n\r\nbody", 40, 2},
+		{"HTTP/1.1 204 No Content\r\n\r\n", 27, 0},
+		{"GET / HTTP/1.1\r\nHost: a\r\n", -1, 0},
+	} {
+		if size, count := HeaderSection([]byte(tt.payload)); size != tt.size || count != tt.count {
+			t.Errorf("expected %d %d, got %d %d, payload: %q", tt.size, tt.count, size, count, tt.payload)
+		}
+	}
+}
+
+func TestNormalizeURL(t *testing.T) {
+	all := &URLNormalization{Decode: true, Slashes: true, SortQuery: true, Template: true}
+	templates := &URLNormalization{Templates: [][]string{strings.Split("/users/{user}/orders/{order}", "/")}}
+	for _, tt := range []struct {
+		url        string
+		n          *URLNormalization
+		normalized string
+	}{
+		{"/users//42?b=2&a=%31", all, "/users/{id}?a=1&b=2"},
+		{"/caf%C3%A9/items/550e8400-e29b-41d4-a716-446655440000", all, "/café/items/{id}"},
+		{"/blobs/5f2b3c4d5e6f7a8b9c0d1e2f/v2", all, "/blobs/{id}/v2"},
+		{"http://example.com//a//b?z=1&y=2", all, "http://example.com/a/b?y=2&z=1"},
+		{"/users//42?b=2&a=%31", &URLNormalization{Slashes: true}, "/users/42?b=2&a=%31"},
+		{"/search?q=a%26b", &URLNormalization{SortQuery: true}, "/search?q=a%26b"},
+		{"/users/bob/orders/7", templates, "/users/{user}/orders/{order}"},
+		{"/users/bob/orders", templates, "/users/bob/orders"},
+		{"/feed?url=http://a//b", all, "/feed?url=http://a//b"},
+	} {
+		if normalized := NormalizeURL([]byte(tt.url), tt.n); string(normalized) != tt.normalized {
+			t.Errorf("expected %q, got %q", tt.normalized, normalized)
+		}
+	}
+}
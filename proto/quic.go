@@ -0,0 +1,262 @@
+package proto
+
+import "encoding/binary"
+
+// QUIC versions
+const (
+	QUICVersion1 uint32 = 0x00000001
+	QUICVersion2 uint32 = 0x6b3343cf
+)
+
+// QUIC long header packet types, the types of QUIC version 2 are mapped to them by ParseQUICHeader
+const (
+	QUICInitial uint8 = iota
+	QUIC0RTT
+	QUICHandshake
+	QUICRetry
+)
+
+// QUIC frame types(https://www.rfc-editor.org/rfc/rfc9000.html#name-frame-types-and-formats)
+const (
+	QUICFramePadding         uint64 = 0x00
+	QUICFramePing            uint64 = 0x01
+	QUICFrameAck             uint64 = 0x02
+	QUICFrameAckECN          uint64 = 0x03
+	QUICFrameResetStream     uint64 = 0x04
+	QUICFrameStopSending     uint64 = 0x05
+	QUICFrameCrypto          uint64 = 0x06
+	QUICFrameNewToken        uint64 = 0x07
+	QUICFrameStream          uint64 = 0x08 // to 0x0f, with the OFF, LEN and FIN bits
+	QUICFrameConnectionClose uint64 = 0x1c
+	QUICFrameHandshakeDone   uint64 = 0x1e
+	QUICFrameDatagram        uint64 = 0x30
+)
+
+// QUICVarint returns the variable-length integer at the start of data and its length, n is 0 if it is not complete
+func QUICVarint(data []byte) (v uint64, n int) {
+	if len(data) == 0 {
+		return
+	}
+	n = 1 << (data[0] >> 6)
+	if len(data) < n {
+		return 0, 0
+	}
+	v = uint64(data[0] & 0x3f)
+	for _, b := range data[1:n] {
+		v = v<<8 | uint64(b)
+	}
+	return
+}
+
+// AppendQUICVarint appends v as a variable-length integer to dst and returns the extended buffer
+func AppendQUICVarint(dst []byte, v uint64) []byte {
+	switch {
+	case v < 1<<6:
+		return append(dst, byte(v))
+	case v < 1<<14:
+		return append(dst, byte(v>>8)|0x40, byte(v))
+	case v < 1<<30:
+		return append(dst, byte(v>>24)|0x80, byte(v>>16), byte(v>>8), byte(v))
+	}
+	return append(dst, byte(v>>56)|0xc0, byte(v>>48), byte(v>>40), byte(v>>32), byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+// QUICHeader is the header of a QUIC packet, still protected: the packet number starts at PNOffset
+type QUICHeader struct {
+	Long     bool
+	Type     uint8 // of long header packets
+	Version  uint32
+	DCID     []byte
+	SCID     []byte // of long header packets
+	Token    []byte // of Initial packets
+	PNOffset int
+	Length   int // of the packet, from its first byte
+}
+
+// ParseQUICHeader returns the header of the packet at the start of data, dcidLen is the length of the connection ID
+// of short header packets, which fill the rest of data. ok is false if the packet is not complete, or if data
+// doesn't start with a packet of a known version.
+func ParseQUICHeader(data []byte, dcidLen int) (h QUICHeader, ok bool) {
+	if len(data) < 1 || data[0]&0x40 == 0 {
+		// without the fixed bit
+		return
+	}
+	if data[0]&0x80 == 0 {
+		if len(data) < 1+dcidLen {
+			return
+		}
+		h.DCID = data[1 : 1+dcidLen]
+		h.PNOffset = 1 + dcidLen
+		h.Length = len(data)
+		return h, true
+	}
+	if len(data) < 7 {
+		return
+	}
+	h.Long = true
+	h.Version = binary.BigEndian.Uint32(data[1:])
+	h.Type = data[0] >> 4 & 3
+	switch h.Version {
+	case QUICVersion1:
+	case QUICVersion2:
+		h.Type = (h.Type + 3) & 3
+	default:
+		return
+	}
+	i := 5
+	for _, cid := range []*[]byte{&h.DCID, &h.SCID} {
+		if i >= len(data) {
+			return
+		}
+		n := int(data[i])
+		if n > 20 || len(data) < i+1+n {
+			return
+		}
+		*cid = data[i+1 : i+1+n]
+		i += 1 + n
+	}
+	if h.Type == QUICRetry {
+		h.Length = len(data)
+		return h, true
+	}
+	if h.Type == QUICInitial {
+		length, n := QUICVarint(data[i:])
+		if n == 0 || uint64(len(data)-i-n) < length {
+			return
+		}
+		h.Token = data[i+n : i+n+int(length)]
+		i += n + int(length)
+	}
+	length, n := QUICVarint(data[i:])
+	if n == 0 || uint64(len(data)-i-n) < length {
+		return
+	}
+	h.PNOffset = i + n
+	h.Length = h.PNOffset + int(length)
+	return h, true
+}
+
+// QUICFrame is a frame of a QUIC packet, the fields of the frames are set depending on their type
+type QUICFrame struct {
+	Type   uint64
+	Stream uint64 // STREAM and RESET_STREAM frames
+	Offset uint64 // STREAM and CRYPTO frames
+	Fin    bool   // STREAM frames
+	Data   []byte // STREAM, CRYPTO and DATAGRAM frames
+}
+
+// ParseQUICFrame returns the frame at the start of the payload of a packet and its length, n is 0 if the frame
+// is not complete or of an unknown type
+func ParseQUICFrame(data []byte) (f QUICFrame, n int) {
+	typ, n := QUICVarint(data)
+	if n == 0 {
+		return
+	}
+	f.Type = typ
+	// varints reads count variable-length integers, returning the last one
+	varints := func(count int) (v uint64, ok bool) {
+		for ; count > 0; count-- {
+			var m int
+			if v, m = QUICVarint(data[n:]); m == 0 {
+				return 0, false
+			}
+			n += m
+		}
+		return v, true
+	}
+	// take reads length bytes
+	take := func(length uint64) ([]byte, bool) {
+		if uint64(len(data)-n) < length {
+			return nil, false
+		}
+		b := data[n : n+int(length)]
+		n += int(length)
+		return b, true
+	}
+	var ok bool
+	switch {
+	case typ == QUICFramePadding, typ == QUICFramePing, typ == QUICFrameHandshakeDone:
+		ok = true
+	case typ == QUICFrameAck, typ == QUICFrameAckECN:
+		var ranges uint64
+		if ranges, ok = varints(3); !ok {
+			break
+		}
+		if ranges > uint64(len(data)) {
+			return QUICFrame{}, 0
+		}
+		count := 1 + 2*int(ranges)
+		if typ == QUICFrameAckECN {
+			count += 3
+		}
+		_, ok = varints(count)
+	case typ == QUICFrameResetStream:
+		if f.Stream, ok = varints(1); ok {
+			_, ok = varints(2)
+		}
+	case typ == QUICFrameStopSending, typ == 0x11, typ == 0x15:
+		_, ok = varints(2)
+	case typ == QUICFrameCrypto:
+		var length uint64
+		if f.Offset, ok = varints(1); ok {
+			if length, ok = varints(1); ok {
+				f.Data, ok = take(length)
+			}
+		}
+	case typ == QUICFrameNewToken:
+		var length uint64
+		if length, ok = varints(1); ok {
+			_, ok = take(length)
+		}
+	case typ >= QUICFrameStream && typ <= 0x0f:
+		if f.Stream, ok = varints(1); !ok {
+			break
+		}
+		if typ&0x04 != 0 {
+			if f.Offset, ok = varints(1); !ok {
+				break
+			}
+		}
+		length := uint64(len(data) - n)
+		if typ&0x02 != 0 {
+			if length, ok = varints(1); !ok {
+				break
+			}
+		}
+		f.Data, ok = take(length)
+		f.Fin = typ&0x01 != 0
+	case typ == 0x10, typ >= 0x12 && typ <= 0x14, typ == 0x16, typ == 0x17, typ == 0x19:
+		_, ok = varints(1)
+	case typ == 0x18:
+		// NEW_CONNECTION_ID
+		if _, ok = varints(2); ok && n < len(data) {
+			length := uint64(data[n])
+			n++
+			_, ok = take(length + 16)
+		} else {
+			ok = false
+		}
+	case typ == 0x1a, typ == 0x1b:
+		_, ok = take(8)
+	case typ == QUICFrameConnectionClose, typ == 0x1d:
+		count := 2
+		if typ == QUICFrameConnectionClose {
+			count = 3
+		}
+		var length uint64
+		if length, ok = varints(count); ok {
+			_, ok = take(length)
+		}
+	case typ == QUICFrameDatagram:
+		f.Data, ok = take(uint64(len(data) - n))
+	case typ == 0x31:
+		var length uint64
+		if length, ok = varints(1); ok {
+			f.Data, ok = take(length)
+		}
+	}
+	if !ok {
+		return QUICFrame{}, 0
+	}
+	return f, n
+}
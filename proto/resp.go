@@ -0,0 +1,203 @@
+package proto
+
+import (
+	"bytes"
+	"strconv"
+)
+
+// RESP types, RESP2 and RESP3(https://github.com/redis/redis-specifications/blob/master/protocol/RESP3.md)
+const (
+	RESPSimpleString   byte = '+'
+	RESPError          byte = '-'
+	RESPInteger        byte = ':'
+	RESPBulkString     byte = '$'
+	RESPArray          byte = '*'
+	RESPNull           byte = '_'
+	RESPDouble         byte = ','
+	RESPBoolean        byte = '#'
+	RESPBlobError      byte = '!'
+	RESPVerbatimString byte = '='
+	RESPBigNumber      byte = '('
+	RESPMap            byte = '%'
+	RESPSet            byte = '~'
+	RESPAttribute      byte = '|'
+	RESPPush           byte = '>'
+	respStreamedPart   byte = ';'
+	respStreamEnd      byte = '.'
+)
+
+// respMaxDepth is the maximum nesting of aggregates
+const respMaxDepth = 64
+
+// RESPLength returns the length of the RESP value at the start of data, including the attributes preceding it,
+// or -1 if it is not complete. data not starting with a RESP type is an inline command ending with its line.
+func RESPLength(data []byte) int {
+	if len(data) == 0 {
+		return -1
+	}
+	if !isRESPType(data[0]) {
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			return i + 1
+		}
+		return -1
+	}
+	return respValue(data, 0)
+}
+
+func isRESPType(c byte) bool {
+	switch c {
+	case RESPSimpleString, RESPError, RESPInteger, RESPBulkString, RESPArray, RESPNull, RESPDouble, RESPBoolean,
+		RESPBlobError, RESPVerbatimString, RESPBigNumber, RESPMap, RESPSet, RESPAttribute, RESPPush:
+		return true
+	}
+	return false
+}
+
+// respLine returns the content of the line at the start of data, after the type, and the length of the line
+func respLine(data []byte) (line []byte, n int) {
+	i := bytes.Index(data, []byte("\r\n"))
+	if i < 1 {
+		return nil, -1
+	}
+	return data[1:i], i + 2
+}
+
+// respValue returns the length of the value at the start of data, or -1
+func respValue(data []byte, depth int) int {
+	if len(data) == 0 || depth > respMaxDepth {
+		return -1
+	}
+	line, n := respLine(data)
+	if n < 0 {
+		return -1
+	}
+	switch data[0] {
+	case RESPSimpleString, RESPError, RESPInteger, RESPNull, RESPDouble, RESPBoolean, RESPBigNumber:
+		return n
+	case RESPBulkString, RESPBlobError, RESPVerbatimString:
+		if bytes.Equal(line, []byte("?")) {
+			// streamed string, in parts ending with an empty one
+			for {
+				part, m := respLine(data[n:])
+				if m < 0 || data[n] != respStreamedPart {
+					return -1
+				}
+				length, err := strconv.Atoi(string(part))
+				if err != nil || length < 0 {
+					return -1
+				}
+				n += m
+				if length == 0 {
+					return n
+				}
+				if len(data)-n < length+2 {
+					return -1
+				}
+				n += length + 2
+			}
+		}
+		length, err := strconv.Atoi(string(line))
+		if err != nil || length < -1 {
+			return -1
+		}
+		if length == -1 {
+			// RESP2 null bulk string
+			return n
+		}
+		if len(data)-n < length+2 {
+			return -1
+		}
+		return n + length + 2
+	case RESPArray, RESPMap, RESPSet, RESPAttribute, RESPPush:
+		streamed := bytes.Equal(line, []byte("?"))
+		count := 0
+		if !streamed {
+			var err error
+			if count, err = strconv.Atoi(string(line)); err != nil || count < -1 {
+				return -1
+			}
+		}
+		if data[0] == RESPMap || data[0] == RESPAttribute {
+			count *= 2
+		}
+		for i := 0; streamed || i < count; i++ {
+			if streamed && n < len(data) && data[n] == respStreamEnd {
+				if _, m := respLine(data[n:]); m > 0 {
+					return n + m
+				}
+				return -1
+			}
+			m := respValue(data[n:], depth+1)
+			if m < 0 {
+				return -1
+			}
+			n += m
+		}
+		if data[0] == RESPAttribute {
+			// the attributes precede a value
+			m := respValue(data[n:], depth+1)
+			if m < 0 {
+				return -1
+			}
+			n += m
+		}
+		return n
+	}
+	return -1
+}
+
+// RESPCommand returns the arguments of the command at the start of data, an array of bulk strings or an inline
+// command, ok is false if it is not complete or not a command
+func RESPCommand(data []byte) (args [][]byte, ok bool) {
+	if len(data) == 0 {
+		return
+	}
+	if data[0] != RESPArray {
+		if isRESPType(data[0]) {
+			return
+		}
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			return
+		}
+		args = bytes.Fields(data[:i])
+		return args, len(args) > 0
+	}
+	line, n := respLine(data)
+	if n < 0 {
+		return
+	}
+	count, err := strconv.Atoi(string(line))
+	if err != nil || count < 1 || count > len(data) {
+		return
+	}
+	args = make([][]byte, count)
+	for i := range args {
+		if n >= len(data) || data[n] != RESPBulkString {
+			return nil, false
+		}
+		line, m := respLine(data[n:])
+		if m < 0 {
+			return nil, false
+		}
+		length, err := strconv.Atoi(string(line))
+		if err != nil || length < 0 || len(data)-n-m < length+2 {
+			return nil, false
+		}
+		n += m
+		args[i] = data[n : n+length]
+		n += length + 2
+	}
+	return args, true
+}
+
+// AppendRESPCommand appends the command of the arguments to dst, as an array of bulk strings
+func AppendRESPCommand(dst []byte, args ...[]byte) []byte {
+	dst = strconv.AppendInt(append(dst, RESPArray), int64(len(args)), 10)
+	dst = append(dst, '\r', '\n')
+	for _, arg := range args {
+		dst = strconv.AppendInt(append(dst, RESPBulkString), int64(len(arg)), 10)
+		dst = append(append(append(dst, '\r', '\n'), arg...), '\r', '\n')
+	}
+	return dst
+}
@@ -0,0 +1,327 @@
+package proto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// SIPVersion is the version of the start lines of SIP messages(https://tools.ietf.org/html/rfc3261)
+const SIPVersion = "SIP/2.0"
+
+// sipCompact are the full names of the compact forms of SIP headers, in lower case
+var sipCompact = map[string]string{
+	"i": "call-id",
+	"m": "contact",
+	"e": "content-encoding",
+	"l": "content-length",
+	"c": "content-type",
+	"f": "from",
+	"s": "subject",
+	"k": "supported",
+	"t": "to",
+	"v": "via",
+}
+
+// SIPMessage is a SIP request or response
+type SIPMessage struct {
+	Method string // of requests
+	URI    string
+	Status int // of responses
+	Reason string
+	Header map[string][]string // by the full names of the headers in lower case
+	Body   []byte
+}
+
+// IsRequest tells if the message is a request
+func (m *SIPMessage) IsRequest() bool {
+	return m.Method != ""
+}
+
+// Get returns the first value of the header name, its full name or its compact form in any case
+func (m *SIPMessage) Get(name string) string {
+	name = strings.ToLower(name)
+	if full, ok := sipCompact[name]; ok {
+		name = full
+	}
+	if v := m.Header[name]; len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// CallID returns the Call-ID of the message, the id of its dialog
+func (m *SIPMessage) CallID() string {
+	return m.Get("call-id")
+}
+
+// CSeq returns the sequence number and the method of the CSeq of the message, the method of a response is the one
+// of its request
+func (m *SIPMessage) CSeq() (seq uint32, method string) {
+	fields := strings.Fields(m.Get("cseq"))
+	if len(fields) != 2 {
+		return
+	}
+	n, _ := strconv.ParseUint(fields[0], 10, 32)
+	return uint32(n), strings.ToUpper(fields[1])
+}
+
+// IsSIP tells if data starts with the start line of a SIP request or response
+func IsSIP(data []byte) bool {
+	end := bytes.IndexByte(data, '\n')
+	if end < 0 {
+		return false
+	}
+	line := string(bytes.TrimRight(data[:end], "\r"))
+	if strings.HasPrefix(line, SIPVersion+" ") {
+		code := line[len(SIPVersion)+1:]
+		if len(code) < 3 {
+			return false
+		}
+		_, err := strconv.Atoi(code[:3])
+		return err == nil && code[0] >= '1' && code[0] <= '6' && (len(code) == 3 || code[3] == ' ')
+	}
+	fields := strings.Split(line, " ")
+	return len(fields) == 3 && fields[2] == SIPVersion && fields[0] != "" && fields[1] != "" && strings.ToUpper(fields[0]) == fields[0]
+}
+
+// ParseSIP parses the SIP message in data, ok is false if it is not a complete SIP message. the folded headers are
+// unfolded, and the headers holding lists are not split.
+func ParseSIP(data []byte) (m *SIPMessage, ok bool) {
+	if !IsSIP(data) {
+		return
+	}
+	end := bytes.Index(data, []byte("\r\n\r\n"))
+	skip := 4
+	if end < 0 {
+		// bare LFs are tolerated
+		if end = bytes.Index(data, []byte("\n\n")); end < 0 {
+			return
+		}
+		skip = 2
+	}
+	lines := strings.Split(strings.Replace(string(data[:end]), "\r\n", "\n", -1), "\n")
+	m = &SIPMessage{Header: make(map[string][]string)}
+	start := strings.SplitN(lines[0], " ", 3)
+	if start[0] == SIPVersion {
+		m.Status, _ = strconv.Atoi(start[1][:3])
+		if len(start) == 3 {
+			m.Reason = start[2]
+		}
+	} else {
+		m.Method, m.URI = start[0], start[1]
+	}
+	var name string
+	for _, line := range lines[1:] {
+		if line != "" && (line[0] == ' ' || line[0] == '\t') {
+			// continuation of the previous header
+			if v := m.Header[name]; len(v) > 0 {
+				v[len(v)-1] += " " + strings.TrimSpace(line)
+			}
+			continue
+		}
+		i := strings.IndexByte(line, ':')
+		if i <= 0 {
+			return nil, false
+		}
+		name = strings.ToLower(strings.TrimSpace(line[:i]))
+		if full, ok := sipCompact[name]; ok {
+			name = full
+		}
+		m.Header[name] = append(m.Header[name], strings.TrimSpace(line[i+1:]))
+	}
+	m.Body = data[end+skip:]
+	if l := m.Get("content-length"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 0 || n > len(m.Body) {
+			return nil, false
+		}
+		m.Body = m.Body[:n]
+	}
+	return m, true
+}
+
+// SIPMessageLength returns the length of the SIP message at the start of data, as given by its Content-Length
+// that is mandatory over streams, or -1 if it is not complete. the CRLFs sent as keep-alives are messages of
+// their own.
+func SIPMessageLength(data []byte) int {
+	if n := sipKeepAlive(data); n > 0 {
+		return n
+	}
+	end := bytes.Index(data, []byte("\r\n\r\n"))
+	if end < 0 {
+		return -1
+	}
+	length := 0
+	for _, line := range strings.Split(string(data[:end]), "\r\n")[1:] {
+		i := strings.IndexByte(line, ':')
+		if i <= 0 {
+			continue
+		}
+		name := strings.ToLower(strings.TrimSpace(line[:i]))
+		if name == "content-length" || name == "l" {
+			length, _ = strconv.Atoi(strings.TrimSpace(line[i+1:]))
+			break
+		}
+	}
+	if length < 0 || len(data) < end+4+length {
+		return -1
+	}
+	return end + 4 + length
+}
+
+// sipKeepAlive returns the length of the CRLFs at the start of data, the keep-alives of SIP over streams
+func sipKeepAlive(data []byte) int {
+	n := 0
+	for n+1 < len(data) && data[n] == '\r' && data[n+1] == '\n' {
+		n += 2
+	}
+	return n
+}
+
+// IsSIPKeepAlive tells if data only holds the CRLFs of keep-alives
+func IsSIPKeepAlive(data []byte) bool {
+	return len(data) > 0 && sipKeepAlive(data) == len(data)
+}
+
+// SDPMedia returns the host:port addresses of the media streams of a SDP session description, with the address of
+// the session for the streams without their own. the streams with the port 0 are disabled and skipped.
+func SDPMedia(body []byte) (addrs []string) {
+	var session, media string
+	var ports []string
+	inMedia := false
+	flush := func() {
+		for _, port := range ports {
+			host := media
+			if host == "" {
+				host = session
+			}
+			if host != "" {
+				addrs = append(addrs, net.JoinHostPort(host, port))
+			}
+		}
+		ports, media = nil, ""
+	}
+	for _, line := range strings.Split(strings.Replace(string(body), "\r\n", "\n", -1), "\n") {
+		if len(line) < 2 || line[1] != '=' {
+			continue
+		}
+		fields := strings.Fields(line[2:])
+		switch line[0] {
+		case 'm':
+			flush()
+			inMedia = true
+			if len(fields) < 2 {
+				continue
+			}
+			// the port may be followed by a number of ports
+			port := strings.SplitN(fields[1], "/", 2)[0]
+			if port != "0" {
+				ports = append(ports, port)
+			}
+		case 'c':
+			if len(fields) < 3 {
+				continue
+			}
+			// a multicast address may be followed by its ttl
+			host := strings.SplitN(fields[2], "/", 2)[0]
+			if !inMedia {
+				session = host
+			} else {
+				media = host
+			}
+		}
+	}
+	flush()
+	return
+}
+
+// RTPHeader is the fixed header of RTP packets(https://tools.ietf.org/html/rfc3550)
+type RTPHeader struct {
+	PayloadType byte
+	Marker      bool
+	Seq         uint16
+	Timestamp   uint32
+	SSRC        uint32
+}
+
+// ParseRTP parses the header of the RTP packet in data, ok is false if it is not a RTP packet of the version 2 or
+// it is a RTCP packet
+func ParseRTP(data []byte) (h RTPHeader, ok bool) {
+	if len(data) < 12 || data[0]>>6 != 2 {
+		return
+	}
+	h.PayloadType = data[1] & 0x7f
+	if h.PayloadType >= 72 && h.PayloadType <= 76 {
+		// the packet types of RTCP from 200 to 204
+		return
+	}
+	h.Marker = data[1]&0x80 != 0
+	h.Seq = binary.BigEndian.Uint16(data[2:])
+	h.Timestamp = binary.BigEndian.Uint32(data[4:])
+	h.SSRC = binary.BigEndian.Uint32(data[8:])
+	return h, 12+int(data[0]&0x0f)*4 <= len(data)
+}
+
+// SIPTag returns the tag parameter of a From or To header
+func SIPTag(value string) string {
+	for _, param := range strings.Split(sipParams(value), ";")[1:] {
+		if kv := strings.SplitN(param, "=", 2); len(kv) == 2 && strings.EqualFold(strings.TrimSpace(kv[0]), "tag") {
+			return strings.TrimSpace(kv[1])
+		}
+	}
+	return ""
+}
+
+// SIPWithTag returns the From or To header with the tag parameter, added or replaced
+func SIPWithTag(value, tag string) string {
+	params := sipParams(value)
+	prefix := value[:len(value)-len(params)]
+	parts := strings.Split(params, ";")
+	for i, param := range parts[1:] {
+		if kv := strings.SplitN(param, "=", 2); len(kv) == 2 && strings.EqualFold(strings.TrimSpace(kv[0]), "tag") {
+			parts[i+1] = "tag=" + tag
+			return prefix + strings.Join(parts, ";")
+		}
+	}
+	return value + ";tag=" + tag
+}
+
+// sipParams returns the end of the header value following its address, starting with its parameters if any
+func sipParams(value string) string {
+	if i := strings.LastIndexByte(value, '>'); i >= 0 {
+		return value[i+1:]
+	}
+	// without angle brackets the parameters are the ones of the header
+	if i := strings.IndexByte(value, ';'); i >= 0 {
+		return value[i:]
+	}
+	return ""
+}
+
+// RewriteSIPHeaders returns the SIP message in data with the values of its headers returned by rewrite, given the
+// full name of the headers in lower case. the start line and the body are kept as they are.
+func RewriteSIPHeaders(data []byte, rewrite func(name, value string) string) []byte {
+	end := bytes.Index(data, []byte("\r\n\r\n"))
+	if end < 0 {
+		return data
+	}
+	lines := strings.Split(string(data[:end]), "\r\n")
+	for j, line := range lines[1:] {
+		i := strings.IndexByte(line, ':')
+		if i <= 0 || line[0] == ' ' || line[0] == '\t' {
+			continue
+		}
+		name := strings.ToLower(strings.TrimSpace(line[:i]))
+		if full, ok := sipCompact[name]; ok {
+			name = full
+		}
+		value := strings.TrimSpace(line[i+1:])
+		if v := rewrite(name, value); v != value {
+			lines[j+1] = line[:i+1] + " " + v
+		}
+	}
+	return append([]byte(strings.Join(lines, "\r\n")), data[end:]...)
+}
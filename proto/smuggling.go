@@ -0,0 +1,121 @@
+package proto
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+)
+
+// the framing of the HTTP/1 messages that can be read differently by the proxies and the servers, see
+// https://portswigger.net/web-security/request-smuggling
+var (
+	ErrLengthAndChunked        = errors.New("content-length with chunked transfer-encoding")
+	ErrConflictingLengths      = errors.New("conflicting content-lengths")
+	ErrInvalidTransferEncoding = errors.New("invalid transfer-encoding")
+	ErrObfuscatedHeader        = errors.New("obfuscated framing header")
+)
+
+var (
+	contentLength    = []byte("Content-Length")
+	transferEncoding = []byte("Transfer-Encoding")
+)
+
+// FramingError returns why the framing of the message is ambiguous: a Content-Length along with a chunked
+// Transfer-Encoding, Content-Lengths that differ or are not a number, a Transfer-Encoding whose last coding
+// is not chunked, or framing headers with whitespace before their colon or folded on several lines. it returns
+// nil if the framing is unambiguous.
+func FramingError(payload []byte) error {
+	pos := MIMEHeadersStartPos(payload)
+	end := MIMEHeadersEndPos(payload)
+	if pos < 0 || end == -1 {
+		return nil
+	}
+	var framing bool
+	for pos < end-2 {
+		nl := bytes.IndexByte(payload[pos:end], '\n') + pos
+		line := payload[pos:nl]
+		pos = nl + 1
+		if len(line) > 0 && (line[0] == ' ' || line[0] == '\t') {
+			if framing {
+				return ErrObfuscatedHeader // obs-fold
+			}
+			continue
+		}
+		colon := bytes.IndexByte(line, ':')
+		if colon == -1 {
+			continue
+		}
+		name := bytes.TrimSpace(line[:colon])
+		framing = bytes.EqualFold(name, contentLength) || bytes.EqualFold(name, transferEncoding)
+		if framing && len(name) != colon {
+			return ErrObfuscatedHeader
+		}
+	}
+
+	lengths := HeaderList(payload, contentLength)
+	for _, l := range lengths {
+		if _, err := strconv.ParseUint(string(l), 10, 63); err != nil {
+			return ErrInvalidLength
+		}
+		if !bytes.Equal(l, lengths[0]) {
+			return ErrConflictingLengths
+		}
+	}
+	codings := HeaderList(payload, transferEncoding)
+	if len(codings) == 0 {
+		if len(HeaderValues(payload, transferEncoding)) > 0 {
+			return ErrInvalidTransferEncoding
+		}
+		return nil
+	}
+	for i, c := range codings {
+		if chunked := bytes.EqualFold(c, []byte("chunked")); chunked != (i == len(codings)-1) {
+			return ErrInvalidTransferEncoding
+		}
+	}
+	if len(lengths) > 0 {
+		return ErrLengthAndChunked
+	}
+	return nil
+}
+
+// NormalizeFraming rewrites the framing headers of the message to the framing used to capture it: a single
+// Transfer-Encoding: chunked if the Transfer-Encoding holds chunked, else a single Content-Length of the size
+// of the body. it returns the modified payload.
+func NormalizeFraming(payload []byte) []byte {
+	chunked := bytes.Contains(Header(payload, transferEncoding), []byte("chunked"))
+	hadLength := len(HeaderValues(payload, contentLength)) > 0
+
+	// the fields with whitespace before their colon and their folded lines are removed as well
+	pos := MIMEHeadersStartPos(payload)
+	if pos < 0 {
+		return payload
+	}
+	var framing bool
+	for end := MIMEHeadersEndPos(payload); pos >= 0 && pos < end-2; end = MIMEHeadersEndPos(payload) {
+		nl := bytes.IndexByte(payload[pos:end], '\n') + pos
+		line := payload[pos:nl]
+		if len(line) > 0 && (line[0] == ' ' || line[0] == '\t') {
+			if framing {
+				payload = append(payload[:pos], payload[nl+1:]...)
+				continue
+			}
+		} else if colon := bytes.IndexByte(line, ':'); colon != -1 {
+			name := bytes.TrimSpace(line[:colon])
+			framing = bytes.EqualFold(name, contentLength) || bytes.EqualFold(name, transferEncoding)
+			if framing {
+				payload = append(payload[:pos], payload[nl+1:]...)
+				continue
+			}
+		}
+		pos = nl + 1
+	}
+
+	if chunked {
+		return AddHeader(payload, transferEncoding, []byte("chunked"))
+	}
+	if body := Body(payload); hadLength || len(body) > 0 {
+		return AddHeader(payload, contentLength, []byte(strconv.Itoa(len(body))))
+	}
+	return payload
+}
@@ -0,0 +1,357 @@
+package proto
+
+import (
+	"encoding/binary"
+)
+
+// Thrift message types
+const (
+	ThriftCall      byte = 1
+	ThriftReply     byte = 2
+	ThriftException byte = 3
+	ThriftOneway    byte = 4
+)
+
+// ThriftProtocol is the encoding of Thrift messages
+type ThriftProtocol uint8
+
+// Thrift protocols
+const (
+	ThriftBinary ThriftProtocol = iota + 1
+	ThriftCompact
+)
+
+// ThriftMaxFrame is the maximum length of the frames of the framed transport
+const ThriftMaxFrame = 64 << 20
+
+// thriftMaxName is the maximum length of method names, it tells the binary protocol without version apart
+const thriftMaxName = 1 << 16
+
+// thriftMaxDepth is the maximum nesting of structs and containers
+const thriftMaxDepth = 64
+
+// ThriftMessage is the header of a Thrift message
+type ThriftMessage struct {
+	Name     string // the name of the method, prefixed by the service of multiplexed protocols(Service:method)
+	Type     byte
+	SeqID    int32
+	Protocol ThriftProtocol
+	Framed   bool
+	Length   int // the length of framed messages, including the frame size, 0 for unframed messages
+}
+
+// ParseThriftHeader returns the header of the message at the start of data, framed or unframed, in the binary
+// protocol(strict or not) or in the compact protocol. n is the position of the struct following the header.
+func ParseThriftHeader(data []byte) (m ThriftMessage, n int, ok bool) {
+	if len(data) < 6 {
+		return
+	}
+	if data[0] != 0x80 && data[0] != 0x82 && thriftVersioned(data[4:]) {
+		size := binary.BigEndian.Uint32(data)
+		if size < 2 || size > ThriftMaxFrame {
+			return
+		}
+		if m, n, ok = ParseThriftHeader(data[4:]); !ok || m.Framed {
+			return m, 0, false
+		}
+		m.Framed = true
+		m.Length = 4 + int(size)
+		return m, 4 + n, true
+	}
+	switch data[0] {
+	case 0x80:
+		// strict binary, the version and the type, then the name and the sequence id
+		if data[1] != 0x01 {
+			return
+		}
+		m.Type = data[3] & 0x07
+		name, rest, ok := thriftBinaryString(data[4:])
+		if !ok || len(rest) < 4 {
+			return m, 0, false
+		}
+		m.Name = string(name)
+		m.SeqID = int32(binary.BigEndian.Uint32(rest))
+		n = len(data) - len(rest) + 4
+	case 0x82:
+		// compact, the version and the type, then the sequence id and the name
+		if data[1]&0x1f != 1 {
+			return
+		}
+		m.Type = data[1] >> 5
+		seq, i := binary.Uvarint(data[2:])
+		if i <= 0 {
+			return
+		}
+		size, j := binary.Uvarint(data[2+i:])
+		if j <= 0 || size > thriftMaxName || uint64(len(data)-2-i-j) < size {
+			return
+		}
+		m.SeqID = int32(seq)
+		m.Name = string(data[2+i+j : 2+i+j+int(size)])
+		n = 2 + i + j + int(size)
+		m.Protocol = ThriftCompact
+	default:
+		// binary without version, the name, then the type and the sequence id
+		name, rest, ok := thriftBinaryString(data)
+		if !ok || len(rest) < 5 {
+			return m, 0, false
+		}
+		m.Name = string(name)
+		m.Type = rest[0]
+		m.SeqID = int32(binary.BigEndian.Uint32(rest[1:]))
+		n = len(data) - len(rest) + 5
+	}
+	if m.Protocol == 0 {
+		m.Protocol = ThriftBinary
+	}
+	if m.Type < ThriftCall || m.Type > ThriftOneway || m.Name == "" && m.Type != ThriftException {
+		return m, 0, false
+	}
+	return m, n, true
+}
+
+// thriftVersioned reports whether data starts with the version of the strict binary or of the compact protocol
+func thriftVersioned(data []byte) bool {
+	return data[0] == 0x80 && data[1] == 0x01 || data[0] == 0x82 && data[1]&0x1f == 1
+}
+
+// ThriftMessageLength returns the length of the message at the start of data, or -1 if it is not complete
+func ThriftMessageLength(data []byte) int {
+	m, n, ok := ParseThriftHeader(data)
+	switch {
+	case !ok:
+		return -1
+	case m.Framed:
+		if len(data) < m.Length {
+			return -1
+		}
+		return m.Length
+	}
+	s := &thriftSkipper{data: data, i: n, compact: m.Protocol == ThriftCompact}
+	if !s.skip(thriftStruct, 0) {
+		return -1
+	}
+	return s.i
+}
+
+// thriftBinaryString returns the string of the binary protocol at the start of data and the data following it
+func thriftBinaryString(data []byte) (s, rest []byte, ok bool) {
+	if len(data) < 4 {
+		return
+	}
+	size := binary.BigEndian.Uint32(data)
+	if size > thriftMaxName || uint32(len(data)-4) < size {
+		return
+	}
+	return data[4 : 4+size], data[4+size:], true
+}
+
+// types of the binary protocol, the types of the compact protocol are converted to them
+const (
+	thriftStop   byte = 0
+	thriftBool   byte = 2
+	thriftByte   byte = 3
+	thriftDouble byte = 4
+	thriftI16    byte = 6
+	thriftI32    byte = 8
+	thriftI64    byte = 10
+	thriftString byte = 11
+	thriftStruct byte = 12
+	thriftMap    byte = 13
+	thriftSet    byte = 14
+	thriftList   byte = 15
+	thriftUUID   byte = 16
+)
+
+// compactTypes converts the types of the compact protocol, boolean true and false are both bool
+var compactTypes = [14]byte{thriftStop, thriftBool, thriftBool, thriftByte, thriftI16, thriftI32, thriftI64,
+	thriftDouble, thriftString, thriftList, thriftSet, thriftMap, thriftStruct, thriftUUID}
+
+// thriftSkipper walks the values of a message
+type thriftSkipper struct {
+	data    []byte
+	i       int
+	compact bool
+}
+
+// skip moves past a value of the type, it returns false if the value is not complete or not valid
+func (s *thriftSkipper) skip(typ byte, depth int) bool {
+	if depth > thriftMaxDepth {
+		return false
+	}
+	switch typ {
+	case thriftBool, thriftByte:
+		return s.advance(1)
+	case thriftDouble:
+		return s.advance(8)
+	case thriftUUID:
+		return s.advance(16)
+	case thriftI16, thriftI32, thriftI64:
+		if s.compact {
+			_, ok := s.varint()
+			return ok
+		}
+		switch typ {
+		case thriftI16:
+			return s.advance(2)
+		case thriftI32:
+			return s.advance(4)
+		}
+		return s.advance(8)
+	case thriftString:
+		size, ok := s.size()
+		return ok && s.advance(size)
+	case thriftStruct:
+		return s.skipStruct(depth)
+	case thriftList, thriftSet:
+		var elem byte
+		var size int
+		if s.compact {
+			if s.i >= len(s.data) {
+				return false
+			}
+			b := s.data[s.i]
+			s.i++
+			if elem = s.compactType(b & 0x0f); elem == 0xff {
+				return false
+			}
+			if size = int(b >> 4); size == 15 {
+				var ok bool
+				if size, ok = s.size(); !ok {
+					return false
+				}
+			}
+		} else {
+			if s.i+5 > len(s.data) {
+				return false
+			}
+			elem = s.data[s.i]
+			size = int(int32(binary.BigEndian.Uint32(s.data[s.i+1:])))
+			s.i += 5
+		}
+		return s.skipElements(size, depth, elem)
+	case thriftMap:
+		var key, value byte
+		var size int
+		if s.compact {
+			var ok bool
+			if size, ok = s.size(); !ok {
+				return false
+			}
+			if size == 0 {
+				return true
+			}
+			if s.i >= len(s.data) {
+				return false
+			}
+			b := s.data[s.i]
+			s.i++
+			key, value = s.compactType(b>>4), s.compactType(b&0x0f)
+		} else {
+			if s.i+6 > len(s.data) {
+				return false
+			}
+			key, value = s.data[s.i], s.data[s.i+1]
+			size = int(int32(binary.BigEndian.Uint32(s.data[s.i+2:])))
+			s.i += 6
+		}
+		if key == 0xff || value == 0xff {
+			return false
+		}
+		return s.skipElements(size, depth, key, value)
+	}
+	return false
+}
+
+// skipElements moves past size elements of containers, each element being values of the types
+func (s *thriftSkipper) skipElements(size int, depth int, types ...byte) bool {
+	if size < 0 || size > len(s.data) {
+		return false
+	}
+	for j := 0; j < size; j++ {
+		for _, typ := range types {
+			if !s.skip(typ, depth+1) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// skipStruct moves past the fields of a struct and its stop
+func (s *thriftSkipper) skipStruct(depth int) bool {
+	for {
+		if s.i >= len(s.data) {
+			return false
+		}
+		b := s.data[s.i]
+		s.i++
+		if b == thriftStop {
+			return true
+		}
+		typ := b
+		if s.compact {
+			if b>>4 == 0 {
+				// the field id is not a delta
+				if _, ok := s.varint(); !ok {
+					return false
+				}
+			}
+			switch b & 0x0f {
+			case 1, 2:
+				// the value of booleans is their type
+				continue
+			}
+			if typ = s.compactType(b & 0x0f); typ == 0xff {
+				return false
+			}
+		} else if !s.advance(2) {
+			return false
+		}
+		if !s.skip(typ, depth+1) {
+			return false
+		}
+	}
+}
+
+// compactType returns the type of a compact type, 0xff if it is not valid
+func (s *thriftSkipper) compactType(t byte) byte {
+	if t == 0 || int(t) >= len(compactTypes) {
+		return 0xff
+	}
+	return compactTypes[t]
+}
+
+func (s *thriftSkipper) advance(n int) bool {
+	if n < 0 || len(s.data)-s.i < n {
+		return false
+	}
+	s.i += n
+	return true
+}
+
+func (s *thriftSkipper) varint() (uint64, bool) {
+	if s.i >= len(s.data) {
+		return 0, false
+	}
+	v, n := binary.Uvarint(s.data[s.i:])
+	if n <= 0 {
+		return 0, false
+	}
+	s.i += n
+	return v, true
+}
+
+// size returns the size of strings and containers
+func (s *thriftSkipper) size() (int, bool) {
+	if s.compact {
+		v, ok := s.varint()
+		return int(v), ok && v <= uint64(len(s.data))
+	}
+	if s.i+4 > len(s.data) {
+		return 0, false
+	}
+	size := int32(binary.BigEndian.Uint32(s.data[s.i:]))
+	s.i += 4
+	return int(size), size >= 0
+}
@@ -0,0 +1,62 @@
+package proto
+
+import "encoding/binary"
+
+// TLSRecordHeaderLen is the length of the header of TLS records
+const TLSRecordHeaderLen = 5
+
+// TLS record content types
+const (
+	TLSChangeCipherSpec uint8 = 20
+	TLSAlert            uint8 = 21
+	TLSHandshake        uint8 = 22
+	TLSApplicationData  uint8 = 23
+)
+
+// TLS handshake message types
+const (
+	TLSClientHello       uint8 = 1
+	TLSServerHello       uint8 = 2
+	TLSClientKeyExchange uint8 = 16
+	TLSFinished          uint8 = 20
+	TLSKeyUpdate         uint8 = 24
+)
+
+// TLSRecord is a record of a TLS connection
+type TLSRecord struct {
+	Type     uint8
+	Version  uint16
+	Fragment []byte
+}
+
+// ParseTLSRecord returns the record at the start of data and its length, n is 0 if the record is not complete
+// or if data doesn't start with a record
+func ParseTLSRecord(data []byte) (r TLSRecord, n int) {
+	if len(data) < TLSRecordHeaderLen || data[0] < TLSChangeCipherSpec || data[0] > TLSApplicationData || data[1] != 3 {
+		return
+	}
+	length := int(binary.BigEndian.Uint16(data[3:]))
+	if len(data) < TLSRecordHeaderLen+length {
+		return
+	}
+	r.Type = data[0]
+	r.Version = binary.BigEndian.Uint16(data[1:])
+	r.Fragment = data[TLSRecordHeaderLen : TLSRecordHeaderLen+length]
+	return r, TLSRecordHeaderLen + length
+}
+
+// TLSRecordsLength returns the length of the complete records at the start of data, or -1 if there is none
+func TLSRecordsLength(data []byte) int {
+	var length int
+	for {
+		_, n := ParseTLSRecord(data[length:])
+		if n == 0 {
+			break
+		}
+		length += n
+	}
+	if length == 0 {
+		return -1
+	}
+	return length
+}
@@ -0,0 +1,137 @@
+package proto
+
+import (
+	"bytes"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// URLNormalization tells how NormalizeURL rewrites the request-target of a request
+type URLNormalization struct {
+	Decode    bool // percent-decode the path and the query params
+	Slashes   bool // collapse the duplicate slashes of the path
+	SortQuery bool // sort the query params
+	Template  bool // replace the numeric, UUID and long hexadecimal segments of the path with {id}
+
+	// paths like /users/{id}/orders/{order}, split in segments, their parameters replace the matching
+	// segments of the paths, the first matching template applies
+	Templates [][]string
+}
+
+// Enabled reports whether a step of the normalization is enabled
+func (n *URLNormalization) Enabled() bool {
+	return n.Decode || n.Slashes || n.SortQuery || n.Template || len(n.Templates) > 0
+}
+
+// NormalizeURL returns the request-target of a request normalized, so that the URLs of the same resource are
+// equal, e.g: /users//42?b=2&a=%31 is /users/{id}?a=1&b=2 with all the steps enabled. the scheme and the host
+// of the absolute-form targets are kept.
+func NormalizeURL(target []byte, n *URLNormalization) []byte {
+	var prefix string
+	s := string(target)
+	if i := strings.Index(s, "://"); i != -1 && i < strings.IndexByte(s+"/", '/') {
+		end := strings.IndexAny(s[i+3:], "/?")
+		if end == -1 {
+			end = len(s) - i - 3
+		}
+		prefix, s = s[:i+3+end], s[i+3+end:]
+	}
+	p, query := s, ""
+	if i := strings.IndexByte(s, '?'); i != -1 {
+		p, query = s[:i], s[i+1:]
+	}
+
+	if n.Decode {
+		if decoded, err := url.PathUnescape(p); err == nil {
+			p = decoded
+		}
+	}
+	if n.Slashes {
+		for strings.Contains(p, "//") {
+			p = strings.Replace(p, "//", "/", -1)
+		}
+	}
+	if n.Template || len(n.Templates) > 0 {
+		p = n.template(p)
+	}
+
+	if query != "" && (n.Decode || n.SortQuery) {
+		params := strings.Split(query, "&")
+		if n.Decode {
+			for i, param := range params {
+				if decoded, err := url.QueryUnescape(param); err == nil {
+					params[i] = decoded
+				}
+			}
+		}
+		if n.SortQuery {
+			sort.Strings(params)
+		}
+		query = strings.Join(params, "&")
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(prefix)
+	buf.WriteString(p)
+	if query != "" {
+		buf.WriteByte('?')
+		buf.WriteString(query)
+	}
+	return buf.Bytes()
+}
+
+// template replaces the segments of the path matching the parameters of a template
+func (n *URLNormalization) template(p string) string {
+	segments := strings.Split(p, "/")
+	for _, t := range n.Templates {
+		if len(t) != len(segments) {
+			continue
+		}
+		matched := true
+		for i, s := range t {
+			if !isTemplateParam(s) && s != segments[i] {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return strings.Join(t, "/")
+		}
+	}
+	if !n.Template {
+		return p
+	}
+	for i, s := range segments {
+		if isIDSegment(s) {
+			segments[i] = "{id}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+func isTemplateParam(segment string) bool {
+	return len(segment) > 2 && segment[0] == '{' && segment[len(segment)-1] == '}'
+}
+
+// isIDSegment reports whether the segment of a path looks like an identifier: a number, a UUID, or a
+// hexadecimal string of at least 16 characters like the ids of MongoDB or the hashes
+func isIDSegment(s string) bool {
+	if s == "" {
+		return false
+	}
+	digits := true
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= '0' && c <= '9':
+		case c >= 'a' && c <= 'f', c >= 'A' && c <= 'F':
+			digits = false
+		case c == '-' && len(s) == 36 && (i == 8 || i == 13 || i == 18 || i == 23):
+			digits = false
+		default:
+			return false
+		}
+	}
+	return digits || len(s) >= 16
+}
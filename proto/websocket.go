@@ -0,0 +1,163 @@
+package proto
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+)
+
+// WebSocket opcodes(https://tools.ietf.org/html/rfc6455#section-5.2)
+const (
+	WebSocketContinuation uint8 = 0x0
+	WebSocketText         uint8 = 0x1
+	WebSocketBinary       uint8 = 0x2
+	WebSocketClose        uint8 = 0x8
+	WebSocketPing         uint8 = 0x9
+	WebSocketPong         uint8 = 0xA
+)
+
+// webSocketGUID is appended to the key of the handshake to compute the accept value
+const webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocketFrame is a frame of a WebSocket connection, the payload of masked frames is masked
+type WebSocketFrame struct {
+	Fin     bool
+	Rsv     uint8 // the RSV1-3 bits, e.g: RSV1 flags compressed messages of permessage-deflate
+	Opcode  uint8
+	Masked  bool
+	Key     [4]byte
+	Payload []byte
+}
+
+// IsControl reports whether the frame is a control frame, they can be interleaved with the frames of fragmented messages
+func (f *WebSocketFrame) IsControl() bool {
+	return f.Opcode&0x8 != 0
+}
+
+// Unmask returns a copy of the payload of the frame, unmasked
+func (f *WebSocketFrame) Unmask() []byte {
+	p := append([]byte(nil), f.Payload...)
+	if f.Masked {
+		for i := range p {
+			p[i] ^= f.Key[i%4]
+		}
+	}
+	return p
+}
+
+// WebSocketHeaderLen returns the length of the header of the frame at the start of data, found in its first
+// two bytes, or -1 if data is shorter
+func WebSocketHeaderLen(data []byte) int {
+	if len(data) < 2 {
+		return -1
+	}
+	n := 2
+	switch data[1] & 0x7f {
+	case 126:
+		n += 2
+	case 127:
+		n += 8
+	}
+	if data[1]&0x80 != 0 {
+		n += 4
+	}
+	return n
+}
+
+// WebSocketFrameLength returns the length of the frame at the start of data, found in its header,
+// or -1 if the header is not complete
+func WebSocketFrameLength(data []byte) int {
+	header := WebSocketHeaderLen(data)
+	if header < 0 || len(data) < header {
+		return -1
+	}
+	length := uint64(data[1] & 0x7f)
+	switch length {
+	case 126:
+		length = uint64(binary.BigEndian.Uint16(data[2:]))
+	case 127:
+		length = binary.BigEndian.Uint64(data[2:])
+	}
+	if length > uint64(int(^uint(0)>>1)-header) {
+		return -1
+	}
+	return header + int(length)
+}
+
+// ParseWebSocketFrame returns the frame at the start of data and its length, n is 0 if the frame is not complete
+func ParseWebSocketFrame(data []byte) (f WebSocketFrame, n int) {
+	length := WebSocketFrameLength(data)
+	if length < 0 || len(data) < length {
+		return
+	}
+	header := WebSocketHeaderLen(data)
+	f.Fin = data[0]&0x80 != 0
+	f.Rsv = data[0] >> 4 & 0x7
+	f.Opcode = data[0] & 0xf
+	f.Masked = data[1]&0x80 != 0
+	if f.Masked {
+		copy(f.Key[:], data[header-4:])
+	}
+	f.Payload = data[header:length]
+	return f, length
+}
+
+// AppendWebSocketFrame appends the frame to dst and returns the extended buffer, the payload of masked
+// frames is masked with their key.
+func AppendWebSocketFrame(dst []byte, f WebSocketFrame) []byte {
+	b := f.Rsv<<4 | f.Opcode&0xf
+	if f.Fin {
+		b |= 0x80
+	}
+	dst = append(dst, b)
+	var mask byte
+	if f.Masked {
+		mask = 0x80
+	}
+	switch length := len(f.Payload); {
+	case length < 126:
+		dst = append(dst, mask|byte(length))
+	case length <= 0xffff:
+		dst = append(dst, mask|126, byte(length>>8), byte(length))
+	default:
+		dst = append(dst, mask|127)
+		dst = append(dst, make([]byte, 8)...)
+		binary.BigEndian.PutUint64(dst[len(dst)-8:], uint64(length))
+	}
+	if !f.Masked {
+		return append(dst, f.Payload...)
+	}
+	dst = append(dst, f.Key[:]...)
+	for i, c := range f.Payload {
+		dst = append(dst, c^f.Key[i%4])
+	}
+	return dst
+}
+
+// WebSocketFramesLength returns the length of the complete frames at the start of data, or -1 if there is none
+func WebSocketFramesLength(data []byte) int {
+	var length int
+	for {
+		_, n := ParseWebSocketFrame(data[length:])
+		if n == 0 {
+			break
+		}
+		length += n
+	}
+	if length == 0 {
+		return -1
+	}
+	return length
+}
+
+// IsWebSocketUpgrade reports whether the payload is a request upgrading its connection to WebSocket
+func IsWebSocketUpgrade(payload []byte) bool {
+	return HasRequestTitle(payload) && bytes.EqualFold(Header(payload, []byte("Upgrade")), []byte("websocket"))
+}
+
+// WebSocketAccept returns the Sec-WebSocket-Accept value of the response to an upgrade with the Sec-WebSocket-Key key
+func WebSocketAccept(key []byte) string {
+	sha := sha1.Sum(append(append([]byte(nil), key...), webSocketGUID...))
+	return base64.StdEncoding.EncodeToString(sha[:])
+}
@@ -5,6 +5,9 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"fmt"
+	"strings"
+
+	"github.com/buger/goreplay/proto"
 )
 
 // These constants help to indicate the type of payload
@@ -90,3 +93,60 @@ func isOriginPayload(payload []byte) bool {
 func isRequestPayload(payload []byte) bool {
 	return payload[0] == RequestPayload
 }
+
+// payloadKey returns the dot separated key of the payload, like a NATS subject or an AMQP routing key, from a
+// template: {method}, {host} and {path} are replaced by the method, the host and the segments of the path of the
+// requests, and {type} by the type of the payload. the characters of the tokens that are not allowed in keys are
+// replaced with _, and so are the empty tokens, like the method of the responses.
+func payloadKey(template string, data []byte) string {
+	var method, host []byte
+	var path []string
+	if body := payloadBody(data); isRequestPayload(data) && proto.HasRequestTitle(body) {
+		method, host = proto.Method(body), proto.Header(body, []byte("Host"))
+		p := string(proto.Path(body))
+		if i := strings.IndexByte(p, '?'); i != -1 {
+			p = p[:i]
+		}
+		for _, segment := range strings.Split(p, "/") {
+			if segment != "" {
+				path = append(path, keyToken(segment))
+			}
+		}
+	}
+	if len(path) == 0 {
+		path = append(path, "_")
+	}
+	return strings.NewReplacer(
+		"{method}", keyToken(string(method)),
+		"{host}", keyToken(string(host)),
+		"{path}", strings.Join(path, "."),
+		"{type}", string(data[0]),
+	).Replace(template)
+}
+
+// payloadPartitionKey returns the partition key of the payload: the value of the header name of the requests,
+// or the UUID of the payload, for the responses, the requests without the header, and the name uuid
+func payloadPartitionKey(name string, data []byte) []byte {
+	if name != "uuid" && isRequestPayload(data) {
+		if value := proto.Header(payloadBody(data), []byte(name)); len(value) > 0 {
+			return value
+		}
+	}
+	if meta := payloadMeta(data); len(meta) > 1 {
+		return meta[1]
+	}
+	return nil
+}
+
+func keyToken(s string) string {
+	if s == "" {
+		return "_"
+	}
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.', '*', '>', '#', ' ', '\t', '\r', '\n':
+			return '_'
+		}
+		return r
+	}, s)
+}
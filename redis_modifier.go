@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/buger/goreplay/proto"
+)
+
+// RedisModifierConfig is the configuration of the filters of Redis commands
+type RedisModifierConfig struct {
+	Commands         RedisCommands `json:"redis-allow-command"`
+	NegativeCommands RedisCommands `json:"redis-disallow-command"`
+	ReadOnly         bool          `json:"redis-read-only"`
+}
+
+// RedisCommands holds names of Redis commands, a name followed by a subcommand(e.g: CONFIG GET) only matches
+// the subcommand
+type RedisCommands []string
+
+func (c *RedisCommands) String() string {
+	return fmt.Sprint(*c)
+}
+
+// Set is here so that RedisCommands can implement flag.Var
+func (c *RedisCommands) Set(value string) error {
+	fields := strings.Fields(value)
+	if len(fields) == 0 || len(fields) > 2 {
+		return fmt.Errorf("invalid redis command %q", value)
+	}
+	*c = append(*c, strings.ToUpper(strings.Join(fields, " ")))
+	return nil
+}
+
+// redisReadCommands are the commands kept by --redis-read-only: the commands reading the keyspace and the
+// commands of the connection, so that the reads are replayed in their database and with their protocol version
+var redisReadCommands = map[string]bool{
+	"GET": true, "MGET": true, "GETRANGE": true, "SUBSTR": true, "STRLEN": true, "LCS": true,
+	"EXISTS": true, "TYPE": true, "TTL": true, "PTTL": true, "EXPIRETIME": true, "PEXPIRETIME": true,
+	"KEYS": true, "SCAN": true, "RANDOMKEY": true, "DBSIZE": true, "DUMP": true, "OBJECT": true, "TOUCH": true,
+	"HGET": true, "HMGET": true, "HGETALL": true, "HKEYS": true, "HVALS": true, "HLEN": true, "HEXISTS": true,
+	"HSTRLEN": true, "HSCAN": true, "HRANDFIELD": true,
+	"LRANGE": true, "LINDEX": true, "LLEN": true, "LPOS": true,
+	"SMEMBERS": true, "SISMEMBER": true, "SMISMEMBER": true, "SCARD": true, "SRANDMEMBER": true, "SSCAN": true,
+	"SINTER": true, "SINTERCARD": true, "SUNION": true, "SDIFF": true,
+	"ZRANGE": true, "ZRANGEBYSCORE": true, "ZRANGEBYLEX": true, "ZREVRANGE": true, "ZREVRANGEBYSCORE": true,
+	"ZREVRANGEBYLEX": true, "ZRANK": true, "ZREVRANK": true, "ZSCORE": true, "ZMSCORE": true, "ZCARD": true,
+	"ZCOUNT": true, "ZLEXCOUNT": true, "ZSCAN": true, "ZRANDMEMBER": true, "ZINTER": true, "ZINTERCARD": true,
+	"ZUNION": true, "ZDIFF": true,
+	"GETBIT": true, "BITCOUNT": true, "BITPOS": true, "BITFIELD_RO": true, "PFCOUNT": true,
+	"GEOPOS": true, "GEODIST": true, "GEOHASH": true, "GEOSEARCH": true, "GEORADIUS_RO": true, "GEORADIUSBYMEMBER_RO": true,
+	"XRANGE": true, "XREVRANGE": true, "XLEN": true, "XREAD": true, "XINFO": true, "XPENDING": true,
+	"SORT_RO": true, "EVAL_RO": true, "EVALSHA_RO": true, "FCALL_RO": true,
+	"PING": true, "ECHO": true, "SELECT": true, "AUTH": true, "HELLO": true, "CLIENT": true, "READONLY": true,
+	"RESET": true, "QUIT": true,
+}
+
+// RedisModifier filters the commands recorded with --input-raw-protocol redis by their name. the payloads that
+// are not commands sent as arrays of bulk strings are returned as is.
+type RedisModifier struct {
+	config *RedisModifierConfig
+}
+
+// NewRedisModifier returns nil when nothing is filtered
+func NewRedisModifier(config *RedisModifierConfig) *RedisModifier {
+	if len(config.Commands) == 0 && len(config.NegativeCommands) == 0 && !config.ReadOnly {
+		return nil
+	}
+	return &RedisModifier{config: config}
+}
+
+// Rewrite returns the command, or nothing if it is filtered out
+func (m *RedisModifier) Rewrite(payload []byte) []byte {
+	if len(payload) == 0 || payload[0] != proto.RESPArray {
+		return payload
+	}
+	args, ok := proto.RESPCommand(payload)
+	if !ok {
+		return payload
+	}
+	name := string(bytes.ToUpper(args[0]))
+	sub := ""
+	if len(args) > 1 {
+		sub = name + " " + string(bytes.ToUpper(args[1]))
+	}
+	if m.config.ReadOnly && !redisReadCommands[name] {
+		return nil
+	}
+	if len(m.config.Commands) > 0 && !matchCommands(m.config.Commands, name, sub) {
+		return nil
+	}
+	if matchCommands(m.config.NegativeCommands, name, sub) {
+		return nil
+	}
+	return payload
+}
+
+// matchCommands reports whether the command or its subcommand is one of the commands
+func matchCommands(commands RedisCommands, name, sub string) bool {
+	for _, c := range commands {
+		if c == name || c == sub {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/buger/goreplay/proto"
+)
+
+func TestRedisModifier(t *testing.T) {
+	if NewRedisModifier(&RedisModifierConfig{}) != nil {
+		t.Error("expected no modifier without filters")
+	}
+	command := func(args ...string) []byte {
+		var b [][]byte
+		for _, arg := range args {
+			b = append(b, []byte(arg))
+		}
+		return proto.AppendRESPCommand(nil, b...)
+	}
+	tests := []struct {
+		config  func(*RedisModifierConfig)
+		command []byte
+		kept    bool
+	}{
+		{func(c *RedisModifierConfig) { c.ReadOnly = true }, command("get", "a"), true},
+		{func(c *RedisModifierConfig) { c.ReadOnly = true }, command("SELECT", "1"), true},
+		{func(c *RedisModifierConfig) { c.ReadOnly = true }, command("SET", "a", "1"), false},
+		{func(c *RedisModifierConfig) { c.Commands.Set("get") }, command("GET", "a"), true},
+		{func(c *RedisModifierConfig) { c.Commands.Set("get") }, command("DEL", "a"), false},
+		{func(c *RedisModifierConfig) { c.Commands.Set("config get") }, command("CONFIG", "GET", "maxmemory"), true},
+		{func(c *RedisModifierConfig) { c.Commands.Set("config get") }, command("CONFIG", "SET", "maxmemory", "1"), false},
+		{func(c *RedisModifierConfig) { c.NegativeCommands.Set("FLUSHALL") }, command("flushall"), false},
+		{func(c *RedisModifierConfig) { c.NegativeCommands.Set("FLUSHALL") }, command("INCR", "a"), true},
+		// the inline commands and the payloads that are not commands are kept
+		{func(c *RedisModifierConfig) { c.ReadOnly = true }, []byte("SET a 1\r\n"), true},
+		{func(c *RedisModifierConfig) { c.ReadOnly = true }, []byte("GET / HTTP/1.1\r\n\r\n"), true},
+	}
+	for i, tt := range tests {
+		config := new(RedisModifierConfig)
+		tt.config(config)
+		got := NewRedisModifier(config).Rewrite(tt.command)
+		if kept := bytes.Equal(got, tt.command); kept != tt.kept || !kept && len(got) != 0 {
+			t.Errorf("%d: expected %q to be kept %v, got %q", i, tt.command, tt.kept, got)
+		}
+	}
+	var commands RedisCommands
+	if commands.Set("CONFIG GET maxmemory") == nil || commands.Set(" ") == nil {
+		t.Error("expected invalid commands to be rejected")
+	}
+}
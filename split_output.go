@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// splitWeights routes the sessions to the outputs by weight, see --split-output-weights. the id of a session is
+// hashed to a point of [0, total) and the session goes to the output whose range of the cumulative weights has
+// it, so that ramping the weight of an output up only moves the sessions in the ranges that changed
+var splitWeights outputWeights
+
+type outputWeights struct {
+	sync.RWMutex
+	outputs []string
+	weights []int
+	total   int
+}
+
+// setup sets the weights of the outputs, they are in the order of the outputs
+func (s *outputWeights) setup(weights string, outputs []io.Writer) error {
+	s.Lock()
+	s.outputs = make([]string, len(outputs))
+	for i, o := range outputs {
+		s.outputs[i] = fmt.Sprint(o)
+	}
+	s.Unlock()
+	return s.set(weights)
+}
+
+// set parses the weights, a comma separated list of numbers like 90,10
+func (s *outputWeights) set(weights string) error {
+	var parsed []int
+	total := 0
+	for _, w := range strings.Split(weights, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(w))
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid weight %q", w)
+		}
+		parsed = append(parsed, n)
+		total += n
+	}
+	s.Lock()
+	defer s.Unlock()
+	if len(parsed) != len(s.outputs) {
+		return fmt.Errorf("%d weights for %d outputs", len(parsed), len(s.outputs))
+	}
+	if total == 0 {
+		return fmt.Errorf("the weights are all 0")
+	}
+	s.weights, s.total = parsed, total
+	return nil
+}
+
+func (s *outputWeights) enabled() bool {
+	s.RLock()
+	defer s.RUnlock()
+	return s.total > 0
+}
+
+// pick returns the index of the output of the session
+func (s *outputWeights) pick(id []byte) int {
+	hasher := fnv.New32a()
+	hasher.Write(id)
+	s.RLock()
+	defer s.RUnlock()
+	point := int(uint64(hasher.Sum32()) * uint64(s.total) >> 32)
+	for i, w := range s.weights {
+		if point < w {
+			return i
+		}
+		point -= w
+	}
+	return len(s.weights) - 1
+}
+
+// ServeHTTP writes the weights of the outputs as json, they are set with a POST request with the weights
+// parameter
+func (s *outputWeights) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		if !s.enabled() {
+			http.Error(w, "the outputs are not split by weight, see --split-output-weights", http.StatusConflict)
+			return
+		}
+		if err := s.set(r.FormValue("weights")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("[EMITTER] the weights of the outputs are %s", r.FormValue("weights"))
+	}
+	s.RLock()
+	defer s.RUnlock()
+	type output struct {
+		Output string `json:"output"`
+		Weight int    `json:"weight"`
+	}
+	outputs := make([]output, 0, len(s.weights))
+	for i, w := range s.weights {
+		outputs = append(outputs, output{s.outputs[i], w})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(outputs)
+}
@@ -0,0 +1,192 @@
+package tcp
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+	"github.com/buger/goreplay/size"
+	"github.com/google/gopacket/layers"
+)
+
+// AMQPSplit is a HintSplit for AMQP 0-9-1, a message holds a frame or the protocol header
+func AMQPSplit(m *Message) int {
+	return proto.AMQPFrameLength(m.Data())
+}
+
+// amqpExpire is how long the state of an idle AMQP connection is kept
+const amqpExpire = 10 * time.Minute
+
+// AMQPDemuxer follows the AMQP 0-9-1 connections, its Handler is the handler of a pool splitting messages with
+// AMQPSplit and whose Start is AMQPDemuxer.Start. the basic.publish commands sent by the clients, their method
+// frame followed by their content header and body frames, are passed to the handler as one message, and the
+// messages of a connection have the UUID of the connection. the other frames are dropped.
+type AMQPDemuxer struct {
+	sync.Mutex
+	handler   Handler
+	debug     Debugger
+	maxSize   size.Size
+	conns     map[string]*amqpConn // by client=server
+	lastPurge time.Time
+	Port      uint16 // when not 0, the frames to this port of connections whose protocol header was not captured are incoming
+}
+
+type amqpConn struct {
+	created time.Time // timestamp of the first message of the connection
+	seen    time.Time
+	publish map[uint16]*amqpPublish // by channel
+}
+
+// amqpPublish is a basic.publish command waiting for its content
+type amqpPublish struct {
+	start     time.Time
+	frames    []byte
+	remaining uint64 // size of the body not received yet
+	header    bool   // the content header was received
+}
+
+// NewAMQPDemuxer returns a new AMQP demultiplexer, the commands larger than maxSize are dropped, default 5mb
+func NewAMQPDemuxer(maxSize size.Size, debugger Debugger, handler Handler) *AMQPDemuxer {
+	d := new(AMQPDemuxer)
+	d.handler = handler
+	d.debug = debugger
+	d.maxSize = maxSize
+	if d.maxSize < 1 {
+		d.maxSize = 5 << 20
+	}
+	d.conns = make(map[string]*amqpConn)
+	d.lastPurge = time.Now()
+	return d
+}
+
+// Start is the HintStart of AMQP connections, the protocol header starts the messages of clients.
+// the direction of connections already seen is kept.
+func (d *AMQPDemuxer) Start(pckt *Packet) (isIncoming, isOutgoing bool) {
+	if len(pckt.Payload) == 0 {
+		return
+	}
+	src, dst := pckt.Src(), pckt.Dst()
+	d.Lock()
+	_, client := d.conns[src+"="+dst]
+	_, server := d.conns[dst+"="+src]
+	d.Unlock()
+	switch {
+	case client:
+		return true, false
+	case server:
+		return false, true
+	case d.Port != 0:
+		return uint16(pckt.DstPort) == d.Port, uint16(pckt.SrcPort) == d.Port
+	}
+	return bytes.HasPrefix(pckt.Payload, []byte(proto.AMQPProtocolHeader)), false
+}
+
+// Handler handles the frames of a direction of a connection
+func (d *AMQPDemuxer) Handler(m *Message) {
+	defer m.Release()
+	client, server := m.SrcAddr, m.DstAddr
+	if !m.IsIncoming {
+		client, server = server, client
+	}
+	key := client + "=" + server
+	now := time.Now()
+	d.Lock()
+	defer d.Unlock()
+	if now.Sub(d.lastPurge) > amqpExpire/10 {
+		d.purge(now)
+	}
+	data := m.Data()
+	if m.IsIncoming && bytes.Equal(data, []byte(proto.AMQPProtocolHeader)) {
+		// the ports may be reused by a new connection
+		d.conns[key] = &amqpConn{created: m.Start, seen: now}
+		return
+	}
+	c, ok := d.conns[key]
+	if !ok {
+		c = &amqpConn{created: m.Start}
+		d.conns[key] = c
+	}
+	c.seen = now
+	typ, channel, payload, n := proto.AMQPFrame(data)
+	if m.Truncated || n == 0 {
+		go d.say(5, fmt.Sprintf("truncated amqp frame from %s to %s dropped\n", m.SrcAddr, m.DstAddr))
+		delete(c.publish, channel)
+		return
+	}
+	class, method, _, _ := proto.AMQPMethod(payload)
+	if typ == proto.AMQPFrameMethod && class == proto.AMQPConnection &&
+		(method == proto.AMQPConnectionClose || method == proto.AMQPConnectionCloseOk) {
+		delete(d.conns, key)
+		return
+	}
+	if !m.IsIncoming {
+		return
+	}
+	p := c.publish[channel]
+	switch typ {
+	case proto.AMQPFrameMethod:
+		delete(c.publish, channel)
+		if class != proto.AMQPBasic || method != proto.AMQPBasicPublish {
+			return
+		}
+		if c.publish == nil {
+			c.publish = make(map[uint16]*amqpPublish)
+		}
+		c.publish[channel] = &amqpPublish{start: m.Start, frames: append([]byte(nil), data...)}
+		return
+	case proto.AMQPFrameHeader:
+		_, bodySize, _, ok := proto.AMQPContentHeader(payload)
+		if p == nil || p.header || !ok {
+			delete(c.publish, channel)
+			return
+		}
+		p.header, p.remaining = true, bodySize
+	case proto.AMQPFrameBody:
+		if p == nil || !p.header || uint64(len(payload)) > p.remaining {
+			delete(c.publish, channel)
+			return
+		}
+		p.remaining -= uint64(len(payload))
+	default:
+		return
+	}
+	if len(p.frames)+len(data) > int(d.maxSize) {
+		go d.say(5, fmt.Sprintf("amqp publish from %s to %s larger than %d bytes dropped\n", m.SrcAddr, m.DstAddr, d.maxSize))
+		delete(c.publish, channel)
+		return
+	}
+	p.frames = append(p.frames, data...)
+	if p.remaining == 0 {
+		delete(c.publish, channel)
+		d.emit(c, m, p)
+	}
+}
+
+// emit passes the command to the handler as an incoming message
+func (d *AMQPDemuxer) emit(c *amqpConn, m *Message, p *amqpPublish) {
+	msg := NewMessage(m.SrcAddr, m.DstAddr, m.IPversion)
+	msg.IsIncoming = true
+	msg.conn = &connection{syn: c.created}
+	msg.add(0, &Packet{TCP: &layers.TCP{BaseLayer: layers.BaseLayer{Payload: p.frames}}, Timestamp: m.End})
+	msg.Start = p.start
+	msg.TimedOut = m.TimedOut
+	d.handler(msg)
+}
+
+// purge forgets the connections idle for longer than amqpExpire
+func (d *AMQPDemuxer) purge(now time.Time) {
+	d.lastPurge = now
+	for key, c := range d.conns {
+		if now.Sub(c.seen) > amqpExpire {
+			delete(d.conns, key)
+		}
+	}
+}
+
+func (d *AMQPDemuxer) say(level int, args ...interface{}) {
+	if d.debug != nil {
+		d.debug(level, args...)
+	}
+}
@@ -0,0 +1,59 @@
+package tcp
+
+import (
+	"fmt"
+
+	"github.com/buger/goreplay/proto"
+	"github.com/google/gopacket/layers"
+)
+
+// DNSSplit is a HintSplit for DNS over TCP, a message holds a query or a response prefixed by its length
+func DNSSplit(m *Message) int {
+	return proto.DNSTCPLength(m.Data())
+}
+
+// DNSStart returns the HintStart of DNS over TCP, the messages to port are queries when it is not 0, else the
+// direction is given by the header of the message
+func DNSStart(port uint16) HintStart {
+	return func(pckt *Packet) (isIncoming, isOutgoing bool) {
+		if port != 0 {
+			return uint16(pckt.DstPort) == port, uint16(pckt.SrcPort) == port
+		}
+		if len(pckt.Payload) < 2+proto.DNSHeaderLen {
+			return
+		}
+		_, response, _ := proto.DNSHeader(pckt.Payload[2:])
+		return !response, response
+	}
+}
+
+// DNSTransactions returns the handler of the DNS messages of a UDP pool, or of a TCP pool split with
+// pool.SetHints("dns") when overTCP. the queries are incoming and the responses outgoing whatever the ports,
+// the length prefixing the messages over TCP is removed, and the id of a query is part of the UUID of the query
+// and of its response, so that the queries sent from the same port don't share it. the other messages are dropped.
+func DNSTransactions(overTCP bool, debugger Debugger, handler Handler) Handler {
+	return func(m *Message) {
+		defer m.Release()
+		data := m.Data()
+		if overTCP && len(data) >= 2 {
+			data = data[2:]
+		}
+		id, response, ok := proto.DNSHeader(data)
+		if m.Truncated || !ok {
+			if debugger != nil {
+				go debugger(5, fmt.Sprintf("invalid dns message from %s to %s dropped\n", m.SrcAddr, m.DstAddr))
+			}
+			return
+		}
+		msg := NewMessage(m.SrcAddr, m.DstAddr, m.IPversion)
+		msg.IsIncoming = !response
+		msg.conn = &connection{isn: uint32(id)}
+		if m.conn != nil {
+			msg.conn.syn, msg.conn.isn = m.conn.syn, m.conn.isn^uint32(id)
+		}
+		msg.add(0, &Packet{TCP: &layers.TCP{BaseLayer: layers.BaseLayer{Payload: append([]byte(nil), data...)}}, Timestamp: m.End})
+		msg.Start = m.Start
+		msg.TimedOut = m.TimedOut
+		handler(msg)
+	}
+}
@@ -17,8 +17,62 @@ messageHandler := func(mssg *tcp.Message){}
 
 mssgPool := tcp.NewMessagePool(maxMessageSize, messageExpire, debugger, messageHandler)
 listener.Listen(ctx, mssgPool.Handler)
+mssgPool.Close() // dispatches the messages still in progress
 
-you can use pool.End or/and pool.Start to set custom session behaviors
+you can use pool.End or/and pool.Start to set custom session behaviors, or pool.SetHints("http")
+to use built-in hints by name(see tcp.HintsNames and tcp.RegisterHints),
+pool.Split = tcp.HTTPSplit emits a message per HTTP request/response on keep-alive connections,
+and tcp.NewPairer(messageExpire, pairHandler).Handler can be used as the messageHandler to
+receive requests paired with their responses
+
+tcp.NewSCTPPool(maxSize, messageExpire, debugger, messageHandler) reassembles the messages of each stream of
+SCTP associations instead, its Handler is used with a listener whose transport is "sctp".
+tcp.NewUDPPool(maxSize, window, debugger, messageHandler) emits a message per UDP datagram, or per window of datagrams.
+
+HTTP/2 connections are split in frames with pool.SetHints("http2"), and tcp.NewHTTP2Demuxer(maxSize, debugger, messageHandler)
+turns their streams into HTTP/1.1 messages, its Handler is the messageHandler of the pool and its Start the pool.Start.
+its GRPC field keeps the gRPC calls only.
+tcp.NewWebSocketDemuxer(maxSize, debugger, messageHandler) follows the HTTP/1.x connections upgraded to WebSocket,
+the pool.Start, pool.End and pool.Split are its own, it passes HTTP messages through and reassembles the frames.
+MySQL connections are split in packets with pool.SetHints("mysql"), and tcp.NewMySQLDemuxer(maxSize, debugger, messageHandler)
+passes each command and its complete response as a message, its Handler is the messageHandler of the pool and its Start the pool.Start.
+its StripAuth field drops the handshake and the authentication packets.
+tcp.NewPostgresDemuxer(maxSize, debugger, messageHandler) groups the messages of PostgreSQL connections up to the points
+where a peer waits for the other(Query, Sync, ReadyForQuery...), its Handler, Start and Split are the ones of the pool.
+Redis connections are split in RESP values with pool.SetHints("redis"), tcp.RedisStart(port) is the pool.Start
+telling commands from replies.
+MongoDB connections are split in messages with pool.SetHints("mongo") and tcp.MongoStart(port), the handler returned by
+tcp.MongoDecompressor(debugger, messageHandler) replaces the OP_COMPRESSED messages by the messages they compress.
+Thrift connections are split in messages with pool.SetHints("thrift") and tcp.ThriftStart(port), framed or not.
+tcp.NewMQTTDemuxer(maxSize, debugger, messageHandler) keeps the PUBLISH packets of MQTT clients, in the encoding of
+MQTT 5 and with the topics of their aliases, its Handler and Start are the ones of a pool split with pool.SetHints("mqtt").
+tcp.NewAMQPDemuxer(maxSize, debugger, messageHandler) reassembles the basic.publish commands of AMQP 0-9-1 clients with
+their content header and body frames, its Handler and Start are the ones of a pool split with pool.SetHints("amqp").
+tcp.DNSTransactions(overTCP, debugger, messageHandler) gives the queries and the responses of DNS the direction of
+their header and the UUID of their transaction, it handles the messages of a UDP pool, or of a pool split with
+pool.SetHints("dns") and tcp.DNSStart(port).
+tcp.NewSIPDemuxer(debugger, messageHandler) gives the requests and the responses of SIP the UUID of the Call-ID of
+their dialog, its Handler handles the messages of a UDP pool, or of a pool split with pool.SetHints("sip"), and it
+drops the RTP of the calls, summed up by stream to its Summary.
+tcp.NewKafkaDemuxer(debugger, messageHandler) gives the requests and the responses of Kafka the UUID of their
+correlation id, its Handler and Start are the ones of a pool split with pool.SetHints("kafka").
+tcp.NewTLSDecryptor(plainPool, debugger) decrypts TLS connections with the secrets of its KeyLog(tcp.NewKeyLog(path)),
+or the RSAKeys of servers(tcp.LoadRSAKeys(path)), its Handler and Start are the ones of a pool split with tcp.TLSSplit,
+and the decrypted data are reassembled by plainPool.
+tcp.NewQUICDecoder(maxSize, debugger, messageHandler) decrypts QUIC connections with the secrets of its KeyLog and
+turns their HTTP/3 streams into HTTP/1.1 messages, its Handler is the one of a UDP pool without window.
+tcp.NewStreams(pool) feeds a pool with the data of connections captured above tcp, streams.Data(id, src, dst, ...)
+passes the data sent on a connection, the first data being sent by its client.
+
+pool.Snapshot() returns the messages in progress, their size and age, to debug stuck sessions.
+
+fragmented IP packets are reassembled by pool.Defragmenter before being parsed,
+it can be replaced with tcp.NewDefragmenter(timeout, maxSize) to change its limits.
+the extension headers of IPv6 packets are walked up to the tcp header, including the ones gopacket can't decode.
+the capture filter can't match the ports of these packets, pool.TunnelPort does.
+
+packets of tunnels(VXLAN, GRE, Geneve, IP in IP, GTP-U of mobile cores) and ERSPAN switch mirrors are decapsulated when enabled with pool.Tunnels,
+pool.TunnelIDs and pool.TunnelPort filter them, and pool.VLANs filters packets by 802.1Q tag.
 
 debugLevel in debugger function indicates the priority of the logs, the bigger the number the lower
 the priority. errors are signified by debug level 4 for errors, 5 for discarded packets, and 6 for received packets.
@@ -0,0 +1,281 @@
+package tcp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+	"github.com/buger/goreplay/size"
+	"github.com/google/gopacket/layers"
+	"golang.org/x/net/http2/hpack"
+)
+
+// HTTP2Split is a HintSplit for HTTP/2, a message holds the complete frames received, or the client preface
+func HTTP2Split(m *Message) int {
+	return proto.HTTP2FramesLength(m.Data())
+}
+
+// http2Expire is how long the state of an idle HTTP/2 connection is kept
+const http2Expire = 10 * time.Minute
+
+// HTTP2Demuxer demultiplexes the streams of HTTP/2 connections(h2c, or h2 whose TLS was decrypted). its Handler
+// is the handler of a pool splitting messages with HTTP2Split, and whose Start is HTTP2Demuxer.Start. the header
+// blocks are decoded with the HPACK context of their connection, and each stream is passed to the handler as an
+// HTTP/1.1 message once it ends(see proto.HTTP2Message), trailers are added to its headers. the response of a
+// stream has the UUID of its request.
+type HTTP2Demuxer struct {
+	sync.Mutex
+	handler   Handler
+	debug     Debugger
+	maxSize   size.Size
+	conns     map[string]*http2Conn // by client=server
+	lastPurge time.Time
+	Port      uint16 // when not 0, the messages to this port of connections whose preface was not captured are incoming
+	GRPC      bool   // only the streams of gRPC calls are handled
+}
+
+type http2Conn struct {
+	created time.Time // timestamp of the first message of the connection
+	seen    time.Time
+	dirs    [2]http2Direction // from the client, from the server
+}
+
+// http2Direction is the state of the frames sent by a peer
+type http2Direction struct {
+	decoder *hpack.Decoder
+	streams map[uint32]*http2Stream
+	block   []byte // header block waiting for its CONTINUATION frames
+	stream  uint32 // stream of the header block
+	end     bool   // the header block ends its stream
+	push    bool   // the header block is a PUSH_PROMISE
+}
+
+type http2Stream struct {
+	fields    []hpack.HeaderField
+	body      []byte
+	start     time.Time
+	truncated bool
+}
+
+// NewHTTP2Demuxer returns a new HTTP/2 demultiplexer, the body of streams is truncated past maxSize, default 5mb
+func NewHTTP2Demuxer(maxSize size.Size, debugger Debugger, handler Handler) *HTTP2Demuxer {
+	d := new(HTTP2Demuxer)
+	d.handler = handler
+	d.debug = debugger
+	d.maxSize = maxSize
+	if d.maxSize < 1 {
+		d.maxSize = 5 << 20
+	}
+	d.conns = make(map[string]*http2Conn)
+	d.lastPurge = time.Now()
+	return d
+}
+
+// Start is the HintStart of HTTP/2 connections, the client preface starts the messages of clients, and the
+// first SETTINGS frame the messages of servers. the direction of connections already seen is kept.
+func (d *HTTP2Demuxer) Start(pckt *Packet) (isIncoming, isOutgoing bool) {
+	if bytes.HasPrefix(pckt.Payload, proto.HTTP2Preface) {
+		return true, false
+	}
+	src, dst := pckt.Src(), pckt.Dst()
+	d.Lock()
+	_, client := d.conns[src+"="+dst]
+	_, server := d.conns[dst+"="+src]
+	d.Unlock()
+	switch {
+	case client:
+		return true, false
+	case server:
+		return false, true
+	case d.Port != 0:
+		return uint16(pckt.DstPort) == d.Port, uint16(pckt.SrcPort) == d.Port
+	}
+	f, n := proto.ParseHTTP2Frame(pckt.Payload)
+	return false, n > 0 && f.Type == proto.HTTP2FrameSettings && f.Flags&proto.HTTP2FlagAck == 0 && f.Stream == 0
+}
+
+// Handler handles the frames of a direction of a connection
+func (d *HTTP2Demuxer) Handler(m *Message) {
+	defer m.Release()
+	data := m.Data()
+	client, server := m.SrcAddr, m.DstAddr
+	if !m.IsIncoming {
+		client, server = server, client
+	}
+	key := client + "=" + server
+	now := time.Now()
+	d.Lock()
+	defer d.Unlock()
+	if now.Sub(d.lastPurge) > http2Expire/10 {
+		d.purge(now)
+	}
+	c, ok := d.conns[key]
+	if preface := bytes.HasPrefix(data, proto.HTTP2Preface); !ok || preface {
+		if preface {
+			data = data[len(proto.HTTP2Preface):]
+		}
+		c = new(http2Conn)
+		c.created = m.Start
+		for i := range c.dirs {
+			c.dirs[i].decoder = hpack.NewDecoder(4096, nil)
+			c.dirs[i].streams = make(map[uint32]*http2Stream)
+		}
+		d.conns[key] = c
+	}
+	c.seen = now
+	if m.Truncated {
+		// the frames that follow can't be found
+		delete(d.conns, key)
+		go d.say(5, fmt.Sprintf("truncated http2 frames from %s to %s, connection state dropped\n", m.SrcAddr, m.DstAddr))
+		return
+	}
+	i := 0
+	if !m.IsIncoming {
+		i = 1
+	}
+	for len(data) > 0 {
+		f, n := proto.ParseHTTP2Frame(data)
+		if n == 0 {
+			break
+		}
+		data = data[n:]
+		d.frame(c, i, m, f)
+	}
+}
+
+// frame handles a frame sent in the direction i of the connection, it must be called while holding the lock
+func (d *HTTP2Demuxer) frame(c *http2Conn, i int, m *Message, f proto.HTTP2Frame) {
+	dir := &c.dirs[i]
+	switch f.Type {
+	case proto.HTTP2FrameSettings:
+		if f.Flags&proto.HTTP2FlagAck != 0 {
+			return
+		}
+		for p := f.Payload; len(p) >= 6; p = p[6:] {
+			if binary.BigEndian.Uint16(p) == proto.HTTP2SettingHeaderTableSize {
+				// the table size the peer decodes the headers with
+				c.dirs[1-i].decoder.SetAllowedMaxDynamicTableSize(binary.BigEndian.Uint32(p[2:]))
+			}
+		}
+	case proto.HTTP2FrameHeaders, proto.HTTP2FramePushPromise:
+		frag, err := f.Fragment()
+		if err != nil {
+			dir.block = nil
+			return
+		}
+		dir.block = append(dir.block[:0], frag...)
+		dir.stream = f.Stream
+		dir.end = f.Flags&proto.HTTP2FlagEndStream != 0
+		dir.push = f.Type == proto.HTTP2FramePushPromise
+		if f.Flags&proto.HTTP2FlagEndHeaders != 0 {
+			d.headers(c, i, m)
+		}
+	case proto.HTTP2FrameContinuation:
+		if dir.block == nil || dir.stream != f.Stream {
+			return
+		}
+		dir.block = append(dir.block, f.Payload...)
+		if f.Flags&proto.HTTP2FlagEndHeaders != 0 {
+			d.headers(c, i, m)
+		}
+	case proto.HTTP2FrameData:
+		s, ok := dir.streams[f.Stream]
+		if !ok {
+			return
+		}
+		data, err := f.Fragment()
+		if err != nil {
+			return
+		}
+		if n := int(d.maxSize) - len(s.body); len(data) > n {
+			data = data[:n]
+			s.truncated = true
+		}
+		s.body = append(s.body, data...)
+		if f.Flags&proto.HTTP2FlagEndStream != 0 {
+			d.emit(c, i, f.Stream, m)
+		}
+	case proto.HTTP2FrameRSTStream:
+		delete(c.dirs[0].streams, f.Stream)
+		delete(c.dirs[1].streams, f.Stream)
+	}
+}
+
+// headers decodes the header block of the direction i, the blocks of all the streams are decoded
+// to keep the HPACK context of the connection.
+func (d *HTTP2Demuxer) headers(c *http2Conn, i int, m *Message) {
+	dir := &c.dirs[i]
+	fields, err := dir.decoder.DecodeFull(dir.block)
+	dir.block = nil
+	if err != nil {
+		go d.say(4, fmt.Sprintf("error decoding http2 headers from %s to %s: %s\n", m.SrcAddr, m.DstAddr, err))
+		return
+	}
+	if dir.push {
+		return
+	}
+	if len(fields) > 0 && fields[0].Name == ":status" && strings.HasPrefix(fields[0].Value, "1") {
+		// informational responses precede the response
+		return
+	}
+	if s, ok := dir.streams[dir.stream]; ok {
+		// trailers, e.g: the status of gRPC calls
+		s.fields = append(s.fields, fields...)
+	} else {
+		dir.streams[dir.stream] = &http2Stream{fields: fields, start: m.Start}
+	}
+	if dir.end {
+		d.emit(c, i, dir.stream, m)
+	}
+}
+
+// emit passes the stream of the direction i to the handler as an HTTP/1.1 message
+func (d *HTTP2Demuxer) emit(c *http2Conn, i int, stream uint32, m *Message) {
+	s := c.dirs[i].streams[stream]
+	delete(c.dirs[i].streams, stream)
+	if d.GRPC && !grpcStream(s.fields) {
+		return
+	}
+	data := proto.HTTP2Message(s.fields, s.body)
+	if data == nil {
+		return
+	}
+	msg := NewMessage(m.SrcAddr, m.DstAddr, m.IPversion)
+	msg.IsIncoming = m.IsIncoming
+	msg.conn = &connection{isn: stream, syn: c.created}
+	msg.add(0, &Packet{TCP: &layers.TCP{BaseLayer: layers.BaseLayer{Payload: data}}, Timestamp: m.End})
+	msg.Start = s.start
+	msg.Truncated = s.truncated
+	msg.TimedOut = m.TimedOut
+	d.handler(msg)
+}
+
+// grpcStream reports whether the content type of the stream is gRPC
+func grpcStream(fields []hpack.HeaderField) bool {
+	for _, f := range fields {
+		if f.Name == "content-type" {
+			return strings.HasPrefix(f.Value, "application/grpc")
+		}
+	}
+	return false
+}
+
+// purge forgets the connections idle for longer than http2Expire
+func (d *HTTP2Demuxer) purge(now time.Time) {
+	d.lastPurge = now
+	for key, c := range d.conns {
+		if now.Sub(c.seen) > http2Expire {
+			delete(d.conns, key)
+		}
+	}
+}
+
+func (d *HTTP2Demuxer) say(level int, args ...interface{}) {
+	if d.debug != nil {
+		d.debug(level, args...)
+	}
+}
@@ -0,0 +1,245 @@
+package tcp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/buger/goreplay/size"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Defragmenter reassembles fragmented IPv4 and IPv6 datagrams, so that the
+// tcp segments they carry can be parsed. datagrams that are not completed
+// within timeout are discarded, and fragments are dropped once maxSize bytes
+// of incomplete datagrams are held.
+type Defragmenter struct {
+	sync.Mutex
+	timeout   time.Duration
+	maxSize   size.Size
+	size      int
+	lastPurge time.Time
+	datagrams map[datagramKey]*datagram
+}
+
+type datagramKey struct {
+	src, dst [16]byte
+	id       uint32
+	protocol layers.IPProtocol
+}
+
+type fragment struct {
+	offset int
+	data   []byte
+}
+
+type datagram struct {
+	header    gopacket.NetworkLayer // network layer of the first fragment
+	protocol  layers.IPProtocol
+	fragments []fragment
+	length    int // length of the whole payload, -1 until the last fragment is received
+	size      int
+	expire    time.Time
+}
+
+// NewDefragmenter returns a new IP defragmenter, the default timeout is 30s
+// and the default maximum size is 4mb
+func NewDefragmenter(timeout time.Duration, maxSize size.Size) (d *Defragmenter) {
+	d = new(Defragmenter)
+	d.timeout = timeout
+	if d.timeout <= 0 {
+		d.timeout = time.Second * 30
+	}
+	d.maxSize = maxSize
+	if d.maxSize < 1 {
+		d.maxSize = 4 << 20
+	}
+	d.datagrams = make(map[datagramKey]*datagram)
+	return
+}
+
+// Defrag returns packet as is if it is not a fragment, nil if the datagram of
+// the fragment is not yet complete, or a new packet holding the reassembled datagram
+// if packet was the last missing fragment.
+func (d *Defragmenter) Defrag(packet gopacket.Packet) (gopacket.Packet, error) {
+	var key datagramKey
+	var offset int
+	var more bool
+	var data []byte
+	switch ip := packet.NetworkLayer().(type) {
+	case *layers.IPv4:
+		if ip.Flags&layers.IPv4MoreFragments == 0 && ip.FragOffset == 0 {
+			return packet, nil
+		}
+		copy(key.src[:], ip.SrcIP.To16())
+		copy(key.dst[:], ip.DstIP.To16())
+		key.id = uint32(ip.Id)
+		key.protocol = ip.Protocol
+		offset = int(ip.FragOffset) * 8
+		more = ip.Flags&layers.IPv4MoreFragments != 0
+		data = ip.Payload
+	case *layers.IPv6:
+		frag, ok := packet.Layer(layers.LayerTypeIPv6Fragment).(*layers.IPv6Fragment)
+		if !ok {
+			// gopacket stops at the extension headers it doesn't know
+			if frag = ipv6Fragment(ip); frag == nil {
+				return packet, nil
+			}
+		}
+		copy(key.src[:], ip.SrcIP)
+		copy(key.dst[:], ip.DstIP)
+		key.id = frag.Identification
+		key.protocol = frag.NextHeader
+		offset = int(frag.FragmentOffset) * 8
+		more = frag.MoreFragments
+		data = frag.Payload
+	default:
+		return packet, nil
+	}
+
+	d.Lock()
+	defer d.Unlock()
+	now := time.Now()
+	d.purge(now)
+	if d.size+len(data) > int(d.maxSize) {
+		return nil, fmt.Errorf("fragment dropped, %d bytes of incomplete datagrams", d.size)
+	}
+	dg, ok := d.datagrams[key]
+	if !ok {
+		dg = &datagram{length: -1, protocol: key.protocol, expire: now.Add(d.timeout)}
+		d.datagrams[key] = dg
+	}
+	d.size += len(data)
+	dg.size += len(data)
+	// the packet buffer can be reused by the capture engine
+	dg.fragments = append(dg.fragments, fragment{offset, append([]byte(nil), data...)})
+	if offset == 0 {
+		dg.header = cloneHeader(packet.NetworkLayer())
+	}
+	if !more {
+		dg.length = offset + len(data)
+	}
+	payload := dg.reassemble()
+	if payload == nil {
+		return nil, nil
+	}
+	delete(d.datagrams, key)
+	d.size -= dg.size
+	return dg.packet(payload, packet.Metadata().CaptureInfo)
+}
+
+// ipv6Fragment returns the fragment header of the packet, nil if it is not a fragment
+func ipv6Fragment(ip *layers.IPv6) *layers.IPv6Fragment {
+	next, data, _, _ := walkIPv6(ip, true)
+	if next != layers.IPProtocolIPv6Fragment || len(data) < 8 {
+		return nil
+	}
+	frag := &layers.IPv6Fragment{
+		NextHeader:     layers.IPProtocol(data[0]),
+		FragmentOffset: binary.BigEndian.Uint16(data[2:4]) >> 3,
+		MoreFragments:  data[3]&1 != 0,
+		Identification: binary.BigEndian.Uint32(data[4:8]),
+	}
+	frag.Contents, frag.Payload = data[:8], data[8:]
+	return frag
+}
+
+// cloneHeader returns a copy of the network layer of a fragment that doesn't share the packet buffer
+func cloneHeader(layer gopacket.NetworkLayer) gopacket.NetworkLayer {
+	switch ip := layer.(type) {
+	case *layers.IPv4:
+		// the addresses and options are decoded again from a copy of the header
+		ip4 := new(layers.IPv4)
+		if err := ip4.DecodeFromBytes(append([]byte(nil), ip.Contents...), gopacket.NilDecodeFeedback); err != nil {
+			return nil
+		}
+		return ip4
+	case *layers.IPv6:
+		// the extension headers are not part of the reassembled datagram
+		return &layers.IPv6{
+			BaseLayer:    layers.BaseLayer{Contents: append([]byte(nil), ip.Contents...)},
+			Version:      ip.Version,
+			TrafficClass: ip.TrafficClass,
+			FlowLabel:    ip.FlowLabel,
+			Length:       ip.Length,
+			NextHeader:   ip.NextHeader,
+			HopLimit:     ip.HopLimit,
+			SrcIP:        append(net.IP(nil), ip.SrcIP...),
+			DstIP:        append(net.IP(nil), ip.DstIP...),
+		}
+	}
+	return nil
+}
+
+// purge discards expired datagrams, at most once every tenth of the timeout
+func (d *Defragmenter) purge(now time.Time) {
+	if now.Sub(d.lastPurge) < d.timeout/10 {
+		return
+	}
+	d.lastPurge = now
+	for key, dg := range d.datagrams {
+		if now.After(dg.expire) {
+			d.size -= dg.size
+			delete(d.datagrams, key)
+		}
+	}
+}
+
+// reassemble returns the payload of the datagram, or nil if it is not complete
+func (dg *datagram) reassemble() []byte {
+	if dg.length < 0 || dg.header == nil {
+		return nil
+	}
+	sort.SliceStable(dg.fragments, func(i, j int) bool { return dg.fragments[i].offset < dg.fragments[j].offset })
+	covered := 0
+	for _, f := range dg.fragments {
+		if f.offset > covered {
+			return nil
+		}
+		if end := f.offset + len(f.data); end > covered {
+			covered = end
+		}
+	}
+	if covered < dg.length {
+		return nil
+	}
+	payload := make([]byte, dg.length)
+	// overlapping data is taken from the first fragments
+	for i := len(dg.fragments) - 1; i >= 0; i-- {
+		if dg.fragments[i].offset < dg.length {
+			copy(payload[dg.fragments[i].offset:], dg.fragments[i].data)
+		}
+	}
+	return payload
+}
+
+// packet returns a new packet, starting at the network layer, holding the whole datagram
+func (dg *datagram) packet(payload []byte, ci gopacket.CaptureInfo) (gopacket.Packet, error) {
+	var header gopacket.SerializableLayer
+	var first gopacket.LayerType
+	switch ip := dg.header.(type) {
+	case *layers.IPv4:
+		ip4 := *ip
+		ip4.Flags &^= layers.IPv4MoreFragments
+		ip4.FragOffset = 0
+		header, first = &ip4, layers.LayerTypeIPv4
+	case *layers.IPv6:
+		ip6 := *ip
+		ip6.NextHeader = dg.protocol
+		header, first = &ip6, layers.LayerTypeIPv6
+	}
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, header, gopacket.Payload(payload)); err != nil {
+		return nil, err
+	}
+	packet := gopacket.NewPacket(buf.Bytes(), first, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+	ci.CaptureLength = len(buf.Bytes())
+	ci.Length = ci.CaptureLength
+	packet.Metadata().CaptureInfo = ci
+	return packet, nil
+}
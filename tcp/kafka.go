@@ -0,0 +1,119 @@
+package tcp
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+	"github.com/google/gopacket/layers"
+)
+
+// KafkaSplit is a HintSplit for Kafka, a message holds a request or a response with its size
+func KafkaSplit(m *Message) int {
+	return proto.KafkaMessageLength(m.Data())
+}
+
+// kafkaExpire is how long the direction of an idle Kafka connection is remembered
+const kafkaExpire = 10 * time.Minute
+
+// KafkaDemuxer gives the requests and the responses of Kafka connections their direction and the UUID of their
+// correlation id, its Handler is the handler of a pool split with pool.SetHints("kafka") and whose Start is
+// KafkaDemuxer.Start. the responses can't be told apart from the requests by their header, the direction of a
+// connection is given by Port, else by its first request.
+type KafkaDemuxer struct {
+	sync.Mutex
+	handler   Handler
+	debug     Debugger
+	conns     map[string]time.Time // last seen by client=server
+	lastPurge time.Time
+	Port      uint16 // when not 0, the messages to this port are the requests
+}
+
+// NewKafkaDemuxer returns a new Kafka demultiplexer
+func NewKafkaDemuxer(debugger Debugger, handler Handler) *KafkaDemuxer {
+	d := new(KafkaDemuxer)
+	d.handler = handler
+	d.debug = debugger
+	d.conns = make(map[string]time.Time)
+	d.lastPurge = time.Now()
+	return d
+}
+
+// Start is the HintStart of Kafka connections
+func (d *KafkaDemuxer) Start(pckt *Packet) (isIncoming, isOutgoing bool) {
+	if len(pckt.Payload) == 0 {
+		return
+	}
+	if d.Port != 0 {
+		return uint16(pckt.DstPort) == d.Port, uint16(pckt.SrcPort) == d.Port
+	}
+	src, dst := pckt.Src(), pckt.Dst()
+	d.Lock()
+	_, client := d.conns[src+"="+dst]
+	_, server := d.conns[dst+"="+src]
+	d.Unlock()
+	switch {
+	case client:
+		return true, false
+	case server:
+		return false, true
+	}
+	return proto.IsKafkaRequest(pckt.Payload), false
+}
+
+// Handler passes the requests and the responses to the handler of the demultiplexer, the correlation id of a
+// request is part of the UUID of the request and of its response, so that the requests in flight of a connection
+// don't share it
+func (d *KafkaDemuxer) Handler(m *Message) {
+	defer m.Release()
+	data := m.Data()
+	var id int32
+	var ok bool
+	if m.IsIncoming {
+		var r proto.KafkaRequest
+		r, ok = proto.ParseKafkaRequest(data)
+		id = r.CorrelationID
+	} else {
+		id, ok = proto.KafkaResponseCorrelation(data)
+	}
+	if m.Truncated || !ok {
+		go d.say(5, fmt.Sprintf("invalid kafka message from %s to %s dropped\n", m.SrcAddr, m.DstAddr))
+		return
+	}
+	if m.IsIncoming {
+		now := time.Now()
+		d.Lock()
+		if now.Sub(d.lastPurge) > kafkaExpire/10 {
+			d.purge(now)
+		}
+		d.conns[m.SrcAddr+"="+m.DstAddr] = now
+		d.Unlock()
+	}
+	msg := NewMessage(m.SrcAddr, m.DstAddr, m.IPversion)
+	msg.IsIncoming = m.IsIncoming
+	msg.conn = &connection{isn: uint32(id)}
+	if m.conn != nil {
+		msg.conn.syn, msg.conn.isn = m.conn.syn, m.conn.isn^uint32(id)
+	}
+	msg.add(0, &Packet{TCP: &layers.TCP{BaseLayer: layers.BaseLayer{Payload: append([]byte(nil), data...)}}, Timestamp: m.End})
+	msg.Start = m.Start
+	msg.TimedOut = m.TimedOut
+	d.handler(msg)
+}
+
+// purge forgets the connections idle for longer than kafkaExpire
+func (d *KafkaDemuxer) purge(now time.Time) {
+	d.lastPurge = now
+	for key, seen := range d.conns {
+		if now.Sub(seen) > kafkaExpire {
+			delete(d.conns, key)
+		}
+	}
+}
+
+func (d *KafkaDemuxer) say(level int, args ...interface{}) {
+	if d.debug != nil {
+		d.debug(level, args...)
+	}
+}
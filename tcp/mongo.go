@@ -0,0 +1,60 @@
+package tcp
+
+import (
+	"fmt"
+
+	"github.com/buger/goreplay/proto"
+	"github.com/google/gopacket/layers"
+)
+
+// MongoSplit is a HintSplit for MongoDB, a message holds a message of the wire protocol
+func MongoSplit(m *Message) int {
+	return proto.MongoMessageLength(m.Data())
+}
+
+// MongoStart returns the HintStart of MongoDB connections, the packets to port are incoming. when port is 0,
+// the messages answering no request are incoming and the others are outgoing.
+func MongoStart(port uint16) HintStart {
+	return func(pckt *Packet) (isIncoming, isOutgoing bool) {
+		if len(pckt.Payload) == 0 {
+			return
+		}
+		if port != 0 {
+			return uint16(pckt.DstPort) == port, uint16(pckt.SrcPort) == port
+		}
+		h, ok := proto.ParseMongoHeader(pckt.Payload)
+		if !ok {
+			return
+		}
+		return h.ResponseTo == 0, h.ResponseTo != 0
+	}
+}
+
+// MongoDecompressor returns a handler passing the messages to handler, the OP_COMPRESSED messages are replaced
+// by the messages they compress. the messages that can't be decompressed are passed as is.
+func MongoDecompressor(debugger Debugger, handler Handler) Handler {
+	return func(m *Message) {
+		data := m.Data()
+		h, ok := proto.ParseMongoHeader(data)
+		if !ok || h.OpCode != proto.MongoOpCompressed || m.Truncated {
+			handler(m)
+			return
+		}
+		plain, err := proto.MongoDecompress(data)
+		if err != nil {
+			if debugger != nil {
+				go debugger(5, fmt.Sprintf("mongo message from %s to %s not decompressed: %v\n", m.SrcAddr, m.DstAddr, err))
+			}
+			handler(m)
+			return
+		}
+		msg := NewMessage(m.SrcAddr, m.DstAddr, m.IPversion)
+		msg.IsIncoming = m.IsIncoming
+		msg.conn = m.conn
+		msg.add(0, &Packet{TCP: &layers.TCP{BaseLayer: layers.BaseLayer{Payload: plain}}, Timestamp: m.End})
+		msg.Start = m.Start
+		msg.TimedOut = m.TimedOut
+		m.Release()
+		handler(msg)
+	}
+}
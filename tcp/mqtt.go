@@ -0,0 +1,200 @@
+package tcp
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+	"github.com/buger/goreplay/size"
+	"github.com/google/gopacket/layers"
+)
+
+// MQTTSplit is a HintSplit for MQTT, a message holds a control packet
+func MQTTSplit(m *Message) int {
+	return proto.MQTTPacketLength(m.Data())
+}
+
+// mqttExpire is how long the state of an idle MQTT connection is kept
+const mqttExpire = 10 * time.Minute
+
+// MQTTDemuxer follows the MQTT connections, its Handler is the handler of a pool splitting messages with
+// MQTTSplit and whose Start is MQTTDemuxer.Start. the PUBLISH packets sent by the clients are passed to the
+// handler in the encoding of MQTT 5 whatever the protocol level of their connection, with the topic of their
+// topic alias, and the messages of a connection have the UUID of the connection. the other packets are dropped.
+type MQTTDemuxer struct {
+	sync.Mutex
+	handler   Handler
+	debug     Debugger
+	maxSize   size.Size
+	conns     map[string]*mqttConn // by client=server
+	lastPurge time.Time
+	Port      uint16 // when not 0, the packets to this port of connections whose CONNECT was not captured are incoming
+	Version   byte   // protocol level of the connections whose CONNECT was not captured, default 4(3.1.1)
+}
+
+type mqttConn struct {
+	created time.Time // timestamp of the first message of the connection
+	seen    time.Time
+	version byte
+	aliases map[uint16]string // topics by alias
+}
+
+// NewMQTTDemuxer returns a new MQTT demultiplexer, the PUBLISH packets larger than maxSize are dropped, default 5mb
+func NewMQTTDemuxer(maxSize size.Size, debugger Debugger, handler Handler) *MQTTDemuxer {
+	d := new(MQTTDemuxer)
+	d.handler = handler
+	d.debug = debugger
+	d.maxSize = maxSize
+	if d.maxSize < 1 {
+		d.maxSize = 5 << 20
+	}
+	d.conns = make(map[string]*mqttConn)
+	d.lastPurge = time.Now()
+	d.Version = proto.MQTT311
+	return d
+}
+
+// Start is the HintStart of MQTT connections, the CONNECT packets start the messages of clients.
+// the direction of connections already seen is kept.
+func (d *MQTTDemuxer) Start(pckt *Packet) (isIncoming, isOutgoing bool) {
+	if len(pckt.Payload) == 0 {
+		return
+	}
+	src, dst := pckt.Src(), pckt.Dst()
+	d.Lock()
+	_, client := d.conns[src+"="+dst]
+	_, server := d.conns[dst+"="+src]
+	d.Unlock()
+	switch {
+	case client:
+		return true, false
+	case server:
+		return false, true
+	case d.Port != 0:
+		return uint16(pckt.DstPort) == d.Port, uint16(pckt.SrcPort) == d.Port
+	}
+	if pckt.Payload[0]>>4 != proto.MQTTConnect || len(pckt.Payload) < 2 {
+		return
+	}
+	// the CONNECT packet may span over the next packets, only its protocol name is checked
+	for i := 1; i < len(pckt.Payload) && i < 5; i++ {
+		if pckt.Payload[i] < 0x80 {
+			name := pckt.Payload[i+1:]
+			return bytes.HasPrefix(name, []byte("\x00\x04MQTT")) || bytes.HasPrefix(name, []byte("\x00\x06MQIsdp")), false
+		}
+	}
+	return
+}
+
+// Handler handles the packets of a direction of a connection
+func (d *MQTTDemuxer) Handler(m *Message) {
+	defer m.Release()
+	client, server := m.SrcAddr, m.DstAddr
+	if !m.IsIncoming {
+		client, server = server, client
+	}
+	key := client + "=" + server
+	now := time.Now()
+	d.Lock()
+	defer d.Unlock()
+	if now.Sub(d.lastPurge) > mqttExpire/10 {
+		d.purge(now)
+	}
+	typ, flags, body, n := proto.MQTTPacket(m.Data())
+	c, ok := d.conns[key]
+	if m.IsIncoming && n > 0 && typ == proto.MQTTConnect {
+		connect, ok := proto.ParseMQTTConnect(body)
+		if !ok {
+			delete(d.conns, key)
+			return
+		}
+		// the ports may be reused by a new connection
+		d.conns[key] = &mqttConn{created: m.Start, seen: now, version: connect.Version}
+		return
+	}
+	if !ok {
+		c = &mqttConn{created: m.Start, version: d.Version}
+		d.conns[key] = c
+	}
+	c.seen = now
+	if m.Truncated || n == 0 || n > int(d.maxSize) {
+		go d.say(5, fmt.Sprintf("truncated mqtt packet from %s to %s dropped\n", m.SrcAddr, m.DstAddr))
+		return
+	}
+	if !m.IsIncoming {
+		return
+	}
+	switch typ {
+	case proto.MQTTPublish:
+		p, ok := proto.ParseMQTTPublish(flags, body, c.version)
+		if !ok {
+			go d.say(5, fmt.Sprintf("invalid mqtt publish from %s to %s dropped\n", m.SrcAddr, m.DstAddr))
+			return
+		}
+		if c.version == proto.MQTT5 && d.resolveAlias(c, &p) != nil {
+			go d.say(5, fmt.Sprintf("mqtt publish from %s to %s with an unknown topic alias dropped\n", m.SrcAddr, m.DstAddr))
+			return
+		}
+		d.emit(c, m, proto.AppendMQTTPublish(nil, p, proto.MQTT5))
+	case proto.MQTTDisconnect:
+		delete(d.conns, key)
+	}
+}
+
+// resolveAlias sets the topic of the PUBLISH packet from its alias, and removes the alias from its properties
+func (d *MQTTDemuxer) resolveAlias(c *mqttConn, p *proto.MQTTPublishPacket) error {
+	var alias uint16
+	proto.MQTTProperties(p.Properties, func(id byte, value []byte) bool {
+		if id == proto.MQTTTopicAlias {
+			alias = uint16(value[0])<<8 | uint16(value[1])
+			return false
+		}
+		return true
+	})
+	if alias == 0 {
+		return nil
+	}
+	p.Properties = proto.MQTTWithoutProperty(p.Properties, proto.MQTTTopicAlias)
+	if p.Topic != "" {
+		if c.aliases == nil {
+			c.aliases = make(map[uint16]string)
+		}
+		c.aliases[alias] = p.Topic
+		return nil
+	}
+	topic, ok := c.aliases[alias]
+	if !ok {
+		return fmt.Errorf("unknown topic alias %d", alias)
+	}
+	p.Topic = topic
+	return nil
+}
+
+// emit passes the packet to the handler as an incoming message
+func (d *MQTTDemuxer) emit(c *mqttConn, m *Message, packet []byte) {
+	msg := NewMessage(m.SrcAddr, m.DstAddr, m.IPversion)
+	msg.IsIncoming = true
+	msg.conn = &connection{syn: c.created}
+	msg.add(0, &Packet{TCP: &layers.TCP{BaseLayer: layers.BaseLayer{Payload: packet}}, Timestamp: m.End})
+	msg.Start = m.Start
+	msg.TimedOut = m.TimedOut
+	d.handler(msg)
+}
+
+// purge forgets the connections idle for longer than mqttExpire
+func (d *MQTTDemuxer) purge(now time.Time) {
+	d.lastPurge = now
+	for key, c := range d.conns {
+		if now.Sub(c.seen) > mqttExpire {
+			delete(d.conns, key)
+		}
+	}
+}
+
+func (d *MQTTDemuxer) say(level int, args ...interface{}) {
+	if d.debug != nil {
+		d.debug(level, args...)
+	}
+}
@@ -0,0 +1,350 @@
+package tcp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+	"github.com/buger/goreplay/size"
+	"github.com/google/gopacket/layers"
+)
+
+// MySQLSplit is a HintSplit for MySQL, a message holds a packet and the packets it continues in
+func MySQLSplit(m *Message) int {
+	return proto.MySQLPacketLength(m.Data())
+}
+
+// mysqlExpire is how long the state of an idle MySQL connection is kept
+const mysqlExpire = 10 * time.Minute
+
+// phases of MySQL connections
+const (
+	mysqlHandshake uint8 = iota // waiting for the handshake response of the client
+	mysqlAuth                   // authentication exchange, until the server accepts it
+	mysqlCommand
+)
+
+// MySQLDemuxer follows the MySQL connections, its Handler is the handler of a pool splitting messages with
+// MySQLSplit and whose Start is MySQLDemuxer.Start. each command of the client is passed to the handler as a
+// message, followed by the complete response of the server. the messages of a connection have the UUID of the
+// connection.
+//
+// the recorded commands can be replayed on another connection: the statements are referred to by their rank in
+// the COM_STMT_PREPARE commands of the connection instead of their id(see MySQLOutput), the commands on
+// statements whose preparation was not captured are dropped with their response. the query attributes are
+// removed from the commands, as if the capability proto.MySQLClientQueryAttributes was not negotiated. the
+// connections switching to TLS are not followed.
+type MySQLDemuxer struct {
+	sync.Mutex
+	handler   Handler
+	debug     Debugger
+	maxSize   size.Size
+	conns     map[string]*mysqlConn // by client=server
+	lastPurge time.Time
+	Port      uint16 // when not 0, the messages to this port of connections whose handshake was not captured are incoming
+	StripAuth bool   // the handshake and the authentication packets are dropped, the database selected by the handshake is selected by a COM_INIT_DB
+}
+
+type mysqlConn struct {
+	created    time.Time // timestamp of the first message of the connection
+	seen       time.Time
+	phase      uint8
+	serverCaps uint32
+	caps       uint32                    // negotiated
+	statements map[uint32]mysqlStatement // by id
+	prepares   uint32                    // COM_STMT_PREPARE sent
+	pending    []*mysqlResponse          // responses expected, in the order of the commands
+	infile     []byte                    // packets of the file requested by the server, until the empty one
+	infileAt   time.Time
+	sending    bool // the server is waiting for the file
+}
+
+type mysqlStatement struct {
+	rank   uint32
+	params uint16
+}
+
+// mysqlResponse is a response in progress
+type mysqlResponse struct {
+	proto.MySQLResponse
+	rank      uint32 // of the statement prepared
+	skip      bool   // the command was dropped, and so is its response
+	data      []byte
+	start     time.Time
+	truncated bool
+}
+
+// NewMySQLDemuxer returns a new MySQL demultiplexer, the responses are truncated past maxSize, default 5mb
+func NewMySQLDemuxer(maxSize size.Size, debugger Debugger, handler Handler) *MySQLDemuxer {
+	d := new(MySQLDemuxer)
+	d.handler = handler
+	d.debug = debugger
+	d.maxSize = maxSize
+	if d.maxSize < 1 {
+		d.maxSize = 5 << 20
+	}
+	d.conns = make(map[string]*mysqlConn)
+	d.lastPurge = time.Now()
+	return d
+}
+
+// Start is the HintStart of MySQL connections, the handshake of the server starts the messages of servers and
+// the handshake response of the client the messages of clients. the direction of connections already seen is kept.
+func (d *MySQLDemuxer) Start(pckt *Packet) (isIncoming, isOutgoing bool) {
+	if len(pckt.Payload) == 0 {
+		return
+	}
+	src, dst := pckt.Src(), pckt.Dst()
+	d.Lock()
+	_, client := d.conns[src+"="+dst]
+	_, server := d.conns[dst+"="+src]
+	d.Unlock()
+	switch {
+	case client:
+		return true, false
+	case server:
+		return false, true
+	case d.Port != 0:
+		return uint16(pckt.DstPort) == d.Port, uint16(pckt.SrcPort) == d.Port
+	}
+	payload, seq, n := proto.MySQLPacket(pckt.Payload)
+	if n == 0 {
+		return
+	}
+	if _, ok := proto.ParseMySQLHandshake(payload); ok && seq == 0 {
+		return false, true
+	}
+	_, ok := proto.ParseMySQLHandshakeResponse(payload)
+	return ok && seq == 1, false
+}
+
+// Handler handles the packets of a direction of a connection
+func (d *MySQLDemuxer) Handler(m *Message) {
+	defer m.Release()
+	client, server := m.SrcAddr, m.DstAddr
+	if !m.IsIncoming {
+		client, server = server, client
+	}
+	key := client + "=" + server
+	now := time.Now()
+	d.Lock()
+	defer d.Unlock()
+	if now.Sub(d.lastPurge) > mysqlExpire/10 {
+		d.purge(now)
+	}
+	data := m.Data()
+	payload, seq, n := proto.MySQLPacket(data)
+	if m.Truncated || n == 0 {
+		// the packets that follow can't be found
+		delete(d.conns, key)
+		go d.say(5, fmt.Sprintf("truncated mysql packet from %s to %s, connection state dropped\n", m.SrcAddr, m.DstAddr))
+		return
+	}
+	c, ok := d.conns[key]
+	h, greeting := proto.ParseMySQLHandshake(payload)
+	greeting = greeting && !m.IsIncoming && seq == 0
+	if !ok || greeting {
+		// the ports may be reused by a new connection
+		c = &mysqlConn{created: m.Start, phase: mysqlCommand, statements: make(map[uint32]mysqlStatement)}
+		if greeting {
+			c.phase, c.serverCaps = mysqlHandshake, h.Capabilities
+		} else if _, ok := proto.ParseMySQLHandshakeResponse(payload); ok && m.IsIncoming && seq == 1 {
+			// the handshake of the server was not captured
+			c.phase, c.serverCaps = mysqlHandshake, ^uint32(0)
+		}
+		d.conns[key] = c
+	}
+	c.seen = now
+	if m.IsIncoming {
+		d.client(key, c, m, payload, seq, data[:n])
+		return
+	}
+	d.server(key, c, m, payload, data[:n])
+}
+
+// client handles a packet of the client of the connection, it must be called while holding the lock
+func (d *MySQLDemuxer) client(key string, c *mysqlConn, m *Message, payload []byte, seq uint8, data []byte) {
+	switch c.phase {
+	case mysqlHandshake:
+		r, ok := proto.ParseMySQLHandshakeResponse(payload)
+		if !ok {
+			return
+		}
+		if len(payload) == 32 {
+			delete(d.conns, key)
+			go d.say(5, fmt.Sprintf("mysql connection from %s to %s switched to tls, dropped\n", m.SrcAddr, m.DstAddr))
+			return
+		}
+		c.caps = r.Capabilities & c.serverCaps
+		c.phase = mysqlAuth
+		if !d.StripAuth {
+			d.emit(c, m, data, m.Start, false)
+		} else if r.Database != "" {
+			d.emit(c, m, proto.AppendMySQLPacket(nil, 0, append([]byte{proto.MySQLComInitDB}, r.Database...)), m.Start, false)
+		}
+		return
+	case mysqlAuth:
+		if !d.StripAuth {
+			d.emit(c, m, data, m.Start, false)
+		}
+		return
+	}
+	if c.sending {
+		if c.infile == nil {
+			c.infileAt = m.Start
+		}
+		c.infile = append(c.infile, data...)
+		if len(payload) > 0 {
+			return
+		}
+		d.emit(c, m, c.infile, c.infileAt, false)
+		c.infile, c.sending = nil, false
+		c.expect(proto.MySQLComQuery, false)
+		return
+	}
+	if seq != 0 || len(payload) == 0 {
+		return
+	}
+	command := payload[0]
+	switch command {
+	case proto.MySQLComQuit:
+		d.emit(c, m, data, m.Start, false)
+		delete(d.conns, key)
+		return
+	case proto.MySQLComChangeUser:
+		c.phase = mysqlAuth
+		c.statements = make(map[uint32]mysqlStatement)
+		if !d.StripAuth {
+			d.emit(c, m, data, m.Start, false)
+		}
+		return
+	case proto.MySQLComResetConnection:
+		c.statements = make(map[uint32]mysqlStatement)
+	case proto.MySQLComStmtPrepare:
+		c.prepares++
+		c.expect(command, false).rank = c.prepares
+	case proto.MySQLComQuery:
+		if c.caps&proto.MySQLClientQueryAttributes != 0 {
+			query, ok := proto.MySQLQuery(payload, true)
+			if !ok {
+				c.expect(command, true)
+				return
+			}
+			payload = append([]byte{command}, query...)
+		}
+	}
+	if id, ok := proto.MySQLStatementID(payload); ok {
+		st, found := c.statements[id]
+		// COM_STMT_SEND_LONG_DATA and COM_STMT_CLOSE have no response
+		respond := command != proto.MySQLComStmtSendLongData && command != proto.MySQLComStmtClose
+		if !found {
+			if respond {
+				c.expect(command, true)
+			}
+			go d.say(5, fmt.Sprintf("mysql statement %d from %s to %s was not prepared, command dropped\n", id, m.SrcAddr, m.DstAddr))
+			return
+		}
+		if command == proto.MySQLComStmtExecute && c.caps&proto.MySQLClientQueryAttributes != 0 {
+			if payload, ok = proto.MySQLExecuteWithoutAttributes(payload, st.params); !ok {
+				c.expect(command, true)
+				return
+			}
+		} else {
+			payload = append([]byte(nil), payload...)
+		}
+		binary.LittleEndian.PutUint32(payload[1:], st.rank)
+		if command == proto.MySQLComStmtClose {
+			delete(c.statements, id)
+		}
+		if respond {
+			c.expect(command, false)
+		}
+	} else if command != proto.MySQLComStmtPrepare {
+		c.expect(command, false)
+	}
+	d.emit(c, m, proto.AppendMySQLPacket(nil, 0, payload), m.Start, false)
+}
+
+// expect adds the response of a command to the responses expected
+func (c *mysqlConn) expect(command byte, skip bool) *mysqlResponse {
+	r := &mysqlResponse{skip: skip}
+	r.Command = command
+	r.DeprecateEOF = c.caps&proto.MySQLClientDeprecateEOF != 0
+	c.pending = append(c.pending, r)
+	return r
+}
+
+// server handles a packet of the server of the connection, it must be called while holding the lock
+func (d *MySQLDemuxer) server(key string, c *mysqlConn, m *Message, payload, data []byte) {
+	switch c.phase {
+	case mysqlHandshake:
+		if !d.StripAuth {
+			d.emit(c, m, data, m.Start, false)
+		}
+		return
+	case mysqlAuth:
+		if !d.StripAuth {
+			d.emit(c, m, data, m.Start, false)
+		}
+		switch {
+		case len(payload) > 0 && payload[0] == 0:
+			c.phase = mysqlCommand
+		case len(payload) > 0 && payload[0] == 0xff:
+			delete(d.conns, key)
+		}
+		return
+	}
+	if len(c.pending) == 0 {
+		return
+	}
+	r := c.pending[0]
+	if r.data == nil {
+		r.start = m.Start
+	}
+	if n := int(d.maxSize) - len(r.data); len(data) > n {
+		data = data[:n]
+		r.truncated = true
+	}
+	r.data = append(r.data, data...)
+	if !r.Packet(payload) {
+		return
+	}
+	c.pending = c.pending[1:]
+	if r.Command == proto.MySQLComStmtPrepare && !r.Err {
+		c.statements[r.StatementID] = mysqlStatement{rank: r.rank, params: r.Params}
+	}
+	c.sending = r.Infile
+	if !r.skip {
+		d.emit(c, m, r.data, r.start, r.truncated)
+	}
+}
+
+// emit passes the packets to the handler as a message of the direction of m
+func (d *MySQLDemuxer) emit(c *mysqlConn, m *Message, data []byte, start time.Time, truncated bool) {
+	msg := NewMessage(m.SrcAddr, m.DstAddr, m.IPversion)
+	msg.IsIncoming = m.IsIncoming
+	msg.conn = &connection{syn: c.created}
+	msg.add(0, &Packet{TCP: &layers.TCP{BaseLayer: layers.BaseLayer{Payload: append([]byte(nil), data...)}}, Timestamp: m.End})
+	msg.Start = start
+	msg.Truncated = truncated
+	msg.TimedOut = m.TimedOut
+	d.handler(msg)
+}
+
+// purge forgets the connections idle for longer than mysqlExpire
+func (d *MySQLDemuxer) purge(now time.Time) {
+	d.lastPurge = now
+	for key, c := range d.conns {
+		if now.Sub(c.seen) > mysqlExpire {
+			delete(d.conns, key)
+		}
+	}
+}
+
+func (d *MySQLDemuxer) say(level int, args ...interface{}) {
+	if d.debug != nil {
+		d.debug(level, args...)
+	}
+}
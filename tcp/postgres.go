@@ -0,0 +1,243 @@
+package tcp
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+	"github.com/buger/goreplay/size"
+	"github.com/google/gopacket/layers"
+)
+
+// PostgresSplit is a HintSplit for PostgreSQL, a message holds a message of the protocol or a startup packet.
+// the answer of servers to SSLRequest is not found, see PostgresDemuxer.Split.
+func PostgresSplit(m *Message) int {
+	data := m.Data()
+	if m.IsIncoming && len(data) > 0 && data[0] == 0 {
+		return proto.PostgresStartupLength(data)
+	}
+	return proto.PostgresMessageLength(data)
+}
+
+// postgresExpire is how long the state of an idle PostgreSQL connection is kept
+const postgresExpire = 10 * time.Minute
+
+// PostgresDemuxer follows the PostgreSQL connections, its Handler is the handler of a pool whose Start and Split
+// are the ones of the demuxer. the messages of the client are grouped in a message up to the Query or Sync
+// messages(and Terminate, FunctionCall, CopyDone, CopyFail and the password messages), the startup message is a
+// message on its own. the messages of the server are grouped up to the ReadyForQuery, or the messages after which
+// it waits for the client: CopyInResponse, CopyBothResponse and the authentication requests. the messages of a
+// connection have the UUID of the connection. the connections switching to TLS or GSSAPI encryption are not followed.
+type PostgresDemuxer struct {
+	sync.Mutex
+	handler   Handler
+	debug     Debugger
+	maxSize   size.Size
+	conns     map[string]*postgresConn // by client=server
+	lastPurge time.Time
+	Port      uint16 // when not 0, the messages to this port of connections whose startup was not captured are incoming
+	StripAuth bool   // the password and SASL messages of the client are dropped, and the authentication requests of the server
+}
+
+type postgresConn struct {
+	created   time.Time // timestamp of the first message of the connection
+	seen      time.Time
+	negotiate bool                 // the client requested encryption, the server answers with a single byte
+	encrypted bool                 // the connection switched to TLS or GSSAPI encryption
+	dirs      [2]postgresDirection // from the client, from the server
+}
+
+// postgresDirection holds the messages of a peer until the other peer is expected to answer
+type postgresDirection struct {
+	data      []byte
+	start     time.Time
+	truncated bool
+}
+
+// NewPostgresDemuxer returns a new PostgreSQL demultiplexer, the messages are truncated past maxSize, default 5mb
+func NewPostgresDemuxer(maxSize size.Size, debugger Debugger, handler Handler) *PostgresDemuxer {
+	d := new(PostgresDemuxer)
+	d.handler = handler
+	d.debug = debugger
+	d.maxSize = maxSize
+	if d.maxSize < 1 {
+		d.maxSize = 5 << 20
+	}
+	d.conns = make(map[string]*postgresConn)
+	d.lastPurge = time.Now()
+	return d
+}
+
+// Start is the HintStart of PostgreSQL connections, the startup packets start the messages of clients.
+// the direction of connections already seen is kept.
+func (d *PostgresDemuxer) Start(pckt *Packet) (isIncoming, isOutgoing bool) {
+	if len(pckt.Payload) == 0 {
+		return
+	}
+	src, dst := pckt.Src(), pckt.Dst()
+	d.Lock()
+	_, client := d.conns[src+"="+dst]
+	_, server := d.conns[dst+"="+src]
+	d.Unlock()
+	switch {
+	case client:
+		return true, false
+	case server:
+		return false, true
+	case d.Port != 0:
+		return uint16(pckt.DstPort) == d.Port, uint16(pckt.SrcPort) == d.Port
+	}
+	return proto.PostgresStartupLength(pckt.Payload) > 0, false
+}
+
+// Split is a HintSplit, it is PostgresSplit with the single byte answering SSLRequest and GSSENCRequest,
+// the encrypted data are not split
+func (d *PostgresDemuxer) Split(m *Message) int {
+	client, server := m.SrcAddr, m.DstAddr
+	if !m.IsIncoming {
+		client, server = server, client
+	}
+	d.Lock()
+	c, ok := d.conns[client+"="+server]
+	d.Unlock()
+	switch {
+	case ok && c.encrypted:
+		return m.Length
+	case ok && c.negotiate && !m.IsIncoming:
+		return 1
+	}
+	return PostgresSplit(m)
+}
+
+// Handler handles the messages of a direction of a connection
+func (d *PostgresDemuxer) Handler(m *Message) {
+	defer m.Release()
+	client, server := m.SrcAddr, m.DstAddr
+	if !m.IsIncoming {
+		client, server = server, client
+	}
+	key := client + "=" + server
+	now := time.Now()
+	d.Lock()
+	defer d.Unlock()
+	if now.Sub(d.lastPurge) > postgresExpire/10 {
+		d.purge(now)
+	}
+	data := m.Data()
+	c, ok := d.conns[key]
+	startup := m.IsIncoming && len(data) > 0 && data[0] == 0 && proto.PostgresStartupLength(data) == len(data)
+	if !ok || startup && !c.negotiate {
+		// the ports may be reused by a new connection
+		c = &postgresConn{created: m.Start}
+		d.conns[key] = c
+	}
+	c.seen = now
+	if m.Truncated {
+		// the messages that follow can't be found
+		delete(d.conns, key)
+		go d.say(5, fmt.Sprintf("truncated postgres message from %s to %s, connection state dropped\n", m.SrcAddr, m.DstAddr))
+		return
+	}
+	if c.encrypted {
+		return
+	}
+	if startup {
+		_, ok := proto.ParsePostgresStartup(data)
+		switch {
+		case ok:
+			c.negotiate = false
+			d.emit(c, m, data, m.Start, false)
+		case len(data) == 8:
+			// SSLRequest and GSSENCRequest
+			c.negotiate = true
+		default:
+			// CancelRequest
+			delete(d.conns, key)
+		}
+		return
+	}
+	if c.negotiate && !m.IsIncoming {
+		c.negotiate = false
+		if len(data) == 1 && (data[0] == 'S' || data[0] == 'G') {
+			c.encrypted = true
+			go d.say(5, fmt.Sprintf("postgres connection from %s to %s is encrypted, dropped\n", client, server))
+		}
+		return
+	}
+	typ, body, n := proto.PostgresMessage(data)
+	if n == 0 {
+		return
+	}
+	i := 0
+	if !m.IsIncoming {
+		i = 1
+	}
+	dir := &c.dirs[i]
+	if len(dir.data) == 0 {
+		dir.start = m.Start
+	}
+	if n := int(d.maxSize) - len(dir.data); len(data) > n {
+		data = data[:n]
+		dir.truncated = true
+	}
+	dir.data = append(dir.data, data...)
+	skip := false
+	if m.IsIncoming {
+		switch typ {
+		case proto.PostgresPassword:
+			skip = d.StripAuth
+		case proto.PostgresQuery, proto.PostgresSync, proto.PostgresTerminate, proto.PostgresFunctionCall,
+			proto.PostgresCopyDone, proto.PostgresCopyFail:
+		default:
+			return
+		}
+	} else {
+		switch typ {
+		case proto.PostgresAuthentication:
+			code, _ := proto.PostgresAuthRequest(body)
+			if code == proto.PostgresAuthOK || code == proto.PostgresAuthSASLFinal {
+				return
+			}
+			skip = d.StripAuth
+		case proto.PostgresReadyForQuery, proto.PostgresCopyInResponse, proto.PostgresCopyBoth:
+		default:
+			return
+		}
+	}
+	if !skip {
+		d.emit(c, m, dir.data, dir.start, dir.truncated)
+	}
+	dir.data, dir.truncated = nil, false
+	if typ == proto.PostgresTerminate {
+		delete(d.conns, key)
+	}
+}
+
+// emit passes the messages to the handler as a message of the direction of m
+func (d *PostgresDemuxer) emit(c *postgresConn, m *Message, data []byte, start time.Time, truncated bool) {
+	msg := NewMessage(m.SrcAddr, m.DstAddr, m.IPversion)
+	msg.IsIncoming = m.IsIncoming
+	msg.conn = &connection{syn: c.created}
+	msg.add(0, &Packet{TCP: &layers.TCP{BaseLayer: layers.BaseLayer{Payload: append([]byte(nil), data...)}}, Timestamp: m.End})
+	msg.Start = start
+	msg.Truncated = truncated
+	msg.TimedOut = m.TimedOut
+	d.handler(msg)
+}
+
+// purge forgets the connections idle for longer than postgresExpire
+func (d *PostgresDemuxer) purge(now time.Time) {
+	d.lastPurge = now
+	for key, c := range d.conns {
+		if now.Sub(c.seen) > postgresExpire {
+			delete(d.conns, key)
+		}
+	}
+}
+
+func (d *PostgresDemuxer) say(level int, args ...interface{}) {
+	if d.debug != nil {
+		d.debug(level, args...)
+	}
+}
@@ -0,0 +1,642 @@
+package tcp
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+	"github.com/buger/goreplay/size"
+	"github.com/google/gopacket/layers"
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/net/http2/hpack"
+)
+
+// quicExpire is how long the state of an idle QUIC connection is kept
+const quicExpire = 10 * time.Minute
+
+// quicMaxCrypto is the length of the handshake data of Initial packets kept, to read the ClientHello and ServerHello
+const quicMaxCrypto = 4 << 10
+
+// quicMaxPending is the number of fragments received ahead of the data of a stream kept
+const quicMaxPending = 1024
+
+// quicSalts are the salts of the initial secrets, by version
+var quicSalts = map[uint32][]byte{
+	proto.QUICVersion1: {0x38, 0x76, 0x2c, 0xf7, 0xf5, 0x59, 0x34, 0xb3, 0x4d, 0x17, 0x9a, 0xe6, 0xa4, 0xc8, 0x0c, 0xad, 0xcc, 0xbb, 0x7f, 0x0a},
+	proto.QUICVersion2: {0x0d, 0xed, 0xe3, 0xde, 0xf7, 0x00, 0xa6, 0xdb, 0x81, 0x93, 0x81, 0xbe, 0x6e, 0x26, 0x9d, 0xcb, 0xf9, 0xbd, 0x2e, 0xd9},
+}
+
+// QUICDecoder decrypts QUIC connections and demultiplexes their HTTP/3 streams. its Handler is the handler of a
+// UDP pool emitting a message per datagram. the Initial packets are decrypted with the keys derived from the
+// connection ID chosen by the client, the 1-RTT packets with the traffic secrets of KeyLog, looked up with the
+// random of the ClientHello. the header sections are decoded with the QPACK context of their connection, and each
+// stream is passed to the handler as an HTTP/1.1 message once it ends(see proto.HTTP2Message). the response of a
+// stream has the UUID of its request. the first Initial packet of connections must be captured, 0-RTT data is lost.
+type QUICDecoder struct {
+	sync.Mutex
+	handler   Handler
+	debug     Debugger
+	maxSize   size.Size
+	conns     map[string]*quicConn // by client=server
+	lastPurge time.Time
+	KeyLog    *KeyLog
+}
+
+type quicConn struct {
+	created time.Time // timestamp of the first packet of the connection
+	seen    time.Time
+	version uint32
+	retried bool   // the server sent a Retry, the next Initial of the client has new initial keys
+	cidLen  [2]int // length of the connection IDs of the short header packets sent by the client, by the server
+	random  []byte // of the ClientHello
+	suiteID uint16
+	known   bool             // the cipher suite is known
+	failed  bool             // the traffic secrets are not in the key log
+	dirs    [2]quicDirection // from the client, from the server
+}
+
+// quicDirection is the state of the packets sent by a peer
+type quicDirection struct {
+	initial    *quicKeys
+	app        *quicKeys
+	next       *quicKeys // of the next key phase
+	secret     []byte    // application traffic secret of the current key phase
+	nextSecret []byte    // of the next key phase
+	largest    [2]int64  // largest packet number received in the Initial and application spaces
+	crypto     quicBuffer
+	hello      []byte // contiguous handshake data of the Initial packets
+	qpack      proto.QPACKDecoder
+	streams    map[uint64]*quicStream
+	done       map[uint64]time.Time // streams emitted, whose retransmitted frames are ignored
+	blocked    []uint64             // streams whose header section references entries not inserted yet
+	failed     bool                 // packets can't be decrypted
+}
+
+type quicStream struct {
+	quicBuffer
+	data      []byte // received and not handled yet
+	typ       int64  // of unidirectional streams, -1 until received
+	left      uint64 // length of the DATA frame not received yet
+	fin       bool
+	end       uint64 // offset of the end of the stream, known once fin is received
+	fields    []hpack.HeaderField
+	body      []byte
+	start     time.Time
+	truncated bool
+	section   []byte // blocked header section
+}
+
+// quicBuffer reassembles the data of a stream
+type quicBuffer struct {
+	offset  uint64            // end of the contiguous data received
+	pending map[uint64][]byte // data received ahead, by offset
+}
+
+// add returns the data following the contiguous data received so far
+func (b *quicBuffer) add(offset uint64, data []byte) (out []byte) {
+	end := offset + uint64(len(data))
+	if end <= b.offset {
+		return nil
+	}
+	if offset > b.offset {
+		if b.pending == nil {
+			b.pending = make(map[uint64][]byte)
+		}
+		if len(b.pending) < quicMaxPending {
+			if prev, ok := b.pending[offset]; !ok || len(prev) < len(data) {
+				b.pending[offset] = append([]byte(nil), data...)
+			}
+		}
+		return nil
+	}
+	out = append(out, data[b.offset-offset:]...)
+	b.offset = end
+	for merged := true; merged && len(b.pending) > 0; {
+		merged = false
+		for off, p := range b.pending {
+			if off > b.offset {
+				continue
+			}
+			delete(b.pending, off)
+			if e := off + uint64(len(p)); e > b.offset {
+				out = append(out, p[b.offset-off:]...)
+				b.offset = e
+			}
+			merged = true
+		}
+	}
+	return out
+}
+
+// quicKeys are the keys protecting the packets of a direction in a packet number space
+type quicKeys struct {
+	aead cipher.AEAD
+	iv   []byte
+	mask func(sample []byte) []byte // returns the header protection mask of the sample
+}
+
+// quicLabel returns the label of the key derivation of the version
+func quicLabel(version uint32, label string) string {
+	if version == proto.QUICVersion2 {
+		return "quicv2 " + label
+	}
+	return "quic " + label
+}
+
+// newQUICKeys derives the packet protection keys of the secret
+func newQUICKeys(suiteID uint16, secret []byte, version uint32) (*quicKeys, error) {
+	suite, ok := tlsSuites[suiteID]
+	if !ok || suiteID>>8 != 0x13 {
+		return nil, fmt.Errorf("unsupported cipher suite %#04x", suiteID)
+	}
+	aead, err := suite.aead(expandLabel(suite.hash, secret, quicLabel(version, "key"), suite.keyLen))
+	if err != nil {
+		return nil, err
+	}
+	k := &quicKeys{aead: aead, iv: expandLabel(suite.hash, secret, quicLabel(version, "iv"), 12)}
+	hp := expandLabel(suite.hash, secret, quicLabel(version, "hp"), suite.keyLen)
+	if suiteID == 0x1303 {
+		k.mask = func(sample []byte) []byte {
+			c, err := chacha20.NewUnauthenticatedCipher(hp, sample[4:16])
+			if err != nil {
+				return nil
+			}
+			c.SetCounter(binary.LittleEndian.Uint32(sample))
+			mask := make([]byte, 5)
+			c.XORKeyStream(mask, mask)
+			return mask
+		}
+		return k, nil
+	}
+	block, err := aes.NewCipher(hp)
+	if err != nil {
+		return nil, err
+	}
+	k.mask = func(sample []byte) []byte {
+		mask := make([]byte, aes.BlockSize)
+		block.Encrypt(mask, sample)
+		return mask
+	}
+	return k, nil
+}
+
+// quicInitialKeys derives the keys of the Initial packets of the client and the server from the destination
+// connection ID of the first Initial packet of the client
+func quicInitialKeys(version uint32, dcid []byte) (client, server *quicKeys, err error) {
+	mac := hmac.New(sha256.New, quicSalts[version])
+	mac.Write(dcid)
+	secret := mac.Sum(nil)
+	if client, err = newQUICKeys(0x1301, expandLabel(sha256.New, secret, "client in", 32), version); err != nil {
+		return
+	}
+	server, err = newQUICKeys(0x1301, expandLabel(sha256.New, secret, "server in", 32), version)
+	return
+}
+
+var errQUICPacket = errors.New("invalid quic packet")
+
+// open removes the header protection of the packet whose packet number starts at pnOffset and decrypts its payload.
+// largest is the largest packet number received in its space.
+func (k *quicKeys) open(packet []byte, pnOffset int, largest int64) (payload []byte, pn int64, err error) {
+	if len(packet) < pnOffset+4+16 {
+		return nil, 0, errQUICPacket
+	}
+	mask := k.mask(packet[pnOffset+4 : pnOffset+20])
+	if len(mask) < 5 {
+		return nil, 0, errQUICPacket
+	}
+	header := append([]byte(nil), packet[:pnOffset+4]...)
+	if header[0]&0x80 != 0 {
+		header[0] ^= mask[0] & 0x0f
+	} else {
+		header[0] ^= mask[0] & 0x1f
+	}
+	pnLen := int(header[0]&3) + 1
+	var truncated uint64
+	for i := 0; i < pnLen; i++ {
+		header[pnOffset+i] ^= mask[1+i]
+		truncated = truncated<<8 | uint64(header[pnOffset+i])
+	}
+	pn = quicPacketNumber(largest, truncated, uint(pnLen*8))
+	payload, err = k.aead.Open(nil, tlsNonce(k.iv, uint64(pn)), packet[pnOffset+pnLen:], header[:pnOffset+pnLen])
+	return payload, pn, err
+}
+
+// quicPacketNumber decodes a truncated packet number(https://www.rfc-editor.org/rfc/rfc9000.html#appendix-A.3)
+func quicPacketNumber(largest int64, truncated uint64, bits uint) int64 {
+	expected := largest + 1
+	win := int64(1) << bits
+	candidate := expected&^(win-1) | int64(truncated)
+	switch {
+	case candidate <= expected-win/2 && candidate < 1<<62-win:
+		return candidate + win
+	case candidate > expected+win/2 && candidate >= win:
+		return candidate - win
+	}
+	return candidate
+}
+
+// NewQUICDecoder returns a new QUIC decoder, the body of streams is truncated past maxSize, default 5mb
+func NewQUICDecoder(maxSize size.Size, debugger Debugger, handler Handler) *QUICDecoder {
+	d := new(QUICDecoder)
+	d.handler = handler
+	d.debug = debugger
+	d.maxSize = maxSize
+	if d.maxSize < 1 {
+		d.maxSize = 5 << 20
+	}
+	d.conns = make(map[string]*quicConn)
+	d.lastPurge = time.Now()
+	return d
+}
+
+// Handler handles the packets of a datagram
+func (d *QUICDecoder) Handler(m *Message) {
+	defer m.Release()
+	data := m.Data()
+	now := time.Now()
+	d.Lock()
+	defer d.Unlock()
+	if now.Sub(d.lastPurge) > quicExpire/10 {
+		d.purge(now)
+	}
+	i := 0
+	key := m.SrcAddr + "=" + m.DstAddr
+	c, ok := d.conns[key]
+	if !ok {
+		if c, ok = d.conns[m.DstAddr+"="+m.SrcAddr]; ok {
+			i = 1
+		}
+	}
+	if h, _ := proto.ParseQUICHeader(data, 0); h.Long && h.Type == proto.QUICInitial && i == 0 && (!ok || c.dirs[0].app != nil) {
+		// a new connection, whose first Initial packet has the connection ID the initial keys are derived from
+		client, server, err := quicInitialKeys(h.Version, h.DCID)
+		if err != nil {
+			return
+		}
+		if _, _, err = client.open(data[:h.Length], h.PNOffset, -1); err != nil {
+			// not sent by the client
+			return
+		}
+		c = &quicConn{created: m.Start, version: h.Version}
+		c.dirs[0].initial, c.dirs[1].initial = client, server
+		for j := range c.dirs {
+			c.dirs[j].largest = [2]int64{-1, -1}
+			c.dirs[j].streams = make(map[uint64]*quicStream)
+			c.dirs[j].done = make(map[uint64]time.Time)
+		}
+		d.conns[key] = c
+	} else if !ok {
+		return
+	}
+	c.seen = now
+	for len(data) > 0 {
+		n := d.packet(c, i, data, m)
+		if n == 0 {
+			break
+		}
+		data = data[n:]
+	}
+}
+
+// packet handles the packet at the start of data sent in the direction i of the connection, and returns its length.
+// it must be called while holding the lock.
+func (d *QUICDecoder) packet(c *quicConn, i int, data []byte, m *Message) int {
+	h, ok := proto.ParseQUICHeader(data, c.cidLen[i])
+	if !ok {
+		return 0
+	}
+	dir := &c.dirs[i]
+	packet := data[:h.Length]
+	if h.Long {
+		if h.Version != c.version {
+			return h.Length
+		}
+		// the connection ID chosen by a peer is the one of the short header packets sent to it
+		c.cidLen[1-i] = len(h.SCID)
+		switch h.Type {
+		case proto.QUICRetry:
+			c.retried = i == 1
+		case proto.QUICInitial:
+			if i == 0 && c.retried {
+				c.retried = false
+				client, server, err := quicInitialKeys(c.version, h.DCID)
+				if err != nil {
+					return h.Length
+				}
+				c.dirs[0].initial, c.dirs[1].initial = client, server
+				c.dirs[0].largest[0], c.dirs[1].largest[0] = -1, -1
+			}
+			payload, pn, err := dir.initial.open(packet, h.PNOffset, dir.largest[0])
+			if err != nil {
+				return h.Length
+			}
+			if pn > dir.largest[0] {
+				dir.largest[0] = pn
+			}
+			d.initial(c, i, payload)
+		}
+		return h.Length
+	}
+	if dir.app == nil && !d.appKeys(c, i, m) {
+		return h.Length
+	}
+	payload, pn, err := dir.app.open(packet, h.PNOffset, dir.largest[1])
+	if err != nil {
+		// the peer may have updated its keys, the header protection key is kept
+		if dir.next == nil {
+			dir.nextSecret = expandLabel(tlsSuites[c.suiteID].hash, dir.secret, quicLabel(c.version, "ku"), len(dir.secret))
+			if dir.next, err = newQUICKeys(c.suiteID, dir.nextSecret, c.version); err != nil {
+				return h.Length
+			}
+			dir.next.mask = dir.app.mask
+		}
+		if payload, pn, err = dir.next.open(packet, h.PNOffset, dir.largest[1]); err != nil {
+			if !dir.failed {
+				dir.failed = true
+				go d.say(4, fmt.Sprintf("error decrypting quic packets from %s to %s: %s\n", m.SrcAddr, m.DstAddr, err))
+			}
+			return h.Length
+		}
+		dir.app, dir.secret, dir.next = dir.next, dir.nextSecret, nil
+	}
+	if pn > dir.largest[1] {
+		dir.largest[1] = pn
+	}
+	for len(payload) > 0 {
+		f, n := proto.ParseQUICFrame(payload)
+		if n == 0 {
+			break
+		}
+		payload = payload[n:]
+		switch {
+		case f.Type >= proto.QUICFrameStream && f.Type <= proto.QUICFrameStream|7:
+			d.stream(c, i, f, m)
+		case f.Type == proto.QUICFrameResetStream:
+			delete(dir.streams, f.Stream)
+		}
+	}
+	return h.Length
+}
+
+// initial reads the random of the ClientHello and the cipher suite of the ServerHello in the CRYPTO frames of
+// an Initial packet sent in the direction i
+func (d *QUICDecoder) initial(c *quicConn, i int, payload []byte) {
+	dir := &c.dirs[i]
+	for len(payload) > 0 {
+		f, n := proto.ParseQUICFrame(payload)
+		if n == 0 {
+			break
+		}
+		payload = payload[n:]
+		if f.Type == proto.QUICFrameCrypto && len(dir.hello) < quicMaxCrypto {
+			dir.hello = append(dir.hello, dir.crypto.add(f.Offset, f.Data)...)
+		}
+	}
+	hello := dir.hello
+	switch {
+	case i == 0 && c.random == nil && len(hello) >= 38 && hello[0] == proto.TLSClientHello:
+		c.random = append([]byte(nil), hello[6:38]...)
+	case i == 1 && !c.known && len(hello) >= 39 && hello[0] == proto.TLSServerHello:
+		if n := 39 + int(hello[38]); len(hello) >= n+2 {
+			c.suiteID = binary.BigEndian.Uint16(hello[n:])
+			c.known = true
+		}
+	}
+}
+
+// appKeys derives the keys of the 1-RTT packets sent in the direction i from the traffic secrets of the key log
+func (d *QUICDecoder) appKeys(c *quicConn, i int, m *Message) bool {
+	if c.random == nil || !c.known || c.failed || d.KeyLog == nil {
+		return false
+	}
+	label := "CLIENT_TRAFFIC_SECRET_0"
+	if i == 1 {
+		label = "SERVER_TRAFFIC_SECRET_0"
+	}
+	secret := d.KeyLog.Secret(label, c.random)
+	if secret == nil {
+		c.failed = true
+		go d.say(4, fmt.Sprintf("no secret for the quic connection from %s to %s in the key log\n", m.SrcAddr, m.DstAddr))
+		return false
+	}
+	keys, err := newQUICKeys(c.suiteID, secret, c.version)
+	if err != nil {
+		c.failed = true
+		go d.say(4, fmt.Sprintf("quic connection from %s to %s: %s\n", m.SrcAddr, m.DstAddr, err))
+		return false
+	}
+	c.dirs[i].app, c.dirs[i].secret = keys, secret
+	return true
+}
+
+// stream handles a STREAM frame sent in the direction i
+func (d *QUICDecoder) stream(c *quicConn, i int, f proto.QUICFrame, m *Message) {
+	dir := &c.dirs[i]
+	if _, ok := dir.done[f.Stream]; ok {
+		return
+	}
+	s, ok := dir.streams[f.Stream]
+	if !ok {
+		s = &quicStream{typ: -1, start: m.Start}
+		dir.streams[f.Stream] = s
+	}
+	s.data = append(s.data, s.add(f.Offset, f.Data)...)
+	if f.Fin {
+		s.fin = true
+		s.end = f.Offset + uint64(len(f.Data))
+	}
+	if f.Stream&2 != 0 {
+		d.unidirectional(c, i, f.Stream, s, m)
+		return
+	}
+	d.frames(c, i, f.Stream, s, m)
+}
+
+// unidirectional handles the data of a unidirectional stream, the control and QPACK encoder streams are read
+func (d *QUICDecoder) unidirectional(c *quicConn, i int, id uint64, s *quicStream, m *Message) {
+	dir := &c.dirs[i]
+	if s.typ < 0 {
+		typ, n := proto.QUICVarint(s.data)
+		if n == 0 {
+			return
+		}
+		s.typ = int64(typ)
+		s.data = s.data[n:]
+	}
+	switch uint64(s.typ) {
+	case proto.HTTP3StreamControl:
+		for {
+			typ, payload, n := proto.ParseHTTP3Frame(s.data)
+			if n == 0 {
+				break
+			}
+			s.data = s.data[n:]
+			if typ != proto.HTTP3FrameSettings {
+				continue
+			}
+			for len(payload) > 0 {
+				setting, j := proto.QUICVarint(payload)
+				value, k := proto.QUICVarint(payload[j:])
+				if j == 0 || k == 0 {
+					break
+				}
+				payload = payload[j+k:]
+				if setting == proto.HTTP3SettingQPACKMaxTableCapacity {
+					// the capacity of the table of the decoder of the peer i, used by the encoder of the other peer
+					c.dirs[1-i].qpack.MaxCapacity = value
+				}
+			}
+		}
+	case proto.HTTP3StreamQPACKEncoder:
+		err := dir.qpack.Encoder(s.data)
+		s.data = nil
+		if err != nil {
+			go d.say(4, fmt.Sprintf("error decoding the qpack encoder stream from %s to %s: %s\n", m.SrcAddr, m.DstAddr, err))
+			return
+		}
+		blocked := dir.blocked
+		dir.blocked = nil
+		for _, id := range blocked {
+			if s, ok := dir.streams[id]; ok {
+				d.frames(c, i, id, s, m)
+			}
+		}
+	default:
+		s.data = nil
+	}
+}
+
+// frames handles the frames of a request stream sent in the direction i
+func (d *QUICDecoder) frames(c *quicConn, i int, id uint64, s *quicStream, m *Message) {
+	dir := &c.dirs[i]
+	if s.section != nil {
+		fields, err := dir.qpack.Decode(s.section)
+		if err == proto.ErrQPACKBlocked {
+			dir.blocked = append(dir.blocked, id)
+			return
+		}
+		s.section = nil
+		if !d.headers(c, i, id, s, fields, err, m) {
+			return
+		}
+	}
+	for len(s.data) > 0 {
+		if s.left > 0 {
+			n := uint64(len(s.data))
+			if n > s.left {
+				n = s.left
+			}
+			s.write(s.data[:n], d.maxSize)
+			s.data = s.data[n:]
+			s.left -= n
+			continue
+		}
+		typ, j := proto.QUICVarint(s.data)
+		length, k := proto.QUICVarint(s.data[j:])
+		if j == 0 || k == 0 {
+			break
+		}
+		if typ == proto.HTTP3FrameData {
+			// the data is handled as it is received
+			s.data = s.data[j+k:]
+			s.left = length
+			continue
+		}
+		if uint64(len(s.data)-j-k) < length {
+			break
+		}
+		payload := s.data[j+k : j+k+int(length)]
+		s.data = s.data[j+k+int(length):]
+		if typ != proto.HTTP3FrameHeaders {
+			continue
+		}
+		fields, err := dir.qpack.Decode(payload)
+		if err == proto.ErrQPACKBlocked {
+			s.section = append([]byte(nil), payload...)
+			dir.blocked = append(dir.blocked, id)
+			return
+		}
+		if !d.headers(c, i, id, s, fields, err, m) {
+			return
+		}
+	}
+	if s.fin && s.offset == s.end && len(s.data) == 0 && s.left == 0 {
+		d.emit(c, i, id, s, m)
+	}
+}
+
+// headers adds the fields of a header section to the stream, it returns false if the stream was dropped
+func (d *QUICDecoder) headers(c *quicConn, i int, id uint64, s *quicStream, fields []hpack.HeaderField, err error, m *Message) bool {
+	if err != nil {
+		delete(c.dirs[i].streams, id)
+		go d.say(4, fmt.Sprintf("error decoding http3 headers from %s to %s: %s\n", m.SrcAddr, m.DstAddr, err))
+		return false
+	}
+	if len(fields) > 0 && fields[0].Name == ":status" && strings.HasPrefix(fields[0].Value, "1") {
+		// informational responses precede the response
+		return true
+	}
+	// trailers follow the body
+	s.fields = append(s.fields, fields...)
+	return true
+}
+
+// write appends data to the body of the stream, up to maxSize
+func (s *quicStream) write(data []byte, maxSize size.Size) {
+	if n := int(maxSize) - len(s.body); len(data) > n {
+		data = data[:n]
+		s.truncated = true
+	}
+	s.body = append(s.body, data...)
+}
+
+// emit passes the stream of the direction i to the handler as an HTTP/1.1 message
+func (d *QUICDecoder) emit(c *quicConn, i int, id uint64, s *quicStream, m *Message) {
+	dir := &c.dirs[i]
+	delete(dir.streams, id)
+	dir.done[id] = time.Now()
+	data := proto.HTTP2Message(s.fields, s.body)
+	if data == nil {
+		return
+	}
+	msg := NewMessage(m.SrcAddr, m.DstAddr, m.IPversion)
+	msg.IsIncoming = i == 0
+	msg.conn = &connection{isn: uint32(id), syn: c.created}
+	msg.add(0, &Packet{TCP: &layers.TCP{BaseLayer: layers.BaseLayer{Payload: data}}, Timestamp: m.End})
+	msg.Start = s.start
+	msg.Truncated = s.truncated
+	d.handler(msg)
+}
+
+// purge forgets the connections idle for longer than quicExpire, and the streams emitted a while ago
+func (d *QUICDecoder) purge(now time.Time) {
+	d.lastPurge = now
+	for key, c := range d.conns {
+		if now.Sub(c.seen) > quicExpire {
+			delete(d.conns, key)
+			continue
+		}
+		for i := range c.dirs {
+			for id, t := range c.dirs[i].done {
+				if now.Sub(t) > quicExpire/10 {
+					delete(c.dirs[i].done, id)
+				}
+			}
+		}
+	}
+}
+
+func (d *QUICDecoder) say(level int, args ...interface{}) {
+	if d.debug != nil {
+		d.debug(level, args...)
+	}
+}
@@ -0,0 +1,29 @@
+package tcp
+
+import (
+	"github.com/buger/goreplay/proto"
+)
+
+// RedisSplit is a HintSplit for Redis, a message holds a RESP2 or RESP3 value: a command of the client,
+// or a reply or a push of the server
+func RedisSplit(m *Message) int {
+	return proto.RESPLength(m.Data())
+}
+
+// RedisStart returns the HintStart of Redis connections, the packets to port are incoming. when port is 0,
+// the packets starting with a command are incoming and the other RESP values are outgoing, the replies that
+// are arrays of bulk strings can't be told apart from commands.
+func RedisStart(port uint16) HintStart {
+	return func(pckt *Packet) (isIncoming, isOutgoing bool) {
+		if len(pckt.Payload) == 0 {
+			return
+		}
+		if port != 0 {
+			return uint16(pckt.DstPort) == port, uint16(pckt.SrcPort) == port
+		}
+		if _, ok := proto.RESPCommand(pckt.Payload); ok {
+			return true, false
+		}
+		return false, proto.RESPLength(pckt.Payload) > 0
+	}
+}
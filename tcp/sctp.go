@@ -0,0 +1,394 @@
+package tcp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/buger/goreplay/size"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// SCTPChunk is a chunk of an SCTP packet(https://www.rfc-editor.org/rfc/rfc9260#section-3.2),
+// the fields past Flags are only set for DATA chunks.
+type SCTPChunk struct {
+	Type   layers.SCTPChunkType
+	Flags  uint8
+	TSN    uint32 // transmission sequence number
+	Stream uint16 // stream identifier
+	SSN    uint16 // stream sequence number
+	PPID   uint32 // payload protocol identifier
+	Data   []byte // user data of DATA chunks, value of the other chunks
+}
+
+// flags of DATA chunks
+const (
+	sctpEnd   = 1 << 0
+	sctpBegin = 1 << 1
+)
+
+// Begin tells if the chunk holds the first fragment of a user message
+func (c *SCTPChunk) Begin() bool {
+	return c.Flags&sctpBegin != 0
+}
+
+// End tells if the chunk holds the last fragment of a user message
+func (c *SCTPChunk) End() bool {
+	return c.Flags&sctpEnd != 0
+}
+
+// ParseSCTP parses an SCTP packet, the ports of its common header are held by the TCP field of pckt,
+// whose payload is empty. gopacket decodes the chunks following a DATA chunk as its payload, the chunks
+// are walked here instead.
+func ParseSCTP(packet gopacket.Packet) (pckt *Packet, chunks []SCTPChunk, err error) {
+	var next layers.IPProtocol
+	var payload []byte
+	if pckt, next, payload = parseNetwork(packet); pckt == nil {
+		return nil, nil, nil
+	}
+	if next != layers.IPProtocolSCTP {
+		return nil, nil, nil
+	}
+	// the common header: ports, verification tag and checksum
+	if len(payload) < 12 {
+		return nil, nil, fmt.Errorf("truncated sctp header of %d bytes", len(payload))
+	}
+	pckt.TCP = &layers.TCP{
+		SrcPort: layers.TCPPort(binary.BigEndian.Uint16(payload)),
+		DstPort: layers.TCPPort(binary.BigEndian.Uint16(payload[2:])),
+	}
+	for data := payload[12:]; len(data) >= 4; {
+		length := int(binary.BigEndian.Uint16(data[2:]))
+		if length < 4 || length > len(data) {
+			return pckt, chunks, fmt.Errorf("truncated sctp chunk of %d bytes", length)
+		}
+		c := SCTPChunk{Type: layers.SCTPChunkType(data[0]), Flags: data[1], Data: data[4:length]}
+		if c.Type == layers.SCTPChunkTypeData {
+			if length < 16 {
+				return pckt, chunks, fmt.Errorf("truncated sctp data chunk of %d bytes", length)
+			}
+			c.TSN = binary.BigEndian.Uint32(data[4:])
+			c.Stream = binary.BigEndian.Uint16(data[8:])
+			c.SSN = binary.BigEndian.Uint16(data[10:])
+			c.PPID = binary.BigEndian.Uint32(data[12:])
+			c.Data = data[16:length]
+		}
+		chunks = append(chunks, c)
+		// chunks are padded to 4 bytes
+		if length = (length + 3) &^ 3; length > len(data) {
+			break
+		}
+		data = data[length:]
+	}
+	return
+}
+
+// sctpFragments holds the fragments of the user messages of a stream not yet complete, ordered by TSN
+type sctpFragments struct {
+	chunks []sctpFragment
+	seen   time.Time
+}
+
+type sctpFragment struct {
+	pckt  *Packet
+	flags uint8
+}
+
+// SCTPPool holds the data of the SCTP messages in progress, like MessagePool does for tcp. the messages of
+// each stream of an association are reassembled apart, from the DATA chunks of the user messages, which are
+// reassembled by TSN when fragmented. a user message is a message unless End is set, the user messages are then
+// added to the message until End tells it is complete.
+// the packets of messages have the user data of a DATA chunk as payload and its TSN as sequence number.
+// the direction of a message is given by Start, else by the INIT chunk of the association, the client
+// sends it, else by Port.
+type SCTPPool struct {
+	sync.Mutex
+	debug         Debugger
+	handler       Handler
+	maxSize       size.Size
+	messageExpire time.Duration
+	messages      map[string]*Message       // by src=dst/stream
+	fragments     map[string]*sctpFragments // by src=dst/stream
+	associations  map[string]time.Time      // client=server of the associations whose INIT was seen, and when they were last seen
+	quit          chan bool
+	closeOnce     sync.Once
+	closed        bool
+	Start         HintStart
+	End           HintEnd
+	Defragmenter  *Defragmenter // reassembles fragmented IP packets before parsing them, can be set to nil
+	Port          uint16        // when not 0, only the packets from or to this port are handled, the messages to it are incoming
+}
+
+// NewSCTPPool returns a new SCTP message pool, see NewMessagePool
+func NewSCTPPool(maxSize size.Size, messageExpire time.Duration, debugger Debugger, handler Handler) (pool *SCTPPool) {
+	pool = new(SCTPPool)
+	pool.debug = debugger
+	pool.handler = handler
+	pool.messageExpire = time.Millisecond * 100
+	if pool.messageExpire < messageExpire {
+		pool.messageExpire = messageExpire
+	}
+	pool.maxSize = maxSize
+	if pool.maxSize < 1 {
+		pool.maxSize = 5 << 20
+	}
+	pool.messages = make(map[string]*Message)
+	pool.fragments = make(map[string]*sctpFragments)
+	pool.associations = make(map[string]time.Time)
+	pool.Defragmenter = NewDefragmenter(0, 0)
+	pool.quit = make(chan bool)
+	go pool.sweep()
+	return pool
+}
+
+// SetHints sets the Start and End hints of the pool to the hints registered with name,
+// the user messages of SCTP are not split.
+func (pool *SCTPPool) SetHints(name string) error {
+	h, ok := LookupHints(name)
+	if !ok {
+		return fmt.Errorf("unknown hints %q, available hints are %v", name, HintsNames())
+	}
+	pool.Start, pool.End = h.Start, h.End
+	return nil
+}
+
+// Handler handles the SCTP packets of the capture
+func (pool *SCTPPool) Handler(packet gopacket.Packet) {
+	if pool.Defragmenter != nil {
+		var err error
+		if packet, err = pool.Defragmenter.Defrag(packet); packet == nil {
+			if err != nil {
+				go pool.say(5, fmt.Sprintf("error defragmenting packet: %s\n", err))
+			}
+			return
+		}
+	}
+	pckt, chunks, err := ParseSCTP(packet)
+	if err != nil {
+		go pool.say(4, fmt.Sprintf("error decoding sctp packet(%dBytes):%s\n", packet.Metadata().CaptureLength, err))
+	}
+	if pckt == nil {
+		return
+	}
+	if pool.Port != 0 && uint16(pckt.SrcPort) != pool.Port && uint16(pckt.DstPort) != pool.Port {
+		return
+	}
+	pool.Lock()
+	defer pool.Unlock()
+	if pool.closed {
+		return
+	}
+	for i := range chunks {
+		c := &chunks[i]
+		switch c.Type {
+		case layers.SCTPChunkTypeInit:
+			pool.associations[pckt.Src()+"="+pckt.Dst()] = time.Now()
+		case layers.SCTPChunkTypeData:
+			pool.data(pckt, c)
+		case layers.SCTPChunkTypeAbort, layers.SCTPChunkTypeShutdownAck:
+			// the peer sends SHUTDOWN ACK once all its data are acknowledged
+			pool.shutdown(pckt.Src(), pckt.Dst())
+			go pool.say(4, fmt.Sprintf("%s chunk from %s to %s at %s\n", c.Type, pckt.Src(), pckt.Dst(), pckt.Timestamp))
+		}
+	}
+}
+
+// data adds the DATA chunk to the message of its stream, once its user message is complete
+func (pool *SCTPPool) data(pckt *Packet, c *SCTPChunk) {
+	p := *pckt
+	tcp := *pckt.TCP
+	p.TCP = &tcp
+	p.Seq = c.TSN
+	p.Payload = c.Data
+	key := fmt.Sprintf("%s=%s/%d", pckt.Src(), pckt.Dst(), c.Stream)
+	for _, assoc := range []string{pckt.Src() + "=" + pckt.Dst(), pckt.Dst() + "=" + pckt.Src()} {
+		if _, ok := pool.associations[assoc]; ok {
+			pool.associations[assoc] = time.Now()
+		}
+	}
+	parts := []*Packet{&p}
+	if !c.Begin() || !c.End() {
+		if parts = pool.reassemble(key, &p, c); parts == nil {
+			return
+		}
+	}
+	m, ok := pool.messages[key]
+	if ok && pool.Start != nil {
+		// the user message starts the next message of the stream
+		if in, out := pool.Start(parts[0]); in || out {
+			pool.dispatch(key, m)
+			ok = false
+		}
+	}
+	if !ok {
+		in, known := pool.direction(parts[0])
+		if !known {
+			go pool.say(5, fmt.Sprintf("sctp message from %s to %s of unknown direction dropped\n", pckt.Src(), pckt.Dst()))
+			return
+		}
+		m = NewMessage(pckt.Src(), pckt.Dst(), pckt.Version)
+		m.IsIncoming = in
+		m.conn = &connection{isn: uint32(c.Stream)}
+		m.Start = parts[0].Timestamp
+		m.created = time.Now()
+		m.expire = m.created.Add(pool.messageExpire)
+		pool.messages[key] = m
+	}
+	for _, p := range parts {
+		if m.Length+len(p.Payload) > int(pool.maxSize) {
+			p.Payload = p.Payload[:int(pool.maxSize)-m.Length]
+			m.Truncated = true
+		}
+		m.add(len(m.packets), p)
+		if m.Truncated {
+			break
+		}
+	}
+	m.seen = time.Now()
+	if pool.End == nil || m.Truncated || pool.End(m) {
+		pool.dispatch(key, m)
+	}
+}
+
+// reassemble returns the fragments of the user message of the chunk once it is complete,
+// ordered by TSN, and nil until then. it must be called while holding the lock of the pool.
+func (pool *SCTPPool) reassemble(key string, p *Packet, c *SCTPChunk) []*Packet {
+	f, ok := pool.fragments[key]
+	if !ok {
+		f = new(sctpFragments)
+		pool.fragments[key] = f
+	}
+	f.seen = time.Now()
+	chunks := f.chunks
+	i := sort.Search(len(chunks), func(i int) bool { return !seqLess(chunks[i].pckt.Seq, p.Seq) })
+	if i < len(chunks) && chunks[i].pckt.Seq == p.Seq {
+		return nil // retransmission
+	}
+	chunks = append(chunks, sctpFragment{})
+	copy(chunks[i+1:], chunks[i:])
+	chunks[i] = sctpFragment{p, c.Flags}
+	f.chunks = chunks
+	// the user message is complete once contiguous TSNs go from its B to its E fragment
+	first := i
+	for first > 0 && chunks[first].flags&sctpBegin == 0 && chunks[first-1].pckt.Seq+1 == chunks[first].pckt.Seq {
+		first--
+	}
+	last := i
+	for last < len(chunks)-1 && chunks[last].flags&sctpEnd == 0 && chunks[last].pckt.Seq+1 == chunks[last+1].pckt.Seq {
+		last++
+	}
+	if chunks[first].flags&sctpBegin == 0 || chunks[last].flags&sctpEnd == 0 {
+		return nil
+	}
+	parts := make([]*Packet, 0, last-first+1)
+	for _, fragment := range chunks[first : last+1] {
+		parts = append(parts, fragment.pckt)
+	}
+	if f.chunks = append(chunks[:first], chunks[last+1:]...); len(f.chunks) == 0 {
+		delete(pool.fragments, key)
+	}
+	return parts
+}
+
+// direction tells whether the message starting with pckt is incoming, known is false if it can't be told
+func (pool *SCTPPool) direction(pckt *Packet) (in, known bool) {
+	if pool.Start != nil {
+		in, out := pool.Start(pckt)
+		return in, in || out
+	}
+	if _, ok := pool.associations[pckt.Src()+"="+pckt.Dst()]; ok {
+		return true, true
+	}
+	if _, ok := pool.associations[pckt.Dst()+"="+pckt.Src()]; ok {
+		return false, true
+	}
+	if pool.Port != 0 {
+		return uint16(pckt.DstPort) == pool.Port, true
+	}
+	return false, false
+}
+
+// shutdown dispatches the messages of all the streams between src and dst, in both directions.
+// it must be called while holding the lock of the pool.
+func (pool *SCTPPool) shutdown(src, dst string) {
+	for _, prefix := range []string{src + "=" + dst + "/", dst + "=" + src + "/"} {
+		for key, m := range pool.messages {
+			if len(key) > len(prefix) && key[:len(prefix)] == prefix {
+				pool.dispatch(key, m)
+			}
+		}
+		for key := range pool.fragments {
+			if len(key) > len(prefix) && key[:len(prefix)] == prefix {
+				delete(pool.fragments, key)
+			}
+		}
+	}
+	delete(pool.associations, src+"="+dst)
+	delete(pool.associations, dst+"="+src)
+}
+
+// dispatch removes the message from the pool and passes it to the handler,
+// it must be called while holding the lock of the pool.
+func (pool *SCTPPool) dispatch(key string, m *Message) {
+	delete(pool.messages, key)
+	pool.handler(m)
+}
+
+// associationExpire is how long an association is remembered once its packets are no longer seen,
+// in case its SHUTDOWN or ABORT is missed
+const associationExpire = 10 * time.Minute
+
+// sweep times out the messages that have been in the pool for longer than messageExpire, and drops
+// the fragments of user messages not seen for as long, and the associations idle for associationExpire.
+func (pool *SCTPPool) sweep() {
+	ticker := time.NewTicker(pool.messageExpire / 10)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-pool.quit:
+			return
+		case now := <-ticker.C:
+			pool.Lock()
+			for key, m := range pool.messages {
+				if now.After(m.expire) {
+					m.TimedOut = true
+					pool.dispatch(key, m)
+				}
+			}
+			for key, f := range pool.fragments {
+				if now.Sub(f.seen) > pool.messageExpire {
+					delete(pool.fragments, key)
+				}
+			}
+			for key, seen := range pool.associations {
+				if now.Sub(seen) > associationExpire {
+					delete(pool.associations, key)
+				}
+			}
+			pool.Unlock()
+		}
+	}
+}
+
+// Close stops the pool and dispatches the messages in progress flagged as TimedOut
+func (pool *SCTPPool) Close() {
+	pool.closeOnce.Do(func() {
+		close(pool.quit)
+		pool.Lock()
+		pool.closed = true
+		for key, m := range pool.messages {
+			m.TimedOut = true
+			pool.dispatch(key, m)
+		}
+		pool.Unlock()
+	})
+}
+
+func (pool *SCTPPool) say(level int, args ...interface{}) {
+	if pool.debug != nil {
+		pool.debug(level, args...)
+	}
+}
@@ -0,0 +1,225 @@
+package tcp
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+	"github.com/google/gopacket/layers"
+)
+
+// SIPSplit is a HintSplit for SIP over TCP, a message holds a request, a response or keep-alives
+func SIPSplit(m *Message) int {
+	return proto.SIPMessageLength(m.Data())
+}
+
+// SIPStart is the HintStart of SIP over TCP, the requests are incoming and the responses outgoing whatever the
+// side of the connection sending them
+func SIPStart(pckt *Packet) (isIncoming, isOutgoing bool) {
+	if !proto.IsSIP(pckt.Payload) {
+		return
+	}
+	response := bytes.HasPrefix(pckt.Payload, []byte(proto.SIPVersion+" "))
+	return !response, response
+}
+
+// sipExpire is how long a call without messages is remembered
+const sipExpire = 10 * time.Minute
+
+// SIPDemuxer correlates the SIP messages of calls, its Handler is the handler of a UDP pool, or of a TCP pool
+// split with pool.SetHints("sip") and whose Start is SIPStart. the requests are incoming and the responses
+// outgoing whatever the ports, and the messages of a dialog have the UUID of its Call-ID whatever the addresses
+// and the connections they were sent over. the keep-alives and the other messages are dropped.
+//
+// the RTP datagrams to the media addresses of the SDP bodies of a call are dropped too, they are counted by
+// stream when Summary is set, and the streams are passed to Summary when the call ends.
+type SIPDemuxer struct {
+	sync.Mutex
+	handler   Handler
+	debug     Debugger
+	calls     map[string]*sipCall // by Call-ID
+	media     map[string]*sipCall // by the host:port of the RTP streams of the calls
+	lastPurge time.Time
+	Summary   func(callID string, streams []RTPStream) // called while holding the lock of the demultiplexer
+}
+
+type sipCall struct {
+	id       string
+	seen     time.Time
+	media    []string
+	streams  map[uint32]*RTPStream // by SSRC
+	answered bool                  // a 2xx answered an INVITE, the failure of a re-INVITE doesn't end the call
+	ended    bool                  // the call is remembered until it expires, for the retransmissions and the ACKs
+}
+
+// RTPStream sums up the RTP packets of a call with the same SSRC
+type RTPStream struct {
+	SSRC        uint32
+	Src, Dst    string
+	PayloadType byte
+	Packets     int
+	Bytes       int // of the payloads
+	Lost        int // guessed from the gaps in the sequence numbers
+	First, Last time.Time
+	firstSeq    uint32
+	lastSeq     uint32 // extended with the number of cycles
+}
+
+func (s *RTPStream) String() string {
+	return fmt.Sprintf("ssrc %08x from %s to %s: payload type %d, %d packets, %d bytes, %d lost, %s",
+		s.SSRC, s.Src, s.Dst, s.PayloadType, s.Packets, s.Bytes, s.Lost, s.Last.Sub(s.First))
+}
+
+// NewSIPDemuxer returns a new SIP demultiplexer
+func NewSIPDemuxer(debugger Debugger, handler Handler) *SIPDemuxer {
+	d := new(SIPDemuxer)
+	d.handler = handler
+	d.debug = debugger
+	d.calls = make(map[string]*sipCall)
+	d.media = make(map[string]*sipCall)
+	d.lastPurge = time.Now()
+	return d
+}
+
+// Handler passes the SIP messages of m to the handler of the demultiplexer
+func (d *SIPDemuxer) Handler(m *Message) {
+	defer m.Release()
+	data := m.Data()
+	if proto.IsSIPKeepAlive(data) {
+		return
+	}
+	now := time.Now()
+	d.Lock()
+	defer d.Unlock()
+	if now.Sub(d.lastPurge) > sipExpire/10 {
+		d.purge(now)
+	}
+	msg, ok := proto.ParseSIP(data)
+	if !ok || m.Truncated {
+		if !d.rtp(m, data, now) {
+			go d.say(5, fmt.Sprintf("invalid sip message from %s to %s dropped\n", m.SrcAddr, m.DstAddr))
+		}
+		return
+	}
+	id := msg.CallID()
+	if id == "" {
+		go d.say(5, fmt.Sprintf("sip message without Call-ID from %s to %s dropped\n", m.SrcAddr, m.DstAddr))
+		return
+	}
+	c, ok := d.calls[id]
+	if !ok {
+		c = &sipCall{id: id, streams: make(map[uint32]*RTPStream)}
+		d.calls[id] = c
+	}
+	c.seen = now
+	if !c.ended && strings.HasPrefix(strings.ToLower(msg.Get("content-type")), "application/sdp") {
+		for _, addr := range proto.SDPMedia(msg.Body) {
+			if _, ok := d.media[addr]; !ok {
+				c.media = append(c.media, addr)
+			}
+			d.media[addr] = c
+		}
+	}
+
+	out := NewMessage(m.SrcAddr, m.DstAddr, m.IPversion)
+	out.IsIncoming = msg.IsRequest()
+	out.conn = &connection{key: id}
+	out.add(0, &Packet{TCP: &layers.TCP{BaseLayer: layers.BaseLayer{Payload: append([]byte(nil), data...)}}, Timestamp: m.End})
+	out.Start = m.Start
+	out.TimedOut = m.TimedOut
+	d.handler(out)
+
+	// the call ends with the final response to its BYE, or the failure of its first INVITE
+	_, method := msg.CSeq()
+	if method == "INVITE" && msg.Status >= 200 && msg.Status < 300 {
+		c.answered = true
+	}
+	if !c.ended && !msg.IsRequest() && (method == "BYE" && msg.Status >= 200 || method == "INVITE" && msg.Status >= 300 && !c.answered) {
+		d.end(c)
+	}
+}
+
+// rtp counts the RTP datagram of a call, it returns false if data is not one
+func (d *SIPDemuxer) rtp(m *Message, data []byte, now time.Time) bool {
+	h, ok := proto.ParseRTP(data)
+	if !ok {
+		return false
+	}
+	c, ok := d.media[m.DstAddr]
+	if !ok {
+		if c, ok = d.media[m.SrcAddr]; !ok {
+			return false
+		}
+	}
+	if d.Summary == nil {
+		return true
+	}
+	c.seen = now
+	s, ok := c.streams[h.SSRC]
+	if !ok {
+		s = &RTPStream{SSRC: h.SSRC, Src: m.SrcAddr, Dst: m.DstAddr, PayloadType: h.PayloadType, First: m.Start}
+		s.firstSeq, s.lastSeq = uint32(h.Seq), uint32(h.Seq)
+		c.streams[h.SSRC] = s
+	}
+	// the sequence numbers are extended by the cycles of the last one, reordered packets are only counted
+	seq := s.lastSeq&^0xffff | uint32(h.Seq)
+	if seq+0x8000 < s.lastSeq {
+		seq += 0x10000
+	} else if seq > s.lastSeq+0x8000 && seq >= 0x10000 {
+		seq -= 0x10000
+	}
+	if seq > s.lastSeq {
+		s.lastSeq = seq
+	}
+	s.Packets++
+	s.Bytes += len(data) - 12
+	s.Last = m.End
+	if expected := int(s.lastSeq-s.firstSeq) + 1; expected > s.Packets {
+		s.Lost = expected - s.Packets
+	} else {
+		s.Lost = 0
+	}
+	return true
+}
+
+// end forgets the media of the call, and passes its streams to Summary
+func (d *SIPDemuxer) end(c *sipCall) {
+	c.ended = true
+	for _, addr := range c.media {
+		if d.media[addr] == c {
+			delete(d.media, addr)
+		}
+	}
+	if d.Summary == nil {
+		return
+	}
+	streams := make([]RTPStream, 0, len(c.streams))
+	for _, s := range c.streams {
+		streams = append(streams, *s)
+	}
+	sort.Slice(streams, func(i, j int) bool { return streams[i].First.Before(streams[j].First) })
+	d.Summary(c.id, streams)
+}
+
+// purge ends and forgets the calls without messages for longer than sipExpire
+func (d *SIPDemuxer) purge(now time.Time) {
+	d.lastPurge = now
+	for id, c := range d.calls {
+		if now.Sub(c.seen) > sipExpire {
+			if !c.ended {
+				d.end(c)
+			}
+			delete(d.calls, id)
+		}
+	}
+}
+
+func (d *SIPDemuxer) say(level int, args ...interface{}) {
+	if d.debug != nil {
+		d.debug(level, args...)
+	}
+}
@@ -0,0 +1,75 @@
+package tcp
+
+import (
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// streamExpire is how long the state of a stream without data is kept
+const streamExpire = 10 * time.Minute
+
+// Streams feeds a MessagePool with the data of connections captured above tcp, e.g: the plaintext of TLS
+// connections read and written by processes. the first data of a connection is sent by its client, the pool
+// sees the handshake of the connection before it.
+type Streams struct {
+	sync.Mutex
+	pool      *MessagePool
+	streams   map[string]*stream
+	lastPurge time.Time
+}
+
+type stream struct {
+	client, server string
+	next           [2]uint32 // sequence of the next byte sent by the client and the server
+	seen           time.Time
+}
+
+// NewStreams returns Streams feeding pool
+func NewStreams(pool *MessagePool) *Streams {
+	return &Streams{pool: pool, streams: make(map[string]*stream)}
+}
+
+// Data handles data sent from src to dst on the connection id, lost is the length of the data sent after it
+// that was not captured. a connection whose addresses change is a new connection.
+func (s *Streams) Data(id, src, dst string, ipVersion byte, data []byte, lost int, timestamp time.Time) {
+	now := time.Now()
+	s.Lock()
+	defer s.Unlock()
+	if now.Sub(s.lastPurge) > streamExpire/10 {
+		s.purge(now)
+	}
+	st, ok := s.streams[id]
+	if ok && !(st.client == src && st.server == dst) && !(st.client == dst && st.server == src) {
+		ok = false
+	}
+	if !ok {
+		if len(data) == 0 {
+			return
+		}
+		st = &stream{client: src, server: dst, next: [2]uint32{1, 1}}
+		s.streams[id] = st
+		s.pool.handle(&Packet{Version: ipVersion, TCP: &layers.TCP{SYN: true}, Timestamp: timestamp, src: src, dst: dst})
+		s.pool.handle(&Packet{Version: ipVersion, TCP: &layers.TCP{SYN: true, ACK: true}, Timestamp: timestamp, src: dst, dst: src})
+	}
+	st.seen = now
+	i := 0
+	if src != st.client {
+		i = 1
+	}
+	if len(data) > 0 {
+		s.pool.handle(&Packet{Version: ipVersion, TCP: &layers.TCP{BaseLayer: layers.BaseLayer{Payload: data}, Seq: st.next[i], ACK: true}, Timestamp: timestamp, src: src, dst: dst})
+	}
+	// the pool sees the lost data as a gap in the sequence
+	st.next[i] += uint32(len(data) + lost)
+}
+
+func (s *Streams) purge(now time.Time) {
+	s.lastPurge = now
+	for id, st := range s.streams {
+		if now.Sub(st.seen) > streamExpire {
+			delete(s.streams, id)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package tcp
+
+import "sync"
+
+// chunk sizes are powers of 2, from minChunk to maxChunk
+const (
+	minChunk = 4 << 10
+	maxChunk = 4 << 20
+)
+
+// chunks holds a pool of buffers per chunk size, 4kb, 8kb, ..., 4mb
+var chunks [11]sync.Pool
+
+// chunkClass returns the index of the smallest chunk size that can hold n bytes
+func chunkClass(n int) (class int) {
+	for size := minChunk; size < n; size <<= 1 {
+		class++
+	}
+	return
+}
+
+// getChunk returns an empty buffer that can hold at least n bytes, the buffer
+// can be given back with putChunk when it's no longer used.
+func getChunk(n int) []byte {
+	if n > maxChunk {
+		return make([]byte, 0, n)
+	}
+	class := chunkClass(n)
+	if b, ok := chunks[class].Get().(*[]byte); ok {
+		return (*b)[:0]
+	}
+	return make([]byte, 0, minChunk<<class)
+}
+
+// putChunk gives back a buffer returned by getChunk, buffers with a size
+// different from the chunk sizes are left to the garbage collector.
+func putChunk(b []byte) {
+	if cap(b) < minChunk || cap(b) > maxChunk {
+		return
+	}
+	class := chunkClass(cap(b))
+	if cap(b) != minChunk<<class {
+		return
+	}
+	b = b[:0]
+	chunks[class].Put(&b)
+}
@@ -0,0 +1,309 @@
+package tcp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Tunnels is a set of encapsulations peeled off packets to reach the tcp segments they carry
+type Tunnels uint8
+
+// Available tunnels
+const (
+	TunnelVXLAN  Tunnels = 1 << iota // ethernet in udp port 4789
+	TunnelGRE                        // ethernet or ip in gre
+	TunnelGeneve                     // ethernet or ip in udp port 6081
+	TunnelIPIP                       // IPv4 or IPv6 in IPv4 or IPv6
+	TunnelERSPAN                     // switch mirrors, ERSPAN type I, II and III over gre
+	TunnelGTP                        // ip in GTP-U, udp port 2152
+)
+
+var tunnelNames = []struct {
+	tunnel Tunnels
+	name   string
+}{
+	{TunnelVXLAN, "vxlan"},
+	{TunnelGRE, "gre"},
+	{TunnelGeneve, "geneve"},
+	{TunnelIPIP, "ipip"},
+	{TunnelERSPAN, "erspan"},
+	{TunnelGTP, "gtp"},
+}
+
+// Set is here so that Tunnels can implement flag.Var, it can be called several times
+// and with comma separated names
+func (tunnels *Tunnels) Set(v string) error {
+next:
+	for _, name := range strings.Split(v, ",") {
+		name = strings.TrimSpace(name)
+		for _, t := range tunnelNames {
+			if t.name == name {
+				*tunnels |= t.tunnel
+				continue next
+			}
+		}
+		return fmt.Errorf("invalid tunnel %q", name)
+	}
+	return nil
+}
+
+func (tunnels *Tunnels) String() string {
+	return strings.Join(tunnels.Names(), ",")
+}
+
+// Names returns the names of the tunnels of the set
+func (tunnels Tunnels) Names() (names []string) {
+	for _, t := range tunnelNames {
+		if tunnels&t.tunnel != 0 {
+			names = append(names, t.name)
+		}
+	}
+	return
+}
+
+// TunnelIDs is a list of tunnel identifiers, the VNI of VXLAN and Geneve tunnels, the key of GRE tunnels,
+// the session ID of ERSPAN mirrors and the TEID of GTP-U tunnels
+type TunnelIDs []uint32
+
+// Set is here so that TunnelIDs can implement flag.Var, it can be called several times
+// and with comma separated identifiers
+func (ids *TunnelIDs) Set(v string) error {
+	for _, id := range strings.Split(v, ",") {
+		n, err := strconv.ParseUint(strings.TrimSpace(id), 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid tunnel id %q", id)
+		}
+		*ids = append(*ids, uint32(n))
+	}
+	return nil
+}
+
+func (ids *TunnelIDs) String() string {
+	s := make([]string, len(*ids))
+	for i, id := range *ids {
+		s[i] = strconv.FormatUint(uint64(id), 10)
+	}
+	return strings.Join(s, ",")
+}
+
+// Match reports whether id is in the list
+func (ids TunnelIDs) Match(id uint32) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+// decap returns the packet carried by the tunnels of packet, starting at its innermost network layer.
+// packets without tunnels are returned as is, and packets going through a tunnel that is not enabled,
+// or whose id is not one of pool.TunnelIDs, are discarded(nil).
+func (pool *MessagePool) decap(packet gopacket.Packet) (inner gopacket.Packet, tunneled bool) {
+	var network, prev gopacket.Layer
+layers:
+	for _, l := range packet.Layers() {
+		var tunnel Tunnels
+		var id uint32
+		var hasID bool
+		switch l := l.(type) {
+		case *layers.VXLAN:
+			tunnel, id, hasID = TunnelVXLAN, l.VNI, true
+		case *layers.Geneve:
+			tunnel, id, hasID = TunnelGeneve, l.VNI, true
+		case *layers.GRE:
+			if l.Protocol == ethernetTypeERSPAN || l.Protocol == ethernetTypeERSPAN3 {
+				return pool.erspan(packet, l)
+			}
+			tunnel, id, hasID = TunnelGRE, l.Key, l.KeyPresent
+		case *layers.GTPv1U:
+			// only the G-PDUs carry user packets, the rest is signalling like echo requests
+			if l.MessageType != gtpMessageGPDU {
+				return nil, true
+			}
+			tunnel, id, hasID = TunnelGTP, l.TEID, true
+		case *layers.IPv4, *layers.IPv6:
+			if _, ok := prev.(gopacket.NetworkLayer); ok {
+				tunnel = TunnelIPIP
+			}
+			network = l
+		case *layers.TCP:
+			break layers
+		}
+		prev = l
+		if tunnel == 0 {
+			continue
+		}
+		if pool.Tunnels&tunnel == 0 {
+			return nil, true
+		}
+		// ip in ip tunnels have no id
+		if tunnel != TunnelIPIP && len(pool.TunnelIDs) > 0 && (!hasID || !pool.TunnelIDs.Match(id)) {
+			return nil, true
+		}
+		tunneled = true
+	}
+	if !tunneled || network == nil {
+		return packet, tunneled
+	}
+	// the payload follows the header in the buffer of the packet
+	data := network.LayerContents()
+	if n := len(data) + len(network.LayerPayload()); n <= cap(data) {
+		data = data[:n]
+	} else {
+		data = append(append([]byte(nil), data...), network.LayerPayload()...)
+	}
+	inner = gopacket.NewPacket(data, network.LayerType(), gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+	ci := packet.Metadata().CaptureInfo
+	ci.CaptureLength, ci.Length = len(data), len(data)
+	inner.Metadata().CaptureInfo = ci
+	return inner, true
+}
+
+// gtpMessageGPDU is the GTP-U message type of encapsulated user packets
+const gtpMessageGPDU = 255
+
+// GRE protocols of ERSPAN, type I and II share the same protocol
+const (
+	ethernetTypeERSPAN  layers.EthernetType = 0x88be
+	ethernetTypeERSPAN3 layers.EthernetType = 0x22eb
+)
+
+// erspan returns the packet mirrored by a switch through the ERSPAN session carried by gre, decapsulated
+// from the tunnels it may go through. when pool.TunnelTimestamps is set, the timestamp of type III headers
+// replaces the time the packet was captured.
+func (pool *MessagePool) erspan(packet gopacket.Packet, gre *layers.GRE) (gopacket.Packet, bool) {
+	if pool.Tunnels&TunnelERSPAN == 0 {
+		return nil, true
+	}
+	data := gre.LayerPayload()
+	ci := packet.Metadata().CaptureInfo
+	first := layers.LayerTypeEthernet
+	var session uint16
+	var hasID bool
+	switch {
+	case gre.Protocol == ethernetTypeERSPAN && !gre.SeqPresent:
+		// type I has no header
+	case gre.Protocol == ethernetTypeERSPAN:
+		if len(data) < 8 || data[0]>>4 != 1 {
+			return nil, true
+		}
+		session, hasID = binary.BigEndian.Uint16(data[2:4])&0x3ff, true
+		data = data[8:]
+	default:
+		if len(data) < 12 || data[0]>>4 != 2 {
+			return nil, true
+		}
+		session, hasID = binary.BigEndian.Uint16(data[2:4])&0x3ff, true
+		if pool.TunnelTimestamps {
+			ci.Timestamp = erspanTime(binary.BigEndian.Uint32(data[4:8]), (data[11]>>1)&3, ci.Timestamp)
+		}
+		// frame type 2 is an IP packet without its ethernet header
+		if (data[10]>>2)&0x1f == 2 {
+			first = layers.LayerTypeIPv4
+		}
+		n := 12
+		if data[11]&1 != 0 {
+			n += 8 // platform specific subheader
+		}
+		if len(data) < n {
+			return nil, true
+		}
+		data = data[n:]
+	}
+	if len(pool.TunnelIDs) > 0 && (!hasID || !pool.TunnelIDs.Match(uint32(session))) {
+		return nil, true
+	}
+	if first == layers.LayerTypeIPv4 && len(data) > 0 && data[0]>>4 == 6 {
+		first = layers.LayerTypeIPv6
+	}
+	mirrored := gopacket.NewPacket(data, first, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+	ci.CaptureLength, ci.Length = len(data), len(data)
+	mirrored.Metadata().CaptureInfo = ci
+	inner, _ := pool.decap(mirrored)
+	return inner, true
+}
+
+// erspanTime returns the time of the 32 bits timestamp of an ERSPAN type III header closest to now,
+// the granularity is 100 microseconds(0), 100 nanoseconds(1) or the nanoseconds of IEEE 1588(2).
+// user defined granularities(3) are not supported and now is returned.
+func erspanTime(ts uint32, granularity uint8, now time.Time) time.Time {
+	var unit, period int64
+	switch granularity {
+	case 0:
+		unit, period = int64(100*time.Microsecond), int64(100*time.Microsecond)<<32
+	case 1:
+		unit, period = 100, 100<<32
+	case 2:
+		unit, period = 1, int64(time.Second)
+	default:
+		return now
+	}
+	n := now.UnixNano()
+	t := n - n%period + int64(ts)*unit
+	if t-n > period/2 {
+		t -= period
+	} else if n-t > period/2 {
+		t += period
+	}
+	return time.Unix(0, t)
+}
+
+// VLANs is a list of 802.1Q VLAN identifiers, 0 stands for untagged packets
+type VLANs []uint16
+
+// Set is here so that VLANs can implement flag.Var, it can be called several times
+// and with comma separated identifiers
+func (vlans *VLANs) Set(v string) error {
+	for _, id := range strings.Split(v, ",") {
+		n, err := strconv.ParseUint(strings.TrimSpace(id), 10, 12)
+		if err != nil {
+			return fmt.Errorf("invalid vlan id %q", id)
+		}
+		*vlans = append(*vlans, uint16(n))
+	}
+	return nil
+}
+
+func (vlans *VLANs) String() string {
+	ids := make([]string, len(*vlans))
+	for i, id := range *vlans {
+		ids[i] = strconv.Itoa(int(id))
+	}
+	return strings.Join(ids, ",")
+}
+
+// Match reports whether one of the tags is in the list, tags is empty for untagged packets
+func (vlans VLANs) Match(tags []uint16) bool {
+	if len(tags) == 0 {
+		tags = []uint16{0}
+	}
+	for _, id := range vlans {
+		for _, tag := range tags {
+			if id == tag {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// vlanTags returns the identifiers of the 802.1Q tags(two with QinQ) of the packet, outermost first
+func vlanTags(packet gopacket.Packet) (tags []uint16) {
+	eth, ok := packet.LinkLayer().(*layers.Ethernet)
+	if !ok || eth.EthernetType != layers.EthernetTypeDot1Q && eth.EthernetType != layers.EthernetTypeQinQ {
+		return
+	}
+	for _, l := range packet.Layers() {
+		if tag, ok := l.(*layers.Dot1Q); ok {
+			tags = append(tags, tag.VLANIdentifier)
+		}
+	}
+	return
+}
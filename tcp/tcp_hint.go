@@ -0,0 +1,158 @@
+package tcp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/buger/goreplay/proto"
+)
+
+// Hints are the hints describing where the messages of a protocol start and end,
+// a nil hint keeps the default behaviour of the pool for it.
+type Hints struct {
+	Start HintStart
+	End   HintEnd
+	Split HintSplit
+}
+
+var hints = struct {
+	sync.RWMutex
+	named map[string]Hints
+}{named: map[string]Hints{
+	"binary":          {},
+	"http":            {Start: HTTPStart, End: HTTPEnd, Split: HTTPSplit},
+	"http-request":    {Start: HTTPRequestStart, End: HTTPEnd, Split: HTTPSplit},
+	"http-response":   {Start: HTTPResponseStart, End: HTTPEnd, Split: HTTPSplit},
+	"http-lenient":    {Start: HTTPLenientStart, End: HTTPLenientEnd, Split: HTTPLenientSplit},
+	"http2":           {Split: HTTP2Split},
+	"grpc":            {Split: HTTP2Split},
+	"websocket":       {Start: HTTPStart, End: HTTPEnd, Split: HTTPSplit},
+	"mysql":           {Split: MySQLSplit},
+	"postgres":        {Split: PostgresSplit},
+	"redis":           {Split: RedisSplit},
+	"mongo":           {Split: MongoSplit},
+	"thrift":          {Split: ThriftSplit},
+	"mqtt":            {Split: MQTTSplit},
+	"amqp":            {Split: AMQPSplit},
+	"dns":             {Split: DNSSplit},
+	"sip":             {Split: SIPSplit, Start: SIPStart},
+	"kafka":           {Split: KafkaSplit},
+	"length-prefixed": {Split: LengthPrefixedSplit(4)},
+}}
+
+// RegisterHints makes the hints of a protocol available by name,
+// hints registered with the name of existing hints replace them.
+func RegisterHints(name string, h Hints) {
+	hints.Lock()
+	hints.named[name] = h
+	hints.Unlock()
+}
+
+// LookupHints returns the hints registered with name
+func LookupHints(name string) (h Hints, ok bool) {
+	hints.RLock()
+	h, ok = hints.named[name]
+	hints.RUnlock()
+	return
+}
+
+// HintsNames returns the sorted names of the registered hints
+func HintsNames() (names []string) {
+	hints.RLock()
+	for name := range hints.named {
+		names = append(names, name)
+	}
+	hints.RUnlock()
+	sort.Strings(names)
+	return
+}
+
+// SetHints sets the Start, End and Split hints of the pool to the hints registered with name
+func (pool *MessagePool) SetHints(name string) error {
+	h, ok := LookupHints(name)
+	if !ok {
+		return fmt.Errorf("unknown hints %q, available hints are %v", name, HintsNames())
+	}
+	pool.Start, pool.End, pool.Split = h.Start, h.End, h.Split
+	return nil
+}
+
+// HTTPStart is a HintStart for HTTP/1.x, messages start with a request or a status line
+func HTTPStart(pckt *Packet) (isIncoming, isOutgoing bool) {
+	return proto.HasRequestTitle(pckt.Payload), proto.HasResponseTitle(pckt.Payload)
+}
+
+// HTTPRequestStart is a HintStart for HTTP/1.x requests only
+func HTTPRequestStart(pckt *Packet) (isIncoming, isOutgoing bool) {
+	return proto.HasRequestTitle(pckt.Payload), false
+}
+
+// HTTPResponseStart is a HintStart for HTTP/1.x responses only
+func HTTPResponseStart(pckt *Packet) (isIncoming, isOutgoing bool) {
+	return false, proto.HasResponseTitle(pckt.Payload)
+}
+
+// HTTPEnd is a HintEnd for HTTP/1.x, the message ends once the Content-Length
+// or the terminating chunk of the chunked transfer encoding is received, the
+// close-delimited bodies of HTTP/1.0 or Connection: close responses end with the FIN.
+func HTTPEnd(m *Message) bool {
+	return proto.MessageLength(m.Data()) == m.Length
+}
+
+// HTTPSplit is a HintSplit for HTTP/1.x, the end of a message is found using the
+// Content-Length header or the terminating chunk of the chunked transfer encoding.
+// it splits keep-alive connections into a message per request or response.
+func HTTPSplit(m *Message) int {
+	return proto.MessageLength(m.Data())
+}
+
+// HTTPLenientStart is HTTPStart for the start lines ending with a bare LF
+func HTTPLenientStart(pckt *Packet) (isIncoming, isOutgoing bool) {
+	return proto.LenientTitle(pckt.Payload)
+}
+
+// HTTPLenientEnd is HTTPEnd with proto.LenientMessageLength
+func HTTPLenientEnd(m *Message) bool {
+	n, _ := proto.LenientMessageLength(m.Data())
+	return n == m.Length
+}
+
+// HTTPLenientSplit is HTTPSplit with proto.LenientMessageLength, the malformed messages are split where they
+// are salvaged instead of being held until they time out
+func HTTPLenientSplit(m *Message) int {
+	n, _ := proto.LenientMessageLength(m.Data())
+	return n
+}
+
+// LengthPrefixedSplit returns a HintSplit for binary protocols whose messages start
+// with their length, excluding the prefix, as a big endian integer of size bytes(1, 2, 4 or 8).
+func LengthPrefixedSplit(size int) HintSplit {
+	switch size {
+	case 1, 2, 4, 8:
+	default:
+		panic(fmt.Sprintf("invalid length prefix size %d", size))
+	}
+	return func(m *Message) int {
+		data := m.Data()
+		if len(data) < size {
+			return -1
+		}
+		var n uint64
+		switch size {
+		case 1:
+			n = uint64(data[0])
+		case 2:
+			n = uint64(binary.BigEndian.Uint16(data))
+		case 4:
+			n = uint64(binary.BigEndian.Uint32(data))
+		case 8:
+			n = binary.BigEndian.Uint64(data)
+		}
+		if n > uint64(len(data)-size) {
+			return -1
+		}
+		return size + int(n)
+	}
+}
@@ -0,0 +1,92 @@
+package tcp
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// LimitPolicy tells the pool what to do with a message when the maximum size of a
+// message or the maximum size of all the messages in progress is reached
+type LimitPolicy uint8
+
+// Available limit policies
+const (
+	LimitTruncate     LimitPolicy = iota // the message is truncated and dispatched
+	LimitDrop                            // the message is discarded
+	LimitBackpressure                    // packets wait for the pool to have room, messages are truncated when the wait expires
+)
+
+// Set is here so that LimitPolicy can implement flag.Var
+func (policy *LimitPolicy) Set(v string) error {
+	switch v {
+	case "", "truncate":
+		*policy = LimitTruncate
+	case "drop":
+		*policy = LimitDrop
+	case "backpressure":
+		*policy = LimitBackpressure
+	default:
+		return fmt.Errorf("invalid limit policy %s", v)
+	}
+	return nil
+}
+
+func (policy *LimitPolicy) String() string {
+	switch *policy {
+	case LimitTruncate:
+		return "truncate"
+	case LimitDrop:
+		return "drop"
+	case LimitBackpressure:
+		return "backpressure"
+	default:
+		return ""
+	}
+}
+
+// LimitStats counts how many times the limits of a pool have been reached
+type LimitStats struct {
+	Truncated uint64 // messages truncated
+	Dropped   uint64 // messages discarded
+	Blocked   uint64 // packets that had to wait for the pool to have room
+}
+
+// LimitStats returns the counters of the limits reached by the pool so far
+func (pool *MessagePool) LimitStats() LimitStats {
+	return LimitStats{
+		Truncated: atomic.LoadUint64(&pool.limits.Truncated),
+		Dropped:   atomic.LoadUint64(&pool.limits.Dropped),
+		Blocked:   atomic.LoadUint64(&pool.limits.Blocked),
+	}
+}
+
+// overflow returns by how many bytes adding n bytes to m exceeds the limits of the pool
+func (pool *MessagePool) overflow(m *Message, n int) int {
+	over := m.Length + n - int(pool.maxSize)
+	if pool.MaxTotalSize > 0 {
+		if total := int(atomic.LoadInt64(&pool.size)) + n - int(pool.MaxTotalSize); total > over {
+			over = total
+		}
+	}
+	return over
+}
+
+// wait blocks while adding n bytes would exceed MaxTotalSize, for at most twice messageExpire,
+// by then all the messages in progress when it was called have timed out.
+// it must not be called while holding the lock of a shard.
+func (pool *MessagePool) wait(n int) {
+	max := int64(pool.MaxTotalSize) - int64(n)
+	if atomic.LoadInt64(&pool.size) <= max {
+		return
+	}
+	atomic.AddUint64(&pool.limits.Blocked, 1)
+	deadline := time.Now().Add(2 * pool.messageExpire)
+	for atomic.LoadInt64(&pool.size) > max && time.Now().Before(deadline) {
+		select {
+		case <-pool.quit:
+			return
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
@@ -1,11 +1,14 @@
 package tcp
 
 import (
+	"bytes"
 	"crypto/sha1"
+	"encoding/binary"
 	"encoding/hex"
 	"fmt"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/buger/goreplay/size"
@@ -29,8 +32,13 @@ type Stats struct {
 // Message is the representation of a tcp message
 type Message struct {
 	packets []*Packet
-	done    chan bool
 	data    []byte
+	copied  int       // number of packets whose payload has been copied to data
+	dirty   bool      // data has to be rebuilt from the packets
+	expire  time.Time // wall clock time after which the message is timed out by the pool
+	created time.Time // wall clock time of the creation of the message
+	seen    time.Time // wall clock time of the last packet added to the message
+	conn    *connection
 	Stats
 }
 
@@ -40,12 +48,18 @@ func NewMessage(srcAddr, dstAddr string, ipVersion uint8) (m *Message) {
 	m.DstAddr = dstAddr
 	m.SrcAddr = srcAddr
 	m.IPversion = ipVersion
-	m.done = make(chan bool)
 	return
 }
 
-// UUID the unique id of a TCP session it is not granted to be unique overtime
+// UUID the unique id of a TCP session it is not granted to be unique overtime,
+// unless the pool is in UUIDConnection mode and the SYN of the connection was captured
 func (m *Message) UUID() []byte {
+	if m.conn != nil && m.conn.key != "" {
+		sha := sha1.Sum([]byte(m.conn.key))
+		uuid := make([]byte, 40)
+		hex.Encode(uuid, sha[:])
+		return uuid
+	}
 	var src, dst string
 	if m.IsIncoming {
 		src = m.SrcAddr
@@ -56,9 +70,16 @@ func (m *Message) UUID() []byte {
 	}
 
 	length := len(src) + len(dst)
+	if m.conn != nil {
+		length += 12
+	}
 	uuid := make([]byte, length)
 	copy(uuid, src)
 	copy(uuid[len(src):], dst)
+	if m.conn != nil {
+		binary.BigEndian.PutUint64(uuid[length-12:], uint64(m.conn.syn.UnixNano()))
+		binary.BigEndian.PutUint32(uuid[length-4:], m.conn.isn)
+	}
 	sha := sha1.Sum(uuid)
 	uuid = make([]byte, 40)
 	hex.Encode(uuid, sha[:])
@@ -66,12 +87,177 @@ func (m *Message) UUID() []byte {
 	return uuid
 }
 
-func (m *Message) add(pckt *Packet) {
+// segment returns the position of the packet in the message by sequence number, data
+// overlapping the data already received are resolved following the policy. packets are
+// mostly received in order so the position is searched from the tail.
+// ok is false if the packet holds no new data, e.g: retransmission of data already received.
+// conflict is true if policy is OverlapDropMessage and the overlapping data are different.
+func (m *Message) segment(pckt *Packet, policy OverlapPolicy) (i int, ok, conflict bool) {
+	i = len(m.packets)
+	for i > 0 && seqLess(pckt.Seq, m.packets[i-1].Seq) {
+		i--
+	}
+	if len(pckt.Payload) == 0 {
+		// a retransmitted SYN holds nothing new
+		return i, !pckt.SYN || i == 0 || !m.packets[i-1].SYN || m.packets[i-1].Seq != pckt.Seq, false
+	}
+	if policy == OverlapLastWins {
+		return i, m.overwrite(i, pckt), false
+	}
+	// trim the head covered by the previous packet
+	for j := i - 1; j >= 0; j-- {
+		prev := m.packets[j]
+		if len(prev.Payload) == 0 {
+			continue
+		}
+		end := prev.Seq + uint32(len(prev.Payload))
+		if !seqLess(pckt.Seq, end) {
+			break
+		}
+		n := int(end - pckt.Seq)
+		if n > len(pckt.Payload) {
+			n = len(pckt.Payload)
+		}
+		conflict = !bytes.Equal(pckt.Payload[:n], prev.Payload[pckt.Seq-prev.Seq:][:n])
+		pckt.Payload = pckt.Payload[n:]
+		pckt.Seq += uint32(n)
+		break
+	}
+	// trim the tail covered by the next packet, if the payload spans over
+	// the next packet the rest of it is expected to be retransmitted
+	for j := i; j < len(m.packets) && len(pckt.Payload) > 0; j++ {
+		next := m.packets[j]
+		if len(next.Payload) == 0 {
+			continue
+		}
+		if seqLess(next.Seq, pckt.Seq+uint32(len(pckt.Payload))) {
+			k := int(next.Seq - pckt.Seq)
+			n := len(pckt.Payload) - k
+			if n > len(next.Payload) {
+				n = len(next.Payload)
+			}
+			conflict = conflict || !bytes.Equal(pckt.Payload[k:k+n], next.Payload[:n])
+			pckt.Payload = pckt.Payload[:k]
+		}
+		break
+	}
+	return i, len(pckt.Payload) > 0, conflict && policy == OverlapDropMessage
+}
+
+// overwrite trims the data of the message overlapped by the packet to be inserted at position i,
+// it returns false if the packet has been copied over a previous packet instead.
+func (m *Message) overwrite(i int, pckt *Packet) bool {
+	end := pckt.Seq + uint32(len(pckt.Payload))
+	for j := i - 1; j >= 0; j-- {
+		prev := m.packets[j]
+		if len(prev.Payload) == 0 {
+			continue
+		}
+		prevEnd := prev.Seq + uint32(len(prev.Payload))
+		if !seqLess(pckt.Seq, prevEnd) {
+			break
+		}
+		m.dirty = true
+		if seqLess(end, prevEnd) {
+			// the packet is within the previous packet
+			payload := append([]byte(nil), prev.Payload...)
+			copy(payload[pckt.Seq-prev.Seq:], pckt.Payload)
+			prev.Payload = payload
+			return false
+		}
+		m.Length -= int(prevEnd - pckt.Seq)
+		prev.Payload = prev.Payload[:pckt.Seq-prev.Seq]
+		break
+	}
+	for j := i; j < len(m.packets); j++ {
+		next := m.packets[j]
+		if len(next.Payload) == 0 {
+			continue
+		}
+		if !seqLess(next.Seq, end) {
+			break
+		}
+		m.dirty = true
+		n := int(end - next.Seq)
+		if n >= len(next.Payload) {
+			m.Length -= len(next.Payload)
+			next.Payload = nil
+			continue
+		}
+		m.Length -= n
+		next.Payload = next.Payload[n:]
+		next.Seq = end
+		break
+	}
+	return true
+}
+
+// handshake reports whether the SYN packet belongs to the connection of the message,
+// i.e. it is a retransmission of the SYN of the message or it was received after the first data.
+func (m *Message) handshake(pckt *Packet) bool {
+	if len(m.packets) == 0 {
+		return true
+	}
+	first := m.packets[0]
+	if first.SYN {
+		return first.Seq == pckt.Seq
+	}
+	return pckt.Seq+1 == first.Seq
+}
+
+// add inserts the packet at position i, see Message.segment
+// the payload is not copied, data are built on demand by Message.Data
+func (m *Message) add(i int, pckt *Packet) {
 	m.Length += len(pckt.Payload)
 	m.LostData += int(pckt.Lost)
-	m.packets = append(m.packets, pckt)
-	m.data = append(m.data, pckt.Payload...)
 	m.End = pckt.Timestamp
+	m.packets = append(m.packets, nil)
+	copy(m.packets[i+1:], m.packets[i:])
+	m.packets[i] = pckt
+	if i < m.copied {
+		// out of order packet
+		m.dirty = true
+	}
+}
+
+// split cuts the message after n bytes of data, the data past n are moved to
+// the returned message, which is the next message of the same connection.
+func (m *Message) split(n int) (next *Message) {
+	m.Data()
+	next = NewMessage(m.SrcAddr, m.DstAddr, m.IPversion)
+	next.IsIncoming = m.IsIncoming
+	next.conn = m.conn
+	var pos int
+	for i, pckt := range m.packets {
+		if pos+len(pckt.Payload) <= n {
+			pos += len(pckt.Payload)
+			continue
+		}
+		rest := m.packets[i:]
+		m.packets = m.packets[:i:i]
+		if k := n - pos; k > 0 {
+			// the packet holds the end of this message and the start of the next one
+			head := *pckt
+			tcp := *pckt.TCP
+			head.TCP = &tcp
+			head.Payload = pckt.Payload[:k:k]
+			pckt.Payload = pckt.Payload[k:]
+			pckt.Seq += uint32(k)
+			m.packets = append(m.packets, &head)
+		}
+		for _, pckt := range rest {
+			next.add(len(next.packets), pckt)
+		}
+		next.Start = rest[0].Timestamp
+		break
+	}
+	m.data = m.data[:n:n]
+	m.copied = len(m.packets)
+	m.Length = n
+	if len(m.packets) > 0 {
+		m.End = m.packets[len(m.packets)-1].Timestamp
+	}
+	return
 }
 
 // Packets returns packets of this message
@@ -79,14 +265,64 @@ func (m *Message) Packets() []*Packet {
 	return m.packets
 }
 
-// Data returns data in this message
+// Data returns data in this message, ordered by sequence number.
+// data are copied from the payloads of the packets on demand, into a buffer that
+// can be reused once the message has been handled, see Message.Release
 func (m *Message) Data() []byte {
+	if m.dirty {
+		m.data = m.data[:0]
+		m.copied = 0
+		m.dirty = false
+	}
+	if m.copied == len(m.packets) {
+		return m.data
+	}
+	if cap(m.data) < m.Length {
+		size := m.Length
+		if size < 2*cap(m.data) {
+			size = 2 * cap(m.data)
+		}
+		data := append(getChunk(size), m.data...)
+		putChunk(m.data)
+		m.data = data
+	}
+	for _, p := range m.packets[m.copied:] {
+		m.data = append(m.data, p.Payload...)
+	}
+	m.copied = len(m.packets)
 	return m.data
 }
 
-// Sort a helper to sort packets
+// Chunks returns the payloads of the packets of this message, ordered by sequence number.
+// unlike Data the payloads are not copied.
+func (m *Message) Chunks() [][]byte {
+	chunks := make([][]byte, 0, len(m.packets))
+	for _, p := range m.packets {
+		if len(p.Payload) > 0 {
+			chunks = append(chunks, p.Payload)
+		}
+	}
+	return chunks
+}
+
+// Release gives back the buffer holding the data of this message to be reused,
+// data previously returned by Message.Data must not be used after release.
+func (m *Message) Release() {
+	putChunk(m.data)
+	m.data = nil
+	m.copied = 0
+	m.dirty = false
+}
+
+// Sort a helper to sort packets, packets are already sorted when added by the pool
 func (m *Message) Sort() {
-	sort.SliceStable(m.packets, func(i, j int) bool { return m.packets[i].Seq < m.packets[j].Seq })
+	sort.SliceStable(m.packets, func(i, j int) bool { return seqLess(m.packets[i].Seq, m.packets[j].Seq) })
+}
+
+// seqLess reports whether sequence number a comes before b, taking into account
+// the wraparound of the 32 bits sequence space(RFC 1982)
+func seqLess(a, b uint32) bool {
+	return int32(a-b) < 0
 }
 
 // Handler message handler
@@ -100,22 +336,103 @@ type Debugger func(int, ...interface{})
 // when set, it will be executed before checking FIN or RST flag
 type HintEnd func(*Message) bool
 
+// OverlapPolicy tells the pool how to resolve segments overlapping data already received
+type OverlapPolicy uint8
+
+// Available overlap policies
+const (
+	OverlapFirstWins   OverlapPolicy = iota // data already received are kept
+	OverlapLastWins                         // data of the last segment replace the data already received
+	OverlapDropMessage                      // the message is discarded if the overlapping data are different
+)
+
+// Set is here so that OverlapPolicy can implement flag.Var
+func (policy *OverlapPolicy) Set(v string) error {
+	switch v {
+	case "", "first-wins":
+		*policy = OverlapFirstWins
+	case "last-wins":
+		*policy = OverlapLastWins
+	case "drop-message":
+		*policy = OverlapDropMessage
+	default:
+		return fmt.Errorf("invalid overlap policy %s", v)
+	}
+	return nil
+}
+
+func (policy *OverlapPolicy) String() string {
+	switch *policy {
+	case OverlapFirstWins:
+		return "first-wins"
+	case OverlapLastWins:
+		return "last-wins"
+	case OverlapDropMessage:
+		return "drop-message"
+	default:
+		return ""
+	}
+}
+
+// HintSplit hints the pool where the first message held by the session ends, it returns
+// the length of the message or -1 if the message is not complete yet. the data past that length
+// start the next message of the same session, see MessagePool.Split and HTTPSplit.
+// when set, it will be executed before HintEnd
+type HintSplit func(*Message) int
+
 // HintStart hints the pool to start the reassembling the message, see MessagePool.Start
 // when set, it will be used instead of checking SYN flag
 type HintStart func(*Packet) (IsIncoming, IsOutgoing bool)
 
+// shards is the number of independent parts of a MessagePool
+const shards = 64
+
+// shard holds part of the messages of a pool, all the messages of a connection
+// are held by the same shard.
+type shard struct {
+	sync.Mutex
+	pool   map[string]*Message
+	conns  map[string]*connection // connections by client=server, in UUIDConnection mode
+	closed bool
+	ready  []*Message // messages dispatched while holding the lock, passed to the handler by unlock
+	// handling keeps the messages of the shard passed to the handler in order, without holding the lock
+	handling sync.Mutex
+}
+
 // MessagePool holds data of all tcp messages in progress(still receiving/sending packets).
 // Incoming message is identified by its source port and address e.g: 127.0.0.1:45785.
 // Outgoing message is identified by  server.addr and dst.addr e.g: localhost:80=internet:45785.
+// messages are spread over shards by connection, so that packets of different connections
+// can be handled in parallel.
 type MessagePool struct {
-	sync.Mutex
-	debug         Debugger
-	maxSize       size.Size // maximum message size, default 5mb
-	pool          map[string]*Message
-	handler       Handler
-	messageExpire time.Duration // the maximum time to wait for the final packet, minimum is 100ms
-	End           HintEnd
-	Start         HintStart
+	size             int64 // size of all the messages in progress, it's first for the alignment of atomic operations
+	limits           LimitStats
+	debug            Debugger
+	maxSize          size.Size // maximum message size, default 5mb
+	shards           [shards]shard
+	quit             chan bool
+	closeOnce        sync.Once
+	idleExpire       int64 // see SetIdleExpire
+	halfOpenExpire   int64
+	handler          Handler
+	messageExpire    time.Duration // the maximum time to wait for the final packet, minimum is 100ms
+	End              HintEnd
+	Split            HintSplit
+	Start            HintStart
+	Defragmenter     *Defragmenter // reassembles fragmented IP packets before parsing them, can be set to nil
+	Overlap          OverlapPolicy // how overlapping segments are resolved, default OverlapFirstWins
+	MaxTotalSize     size.Size     // maximum size of all the messages in progress, 0 means no limit
+	Limit            LimitPolicy   // what to do with messages exceeding maxSize or MaxTotalSize, default LimitTruncate
+	ValidateChecksum bool          // drop packets with an invalid IPv4 or TCP checksum
+	UUID             UUIDMode      // how the UUID of messages are computed, default UUIDAddress
+	MPTCP            bool          // reassemble the data of all the subflows of multipath tcp connections in a single message
+	VLANs            VLANs         // when not empty, only the packets of these vlans are handled
+	Tunnels          Tunnels       // encapsulations peeled off packets, packets of other tunnels are discarded
+	TunnelIDs        TunnelIDs     // when not empty, only the tunnels with these ids are peeled off
+	TunnelPort       uint16        // when not 0, only the decapsulated, reassembled and IPv6 packets with extension headers from or to this port are handled
+	TunnelTimestamps bool          // time packets with the timestamps of ERSPAN type III headers
+	Sampling         Sampling      // fraction of the connections handled, the zero value handles all of them
+	subflows         *mptcp
 }
 
 // NewMessagePool returns a new instance of message pool
@@ -131,42 +448,140 @@ func NewMessagePool(maxSize size.Size, messageExpire time.Duration, debugger Deb
 	if pool.maxSize < 1 {
 		pool.maxSize = 5 << 20
 	}
-	pool.pool = make(map[string]*Message)
+	for i := range pool.shards {
+		pool.shards[i].pool = make(map[string]*Message)
+		pool.shards[i].conns = make(map[string]*connection)
+	}
+	pool.Defragmenter = NewDefragmenter(0, 0)
+	pool.subflows = newMPTCP()
+	pool.quit = make(chan bool)
+	go pool.sweep()
 	return pool
 }
 
+// shard returns the shard holding the messages of the connection between src and dst,
+// it is the same in both directions of the connection.
+func (pool *MessagePool) shard(src, dst string) *shard {
+	if dst < src {
+		src, dst = dst, src
+	}
+	// FNV-1a
+	h := uint32(2166136261)
+	for i := 0; i < len(src); i++ {
+		h ^= uint32(src[i])
+		h *= 16777619
+	}
+	for i := 0; i < len(dst); i++ {
+		h ^= uint32(dst[i])
+		h *= 16777619
+	}
+	return &pool.shards[h%shards]
+}
+
 // Handler returns packet handler
 func (pool *MessagePool) Handler(packet gopacket.Packet) {
-	var in, out bool
-	pckt, err := ParsePacket(packet)
+	captured := packet
+	if pool.Defragmenter != nil {
+		var err error
+		if packet, err = pool.Defragmenter.Defrag(packet); packet == nil {
+			if err != nil {
+				go pool.say(5, fmt.Sprintf("error defragmenting packet: %s\n", err))
+			}
+			return
+		}
+	}
+	inner, tunneled := packet, false
+	if pool.Tunnels != 0 {
+		if inner, tunneled = pool.decap(packet); inner == nil {
+			go pool.say(5, fmt.Sprintf("packet(%dBytes) of a filtered tunnel dropped\n", packet.Metadata().CaptureLength))
+			return
+		}
+	}
+	pckt, err := ParsePacket(inner)
 	if err != nil || pckt == nil {
 		go pool.say(4, fmt.Sprintf("error decoding packet(%dBytes):%s\n", packet.Metadata().CaptureLength, err))
 		return
 	}
-	pool.Lock()
-	defer pool.Unlock()
+	if tunneled {
+		pckt.VLAN = vlanTags(packet)
+	}
+	// the capture filter can't match the ports of these packets
+	if tunneled || packet != captured || pckt.ext > 0 {
+		if pool.TunnelPort != 0 && uint16(pckt.SrcPort) != pool.TunnelPort && uint16(pckt.DstPort) != pool.TunnelPort {
+			return
+		}
+	}
+	if len(pool.VLANs) > 0 && !pool.VLANs.Match(pckt.VLAN) {
+		go pool.say(5, fmt.Sprintf("packet from %s to %s of vlan %v dropped\n", pckt.Src(), pckt.Dst(), pckt.VLAN))
+		return
+	}
+	if !pool.Sampling.Match(pckt) {
+		return
+	}
+	if pool.ValidateChecksum && !pckt.ValidChecksum() {
+		go pool.say(5, fmt.Sprintf("invalid checksum, packet from %s to %s at %s dropped\n", pckt.Src(), pckt.Dst(), pckt.Timestamp))
+		return
+	}
+	if pckt.SYN && len(pckt.Payload) > 0 {
+		// TCP Fast Open, the data of the SYN are handled as the packet following it
+		data := pckt.fastOpen()
+		pool.handle(pckt)
+		pckt = data
+	}
+	pool.handle(pckt)
+}
+
+func (pool *MessagePool) handle(pckt *Packet) {
+	var in, out bool
+	if pool.MPTCP {
+		pool.subflows.subflow(pckt)
+	}
+	if pool.Limit == LimitBackpressure && pool.MaxTotalSize > 0 {
+		pool.wait(len(pckt.Payload))
+	}
 	srcKey := pckt.Src()
-	dstKey := srcKey + "=" + pckt.Dst()
-	m, ok := pool.pool[srcKey]
+	dst := pckt.Dst()
+	dstKey := srcKey + "=" + dst
+	s := pool.shard(srcKey, dst)
+	s.Lock()
+	defer pool.unlock(s)
+	if s.closed {
+		return
+	}
+	key := srcKey
+	m, ok := s.pool[key]
 	if !ok {
-		m, ok = pool.pool[dstKey]
+		key = dstKey
+		m, ok = s.pool[key]
 	}
 	if pckt.RST {
 		if ok {
-			<-m.done
+			pool.dispatch(s, key, m)
 		}
-		if m, ok = pool.pool[pckt.Dst()]; !ok {
-			m, ok = pool.pool[pckt.Dst()+"="+srcKey]
+		key = dst
+		if m, ok = s.pool[key]; !ok {
+			key = dst + "=" + srcKey
+			m, ok = s.pool[key]
 		}
 		if ok {
-			<-m.done
+			pool.dispatch(s, key, m)
 		}
+		delete(s.conns, dstKey)
+		delete(s.conns, dst+"="+srcKey)
 		go pool.say(4, fmt.Sprintf("RST flag from %s to %s at %s\n", pckt.Src(), pckt.Dst(), pckt.Timestamp))
 		return
 	}
+	if ok && pckt.SYN && !m.handshake(pckt) {
+		// the ports are reused by a new connection
+		pool.dispatch(s, key, m)
+		ok = false
+	}
+	if pool.UUID == UUIDConnection && pckt.SYN && !pckt.ACK {
+		pool.track(s, pckt)
+	}
 	switch {
 	case ok:
-		pool.addPacket(m, pckt)
+		pool.addPacket(s, key, m, pckt)
 		return
 	case pool.Start != nil:
 		if in, out = pool.Start(pckt); in || out {
@@ -175,41 +590,181 @@ func (pool *MessagePool) Handler(packet gopacket.Packet) {
 		return
 	case pckt.SYN:
 		in = !pckt.ACK
+		// on simultaneous open both peers send a SYN, the second one is taken as the answer
+		if peer, ok := s.pool[dst]; in && ok && peer.DstAddr == srcKey {
+			in = false
+		}
 	default:
-		return
+		// the direction of packets captured with linux cooked headers is known
+		var known bool
+		if in, known = pckt.Incoming(); !known || len(pckt.Payload) == 0 {
+			return
+		}
 	}
-	m = NewMessage(srcKey, pckt.Dst(), pckt.Version)
+	m = NewMessage(srcKey, dst, pckt.Version)
 	m.IsIncoming = in
-	key := srcKey
+	if pool.UUID == UUIDConnection {
+		m.conn = pool.connection(s, m)
+	}
+	key = srcKey
 	if !m.IsIncoming {
 		key = dstKey
 	}
-	pool.pool[key] = m
+	s.pool[key] = m
 	m.Start = pckt.Timestamp
-	go pool.dispatch(key, m)
-	pool.addPacket(m, pckt)
+	m.created = time.Now()
+	m.expire = m.created.Add(pool.messageExpire)
+	pool.addPacket(s, key, m, pckt)
+}
+
+// dispatch removes the message from the pool and queues it for the handler,
+// it must be called while holding the lock of the shard.
+func (pool *MessagePool) dispatch(s *shard, key string, m *Message) {
+	delete(s.pool, key)
+	atomic.AddInt64(&pool.size, -int64(m.Length))
+	s.ready = append(s.ready, m)
 }
 
-func (pool *MessagePool) dispatch(key string, m *Message) {
-	select {
-	case <-m.done:
-		defer func() { m.done <- true }()
-	case <-time.After(pool.messageExpire):
-		pool.Lock()
-		defer pool.Unlock()
-		m.TimedOut = true
+// unlock releases the lock of the shard, then passes the messages dispatched while holding it to the handler.
+// a slow handler doesn't block the packets of the shard nor the sweeper, the messages still reach it in order.
+func (pool *MessagePool) unlock(s *shard) {
+	ready := s.ready
+	if len(ready) == 0 {
+		s.Unlock()
+		return
+	}
+	s.ready = nil
+	s.handling.Lock()
+	s.Unlock()
+	for _, m := range ready {
+		pool.handler(m)
+	}
+	s.handling.Unlock()
+}
+
+// flush passes the messages dispatched so far to the handler the way unlock does, as the hints splitting the rest
+// of a message can depend on them(e.g: a websocket upgrade), and then locks the shard again. it returns false if
+// m is no longer the message in progress at key, it was dispatched in the meantime.
+func (pool *MessagePool) flush(s *shard, key string, m *Message) bool {
+	pool.unlock(s)
+	s.Lock()
+	return !s.closed && s.pool[key] == m
+}
+
+// drop removes the message from the pool without dispatching it,
+// it must be called while holding the lock of the shard.
+func (pool *MessagePool) drop(s *shard, key string, m *Message) {
+	delete(s.pool, key)
+	atomic.AddInt64(&pool.size, -int64(m.Length))
+}
+
+// SetIdleExpire sets the timeouts of messages idle for longer than idle, and of messages holding
+// no data(e.g: the SYN of a connection) for longer than halfOpen, they are both shorter than messageExpire.
+// idle messages are dispatched flagged as TimedOut, half-open messages are dropped.
+// zero disables the timeout, it is safe to call SetIdleExpire while the pool is in use.
+func (pool *MessagePool) SetIdleExpire(idle, halfOpen time.Duration) {
+	atomic.StoreInt64(&pool.idleExpire, int64(idle))
+	atomic.StoreInt64(&pool.halfOpenExpire, int64(halfOpen))
+}
+
+// sweep times out, in batches, the messages that have been in the pool for longer than messageExpire,
+// or that are idle or half-open for too long. a single goroutine checks all the shards every tenth of
+// the shortest timeout.
+func (pool *MessagePool) sweep() {
+	for {
+		idle := time.Duration(atomic.LoadInt64(&pool.idleExpire))
+		halfOpen := time.Duration(atomic.LoadInt64(&pool.halfOpenExpire))
+		interval := pool.messageExpire
+		for _, v := range []time.Duration{idle, halfOpen} {
+			if v > 0 && v < interval {
+				interval = v
+			}
+		}
+		timer := time.NewTimer(interval / 10)
+		select {
+		case <-pool.quit:
+			timer.Stop()
+			return
+		case now := <-timer.C:
+			for i := range pool.shards {
+				s := &pool.shards[i]
+				s.Lock()
+				for key, m := range s.pool {
+					switch {
+					case halfOpen > 0 && m.Length == 0 && now.Sub(m.created) > halfOpen:
+						pool.drop(s, key, m)
+						go pool.say(5, fmt.Sprintf("half-open message from %s to %s dropped\n", m.SrcAddr, m.DstAddr))
+					case now.After(m.expire), idle > 0 && now.Sub(m.seen) > idle:
+						m.TimedOut = true
+						pool.dispatch(s, key, m)
+					}
+				}
+				for key, c := range s.conns {
+					if now.After(c.expire) {
+						delete(s.conns, key)
+					}
+				}
+				pool.unlock(s)
+			}
+			pool.subflows.purge(now)
+		}
 	}
-	delete(pool.pool, key)
-	pool.handler(m)
 }
 
-func (pool *MessagePool) addPacket(m *Message, pckt *Packet) {
-	trunc := m.Length + len(pckt.Payload) - int(pool.maxSize)
+// Close stops the pool from accepting packets, and dispatches all the messages
+// in progress flagged as TimedOut. it is safe to call Close more than once.
+func (pool *MessagePool) Close() {
+	pool.closeOnce.Do(func() {
+		close(pool.quit)
+		for i := range pool.shards {
+			s := &pool.shards[i]
+			s.Lock()
+			s.closed = true
+			for key, m := range s.pool {
+				m.TimedOut = true
+				pool.dispatch(s, key, m)
+			}
+			pool.unlock(s)
+		}
+	})
+}
+
+func (pool *MessagePool) addPacket(s *shard, key string, m *Message, pckt *Packet) {
+	length := m.Length
+	i, ok, conflict := m.segment(pckt, pool.Overlap)
+	atomic.AddInt64(&pool.size, int64(m.Length-length))
+	if conflict {
+		pool.drop(s, key, m)
+		go pool.say(5, fmt.Sprintf("conflicting overlapping packet from %s to %s at %s, message dropped\n", pckt.Src(), pckt.Dst(), pckt.Timestamp))
+		return
+	}
+	if !ok && !pckt.FIN {
+		go pool.say(5, fmt.Sprintf("retransmitted packet from %s to %s at %s\n", pckt.Src(), pckt.Dst(), pckt.Timestamp))
+		return
+	}
+	trunc := pool.overflow(m, len(pckt.Payload))
 	if trunc > 0 {
+		if pool.Limit == LimitDrop {
+			atomic.AddUint64(&pool.limits.Dropped, 1)
+			pool.drop(s, key, m)
+			go pool.say(5, fmt.Sprintf("message from %s to %s exceeds the size limits, message dropped\n", pckt.Src(), pckt.Dst()))
+			return
+		}
+		atomic.AddUint64(&pool.limits.Truncated, 1)
 		m.Truncated = true
-		pckt.Payload = pckt.Payload[:int(pool.maxSize)-m.Length]
+		if trunc > len(pckt.Payload) {
+			trunc = len(pckt.Payload)
+		}
+		pckt.Payload = pckt.Payload[:len(pckt.Payload)-trunc]
+	}
+	m.add(i, pckt)
+	m.seen = time.Now()
+	atomic.AddInt64(&pool.size, int64(len(pckt.Payload)))
+	if trunc < 0 && pool.Split != nil {
+		if m = pool.split(s, key, m); m == nil {
+			return
+		}
 	}
-	m.add(pckt)
 	switch {
 	case trunc >= 0:
 	case pool.End != nil && pool.End(m):
@@ -217,8 +772,31 @@ func (pool *MessagePool) addPacket(m *Message, pckt *Packet) {
 	default:
 		return
 	}
-	m.done <- true
-	<-m.done
+	pool.dispatch(s, key, m)
+}
+
+// split dispatches the complete messages held by m, using pool.Split. it returns
+// the message still in progress, or nil if all of them were dispatched.
+func (pool *MessagePool) split(s *shard, key string, m *Message) *Message {
+	for {
+		n := pool.Split(m)
+		switch {
+		case n < 1:
+			return m
+		case n >= m.Length:
+			pool.dispatch(s, key, m)
+			return nil
+		}
+		next := m.split(n)
+		next.created, next.seen = time.Now(), m.seen
+		next.expire = next.created.Add(pool.messageExpire)
+		pool.dispatch(s, key, m)
+		s.pool[key] = next
+		if !pool.flush(s, key, next) {
+			return nil
+		}
+		m = next
+	}
 }
 
 // this function should not block other pool operations
@@ -0,0 +1,220 @@
+package tcp
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+// MPTCP option, see RFC 8684
+const (
+	tcpOptionMPTCP = 30
+	mpCapable      = 0
+	mpJoin         = 1
+	mpDSS          = 2
+)
+
+// mptcp tracks the subflows of multipath tcp connections, so that the data of all the subflows
+// of a connection are reassembled in a single message, see MessagePool.MPTCP
+type mptcp struct {
+	sync.Mutex
+	tokens   map[uint32]token
+	subflows map[string]*subflow // by src=dst
+}
+
+// mptcpConn is a multipath tcp connection, it is identified by the addresses of its first subflow
+type mptcpConn struct {
+	client, server string
+}
+
+// token is the token of the key of a peer of a connection
+type token struct {
+	conn   *mptcpConn
+	server bool
+}
+
+// subflow is a direction of a subflow of a connection
+type subflow struct {
+	conn     *mptcpConn
+	isn      uint32
+	toServer bool
+	primary  bool
+	mapping  dssMapping
+	expire   time.Time
+}
+
+// dssMapping maps length bytes of a subflow, starting at the relative subflow sequence number ssn,
+// to the data sequence number dsn of the connection
+type dssMapping struct {
+	dsn    uint32
+	ssn    uint32
+	length uint32
+}
+
+// mptcpOption is the multipath tcp option of a packet
+type mptcpOption struct {
+	subtype uint8
+	keys    [][]byte
+	token   uint32
+	mapping *dssMapping
+	dataFIN bool
+}
+
+func newMPTCP() *mptcp {
+	return &mptcp{
+		tokens:   make(map[uint32]token),
+		subflows: make(map[string]*subflow),
+	}
+}
+
+// parseMPTCP returns the multipath tcp option of the packet, nil if it has none
+func parseMPTCP(pckt *Packet) *mptcpOption {
+	for _, o := range pckt.Options {
+		if o.OptionType != tcpOptionMPTCP || len(o.OptionData) < 2 {
+			continue
+		}
+		data := o.OptionData
+		opt := &mptcpOption{subtype: data[0] >> 4}
+		switch opt.subtype {
+		case mpCapable:
+			for keys := data[2:]; len(keys) >= 8 && len(opt.keys) < 2; keys = keys[8:] {
+				opt.keys = append(opt.keys, keys[:8])
+			}
+		case mpJoin:
+			if pckt.SYN && !pckt.ACK && len(data) >= 6 {
+				opt.token = binary.BigEndian.Uint32(data[2:6])
+			}
+		case mpDSS:
+			flags := data[1]
+			opt.dataFIN = flags&0x10 != 0
+			data = data[2:]
+			if flags&0x01 != 0 { // data ack
+				n := 4
+				if flags&0x02 != 0 {
+					n = 8
+				}
+				if len(data) < n {
+					return opt
+				}
+				data = data[n:]
+			}
+			if flags&0x04 != 0 { // mapping
+				n := 4
+				if flags&0x08 != 0 {
+					n = 8
+				}
+				if len(data) < n+6 {
+					return opt
+				}
+				opt.mapping = &dssMapping{
+					dsn:    binary.BigEndian.Uint32(data[n-4:]),
+					ssn:    binary.BigEndian.Uint32(data[n:]),
+					length: uint32(binary.BigEndian.Uint16(data[n+4:])),
+				}
+			}
+		}
+		return opt
+	}
+	return nil
+}
+
+// keyToken returns the token of a key, the most significant 32 bits of its SHA-1
+func keyToken(key []byte) uint32 {
+	sum := sha1.Sum(key)
+	return binary.BigEndian.Uint32(sum[:4])
+}
+
+// subflow records the handshakes of the subflows of multipath tcp connections, and
+// moves the data of subflows to the first subflow of their connection, in its data sequence space.
+func (mp *mptcp) subflow(pckt *Packet) {
+	opt := parseMPTCP(pckt)
+	src, dst := pckt.Src(), pckt.Dst()
+	now := time.Now()
+	mp.Lock()
+	defer mp.Unlock()
+	sub := mp.subflows[src+"="+dst]
+	if pckt.SYN {
+		if opt == nil {
+			return
+		}
+		rev := mp.subflows[dst+"="+src]
+		switch {
+		case opt.subtype == mpCapable && !pckt.ACK:
+			sub = &subflow{conn: &mptcpConn{client: src, server: dst}, toServer: true, primary: true}
+		case opt.subtype == mpCapable && rev != nil:
+			sub = &subflow{conn: rev.conn, primary: true}
+		case opt.subtype == mpJoin && !pckt.ACK:
+			t, ok := mp.tokens[opt.token]
+			if !ok {
+				return
+			}
+			sub = &subflow{conn: t.conn, toServer: t.server}
+		case opt.subtype == mpJoin && rev != nil:
+			sub = &subflow{conn: rev.conn, toServer: !rev.toServer}
+		default:
+			return
+		}
+		sub.isn = pckt.Seq
+		mp.subflows[src+"="+dst] = sub
+	}
+	if sub == nil {
+		return
+	}
+	sub.expire = now.Add(connExpire)
+	if opt != nil {
+		for i, key := range opt.keys {
+			// keys are sent by the sender first
+			server := (i == 0) != sub.toServer
+			mp.tokens[keyToken(key)] = token{sub.conn, server}
+		}
+		if opt.mapping != nil {
+			sub.mapping = *opt.mapping
+		}
+	}
+	if pckt.SYN {
+		return
+	}
+	if pckt.RST {
+		delete(mp.subflows, src+"="+dst)
+		if !sub.primary {
+			pckt.RST = false
+		}
+		return
+	}
+	if opt != nil && opt.subtype == mpDSS {
+		// subflows are closed independently, the connection is closed by DATA_FIN
+		pckt.FIN = opt.dataFIN
+	}
+	if len(pckt.Payload) == 0 || sub.mapping.length == 0 {
+		return
+	}
+	offset := pckt.Seq - sub.isn - sub.mapping.ssn
+	if offset >= sub.mapping.length {
+		return
+	}
+	pckt.Seq = sub.mapping.dsn + offset
+	pckt.src, pckt.dst = sub.conn.client, sub.conn.server
+	if !sub.toServer {
+		pckt.src, pckt.dst = sub.conn.server, sub.conn.client
+	}
+}
+
+// purge forgets the subflows and tokens of connections idle for too long
+func (mp *mptcp) purge(now time.Time) {
+	mp.Lock()
+	defer mp.Unlock()
+	alive := make(map[*mptcpConn]bool)
+	for key, sub := range mp.subflows {
+		if now.After(sub.expire) {
+			delete(mp.subflows, key)
+			continue
+		}
+		alive[sub.conn] = true
+	}
+	for key, t := range mp.tokens {
+		if !alive[t.conn] {
+			delete(mp.tokens, key)
+		}
+	}
+}
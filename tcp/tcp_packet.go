@@ -19,6 +19,7 @@ function.
 type Packet struct {
 	// Link layer
 	gopacket.LinkLayer
+	VLAN []uint16 // identifiers of the 802.1Q tags, outermost first
 
 	// IP Header
 	gopacket.NetworkLayer
@@ -30,13 +31,20 @@ type Packet struct {
 	// Data info
 	Lost      uint16
 	Timestamp time.Time
+	Interface int      // index of the interface of capture files, see gopacket.CaptureInfo.InterfaceIndex
+	Comments  []string // comments of capture files, the strings of gopacket.CaptureInfo.AncillaryData
+
+	src, dst string // addresses of the first subflow of a multipath tcp connection, see MessagePool.MPTCP
+	ext      int    // length of the IPv6 extension headers preceding the tcp header
+	routing  []byte // IPv6 routing header
 }
 
 // ParsePacket parse raw packets
 func ParsePacket(packet gopacket.Packet) (pckt *Packet, err error) {
+	var walked bool // the IPv6 extension headers gopacket failed to decode were walked
 	// early check of error
 	defer func() {
-		if packet.ErrorLayer() != nil {
+		if packet.ErrorLayer() != nil && !walked {
 			err = packet.ErrorLayer().Error()
 			println(err.Error())
 			return
@@ -49,9 +57,16 @@ func ParsePacket(packet gopacket.Packet) (pckt *Packet, err error) {
 	if pckt.Timestamp.IsZero() {
 		pckt.Timestamp = time.Now()
 	}
+	pckt.Interface = packet.Metadata().InterfaceIndex
+	for _, data := range packet.Metadata().AncillaryData {
+		if comment, ok := data.(string); ok {
+			pckt.Comments = append(pckt.Comments, comment)
+		}
+	}
 
 	// parsing link layer
 	pckt.LinkLayer = packet.LinkLayer()
+	pckt.VLAN = vlanTags(packet)
 
 	// parsing network layer
 	if net4, ok := packet.NetworkLayer().(*layers.IPv4); ok {
@@ -66,8 +81,22 @@ func ParsePacket(packet gopacket.Packet) (pckt *Packet, err error) {
 	}
 
 	// parsing tcp header(transportation layer)
+	var next layers.IPProtocol
+	var payload []byte
+	if pckt.Version == 6 {
+		next, payload, pckt.ext, pckt.routing = walkIPv6(pckt.NetworkLayer.(*layers.IPv6), false)
+	}
 	if tcp, ok := packet.TransportLayer().(*layers.TCP); ok {
 		pckt.TCP = tcp
+	} else if next == layers.IPProtocolTCP {
+		// gopacket stops at the extension headers it doesn't know, e.g. segment routing headers
+		tcp = new(layers.TCP)
+		if err = tcp.DecodeFromBytes(payload, gopacket.NilDecodeFeedback); err != nil {
+			pckt = nil
+			return
+		}
+		pckt.TCP = tcp
+		walked = true
 	} else {
 		pckt = nil
 		return
@@ -78,19 +107,180 @@ func ParsePacket(packet gopacket.Packet) (pckt *Packet, err error) {
 	headerSize := int(uint32(pckt.DataOffset) + uint32(pckt.IHL()))
 	if pckt.Version == 6 {
 		headerSize -= 40 // in ipv6 the length of payload doesn't include the IPheader size
+		headerSize += pckt.ext
+	}
+	// offloaded segments larger than 64kb can't have their length in the IP header
+	if lost := int(pckt.Length()) - headerSize - len(pckt.Payload); lost > 0 {
+		pckt.Lost = uint16(lost)
 	}
-	pckt.Lost = pckt.Length() - uint16(headerSize+len(pckt.Payload))
 
 	return
 }
 
+// parseNetwork parses the link and network layers of packets of transports other than tcp, it returns
+// the protocol and the data following the IP headers, pckt is nil if the packet is not an IP packet.
+func parseNetwork(packet gopacket.Packet) (pckt *Packet, next layers.IPProtocol, payload []byte) {
+	pckt = new(Packet)
+	pckt.Timestamp = packet.Metadata().Timestamp
+	if pckt.Timestamp.IsZero() {
+		pckt.Timestamp = time.Now()
+	}
+	pckt.Interface = packet.Metadata().InterfaceIndex
+	pckt.LinkLayer = packet.LinkLayer()
+	pckt.VLAN = vlanTags(packet)
+	if net4, ok := packet.NetworkLayer().(*layers.IPv4); ok {
+		pckt.NetworkLayer = net4
+		pckt.Version = 4
+		next, payload = net4.Protocol, net4.Payload
+	} else if net6, ok := packet.NetworkLayer().(*layers.IPv6); ok {
+		pckt.NetworkLayer = net6
+		pckt.Version = 6
+		next, payload, pckt.ext, pckt.routing = walkIPv6(net6, false)
+	} else {
+		return nil, 0, nil
+	}
+	return
+}
+
+// walkIPv6 walks the chain of extension headers of an IPv6 packet, it returns the protocol and the data
+// following them, their length and the routing header. the protocol of a fragment other than the first is
+// IPProtocolNoNextHeader, and so is the one of a truncated chain. with toFragment, the walk stops at the
+// fragment header, whose data are returned.
+func walkIPv6(ip *layers.IPv6, toFragment bool) (next layers.IPProtocol, data []byte, length int, routing []byte) {
+	next, data = ip.NextHeader, ip.Payload
+	// the hop-by-hop options are decoded with the IPv6 header
+	if ip.HopByHop != nil {
+		next, length = ip.HopByHop.NextHeader, ip.HopByHop.ActualLength
+	}
+	for {
+		var n int
+		if len(data) < 8 {
+			n = 8
+		}
+		switch next {
+		case layers.IPProtocolIPv6HopByHop, layers.IPProtocolIPv6Routing, layers.IPProtocolIPv6Destination,
+			ipv6Mobility, ipv6HIP, ipv6Shim6:
+			if n == 0 {
+				n = (int(data[1]) + 1) * 8
+			}
+		case layers.IPProtocolIPv6Fragment:
+			if toFragment {
+				return
+			}
+			if n == 0 && binary.BigEndian.Uint16(data[2:4])&^7 != 0 {
+				return layers.IPProtocolNoNextHeader, data, length, routing
+			}
+			n = 8
+		case layers.IPProtocolAH:
+			if n == 0 {
+				n = (int(data[1]) + 2) * 4
+			}
+		default:
+			return
+		}
+		if len(data) < n {
+			return layers.IPProtocolNoNextHeader, data, length, routing
+		}
+		if next == layers.IPProtocolIPv6Routing {
+			routing = data[:n]
+		}
+		next, data, length = layers.IPProtocol(data[0]), data[n:], length+n
+	}
+}
+
+// extension headers unknown to gopacket, https://www.iana.org/assignments/ipv6-parameters
+const (
+	ipv6Mobility layers.IPProtocol = 135
+	ipv6HIP      layers.IPProtocol = 139
+	ipv6Shim6    layers.IPProtocol = 140
+)
+
+// fastOpen moves the payload of a SYN(TCP Fast Open) to a new packet, whose sequence
+// number follows the one of the SYN
+func (pckt *Packet) fastOpen() *Packet {
+	tcp := *pckt.TCP
+	data := *pckt
+	data.TCP = &tcp
+	data.SYN = false
+	data.Seq++
+	pckt.Payload = nil
+	pckt.Lost = 0
+	return &data
+}
+
+// ValidChecksum reports whether the IPv4 header checksum and the TCP checksum of the packet are valid.
+// packets that were not captured whole can't be validated, and are reported as valid.
+func (pckt *Packet) ValidChecksum() bool {
+	if pckt.Lost != 0 {
+		return true
+	}
+	length := len(pckt.TCP.Contents) + len(pckt.Payload)
+	var sum uint32
+	if l, ok := pckt.NetworkLayer.(*layers.IPv4); ok {
+		if foldChecksum(checksum(0, l.Contents)) != 0xffff {
+			return false
+		}
+		sum = checksum(sum, l.SrcIP.To4())
+		sum = checksum(sum, l.DstIP.To4())
+	} else {
+		l := pckt.NetworkLayer.(*layers.IPv6)
+		sum = checksum(sum, l.SrcIP.To16())
+		sum = checksum(sum, pckt.finalDst(l).To16())
+	}
+	sum += uint32(layers.IPProtocolTCP) + uint32(length&0xffff) + uint32(length>>16)
+	sum = checksum(sum, pckt.TCP.Contents)
+	sum = checksum(sum, pckt.Payload)
+	return foldChecksum(sum) == 0xffff
+}
+
+// finalDst returns the destination of the pseudo header of the tcp checksum, the last address of
+// the routing header while segments are left, https://www.rfc-editor.org/rfc/rfc8200#section-8.1
+func (pckt *Packet) finalDst(ip *layers.IPv6) net.IP {
+	r := pckt.routing
+	if len(r) < 24 || r[3] == 0 {
+		return ip.DstIP
+	}
+	switch r[2] {
+	case 0, 2:
+		return net.IP(r[len(r)-16:])
+	case 4:
+		// the segment list of segment routing headers is in reverse order
+		return net.IP(r[8:24])
+	}
+	return ip.DstIP
+}
+
+// checksum adds data to the one's complement sum of 16 bits words
+func checksum(sum uint32, data []byte) uint32 {
+	for ; len(data) > 1; data = data[2:] {
+		sum += uint32(data[0])<<8 | uint32(data[1])
+	}
+	if len(data) == 1 {
+		sum += uint32(data[0]) << 8
+	}
+	return sum
+}
+
+func foldChecksum(sum uint32) uint16 {
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return uint16(sum)
+}
+
 // Src returns the source socket of a packet
 func (pckt *Packet) Src() string {
+	if pckt.src != "" {
+		return pckt.src
+	}
 	return fmt.Sprintf("%s:%d", pckt.SrcIP(), pckt.SrcPort)
 }
 
 // Dst returns destination socket
 func (pckt *Packet) Dst() string {
+	if pckt.dst != "" {
+		return pckt.dst
+	}
 	return fmt.Sprintf("%s:%d", pckt.DstIP(), pckt.DstPort)
 }
 
@@ -148,17 +338,41 @@ func (pckt *Packet) SYNOptions() (mss uint16, windowscale byte) {
 
 // LinkInfo returns info about the link layer
 func (pckt *Packet) LinkInfo() string {
-	if l, ok := pckt.LinkLayer.(*layers.Ethernet); ok {
+	switch l := pckt.LinkLayer.(type) {
+	case *layers.Ethernet:
 		return fmt.Sprintf(
 			"Source Mac: %s\nDestination Mac: %s\nProtocol: %s",
 			l.SrcMAC,
 			l.DstMAC,
 			l.EthernetType,
 		)
+	case *layers.LinuxSLL:
+		return fmt.Sprintf(
+			"Linux cooked\nAddress: %s\nPacket Type: %s\nProtocol: %s",
+			l.Addr,
+			l.PacketType,
+			l.EthernetType,
+		)
 	}
 	return "<Not Ethernet>"
 }
 
+// Incoming reports whether the packet was sent to the capturing host, known is false unless
+// the link layer tells it: linux cooked captures, e.g. on the any interface
+func (pckt *Packet) Incoming() (in, known bool) {
+	sll, ok := pckt.LinkLayer.(*layers.LinuxSLL)
+	if !ok {
+		return
+	}
+	switch sll.PacketType {
+	case layers.LinuxSLLPacketTypeHost:
+		return true, true
+	case layers.LinuxSLLPacketTypeOutgoing:
+		return false, true
+	}
+	return
+}
+
 // Flag returns formatted tcp flags
 func (pckt *Packet) Flag() (flag string) {
 	if pckt.FIN {
@@ -0,0 +1,149 @@
+package tcp
+
+import (
+	"sync"
+	"time"
+)
+
+// Pair is an incoming message(request) and the outgoing message(response) answering it
+type Pair struct {
+	Request  *Message // nil if the request wasn't received before the pair expired
+	Response *Message // nil if the response wasn't received before the pair expired
+	Ordinal  int      // position of the pair in its connection, starting from 1
+}
+
+// PairHandler pair handler
+type PairHandler func(*Pair)
+
+// Pairer matches incoming and outgoing messages of the same connection. messages of a
+// connection are matched in the order they are received, which is the order HTTP/1.x
+// answers pipelined requests on keep-alive connections. a response that starts before
+// the end of the oldest request waiting for one can't answer it, its request was lost and
+// it is passed alone. each message waits at most expire for the other message of its pair,
+// connections idle for longer than expire are forgotten, and their ordinal restarts from 1.
+// Pairer.Handler is meant to be used as the handler of a MessagePool e.g:
+//
+//	pairer := tcp.NewPairer(messageExpire, pairHandler)
+//	pool := tcp.NewMessagePool(maxSize, messageExpire, debugger, pairer.Handler)
+type Pairer struct {
+	sync.Mutex
+	conns   map[string]*pairs
+	handler PairHandler
+	expire  time.Duration // the maximum time to wait for the other message of a pair, minimum is 100ms
+	quit    chan bool
+	once    sync.Once
+}
+
+// pairs holds the messages of a connection waiting to be paired
+type pairs struct {
+	requests  []pending
+	responses []pending
+	ordinal   int
+	seen      time.Time
+}
+
+// pending is a message waiting for the other message of its pair until expire
+type pending struct {
+	m      *Message
+	expire time.Time
+}
+
+// NewPairer returns a new pairer, messages that are not paired after expire are
+// passed to handler alone.
+func NewPairer(expire time.Duration, handler PairHandler) (p *Pairer) {
+	p = new(Pairer)
+	p.handler = handler
+	p.expire = time.Millisecond * 100
+	if p.expire < expire {
+		p.expire = expire
+	}
+	p.conns = make(map[string]*pairs)
+	p.quit = make(chan bool)
+	go p.sweep()
+	return
+}
+
+// Handler returns message handler
+func (p *Pairer) Handler(m *Message) {
+	key := m.DstAddr + "=" + m.SrcAddr
+	if m.IsIncoming {
+		key = m.SrcAddr + "=" + m.DstAddr
+	}
+	p.Lock()
+	defer p.Unlock()
+	c, ok := p.conns[key]
+	if !ok {
+		c = new(pairs)
+		p.conns[key] = c
+	}
+	c.seen = time.Now()
+	if m.IsIncoming {
+		c.requests = append(c.requests, pending{m, c.seen.Add(p.expire)})
+	} else {
+		c.responses = append(c.responses, pending{m, c.seen.Add(p.expire)})
+	}
+	for len(c.requests) > 0 && len(c.responses) > 0 {
+		req, resp := c.requests[0].m, c.responses[0].m
+		c.responses[0] = pending{}
+		c.responses = c.responses[1:]
+		c.ordinal++
+		if resp.Start.Before(req.End) {
+			p.handler(&Pair{Response: resp, Ordinal: c.ordinal})
+			continue
+		}
+		c.requests[0] = pending{}
+		c.requests = c.requests[1:]
+		p.handler(&Pair{Request: req, Response: resp, Ordinal: c.ordinal})
+	}
+}
+
+// sweep passes alone the messages that have waited for a pair for longer than expire,
+// and forgets idle connections.
+func (p *Pairer) sweep() {
+	ticker := time.NewTicker(p.expire / 10)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.quit:
+			return
+		case now := <-ticker.C:
+			p.Lock()
+			p.flush(now)
+			p.Unlock()
+		}
+	}
+}
+
+// Close passes alone all the messages waiting for a pair, the pool feeding the pairer
+// should be closed first. it is safe to call Close more than once.
+func (p *Pairer) Close() {
+	p.once.Do(func() {
+		close(p.quit)
+		p.Lock()
+		p.flush(time.Time{})
+		p.Unlock()
+	})
+}
+
+// flush passes alone the messages that expired before now and forgets the connections
+// idle since, all the messages and connections if now is zero.
+func (p *Pairer) flush(now time.Time) {
+	for key, c := range p.conns {
+		// the messages of a connection are queued in the order they expire
+		for len(c.requests) > 0 && (now.IsZero() || now.After(c.requests[0].expire)) {
+			c.ordinal++
+			p.handler(&Pair{Request: c.requests[0].m, Ordinal: c.ordinal})
+			c.requests[0] = pending{}
+			c.requests = c.requests[1:]
+		}
+		for len(c.responses) > 0 && (now.IsZero() || now.After(c.responses[0].expire)) {
+			c.ordinal++
+			p.handler(&Pair{Response: c.responses[0].m, Ordinal: c.ordinal})
+			c.responses[0] = pending{}
+			c.responses = c.responses[1:]
+		}
+		if len(c.requests) == 0 && len(c.responses) == 0 && (now.IsZero() || now.Sub(c.seen) > p.expire) {
+			delete(p.conns, key)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package tcp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Sampling keeps Keep connections out of Of, a connection is kept when the hash of its tuple
+// modulo Of is below Keep so that all of its packets are either kept or dropped. the zero value keeps them all.
+// the hash is the sum of the 32 bits words of the addresses and of the ports, it is the same in both directions
+// and can be computed by BPF filters, see capture.Listener.Sample
+type Sampling struct {
+	Keep, Of uint32
+}
+
+// Set is here so that Sampling can implement flag.Var, it accepts 1-in-N rates "1/10", and percentages "25%"
+func (s *Sampling) Set(v string) error {
+	var keep, of uint64
+	var err error
+	v = strings.TrimSpace(v)
+	if i := strings.IndexByte(v, '/'); i > 0 {
+		keep, err = strconv.ParseUint(v[:i], 10, 32)
+		if err == nil {
+			of, err = strconv.ParseUint(v[i+1:], 10, 32)
+		}
+	} else {
+		of = 100
+		keep, err = strconv.ParseUint(strings.TrimSuffix(v, "%"), 10, 32)
+		if !strings.HasSuffix(v, "%") {
+			err = fmt.Errorf("missing %%")
+		}
+	}
+	if err != nil || keep == 0 || keep > of {
+		return fmt.Errorf("invalid sampling %q, expected a 1-in-N rate(1/10) or a percentage(25%%)", v)
+	}
+	s.Keep, s.Of = uint32(keep), uint32(of)
+	return nil
+}
+
+func (s *Sampling) String() string {
+	if s.Of == 0 {
+		return ""
+	}
+	if s.Of == 100 {
+		return fmt.Sprintf("%d%%", s.Keep)
+	}
+	return fmt.Sprintf("%d/%d", s.Keep, s.Of)
+}
+
+// Match reports whether the connection of the packet is sampled
+func (s Sampling) Match(pckt *Packet) bool {
+	return s.Of == 0 || tupleHash(pckt.SrcIP(), pckt.DstIP(), uint16(pckt.SrcPort), uint16(pckt.DstPort))%s.Of < s.Keep
+}
+
+func tupleHash(src, dst net.IP, sport, dport uint16) uint32 {
+	sum := uint32(sport) + uint32(dport)
+	for _, ip := range []net.IP{src, dst} {
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		for i := 0; i+4 <= len(ip); i += 4 {
+			sum += binary.BigEndian.Uint32(ip[i:])
+		}
+	}
+	return sum
+}
@@ -0,0 +1,50 @@
+package tcp
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Session is the state of a message in progress
+type Session struct {
+	SrcAddr    string
+	DstAddr    string
+	IsIncoming bool
+	Length     int           // bytes received so far
+	Packets    int           // packets received so far
+	Age        time.Duration // wall clock time since the message was created
+	Idle       time.Duration // wall clock time since the last packet was added
+}
+
+// Snapshot is the state of a MessagePool at a point in time
+type Snapshot struct {
+	Time     time.Time
+	Size     int64 // bytes held by all the messages in progress
+	Limits   LimitStats
+	Sessions []Session
+}
+
+// Snapshot returns the state of the messages in progress. shards are locked one at a
+// time, so packets of the other shards are handled while the snapshot is taken.
+func (pool *MessagePool) Snapshot() (snap Snapshot) {
+	snap.Time = time.Now()
+	snap.Size = atomic.LoadInt64(&pool.size)
+	snap.Limits = pool.LimitStats()
+	for i := range pool.shards {
+		s := &pool.shards[i]
+		s.Lock()
+		for _, m := range s.pool {
+			snap.Sessions = append(snap.Sessions, Session{
+				SrcAddr:    m.SrcAddr,
+				DstAddr:    m.DstAddr,
+				IsIncoming: m.IsIncoming,
+				Length:     m.Length,
+				Packets:    len(m.packets),
+				Age:        snap.Time.Sub(m.created),
+				Idle:       snap.Time.Sub(m.seen),
+			})
+		}
+		s.Unlock()
+	}
+	return
+}
@@ -2,14 +2,33 @@ package tcp
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/buger/goreplay/proto"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
+	"golang.org/x/net/http2/hpack"
 )
 
 var decodeOpts = gopacket.DecodeOptions{Lazy: true, NoCopy: true}
@@ -30,18 +49,31 @@ func headersIP4(seq uint32, length uint16) (headers [54]byte) {
 	tcp := ip[20:]
 	binary.BigEndian.PutUint16(tcp[0:2], 45678)
 	binary.BigEndian.PutUint16(tcp[2:4], 8001)
+	binary.BigEndian.PutUint32(tcp[4:8], seq)
 	tcp[12] = 5 << 4
 	return
 }
 
 func GetPackets(start uint32, _len int, payload []byte) []gopacket.Packet {
 	var packets = make([]gopacket.Packet, _len)
-	for i := start; i < start+uint32(_len); i++ {
+	seq := start
+	for i := 0; i < _len; i++ {
 		data := make([]byte, 54+len(payload))
-		h := headersIP4(i, uint16(len(payload)))
+		h := headersIP4(seq, uint16(len(payload)))
 		copy(data, h[:])
 		copy(data[len(h):], payload)
-		packets[i-start] = gopacket.NewPacket(data, layers.LinkTypeEthernet, decodeOpts)
+		packets[i] = gopacket.NewPacket(data, layers.LinkTypeEthernet, decodeOpts)
+		seq += uint32(len(payload))
+	}
+	return packets
+}
+
+// GetSegments returns a packet for each payload, with sequence numbers following each other
+func GetSegments(start uint32, payloads ...string) []gopacket.Packet {
+	var packets []gopacket.Packet
+	for _, v := range payloads {
+		packets = append(packets, GetPackets(start, 1, []byte(v))...)
+		start += uint32(len(v))
 	}
 	return packets
 }
@@ -59,12 +91,16 @@ func TestMessageParserWithHint(t *testing.T) {
 	packets[0].Data()[14:][20:][13] = 2  // SYN flag
 	packets[10].Data()[14:][20:][13] = 2 // SYN flag
 	packets[29].Data()[14:][20:][13] = 1 // FIN flag
-	packets[4] = GetPackets(5, 1, []byte("HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nTransfer-Encoding: chunked\r\n\r\n7"))[0]
-	packets[5] = GetPackets(6, 1, []byte("\r\nMozilla\r\n9\r\nDeveloper\r"))[0]
-	packets[6] = GetPackets(7, 1, []byte("\n7\r\nNetwork\r\n0\r\n\r\n"))[0]
-	packets[14] = GetPackets(5, 1, []byte("POST / HTTP/1.1\r\nContent-Type: text/plain\r\nContent-Length: 23\r\n\r\n"))[0]
-	packets[15] = GetPackets(6, 1, []byte("MozillaDeveloper"))[0]
-	packets[16] = GetPackets(7, 1, []byte("Network"))[0]
+	copy(packets[4:], GetSegments(5,
+		"HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nTransfer-Encoding: chunked\r\n\r\n7",
+		"\r\nMozilla\r\n9\r\nDeveloper\r",
+		"\n7\r\nNetwork\r\n0\r\n\r\n",
+	))
+	copy(packets[14:], GetSegments(5,
+		"POST / HTTP/1.1\r\nContent-Type: text/plain\r\nContent-Length: 23\r\n\r\n",
+		"MozillaDeveloper",
+		"Network",
+	))
 	packets[24] = GetPackets(5, 1, []byte("HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: 0\r\n\r"))[0]
 	for i := 0; i < 30; i++ {
 		pool.Handler(packets[i])
@@ -114,7 +150,8 @@ func TestMessageParserWithHint(t *testing.T) {
 func TestMessageParserWithoutHint(t *testing.T) {
 	var mssg = make(chan *Message, 1)
 	var data [63 << 10]byte
-	packets := GetPackets(1, 10, data[:])
+	// the data of the SYN start after its sequence number
+	packets := append(GetPackets(1, 1, data[:]), GetPackets(2+63<<10, 9, data[:])...)
 	packets[0].Data()[14:][20:][13] = 2 // SYN flag
 	packets[9].Data()[14:][20:][13] = 1 // FIN flag
 	p := NewMessagePool(63<<10*10, time.Second, nil, func(m *Message) { mssg <- m })
@@ -191,89 +228,2603 @@ func TestMessageTimeoutReached(t *testing.T) {
 	}
 }
 
-func TestMessageUUID(t *testing.T) {
-	m1 := &Message{}
-	m1.IsIncoming = true
-	m1.SrcAddr = "src"
-	m1.DstAddr = "dst"
-	m2 := &Message{}
-	m2.SrcAddr = "dst"
-	m2.DstAddr = "src"
-	if string(m1.UUID()) != string(m2.UUID()) {
-		t.Errorf("expected %s, to equal %s", m1.UUID(), m2.UUID())
+func TestMessageOutOfOrder(t *testing.T) {
+	var mssg = make(chan *Message, 1)
+	pool := NewMessagePool(1<<20, time.Second, nil, func(m *Message) { mssg <- m })
+	// sequence numbers wrap around in the middle of the message
+	start := ^uint32(0) - 5
+	packets := GetPackets(start-1, 1, nil)
+	packets[0].Data()[14:][20:][13] = 2 // SYN flag
+	packets = append(packets, GetSegments(start, "GET / HTTP/1.1\r\n", "Host: ", "localhost\r\n", "\r\n")...)
+	packets[4].Data()[14:][20:][13] = 1 // FIN flag
+	packets[1], packets[3] = packets[3], packets[1]
+	for _, v := range packets {
+		pool.Handler(v)
 	}
-}
-
-func BenchmarkPacketParseAndSort(b *testing.B) {
-	if b.N < 3 {
+	var m *Message
+	select {
+	case <-time.After(time.Second):
+		t.Errorf("can't parse packets fast enough")
 		return
+	case m = <-mssg:
 	}
-	now := time.Now()
-	m := new(Message)
-	m.packets = make([]*Packet, b.N)
-	for i, v := range GetPackets(1, b.N, nil) {
-		m.packets[i], _ = ParsePacket(v)
+	expected := "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"
+	if string(m.Data()) != expected {
+		t.Errorf("expected %q to equal %q", m.Data(), expected)
 	}
-	m.Sort()
-	b.Logf("%d packets in %s", b.N, time.Since(now))
 }
 
-func BenchmarkMessageParserWithoutHint(b *testing.B) {
+func TestMessageRetransmission(t *testing.T) {
 	var mssg = make(chan *Message, 1)
-	if b.N < 3 {
+	pool := NewMessagePool(1<<20, time.Second, nil, func(m *Message) { mssg <- m })
+	segments := func() []gopacket.Packet {
+		return GetSegments(1, "GET / HTTP/1.1\r\n", "Host: ", "localhost\r\n", "\r\n")
+	}
+	first, second := segments(), segments()
+	packets := append(GetPackets(0, 1, nil),
+		first[0],
+		first[1],
+		second[0], // duplicate
+		GetPackets(1+16+2, 1, []byte("st: local"))[0], // overlaps both sides
+		second[1], // duplicate
+		first[2],
+		GetSegments(1+16, "Host: localhost")[0], // spans over the two previous packets
+		first[3],
+	)
+	packets[0].Data()[14:][20:][13] = 2 // SYN flag
+	packets[8].Data()[14:][20:][13] = 1 // FIN flag
+	for _, v := range packets {
+		pool.Handler(v)
+	}
+	var m *Message
+	select {
+	case <-time.After(time.Second):
+		t.Errorf("can't parse packets fast enough")
 		return
+	case m = <-mssg:
 	}
-	now := time.Now()
-	n := b.N
-	packets := GetPackets(1, n, nil)
-	packets[0].Data()[14:][20:][13] = 2     // SYN flag
-	packets[b.N-1].Data()[14:][20:][13] = 1 // FIN flag
-	p := NewMessagePool(1<<20, time.Second*2, nil, func(m *Message) {
-		b.Logf("%d/%d packets in %s", len(m.packets), n, time.Since(now))
-		mssg <- m
-	})
+	expected := "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"
+	if string(m.Data()) != expected {
+		t.Errorf("expected %q to equal %q", m.Data(), expected)
+	}
+	if m.Length != len(expected) {
+		t.Errorf("expected %d to equal %d", m.Length, len(expected))
+	}
+}
+
+func TestMessagePoolShard(t *testing.T) {
+	pool := NewMessagePool(0, 0, nil, nil)
+	src, dst := "192.168.1.2:45678", "192.168.1.3:8001"
+	if pool.shard(src, dst) != pool.shard(dst, src) {
+		t.Error("expected both directions of a connection to share the same shard")
+	}
+	used := make(map[*shard]bool)
+	for i := 0; i < shards; i++ {
+		used[pool.shard(fmt.Sprintf("192.168.1.2:%d", 40000+i), dst)] = true
+	}
+	if len(used) < 2 {
+		t.Error("expected connections to be spread over shards")
+	}
+}
+
+func TestMessageRSTReached(t *testing.T) {
+	var mssg = make(chan *Message, 1)
+	packets := GetSegments(1, "", "GET / HTTP/1.1\r\n", "")
+	packets[0].Data()[14:][20:][13] = 2 // SYN flag
+	packets[2].Data()[14:][20:][13] = 4 // RST flag
+	p := NewMessagePool(1<<20, time.Second, nil, func(m *Message) { mssg <- m })
 	for _, v := range packets {
 		p.Handler(v)
 	}
-	<-mssg
+	select {
+	case <-time.After(time.Millisecond * 500):
+		t.Errorf("expected message to be dispatched on RST")
+	case m := <-mssg:
+		if m.TimedOut {
+			t.Error("expected message to not be timeout")
+		}
+	}
 }
 
-func BenchmarkMessageParserWithHint(b *testing.B) {
-	if b.N < 3 {
-		return
+// fragments returns the ip fragments of a tcp segment, the segment is split at each offset(in bytes)
+func fragments(t *testing.T, ipv6 bool, payload []byte, offsets ...int) (packets []gopacket.Packet) {
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	tcp := &layers.TCP{SrcPort: 45678, DstPort: 8001, SYN: true, Seq: 1}
+	var network gopacket.NetworkLayer
+	if ipv6 {
+		network = &layers.IPv6{Version: 6, NextHeader: layers.IPProtocolTCP, HopLimit: 64, SrcIP: net.ParseIP("fd00::2"), DstIP: net.ParseIP("fd00::3")}
+	} else {
+		network = &layers.IPv4{Version: 4, Protocol: layers.IPProtocolTCP, TTL: 64, Id: 7, SrcIP: net.IP{192, 168, 1, 2}, DstIP: net.IP{192, 168, 1, 3}}
 	}
-	now := time.Now()
-	n := b.N
+	tcp.SetNetworkLayerForChecksum(network)
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, opts, tcp, gopacket.Payload(payload)); err != nil {
+		t.Fatal(err)
+	}
+	segment := append([]byte(nil), buf.Bytes()...)
+	offsets = append(append([]int{0}, offsets...), len(segment))
+	for i := 0; i < len(offsets)-1; i++ {
+		eth := &layers.Ethernet{SrcMAC: net.HardwareAddr{0, 0, 0, 0, 0, 1}, DstMAC: net.HardwareAddr{0, 0, 0, 0, 0, 2}}
+		var ls []gopacket.SerializableLayer
+		more := i < len(offsets)-2
+		if ipv6 {
+			ip := *network.(*layers.IPv6)
+			ip.NextHeader = layers.IPProtocolIPv6Fragment
+			eth.EthernetType = layers.EthernetTypeIPv6
+			frag := []byte{byte(layers.IPProtocolTCP), 0, 0, 0, 0, 0, 0, 9}
+			binary.BigEndian.PutUint16(frag[2:], uint16(offsets[i]/8)<<3)
+			if more {
+				frag[3] |= 1
+			}
+			ls = []gopacket.SerializableLayer{eth, &ip, gopacket.Payload(frag)}
+		} else {
+			ip := *network.(*layers.IPv4)
+			ip.FragOffset = uint16(offsets[i] / 8)
+			if more {
+				ip.Flags = layers.IPv4MoreFragments
+			}
+			eth.EthernetType = layers.EthernetTypeIPv4
+			ls = []gopacket.SerializableLayer{eth, &ip}
+		}
+		ls = append(ls, gopacket.Payload(segment[offsets[i]:offsets[i+1]]))
+		buf = gopacket.NewSerializeBuffer()
+		if err := gopacket.SerializeLayers(buf, opts, ls...); err != nil {
+			t.Fatal(err)
+		}
+		packets = append(packets, gopacket.NewPacket(buf.Bytes(), layers.LinkTypeEthernet, decodeOpts))
+	}
+	return
+}
+
+func TestMessageFragmented(t *testing.T) {
+	payload := []byte("POST / HTTP/1.1\r\nContent-Length: 7\r\n\r\nNetwork")
+	for _, ipv6 := range []bool{false, true} {
+		var mssg = make(chan *Message, 1)
+		pool := NewMessagePool(1<<20, time.Second, nil, func(m *Message) { mssg <- m })
+		pool.End = func(m *Message) bool {
+			return proto.HasFullPayload(m.Data())
+		}
+		packets := fragments(t, ipv6, payload, 16, 40)
+		packets[0], packets[2] = packets[2], packets[0]
+		for _, v := range packets {
+			pool.Handler(v)
+		}
+		select {
+		case <-time.After(time.Second):
+			t.Errorf("can't parse packets fast enough, ipv6: %v", ipv6)
+		case m := <-mssg:
+			if !bytes.Equal(m.Data(), payload) {
+				t.Errorf("expected %q to equal %q, ipv6: %v", m.Data(), payload, ipv6)
+			}
+		}
+	}
+}
+
+// ipv6Packet returns an ethernet frame of an IPv6 packet whose extension headers, starting with
+// the protocol first, precede data
+func ipv6Packet(t *testing.T, first layers.IPProtocol, exts, data []byte) gopacket.Packet {
+	eth := &layers.Ethernet{SrcMAC: net.HardwareAddr{0, 0, 0, 0, 0, 1}, DstMAC: net.HardwareAddr{0, 0, 0, 0, 0, 2}, EthernetType: layers.EthernetTypeIPv6}
+	ip := &layers.IPv6{Version: 6, NextHeader: first, HopLimit: 64, SrcIP: net.ParseIP("fd00::2"), DstIP: net.ParseIP("fd00::3")}
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true}
+	if err := gopacket.SerializeLayers(buf, opts, eth, ip, gopacket.Payload(append(append([]byte(nil), exts...), data...))); err != nil {
+		t.Fatal(err)
+	}
+	return gopacket.NewPacket(buf.Bytes(), layers.LinkTypeEthernet, decodeOpts)
+}
+
+func TestIPv6Extensions(t *testing.T) {
+	payload := []byte("GET / HTTP/1.1\r\n\r\n")
+	final := net.ParseIP("fd00::4")
+	// the checksum of the segment is computed with the last segment of the routing header
+	tcp := &layers.TCP{SrcPort: 45678, DstPort: 8001, Seq: 1, PSH: true, ACK: true}
+	tcp.SetNetworkLayerForChecksum(&layers.IPv6{SrcIP: net.ParseIP("fd00::2"), DstIP: final})
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, tcp, gopacket.Payload(payload)); err != nil {
+		t.Fatal(err)
+	}
+	segment := append([]byte(nil), buf.Bytes()...)
+
+	// hop-by-hop options, a segment routing header(unknown to gopacket) and destination options
+	hbh := []byte{byte(layers.IPProtocolIPv6Routing), 0, 1, 4, 0, 0, 0, 0}
+	srh := append([]byte{byte(layers.IPProtocolIPv6Destination), 4, 4, 1, 1, 0, 0, 0}, final...)
+	srh = append(srh, net.ParseIP("fd00::3")...)
+	dst := []byte{byte(layers.IPProtocolTCP), 0, 1, 4, 0, 0, 0, 0}
+	exts := append(append(append([]byte(nil), hbh...), srh...), dst...)
+
+	pckt, err := ParsePacket(ipv6Packet(t, layers.IPProtocolIPv6HopByHop, exts, segment))
+	if err != nil || pckt == nil {
+		t.Fatalf("expected the tcp segment to be parsed, got %v", err)
+	}
+	if pckt.Dst() != "fd00::3:8001" || !bytes.Equal(pckt.Payload, payload) || pckt.Lost != 0 {
+		t.Errorf("expected %q to fd00::3:8001, got %q to %s, %d bytes lost", payload, pckt.Payload, pckt.Dst(), pckt.Lost)
+	}
+	if !pckt.ValidChecksum() {
+		t.Error("expected the checksum to be valid with the final destination")
+	}
+
+	// the capture filter lets the packets with extension headers of other ports pass
 	var mssg = make(chan *Message, 1)
-	payload := make([]byte, 0xfc00)
-	for i := 0; i < 0xfc00; i++ {
-		payload[i] = '1'
+	pool := NewMessagePool(1<<20, time.Second, nil, func(m *Message) { mssg <- m })
+	pool.SetHints("http")
+	pool.TunnelPort = 80
+	pool.Handler(ipv6Packet(t, layers.IPProtocolIPv6HopByHop, exts, segment))
+	pool.Close()
+	if len(mssg) != 0 {
+		t.Error("expected the packet of another port to be dropped")
 	}
-	pool := NewMessagePool(1<<30, time.Second*10, nil, func(m *Message) { mssg <- m })
+
+	// a datagram fragmented after the routing header
+	pool = NewMessagePool(1<<20, time.Second, nil, func(m *Message) { mssg <- m })
+	pool.SetHints("http")
+	pool.TunnelPort = 8001
+	srh[0] = byte(layers.IPProtocolIPv6Fragment)
+	srh[3] = 0
+	for i, part := range [][]byte{segment[:16], segment[16:]} {
+		frag := []byte{byte(layers.IPProtocolTCP), 0, 0, 0, 0, 0, 0, 9}
+		binary.BigEndian.PutUint16(frag[2:], uint16(i*16/8)<<3)
+		if i == 0 {
+			frag[3] |= 1
+		}
+		pool.Handler(ipv6Packet(t, layers.IPProtocolIPv6Routing, append(append([]byte(nil), srh...), frag...), part))
+	}
+	select {
+	case <-time.After(time.Second):
+		t.Error("expected the fragments to be reassembled")
+	case m := <-mssg:
+		if !bytes.Equal(m.Data(), payload) {
+			t.Errorf("expected %q to equal %q", m.Data(), payload)
+		}
+	}
+	pool.Close()
+}
+
+func TestDefragmenterMaxSize(t *testing.T) {
+	d := NewDefragmenter(time.Second, 16)
+	packets := fragments(t, false, make([]byte, 64), 16, 40)
+	if p, err := d.Defrag(packets[0]); p != nil || err != nil {
+		t.Errorf("expected the first fragment to be held, got %v, %v", p, err)
+	}
+	if p, err := d.Defrag(packets[1]); p != nil || err == nil {
+		t.Errorf("expected the second fragment to be dropped, got %v, %v", p, err)
+	}
+	// the fragments of other datagrams dropped are not held
+	for id := 8; id < 16; id++ {
+		ip := packets[1].NetworkLayer().(*layers.IPv4)
+		ip.Id = uint16(id)
+		if p, err := d.Defrag(packets[1]); p != nil || err == nil {
+			t.Errorf("expected the fragment of datagram %d to be dropped, got %v, %v", id, p, err)
+		}
+	}
+	if len(d.datagrams) != 1 {
+		t.Errorf("expected 1 datagram, got %d", len(d.datagrams))
+	}
+}
+
+func TestDefragmenterReusedBuffer(t *testing.T) {
+	payload := []byte("POST / HTTP/1.1\r\nContent-Length: 7\r\n\r\nNetwork")
+	for _, ipv6 := range []bool{false, true} {
+		d := NewDefragmenter(time.Second, 0)
+		packets := fragments(t, ipv6, payload, 16, 40)
+		if p, err := d.Defrag(packets[0]); p != nil || err != nil {
+			t.Fatalf("expected the first fragment to be held, got %v, %v", p, err)
+		}
+		// the capture engine reuses the buffer of the first fragment
+		for i := range packets[0].Data() {
+			packets[0].Data()[i] = 0
+		}
+		d.Defrag(packets[1])
+		p, err := d.Defrag(packets[2])
+		if p == nil || err != nil {
+			t.Fatalf("expected the reassembled datagram, got %v, %v, ipv6: %v", p, err, ipv6)
+		}
+		src, _ := p.NetworkLayer().NetworkFlow().Endpoints()
+		expected := "192.168.1.2"
+		if ipv6 {
+			expected = "fd00::2"
+		}
+		if src.String() != expected {
+			t.Errorf("expected the source %s, got %s", expected, src)
+		}
+	}
+}
+
+func TestMessageKeepAlive(t *testing.T) {
+	var mssg = make(chan *Message, 4)
+	pool := NewMessagePool(1<<20, time.Second, nil, func(m *Message) { mssg <- m })
 	pool.Start = func(pckt *Packet) (bool, bool) {
 		return proto.HasRequestTitle(pckt.Payload), proto.HasResponseTitle(pckt.Payload)
 	}
-	pool.End = func(m *Message) bool {
-		return proto.HasFullPayload(m.Data())
+	pool.Split = HTTPSplit
+	packets := GetSegments(1,
+		"GET /1 HTTP/1.1\r\n\r\nPOST /2 HTTP/1.1\r\nContent-Length: 7\r\n\r\nNet",
+		"workGET /3 HTTP/1.1\r\n\r\nGET /4 HTTP/1.1\r\n",
+		"\r\n",
+	)
+	for _, v := range packets {
+		pool.Handler(v)
 	}
-	pool.Handler(GetPackets(1, 1, []byte("POST / HTTP/1.1\r\nContent-Type: text/plain\r\nTransfer-Encoding: chunked\r\n\r\n"))[0])
-	i := 0
-	var d []byte
-	for {
+	for _, expected := range []string{
+		"GET /1 HTTP/1.1\r\n\r\n",
+		"POST /2 HTTP/1.1\r\nContent-Length: 7\r\n\r\nNetwork",
+		"GET /3 HTTP/1.1\r\n\r\n",
+		"GET /4 HTTP/1.1\r\n\r\n",
+	} {
 		select {
+		case <-time.After(time.Second):
+			t.Errorf("can't parse packets fast enough")
+			return
 		case m := <-mssg:
-			b.Logf("%d/%d packets, %dbytes, truncated: %v, timedout: %v in %s", len(m.packets), n, m.Length, m.Truncated, m.TimedOut, time.Since(now))
+			if string(m.Data()) != expected {
+				t.Errorf("expected %q to equal %q", m.Data(), expected)
+			}
+			if m.Length != len(expected) {
+				t.Errorf("expected %d to equal %d", m.Length, len(expected))
+			}
+			if m.TimedOut {
+				t.Error("expected message to not be timeout")
+			}
+		}
+	}
+}
+
+func TestMessageCloseDelimited(t *testing.T) {
+	var mssg = make(chan *Message, 1)
+	pool := NewMessagePool(1<<20, 10*time.Second, nil, func(m *Message) { mssg <- m })
+	pool.SetHints("http")
+	head := "HTTP/1.0 200 OK\r\nContent-Type: text/plain\r\n\r\n"
+	packets := GetSegments(1, head+"Mozilla", "Developer", "")
+	packets[2].Data()[14:][20:][13] = 1 // FIN flag
+	for _, v := range packets[:2] {
+		pool.Handler(v)
+	}
+	if len(mssg) != 0 {
+		t.Fatal("expected the body to end with the connection")
+	}
+	pool.Handler(packets[2])
+	select {
+	case <-time.After(time.Second):
+		t.Error("expected the message to be dispatched on FIN")
+	case m := <-mssg:
+		if string(m.Data()) != head+"MozillaDeveloper" {
+			t.Errorf("expected %q to equal %q", m.Data(), head+"MozillaDeveloper")
+		}
+		if m.TimedOut {
+			t.Error("expected message to not be timeout")
+		}
+	}
+	pool.Close()
+}
+
+func TestPairer(t *testing.T) {
+	var pairs = make(chan *Pair, 4)
+	pairer := NewPairer(0, func(p *Pair) { pairs <- p })
+	req := func(src string) *Message {
+		m := NewMessage(src, "192.168.1.3:80", 4)
+		m.IsIncoming = true
+		return m
+	}
+	resp := func(dst string) *Message {
+		return NewMessage("192.168.1.3:80", dst, 4)
+	}
+	r1, r2, r3 := req("192.168.1.2:45678"), req("192.168.1.2:45678"), req("192.168.1.2:45679")
+	w1, w2 := resp("192.168.1.2:45678"), resp("192.168.1.2:45678")
+	for _, m := range []*Message{r1, r2, r3, w1, w2} {
+		pairer.Handler(m)
+	}
+	pairer.Close()
+	for i, expected := range []Pair{{r1, w1, 1}, {r2, w2, 2}, {r3, nil, 1}} {
+		select {
+		case <-time.After(time.Second):
+			t.Errorf("expected pair %d", i)
 			return
-		default:
-			if i > n-2 {
-				break
-			} else if i < n-2 {
-				d = []byte(fmt.Sprintf("fc00\r\n%s\r\n", payload))
-			} else {
-				d = []byte("0\r\n\r\n")
+		case p := <-pairs:
+			if *p != expected {
+				t.Errorf("expected %v to equal %v", *p, expected)
 			}
-			pool.Handler(GetPackets(1, i+2, d)[0])
-			i++
 		}
 	}
 }
+
+func TestPairerLostMessages(t *testing.T) {
+	var pairs = make(chan *Pair, 4)
+	pairer := NewPairer(200*time.Millisecond, func(p *Pair) { pairs <- p })
+	defer pairer.Close()
+	now := time.Now()
+	message := func(incoming bool, start, end time.Duration) *Message {
+		m := NewMessage("192.168.1.2:45678", "192.168.1.3:80", 4)
+		if m.IsIncoming = incoming; !incoming {
+			m.SrcAddr, m.DstAddr = m.DstAddr, m.SrcAddr
+		}
+		m.Start, m.End = now.Add(start), now.Add(end)
+		return m
+	}
+	// the request of the first response was lost
+	r2, w1 := message(true, 2, 3), message(false, 1, 2)
+	pairer.Handler(r2)
+	pairer.Handler(w1)
+	if p := <-pairs; p.Request != nil || p.Response != w1 {
+		t.Errorf("expected the response alone, got %v", p)
+	}
+
+	// the response of the second request was lost, it expires on its own deadline
+	time.Sleep(120 * time.Millisecond)
+	r3 := message(true, 4, 5)
+	pairer.Handler(r3)
+	select {
+	case p := <-pairs:
+		if p.Request != r2 || p.Response != nil {
+			t.Errorf("expected the second request alone, got %v", p)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the second request to expire")
+	}
+	if len(pairs) != 0 {
+		t.Errorf("expected the third request to wait for its response, got %v", <-pairs)
+	}
+}
+
+func TestMessageOverlapPolicy(t *testing.T) {
+	for _, tt := range []struct {
+		policy   OverlapPolicy
+		expected string
+	}{
+		{OverlapFirstWins, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"},
+		{OverlapLastWins, "GET / HTTP/1.1\r\nHxst: lxcLlhost\r\n\r\n"},
+		{OverlapDropMessage, ""},
+	} {
+		var mssg = make(chan *Message, 1)
+		pool := NewMessagePool(1<<20, time.Second, nil, func(m *Message) { mssg <- m })
+		pool.Overlap = tt.policy
+		packets := append(GetPackets(0, 1, nil), GetSegments(1, "GET / HTTP/1.1\r\n", "Host: ", "localhost\r\n", "\r\n")...)
+		packets[0].Data()[14:][20:][13] = 2 // SYN flag
+		packets[4].Data()[14:][20:][13] = 1 // FIN flag
+		packets = append(packets[:4],
+			GetSegments(1+16, "Hxst: lxcal")[0], // overlaps two packets
+			GetSegments(1+16+6+3, "L")[0],       // within a packet
+			packets[4],
+		)
+		for _, v := range packets {
+			pool.Handler(v)
+		}
+		select {
+		case <-time.After(time.Millisecond * 200):
+			if tt.expected != "" {
+				t.Errorf("can't parse packets fast enough, policy: %s", &tt.policy)
+			}
+		case m := <-mssg:
+			if string(m.Data()) != tt.expected {
+				t.Errorf("expected %q to equal %q, policy: %s", m.Data(), tt.expected, &tt.policy)
+			}
+			if m.Length != len(tt.expected) {
+				t.Errorf("expected %d to equal %d, policy: %s", m.Length, len(tt.expected), &tt.policy)
+			}
+		}
+	}
+}
+
+func TestMessagePoolClose(t *testing.T) {
+	var mssg = make(chan *Message, 2)
+	packets := GetSegments(1, "", "GET / HTTP/1.1\r\n", "Host: localhost\r\n")
+	packets[0].Data()[14:][20:][13] = 2 // SYN flag
+	p := NewMessagePool(1<<20, time.Second, nil, func(m *Message) { mssg <- m })
+	p.Handler(packets[0])
+	p.Handler(packets[1])
+	p.Close()
+	p.Handler(packets[2])
+	p.Close()
+	select {
+	case m := <-mssg:
+		if !m.TimedOut {
+			t.Error("expected message to be flagged as timeout")
+		}
+		if string(m.Data()) != "GET / HTTP/1.1\r\n" {
+			t.Errorf("expected %q to equal %q", m.Data(), "GET / HTTP/1.1\r\n")
+		}
+	default:
+		t.Error("expected message to be dispatched on close")
+	}
+	if len(mssg) != 0 {
+		t.Error("expected no more messages after close")
+	}
+}
+
+func TestMessagePoolLimit(t *testing.T) {
+	for _, policy := range []LimitPolicy{LimitTruncate, LimitDrop, LimitBackpressure} {
+		var mssg = make(chan *Message, 2)
+		packets := GetSegments(1, "GET / HTTP/1.1\r\n", "Host: localhost\r\n", "\r\n")
+		packets[0].Data()[14:][20:][13] = 2 // SYN flag
+		p := NewMessagePool(1<<20, time.Millisecond*100, nil, func(m *Message) { mssg <- m })
+		p.MaxTotalSize = 20
+		p.Limit = policy
+		for _, v := range packets {
+			p.Handler(v)
+		}
+		p.Close()
+		stats := p.LimitStats()
+		switch policy {
+		case LimitTruncate:
+			m := <-mssg
+			if !m.Truncated || len(m.Data()) != 20 {
+				t.Errorf("expected message to be truncated to 20 bytes, got %q", m.Data())
+			}
+			if stats.Truncated != 1 {
+				t.Errorf("expected 1 truncated message, got %d", stats.Truncated)
+			}
+		case LimitDrop:
+			if len(mssg) != 0 {
+				t.Error("expected message to be dropped")
+			}
+			if stats.Dropped != 1 {
+				t.Errorf("expected 1 dropped message, got %d", stats.Dropped)
+			}
+		case LimitBackpressure:
+			// the packet waits for the first part of the message to time out
+			m := <-mssg
+			if !m.TimedOut || m.Truncated || string(m.Data()) != "GET / HTTP/1.1\r\n" {
+				t.Errorf("expected message to time out untruncated, got %q", m.Data())
+			}
+			if stats.Blocked != 1 {
+				t.Errorf("expected 1 blocked packet, got %d", stats.Blocked)
+			}
+		}
+	}
+}
+
+func TestHints(t *testing.T) {
+	var mssg = make(chan *Message, 3)
+	p := NewMessagePool(1<<20, time.Second, nil, func(m *Message) { mssg <- m })
+	if err := p.SetHints("unknown"); err == nil {
+		t.Error("expected unknown hints to be rejected")
+	}
+	if err := p.SetHints("length-prefixed"); err != nil {
+		t.Fatal(err)
+	}
+	packets := GetSegments(1, "", "\x00\x00\x00\x03abc\x00\x00", "\x00\x02de")
+	packets[0].Data()[14:][20:][13] = 2 // SYN flag
+	for _, v := range packets {
+		p.Handler(v)
+	}
+	p.Close()
+	expected := []string{"\x00\x00\x00\x03abc", "\x00\x00\x00\x02de"}
+	for _, e := range expected {
+		if m := <-mssg; string(m.Data()) != e {
+			t.Errorf("expected %q to equal %q", m.Data(), e)
+		}
+	}
+
+	p = NewMessagePool(1<<20, time.Second, nil, func(m *Message) { mssg <- m })
+	p.SetHints("http-request")
+	packets = GetSegments(1, "HTTP/1.1 200 OK\r\n\r\n", "GET / HTTP/1.1\r\n\r\n")
+	for _, v := range packets {
+		p.Handler(v)
+	}
+	if m := <-mssg; !m.IsIncoming || string(m.Data()) != "GET / HTTP/1.1\r\n\r\n" {
+		t.Errorf("expected only the request to be reassembled, got %q", m.Data())
+	}
+	p.Close()
+	if len(mssg) != 0 {
+		t.Error("expected the response to be ignored")
+	}
+
+	p = NewMessagePool(1<<20, time.Second, nil, func(m *Message) { mssg <- m })
+	p.SetHints("http-lenient")
+	packets = GetSegments(1, "GET / HTTP/1.1\nHost: a\n\n", "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\n", "GET /b HTTP/1.1\r\n\r\n")
+	for _, v := range packets {
+		p.Handler(v)
+	}
+	expected = []string{"GET / HTTP/1.1\nHost: a\n\n", "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\n", "GET /b HTTP/1.1\r\n\r\n"}
+	for _, e := range expected {
+		if m := <-mssg; string(m.Data()) != e {
+			t.Errorf("expected %q to equal %q", m.Data(), e)
+		}
+	}
+	p.Close()
+}
+
+func TestPacketChecksum(t *testing.T) {
+	serialize := func(ipv6 bool, payload string) gopacket.Packet {
+		tcp := &layers.TCP{SrcPort: 45678, DstPort: 8001, Seq: 1, PSH: true, ACK: true}
+		var ip gopacket.SerializableLayer
+		var first gopacket.LayerType
+		if ipv6 {
+			ip6 := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolTCP, SrcIP: net.ParseIP("::1"), DstIP: net.ParseIP("::2")}
+			tcp.SetNetworkLayerForChecksum(ip6)
+			ip, first = ip6, layers.LayerTypeIPv6
+		} else {
+			ip4 := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: net.IPv4(192, 168, 1, 2), DstIP: net.IPv4(192, 168, 1, 3)}
+			tcp.SetNetworkLayerForChecksum(ip4)
+			ip, first = ip4, layers.LayerTypeIPv4
+		}
+		buf := gopacket.NewSerializeBuffer()
+		opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+		if err := gopacket.SerializeLayers(buf, opts, ip, tcp, gopacket.Payload(payload)); err != nil {
+			t.Fatal(err)
+		}
+		return gopacket.NewPacket(buf.Bytes(), first, decodeOpts)
+	}
+	for _, ipv6 := range []bool{false, true} {
+		pckt, _ := ParsePacket(serialize(ipv6, "GET / HTTP/1.1\r\n\r"))
+		if !pckt.ValidChecksum() {
+			t.Errorf("expected checksum to be valid, ipv6: %t", ipv6)
+		}
+		pckt.Payload[0] = 'P'
+		if pckt.ValidChecksum() {
+			t.Errorf("expected checksum to be invalid, ipv6: %t", ipv6)
+		}
+	}
+
+	var mssg = make(chan *Message, 2)
+	p := NewMessagePool(1<<20, time.Second, nil, func(m *Message) { mssg <- m })
+	p.ValidateChecksum = true
+	p.SetHints("http")
+	p.Handler(GetPackets(1, 1, []byte("GET / HTTP/1.1\r\n\r\n"))[0]) // no checksum
+	p.Handler(serialize(false, "GET / HTTP/1.1\r\n\r\n"))
+	p.Close()
+	if len(mssg) != 1 {
+		t.Errorf("expected the packet with no checksum to be dropped, got %d messages", len(mssg))
+	}
+}
+
+func TestMessageSuperSegments(t *testing.T) {
+	var mssg = make(chan *Message, 1)
+	p := NewMessagePool(1<<20, time.Second, nil, func(m *Message) { mssg <- m })
+	p.SetHints("http")
+	body := bytes.Repeat([]byte("a"), 60000)
+	head := fmt.Sprintf("POST / HTTP/1.1\r\nContent-Length: %d\r\n\r\n", 2*len(body)+1)
+	for _, v := range GetSegments(1, head, string(body), string(body), "a") {
+		p.Handler(v)
+	}
+	m := <-mssg
+	if m.Length != len(head)+2*len(body)+1 || m.LostData != 0 {
+		t.Errorf("expected super segments to be assembled whole, got %d bytes, %d lost", m.Length, m.LostData)
+	}
+}
+
+func TestMessageSYN(t *testing.T) {
+	var mssg = make(chan *Message, 4)
+	p := NewMessagePool(1<<20, time.Second, nil, func(m *Message) { mssg <- m })
+	packets := GetSegments(1, "", "", "GET / HTTP/1.1\r\n\r\n", "")
+	packets[0].Data()[14:][20:][13] = 2 // SYN flag
+	packets[1] = GetPackets(1, 1, nil)[0]
+	packets[1].Data()[14:][20:][13] = 2 // retransmitted SYN
+	packets[3] = GetPackets(100, 1, nil)[0]
+	packets[3].Data()[14:][20:][13] = 2 // SYN of a new connection on the same ports
+	for i, v := range packets {
+		v.Metadata().Timestamp = time.Unix(int64(i+1), 0)
+		p.Handler(v)
+	}
+	m := <-mssg
+	if len(m.packets) != 2 || !m.IsIncoming || m.Start.Unix() != 1 || m.End.Unix() != 3 {
+		t.Errorf("expected retransmitted SYN to be ignored, got %d packets", len(m.packets))
+	}
+	p.Close()
+	if m = <-mssg; len(m.packets) != 1 || m.packets[0].Seq != 100 {
+		t.Error("expected a new message for the new connection")
+	}
+
+	// simultaneous open
+	p = NewMessagePool(1<<20, time.Second, nil, func(m *Message) { mssg <- m })
+	syn := GetPackets(1, 1, nil)[0]
+	syn.Data()[14:][20:][13] = 2
+	peer := GetPackets(500, 1, nil)[0]
+	ip := peer.Data()[14:]
+	copy(ip[12:16], []byte{192, 168, 1, 3})
+	copy(ip[16:20], []byte{192, 168, 1, 2})
+	binary.BigEndian.PutUint16(ip[20:], 8001)
+	binary.BigEndian.PutUint16(ip[22:], 45678)
+	ip[20:][13] = 2
+	peer = gopacket.NewPacket(peer.Data(), layers.LinkTypeEthernet, decodeOpts)
+	p.Handler(syn)
+	p.Handler(peer)
+	p.Close()
+	in, out := <-mssg, <-mssg
+	if in.IsIncoming == out.IsIncoming || !bytes.Equal(in.UUID(), out.UUID()) {
+		t.Error("expected the second SYN of a simultaneous open to be taken as the answer")
+	}
+}
+
+func TestMessagePoolSnapshot(t *testing.T) {
+	p := NewMessagePool(1<<20, time.Second, nil, func(m *Message) {})
+	packets := GetSegments(1, "", "GET / HTTP/1.1\r\n")
+	packets[0].Data()[14:][20:][13] = 2 // SYN flag
+	for _, v := range packets {
+		v.Metadata().Timestamp = time.Now().Add(-time.Hour)
+		p.Handler(v)
+	}
+	snap := p.Snapshot()
+	p.Close()
+	if len(snap.Sessions) != 1 || snap.Size != 16 {
+		t.Fatalf("expected 1 session of 16 bytes, got %d sessions of %d bytes", len(snap.Sessions), snap.Size)
+	}
+	if s := snap.Sessions[0]; s.SrcAddr != "192.168.1.2:45678" || s.Length != 16 || s.Packets != 2 || !s.IsIncoming {
+		t.Errorf("unexpected session %+v", s)
+	}
+	// the packets were captured an hour ago, but handled just now
+	if s := snap.Sessions[0]; s.Idle < 0 || s.Idle > s.Age || s.Age > time.Second {
+		t.Errorf("expected the age and idle time since the packets were handled, got %v and %v", s.Age, s.Idle)
+	}
+	if len(p.Snapshot().Sessions) != 0 {
+		t.Error("expected no session after close")
+	}
+}
+
+func TestMessagePoolSlowHandler(t *testing.T) {
+	handling, release := make(chan *Message), make(chan struct{})
+	p := NewMessagePool(1<<20, time.Second, nil, func(m *Message) {
+		handling <- m
+		<-release
+	})
+	p.Start = func(*Packet) (bool, bool) { return true, false }
+	p.End = func(m *Message) bool { return true }
+	packet := GetSegments(1, "GET / HTTP/1.1\r\n\r\n")[0]
+	go p.Handler(packet)
+	<-handling
+
+	// the shard of the message is not locked while the handler runs
+	done := make(chan Snapshot)
+	go func() { done <- p.Snapshot() }()
+	select {
+	case snap := <-done:
+		if len(snap.Sessions) != 0 {
+			t.Errorf("expected no session, got %d", len(snap.Sessions))
+		}
+	case <-time.After(time.Second):
+		t.Error("the shard is locked while the handler runs")
+	}
+	close(release)
+	p.Close()
+}
+
+func TestMessageUUIDMode(t *testing.T) {
+	for _, mode := range []UUIDMode{UUIDAddress, UUIDConnection} {
+		var mssg = make(chan *Message, 3)
+		p := NewMessagePool(1<<20, time.Second, nil, func(m *Message) { mssg <- m })
+		p.UUID = mode
+		for _, seq := range []uint32{1, 1000} {
+			packets := GetSegments(seq, "", "GET / HTTP/1.1\r\n\r\n")
+			packets[0].Data()[14:][20:][13] = 2 // SYN flag
+			for _, v := range packets {
+				p.Handler(v)
+			}
+		}
+		// the SYN-ACK of the second connection
+		synack := GetPackets(500, 1, nil)[0]
+		ip := synack.Data()[14:]
+		copy(ip[12:16], []byte{192, 168, 1, 3})
+		copy(ip[16:20], []byte{192, 168, 1, 2})
+		binary.BigEndian.PutUint16(ip[20:], 8001)
+		binary.BigEndian.PutUint16(ip[22:], 45678)
+		ip[20:][13] = 0x12
+		p.Handler(gopacket.NewPacket(synack.Data(), layers.LinkTypeEthernet, decodeOpts))
+		p.Close()
+		first, second, response := <-mssg, <-mssg, <-mssg
+		if second.IsIncoming {
+			second, response = response, second
+		}
+		if !bytes.Equal(second.UUID(), response.UUID()) {
+			t.Errorf("expected request and response to have the same UUID, mode %s", &mode)
+		}
+		if bytes.Equal(first.UUID(), second.UUID()) != (mode == UUIDAddress) {
+			t.Errorf("unexpected UUID of connections reusing the same ports, mode %s", &mode)
+		}
+	}
+}
+
+func TestMessagePoolIdleExpire(t *testing.T) {
+	var mssg = make(chan *Message, 2)
+	p := NewMessagePool(1<<20, time.Hour, nil, func(m *Message) { mssg <- m })
+	p.SetIdleExpire(time.Millisecond*100, time.Millisecond*50)
+	packets := GetSegments(1, "", "GET / HTTP/1.1\r\n")
+	packets[0].Data()[14:][20:][13] = 2 // SYN flag
+	half := GetPackets(1000, 1, nil)[0]
+	ip := half.Data()[14:]
+	binary.BigEndian.PutUint16(ip[20:], 45679)
+	ip[20:][13] = 2 // SYN flag
+	half = gopacket.NewPacket(half.Data(), layers.LinkTypeEthernet, decodeOpts)
+	p.Handler(packets[0])
+	p.Handler(packets[1])
+	p.Handler(half)
+	select {
+	case m := <-mssg:
+		if !m.TimedOut || m.Length != 16 {
+			t.Errorf("expected idle message to time out, got %q", m.Data())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected idle message to be dispatched")
+	}
+	time.Sleep(time.Millisecond * 50)
+	if len(mssg) != 0 || len(p.Snapshot().Sessions) != 0 {
+		t.Error("expected half-open message to be dropped")
+	}
+	p.Close()
+}
+
+// tcpPacket returns a packet from src to dst, with the SYN and ACK flags, and the option opt if not nil
+func tcpPacket(t *testing.T, src, dst string, seq uint32, syn, ack bool, opt []byte, payload string) gopacket.Packet {
+	srcIP, srcPort, _ := net.SplitHostPort(src)
+	dstIP, dstPort, _ := net.SplitHostPort(dst)
+	sport, _ := strconv.Atoi(srcPort)
+	dport, _ := strconv.Atoi(dstPort)
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: net.ParseIP(srcIP), DstIP: net.ParseIP(dstIP)}
+	tcp := &layers.TCP{SrcPort: layers.TCPPort(sport), DstPort: layers.TCPPort(dport), Seq: seq, SYN: syn, ACK: ack}
+	if opt != nil {
+		tcp.Options = []layers.TCPOption{{OptionType: tcpOptionMPTCP, OptionLength: uint8(len(opt) + 2), OptionData: opt}}
+	}
+	tcp.SetNetworkLayerForChecksum(ip)
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, ip, tcp, gopacket.Payload(payload)); err != nil {
+		t.Fatal(err)
+	}
+	return gopacket.NewPacket(buf.Bytes(), layers.LayerTypeIPv4, decodeOpts)
+}
+
+func TestMessageMPTCP(t *testing.T) {
+	var mssg = make(chan *Message, 2)
+	p := NewMessagePool(1<<20, time.Second, nil, func(m *Message) { mssg <- m })
+	p.SetHints("http")
+	p.MPTCP = true
+	client1, client2, server := "192.168.1.2:45678", "192.168.1.2:45679", "192.168.1.3:8001"
+	keyA, keyB := []byte("keyAkeyA"), []byte("keyBkeyB")
+	var token [4]byte
+	binary.BigEndian.PutUint32(token[:], keyToken(keyB))
+	dss := func(dsn, ssn uint32, length uint16) []byte {
+		opt := []byte{mpDSS << 4, 0x04, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(opt[2:], dsn)
+		binary.BigEndian.PutUint32(opt[6:], ssn)
+		binary.BigEndian.PutUint16(opt[10:], length)
+		return opt
+	}
+	response := "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"
+	packets := []gopacket.Packet{
+		tcpPacket(t, client1, server, 1000, true, false, append([]byte{mpCapable << 4, 0x81}, keyA...), ""),
+		tcpPacket(t, server, client1, 5000, true, true, append([]byte{mpCapable << 4, 0x81}, keyB...), ""),
+		tcpPacket(t, client2, server, 9000, true, false, append([]byte{mpJoin << 4, 1}, append(token[:], 0, 0, 0, 0)...), ""),
+		tcpPacket(t, server, client2, 7000, true, true, append([]byte{mpJoin << 4, 1}, make([]byte, 12)...), ""),
+		tcpPacket(t, client1, server, 1001, false, true, dss(100, 1, 16), "GET / HTTP/1.1\r\n"),
+		tcpPacket(t, client2, server, 9001, false, true, dss(116, 1, 11), "Host: a\r\n\r\n"),
+		tcpPacket(t, server, client2, 7001, false, true, dss(50, 1, uint16(len(response))), response),
+	}
+	for _, v := range packets {
+		p.Handler(v)
+	}
+	p.Close()
+	req, resp := <-mssg, <-mssg
+	if string(req.Data()) != "GET / HTTP/1.1\r\nHost: a\r\n\r\n" || req.SrcAddr != client1 || !req.IsIncoming {
+		t.Errorf("expected the request to be reassembled from both subflows, got %q from %s", req.Data(), req.SrcAddr)
+	}
+	if string(resp.Data()) != response || resp.DstAddr != client1 || !bytes.Equal(req.UUID(), resp.UUID()) {
+		t.Errorf("expected the response to be moved to the first subflow, got %q to %s", resp.Data(), resp.DstAddr)
+	}
+}
+
+func TestMessageFastOpen(t *testing.T) {
+	for _, hints := range []string{"binary", "http"} {
+		var mssg = make(chan *Message, 2)
+		p := NewMessagePool(1<<20, time.Second, nil, func(m *Message) { mssg <- m })
+		p.SetHints(hints)
+		client, server := "192.168.1.2:45678", "192.168.1.3:8001"
+		p.Handler(tcpPacket(t, client, server, 1000, true, false, nil, "GET / HTTP/1.1\r\n"))
+		// the data of the SYN retransmitted after the handshake
+		p.Handler(tcpPacket(t, client, server, 1001, false, true, nil, "GET / HTTP/1.1\r\n"))
+		p.Handler(tcpPacket(t, client, server, 1017, false, true, nil, "\r\n"))
+		p.Close()
+		if m := <-mssg; string(m.Data()) != "GET / HTTP/1.1\r\n\r\n" || !m.IsIncoming {
+			t.Errorf("expected the data of the SYN to be in the message, got %q with %s hints", m.Data(), hints)
+		}
+	}
+}
+
+// vlanPacket encapsulates the IPv4 packet in an ethernet frame with the 802.1Q tags ids, outermost first
+func vlanPacket(t *testing.T, packet gopacket.Packet, ids ...uint16) gopacket.Packet {
+	eth := &layers.Ethernet{SrcMAC: net.HardwareAddr{0, 1, 2, 3, 4, 5}, DstMAC: net.HardwareAddr{0, 1, 2, 3, 4, 6}, EthernetType: layers.EthernetTypeIPv4}
+	serializable := []gopacket.SerializableLayer{eth}
+	for i, id := range ids {
+		if i == 0 {
+			eth.EthernetType = layers.EthernetTypeDot1Q
+			if len(ids) > 1 {
+				eth.EthernetType = layers.EthernetTypeQinQ
+			}
+		}
+		tag := &layers.Dot1Q{VLANIdentifier: id, Type: layers.EthernetTypeDot1Q}
+		if i == len(ids)-1 {
+			tag.Type = layers.EthernetTypeIPv4
+		}
+		serializable = append(serializable, tag)
+	}
+	serializable = append(serializable, gopacket.Payload(packet.Data()))
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{}, serializable...); err != nil {
+		t.Fatal(err)
+	}
+	return gopacket.NewPacket(buf.Bytes(), layers.LayerTypeEthernet, decodeOpts)
+}
+
+func TestMessageVLAN(t *testing.T) {
+	client, server := "192.168.1.2:45678", "192.168.1.3:8001"
+	pckt, err := ParsePacket(vlanPacket(t, tcpPacket(t, client, server, 1000, false, true, nil, "a"), 100, 200))
+	if err != nil || pckt == nil || len(pckt.VLAN) != 2 || pckt.VLAN[0] != 100 || pckt.VLAN[1] != 200 || string(pckt.Payload) != "a" {
+		t.Fatalf("expected a packet of vlans [100 200], got %v %v", pckt, err)
+	}
+	var vlans VLANs
+	if err = vlans.Set("200, 300"); err != nil || vlans.String() != "200,300" {
+		t.Errorf("expected vlans 200,300 got %s %v", vlans.String(), err)
+	}
+	if vlans.Set("4096") == nil {
+		t.Error("expected an error for vlan 4096")
+	}
+	var mssg = make(chan *Message, 3)
+	p := NewMessagePool(1<<20, time.Second, nil, func(m *Message) { mssg <- m })
+	p.SetHints("http")
+	p.VLANs = vlans
+	p.Handler(vlanPacket(t, tcpPacket(t, client, server, 1000, false, true, nil, "GET /qinq HTTP/1.1\r\n\r\n"), 100, 200))
+	p.Handler(vlanPacket(t, tcpPacket(t, client, "192.168.1.3:8002", 1000, false, true, nil, "GET /vlan HTTP/1.1\r\n\r\n"), 300))
+	p.Handler(vlanPacket(t, tcpPacket(t, client, "192.168.1.3:8003", 1000, false, true, nil, "GET /other HTTP/1.1\r\n\r\n"), 100))
+	p.Handler(tcpPacket(t, client, "192.168.1.3:8004", 1000, false, true, nil, "GET /untagged HTTP/1.1\r\n\r\n"))
+	p.Close()
+	close(mssg)
+	var data []string
+	for m := range mssg {
+		data = append(data, string(m.Data()))
+	}
+	sort.Strings(data)
+	if len(data) != 2 || data[0] != "GET /qinq HTTP/1.1\r\n\r\n" || data[1] != "GET /vlan HTTP/1.1\r\n\r\n" {
+		t.Errorf("expected the messages of vlans 200 and 300, got %q", data)
+	}
+}
+
+// tunnelPacket encapsulates the inner packet in an IPv4 packet with the outer layers
+func tunnelPacket(t *testing.T, inner []byte, outer ...gopacket.SerializableLayer) gopacket.Packet {
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, append(outer, gopacket.Payload(inner))...); err != nil {
+		t.Fatal(err)
+	}
+	return gopacket.NewPacket(buf.Bytes(), layers.LayerTypeIPv4, decodeOpts)
+}
+
+func TestMessageTunnels(t *testing.T) {
+	outer := func(proto layers.IPProtocol) *layers.IPv4 {
+		return &layers.IPv4{Version: 4, TTL: 64, Protocol: proto, SrcIP: net.IP{10, 0, 0, 1}, DstIP: net.IP{10, 0, 0, 2}}
+	}
+	request := func(path string, port int) []byte {
+		return tcpPacket(t, "192.168.1.2:"+strconv.Itoa(port), "192.168.1.3:8001", 1000, false, true, nil, "GET /"+path+" HTTP/1.1\r\n\r\n").Data()
+	}
+	geneve := func(vni uint32) []byte {
+		return []byte{0, 0, 0x08, 0x00, byte(vni >> 16), byte(vni >> 8), byte(vni), 0}
+	}
+	packets := []gopacket.Packet{
+		tunnelPacket(t, vlanPacket(t, gopacket.NewPacket(request("vxlan", 1), layers.LayerTypeIPv4, decodeOpts)).Data(),
+			outer(layers.IPProtocolUDP), &layers.UDP{SrcPort: 50000, DstPort: 4789}, &layers.VXLAN{ValidIDFlag: true, VNI: 10}),
+		tunnelPacket(t, request("gre", 2), outer(layers.IPProtocolGRE), &layers.GRE{KeyPresent: true, Key: 10, Protocol: layers.EthernetTypeIPv4}),
+		tunnelPacket(t, append(geneve(10), request("geneve", 3)...), outer(layers.IPProtocolUDP), &layers.UDP{SrcPort: 50000, DstPort: 6081}),
+		tunnelPacket(t, request("ipip", 4), outer(layers.IPProtocolIPv4)),
+		tunnelPacket(t, request("gtp", 7), outer(layers.IPProtocolUDP), &layers.UDP{SrcPort: 2152, DstPort: 2152},
+			&layers.GTPv1U{Version: 1, ProtocolType: 1, MessageType: 255, TEID: 10}),
+		// filtered by id
+		tunnelPacket(t, request("gre-20", 5), outer(layers.IPProtocolGRE), &layers.GRE{KeyPresent: true, Key: 20, Protocol: layers.EthernetTypeIPv4}),
+		tunnelPacket(t, request("gtp-20", 8), outer(layers.IPProtocolUDP), &layers.UDP{SrcPort: 2152, DstPort: 2152},
+			&layers.GTPv1U{Version: 1, ProtocolType: 1, MessageType: 255, TEID: 20}),
+		// not a G-PDU
+		tunnelPacket(t, request("gtp-echo", 9), outer(layers.IPProtocolUDP), &layers.UDP{SrcPort: 2152, DstPort: 2152},
+			&layers.GTPv1U{Version: 1, ProtocolType: 1, MessageType: 1, TEID: 10}),
+		// filtered by port
+		tunnelPacket(t, tcpPacket(t, "192.168.1.2:6", "192.168.1.3:8002", 1000, false, true, nil, "GET /port HTTP/1.1\r\n\r\n").Data(), outer(layers.IPProtocolIPv4)),
+	}
+	var tunnels Tunnels
+	if err := tunnels.Set("vxlan,gre, geneve"); err != nil || tunnels.String() != "vxlan,gre,geneve" {
+		t.Errorf("expected vxlan,gre,geneve tunnels, got %s %v", tunnels.String(), err)
+	}
+	tunnels.Set("ipip,gtp")
+	for _, c := range []struct {
+		tunnels  Tunnels
+		expected []string
+	}{
+		{tunnels, []string{"geneve", "gre", "gtp", "ipip", "vxlan"}},
+		{TunnelVXLAN, []string{"vxlan"}},
+	} {
+		var mssg = make(chan *Message, len(packets))
+		p := NewMessagePool(1<<20, time.Second, nil, func(m *Message) { mssg <- m })
+		p.SetHints("http")
+		p.Tunnels = c.tunnels
+		p.TunnelIDs = TunnelIDs{10}
+		p.TunnelPort = 8001
+		for _, packet := range packets {
+			p.Handler(packet)
+		}
+		p.Close()
+		close(mssg)
+		var paths []string
+		for m := range mssg {
+			if !strings.HasPrefix(m.SrcAddr, "192.168.1.2:") || !m.IsIncoming {
+				t.Errorf("expected a request of the inner connection, got one from %s", m.SrcAddr)
+			}
+			paths = append(paths, strings.Fields(string(m.Data()))[1][1:])
+		}
+		sort.Strings(paths)
+		if strings.Join(paths, ",") != strings.Join(c.expected, ",") {
+			t.Errorf("expected the requests %q with %s tunnels, got %q", c.expected, c.tunnels.String(), paths)
+		}
+	}
+}
+
+func TestMessageERSPAN(t *testing.T) {
+	outer := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolGRE, SrcIP: net.IP{10, 0, 0, 1}, DstIP: net.IP{10, 0, 0, 2}}
+	frame := func(path string, port int) []byte {
+		request := tcpPacket(t, "192.168.1.2:"+strconv.Itoa(port), "192.168.1.3:8001", 1000, false, true, nil, "GET /"+path+" HTTP/1.1\r\n\r\n")
+		return vlanPacket(t, request).Data()
+	}
+	now := time.Now()
+	// 100ns ticks of a switch clock one second behind
+	ticks := uint32(now.Add(-time.Second).UnixNano() / 100)
+	type2 := func(session uint16) []byte {
+		return []byte{0x10, 0, byte(session >> 8), byte(session), 0, 0, 0, 0}
+	}
+	type3 := []byte{0x20, 0, 0, 7, byte(ticks >> 24), byte(ticks >> 16), byte(ticks >> 8), byte(ticks), 0, 0, 0, 1 << 1}
+	packets := []gopacket.Packet{
+		tunnelPacket(t, frame("type1", 1), outer, &layers.GRE{Protocol: ethernetTypeERSPAN}),
+		tunnelPacket(t, append(type2(7), frame("type2", 2)...), outer, &layers.GRE{SeqPresent: true, Protocol: ethernetTypeERSPAN}),
+		tunnelPacket(t, append(type2(8), frame("session8", 3)...), outer, &layers.GRE{SeqPresent: true, Protocol: ethernetTypeERSPAN}),
+		tunnelPacket(t, append(type3, frame("type3", 4)...), outer, &layers.GRE{SeqPresent: true, Protocol: ethernetTypeERSPAN3}),
+	}
+	for _, c := range []struct {
+		ids      TunnelIDs
+		expected string
+	}{
+		{nil, "session8,type1,type2,type3"},
+		{TunnelIDs{7}, "type2,type3"},
+	} {
+		var mssg = make(chan *Message, len(packets))
+		p := NewMessagePool(1<<20, time.Second, nil, func(m *Message) { mssg <- m })
+		p.SetHints("http")
+		p.Tunnels = TunnelERSPAN
+		p.TunnelIDs = c.ids
+		p.TunnelTimestamps = true
+		for _, packet := range packets {
+			packet.Metadata().Timestamp = now
+			p.Handler(packet)
+		}
+		p.Close()
+		close(mssg)
+		var paths []string
+		for m := range mssg {
+			path := strings.Fields(string(m.Data()))[1][1:]
+			paths = append(paths, path)
+			switch {
+			case path == "type3" && m.Start.Sub(now.Add(-time.Second)).Round(time.Microsecond) != 0:
+				t.Errorf("expected the time of the switch %s, got %s", now.Add(-time.Second), m.Start)
+			case path != "type3" && !m.Start.Equal(now):
+				t.Errorf("expected the capture time %s, got %s", now, m.Start)
+			}
+		}
+		sort.Strings(paths)
+		if strings.Join(paths, ",") != c.expected {
+			t.Errorf("expected the requests %s with ids %v, got %q", c.expected, c.ids, paths)
+		}
+	}
+}
+
+func TestERSPANTime(t *testing.T) {
+	now := time.Unix(1700000000, 999999000)
+	for _, c := range []struct {
+		ts          uint32
+		granularity uint8
+		expected    time.Time
+	}{
+		{uint32(now.UnixNano() / 100), 1, now},
+		{uint32(now.Add(-time.Minute).UnixNano() / 100), 1, now.Add(-time.Minute)},
+		{uint32(now.Add(time.Hour).UnixNano() / int64(100*time.Microsecond)), 0, now.Add(time.Hour).Truncate(100 * time.Microsecond)},
+		{1000, 2, time.Unix(1700000001, 1000)},
+		{5, 3, now},
+	} {
+		if ts := erspanTime(c.ts, c.granularity, now); !ts.Equal(c.expected) {
+			t.Errorf("expected %s with granularity %d, got %s", c.expected, c.granularity, ts)
+		}
+	}
+}
+
+func TestMessageDataOnDemand(t *testing.T) {
+	m := NewMessage("src", "dst", 4)
+	packets := GetSegments(1, "GET / HTTP/1.1\r\n", "Host: ", "localhost\r\n")
+	packets[0], packets[1] = packets[1], packets[0] // out of order
+	for _, v := range packets {
+		pckt, _ := ParsePacket(v)
+		i, _, _ := m.segment(pckt, OverlapFirstWins)
+		m.add(i, pckt)
+		m.Data()
+	}
+	chunks := m.Chunks()
+	if len(chunks) != 3 || string(chunks[0]) != "GET / HTTP/1.1\r\n" {
+		t.Errorf("expected chunks to be ordered, got %q", chunks)
+	}
+	expected := "GET / HTTP/1.1\r\nHost: localhost\r\n"
+	if string(m.Data()) != expected {
+		t.Errorf("expected %q to equal %q", m.Data(), expected)
+	}
+	m.Release()
+	if string(m.Data()) != expected {
+		t.Errorf("expected %q to equal %q after release", m.Data(), expected)
+	}
+}
+
+func TestChunk(t *testing.T) {
+	for _, n := range []int{0, 1, minChunk, minChunk + 1, maxChunk, maxChunk + 1} {
+		b := getChunk(n)
+		if len(b) != 0 || cap(b) < n {
+			t.Errorf("expected empty chunk of at least %d bytes, got len %d cap %d", n, len(b), cap(b))
+		}
+		putChunk(b)
+	}
+}
+
+func TestMessageUUID(t *testing.T) {
+	m1 := &Message{}
+	m1.IsIncoming = true
+	m1.SrcAddr = "src"
+	m1.DstAddr = "dst"
+	m2 := &Message{}
+	m2.SrcAddr = "dst"
+	m2.DstAddr = "src"
+	if string(m1.UUID()) != string(m2.UUID()) {
+		t.Errorf("expected %s, to equal %s", m1.UUID(), m2.UUID())
+	}
+}
+
+func BenchmarkPacketParseAndSort(b *testing.B) {
+	if b.N < 3 {
+		return
+	}
+	now := time.Now()
+	m := new(Message)
+	m.packets = make([]*Packet, b.N)
+	for i, v := range GetPackets(1, b.N, nil) {
+		m.packets[i], _ = ParsePacket(v)
+	}
+	m.Sort()
+	b.Logf("%d packets in %s", b.N, time.Since(now))
+}
+
+func BenchmarkMessageParserWithoutHint(b *testing.B) {
+	var mssg = make(chan *Message, 1)
+	if b.N < 3 {
+		return
+	}
+	now := time.Now()
+	n := b.N
+	packets := GetPackets(1, n, nil)
+	packets[0].Data()[14:][20:][13] = 2     // SYN flag
+	packets[b.N-1].Data()[14:][20:][13] = 1 // FIN flag
+	p := NewMessagePool(1<<20, time.Second*2, nil, func(m *Message) {
+		b.Logf("%d/%d packets in %s", len(m.packets), n, time.Since(now))
+		mssg <- m
+	})
+	for _, v := range packets {
+		p.Handler(v)
+	}
+	<-mssg
+}
+
+func BenchmarkMessageParserWithHint(b *testing.B) {
+	if b.N < 3 {
+		return
+	}
+	now := time.Now()
+	n := b.N
+	var mssg = make(chan *Message, 1)
+	payload := make([]byte, 0xfc00)
+	for i := 0; i < 0xfc00; i++ {
+		payload[i] = '1'
+	}
+	pool := NewMessagePool(1<<30, time.Second*10, nil, func(m *Message) { mssg <- m })
+	pool.Start = func(pckt *Packet) (bool, bool) {
+		return proto.HasRequestTitle(pckt.Payload), proto.HasResponseTitle(pckt.Payload)
+	}
+	pool.End = func(m *Message) bool {
+		return proto.HasFullPayload(m.Data())
+	}
+	d := []byte("POST / HTTP/1.1\r\nContent-Type: text/plain\r\nTransfer-Encoding: chunked\r\n\r\n")
+	pool.Handler(GetPackets(1, 1, d)[0])
+	seq := 1 + uint32(len(d))
+	i := 0
+	for {
+		select {
+		case m := <-mssg:
+			b.Logf("%d/%d packets, %dbytes, truncated: %v, timedout: %v in %s", len(m.packets), n, m.Length, m.Truncated, m.TimedOut, time.Since(now))
+			return
+		default:
+			if i > n-2 {
+				break
+			} else if i < n-2 {
+				d = []byte(fmt.Sprintf("fc00\r\n%s\r\n", payload))
+			} else {
+				d = []byte("0\r\n\r\n")
+			}
+			pool.Handler(GetPackets(seq, 1, d)[0])
+			seq += uint32(len(d))
+			i++
+		}
+	}
+}
+
+func sllPacket(packet gopacket.Packet, packetType layers.LinuxSLLPacketType) gopacket.Packet {
+	var header [16]byte
+	binary.BigEndian.PutUint16(header[0:], uint16(packetType))
+	binary.BigEndian.PutUint16(header[2:], 1)
+	binary.BigEndian.PutUint16(header[4:], 6)
+	copy(header[6:], []byte{0, 1, 2, 3, 4, 5})
+	binary.BigEndian.PutUint16(header[14:], uint16(layers.EthernetTypeIPv4))
+	return gopacket.NewPacket(append(header[:], packet.Data()...), layers.LinkTypeLinuxSLL, decodeOpts)
+}
+
+func TestMessageLinuxSLL(t *testing.T) {
+	client, server := "192.168.1.2:45678", "192.168.1.3:8001"
+	pckt, err := ParsePacket(sllPacket(tcpPacket(t, client, server, 1000, false, true, nil, "a"), layers.LinuxSLLPacketTypeHost))
+	if err != nil || pckt == nil || string(pckt.Payload) != "a" {
+		t.Fatalf("expected a packet, got %v %v", pckt, err)
+	}
+	if in, known := pckt.Incoming(); !in || !known {
+		t.Errorf("expected an incoming packet, got %t %t", in, known)
+	}
+	var mssg = make(chan *Message, 3)
+	p := NewMessagePool(1<<20, time.Second, nil, func(m *Message) { mssg <- m })
+	p.Handler(sllPacket(tcpPacket(t, client, server, 1000, false, true, nil, "request"), layers.LinuxSLLPacketTypeHost))
+	p.Handler(sllPacket(tcpPacket(t, server, client, 2000, false, true, nil, "response"), layers.LinuxSLLPacketTypeOutgoing))
+	p.Handler(sllPacket(tcpPacket(t, "192.168.1.4:45678", server, 1000, false, true, nil, "other"), layers.LinuxSLLPacketTypeOtherhost))
+	p.Handler(tcpPacket(t, "192.168.1.5:45678", server, 1000, false, true, nil, "unknown"))
+	p.Close()
+	close(mssg)
+	var data []string
+	for m := range mssg {
+		data = append(data, fmt.Sprintf("%s %t", m.Data(), m.IsIncoming))
+	}
+	sort.Strings(data)
+	if len(data) != 2 || data[0] != "request true" || data[1] != "response false" {
+		t.Errorf("expected an incoming request and an outgoing response, got %q", data)
+	}
+}
+
+func TestSampling(t *testing.T) {
+	var s Sampling
+	for _, v := range []string{"0/10", "11/10", "1/0", "10", "101%", "a/b"} {
+		if s.Set(v) == nil {
+			t.Errorf("expected an error for %q", v)
+		}
+	}
+	if err := s.Set("25%"); err != nil || s.Keep != 25 || s.Of != 100 || s.String() != "25%" {
+		t.Errorf("expected 25%%, got %s %v", s.String(), err)
+	}
+	if err := s.Set("1/2"); err != nil || s.Keep != 1 || s.Of != 2 || s.String() != "1/2" {
+		t.Errorf("expected 1/2, got %s %v", s.String(), err)
+	}
+	var mssg = make(chan *Message, 64)
+	p := NewMessagePool(1<<20, time.Second, nil, func(m *Message) { mssg <- m })
+	p.SetHints("http")
+	p.Sampling = s
+	for port := 40000; port < 40032; port++ {
+		client := fmt.Sprintf("192.168.1.2:%d", port)
+		p.Handler(tcpPacket(t, client, "192.168.1.3:80", 1000, false, true, nil, "GET / HTTP/1.1\r\n\r\n"))
+		p.Handler(tcpPacket(t, "192.168.1.3:80", client, 2000, false, true, nil, "HTTP/1.1 200 OK\r\n\r\n"))
+	}
+	p.Close()
+	close(mssg)
+	var requests, responses int
+	for m := range mssg {
+		pckt := m.Packets()[0]
+		if tupleHash(pckt.SrcIP(), pckt.DstIP(), uint16(pckt.SrcPort), uint16(pckt.DstPort))%2 != 0 {
+			t.Errorf("unexpected message from %s to %s", m.SrcAddr, m.DstAddr)
+		}
+		if m.IsIncoming {
+			requests++
+		} else {
+			responses++
+		}
+	}
+	if requests != 16 || responses != 16 {
+		t.Errorf("expected 16 requests and responses, got %d and %d", requests, responses)
+	}
+}
+
+// sctpChunk returns a chunk padded to 4 bytes, data chunks are prefixed with their TSN, stream and PPID
+func sctpChunk(typ layers.SCTPChunkType, flags uint8, tsn uint32, stream uint16, data string) []byte {
+	var header []byte
+	if typ == layers.SCTPChunkTypeData {
+		header = make([]byte, 12)
+		binary.BigEndian.PutUint32(header, tsn)
+		binary.BigEndian.PutUint16(header[4:], stream)
+	}
+	chunk := append([]byte{byte(typ), flags, 0, 0}, header...)
+	chunk = append(chunk, data...)
+	binary.BigEndian.PutUint16(chunk[2:], uint16(len(chunk)))
+	for len(chunk)%4 != 0 {
+		chunk = append(chunk, 0)
+	}
+	return chunk
+}
+
+func sctpPacket(t *testing.T, src, dst string, chunks ...[]byte) gopacket.Packet {
+	srcIP, srcPort, _ := net.SplitHostPort(src)
+	dstIP, dstPort, _ := net.SplitHostPort(dst)
+	sp, _ := strconv.Atoi(srcPort)
+	dp, _ := strconv.Atoi(dstPort)
+	header := make([]byte, 12)
+	binary.BigEndian.PutUint16(header, uint16(sp))
+	binary.BigEndian.PutUint16(header[2:], uint16(dp))
+	for _, c := range chunks {
+		header = append(header, c...)
+	}
+	eth := &layers.Ethernet{SrcMAC: net.HardwareAddr{0, 0, 0, 0, 0, 1}, DstMAC: net.HardwareAddr{0, 0, 0, 0, 0, 2}, EthernetType: layers.EthernetTypeIPv4}
+	ip := &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolSCTP, SrcIP: net.ParseIP(srcIP), DstIP: net.ParseIP(dstIP)}
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, eth, ip, gopacket.Payload(header)); err != nil {
+		t.Fatal(err)
+	}
+	return gopacket.NewPacket(buf.Bytes(), layers.LinkTypeEthernet, decodeOpts)
+}
+
+func TestSCTPPool(t *testing.T) {
+	const client, server = "10.0.0.1:5000", "10.0.0.2:3868"
+	const begin, end = 2, 1
+	mssg := make(chan *Message, 10)
+	pool := NewSCTPPool(1<<20, time.Second, nil, func(m *Message) { mssg <- m })
+	defer pool.Close()
+
+	pckt, chunks, err := ParseSCTP(sctpPacket(t, client, server,
+		sctpChunk(layers.SCTPChunkTypeData, begin|end, 1, 0, "GET /a HTTP/1.1\r\n\r\n"),
+		sctpChunk(layers.SCTPChunkTypeData, begin, 2, 1, "GET /b")))
+	if err != nil || pckt == nil || len(chunks) != 2 {
+		t.Fatalf("expected the 2 bundled data chunks to be parsed, got %d, %v", len(chunks), err)
+	}
+	if pckt.Src() != client || chunks[1].TSN != 2 || chunks[1].Stream != 1 || string(chunks[1].Data) != "GET /b" || !chunks[1].Begin() || chunks[1].End() {
+		t.Errorf("unexpected chunk %+v from %s", chunks[1], pckt.Src())
+	}
+
+	// the direction is given by the INIT of the association
+	pool.Handler(sctpPacket(t, client, server, sctpChunk(layers.SCTPChunkTypeInit, 0, 0, 0, "")))
+	pool.Handler(sctpPacket(t, client, server,
+		sctpChunk(layers.SCTPChunkTypeData, begin|end, 1, 0, "GET /a HTTP/1.1\r\n\r\n"),
+		sctpChunk(layers.SCTPChunkTypeData, begin, 2, 1, "GET /b")))
+	// fragments of the user message of stream 1, out of order
+	pool.Handler(sctpPacket(t, client, server, sctpChunk(layers.SCTPChunkTypeData, end, 4, 1, "\r\n\r\n")))
+	pool.Handler(sctpPacket(t, client, server, sctpChunk(layers.SCTPChunkTypeData, 0, 3, 1, " HTTP/1.1")))
+	pool.Handler(sctpPacket(t, server, client, sctpChunk(layers.SCTPChunkTypeData, begin|end, 1, 0, "HTTP/1.1 200 OK\r\n\r\n")))
+
+	var got []*Message
+	for len(got) < 3 {
+		select {
+		case m := <-mssg:
+			got = append(got, m)
+		case <-time.After(time.Second):
+			t.Fatalf("expected 3 messages, got %d", len(got))
+		}
+	}
+	for i, want := range []string{"GET /a HTTP/1.1\r\n\r\n", "GET /b HTTP/1.1\r\n\r\n", "HTTP/1.1 200 OK\r\n\r\n"} {
+		if string(got[i].Data()) != want || got[i].IsIncoming != (i < 2) {
+			t.Errorf("expected message %d to be %q, incoming %v, got %q, incoming %v", i, want, i < 2, got[i].Data(), got[i].IsIncoming)
+		}
+	}
+	if !bytes.Equal(got[0].UUID(), got[2].UUID()) || bytes.Equal(got[0].UUID(), got[1].UUID()) {
+		t.Error("expected the messages of a stream to share their UUID, and the streams to have different ones")
+	}
+
+	// with hints, the user messages are added to the message until it is complete
+	if err = pool.SetHints("http"); err != nil {
+		t.Fatal(err)
+	}
+	pool.Handler(sctpPacket(t, client, server, sctpChunk(layers.SCTPChunkTypeData, begin|end, 5, 0, "POST / HTTP/1.1\r\nContent-Length: 4\r\n\r\n")))
+	pool.Handler(sctpPacket(t, client, server, sctpChunk(layers.SCTPChunkTypeData, begin|end, 6, 0, "ab")))
+	select {
+	case m := <-mssg:
+		t.Fatalf("expected the message to be incomplete, got %q", m.Data())
+	case <-time.After(50 * time.Millisecond):
+	}
+	pool.Handler(sctpPacket(t, client, server, sctpChunk(layers.SCTPChunkTypeData, begin|end, 7, 0, "cd")))
+	select {
+	case m := <-mssg:
+		if string(m.Data()) != "POST / HTTP/1.1\r\nContent-Length: 4\r\n\r\nabcd" || m.TimedOut {
+			t.Errorf("unexpected message %q", m.Data())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the complete message to be dispatched")
+	}
+
+	// ABORT dispatches the messages of the association
+	pool.Handler(sctpPacket(t, client, server, sctpChunk(layers.SCTPChunkTypeData, begin|end, 8, 2, "POST / HTTP/1.1\r\nContent-Length: 4\r\n\r\n")))
+	pool.Handler(sctpPacket(t, server, client, sctpChunk(layers.SCTPChunkTypeAbort, 0, 0, 0, "")))
+	select {
+	case m := <-mssg:
+		if !m.IsIncoming || m.Length == 0 {
+			t.Errorf("unexpected message %q", m.Data())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the message to be dispatched on abort")
+	}
+}
+
+func udpPacket(t *testing.T, src, dst string, at time.Time, payload string) gopacket.Packet {
+	srcIP, srcPort, _ := net.SplitHostPort(src)
+	dstIP, dstPort, _ := net.SplitHostPort(dst)
+	sp, _ := strconv.Atoi(srcPort)
+	dp, _ := strconv.Atoi(dstPort)
+	eth := &layers.Ethernet{SrcMAC: net.HardwareAddr{0, 0, 0, 0, 0, 1}, DstMAC: net.HardwareAddr{0, 0, 0, 0, 0, 2}, EthernetType: layers.EthernetTypeIPv4}
+	ip := &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: net.ParseIP(srcIP), DstIP: net.ParseIP(dstIP)}
+	udp := &layers.UDP{SrcPort: layers.UDPPort(sp), DstPort: layers.UDPPort(dp)}
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, eth, ip, udp, gopacket.Payload(payload)); err != nil {
+		t.Fatal(err)
+	}
+	packet := gopacket.NewPacket(buf.Bytes(), layers.LinkTypeEthernet, decodeOpts)
+	packet.Metadata().Timestamp = at
+	return packet
+}
+
+func TestUDPPool(t *testing.T) {
+	const client, server = "10.0.0.1:5353", "10.0.0.2:53"
+	mssg := make(chan *Message, 10)
+	now := time.Now()
+
+	// a message per datagram
+	pool := NewUDPPool(1<<20, 0, nil, func(m *Message) { mssg <- m })
+	pool.Port = 53
+	pool.Handler(udpPacket(t, client, server, now, "query"))
+	pool.Handler(udpPacket(t, server, client, now, "answer"))
+	pool.Handler(udpPacket(t, "10.0.0.1:5000", "10.0.0.2:5001", now, "other port"))
+	pool.Close()
+	if len(mssg) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(mssg))
+	}
+	req, resp := <-mssg, <-mssg
+	if string(req.Data()) != "query" || !req.IsIncoming || string(resp.Data()) != "answer" || resp.IsIncoming {
+		t.Errorf("unexpected messages %q(incoming %v) and %q(incoming %v)", req.Data(), req.IsIncoming, resp.Data(), resp.IsIncoming)
+	}
+	if !bytes.Equal(req.UUID(), resp.UUID()) {
+		t.Error("expected the answer to have the UUID of the query")
+	}
+
+	// datagrams aggregated by window of time and size
+	pool = NewUDPPool(10, 100*time.Millisecond, nil, func(m *Message) { mssg <- m })
+	defer pool.Close()
+	pool.Handler(udpPacket(t, client, server, now, "a"))
+	pool.Handler(udpPacket(t, client, server, now.Add(10*time.Millisecond), "b"))
+	pool.Handler(udpPacket(t, client, server, now.Add(200*time.Millisecond), "c"))
+	pool.Handler(udpPacket(t, client, server, now.Add(210*time.Millisecond), "0123456789"))
+	for _, want := range []string{"ab", "c", "0123456789"} {
+		select {
+		case m := <-mssg:
+			if string(m.Data()) != want {
+				t.Errorf("expected %q, got %q", want, m.Data())
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected message %q", want)
+		}
+	}
+}
+
+// http2Frames returns the frames of a header block and of the data of a stream
+func http2Frames(t *testing.T, enc *hpack.Encoder, block *bytes.Buffer, stream uint32, fields []hpack.HeaderField, body string) []byte {
+	block.Reset()
+	for _, f := range fields {
+		if err := enc.WriteField(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var flags uint8 = proto.HTTP2FlagEndHeaders
+	if body == "" {
+		flags |= proto.HTTP2FlagEndStream
+	}
+	data := proto.AppendHTTP2Frame(nil, proto.HTTP2Frame{Type: proto.HTTP2FrameHeaders, Flags: flags, Stream: stream, Payload: block.Bytes()})
+	if body != "" {
+		data = proto.AppendHTTP2Frame(data, proto.HTTP2Frame{Type: proto.HTTP2FrameData, Flags: proto.HTTP2FlagEndStream, Stream: stream, Payload: []byte(body)})
+	}
+	return data
+}
+
+func TestHTTP2Demuxer(t *testing.T) {
+	const client, server = "10.0.0.1:40000", "10.0.0.2:8080"
+	var reqBlock, respBlock bytes.Buffer
+	reqEnc, respEnc := hpack.NewEncoder(&reqBlock), hpack.NewEncoder(&respBlock)
+	get := []hpack.HeaderField{{Name: ":method", Value: "GET"}, {Name: ":scheme", Value: "http"}, {Name: ":path", Value: "/a"}, {Name: ":authority", Value: "example.com"}, {Name: "x-id", Value: "1"}}
+	post := []hpack.HeaderField{{Name: ":method", Value: "POST"}, {Name: ":scheme", Value: "http"}, {Name: ":path", Value: "/b"}, {Name: ":authority", Value: "example.com"}, {Name: "x-id", Value: "1"}}
+	ok := []hpack.HeaderField{{Name: ":status", Value: "200"}, {Name: "server", Value: "h2"}}
+
+	out := append([]byte(nil), proto.HTTP2Preface...)
+	out = proto.AppendHTTP2Frame(out, proto.HTTP2Frame{Type: proto.HTTP2FrameSettings})
+	out = append(out, http2Frames(t, reqEnc, &reqBlock, 1, get, "")...)
+	// the header fields of the second request are in the dynamic table
+	out = append(out, http2Frames(t, reqEnc, &reqBlock, 3, post, "hello")...)
+	in := proto.AppendHTTP2Frame(nil, proto.HTTP2Frame{Type: proto.HTTP2FrameSettings})
+	in = append(in, http2Frames(t, respEnc, &respBlock, 3, ok, "posted")...)
+	in = append(in, http2Frames(t, respEnc, &respBlock, 1, ok, "got")...)
+
+	mssg := make(chan *Message, 10)
+	d := NewHTTP2Demuxer(0, nil, func(m *Message) { mssg <- m })
+	pool := NewMessagePool(1<<20, time.Second, nil, d.Handler)
+	if err := pool.SetHints("http2"); err != nil {
+		t.Fatal(err)
+	}
+	pool.Start = d.Start
+	defer pool.Close()
+	// the frames straddle the segments
+	pool.Handler(tcpPacket(t, client, server, 1, false, true, nil, string(out[:30])))
+	pool.Handler(tcpPacket(t, client, server, 31, false, true, nil, string(out[30:])))
+	pool.Handler(tcpPacket(t, server, client, 1, false, true, nil, string(in[:20])))
+	pool.Handler(tcpPacket(t, server, client, 21, false, true, nil, string(in[20:])))
+
+	expected := []string{
+		"GET /a HTTP/1.1\r\nHost: example.com\r\nX-Id: 1\r\n\r\n",
+		"POST /b HTTP/1.1\r\nHost: example.com\r\nX-Id: 1\r\nContent-Length: 5\r\n\r\nhello",
+		"HTTP/1.1 200 OK\r\nServer: h2\r\nContent-Length: 6\r\n\r\nposted",
+		"HTTP/1.1 200 OK\r\nServer: h2\r\nContent-Length: 3\r\n\r\ngot",
+	}
+	var got []*Message
+	for range expected {
+		select {
+		case m := <-mssg:
+			got = append(got, m)
+		case <-time.After(time.Second):
+			t.Fatalf("expected %d messages, got %d", len(expected), len(got))
+		}
+	}
+	for i, m := range got {
+		if string(m.Data()) != expected[i] || m.IsIncoming != (i < 2) {
+			t.Errorf("expected %q, got %q(incoming %v)", expected[i], m.Data(), m.IsIncoming)
+		}
+	}
+	if !bytes.Equal(got[0].UUID(), got[3].UUID()) || !bytes.Equal(got[1].UUID(), got[2].UUID()) || bytes.Equal(got[0].UUID(), got[1].UUID()) {
+		t.Error("expected the responses to have the UUID of the request of their stream")
+	}
+}
+
+func TestHTTP2DemuxerGRPC(t *testing.T) {
+	const client, server = "10.0.0.1:40000", "10.0.0.2:50051"
+	var reqBlock, respBlock bytes.Buffer
+	reqEnc, respEnc := hpack.NewEncoder(&reqBlock), hpack.NewEncoder(&respBlock)
+	call := []hpack.HeaderField{{Name: ":method", Value: "POST"}, {Name: ":scheme", Value: "http"}, {Name: ":path", Value: "/users.v1.UserService/Get"}, {Name: ":authority", Value: "users"}, {Name: "content-type", Value: "application/grpc"}, {Name: "te", Value: "trailers"}}
+	get := []hpack.HeaderField{{Name: ":method", Value: "GET"}, {Name: ":scheme", Value: "http"}, {Name: ":path", Value: "/health"}, {Name: ":authority", Value: "users"}}
+	ok := []hpack.HeaderField{{Name: ":status", Value: "200"}, {Name: "content-type", Value: "application/grpc"}}
+	trailers := []hpack.HeaderField{{Name: "grpc-status", Value: "0"}}
+
+	out := append([]byte(nil), proto.HTTP2Preface...)
+	out = append(out, http2Frames(t, reqEnc, &reqBlock, 1, get, "")...)
+	out = append(out, http2Frames(t, reqEnc, &reqBlock, 3, call, "\x00\x00\x00\x00\x01a")...)
+	// the response ends with its trailers
+	in := proto.AppendHTTP2Frame(nil, proto.HTTP2Frame{Type: proto.HTTP2FrameSettings})
+	in = append(in, http2Frames(t, respEnc, &respBlock, 1, ok[:1], "")...)
+	data := http2Frames(t, respEnc, &respBlock, 3, ok, "\x00\x00\x00\x00\x01b")
+	in = append(in, data[:len(data)-15]...)
+	in = proto.AppendHTTP2Frame(in, proto.HTTP2Frame{Type: proto.HTTP2FrameData, Stream: 3, Payload: []byte("\x00\x00\x00\x00\x01b")})
+	in = append(in, http2Frames(t, respEnc, &respBlock, 3, trailers, "")...)
+
+	mssg := make(chan *Message, 10)
+	d := NewHTTP2Demuxer(0, nil, func(m *Message) { mssg <- m })
+	d.GRPC = true
+	pool := NewMessagePool(1<<20, time.Second, nil, d.Handler)
+	if err := pool.SetHints("grpc"); err != nil {
+		t.Fatal(err)
+	}
+	pool.Start = d.Start
+	defer pool.Close()
+	pool.Handler(tcpPacket(t, client, server, 1, false, true, nil, string(out)))
+	pool.Handler(tcpPacket(t, server, client, 1, false, true, nil, string(in)))
+
+	expected := []string{
+		"POST /users.v1.UserService/Get HTTP/1.1\r\nHost: users\r\nContent-Type: application/grpc\r\nTe: trailers\r\nContent-Length: 6\r\n\r\n\x00\x00\x00\x00\x01a",
+		"HTTP/1.1 200 OK\r\nContent-Type: application/grpc\r\nGrpc-Status: 0\r\nContent-Length: 6\r\n\r\n\x00\x00\x00\x00\x01b",
+	}
+	for i := range expected {
+		select {
+		case m := <-mssg:
+			if string(m.Data()) != expected[i] {
+				t.Errorf("expected %q, got %q", expected[i], m.Data())
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected %d messages, got %d", len(expected), i)
+		}
+	}
+	select {
+	case m := <-mssg:
+		t.Errorf("expected the streams of other requests to be dropped, got %q", m.Data())
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestWebSocketDemuxer(t *testing.T) {
+	const client, server = "10.0.0.1:40000", "10.0.0.2:8080"
+	key := [4]byte{7, 7, 7, 7}
+	upgrade := "GET /chat HTTP/1.1\r\nHost: example.com\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n"
+	switching := "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: s3pPLMBiTxaQ9kYGzzhZRbK+xOo=\r\n\r\n"
+	// a fragmented message with a ping in between
+	out := proto.AppendWebSocketFrame(nil, proto.WebSocketFrame{Opcode: proto.WebSocketText, Masked: true, Key: key, Payload: []byte("hel")})
+	out = proto.AppendWebSocketFrame(out, proto.WebSocketFrame{Fin: true, Opcode: proto.WebSocketPing, Masked: true, Key: key})
+	out = proto.AppendWebSocketFrame(out, proto.WebSocketFrame{Fin: true, Opcode: proto.WebSocketContinuation, Masked: true, Key: key, Payload: []byte("lo")})
+	// the first frame of the server follows the upgrade in the same segment
+	in := append([]byte(switching), proto.AppendWebSocketFrame(nil, proto.WebSocketFrame{Fin: true, Opcode: proto.WebSocketBinary, Payload: []byte{1, 2}})...)
+
+	mssg := make(chan *Message, 10)
+	d := NewWebSocketDemuxer(0, nil, func(m *Message) { mssg <- m })
+	pool := NewMessagePool(1<<20, time.Second, nil, d.Handler)
+	if err := pool.SetHints("websocket"); err != nil {
+		t.Fatal(err)
+	}
+	pool.Start, pool.End, pool.Split = d.Start, d.End, d.Split
+	defer pool.Close()
+	pool.Handler(tcpPacket(t, client, server, 1, false, true, nil, upgrade))
+	pool.Handler(tcpPacket(t, server, client, 1, false, true, nil, string(in)))
+	pool.Handler(tcpPacket(t, client, server, uint32(1+len(upgrade)), false, true, nil, string(out[:4])))
+	pool.Handler(tcpPacket(t, client, server, uint32(5+len(upgrade)), false, true, nil, string(out[4:])))
+
+	expected := []string{
+		upgrade,
+		switching,
+		string(proto.AppendWebSocketFrame(nil, proto.WebSocketFrame{Fin: true, Opcode: proto.WebSocketBinary, Payload: []byte{1, 2}})),
+		string(proto.AppendWebSocketFrame(nil, proto.WebSocketFrame{Fin: true, Opcode: proto.WebSocketPing})),
+		string(proto.AppendWebSocketFrame(nil, proto.WebSocketFrame{Fin: true, Opcode: proto.WebSocketText, Payload: []byte("hello")})),
+	}
+	var got []*Message
+	for range expected {
+		select {
+		case m := <-mssg:
+			got = append(got, m)
+		case <-time.After(time.Second):
+			t.Fatalf("expected %d messages, got %d", len(expected), len(got))
+		}
+	}
+	for i, m := range got {
+		if string(m.Data()) != expected[i] {
+			t.Errorf("expected %q, got %q", expected[i], m.Data())
+		}
+		if !bytes.Equal(m.UUID(), got[0].UUID()) {
+			t.Errorf("expected the message %d to have the UUID of the upgrade request", i)
+		}
+	}
+}
+
+func TestMySQLDemuxer(t *testing.T) {
+	const client, server = "10.0.0.1:40000", "10.0.0.2:3306"
+	caps := proto.MySQLClientDeprecateEOF | proto.MySQLClientPluginAuthLenencData
+	greeting := proto.AppendMySQLPacket(nil, 0, proto.AppendMySQLHandshake(nil, proto.MySQLHandshake{ServerVersion: "8.0.36", Capabilities: caps, AuthPlugin: "mysql_native_password"}))
+	handshake := proto.AppendMySQLPacket(nil, 1, proto.AppendMySQLHandshakeResponse(nil, proto.MySQLHandshakeResponse{Capabilities: caps, User: "app", AuthResponse: []byte{1, 2}, Database: "shop"}))
+	ok := proto.AppendMySQLPacket(nil, 2, []byte{0, 0, 0, 2, 0, 0, 0})
+	prepare := proto.AppendMySQLPacket(nil, 0, []byte("\x16SELECT ?"))
+	prepared := proto.AppendMySQLPacket(nil, 1, []byte{0, 7, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0})
+	prepared = proto.AppendMySQLPacket(prepared, 2, []byte("\x03def\x00"))
+	execute := []byte("\x17\x07\x00\x00\x00\x00\x01\x00\x00\x00\x00\x01\x01\x00\x2a")
+	executed := proto.AppendMySQLPacket(nil, 1, []byte{0, 1, 0, 2, 0, 0, 0})
+	unknown := proto.AppendMySQLPacket(nil, 0, []byte("\x17\x09\x00\x00\x00\x00\x01\x00\x00\x00"))
+	denied := proto.AppendMySQLPacket(nil, 1, []byte("\xff\x13\x02#HY000unknown statement"))
+	query := proto.AppendMySQLPacket(nil, 0, []byte("\x03SELECT 1"))
+	result := proto.AppendMySQLPacket(nil, 1, []byte{1})
+	result = proto.AppendMySQLPacket(result, 2, []byte("\x03def\x00"))
+	result = proto.AppendMySQLPacket(result, 3, []byte("\x011"))
+	result = proto.AppendMySQLPacket(result, 4, []byte{0xfe, 0, 0, 2, 0, 0, 0})
+	quit := proto.AppendMySQLPacket(nil, 0, []byte{proto.MySQLComQuit})
+	rewritten := append([]byte(nil), execute...)
+	rewritten[1] = 1
+
+	for _, strip := range []bool{false, true} {
+		mssg := make(chan *Message, 20)
+		d := NewMySQLDemuxer(0, nil, func(m *Message) { mssg <- m })
+		d.StripAuth = strip
+		pool := NewMessagePool(1<<20, time.Second, nil, d.Handler)
+		if err := pool.SetHints("mysql"); err != nil {
+			t.Fatal(err)
+		}
+		pool.Start = d.Start
+		seqs := map[string]uint32{client: 1, server: 1}
+		send := func(src, dst string, data []byte) {
+			pool.Handler(tcpPacket(t, src, dst, seqs[src], false, true, nil, string(data)))
+			seqs[src] += uint32(len(data))
+		}
+		send(server, client, greeting)
+		send(client, server, handshake)
+		send(server, client, ok)
+		send(client, server, prepare)
+		send(server, client, prepared)
+		send(client, server, proto.AppendMySQLPacket(nil, 0, execute))
+		send(server, client, executed)
+		send(client, server, unknown)
+		send(server, client, denied)
+		send(client, server, query)
+		// the response is split over two segments
+		send(server, client, result[:6])
+		send(server, client, result[6:])
+		send(client, server, quit)
+
+		expected := [][]byte{greeting, handshake, ok}
+		if strip {
+			expected = [][]byte{proto.AppendMySQLPacket(nil, 0, []byte("\x02shop"))}
+		}
+		expected = append(expected, prepare, prepared, proto.AppendMySQLPacket(nil, 0, rewritten), executed, query, result, quit)
+		var got []*Message
+		for range expected {
+			select {
+			case m := <-mssg:
+				got = append(got, m)
+			case <-time.After(time.Second):
+				t.Fatalf("strip %v: expected %d messages, got %d", strip, len(expected), len(got))
+			}
+		}
+		pool.Close()
+		for i, m := range got {
+			if !bytes.Equal(m.Data(), expected[i]) {
+				t.Errorf("strip %v: expected %x, got %x", strip, expected[i], m.Data())
+			}
+			if !bytes.Equal(m.UUID(), got[0].UUID()) {
+				t.Errorf("strip %v: expected the message %d to have the UUID of the connection", strip, i)
+			}
+		}
+		select {
+		case m := <-mssg:
+			t.Errorf("strip %v: unexpected message %x", strip, m.Data())
+		default:
+		}
+	}
+}
+
+func TestPostgresDemuxer(t *testing.T) {
+	const client, server = "10.0.0.1:40000", "10.0.0.2:5432"
+	msg := func(typ byte, body string) []byte {
+		return proto.AppendPostgresMessage(nil, typ, []byte(body))
+	}
+	join := func(messages ...[]byte) []byte {
+		return bytes.Join(messages, nil)
+	}
+	ssl := []byte{0, 0, 0, 8, 4, 210, 22, 47}
+	startup := proto.AppendPostgresStartup(nil, "user", "app", "database", "shop")
+	md5 := msg('R', "\x00\x00\x00\x05salt")
+	password := msg('p', "md5abcdef\x00")
+	ready := join(msg('R', "\x00\x00\x00\x00"), msg('S', "TimeZone\x00UTC\x00"), msg('K', "\x00\x00\x00\x01\x00\x00\x00\x02"), msg('Z', "I"))
+	extended := join(msg('P', "\x00SELECT $1\x00\x00\x00"), msg('B', "\x00\x00\x00\x00\x00\x01\x00\x00\x00\x011\x00\x00"), msg('E', "\x00\x00\x00\x00\x00"), msg('S', ""))
+	executed := join(msg('1', ""), msg('2', ""), msg('D', "\x00\x01\x00\x00\x00\x011"), msg('C', "SELECT 1\x00"), msg('Z', "I"))
+	query := msg('Q', "COPY t FROM STDIN\x00")
+	copyIn := msg('G', "\x00\x00\x00")
+	copyData := join(msg('d', "1\n"), msg('c', ""))
+	copied := join(msg('C', "COPY 1\x00"), msg('Z', "I"))
+	terminate := msg('X', "")
+
+	for _, strip := range []bool{false, true} {
+		mssg := make(chan *Message, 20)
+		d := NewPostgresDemuxer(0, nil, func(m *Message) { mssg <- m })
+		d.StripAuth = strip
+		pool := NewMessagePool(1<<20, time.Second, nil, d.Handler)
+		if err := pool.SetHints("postgres"); err != nil {
+			t.Fatal(err)
+		}
+		pool.Start, pool.Split = d.Start, d.Split
+		seqs := map[string]uint32{client: 1, server: 1}
+		send := func(src, dst string, data []byte) {
+			pool.Handler(tcpPacket(t, src, dst, seqs[src], false, true, nil, string(data)))
+			seqs[src] += uint32(len(data))
+		}
+		// the server declines tls
+		send(client, server, ssl)
+		send(server, client, []byte("N"))
+		send(client, server, startup)
+		send(server, client, md5)
+		send(client, server, password)
+		send(server, client, ready[:7])
+		send(server, client, ready[7:])
+		send(client, server, extended)
+		send(server, client, executed)
+		send(client, server, query)
+		send(server, client, copyIn)
+		send(client, server, copyData)
+		send(server, client, copied)
+		send(client, server, terminate)
+
+		expected := [][]byte{startup, md5, password, ready}
+		if strip {
+			expected = [][]byte{startup, ready}
+		}
+		expected = append(expected, extended, executed, query, copyIn, copyData, copied, terminate)
+		var got []*Message
+		for range expected {
+			select {
+			case m := <-mssg:
+				got = append(got, m)
+			case <-time.After(time.Second):
+				t.Fatalf("strip %v: expected %d messages, got %d", strip, len(expected), len(got))
+			}
+		}
+		pool.Close()
+		for i, m := range got {
+			if !bytes.Equal(m.Data(), expected[i]) {
+				t.Errorf("strip %v: expected %q, got %q", strip, expected[i], m.Data())
+			}
+			if !bytes.Equal(m.UUID(), got[0].UUID()) {
+				t.Errorf("strip %v: expected the message %d to have the UUID of the connection", strip, i)
+			}
+		}
+		select {
+		case m := <-mssg:
+			t.Errorf("strip %v: unexpected message %q", strip, m.Data())
+		default:
+		}
+	}
+}
+
+// tlsCert returns a self-signed certificate and its key, PEM encoded
+func tlsCert(t *testing.T) (tls.Certificate, []byte) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		DNSNames:     []string{"example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, keyPEM
+}
+
+type tlsWrite struct {
+	client bool
+	data   []byte
+}
+
+// tlsRecorder records the writes of both peers of a connection, in order
+type tlsRecorder struct {
+	net.Conn
+	client bool
+	mu     *sync.Mutex
+	writes *[]tlsWrite
+}
+
+func (r *tlsRecorder) Write(b []byte) (int, error) {
+	r.mu.Lock()
+	*r.writes = append(*r.writes, tlsWrite{r.client, append([]byte(nil), b...)})
+	r.mu.Unlock()
+	return r.Conn.Write(b)
+}
+
+// tlsExchange returns the segments of a request and its response sent over TLS
+func tlsExchange(t *testing.T, config *tls.Config, request, response string) []tlsWrite {
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+	var mu sync.Mutex
+	var writes []tlsWrite
+	errs := make(chan error, 1)
+	go func() {
+		conn := tls.Server(&tlsRecorder{s, false, &mu, &writes}, config)
+		if _, err := io.ReadFull(conn, make([]byte, len(request))); err != nil {
+			errs <- err
+			return
+		}
+		_, err := conn.Write([]byte(response))
+		errs <- err
+	}()
+	conn := tls.Client(&tlsRecorder{c, true, &mu, &writes}, &tls.Config{
+		InsecureSkipVerify: true,
+		MaxVersion:         config.MaxVersion,
+		CipherSuites:       config.CipherSuites,
+	})
+	if _, err := conn.Write([]byte(request)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, len(response))); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	return writes
+}
+
+func TestTLSDecryptor(t *testing.T) {
+	const client, server = "10.0.0.1:40000", "10.0.0.2:443"
+	const request = "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"
+	const response = "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"
+	cert, keyPEM := tlsCert(t)
+	keyFile, err := ioutil.TempFile("", "tls_key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(keyFile.Name())
+	keyFile.Write(keyPEM)
+	keyFile.Close()
+	keys, err := LoadRSAKeys(keyFile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		version uint16
+		suite   uint16
+		rsa     bool // decrypted with the key of the server instead of the key log
+	}{
+		{"tls1.3", tls.VersionTLS13, 0, false},
+		{"aes-gcm", tls.VersionTLS12, tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384, false},
+		{"chacha20-poly1305", tls.VersionTLS12, tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305, false},
+		{"aes-cbc", tls.VersionTLS12, tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA, false},
+		{"rsa", tls.VersionTLS12, tls.TLS_RSA_WITH_AES_128_GCM_SHA256, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keyLog, err := ioutil.TempFile("", "tls_keylog")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(keyLog.Name())
+			config := &tls.Config{Certificates: []tls.Certificate{cert}, MaxVersion: tt.version, KeyLogWriter: keyLog}
+			if tt.suite != 0 {
+				config.CipherSuites = []uint16{tt.suite}
+			}
+			writes := tlsExchange(t, config, request, response)
+			keyLog.Close()
+
+			mssg := make(chan *Message, 10)
+			plain := NewMessagePool(1<<20, time.Second, nil, func(m *Message) { mssg <- m })
+			if err := plain.SetHints("http"); err != nil {
+				t.Fatal(err)
+			}
+			d := NewTLSDecryptor(plain, nil)
+			if tt.rsa {
+				d.RSAKeys = keys
+			} else if d.KeyLog, err = NewKeyLog(keyLog.Name()); err != nil {
+				t.Fatal(err)
+			}
+			pool := NewMessagePool(1<<20, time.Second, nil, d.Handler)
+			pool.Start, pool.Split = d.Start, TLSSplit
+			seq := [2]uint32{1, 1}
+			for _, w := range writes {
+				if w.client {
+					pool.Handler(tcpPacket(t, client, server, seq[0], false, true, nil, string(w.data)))
+					seq[0] += uint32(len(w.data))
+				} else {
+					pool.Handler(tcpPacket(t, server, client, seq[1], false, true, nil, string(w.data)))
+					seq[1] += uint32(len(w.data))
+				}
+			}
+			pool.Close()
+			plain.Close()
+
+			for _, expected := range []string{request, response} {
+				select {
+				case m := <-mssg:
+					if string(m.Data()) != expected {
+						t.Errorf("expected %q, got %q", expected, m.Data())
+					}
+				case <-time.After(time.Second):
+					t.Fatalf("expected the message %q", expected)
+				}
+			}
+		})
+	}
+}
+
+func TestStreams(t *testing.T) {
+	const client, server = "10.0.0.1:40000", "10.0.0.2:443"
+	mssg := make(chan *Message, 10)
+	pool := NewMessagePool(1<<20, time.Second, nil, func(m *Message) { mssg <- m })
+	if err := pool.SetHints("http"); err != nil {
+		t.Fatal(err)
+	}
+	s := NewStreams(pool)
+	now := time.Now()
+	s.Data("1", client, server, 4, []byte("GET / HTTP/1.1\r\nHost: "), 0, now)
+	s.Data("1", client, server, 4, []byte("example.com\r\n\r\n"), 0, now)
+	s.Data("1", server, client, 4, []byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"), 0, now)
+	// the same connection with other addresses, then a request whose end was lost
+	s.Data("1", "10.0.0.1:40001", server, 4, []byte("GET /a HTTP/1.1\r\n\r\n"), 0, now)
+	s.Data("2", client, server, 4, []byte("POST / HTTP/1.1\r\nContent-Length: 4\r\n\r\n"), 4, now)
+	pool.Close()
+
+	expected := map[string]bool{
+		client + " GET / HTTP/1.1\r\nHost: example.com\r\n\r\n":    true,
+		server + " HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok": false,
+		"10.0.0.1:40001 GET /a HTTP/1.1\r\n\r\n":                   true,
+		client + " POST / HTTP/1.1\r\nContent-Length: 4\r\n\r\n":   true,
+	}
+	for range expected {
+		select {
+		case m := <-mssg:
+			key := m.SrcAddr + " " + string(m.Data())
+			incoming, ok := expected[key]
+			if !ok {
+				t.Errorf("unexpected message %q", key)
+				continue
+			}
+			if m.IsIncoming != incoming {
+				t.Errorf("expected %q to be incoming: %v", key, incoming)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("expected more messages")
+		}
+	}
+}
+
+func TestQUICKeys(t *testing.T) {
+	unhex := func(s string) []byte {
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	// https://www.rfc-editor.org/rfc/rfc9001.html#appendix-A.1
+	mac := hmac.New(sha256.New, quicSalts[proto.QUICVersion1])
+	mac.Write(unhex("8394c8f03e515708"))
+	secret := expandLabel(sha256.New, mac.Sum(nil), "client in", 32)
+	for _, tt := range []struct{ label, want string }{
+		{"quic key", "1f369613dd76d5467730efcbe3b1a22d"},
+		{"quic iv", "fa044b2f42a3fd3b46fb255c"},
+		{"quic hp", "9f50449e04a0e810283a1e9933adedd2"},
+	} {
+		if got := hex.EncodeToString(expandLabel(sha256.New, secret, tt.label, len(tt.want)/2)); got != tt.want {
+			t.Errorf("expected the %s %s, got %s", tt.label, tt.want, got)
+		}
+	}
+
+	// https://www.rfc-editor.org/rfc/rfc9001.html#appendix-A.5
+	keys, err := newQUICKeys(0x1303, unhex("9ac312a7f877468ebe69422748ad00a15443f18203a07d6060f688f30f21632b"), proto.QUICVersion1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, pn, err := keys.open(unhex("4cfe4189655e5cd55c41f69080575d7999c25a5bfb"), 1, 654360563)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pn != 654360564 || !bytes.Equal(payload, []byte{byte(proto.QUICFramePing)}) {
+		t.Errorf("expected the packet 654360564 with a PING frame, got %d %x", pn, payload)
+	}
+}
+
+// quicSeal encrypts the payload of a packet whose header ends with a packet number of 2 bytes
+func quicSeal(k *quicKeys, header []byte, pn uint64, payload []byte) []byte {
+	pnOffset := len(header) - 2
+	packet := k.aead.Seal(append([]byte(nil), header...), tlsNonce(k.iv, pn), payload, header)
+	mask := k.mask(packet[pnOffset+4 : pnOffset+20])
+	if packet[0]&0x80 != 0 {
+		packet[0] ^= mask[0] & 0x0f
+	} else {
+		packet[0] ^= mask[0] & 0x1f
+	}
+	packet[pnOffset] ^= mask[1]
+	packet[pnOffset+1] ^= mask[2]
+	return packet
+}
+
+// quicInitial returns an Initial packet carrying the handshake message hello, padded to 1200 bytes
+func quicInitial(k *quicKeys, dcid, scid []byte, pn uint64, hello []byte) []byte {
+	payload := append(proto.AppendQUICVarint(proto.AppendQUICVarint([]byte{byte(proto.QUICFrameCrypto)}, 0), uint64(len(hello))), hello...)
+	payload = append(payload, make([]byte, 1100-len(payload))...)
+	header := append([]byte{0xc1, 0, 0, 0, 1, byte(len(dcid))}, dcid...)
+	header = append(append(header, byte(len(scid))), scid...)
+	header = proto.AppendQUICVarint(append(header, 0), uint64(2+len(payload)+16))
+	return quicSeal(k, append(header, byte(pn>>8), byte(pn)), pn, payload)
+}
+
+// quicStreamFrame returns a STREAM frame with an offset and a length
+func quicStreamFrame(id, offset uint64, fin bool, data []byte) []byte {
+	typ := proto.QUICFrameStream | 0x06
+	if fin {
+		typ |= 0x01
+	}
+	f := proto.AppendQUICVarint(nil, typ)
+	f = proto.AppendQUICVarint(f, id)
+	f = proto.AppendQUICVarint(f, offset)
+	f = proto.AppendQUICVarint(f, uint64(len(data)))
+	return append(f, data...)
+}
+
+func TestQUICDecoder(t *testing.T) {
+	const client, server = "10.0.0.1:50000", "10.0.0.2:443"
+	dcid, clientCID, serverCID := []byte("original"), []byte("clientid"), []byte("serverid")
+	random := bytes.Repeat([]byte{0x42}, 32)
+	clientSecret, serverSecret := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32)
+	keyLog, err := ioutil.TempFile("", "quic_keylog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(keyLog.Name())
+	fmt.Fprintf(keyLog, "CLIENT_TRAFFIC_SECRET_0 %x %x\nSERVER_TRAFFIC_SECRET_0 %x %x\n", random, clientSecret, random, serverSecret)
+	keyLog.Close()
+
+	mssg := make(chan *Message, 10)
+	d := NewQUICDecoder(1<<20, nil, func(m *Message) { mssg <- m })
+	if d.KeyLog, err = NewKeyLog(keyLog.Name()); err != nil {
+		t.Fatal(err)
+	}
+	pool := NewUDPPool(1<<20, 0, nil, d.Handler)
+	now := time.Now()
+	send := func(src, dst string, packet []byte) {
+		pool.Handler(udpPacket(t, src, dst, now, string(packet)))
+	}
+
+	clientInitial, serverInitial, err := quicInitialKeys(proto.QUICVersion1, dcid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientHello := append([]byte{proto.TLSClientHello, 0, 0, 38, 3, 3}, random...)
+	send(client, server, quicInitial(clientInitial, dcid, clientCID, 0, clientHello))
+	serverHello := append(append([]byte{proto.TLSServerHello, 0, 0, 41, 3, 3}, bytes.Repeat([]byte{7}, 32)...), 0, 0x13, 0x01, 0)
+	send(server, client, quicInitial(serverInitial, clientCID, serverCID, 0, serverHello))
+
+	clientKeys, _ := newQUICKeys(0x1301, clientSecret, proto.QUICVersion1)
+	serverKeys, _ := newQUICKeys(0x1301, serverSecret, proto.QUICVersion1)
+	short := func(k *quicKeys, cid []byte, phase byte, pn uint64, frames ...[]byte) []byte {
+		header := append(append([]byte{0x41 | phase}, cid...), byte(pn>>8), byte(pn))
+		return quicSeal(k, header, pn, bytes.Join(append(frames, make([]byte, 20)), nil))
+	}
+
+	// the request references an entry of the dynamic table inserted by the encoder stream
+	section := []byte{2, 0, 0xd1, 0xd7, 0x51, 2, '/', 'q', 0x50, 11}
+	section = append(append(section, "example.com"...), 0x80)
+	headers := proto.AppendHTTP3Frame(nil, proto.HTTP3FrameHeaders, section)
+	body := proto.AppendHTTP3Frame(nil, proto.HTTP3FrameData, []byte("hi"))
+	control := append([]byte{byte(proto.HTTP3StreamControl)}, proto.AppendHTTP3Frame(nil, proto.HTTP3FrameSettings, []byte{0x01, 0x50, 0x00})...)
+	encoder := []byte{byte(proto.HTTP3StreamQPACKEncoder), 0x3f, 0xbd, 0x01, 0x46}
+	encoder = append(append(encoder, "x-test"...), 3, 'd', 'y', 'n')
+	send(client, server, short(clientKeys, serverCID, 0, 0, quicStreamFrame(0, uint64(len(headers)), true, body)))
+	send(client, server, short(clientKeys, serverCID, 0, 1, quicStreamFrame(0, 0, false, headers)))
+	send(client, server, short(clientKeys, serverCID, 0, 2, quicStreamFrame(2, 0, false, control), quicStreamFrame(6, 0, false, encoder)))
+
+	// the response is sent across a key update
+	headers = proto.AppendHTTP3Frame(nil, proto.HTTP3FrameHeaders, []byte{0, 0, 0xd9, 0xf5})
+	body = proto.AppendHTTP3Frame(nil, proto.HTTP3FrameData, []byte("ok"))
+	send(server, client, short(serverKeys, clientCID, 0, 0, quicStreamFrame(0, 0, false, headers)))
+	nextKeys, _ := newQUICKeys(0x1301, expandLabel(sha256.New, serverSecret, "quic ku", 32), proto.QUICVersion1)
+	nextKeys.mask = serverKeys.mask
+	send(server, client, short(nextKeys, clientCID, 0x04, 1, quicStreamFrame(0, uint64(len(headers)), true, body)))
+	pool.Close()
+
+	var req, resp *Message
+	for _, m := range []**Message{&req, &resp} {
+		select {
+		case *m = <-mssg:
+		case <-time.After(time.Second):
+			t.Fatal("expected the request and the response")
+		}
+	}
+	if data := string(req.Data()); !req.IsIncoming || !strings.HasPrefix(data, "GET /q HTTP/1.1\r\n") || !strings.Contains(data, "Host: example.com\r\n") ||
+		!strings.Contains(data, "X-Test: dyn\r\n") || !strings.HasSuffix(data, "\r\n\r\nhi") {
+		t.Errorf("unexpected request %q", data)
+	}
+	if data := string(resp.Data()); resp.IsIncoming || !strings.HasPrefix(data, "HTTP/1.1 200 OK\r\n") || !strings.Contains(data, "Content-Type: text/plain\r\n") ||
+		!strings.HasSuffix(data, "\r\n\r\nok") {
+		t.Errorf("unexpected response %q", data)
+	}
+	if !bytes.Equal(req.UUID(), resp.UUID()) {
+		t.Error("expected the response to have the UUID of the request")
+	}
+}
+
+func TestRedisSplit(t *testing.T) {
+	const client, server = "10.0.0.1:40000", "10.0.0.2:6379"
+	mssg := make(chan *Message, 10)
+	pool := NewMessagePool(1<<20, time.Second, nil, func(m *Message) { mssg <- m })
+	if err := pool.SetHints("redis"); err != nil {
+		t.Fatal(err)
+	}
+	pool.Start = RedisStart(0)
+	seqs := map[string]uint32{client: 1, server: 1}
+	send := func(src, dst string, data string) {
+		pool.Handler(tcpPacket(t, src, dst, seqs[src], false, true, nil, data))
+		seqs[src] += uint32(len(data))
+	}
+	get := "*2\r\n$3\r\nGET\r\n$1\r\na\r\n"
+	set := "*3\r\n$3\r\nSET\r\n$1\r\nb\r\n$5\r\nhello\r\n"
+	// pipelined commands, the second one split across packets
+	send(client, server, get+set[:10])
+	send(client, server, set[10:])
+	send(server, client, "$-1\r\n+OK\r\n")
+	expected := []struct {
+		data     string
+		incoming bool
+	}{{get, true}, {set, true}, {"$-1\r\n", false}, {"+OK\r\n", false}}
+	for _, e := range expected {
+		select {
+		case m := <-mssg:
+			if string(m.Data()) != e.data || m.IsIncoming != e.incoming {
+				t.Errorf("expected %q(incoming %v), got %q(incoming %v)", e.data, e.incoming, m.Data(), m.IsIncoming)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected the message %q", e.data)
+		}
+	}
+	pool.Close()
+}
+
+func TestMongoSplit(t *testing.T) {
+	const client, server = "10.0.0.1:40000", "10.0.0.2:27017"
+	mssg := make(chan *Message, 10)
+	pool := NewMessagePool(1<<20, time.Second, nil, MongoDecompressor(nil, func(m *Message) { mssg <- m }))
+	if err := pool.SetHints("mongo"); err != nil {
+		t.Fatal(err)
+	}
+	pool.Start = MongoStart(0)
+	seqs := map[string]uint32{client: 1, server: 1}
+	send := func(src, dst string, data []byte) {
+		pool.Handler(tcpPacket(t, src, dst, seqs[src], false, true, nil, string(data)))
+		seqs[src] += uint32(len(data))
+	}
+	find := proto.AppendMongoMsg(nil, 1, proto.BSONDoc(proto.AppendBSONString(proto.AppendBSONString(nil, "find", "users"), "$db", "shop")))
+	// a noop compressed message
+	head := make([]byte, 9)
+	binary.LittleEndian.PutUint32(head, uint32(proto.MongoOpMsg))
+	binary.LittleEndian.PutUint32(head[4:], uint32(len(find)-proto.MongoHeaderLen))
+	compressed := proto.AppendMongoMessage(nil, proto.MongoHeader{RequestID: 2, OpCode: proto.MongoOpCompressed}, append(head, find[proto.MongoHeaderLen:]...))
+	decompressed := proto.AppendMongoMessage(nil, proto.MongoHeader{RequestID: 2, OpCode: proto.MongoOpMsg}, find[proto.MongoHeaderLen:])
+	reply := proto.AppendMongoMessage(nil, proto.MongoHeader{RequestID: 3, ResponseTo: 1, OpCode: proto.MongoOpMsg}, append(make([]byte, 5), proto.BSONDoc(proto.AppendBSONInt32(nil, "ok", 1))...))
+	data := append(append([]byte(nil), find...), compressed...)
+	send(client, server, data[:20])
+	send(client, server, data[20:])
+	send(server, client, reply)
+	expected := []struct {
+		data     []byte
+		incoming bool
+	}{{find, true}, {decompressed, true}, {reply, false}}
+	var uuid []byte
+	for _, e := range expected {
+		select {
+		case m := <-mssg:
+			if !bytes.Equal(m.Data(), e.data) || m.IsIncoming != e.incoming {
+				t.Errorf("expected %q(incoming %v), got %q(incoming %v)", e.data, e.incoming, m.Data(), m.IsIncoming)
+			}
+			if uuid == nil {
+				uuid = m.UUID()
+			} else if !bytes.Equal(m.UUID(), uuid) {
+				t.Error("expected the messages to have the UUID of the connection")
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected the message %q", e.data)
+		}
+	}
+	pool.Close()
+}
+
+func TestThriftSplit(t *testing.T) {
+	const client, server = "10.0.0.1:40000", "10.0.0.2:9090"
+	mssg := make(chan *Message, 10)
+	pool := NewMessagePool(1<<20, time.Second, nil, func(m *Message) { mssg <- m })
+	if err := pool.SetHints("thrift"); err != nil {
+		t.Fatal(err)
+	}
+	pool.Start = ThriftStart(0)
+	seqs := map[string]uint32{client: 1, server: 1}
+	send := func(src, dst string, data string) {
+		pool.Handler(tcpPacket(t, src, dst, seqs[src], false, true, nil, data))
+		seqs[src] += uint32(len(data))
+	}
+	call := "\x80\x01\x00\x01\x00\x00\x00\x04ping\x00\x00\x00\x01\x00"
+	framed := "\x00\x00\x00\x11\x80\x01\x00\x01\x00\x00\x00\x04ping\x00\x00\x00\x02\x00"
+	reply := "\x80\x01\x00\x02\x00\x00\x00\x04ping\x00\x00\x00\x01\x00"
+	// the second call is split across packets
+	send(client, server, call+framed[:6])
+	send(client, server, framed[6:])
+	send(server, client, reply)
+	expected := []struct {
+		data     string
+		incoming bool
+	}{{call, true}, {framed, true}, {reply, false}}
+	for _, e := range expected {
+		select {
+		case m := <-mssg:
+			if string(m.Data()) != e.data || m.IsIncoming != e.incoming {
+				t.Errorf("expected %q(incoming %v), got %q(incoming %v)", e.data, e.incoming, m.Data(), m.IsIncoming)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected the message %q", e.data)
+		}
+	}
+	pool.Close()
+}
+
+func TestMQTTDemuxer(t *testing.T) {
+	const client5, client3, server = "10.0.0.1:40000", "10.0.0.3:40000", "10.0.0.2:1883"
+	mssg := make(chan *Message, 10)
+	demuxer := NewMQTTDemuxer(1<<20, nil, func(m *Message) { mssg <- m })
+	pool := NewMessagePool(1<<20, time.Second, nil, demuxer.Handler)
+	if err := pool.SetHints("mqtt"); err != nil {
+		t.Fatal(err)
+	}
+	pool.Start = demuxer.Start
+	seqs := map[string]uint32{client5: 1, client3: 1, server + "5": 1, server + "3": 1}
+	send := func(src, dst string, data []byte) {
+		key := src
+		if src == server {
+			key = src + dst[7:8]
+		}
+		pool.Handler(tcpPacket(t, src, dst, seqs[key], false, true, nil, string(data)))
+		seqs[key] += uint32(len(data))
+	}
+	alias := proto.MQTTPublishPacket{Topic: "sensors/1/temp", Properties: []byte{proto.MQTTTopicAlias, 0, 1}, Payload: []byte("21.5")}
+	aliased := proto.MQTTPublishPacket{Properties: []byte{proto.MQTTTopicAlias, 0, 1}, Payload: []byte("21.7")}
+	var data []byte
+	data = proto.AppendMQTTConnect(data, proto.MQTT5, "sensor-1", "", "", 60)
+	data = proto.AppendMQTTPublish(data, alias, proto.MQTT5)
+	send(client5, server, data[:10])
+	send(client5, server, data[10:])
+	send(server, client5, proto.AppendMQTTPacket(nil, proto.MQTTConnAck, 0, []byte{0, 0, 0}))
+	send(client5, server, proto.AppendMQTTPublish(nil, aliased, proto.MQTT5))
+	// the PUBLISH packets of MQTT 3.1.1 get empty properties
+	qos1 := proto.MQTTPublishPacket{Topic: "sensors/2/temp", QoS: 1, PacketID: 7, Payload: []byte("18")}
+	send(client3, server, append(proto.AppendMQTTConnect(nil, proto.MQTT311, "sensor-2", "", "", 60), proto.AppendMQTTPublish(nil, qos1, proto.MQTT311)...))
+	send(server, client3, proto.AppendMQTTPacket(nil, proto.MQTTPubAck, 0, []byte{0, 7}))
+
+	alias.Properties, aliased.Properties, aliased.Topic = nil, nil, alias.Topic
+	expected := []struct {
+		data []byte
+		src  string
+	}{
+		{proto.AppendMQTTPublish(nil, alias, proto.MQTT5), client5},
+		{proto.AppendMQTTPublish(nil, aliased, proto.MQTT5), client5},
+		{proto.AppendMQTTPublish(nil, qos1, proto.MQTT5), client3},
+	}
+	uuids := make(map[string][]byte)
+	for _, e := range expected {
+		select {
+		case m := <-mssg:
+			if !bytes.Equal(m.Data(), e.data) || !m.IsIncoming || m.SrcAddr != e.src {
+				t.Errorf("expected %q from %s, got %q from %s(incoming %v)", e.data, e.src, m.Data(), m.SrcAddr, m.IsIncoming)
+			}
+			if uuid, ok := uuids[m.SrcAddr]; !ok {
+				uuids[m.SrcAddr] = m.UUID()
+			} else if !bytes.Equal(m.UUID(), uuid) {
+				t.Error("expected the messages to have the UUID of the connection")
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected the message %q", e.data)
+		}
+	}
+	select {
+	case m := <-mssg:
+		t.Errorf("unexpected message %q", m.Data())
+	case <-time.After(100 * time.Millisecond):
+	}
+	pool.Close()
+}
+
+func TestAMQPDemuxer(t *testing.T) {
+	const client, server = "10.0.0.1:40000", "10.0.0.2:5672"
+	mssg := make(chan *Message, 10)
+	demuxer := NewAMQPDemuxer(1<<20, nil, func(m *Message) { mssg <- m })
+	pool := NewMessagePool(1<<20, time.Second, nil, demuxer.Handler)
+	if err := pool.SetHints("amqp"); err != nil {
+		t.Fatal(err)
+	}
+	pool.Start = demuxer.Start
+	seqs := map[string]uint32{client: 1, server: 1}
+	send := func(src, dst string, data []byte) {
+		pool.Handler(tcpPacket(t, src, dst, seqs[src], false, true, nil, string(data)))
+		seqs[src] += uint32(len(data))
+	}
+	send(client, server, []byte(proto.AMQPProtocolHeader))
+	send(server, client, proto.AppendAMQPMethod(nil, 0, proto.AMQPConnection, proto.AMQPConnectionStart, []byte{0, 9}))
+	created := proto.AppendAMQPPublish(nil, proto.AMQPPublishCommand{Channel: 1, Exchange: "orders", RoutingKey: "created", Body: []byte("{\"id\":1}")}, 12)
+	paid := proto.AppendAMQPPublish(nil, proto.AMQPPublishCommand{Channel: 2, Exchange: "orders", RoutingKey: "paid"}, 0)
+	// the frames of the channels are interleaved, and split over packets
+	send(client, server, created[:30])
+	send(client, server, append(append([]byte(nil), created[30:len(created)-12]...), paid...))
+	send(client, server, proto.AppendAMQPFrame(nil, proto.AMQPFrameHeartbeat, 0, nil))
+	send(client, server, created[len(created)-12:])
+	send(client, server, proto.AppendAMQPMethod(nil, 1, proto.AMQPChannel, proto.AMQPChannelClose, []byte{0, 200, 0, 0, 0, 0, 0}))
+
+	var uuid []byte
+	for _, expected := range [][]byte{paid, created} {
+		select {
+		case m := <-mssg:
+			if !bytes.Equal(m.Data(), expected) || !m.IsIncoming {
+				t.Errorf("expected %q, got %q(incoming %v)", expected, m.Data(), m.IsIncoming)
+			}
+			if uuid == nil {
+				uuid = m.UUID()
+			} else if !bytes.Equal(m.UUID(), uuid) {
+				t.Error("expected the messages to have the UUID of the connection")
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected the message %q", expected)
+		}
+	}
+	select {
+	case m := <-mssg:
+		t.Errorf("unexpected message %q", m.Data())
+	case <-time.After(100 * time.Millisecond):
+	}
+	pool.Close()
+}
+
+func TestDNSTransactions(t *testing.T) {
+	const client, server = "10.0.0.1:40000", "10.0.0.2:53"
+	mssg := make(chan *Message, 10)
+	pool := NewMessagePool(1<<20, time.Second, nil, DNSTransactions(true, nil, func(m *Message) { mssg <- m }))
+	if err := pool.SetHints("dns"); err != nil {
+		t.Fatal(err)
+	}
+	pool.Start = DNSStart(0)
+	seqs := map[string]uint32{client: 1, server: 1}
+	send := func(src, dst string, data []byte) {
+		pool.Handler(tcpPacket(t, src, dst, seqs[src], false, true, nil, string(data)))
+		seqs[src] += uint32(len(data))
+	}
+	message := func(id uint16, response bool) []byte {
+		return proto.AppendDNS(nil, proto.DNSMessage{ID: id, Response: response, Questions: []proto.DNSQuestion{{Name: "example.com.", Type: proto.DNSTypeA, Class: 1}}})
+	}
+	prefixed := func(data []byte) []byte {
+		return append([]byte{byte(len(data) >> 8), byte(len(data))}, data...)
+	}
+	// pipelined queries, answered out of order
+	send(client, server, append(prefixed(message(1, false)), prefixed(message(2, false))...))
+	send(server, client, append(prefixed(message(2, true)), prefixed(message(1, true))...))
+	uuids := make(map[string][]byte)
+	for _, e := range [][]byte{message(1, false), message(2, false), message(2, true), message(1, true)} {
+		select {
+		case m := <-mssg:
+			id, response, _ := proto.DNSHeader(m.Data())
+			if !bytes.Equal(m.Data(), e) || m.IsIncoming == response {
+				t.Errorf("expected %q, got %q(incoming %v)", e, m.Data(), m.IsIncoming)
+			}
+			key := fmt.Sprint(id)
+			if uuid, ok := uuids[key]; !ok {
+				uuids[key] = m.UUID()
+			} else if !bytes.Equal(m.UUID(), uuid) {
+				t.Errorf("expected the query %d and its response to have the same UUID", id)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected the message %q", e)
+		}
+	}
+	if bytes.Equal(uuids["1"], uuids["2"]) {
+		t.Error("expected the transactions of a connection to have different UUIDs")
+	}
+	pool.Close()
+
+	// over udp the datagrams are not prefixed
+	handler := DNSTransactions(false, nil, func(m *Message) { mssg <- m })
+	m := NewMessage(server, client, 4)
+	m.add(0, &Packet{TCP: &layers.TCP{BaseLayer: layers.BaseLayer{Payload: message(1, true)}}})
+	handler(m)
+	if m := <-mssg; m.IsIncoming || !bytes.Equal(m.Data(), message(1, true)) {
+		t.Errorf("expected an outgoing response, got %q(incoming %v)", m.Data(), m.IsIncoming)
+	}
+}
+
+func TestSIPDemuxer(t *testing.T) {
+	const caller, callee, proxy = "10.0.0.1:5060", "10.0.0.2:5060", "10.0.0.3:5060"
+	sip := func(start, cseq, extra, body string) []byte {
+		return []byte(fmt.Sprintf("%s\r\nVia: SIP/2.0/UDP 10.0.0.1:5060;branch=z9hG4bK1\r\nCall-ID: call-1\r\nCSeq: %s\r\n%sContent-Length: %d\r\n\r\n%s", start, cseq, extra, len(body), body))
+	}
+	sdp := "v=0\r\nc=IN IP4 10.0.0.1\r\nm=audio 49170 RTP/AVP 0\r\n"
+	mssg := make(chan *Message, 10)
+	var summaries [][]RTPStream
+	d := NewSIPDemuxer(nil, func(m *Message) { mssg <- m })
+	d.Summary = func(callID string, streams []RTPStream) {
+		summaries = append(summaries, streams)
+	}
+	datagram := func(src, dst string, data []byte) {
+		m := NewMessage(src, dst, 4)
+		m.add(0, &Packet{TCP: &layers.TCP{BaseLayer: layers.BaseLayer{Payload: data}}, Timestamp: time.Now()})
+		d.Handler(m)
+	}
+	rtp := func(seq uint16) []byte {
+		return append([]byte{0x80, 0, byte(seq >> 8), byte(seq), 0, 0, 0, 0, 0, 0, 0, 1}, make([]byte, 160)...)
+	}
+	// the dialog crosses a proxy, and the datagrams of the media are dropped
+	messages := []struct {
+		src, dst string
+		data     []byte
+		incoming bool
+	}{
+		{caller, proxy, sip("INVITE sip:bob@example.com SIP/2.0", "1 INVITE", "Content-Type: application/sdp\r\n", sdp), true},
+		{proxy, callee, sip("INVITE sip:bob@10.0.0.2 SIP/2.0", "1 INVITE", "Content-Type: application/sdp\r\n", sdp), true},
+		{callee, proxy, sip("SIP/2.0 200 OK", "1 INVITE", "", ""), false},
+		{proxy, caller, sip("SIP/2.0 200 OK", "1 INVITE", "", ""), false},
+		{caller, callee, sip("BYE sip:bob@10.0.0.2 SIP/2.0", "2 BYE", "", ""), true},
+		{callee, caller, sip("SIP/2.0 200 OK", "2 BYE", "", ""), false},
+	}
+	var uuid []byte
+	for i, e := range messages {
+		datagram(e.src, e.dst, e.data)
+		if i == 3 {
+			// a lost packet
+			for _, seq := range []uint16{65534, 65535, 1, 2} {
+				datagram("10.0.0.2:30000", "10.0.0.1:49170", rtp(seq))
+			}
+			datagram(caller, callee, []byte("\r\n\r\n"))
+		}
+		select {
+		case m := <-mssg:
+			if !bytes.Equal(m.Data(), e.data) || m.IsIncoming != e.incoming {
+				t.Errorf("expected %q(incoming %v), got %q(incoming %v)", e.data, e.incoming, m.Data(), m.IsIncoming)
+			}
+			if uuid == nil {
+				uuid = m.UUID()
+			} else if !bytes.Equal(m.UUID(), uuid) {
+				t.Errorf("expected the messages of the call to have the same UUID, got %q", m.Data())
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected the message %q", e.data)
+		}
+	}
+	select {
+	case m := <-mssg:
+		t.Errorf("unexpected message %q", m.Data())
+	default:
+	}
+	if len(summaries) != 1 || len(summaries[0]) != 1 {
+		t.Fatalf("expected a summary of a stream, got %v", summaries)
+	}
+	if s := summaries[0][0]; s.SSRC != 1 || s.Packets != 4 || s.Bytes != 4*160 || s.Lost != 1 || s.Dst != "10.0.0.1:49170" {
+		t.Errorf("unexpected stream %s", &s)
+	}
+
+	// over tcp the messages are split by their Content-Length
+	pool := NewMessagePool(1<<20, time.Second, nil, d.Handler)
+	if err := pool.SetHints("sip"); err != nil {
+		t.Fatal(err)
+	}
+	options := sip("OPTIONS sip:bob@example.com SIP/2.0", "1 OPTIONS", "", "")
+	pool.Handler(tcpPacket(t, caller, callee, 1, false, true, nil, string(options)+"\r\n\r\n"+string(options)))
+	for i := 0; i < 2; i++ {
+		select {
+		case m := <-mssg:
+			if !bytes.Equal(m.Data(), options) || !m.IsIncoming {
+				t.Errorf("expected %q, got %q(incoming %v)", options, m.Data(), m.IsIncoming)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("expected the requests over tcp")
+		}
+	}
+	pool.Close()
+}
+
+func TestKafkaDemuxer(t *testing.T) {
+	const client, server = "10.0.0.1:40000", "10.0.0.2:9092"
+	mssg := make(chan *Message, 10)
+	d := NewKafkaDemuxer(nil, func(m *Message) { mssg <- m })
+	pool := NewMessagePool(1<<20, time.Second, nil, d.Handler)
+	if err := pool.SetHints("kafka"); err != nil {
+		t.Fatal(err)
+	}
+	pool.Start = d.Start
+	seqs := map[string]uint32{client: 1, server: 1}
+	send := func(src, dst string, data []byte) {
+		pool.Handler(tcpPacket(t, src, dst, seqs[src], false, true, nil, string(data)))
+		seqs[src] += uint32(len(data))
+	}
+	request := func(id int32) []byte {
+		return proto.AppendKafkaRequest(nil, proto.KafkaRequest{APIKey: proto.KafkaMetadata, APIVersion: 1, CorrelationID: id, ClientID: "c", Body: []byte{0, 0, 0, 0}})
+	}
+	// the correlation id 1 of a response looks like the header of a Produce request v1
+	response := func(id int32) []byte {
+		return []byte{0, 0, 0, 10, byte(id >> 24), byte(id >> 16), byte(id >> 8), byte(id), 0, 1, 0, 0, 0, 0}
+	}
+	// pipelined requests
+	send(client, server, append(request(1), request(2)...))
+	send(server, client, response(1))
+	send(server, client, response(2))
+	uuids := make(map[int32][]byte)
+	for _, e := range []struct {
+		data     []byte
+		incoming bool
+		id       int32
+	}{{request(1), true, 1}, {request(2), true, 2}, {response(1), false, 1}, {response(2), false, 2}} {
+		select {
+		case m := <-mssg:
+			if !bytes.Equal(m.Data(), e.data) || m.IsIncoming != e.incoming {
+				t.Errorf("expected %q(incoming %v), got %q(incoming %v)", e.data, e.incoming, m.Data(), m.IsIncoming)
+			}
+			if uuid, ok := uuids[e.id]; !ok {
+				uuids[e.id] = m.UUID()
+			} else if !bytes.Equal(m.UUID(), uuid) {
+				t.Errorf("expected the request %d and its response to have the same UUID", e.id)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected the message %q", e.data)
+		}
+	}
+	if bytes.Equal(uuids[1], uuids[2]) {
+		t.Error("expected the requests of a connection to have different UUIDs")
+	}
+	pool.Close()
+}
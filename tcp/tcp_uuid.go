@@ -0,0 +1,79 @@
+package tcp
+
+import (
+	"fmt"
+	"time"
+)
+
+// UUIDMode tells the pool how the UUID of messages are computed
+type UUIDMode uint8
+
+// Available UUID modes
+const (
+	UUIDAddress    UUIDMode = iota // hash of the addresses, connections reusing the same ports have the same UUID
+	UUIDConnection                 // hash of the addresses, the time and the initial sequence number of the SYN of the connection
+)
+
+// Set is here so that UUIDMode can implement flag.Var
+func (mode *UUIDMode) Set(v string) error {
+	switch v {
+	case "", "address":
+		*mode = UUIDAddress
+	case "connection":
+		*mode = UUIDConnection
+	default:
+		return fmt.Errorf("invalid uuid mode %s", v)
+	}
+	return nil
+}
+
+func (mode *UUIDMode) String() string {
+	switch *mode {
+	case UUIDAddress:
+		return "address"
+	case UUIDConnection:
+		return "connection"
+	default:
+		return ""
+	}
+}
+
+// connExpire is how long a connection is remembered after its last message started
+const connExpire = 5 * time.Minute
+
+// connection is a tcp connection identified by the SYN of its client
+type connection struct {
+	isn    uint32    // initial sequence number of the client
+	syn    time.Time // timestamp of the SYN of the client
+	expire time.Time
+	key    string // when not empty, the UUID of the messages is the hash of the key alone, e.g. a SIP Call-ID
+}
+
+// track remembers the connection opened by the SYN packet, it must be called while holding the lock of the shard
+func (pool *MessagePool) track(s *shard, pckt *Packet) {
+	src, dst := pckt.Src(), pckt.Dst()
+	if _, ok := s.conns[dst+"="+src]; ok {
+		// simultaneous open, the connection is identified by the first SYN
+		return
+	}
+	key := src + "=" + dst
+	if c, ok := s.conns[key]; ok && c.isn == pckt.Seq {
+		return
+	}
+	s.conns[key] = &connection{isn: pckt.Seq, syn: pckt.Timestamp, expire: time.Now().Add(connExpire)}
+}
+
+// connection returns the connection of a new message, nil if its SYN wasn't captured.
+// it must be called while holding the lock of the shard.
+func (pool *MessagePool) connection(s *shard, m *Message) *connection {
+	key := m.SrcAddr + "=" + m.DstAddr
+	if !m.IsIncoming {
+		key = m.DstAddr + "=" + m.SrcAddr
+	}
+	c, ok := s.conns[key]
+	if !ok {
+		return nil
+	}
+	c.expire = time.Now().Add(connExpire)
+	return c
+}
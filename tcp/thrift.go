@@ -0,0 +1,30 @@
+package tcp
+
+import (
+	"github.com/buger/goreplay/proto"
+)
+
+// ThriftSplit is a HintSplit for Thrift, a message holds a message of the binary or the compact protocol, framed
+// or not
+func ThriftSplit(m *Message) int {
+	return proto.ThriftMessageLength(m.Data())
+}
+
+// ThriftStart returns the HintStart of Thrift connections, the packets to port are incoming. when port is 0,
+// the calls are incoming and the replies and exceptions are outgoing.
+func ThriftStart(port uint16) HintStart {
+	return func(pckt *Packet) (isIncoming, isOutgoing bool) {
+		if len(pckt.Payload) == 0 {
+			return
+		}
+		if port != 0 {
+			return uint16(pckt.DstPort) == port, uint16(pckt.SrcPort) == port
+		}
+		m, _, ok := proto.ParseThriftHeader(pckt.Payload)
+		if !ok {
+			return
+		}
+		call := m.Type == proto.ThriftCall || m.Type == proto.ThriftOneway
+		return call, !call
+	}
+}
@@ -0,0 +1,548 @@
+package tcp
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"sync"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+	"github.com/google/gopacket/layers"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// TLSSplit is a HintSplit for TLS, a message holds the complete records received
+func TLSSplit(m *Message) int {
+	return proto.TLSRecordsLength(m.Data())
+}
+
+// tlsExpire is how long the state of an idle TLS connection is kept
+const tlsExpire = 10 * time.Minute
+
+// tlsMaxHandshake is the maximum size of the handshake messages buffered, certificate chains included
+const tlsMaxHandshake = 1 << 18
+
+const tls13 = 0x0304
+
+// helloRetryRequest is the random of the ServerHello messages that are a HelloRetryRequest
+var helloRetryRequest = []byte{
+	0xcf, 0x21, 0xad, 0x74, 0xe5, 0x9a, 0x61, 0x11, 0xbe, 0x1d, 0x8c, 0x02, 0x1e, 0x65, 0xb8, 0x91,
+	0xc2, 0xa2, 0x11, 0x16, 0x7a, 0xbb, 0x8c, 0x5e, 0x07, 0x9e, 0x09, 0xe2, 0xc8, 0xa8, 0x33, 0x9c,
+}
+
+var errTLSRecord = errors.New("invalid tls record")
+
+// tlsSuite is a cipher suite the TLSDecryptor supports
+type tlsSuite struct {
+	keyLen int
+	ivLen  int // fixed part of the nonce of AEAD suites in TLS 1.2
+	macLen int // MAC of CBC suites, 0 for AEAD suites
+	hash   func() hash.Hash
+	aead   func(key []byte) (cipher.AEAD, error) // nil for CBC suites
+	rsa    bool                                  // RSA key exchange
+}
+
+func aesGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+var tlsSuites = map[uint16]tlsSuite{
+	// TLS 1.3
+	0x1301: {keyLen: 16, ivLen: 12, hash: sha256.New, aead: aesGCM},
+	0x1302: {keyLen: 32, ivLen: 12, hash: sha512.New384, aead: aesGCM},
+	0x1303: {keyLen: 32, ivLen: 12, hash: sha256.New, aead: chacha20poly1305.New},
+	// TLS 1.2 AES-GCM
+	0x009c: {keyLen: 16, ivLen: 4, hash: sha256.New, aead: aesGCM, rsa: true},
+	0x009d: {keyLen: 32, ivLen: 4, hash: sha512.New384, aead: aesGCM, rsa: true},
+	0x009e: {keyLen: 16, ivLen: 4, hash: sha256.New, aead: aesGCM},
+	0x009f: {keyLen: 32, ivLen: 4, hash: sha512.New384, aead: aesGCM},
+	0xc02b: {keyLen: 16, ivLen: 4, hash: sha256.New, aead: aesGCM},
+	0xc02c: {keyLen: 32, ivLen: 4, hash: sha512.New384, aead: aesGCM},
+	0xc02f: {keyLen: 16, ivLen: 4, hash: sha256.New, aead: aesGCM},
+	0xc030: {keyLen: 32, ivLen: 4, hash: sha512.New384, aead: aesGCM},
+	// TLS 1.2 ChaCha20-Poly1305
+	0xcca8: {keyLen: 32, ivLen: 12, hash: sha256.New, aead: chacha20poly1305.New},
+	0xcca9: {keyLen: 32, ivLen: 12, hash: sha256.New, aead: chacha20poly1305.New},
+	0xccaa: {keyLen: 32, ivLen: 12, hash: sha256.New, aead: chacha20poly1305.New},
+	// TLS 1.2 AES-CBC
+	0x002f: {keyLen: 16, macLen: sha1.Size, hash: sha256.New, rsa: true},
+	0x0035: {keyLen: 32, macLen: sha1.Size, hash: sha256.New, rsa: true},
+	0x003c: {keyLen: 16, macLen: sha256.Size, hash: sha256.New, rsa: true},
+	0x003d: {keyLen: 32, macLen: sha256.Size, hash: sha256.New, rsa: true},
+	0xc009: {keyLen: 16, macLen: sha1.Size, hash: sha256.New},
+	0xc00a: {keyLen: 32, macLen: sha1.Size, hash: sha256.New},
+	0xc013: {keyLen: 16, macLen: sha1.Size, hash: sha256.New},
+	0xc014: {keyLen: 32, macLen: sha1.Size, hash: sha256.New},
+	0xc023: {keyLen: 16, macLen: sha256.Size, hash: sha256.New},
+	0xc027: {keyLen: 16, macLen: sha256.Size, hash: sha256.New},
+}
+
+// TLSDecryptor decrypts TLS 1.2 and 1.3 connections. its Handler is the handler of a pool splitting messages
+// with TLSSplit, and whose Start is TLSDecryptor.Start. the decrypted data are passed to another pool as the
+// segments of a plaintext connection, to be reassembled into the messages of the application protocol.
+// the secrets are read from KeyLog, or for TLS 1.2 connections using the RSA key exchange, the pre-master
+// secret is decrypted with RSAKeys. AES-GCM, ChaCha20-Poly1305 and AES-CBC suites are supported, the MAC of
+// CBC records is not verified. the ClientHello of connections must be captured.
+type TLSDecryptor struct {
+	sync.Mutex
+	pool      *MessagePool
+	debug     Debugger
+	conns     map[string]*tlsConn // by client=server
+	lastPurge time.Time
+	KeyLog    *KeyLog
+	RSAKeys   []*rsa.PrivateKey
+}
+
+type tlsConn struct {
+	clientRandom []byte
+	serverRandom []byte
+	version      uint16
+	suiteID      uint16
+	suite        tlsSuite
+	known        bool   // the suite is supported
+	etm          bool   // encrypt_then_mac was negotiated
+	ems          bool   // extended_master_secret was negotiated
+	transcript   []byte // handshake messages hashed by the extended master secret
+	sessionHash  []byte
+	premaster    []byte // encrypted pre-master secret of the RSA key exchange
+	master       []byte
+	seen         time.Time
+	dirs         [2]tlsDirection // from the client, from the server
+}
+
+// tlsDirection is the state of the records sent by a peer
+type tlsDirection struct {
+	handshake []byte // handshake message split in records
+	encrypted bool
+	label     string // key log label of the TLS 1.3 traffic secret
+	secret    []byte // TLS 1.3 traffic secret
+	aead      cipher.AEAD
+	block     cipher.Block
+	iv        []byte
+	seq       uint64 // of the encrypted records
+	next      uint32 // sequence number of the plaintext segments
+	failed    bool   // the records can't be decrypted, it was logged
+}
+
+// NewTLSDecryptor returns a new TLS decryptor passing the decrypted data to pool
+func NewTLSDecryptor(pool *MessagePool, debugger Debugger) *TLSDecryptor {
+	d := new(TLSDecryptor)
+	d.pool = pool
+	d.debug = debugger
+	d.conns = make(map[string]*tlsConn)
+	d.lastPurge = time.Now()
+	return d
+}
+
+// Start is the HintStart of TLS connections, the ClientHello starts the messages of clients, and the ServerHello
+// the messages of servers. the direction of connections already seen is kept.
+func (d *TLSDecryptor) Start(pckt *Packet) (isIncoming, isOutgoing bool) {
+	if p := pckt.Payload; len(p) > proto.TLSRecordHeaderLen && p[0] == proto.TLSHandshake && p[1] == 3 {
+		switch p[proto.TLSRecordHeaderLen] {
+		case proto.TLSClientHello:
+			return true, false
+		case proto.TLSServerHello:
+			return false, true
+		}
+	}
+	src, dst := pckt.Src(), pckt.Dst()
+	d.Lock()
+	_, client := d.conns[src+"="+dst]
+	_, server := d.conns[dst+"="+src]
+	d.Unlock()
+	return client, server
+}
+
+// Handler handles the records of a direction of a connection
+func (d *TLSDecryptor) Handler(m *Message) {
+	defer m.Release()
+	data := m.Data()
+	client, server := m.SrcAddr, m.DstAddr
+	if !m.IsIncoming {
+		client, server = server, client
+	}
+	key := client + "=" + server
+	now := time.Now()
+	d.Lock()
+	defer d.Unlock()
+	if now.Sub(d.lastPurge) > tlsExpire/10 {
+		d.purge(now)
+	}
+	c, ok := d.conns[key]
+	r, _ := proto.ParseTLSRecord(data)
+	hello := m.IsIncoming && r.Type == proto.TLSHandshake && len(r.Fragment) > 0 && r.Fragment[0] == proto.TLSClientHello
+	switch {
+	case hello && (!ok || c.dirs[0].encrypted || c.dirs[1].encrypted):
+		// a new connection, the plaintext pool sees its handshake
+		c = new(tlsConn)
+		c.dirs[0].next, c.dirs[1].next = 1, 1
+		d.conns[key] = c
+		d.pool.handle(&Packet{Version: m.IPversion, TCP: &layers.TCP{SYN: true}, Timestamp: m.Start, src: client, dst: server})
+		d.pool.handle(&Packet{Version: m.IPversion, TCP: &layers.TCP{SYN: true, ACK: true}, Timestamp: m.Start, src: server, dst: client})
+	case !ok:
+		return
+	}
+	c.seen = now
+	if m.Truncated {
+		// the records that follow can't be found
+		delete(d.conns, key)
+		go d.say(5, fmt.Sprintf("truncated tls records from %s to %s, connection state dropped\n", m.SrcAddr, m.DstAddr))
+		return
+	}
+	i := 0
+	if !m.IsIncoming {
+		i = 1
+	}
+	for len(data) > 0 {
+		r, n := proto.ParseTLSRecord(data)
+		if n == 0 {
+			break
+		}
+		d.record(c, i, m, data[:proto.TLSRecordHeaderLen], r)
+		data = data[n:]
+	}
+}
+
+// record handles a record sent in the direction i of the connection, it must be called while holding the lock
+func (d *TLSDecryptor) record(c *tlsConn, i int, m *Message, header []byte, r proto.TLSRecord) {
+	dir := &c.dirs[i]
+	if r.Type == proto.TLSChangeCipherSpec {
+		// TLS 1.3 sends it for middlebox compatibility only
+		if c.version != tls13 {
+			dir.encrypted = true
+			dir.seq = 0
+		}
+		return
+	}
+	if !dir.encrypted {
+		if r.Type == proto.TLSHandshake {
+			d.handshake(c, i, r.Fragment)
+		}
+		// early data can't be decrypted
+		return
+	}
+	typ, data, err := d.decrypt(c, i, header, r)
+	if err != nil {
+		if !dir.failed {
+			dir.failed = true
+			go d.say(4, fmt.Sprintf("error decrypting tls records from %s to %s: %s\n", m.SrcAddr, m.DstAddr, err))
+		}
+		return
+	}
+	switch typ {
+	case proto.TLSHandshake:
+		d.handshake(c, i, data)
+	case proto.TLSApplicationData:
+		if len(data) == 0 {
+			return
+		}
+		src, dst := m.SrcAddr, m.DstAddr
+		d.pool.handle(&Packet{Version: m.IPversion, TCP: &layers.TCP{BaseLayer: layers.BaseLayer{Payload: data}, Seq: dir.next, ACK: true}, Timestamp: m.Start, src: src, dst: dst})
+		dir.next += uint32(len(data))
+	}
+}
+
+// handshake handles the handshake messages sent in the direction i of the connection
+func (d *TLSDecryptor) handshake(c *tlsConn, i int, data []byte) {
+	dir := &c.dirs[i]
+	dir.handshake = append(dir.handshake, data...)
+	for len(dir.handshake) >= 4 {
+		length := int(dir.handshake[1])<<16 | int(dir.handshake[2])<<8 | int(dir.handshake[3])
+		if len(dir.handshake) < 4+length {
+			if length > tlsMaxHandshake {
+				dir.handshake = nil
+			}
+			return
+		}
+		msg := dir.handshake[:4+length]
+		dir.handshake = dir.handshake[4+length:]
+		if len(d.RSAKeys) > 0 && c.sessionHash == nil && c.version != tls13 {
+			c.transcript = append(c.transcript, msg...)
+		}
+		d.message(c, i, msg[0], msg[4:])
+	}
+	dir.handshake = nil
+}
+
+// message handles a handshake message sent in the direction i of the connection
+func (d *TLSDecryptor) message(c *tlsConn, i int, typ uint8, body []byte) {
+	dir := &c.dirs[i]
+	switch typ {
+	case proto.TLSClientHello:
+		if len(body) >= 34 {
+			c.clientRandom = append([]byte(nil), body[2:34]...)
+		}
+	case proto.TLSServerHello:
+		d.serverHello(c, body)
+	case proto.TLSClientKeyExchange:
+		if c.known && c.suite.rsa && len(body) > 2 {
+			c.premaster = append([]byte(nil), body[2:]...)
+			h := c.suite.hash()
+			h.Write(c.transcript)
+			c.sessionHash = h.Sum(nil)
+			c.transcript = nil
+		}
+	case proto.TLSFinished:
+		if c.version == tls13 {
+			dir.label = "CLIENT_TRAFFIC_SECRET_0"
+			if i == 1 {
+				dir.label = "SERVER_TRAFFIC_SECRET_0"
+			}
+			dir.secret, dir.aead, dir.seq = nil, nil, 0
+		}
+	case proto.TLSKeyUpdate:
+		if c.version == tls13 && dir.secret != nil {
+			dir.secret = expandLabel(c.suite.hash, dir.secret, "traffic upd", c.suite.hash().Size())
+			dir.aead, dir.seq = nil, 0
+		}
+	}
+}
+
+// serverHello reads the random, the version and the cipher suite of the connection
+func (d *TLSDecryptor) serverHello(c *tlsConn, body []byte) {
+	if len(body) < 35 || bytes.Equal(body[2:34], helloRetryRequest) {
+		return
+	}
+	c.version = binary.BigEndian.Uint16(body)
+	c.serverRandom = append([]byte(nil), body[2:34]...)
+	p := body[34:]
+	if len(p) < 1+int(p[0])+3 {
+		return
+	}
+	p = p[1+int(p[0]):]
+	c.suiteID = binary.BigEndian.Uint16(p)
+	c.suite, c.known = tlsSuites[c.suiteID]
+	p = p[3:]
+	if len(p) >= 2 {
+		exts := p[2:]
+		if n := int(binary.BigEndian.Uint16(p)); n < len(exts) {
+			exts = exts[:n]
+		}
+		for len(exts) >= 4 {
+			n := int(binary.BigEndian.Uint16(exts[2:]))
+			if len(exts) < 4+n {
+				break
+			}
+			switch binary.BigEndian.Uint16(exts) {
+			case 43: // supported_versions
+				if n >= 2 {
+					c.version = binary.BigEndian.Uint16(exts[4:])
+				}
+			case 22:
+				c.etm = true
+			case 23:
+				c.ems = true
+			}
+			exts = exts[4+n:]
+		}
+	}
+	if c.version == tls13 {
+		c.dirs[0].encrypted, c.dirs[0].label = true, "CLIENT_HANDSHAKE_TRAFFIC_SECRET"
+		c.dirs[1].encrypted, c.dirs[1].label = true, "SERVER_HANDSHAKE_TRAFFIC_SECRET"
+	}
+}
+
+// decrypt returns the content type and the plaintext of an encrypted record sent in the direction i
+func (d *TLSDecryptor) decrypt(c *tlsConn, i int, header []byte, r proto.TLSRecord) (typ uint8, data []byte, err error) {
+	dir := &c.dirs[i]
+	seq := dir.seq
+	dir.seq++
+	if dir.aead == nil && dir.block == nil {
+		if err = d.keys(c, i); err != nil {
+			return
+		}
+	}
+	p := r.Fragment
+	if c.version == tls13 {
+		if data, err = dir.aead.Open(nil, tlsNonce(dir.iv, seq), p, header); err != nil {
+			return
+		}
+		// the content type precedes the padding
+		j := len(data) - 1
+		for j >= 0 && data[j] == 0 {
+			j--
+		}
+		if j < 0 {
+			return 0, nil, errTLSRecord
+		}
+		return data[j], data[:j], nil
+	}
+	aad := make([]byte, 13)
+	binary.BigEndian.PutUint64(aad, seq)
+	aad[8] = r.Type
+	binary.BigEndian.PutUint16(aad[9:], r.Version)
+	if dir.aead != nil {
+		nonce := tlsNonce(dir.iv, seq)
+		if len(dir.iv) < 12 {
+			// the explicit part of the nonce starts the record
+			if len(p) < 8 {
+				return 0, nil, errTLSRecord
+			}
+			nonce = append(append([]byte(nil), dir.iv...), p[:8]...)
+			p = p[8:]
+		}
+		if len(p) < dir.aead.Overhead() {
+			return 0, nil, errTLSRecord
+		}
+		binary.BigEndian.PutUint16(aad[11:], uint16(len(p)-dir.aead.Overhead()))
+		data, err = dir.aead.Open(nil, nonce, p, aad)
+		return r.Type, data, err
+	}
+	size := dir.block.BlockSize()
+	if c.etm {
+		if len(p) < c.suite.macLen {
+			return 0, nil, errTLSRecord
+		}
+		p = p[:len(p)-c.suite.macLen]
+	}
+	if len(p) < 2*size || len(p)%size != 0 {
+		return 0, nil, errTLSRecord
+	}
+	data = make([]byte, len(p)-size)
+	cipher.NewCBCDecrypter(dir.block, p[:size]).CryptBlocks(data, p[size:])
+	pad := int(data[len(data)-1]) + 1
+	if !c.etm {
+		pad += c.suite.macLen
+	}
+	if pad > len(data) {
+		return 0, nil, errTLSRecord
+	}
+	return r.Type, data[:len(data)-pad], nil
+}
+
+// keys derives the keys of the direction i of the connection
+func (d *TLSDecryptor) keys(c *tlsConn, i int) (err error) {
+	if !c.known {
+		return fmt.Errorf("unsupported cipher suite %#04x", c.suiteID)
+	}
+	dir := &c.dirs[i]
+	s := c.suite
+	if c.version == tls13 {
+		if dir.secret == nil && d.KeyLog != nil {
+			dir.secret = d.KeyLog.Secret(dir.label, c.clientRandom)
+		}
+		if dir.secret == nil {
+			return fmt.Errorf("no %s logged", dir.label)
+		}
+		dir.iv = expandLabel(s.hash, dir.secret, "iv", 12)
+		dir.aead, err = s.aead(expandLabel(s.hash, dir.secret, "key", s.keyLen))
+		return
+	}
+	if c.master == nil {
+		if c.master = d.master(c); c.master == nil {
+			return errors.New("no master secret logged or decrypted")
+		}
+	}
+	seed := append(append([]byte(nil), c.serverRandom...), c.clientRandom...)
+	block := prf12(s.hash, c.master, "key expansion", seed, 2*(s.macLen+s.keyLen+s.ivLen))
+	keys := block[2*s.macLen:]
+	key := keys[i*s.keyLen : (i+1)*s.keyLen]
+	if s.aead == nil {
+		dir.block, err = aes.NewCipher(key)
+		return
+	}
+	ivs := keys[2*s.keyLen:]
+	dir.iv = ivs[i*s.ivLen : (i+1)*s.ivLen]
+	dir.aead, err = s.aead(key)
+	return
+}
+
+// master returns the master secret of a TLS 1.2 connection, or nil if it is not known
+func (d *TLSDecryptor) master(c *tlsConn) []byte {
+	if d.KeyLog != nil {
+		if master := d.KeyLog.Secret("CLIENT_RANDOM", c.clientRandom); master != nil {
+			return master
+		}
+	}
+	if !c.suite.rsa || c.premaster == nil {
+		return nil
+	}
+	for _, key := range d.RSAKeys {
+		premaster, err := rsa.DecryptPKCS1v15(nil, key, c.premaster)
+		if err != nil || len(premaster) != 48 {
+			continue
+		}
+		if c.ems {
+			return prf12(c.suite.hash, premaster, "extended master secret", c.sessionHash, 48)
+		}
+		seed := append(append([]byte(nil), c.clientRandom...), c.serverRandom...)
+		return prf12(c.suite.hash, premaster, "master secret", seed, 48)
+	}
+	return nil
+}
+
+// purge forgets the connections idle for longer than tlsExpire
+func (d *TLSDecryptor) purge(now time.Time) {
+	d.lastPurge = now
+	for key, c := range d.conns {
+		if now.Sub(c.seen) > tlsExpire {
+			delete(d.conns, key)
+		}
+	}
+}
+
+func (d *TLSDecryptor) say(level int, args ...interface{}) {
+	if d.debug != nil {
+		d.debug(level, args...)
+	}
+}
+
+// prf12 is the pseudorandom function of TLS 1.2(https://tools.ietf.org/html/rfc5246#section-5)
+func prf12(h func() hash.Hash, secret []byte, label string, seed []byte, n int) []byte {
+	seed = append([]byte(label), seed...)
+	mac := hmac.New(h, secret)
+	out := make([]byte, 0, n+mac.Size())
+	a := seed
+	for len(out) < n {
+		mac.Reset()
+		mac.Write(a)
+		a = mac.Sum(nil)
+		mac.Reset()
+		mac.Write(a)
+		mac.Write(seed)
+		out = mac.Sum(out)
+	}
+	return out[:n]
+}
+
+// expandLabel is HKDF-Expand-Label of TLS 1.3 with an empty context(https://tools.ietf.org/html/rfc8446#section-7.1)
+func expandLabel(h func() hash.Hash, secret []byte, label string, n int) []byte {
+	info := []byte{byte(n >> 8), byte(n), byte(len("tls13 ") + len(label))}
+	info = append(append(info, "tls13 "...), label...)
+	info = append(info, 0)
+	mac := hmac.New(h, secret)
+	out := make([]byte, 0, n+mac.Size())
+	var t []byte
+	for i := byte(1); len(out) < n; i++ {
+		mac.Reset()
+		mac.Write(t)
+		mac.Write(info)
+		mac.Write([]byte{i})
+		t = mac.Sum(nil)
+		out = append(out, t...)
+	}
+	return out[:n]
+}
+
+// tlsNonce returns the nonce of the record seq, the iv xored with the sequence number
+func tlsNonce(iv []byte, seq uint64) []byte {
+	nonce := append([]byte(nil), iv...)
+	for i := 0; i < 8 && i < len(nonce); i++ {
+		nonce[len(nonce)-1-i] ^= byte(seq >> (8 * i))
+	}
+	return nonce
+}
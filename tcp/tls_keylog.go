@@ -0,0 +1,138 @@
+package tcp
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// keyLogExpire is how long the secrets read from a key log are kept
+const keyLogExpire = time.Hour
+
+// KeyLog holds the secrets of an NSS key log file, written by applications when SSLKEYLOGFILE is set.
+// the lines appended to the file are read when a secret is missing.
+type KeyLog struct {
+	sync.Mutex
+	path    string
+	offset  int64
+	partial []byte                  // last line of the file, not terminated yet
+	secrets map[string]keyLogSecret // by label and client random, e.g: CLIENT_RANDOM 3f5a...
+}
+
+type keyLogSecret struct {
+	secret []byte
+	read   time.Time
+}
+
+// NewKeyLog reads the key log file at path
+func NewKeyLog(path string) (*KeyLog, error) {
+	k := &KeyLog{path: path, secrets: make(map[string]keyLogSecret)}
+	k.Lock()
+	defer k.Unlock()
+	return k, k.read()
+}
+
+// Secret returns the secret logged with label, e.g: CLIENT_RANDOM or SERVER_TRAFFIC_SECRET_0, for the connection
+// whose ClientHello has the random clientRandom. it returns nil if the secret is not logged.
+func (k *KeyLog) Secret(label string, clientRandom []byte) []byte {
+	key := label + " " + hex.EncodeToString(clientRandom)
+	k.Lock()
+	defer k.Unlock()
+	if s, ok := k.secrets[key]; ok {
+		return s.secret
+	}
+	if err := k.read(); err != nil {
+		return nil
+	}
+	return k.secrets[key].secret
+}
+
+// read reads the lines appended to the file since the last read, it must be called while holding the lock
+func (k *KeyLog) read() error {
+	f, err := os.Open(k.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() < k.offset {
+		// the file was truncated
+		k.offset = 0
+		k.partial = nil
+	}
+	if _, err = f.Seek(k.offset, io.SeekStart); err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	k.offset += int64(len(data))
+	data = append(k.partial, data...)
+	end := bytes.LastIndexByte(data, '\n') + 1
+	k.partial = append([]byte(nil), data[end:]...)
+	now := time.Now()
+	for key, s := range k.secrets {
+		if now.Sub(s.read) > keyLogExpire {
+			delete(k.secrets, key)
+		}
+	}
+	for _, line := range strings.Split(string(data[:end]), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		secret, err := hex.DecodeString(fields[2])
+		if err != nil {
+			continue
+		}
+		k.secrets[fields[0]+" "+strings.ToLower(fields[1])] = keyLogSecret{secret, now}
+	}
+	return nil
+}
+
+// LoadRSAKeys returns the RSA private keys of the PEM file at path, PKCS #1 and PKCS #8 keys are loaded
+func LoadRSAKeys(path string) (keys []*rsa.PrivateKey, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var block *pem.Block
+		if block, data = pem.Decode(data); block == nil {
+			break
+		}
+		switch block.Type {
+		case "RSA PRIVATE KEY":
+			key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, key)
+		case "PRIVATE KEY":
+			key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			if key, ok := key.(*rsa.PrivateKey); ok {
+				keys = append(keys, key)
+			}
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no RSA private key in %s", path)
+	}
+	return keys, nil
+}
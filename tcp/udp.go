@@ -0,0 +1,182 @@
+package tcp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/buger/goreplay/size"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// ParseUDP parses a UDP datagram, the ports of its header are held by the TCP field of pckt,
+// whose payload is the payload of the datagram.
+func ParseUDP(packet gopacket.Packet) (pckt *Packet, err error) {
+	var next layers.IPProtocol
+	var payload []byte
+	if pckt, next, payload = parseNetwork(packet); pckt == nil || next != layers.IPProtocolUDP {
+		return nil, nil
+	}
+	if len(payload) < 8 {
+		return nil, fmt.Errorf("truncated udp header of %d bytes", len(payload))
+	}
+	pckt.TCP = &layers.TCP{
+		SrcPort: layers.TCPPort(binary.BigEndian.Uint16(payload)),
+		DstPort: layers.TCPPort(binary.BigEndian.Uint16(payload[2:])),
+	}
+	pckt.Payload = payload[8:]
+	if length := int(binary.BigEndian.Uint16(payload[4:])); length >= 8 && length <= len(payload) {
+		// the IP payload may be padded
+		pckt.Payload = payload[8:length]
+	} else if length > len(payload) {
+		pckt.Lost = uint16(length - len(payload))
+	}
+	return
+}
+
+// UDPPool turns UDP datagrams into messages. each datagram is a message, unless the pool has a window, the
+// datagrams sent from an address to another within the window of the first one are then aggregated in a message,
+// of at most maxSize bytes. the direction of a message is given by Port, else by the linux cooked header, messages
+// are incoming otherwise.
+type UDPPool struct {
+	sync.Mutex
+	debug        Debugger
+	handler      Handler
+	maxSize      size.Size
+	window       time.Duration
+	messages     map[string]*Message // by src=dst
+	quit         chan bool
+	closeOnce    sync.Once
+	closed       bool
+	Defragmenter *Defragmenter // reassembles fragmented IP packets before parsing them, can be set to nil
+	Port         uint16        // when not 0, only the datagrams from or to this port are handled, the datagrams to it are incoming
+}
+
+// NewUDPPool returns a new UDP message pool, the size of messages is limited to maxSize, default 5mb.
+// window is the time the datagrams of a message are aggregated for, zero emits a message per datagram.
+func NewUDPPool(maxSize size.Size, window time.Duration, debugger Debugger, handler Handler) (pool *UDPPool) {
+	pool = new(UDPPool)
+	pool.debug = debugger
+	pool.handler = handler
+	pool.maxSize = maxSize
+	if pool.maxSize < 1 {
+		pool.maxSize = 5 << 20
+	}
+	pool.window = window
+	pool.messages = make(map[string]*Message)
+	pool.Defragmenter = NewDefragmenter(0, 0)
+	pool.quit = make(chan bool)
+	if pool.window > 0 {
+		go pool.sweep()
+	}
+	return pool
+}
+
+// Handler handles the UDP packets of the capture
+func (pool *UDPPool) Handler(packet gopacket.Packet) {
+	if pool.Defragmenter != nil {
+		var err error
+		if packet, err = pool.Defragmenter.Defrag(packet); packet == nil {
+			if err != nil {
+				go pool.say(5, fmt.Sprintf("error defragmenting packet: %s\n", err))
+			}
+			return
+		}
+	}
+	pckt, err := ParseUDP(packet)
+	if err != nil || pckt == nil {
+		if err != nil {
+			go pool.say(4, fmt.Sprintf("error decoding udp packet(%dBytes):%s\n", packet.Metadata().CaptureLength, err))
+		}
+		return
+	}
+	if pool.Port != 0 && uint16(pckt.SrcPort) != pool.Port && uint16(pckt.DstPort) != pool.Port {
+		return
+	}
+	pool.Lock()
+	defer pool.Unlock()
+	if pool.closed {
+		return
+	}
+	key := pckt.Src() + "=" + pckt.Dst()
+	m, ok := pool.messages[key]
+	if ok && (pckt.Timestamp.Sub(m.Start) > pool.window || m.Length+len(pckt.Payload) > int(pool.maxSize)) {
+		pool.dispatch(key, m)
+		ok = false
+	}
+	if !ok {
+		m = NewMessage(pckt.Src(), pckt.Dst(), pckt.Version)
+		m.IsIncoming = true
+		if pool.Port != 0 {
+			m.IsIncoming = uint16(pckt.DstPort) == pool.Port
+		} else if in, known := pckt.Incoming(); known {
+			m.IsIncoming = in
+		}
+		m.Start = pckt.Timestamp
+		m.created = time.Now()
+		m.expire = m.created.Add(pool.window)
+	}
+	if m.Length+len(pckt.Payload) > int(pool.maxSize) {
+		pckt.Payload = pckt.Payload[:int(pool.maxSize)-m.Length]
+		m.Truncated = true
+	}
+	m.add(len(m.packets), pckt)
+	m.seen = time.Now()
+	if pool.window <= 0 || m.Truncated {
+		pool.handler(m)
+		return
+	}
+	pool.messages[key] = m
+}
+
+// dispatch removes the message from the pool and passes it to the handler,
+// it must be called while holding the lock of the pool.
+func (pool *UDPPool) dispatch(key string, m *Message) {
+	delete(pool.messages, key)
+	pool.handler(m)
+}
+
+// sweep dispatches the messages whose window is over
+func (pool *UDPPool) sweep() {
+	interval := pool.window / 10
+	if interval < time.Millisecond*10 {
+		interval = time.Millisecond * 10
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-pool.quit:
+			return
+		case now := <-ticker.C:
+			pool.Lock()
+			for key, m := range pool.messages {
+				if now.After(m.expire) {
+					pool.dispatch(key, m)
+				}
+			}
+			pool.Unlock()
+		}
+	}
+}
+
+// Close stops the pool and dispatches the messages in progress
+func (pool *UDPPool) Close() {
+	pool.closeOnce.Do(func() {
+		close(pool.quit)
+		pool.Lock()
+		pool.closed = true
+		for key, m := range pool.messages {
+			pool.dispatch(key, m)
+		}
+		pool.Unlock()
+	})
+}
+
+func (pool *UDPPool) say(level int, args ...interface{}) {
+	if pool.debug != nil {
+		pool.debug(level, args...)
+	}
+}
@@ -0,0 +1,211 @@
+package tcp
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+	"github.com/buger/goreplay/size"
+	"github.com/google/gopacket/layers"
+)
+
+// webSocketExpire is how long the state of an idle WebSocket session is kept
+const webSocketExpire = 10 * time.Minute
+
+// WebSocketDemuxer follows the HTTP/1.x connections upgraded to WebSocket. its Handler is the handler of a pool
+// whose Start, End and Split are the ones of the demuxer: HTTP messages are split as usual and passed through, once
+// a connection is upgraded by a 101 response its frames are reassembled instead. each WebSocket message, and each
+// control frame, is passed to the handler unmasked as a single frame(see proto.ParseWebSocketFrame), timed with the
+// segments of its first frame. the frames have the UUID of the upgrade request of their session.
+type WebSocketDemuxer struct {
+	sync.Mutex
+	handler   Handler
+	debug     Debugger
+	maxSize   size.Size
+	sessions  map[string]*webSocketSession // by client=server
+	lastPurge time.Time
+}
+
+type webSocketSession struct {
+	conn     *connection // of the upgrade request
+	upgraded bool        // the server accepted the upgrade
+	seen     time.Time
+	dirs     [2]webSocketDirection // from the client, from the server
+}
+
+// webSocketDirection is the state of the frames sent by a peer
+type webSocketDirection struct {
+	opcode    uint8 // of the fragmented message in progress, 0 if there is none
+	rsv       uint8
+	data      []byte
+	start     time.Time
+	truncated bool
+	closed    bool // a Close frame was sent
+}
+
+// NewWebSocketDemuxer returns a new WebSocket demultiplexer, the messages are truncated past maxSize, default 5mb
+func NewWebSocketDemuxer(maxSize size.Size, debugger Debugger, handler Handler) *WebSocketDemuxer {
+	d := new(WebSocketDemuxer)
+	d.handler = handler
+	d.debug = debugger
+	d.maxSize = maxSize
+	if d.maxSize < 1 {
+		d.maxSize = 5 << 20
+	}
+	d.sessions = make(map[string]*webSocketSession)
+	d.lastPurge = time.Now()
+	return d
+}
+
+// upgraded returns the direction of the frames between src and dst, ok is false if their connection is not upgraded
+func (d *WebSocketDemuxer) upgraded(src, dst string) (isIncoming, ok bool) {
+	d.Lock()
+	defer d.Unlock()
+	if s, found := d.sessions[src+"="+dst]; found && s.upgraded {
+		return true, true
+	}
+	if s, found := d.sessions[dst+"="+src]; found && s.upgraded {
+		return false, true
+	}
+	return false, false
+}
+
+// Start is a HintStart, frames start the messages of upgraded connections, and HTTPStart the others
+func (d *WebSocketDemuxer) Start(pckt *Packet) (isIncoming, isOutgoing bool) {
+	if in, ok := d.upgraded(pckt.Src(), pckt.Dst()); ok {
+		return in && len(pckt.Payload) > 0, !in && len(pckt.Payload) > 0
+	}
+	return HTTPStart(pckt)
+}
+
+// End is a HintEnd, the frames of upgraded connections are only split
+func (d *WebSocketDemuxer) End(m *Message) bool {
+	if _, ok := d.upgraded(m.SrcAddr, m.DstAddr); ok {
+		return false
+	}
+	return HTTPEnd(m)
+}
+
+// Split is a HintSplit, a message of an upgraded connection holds the complete frames received
+func (d *WebSocketDemuxer) Split(m *Message) int {
+	if _, ok := d.upgraded(m.SrcAddr, m.DstAddr); ok {
+		return proto.WebSocketFramesLength(m.Data())
+	}
+	return HTTPSplit(m)
+}
+
+// Handler handles the messages of the pool, the HTTP messages are passed through
+func (d *WebSocketDemuxer) Handler(m *Message) {
+	client, server := m.SrcAddr, m.DstAddr
+	if !m.IsIncoming {
+		client, server = server, client
+	}
+	key := client + "=" + server
+	now := time.Now()
+	d.Lock()
+	if now.Sub(d.lastPurge) > webSocketExpire/10 {
+		d.purge(now)
+	}
+	s, ok := d.sessions[key]
+	if !ok || !s.upgraded {
+		data := m.Data()
+		switch {
+		case m.IsIncoming && proto.IsWebSocketUpgrade(data):
+			d.sessions[key] = &webSocketSession{conn: m.conn, seen: now}
+		case ok && !m.IsIncoming && proto.HasResponseTitle(data):
+			if bytes.Equal(proto.Status(data), []byte("101")) {
+				s.upgraded = true
+				s.seen = now
+			} else {
+				delete(d.sessions, key)
+			}
+		}
+		d.Unlock()
+		d.handler(m)
+		return
+	}
+	defer d.Unlock()
+	defer m.Release()
+	s.seen = now
+	if m.Truncated {
+		// the frames that follow can't be found
+		delete(d.sessions, key)
+		go d.say(5, fmt.Sprintf("truncated websocket frames from %s to %s, session dropped\n", m.SrcAddr, m.DstAddr))
+		return
+	}
+	i := 0
+	if !m.IsIncoming {
+		i = 1
+	}
+	for data := m.Data(); len(data) > 0; {
+		f, n := proto.ParseWebSocketFrame(data)
+		if n == 0 {
+			break
+		}
+		data = data[n:]
+		d.frame(s, i, m, f)
+	}
+	if s.dirs[0].closed && s.dirs[1].closed {
+		delete(d.sessions, key)
+	}
+}
+
+// frame handles a frame sent in the direction i of the session, it must be called while holding the lock
+func (d *WebSocketDemuxer) frame(s *webSocketSession, i int, m *Message, f proto.WebSocketFrame) {
+	if f.IsControl() {
+		s.dirs[i].closed = s.dirs[i].closed || f.Opcode == proto.WebSocketClose
+		d.emit(s, m, f.Rsv, f.Opcode, f.Unmask(), m.Start, false)
+		return
+	}
+	dir := &s.dirs[i]
+	switch {
+	case f.Opcode != proto.WebSocketContinuation:
+		dir.opcode, dir.rsv, dir.start, dir.truncated = f.Opcode, f.Rsv, m.Start, false
+		dir.data = dir.data[:0]
+	case dir.opcode == 0:
+		// the start of the message was not captured
+		return
+	}
+	data := f.Unmask()
+	if n := int(d.maxSize) - len(dir.data); len(data) > n {
+		data = data[:n]
+		dir.truncated = true
+	}
+	dir.data = append(dir.data, data...)
+	if f.Fin {
+		d.emit(s, m, dir.rsv, dir.opcode, dir.data, dir.start, dir.truncated)
+		dir.opcode = 0
+		dir.data = nil
+	}
+}
+
+// emit passes a WebSocket message to the handler as a single unmasked frame
+func (d *WebSocketDemuxer) emit(s *webSocketSession, m *Message, rsv, opcode uint8, payload []byte, start time.Time, truncated bool) {
+	data := proto.AppendWebSocketFrame(nil, proto.WebSocketFrame{Fin: true, Rsv: rsv, Opcode: opcode, Payload: payload})
+	msg := NewMessage(m.SrcAddr, m.DstAddr, m.IPversion)
+	msg.IsIncoming = m.IsIncoming
+	msg.conn = s.conn
+	msg.add(0, &Packet{TCP: &layers.TCP{BaseLayer: layers.BaseLayer{Payload: data}}, Timestamp: m.End})
+	msg.Start = start
+	msg.Truncated = truncated
+	msg.TimedOut = m.TimedOut
+	d.handler(msg)
+}
+
+// purge forgets the sessions idle for longer than webSocketExpire
+func (d *WebSocketDemuxer) purge(now time.Time) {
+	d.lastPurge = now
+	for key, s := range d.sessions {
+		if now.Sub(s.seen) > webSocketExpire {
+			delete(d.sessions, key)
+		}
+	}
+}
+
+func (d *WebSocketDemuxer) say(level int, args ...interface{}) {
+	if d.debug != nil {
+		d.debug(level, args...)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"path"
+
+	"github.com/buger/goreplay/proto"
+)
+
+// ThriftModifierConfig is the configuration of the filters of Thrift calls
+type ThriftModifierConfig struct {
+	Methods         ThriftMethods `json:"thrift-allow-method"`
+	NegativeMethods ThriftMethods `json:"thrift-disallow-method"`
+}
+
+// ThriftMethods holds names of Thrift methods, or patterns matching them like UserService:get*
+type ThriftMethods []string
+
+func (t *ThriftMethods) String() string {
+	return fmt.Sprint(*t)
+}
+
+// Set is here so that ThriftMethods can implement flag.Var
+func (t *ThriftMethods) Set(value string) error {
+	if _, err := path.Match(value, ""); err != nil {
+		return fmt.Errorf("invalid thrift method pattern %q: %v", value, err)
+	}
+	*t = append(*t, value)
+	return nil
+}
+
+// Match reports whether the method matches one of the methods
+func (t ThriftMethods) Match(method string) bool {
+	for _, pattern := range t {
+		if ok, _ := path.Match(pattern, method); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ThriftModifier filters the calls recorded with --input-raw-protocol thrift by the name of their method, the
+// methods of multiplexed services are prefixed by the name of the service(Service:method). the payloads that are
+// not Thrift messages are returned as is.
+type ThriftModifier struct {
+	config *ThriftModifierConfig
+}
+
+// NewThriftModifier returns nil when nothing is filtered
+func NewThriftModifier(config *ThriftModifierConfig) *ThriftModifier {
+	if len(config.Methods) == 0 && len(config.NegativeMethods) == 0 {
+		return nil
+	}
+	return &ThriftModifier{config: config}
+}
+
+// Rewrite returns the call, or nothing if it is filtered out
+func (m *ThriftModifier) Rewrite(payload []byte) []byte {
+	if proto.ThriftMessageLength(payload) != len(payload) {
+		return payload
+	}
+	msg, _, _ := proto.ParseThriftHeader(payload)
+	if len(m.config.Methods) > 0 && !m.config.Methods.Match(msg.Name) {
+		return nil
+	}
+	if m.config.NegativeMethods.Match(msg.Name) {
+		return nil
+	}
+	return payload
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestThriftModifier(t *testing.T) {
+	if NewThriftModifier(&ThriftModifierConfig{}) != nil {
+		t.Error("expected no modifier without filters")
+	}
+	call := func(method string) []byte {
+		return append(append([]byte("\x80\x01\x00\x01\x00\x00\x00"), byte(len(method))), append([]byte(method), "\x00\x00\x00\x01\x00"...)...)
+	}
+	tests := []struct {
+		config func(*ThriftModifierConfig)
+		call   []byte
+		kept   bool
+	}{
+		{func(c *ThriftModifierConfig) { c.Methods.Set("get*") }, call("getUser"), true},
+		{func(c *ThriftModifierConfig) { c.Methods.Set("get*") }, call("deleteUser"), false},
+		{func(c *ThriftModifierConfig) { c.Methods.Set("UserService:*") }, call("UserService:getUser"), true},
+		{func(c *ThriftModifierConfig) { c.Methods.Set("UserService:*") }, call("OrderService:getOrder"), false},
+		{func(c *ThriftModifierConfig) { c.NegativeMethods.Set("delete*") }, call("deleteUser"), false},
+		{func(c *ThriftModifierConfig) { c.NegativeMethods.Set("delete*") }, call("getUser"), true},
+		// not thrift
+		{func(c *ThriftModifierConfig) { c.Methods.Set("get*") }, []byte("GET / HTTP/1.1\r\n\r\n"), true},
+	}
+	for i, tt := range tests {
+		config := new(ThriftModifierConfig)
+		tt.config(config)
+		got := NewThriftModifier(config).Rewrite(tt.call)
+		if kept := bytes.Equal(got, tt.call); kept != tt.kept || !kept && len(got) != 0 {
+			t.Errorf("%d: expected %q to be kept %v, got %q", i, tt.call, tt.kept, got)
+		}
+	}
+	var methods ThriftMethods
+	if methods.Set("[") == nil {
+		t.Error("expected an invalid pattern to be rejected")
+	}
+}
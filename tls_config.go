@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// newClientTLSConfig returns the TLS configuration of the connections of an output to its target: the client
+// certificate of certFile and keyFile, loaded again when the files are rotated, the CAs of caFile instead of the
+// ones of the system, and the server name of SNI and of the verification instead of the host of the target. the
+// certificate of the target is not verified with skipVerify. it returns nil without any of them
+func newClientTLSConfig(certFile, keyFile, caFile, serverName string, skipVerify bool) (*tls.Config, error) {
+	if certFile == "" && keyFile == "" && caFile == "" && serverName == "" && !skipVerify {
+		return nil, nil
+	}
+	config := &tls.Config{ServerName: serverName, InsecureSkipVerify: skipVerify}
+	if certFile != "" || keyFile != "" {
+		cert, err := newTLSCertificate(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return cert.get(), nil
+		}
+	}
+	if caFile != "" {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
+
+// newServerTLSConfig returns the TLS configuration of a listener with the certificate of certFile and keyFile,
+// loaded again when the files are rotated. with clientCAFile the clients must present a certificate of its CAs
+func newServerTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cert, err := newTLSCertificate(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return cert.get(), nil
+		},
+	}
+	if clientCAFile != "" {
+		if config.ClientCAs, err = loadCertPool(clientCAFile); err != nil {
+			return nil, err
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// loadCertPool returns the pool of the PEM certificates of the file
+func loadCertPool(name string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate in %q", name)
+	}
+	return pool, nil
+}
+
+// tlsCertificate is a certificate loaded again when its files are modified, the previous certificate is kept
+// while the new one can't be loaded, like when only one of the files is rotated yet
+type tlsCertificate struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time // the last modification of the files loaded
+}
+
+func newTLSCertificate(certFile, keyFile string) (*tlsCertificate, error) {
+	c := &tlsCertificate{certFile: certFile, keyFile: keyFile}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// get returns the certificate, loaded again if the files were modified since it was loaded
+func (c *tlsCertificate) get() *tls.Certificate {
+	c.mu.Lock()
+	modTime := c.modTime
+	c.mu.Unlock()
+	if t, err := c.lastModified(); err == nil && !t.Equal(modTime) {
+		if err := c.load(); err != nil {
+			log.Printf("[TLS] the certificate %s can't be reloaded: %v", c.certFile, err)
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cert
+}
+
+func (c *tlsCertificate) load() error {
+	modTime, err := c.lastModified()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// the files are not loaded again until they are modified
+	c.modTime = modTime
+	if err != nil {
+		return err
+	}
+	c.cert = &cert
+	Debug(1, fmt.Sprintf("[TLS] loaded the certificate %s", c.certFile))
+	return nil
+}
+
+// lastModified returns the last modification of the files
+func (c *tlsCertificate) lastModified() (time.Time, error) {
+	var modTime time.Time
+	for _, name := range []string{c.certFile, c.keyFile} {
+		stat, err := os.Stat(name)
+		if err != nil {
+			return modTime, err
+		}
+		if stat.ModTime().After(modTime) {
+			modTime = stat.ModTime()
+		}
+	}
+	return modTime, nil
+}